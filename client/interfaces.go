@@ -160,6 +160,8 @@ type InstanceServer interface {
 	GetInstanceFile(instanceName string, path string) (content io.ReadCloser, resp *InstanceFileResponse, err error)
 	CreateInstanceFile(instanceName string, path string, args InstanceFileArgs) (err error)
 	DeleteInstanceFile(instanceName string, path string) (err error)
+	GetInstanceFileTree(instanceName string, path string) (content io.ReadCloser, err error)
+	CreateInstanceFileTree(instanceName string, path string, args InstanceFileTreeArgs) (err error)
 
 	GetInstanceSnapshotNames(instanceName string) (names []string, err error)
 	GetInstanceSnapshots(instanceName string) (snapshots []api.InstanceSnapshot, err error)
@@ -183,6 +185,9 @@ type InstanceServer interface {
 	GetInstanceState(name string) (state *api.InstanceState, ETag string, err error)
 	UpdateInstanceState(name string, state api.InstanceStatePut, ETag string) (op Operation, err error)
 
+	GetInstanceQemuConfig(name string) (config *api.InstanceQemuConfig, err error)
+	GetInstanceMetrics(name string) (metrics *api.InstanceMetrics, err error)
+
 	GetInstanceLogfiles(name string) (logfiles []string, err error)
 	GetInstanceLogfile(name string, filename string) (content io.ReadCloser, err error)
 	DeleteInstanceLogfile(name string, filename string) (err error)
@@ -511,6 +516,18 @@ type InstanceFileArgs struct {
 	WriteMode string
 }
 
+// The InstanceFileTreeArgs struct is used to pass the various options for a instance file tree upload.
+type InstanceFileTreeArgs struct {
+	// Tar archive of the file tree
+	Content io.Reader
+
+	// User id that owns the entries (-1 to keep the ones in the archive)
+	UID int64
+
+	// Group id that owns the entries (-1 to keep the ones in the archive)
+	GID int64
+}
+
 // The InstanceFileResponse struct is used as part of the response for a instance file download.
 type InstanceFileResponse struct {
 	// User id that owns the file
@@ -1142,6 +1142,126 @@ func (r *ProtocolLXD) DeleteInstanceFile(instanceName string, filePath string) e
 	return nil
 }
 
+// instanceFileTreeURL returns the URL of the file tree at filePath in the instance.
+func (r *ProtocolLXD) instanceFileTreeURL(instanceName string, filePath string) (string, error) {
+	if r.IsAgent() {
+		return r.setQueryAttributes(fmt.Sprintf("%s/1.0/files/tree?path=%s", r.httpHost, url.QueryEscape(filePath)))
+	}
+
+	path, _, err := r.instanceTypeToPath(api.InstanceTypeAny)
+	if err != nil {
+		return "", err
+	}
+
+	return r.setQueryAttributes(fmt.Sprintf("%s/1.0%s/%s/files/tree?path=%s", r.httpHost, path, url.PathEscape(instanceName), url.QueryEscape(filePath)))
+}
+
+// GetInstanceFileTree retrieves the file tree at path from the instance as a tar archive.
+// This is only supported by virtual machines.
+func (r *ProtocolLXD) GetInstanceFileTree(instanceName string, filePath string) (io.ReadCloser, error) {
+	if !r.HasExtension("instance_file_tree") {
+		return nil, fmt.Errorf("The server is missing the required \"instance_file_tree\" API extension")
+	}
+
+	requestURL, err := r.instanceFileTreeURL(instanceName, filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("GET", requestURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Set the user agent
+	if r.httpUserAgent != "" {
+		req.Header.Set("User-Agent", r.httpUserAgent)
+	}
+
+	// Send the request
+	resp, err := r.do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check the return value for a cleaner error
+	if resp.StatusCode != http.StatusOK {
+		_, _, err := lxdParseResponse(resp)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &fileTreeReader{resp: resp}, nil
+}
+
+// fileTreeReader reads a file tree archive, reporting the error sent by the server in the
+// X-LXD-Error trailer once the end of the archive is reached.
+type fileTreeReader struct {
+	resp *http.Response
+}
+
+func (r *fileTreeReader) Read(p []byte) (int, error) {
+	n, err := r.resp.Body.Read(p)
+	if err == io.EOF && r.resp.Trailer.Get("X-LXD-Error") != "" {
+		return n, fmt.Errorf("Failed reading file tree: %s", r.resp.Trailer.Get("X-LXD-Error"))
+	}
+
+	return n, err
+}
+
+func (r *fileTreeReader) Close() error {
+	return r.resp.Body.Close()
+}
+
+// CreateInstanceFileTree extracts the tar archive read from args.Content below path in the instance.
+// This is only supported by virtual machines.
+func (r *ProtocolLXD) CreateInstanceFileTree(instanceName string, filePath string, args InstanceFileTreeArgs) error {
+	if !r.HasExtension("instance_file_tree") {
+		return fmt.Errorf("The server is missing the required \"instance_file_tree\" API extension")
+	}
+
+	requestURL, err := r.instanceFileTreeURL(instanceName, filePath)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", requestURL, args.Content)
+	if err != nil {
+		return err
+	}
+
+	// Set the user agent
+	if r.httpUserAgent != "" {
+		req.Header.Set("User-Agent", r.httpUserAgent)
+	}
+
+	req.Header.Set("Content-Type", "application/x-tar")
+
+	// Set the ownership of the entries
+	if args.UID > -1 {
+		req.Header.Set("X-LXD-uid", fmt.Sprintf("%d", args.UID))
+	}
+
+	if args.GID > -1 {
+		req.Header.Set("X-LXD-gid", fmt.Sprintf("%d", args.GID))
+	}
+
+	// Send the request
+	resp, err := r.do(req)
+	if err != nil {
+		return err
+	}
+
+	// Check the return value for a cleaner error
+	_, _, err = lxdParseResponse(resp)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
 // GetInstanceSnapshotNames returns a list of snapshot names for the instance.
 func (r *ProtocolLXD) GetInstanceSnapshotNames(instanceName string) ([]string, error) {
 	path, _, err := r.instanceTypeToPath(api.InstanceTypeAny)
@@ -1604,6 +1724,50 @@ func (r *ProtocolLXD) UpdateInstanceState(name string, state api.InstanceStatePu
 	return op, nil
 }
 
+// GetInstanceQemuConfig returns the qemu config file and arguments a virtual machine would be started with.
+func (r *ProtocolLXD) GetInstanceQemuConfig(name string) (*api.InstanceQemuConfig, error) {
+	if !r.HasExtension("instance_qemu_config") {
+		return nil, fmt.Errorf("The server is missing the required \"instance_qemu_config\" API extension")
+	}
+
+	path, _, err := r.instanceTypeToPath(api.InstanceTypeVM)
+	if err != nil {
+		return nil, err
+	}
+
+	config := api.InstanceQemuConfig{}
+
+	// Fetch the raw value
+	_, err = r.queryStruct("GET", fmt.Sprintf("%s/%s/qemu-config", path, url.PathEscape(name)), nil, "", &config)
+	if err != nil {
+		return nil, err
+	}
+
+	return &config, nil
+}
+
+// GetInstanceMetrics returns the resource usage of a virtual machine.
+func (r *ProtocolLXD) GetInstanceMetrics(name string) (*api.InstanceMetrics, error) {
+	if !r.HasExtension("instance_metrics") {
+		return nil, fmt.Errorf("The server is missing the required \"instance_metrics\" API extension")
+	}
+
+	path, _, err := r.instanceTypeToPath(api.InstanceTypeVM)
+	if err != nil {
+		return nil, err
+	}
+
+	metrics := api.InstanceMetrics{}
+
+	// Fetch the raw value
+	_, err = r.queryStruct("GET", fmt.Sprintf("%s/%s/metrics", path, url.PathEscape(name)), nil, "", &metrics)
+	if err != nil {
+		return nil, err
+	}
+
+	return &metrics, nil
+}
+
 // GetInstanceLogfiles returns a list of logfiles for the instance.
 func (r *ProtocolLXD) GetInstanceLogfiles(name string) ([]string, error) {
 	path, _, err := r.instanceTypeToPath(api.InstanceTypeAny)
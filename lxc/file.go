@@ -17,6 +17,7 @@ import (
 	"github.com/lxc/lxd/client"
 	"github.com/lxc/lxd/lxc/utils"
 	"github.com/lxc/lxd/shared"
+	"github.com/lxc/lxd/shared/api"
 	cli "github.com/lxc/lxd/shared/cmd"
 	"github.com/lxc/lxd/shared/i18n"
 	"github.com/lxc/lxd/shared/ioprogress"
@@ -291,7 +292,11 @@ func (c *cmdFilePull) Run(cmd *cobra.Command, args []string) error {
 					targetIsDir = true
 				}
 
-				err := c.file.recursivePullFile(resource.server, pathSpec[0], pathSpec[1], target)
+				if c.file.fileTreeSupported(resource.server, pathSpec[0]) {
+					err = c.file.pullFileTree(resource.server, pathSpec[0], pathSpec[1], target)
+				} else {
+					err = c.file.recursivePullFile(resource.server, pathSpec[0], pathSpec[1], target)
+				}
 				if err != nil {
 					return err
 				}
@@ -502,8 +507,13 @@ func (c *cmdFilePush) Run(cmd *cobra.Command, args []string) error {
 		}
 
 		// Transfer the files
+		fileTree := c.file.fileTreeSupported(resource.server, resource.name)
 		for _, fname := range sourcefilenames {
-			err := c.file.recursivePushFile(resource.server, resource.name, fname, targetPath)
+			if fileTree && shared.IsDir(fname) {
+				err = c.file.pushFileTree(resource.server, resource.name, fname, targetPath)
+			} else {
+				err = c.file.recursivePushFile(resource.server, resource.name, fname, targetPath)
+			}
 			if err != nil {
 				return err
 			}
@@ -821,6 +831,63 @@ func (c *cmdFile) recursivePushFile(d lxd.InstanceServer, inst string, source st
 	return filepath.Walk(source, sendFile)
 }
 
+// fileTreeSupported returns whether whole file trees can be transferred to and from the instance in a
+// single request, which is the case for virtual machines.
+func (c *cmdFile) fileTreeSupported(d lxd.InstanceServer, inst string) bool {
+	if !d.HasExtension("instance_file_tree") {
+		return false
+	}
+
+	instance, _, err := d.GetInstance(inst)
+	if err != nil {
+		return false
+	}
+
+	return instance.Type == string(api.InstanceTypeVM)
+}
+
+// pullFileTree pulls the directory p from the instance into targetDir as a single archive. The
+// pulled entries are owned by the local user, as the IDs of the instance may not exist locally.
+func (c *cmdFile) pullFileTree(d lxd.InstanceServer, inst string, p string, targetDir string) error {
+	target := filepath.Join(targetDir, filepath.Base(p))
+	logger.Infof("Pulling %s from %s (tree)", target, p)
+
+	content, err := d.GetInstanceFileTree(inst, p)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+
+	err = os.MkdirAll(target, 0755)
+	if err != nil {
+		return err
+	}
+
+	return shared.UntarTree(content, target, int64(os.Getuid()), int64(os.Getgid()))
+}
+
+// pushFileTree pushes the directory source into target in the instance as a single archive. The
+// pushed entries keep their owners, as with pushing files one at a time.
+func (c *cmdFile) pushFileTree(d lxd.InstanceServer, inst string, source string, target string) error {
+	source = filepath.Clean(source)
+	targetPath := path.Join(target, filepath.Base(source))
+	logger.Infof("Pushing %s to %s (tree)", source, targetPath)
+
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(shared.TarTree(writer, source))
+	}()
+	defer reader.Close()
+
+	args := lxd.InstanceFileTreeArgs{
+		Content: reader,
+		UID:     -1,
+		GID:     -1,
+	}
+
+	return d.CreateInstanceFileTree(inst, targetPath, args)
+}
+
 func (c *cmdFile) recursiveMkdir(d lxd.InstanceServer, inst string, p string, mode *os.FileMode, uid int64, gid int64) error {
 	/* special case, every instance has a /, we don't need to do anything */
 	if p == "/" {
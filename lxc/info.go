@@ -465,6 +465,24 @@ func (c *cmdInfo) instanceInfo(d lxd.InstanceServer, remote config.Remote, name
 	if cs.Pid != 0 {
 		fmt.Printf(i18n.G("Pid: %d")+"\n", cs.Pid)
 
+		if ct.Type == "virtual-machine" && d.HasExtension("vm_agent_status") {
+			if cs.AgentConnected {
+				fmt.Printf(i18n.G("Agent: %s")+"\n", i18n.G("online"))
+			} else {
+				fmt.Printf(i18n.G("Agent: %s")+"\n", i18n.G("offline"))
+			}
+		}
+
+		if cs.OSInfo != nil {
+			if cs.OSInfo.OS != "" {
+				fmt.Printf(i18n.G("OS: %s")+"\n", strings.TrimSpace(fmt.Sprintf("%s %s", cs.OSInfo.OS, cs.OSInfo.OSVersion)))
+			}
+
+			if cs.OSInfo.KernelVersion != "" {
+				fmt.Printf(i18n.G("Kernel: %s")+"\n", cs.OSInfo.KernelVersion)
+			}
+		}
+
 		// IP addresses
 		ipInfo := ""
 		if cs.Network != nil {
@@ -504,6 +522,21 @@ func (c *cmdInfo) instanceInfo(d lxd.InstanceServer, remote config.Remote, name
 			fmt.Printf(diskInfo)
 		}
 
+		// Disk I/O
+		diskIOInfo := ""
+		if cs.Disk != nil {
+			for entry, disk := range cs.Disk {
+				if disk.ReadOperations != 0 || disk.WriteOperations != 0 {
+					diskIOInfo += fmt.Sprintf("    %s: "+i18n.G("%s read (%d operations), %s written (%d operations)")+"\n", entry, units.GetByteSizeString(disk.BytesRead, 2), disk.ReadOperations, units.GetByteSizeString(disk.BytesWritten, 2), disk.WriteOperations)
+				}
+			}
+		}
+
+		if diskIOInfo != "" {
+			fmt.Println(fmt.Sprintf("  %s", i18n.G("Disk I/O:")))
+			fmt.Printf(diskIOInfo)
+		}
+
 		// CPU usage
 		cpuInfo := ""
 		if cs.CPU.Usage != 0 {
@@ -23,6 +23,14 @@ var fileCmd = APIEndpoint{
 	Delete: APIEndpointAction{Handler: fileHandler},
 }
 
+var fileTreeCmd = APIEndpoint{
+	Name: "fileTree",
+	Path: "files/tree",
+
+	Get:  APIEndpointAction{Handler: fileTreeHandler},
+	Post: APIEndpointAction{Handler: fileTreeHandler},
+}
+
 func fileHandler(d *Daemon, r *http.Request) response.Response {
 	path := r.FormValue("path")
 	if path == "" {
@@ -303,3 +311,60 @@ func filePush(fType string, srcpath string, dstpath string, uid int64, gid int64
 
 	return fmt.Errorf("Bad file type: %s", fType)
 }
+
+func fileTreeHandler(d *Daemon, r *http.Request) response.Response {
+	path := r.FormValue("path")
+	if path == "" {
+		return response.BadRequest(fmt.Errorf("missing path argument"))
+	}
+
+	switch r.Method {
+	case "GET":
+		_, err := os.Lstat(path)
+		if err != nil {
+			return response.SmartError(err)
+		}
+
+		return &fileTreeResponse{path: path}
+	case "POST":
+		err := os.MkdirAll(path, 0755)
+		if err != nil {
+			return response.SmartError(err)
+		}
+
+		// Entries are owned by the requested IDs, by the ones in the archive by default.
+		uid, gid, _, _, _ := shared.ParseLXDFileHeaders(r.Header)
+
+		err = shared.UntarTree(r.Body, path, uid, gid)
+		if err != nil {
+			return response.InternalError(err)
+		}
+
+		return response.EmptySyncResponse
+	default:
+		return response.NotFound(fmt.Errorf("Method '%s' not found", r.Method))
+	}
+}
+
+// fileTreeResponse streams the file tree at path as a tar archive. As the status has already been
+// sent by the time the archive fails to be written, errors are reported in the X-LXD-Error trailer.
+type fileTreeResponse struct {
+	path string
+}
+
+func (r *fileTreeResponse) Render(w http.ResponseWriter) error {
+	w.Header().Set("Content-Type", "application/x-tar")
+	w.Header().Set("Trailer", "X-LXD-Error")
+	w.WriteHeader(http.StatusOK)
+
+	err := shared.TarTree(w, r.path)
+	if err != nil {
+		w.Header().Set("X-LXD-Error", err.Error())
+	}
+
+	return nil
+}
+
+func (r *fileTreeResponse) String() string {
+	return fmt.Sprintf("file tree %s", r.path)
+}
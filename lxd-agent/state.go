@@ -9,8 +9,10 @@ import (
 	"strings"
 
 	"github.com/lxc/lxd/lxd/response"
+	"github.com/lxc/lxd/shared"
 	"github.com/lxc/lxd/shared/api"
 	"github.com/lxc/lxd/shared/logger"
+	"github.com/lxc/lxd/shared/osarch"
 )
 
 var stateCmd = APIEndpoint{
@@ -36,9 +38,28 @@ func renderState() *api.InstanceState {
 		Network:   networkState(),
 		Pid:       1,
 		Processes: processesState(),
+		OSInfo:    osInfoState(),
 	}
 }
 
+func osInfoState() *api.InstanceStateOSInfo {
+	osInfo := &api.InstanceStateOSInfo{}
+
+	// The distribution is only informational, leave it empty if it can't be found.
+	osRelease, err := osarch.GetLSBRelease()
+	if err == nil {
+		osInfo.OS = osRelease["NAME"]
+		osInfo.OSVersion = osRelease["VERSION_ID"]
+	}
+
+	uname, err := shared.Uname()
+	if err == nil {
+		osInfo.KernelVersion = uname.Release
+	}
+
+	return osInfo
+}
+
 func cpuState() api.InstanceStateCPU {
 	cpu := api.InstanceStateCPU{}
 
@@ -45,10 +45,13 @@ var api10 = []APIEndpoint{
 	instanceConsoleCmd,
 	instanceExecCmd,
 	instanceFileCmd,
+	instanceFileTreeCmd,
 	instanceLogCmd,
 	instanceLogsCmd,
 	instanceMetadataCmd,
 	instanceMetadataTemplatesCmd,
+	instanceQemuConfigCmd,
+	instanceMetricsCmd,
 	instancesCmd,
 	instanceSnapshotCmd,
 	instanceSnapshotsCmd,
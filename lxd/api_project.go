@@ -546,6 +546,7 @@ var projectConfigKeys = map[string]func(value string) error{
 	"restricted.devices.unix-char":         isEitherAllowOrBlock,
 	"restricted.devices.unix-block":        isEitherAllowOrBlock,
 	"restricted.devices.unix-hotplug":      isEitherAllowOrBlock,
+	"restricted.devices.serial":            isEitherAllowOrBlock,
 	"restricted.devices.infiniband":        isEitherAllowOrBlock,
 	"restricted.devices.gpu":               isEitherAllowOrBlock,
 	"restricted.devices.usb":               isEitherAllowOrBlock,
@@ -2,6 +2,7 @@ package cgroup
 
 import (
 	"fmt"
+	"strconv"
 )
 
 // CGroup represents the main cgroup abstraction.
@@ -246,7 +247,8 @@ func (cg *CGroup) SetBlkioWeight(value string) error {
 
 }
 
-// SetCPUShare sets the weight of each group in the same hierarchy
+// SetCPUShare sets the weight of each group in the same hierarchy. On cgroup v2, the shares are
+// scaled to a weight, keeping the default of 1024 shares as the default weight of 100.
 func (cg *CGroup) SetCPUShare(value string) error {
 	//Confirm we have the controller
 	version := cgControllers["cpu"]
@@ -256,38 +258,44 @@ func (cg *CGroup) SetCPUShare(value string) error {
 	case V1:
 		return cg.rw.Set(version, "cpu", "cpu.shares", value)
 	case V2:
-		return ErrControllerMissing
-	}
-	return ErrUnknownVersion
-}
+		shares, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return err
+		}
 
-// SetCPUCfsPeriod sets the duration in ms for each scheduling period
-func (cg *CGroup) SetCPUCfsPeriod(value string) error {
-	//Confirm we have the controller
-	version := cgControllers["cpu"]
-	switch version {
-	case Unavailable:
-		return ErrControllerMissing
-	case V1:
-		return cg.rw.Set(version, "cpu", "cpu.cfs_period_us", value)
-	case V2:
-		return ErrControllerMissing
+		weight := shares * 100 / 1024
+		if weight < 1 {
+			weight = 1
+		} else if weight > 10000 {
+			weight = 10000
+		}
+
+		return cg.rw.Set(version, "cpu", "cpu.weight", fmt.Sprintf("%d", weight))
 	}
 	return ErrUnknownVersion
 }
 
-// SetCPUCfsQuota sets the max time in ms during each cfs_period_us that
-// the current group can run for
-func (cg *CGroup) SetCPUCfsQuota(value string) error {
+// SetCPUCfsLimit sets the duration in us of each scheduling period and the max time in us during
+// each of them that the current group can run for, -1 meaning no limit
+func (cg *CGroup) SetCPUCfsLimit(period string, quota string) error {
 	//Confirm we have the controller
 	version := cgControllers["cpu"]
 	switch version {
 	case Unavailable:
 		return ErrControllerMissing
 	case V1:
-		return cg.rw.Set(version, "cpu", "cpu.cfs_quota_us", value)
+		err := cg.rw.Set(version, "cpu", "cpu.cfs_period_us", period)
+		if err != nil {
+			return err
+		}
+
+		return cg.rw.Set(version, "cpu", "cpu.cfs_quota_us", quota)
 	case V2:
-		return ErrControllerMissing
+		if quota == "-1" {
+			quota = "max"
+		}
+
+		return cg.rw.Set(version, "cpu", "cpu.max", fmt.Sprintf("%s %s", quota, period))
 	}
 	return ErrUnknownVersion
 }
@@ -2,6 +2,7 @@ package cgroup
 
 import (
 	"bufio"
+	"io"
 	"os"
 	"path/filepath"
 	"strings"
@@ -139,11 +140,7 @@ func (info *Info) SupportsVersion(resource Resource) (Backend, bool) {
 		return Unavailable, false
 	case CPU:
 		val, ok := cgControllers["cpu"]
-		if ok && val == V1 {
-			return V1, ok
-		}
-
-		return Unavailable, false
+		return val, ok
 	case CPUAcct:
 		val, ok := cgControllers["cpuacct"]
 		if ok && val == V1 {
@@ -293,6 +290,22 @@ func (info *Info) Log() {
 	}
 }
 
+// parseUnifiedControllers returns the controllers listed in a cgroup.controllers file, along with
+// "unified" recording the fact that V2 is present at all.
+func parseUnifiedControllers(r io.Reader) map[string]Backend {
+	unifiedControllers := map[string]Backend{}
+	unifiedControllers["unified"] = V2
+
+	scanControllers := bufio.NewScanner(r)
+	for scanControllers.Scan() {
+		for _, controller := range strings.Fields(scanControllers.Text()) {
+			unifiedControllers[controller] = V2
+		}
+	}
+
+	return unifiedControllers
+}
+
 func init() {
 	_, err := os.Stat("/proc/self/ns/cgroup")
 	if err == nil {
@@ -353,16 +366,8 @@ func init() {
 		}
 
 		if err == nil {
-			unifiedControllers := map[string]Backend{}
-
-			// Record the fact that V2 is present at all.
-			unifiedControllers["unified"] = V2
-
-			scanControllers := bufio.NewScanner(controllers)
-			for scanControllers.Scan() {
-				line := strings.TrimSpace(scanSelfCg.Text())
-				unifiedControllers[line] = V2
-			}
+			unifiedControllers := parseUnifiedControllers(controllers)
+			controllers.Close()
 			hasV2 = true
 
 			if dedicatedPath != "" {
@@ -0,0 +1,27 @@
+package cgroup
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Test that each of the space separated controllers of a cgroup.controllers file is found.
+func TestParseUnifiedControllers(t *testing.T) {
+	controllers := parseUnifiedControllers(strings.NewReader("cpuset cpu io memory hugetlb pids rdma\n"))
+	assert.Equal(t, map[string]Backend{
+		"unified": V2,
+		"cpuset":  V2,
+		"cpu":     V2,
+		"io":      V2,
+		"memory":  V2,
+		"hugetlb": V2,
+		"pids":    V2,
+		"rdma":    V2,
+	}, controllers)
+
+	// No controller is enabled.
+	controllers = parseUnifiedControllers(strings.NewReader(""))
+	assert.Equal(t, map[string]Backend{"unified": V2}, controllers)
+}
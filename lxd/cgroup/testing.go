@@ -0,0 +1,13 @@
+package cgroup
+
+// SetTestControllers replaces the controllers found on the system with the given ones, so that the
+// users of this package can be tested against any cgroup layout. The returned function restores the
+// controllers found on the system.
+func SetTestControllers(controllers map[string]Backend) func() {
+	oldControllers := cgControllers
+	cgControllers = controllers
+
+	return func() {
+		cgControllers = oldControllers
+	}
+}
@@ -1040,6 +1040,9 @@ func (d *Daemon) Ready() error {
 
 		// Remove expired container snapshots (minutely)
 		d.tasks.Add(pruneExpiredContainerSnapshotsTask(d))
+
+		// Run the health checks of VMs (every 5 seconds, configurable per VM)
+		d.tasks.Add(instanceHealthCheckTask(d))
 	}
 
 	// Start all background tasks
@@ -148,13 +148,13 @@ func EnsureSchema(db *sql.DB, address string, dir string) (bool, error) {
 	schema.File(filepath.Join(dir, "patch.global.sql")) // Optional custom queries
 	schema.Check(check)
 	schema.Hook(hook)
-
-	var initial int
-	err := query.Retry(func() error {
-		var err error
-		initial, err = schema.Ensure(db)
-		return err
+	schema.Progress(func(version int, n int, total int, target int) {
+		logger.Infof("Updating the LXD global schema to version %d (%d of %d)", version, n, total)
 	})
+
+	// Ensure retries the transaction if the database is busy, for example
+	// because other nodes are starting at the same time.
+	initial, err := schema.Ensure(db)
 	if someNodesAreBehind {
 		return false, nil
 	}
@@ -907,6 +907,31 @@ func (c *Cluster) ContainersNodeList(instanceType instancetype.Type) ([]string,
 	return ret, nil
 }
 
+// InstancesNodeConfigValues returns the value of the given config key of all
+// the instances on the local node having it, indexed by instance ID.
+func (c *Cluster) InstancesNodeConfigValues(key string) (map[int]string, error) {
+	q := `
+SELECT instances_config.instance_id, instances_config.value
+  FROM instances_config JOIN instances ON instances.id = instances_config.instance_id
+  WHERE instances.node_id=? AND instances_config.key=?
+`
+	inargs := []interface{}{c.nodeID, key}
+	var id int
+	var value string
+	outfmt := []interface{}{id, value}
+	result, err := queryScan(c.db, q, inargs, outfmt)
+	if err != nil {
+		return nil, err
+	}
+
+	values := map[int]string{}
+	for _, r := range result {
+		values[r[0].(int)] = r[1].(string)
+	}
+
+	return values, nil
+}
+
 // ContainersResetState resets the power state of all containers.
 func (c *Cluster) ContainersResetState() error {
 	// Reset all container states
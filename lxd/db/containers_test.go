@@ -405,6 +405,35 @@ func TestContainersNodeList(t *testing.T) {
 	assert.Equal(t, names, []string{"c1"})
 }
 
+func TestInstancesNodeConfigValues(t *testing.T) {
+	cluster, cleanup := db.NewTestCluster(t)
+	defer cleanup()
+
+	nodeID1 := int64(1) // This is the default local node
+
+	// Add another node
+	var nodeID2 int64
+	var id1 int64
+	err := cluster.Transaction(func(tx *db.ClusterTx) error {
+		var err error
+		nodeID2, err = tx.NodeAdd("node2", "1.2.3.4:666")
+		require.NoError(t, err)
+		addContainer(t, tx, nodeID1, "c1")
+		addContainer(t, tx, nodeID1, "c2")
+		addContainer(t, tx, nodeID2, "c3")
+		addContainerConfig(t, tx, "c1", "volatile.vm.vsock_id", "10")
+		addContainerConfig(t, tx, "c1", "limits.cpu", "2")
+		addContainerConfig(t, tx, "c3", "volatile.vm.vsock_id", "10")
+		id1 = getContainerID(t, tx, "c1")
+		return nil
+	})
+	require.NoError(t, err)
+
+	values, err := cluster.InstancesNodeConfigValues("volatile.vm.vsock_id")
+	require.NoError(t, err)
+	assert.Equal(t, map[int]string{int(id1): "10"}, values)
+}
+
 // All containers on a node are loaded in bulk.
 func TestContainerNodeProjectList(t *testing.T) {
 	tx, cleanup := db.NewTestClusterTx(t)
@@ -31,6 +31,10 @@ func dbDeviceTypeToString(t int) (string, error) {
 		return "proxy", nil
 	case 9:
 		return "unix-hotplug", nil
+	case 10:
+		return "serial", nil
+	case 11:
+		return "shm", nil
 	default:
 		return "", fmt.Errorf("Invalid device type %d", t)
 	}
@@ -58,6 +62,10 @@ func dbDeviceTypeToInt(t string) (int, error) {
 		return 8, nil
 	case "unix-hotplug":
 		return 9, nil
+	case "serial":
+		return 10, nil
+	case "shm":
+		return 11, nil
 	default:
 		return -1, fmt.Errorf("Invalid device type %s", t)
 	}
@@ -10,6 +10,7 @@ import (
 
 	"github.com/lxc/lxd/lxd/db/cluster"
 	"github.com/lxc/lxd/lxd/db/query"
+	"github.com/lxc/lxd/lxd/instance/instancetype"
 	"github.com/lxc/lxd/lxd/util"
 	"github.com/lxc/lxd/shared"
 	"github.com/lxc/lxd/shared/osarch"
@@ -584,18 +585,52 @@ func (c *ClusterTx) NodeOfflineThreshold() (time.Duration, error) {
 // an operation). If archs is not empty, then return only nodes with an
 // architecture in that list.
 func (c *ClusterTx) NodeWithLeastContainers(archs []int) (string, error) {
+	name, _, err := c.NodeForPlacement(archs, NodePlacement{})
+	return name, err
+}
+
+// NodePlacement holds the hints for placing an instance on a node, given as
+// the names of other instances of the project.
+type NodePlacement struct {
+	Project      string
+	Affinity     []string // Instances to run on the same node as.
+	AntiAffinity []string // Instances to avoid running on the same node as.
+}
+
+// NodeForPlacement returns the name of the non-offline node to place an
+// instance on according to the given hints. Nodes running any of the
+// anti-affinity instances are skipped, then the ones running the most
+// affinity instances are preferred, then the ones with the least number of
+// containers (either already created or being created with an operation). If
+// archs is not empty, then return only nodes with an architecture in that
+// list.
+//
+// The returned flag is false if the anti-affinity couldn't be honoured as all
+// the candidate nodes run some of those instances.
+func (c *ClusterTx) NodeForPlacement(archs []int, placement NodePlacement) (string, bool, error) {
 	threshold, err := c.NodeOfflineThreshold()
 	if err != nil {
-		return "", errors.Wrap(err, "failed to get offline threshold")
+		return "", false, errors.Wrap(err, "failed to get offline threshold")
 	}
 
 	nodes, err := c.Nodes()
 	if err != nil {
-		return "", errors.Wrap(err, "failed to get current nodes")
+		return "", false, errors.Wrap(err, "failed to get current nodes")
+	}
+
+	instanceNodes, err := c.placementInstanceNodes(placement)
+	if err != nil {
+		return "", false, err
+	}
+
+	type candidate struct {
+		name        string
+		conflicting bool
+		affinity    int
+		containers  int
 	}
 
-	name := ""
-	containers := -1
+	var best *candidate
 	for _, node := range nodes {
 		if node.IsOffline(threshold) {
 			continue
@@ -608,23 +643,83 @@ func (c *ClusterTx) NodeWithLeastContainers(archs []int) (string, error) {
 		// Fetch the number of containers already created on this node.
 		created, err := query.Count(c.tx, "instances", "node_id=?", node.ID)
 		if err != nil {
-			return "", errors.Wrap(err, "Failed to get instances count")
+			return "", false, errors.Wrap(err, "Failed to get instances count")
 		}
 
 		// Fetch the number of containers currently being created on this node.
 		pending, err := query.Count(
 			c.tx, "operations", "node_id=? AND type=?", node.ID, OperationContainerCreate)
 		if err != nil {
-			return "", errors.Wrap(err, "Failed to get pending instances count")
+			return "", false, errors.Wrap(err, "Failed to get pending instances count")
 		}
 
-		count := created + pending
-		if containers == -1 || count < containers {
-			containers = count
-			name = node.Name
+		current := candidate{
+			name:        node.Name,
+			conflicting: len(placementInstancesOn(node.Name, placement.AntiAffinity, instanceNodes)) > 0,
+			affinity:    len(placementInstancesOn(node.Name, placement.Affinity, instanceNodes)),
+			containers:  created + pending,
 		}
+
+		switch {
+		case best == nil:
+		case current.conflicting != best.conflicting:
+			if current.conflicting {
+				continue
+			}
+		case current.affinity != best.affinity:
+			if current.affinity < best.affinity {
+				continue
+			}
+		case current.containers >= best.containers:
+			continue
+		}
+
+		best = &current
+	}
+
+	if best == nil {
+		return "", true, nil
 	}
-	return name, nil
+
+	return best.name, !best.conflicting, nil
+}
+
+// NodePlacementConflicts returns the anti-affinity instances of the given
+// placement hints which run on the given node.
+func (c *ClusterTx) NodePlacementConflicts(node string, placement NodePlacement) ([]string, error) {
+	instanceNodes, err := c.placementInstanceNodes(placement)
+	if err != nil {
+		return nil, err
+	}
+
+	return placementInstancesOn(node, placement.AntiAffinity, instanceNodes), nil
+}
+
+// Returns a map associating the instances of the project of the given
+// placement hints to the name of their node, if there are any hints.
+func (c *ClusterTx) placementInstanceNodes(placement NodePlacement) (map[string]string, error) {
+	if len(placement.Affinity) == 0 && len(placement.AntiAffinity) == 0 {
+		return map[string]string{}, nil
+	}
+
+	instanceNodes, err := c.ContainersByNodeName(placement.Project, instancetype.Any)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to get nodes of instances")
+	}
+
+	return instanceNodes, nil
+}
+
+// Returns the given instances which run on the given node.
+func placementInstancesOn(node string, instances []string, instanceNodes map[string]string) []string {
+	found := []string{}
+	for _, name := range instances {
+		if instanceNodes[name] == node {
+			found = append(found, name)
+		}
+	}
+
+	return found
 }
 
 // NodeUpdateVersion updates the schema and API version of the node with the
@@ -59,5 +59,8 @@ func EnsureSchema(db *sql.DB, dir string, hook schema.Hook) (int, error) {
 
 		return nil
 	})
+	schema.Progress(func(version int, n int, total int, target int) {
+		logger.Infof("Updating the LXD database schema to version %d (%d of %d)", version, n, total)
+	})
 	return schema.Ensure(db)
 }
@@ -386,3 +386,97 @@ INSERT INTO instances (id, node_id, name, architecture, type, project_id) VALUES
 	require.NoError(t, err)
 	assert.Equal(t, "none", name)
 }
+
+// Nodes running anti-affinity instances are avoided, even if they have less
+// containers.
+func TestNodeForPlacement_AntiAffinity(t *testing.T) {
+	tx, cleanup := db.NewTestClusterTx(t)
+	defer cleanup()
+
+	id, err := tx.NodeAdd("buzz", "1.2.3.4:666")
+	require.NoError(t, err)
+
+	// Add a container to the default node (ID 1) and two to the new one.
+	_, err = tx.Tx().Exec(`
+INSERT INTO instances (id, node_id, name, architecture, type, project_id) VALUES (1, 1, 'foo', 1, 1, 1);
+INSERT INTO instances (id, node_id, name, architecture, type, project_id) VALUES (2, ?, 'bar', 1, 1, 1);
+INSERT INTO instances (id, node_id, name, architecture, type, project_id) VALUES (3, ?, 'egg', 1, 1, 1);
+`, id, id)
+	require.NoError(t, err)
+
+	name, satisfied, err := tx.NodeForPlacement(nil, db.NodePlacement{Project: "default", AntiAffinity: []string{"foo"}})
+	require.NoError(t, err)
+	assert.Equal(t, "buzz", name)
+	assert.True(t, satisfied)
+
+	// When all nodes run anti-affinity instances, the least loaded one is used.
+	name, satisfied, err = tx.NodeForPlacement(nil, db.NodePlacement{Project: "default", AntiAffinity: []string{"foo", "bar"}})
+	require.NoError(t, err)
+	assert.Equal(t, "none", name)
+	assert.False(t, satisfied)
+
+	// Instances of other projects are ignored.
+	name, satisfied, err = tx.NodeForPlacement(nil, db.NodePlacement{Project: "other", AntiAffinity: []string{"foo"}})
+	require.NoError(t, err)
+	assert.Equal(t, "none", name)
+	assert.True(t, satisfied)
+}
+
+// Nodes running affinity instances are preferred, even if they have more
+// containers.
+func TestNodeForPlacement_Affinity(t *testing.T) {
+	tx, cleanup := db.NewTestClusterTx(t)
+	defer cleanup()
+
+	id, err := tx.NodeAdd("buzz", "1.2.3.4:666")
+	require.NoError(t, err)
+
+	_, err = tx.NodeAdd("rusp", "5.6.7.8:666")
+	require.NoError(t, err)
+
+	// Add two containers to the default node (ID 1) and one to buzz.
+	_, err = tx.Tx().Exec(`
+INSERT INTO instances (id, node_id, name, architecture, type, project_id) VALUES (1, 1, 'foo', 1, 1, 1);
+INSERT INTO instances (id, node_id, name, architecture, type, project_id) VALUES (2, 1, 'bar', 1, 1, 1);
+INSERT INTO instances (id, node_id, name, architecture, type, project_id) VALUES (3, ?, 'egg', 1, 1, 1);
+`, id)
+	require.NoError(t, err)
+
+	name, satisfied, err := tx.NodeForPlacement(nil, db.NodePlacement{Project: "default", Affinity: []string{"foo"}})
+	require.NoError(t, err)
+	assert.Equal(t, "none", name)
+	assert.True(t, satisfied)
+
+	// The anti-affinity takes precedence.
+	name, _, err = tx.NodeForPlacement(nil, db.NodePlacement{Project: "default", Affinity: []string{"foo"}, AntiAffinity: []string{"bar"}})
+	require.NoError(t, err)
+	assert.Equal(t, "rusp", name)
+
+	// Unknown instances don't matter.
+	name, _, err = tx.NodeForPlacement(nil, db.NodePlacement{Project: "default", Affinity: []string{"ham"}})
+	require.NoError(t, err)
+	assert.Equal(t, "rusp", name)
+}
+
+func TestNodePlacementConflicts(t *testing.T) {
+	tx, cleanup := db.NewTestClusterTx(t)
+	defer cleanup()
+
+	_, err := tx.NodeAdd("buzz", "1.2.3.4:666")
+	require.NoError(t, err)
+
+	_, err = tx.Tx().Exec(`
+INSERT INTO instances (id, node_id, name, architecture, type, project_id) VALUES (1, 1, 'foo', 1, 1, 1)
+`)
+	require.NoError(t, err)
+
+	placement := db.NodePlacement{Project: "default", Affinity: []string{"foo"}, AntiAffinity: []string{"foo", "bar"}}
+
+	conflicts, err := tx.NodePlacementConflicts("none", placement)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"foo"}, conflicts)
+
+	conflicts, err = tx.NodePlacementConflicts("buzz", placement)
+	require.NoError(t, err)
+	assert.Empty(t, conflicts)
+}
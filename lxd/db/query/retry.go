@@ -16,6 +16,21 @@ import (
 //
 // This should by typically used to wrap transactions.
 func Retry(f func() error) error {
+	return retry(f, func(attempt int) time.Duration {
+		return 250 * time.Millisecond
+	})
+}
+
+// RetryBackoff is like Retry, but the delay between attempts grows at each
+// retry, to let heavy contention on the database settle, such as when all
+// the nodes of a cluster update the schema at the same time.
+func RetryBackoff(f func() error) error {
+	return retry(f, func(attempt int) time.Duration {
+		return time.Duration(attempt+1) * 250 * time.Millisecond
+	})
+}
+
+func retry(f func() error, delay func(attempt int) time.Duration) error {
 	// TODO: the retry loop should be configurable.
 	var err error
 	for i := 0; i < 5; i++ {
@@ -30,7 +45,7 @@ func Retry(f func() error) error {
 			logger.Debugf("Database error: %#v", err)
 			if IsRetriableError(err) {
 				logger.Debugf("Retry failed db interaction (%v)", err)
-				time.Sleep(250 * time.Millisecond)
+				time.Sleep(delay(i))
 				continue
 			}
 		}
@@ -8,3 +8,24 @@ import "fmt"
 // Every change performed so by the Check will be committed, although
 // ErrGracefulAbort will be returned.
 var ErrGracefulAbort = fmt.Errorf("schema check gracefully aborted")
+
+// UpdateError is returned by Schema.Ensure when a update, or the hook invoked
+// right before it, fails.
+type UpdateError struct {
+	Version int   // Version of the schema once the failed update is applied
+	Hook    bool  // Whether the hook failed, rather than the update itself
+	Err     error // Error returned by the update or the hook
+}
+
+func (e *UpdateError) Error() string {
+	if e.Hook {
+		return fmt.Sprintf("failed to execute hook before update %d: %v", e.Version, e.Err)
+	}
+
+	return fmt.Sprintf("failed to apply update %d: %v", e.Version, e.Err)
+}
+
+// Unwrap returns the error returned by the update or the hook.
+func (e *UpdateError) Unwrap() error {
+	return e.Err
+}
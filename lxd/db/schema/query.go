@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"strings"
 
 	"github.com/lxc/lxd/lxd/db/query"
 	"github.com/lxc/lxd/shared"
@@ -14,10 +15,16 @@ import (
 // DoesSchemaTableExist return whether the schema table is present in the
 // database.
 func DoesSchemaTableExist(tx *sql.Tx) (bool, error) {
+	return doesSchemaTableExist(tx, defaultTable)
+}
+
+// Return whether the schema table with the given name is present in the
+// database.
+func doesSchemaTableExist(tx *sql.Tx, table string) (bool, error) {
 	statement := `
-SELECT COUNT(name) FROM sqlite_master WHERE type = 'table' AND name = 'schema'
+SELECT COUNT(name) FROM sqlite_master WHERE type = 'table' AND name = ?
 `
-	rows, err := tx.Query(statement)
+	rows, err := tx.Query(statement, table)
 	if err != nil {
 		return false, err
 	}
@@ -38,49 +45,150 @@ SELECT COUNT(name) FROM sqlite_master WHERE type = 'table' AND name = 'schema'
 }
 
 // Return all versions in the schema table, in increasing order.
-func selectSchemaVersions(tx *sql.Tx) ([]int, error) {
-	statement := `
-SELECT version FROM schema ORDER BY version
-`
+func selectSchemaVersions(tx *sql.Tx, table string) ([]int, error) {
+	statement := fmt.Sprintf(`
+SELECT version FROM %s ORDER BY version
+`, table)
 	return query.SelectIntegers(tx, statement)
 }
 
 // Return a list of SQL statements that can be used to create all tables in the
-// database.
-func selectTablesSQL(tx *sql.Tx) ([]string, error) {
+// database, except the schema table.
+func selectTablesSQL(tx *sql.Tx, table string) ([]string, error) {
 	statement := `
 SELECT sql FROM sqlite_master WHERE
   type IN ('table', 'index', 'view', 'trigger') AND
-  name != 'schema' AND
+  name != ? AND
   name NOT LIKE 'sqlite_%'
 ORDER BY name
 `
-	return query.SelectStrings(tx, statement)
+	return query.SelectStrings(tx, statement, table)
 }
 
 // Create the schema table.
-func createSchemaTable(tx *sql.Tx) error {
-	statement := `
-CREATE TABLE schema (
+func createSchemaTable(tx *sql.Tx, table string) error {
+	statement := fmt.Sprintf(`
+CREATE TABLE %s (
     id         INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
     version    INTEGER NOT NULL,
     updated_at DATETIME NOT NULL,
     UNIQUE (version)
 )
-`
+`, table)
 	_, err := tx.Exec(statement)
 	return err
 }
 
 // Insert a new version into the schema table.
-func insertSchemaVersion(tx *sql.Tx, new int) error {
-	statement := `
-INSERT INTO schema (version, updated_at) VALUES (?, strftime("%s"))
-`
+func insertSchemaVersion(tx *sql.Tx, table string, new int) error {
+	statement := fmt.Sprintf(`
+INSERT INTO %s (version, updated_at) VALUES (?, strftime("%%s"))
+`, table)
 	_, err := tx.Exec(statement, new)
 	return err
 }
 
+// Return the fingerprints recorded in the schema table, by version. Schema
+// tables created before fingerprints were recorded have none.
+func selectSchemaFingerprints(tx *sql.Tx, table string) (map[int]string, error) {
+	fingerprints := map[int]string{}
+
+	count, err := query.Count(tx, fmt.Sprintf("pragma_table_info('%s')", table), "name = 'fingerprint'")
+	if err != nil {
+		return nil, err
+	}
+
+	if count == 0 {
+		return fingerprints, nil
+	}
+
+	statement := fmt.Sprintf(`
+SELECT version, fingerprint FROM %s WHERE fingerprint IS NOT NULL ORDER BY version
+`, table)
+	rows, err := tx.Query(statement)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var version int
+		var fingerprint string
+
+		err := rows.Scan(&version, &fingerprint)
+		if err != nil {
+			return nil, err
+		}
+
+		fingerprints[version] = fingerprint
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return fingerprints, nil
+}
+
+// Record the fingerprint of an applied version in the schema table, adding
+// the fingerprint column to schema tables lacking it.
+func updateSchemaFingerprint(tx *sql.Tx, table string, version int, fingerprint string) error {
+	count, err := query.Count(tx, fmt.Sprintf("pragma_table_info('%s')", table), "name = 'fingerprint'")
+	if err != nil {
+		return err
+	}
+
+	if count == 0 {
+		_, err = tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN fingerprint TEXT", table))
+		if err != nil {
+			return err
+		}
+	}
+
+	statement := fmt.Sprintf(`
+UPDATE %s SET fingerprint = ? WHERE version = ?
+`, table)
+	_, err = tx.Exec(statement, fingerprint, version)
+	return err
+}
+
+// Delete all versions from the schema table.
+func deleteSchemaVersions(tx *sql.Tx, table string) error {
+	_, err := tx.Exec(fmt.Sprintf("DELETE FROM %s", table))
+	return err
+}
+
+// Delete a version from the schema table.
+func deleteSchemaVersion(tx *sql.Tx, table string, version int) error {
+	statement := fmt.Sprintf(`
+DELETE FROM %s WHERE version = ?
+`, table)
+	_, err := tx.Exec(statement, version)
+	return err
+}
+
+// Write a SQL dump of the tables of the database and their rows to the given
+// path, in the same format as the sql dump API. The schema table must have its
+// default name.
+func writeBackup(tx *sql.Tx, table string, path string) error {
+	if table != defaultTable {
+		return fmt.Errorf("cannot dump schema table %s", table)
+	}
+
+	statements, err := selectTablesSQL(tx, table)
+	if err != nil {
+		return err
+	}
+
+	dump, err := query.Dump(tx, strings.Join(statements, ";\n"), false)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, []byte(dump), 0600)
+}
+
 // Read the given file (if it exists) and executes all queries it contains.
 func execFromFile(tx *sql.Tx, path string, hook Hook) error {
 	if !shared.PathExists(path) {
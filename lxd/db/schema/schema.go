@@ -1,6 +1,7 @@
 package schema
 
 import (
+	"crypto/sha256"
 	"database/sql"
 	"fmt"
 	"sort"
@@ -14,20 +15,42 @@ import (
 // Schema captures the schema of a database in terms of a series of ordered
 // updates.
 type Schema struct {
-	updates []Update // Ordered series of updates making up the schema
-	hook    Hook     // Optional hook to execute whenever a update gets applied
-	fresh   string   // Optional SQL statement used to create schema from scratch
-	check   Check    // Optional callback invoked before doing any update
-	path    string   // Optional path to a file containing extra queries to run
+	updates   []Update       // Ordered series of updates making up the schema
+	hook      Hook           // Optional hook to execute whenever a update gets applied
+	fresh     string         // Optional SQL statement used to create schema from scratch
+	check     Check          // Optional callback invoked before doing any update
+	path      string         // Optional path to a file containing extra queries to run
+	rollbacks map[int]Update // Optional updates reverting the update with the same version
+	downgrade bool           // Whether DowngradeTo is allowed to run
+	sql       map[int]string // Optional SQL run by the update with the same version
+	checksums map[int]string // Optional fingerprints declared for the update with the same version
+	backup    string         // Optional path to write a SQL dump to before applying updates
+	progress  Progress       // Optional callback reporting the progress of the updates
+	table     string         // Name of the table tracking the applied updates
 }
 
+// Name of the table tracking the applied updates, unless set with Table.
+const defaultTable = "schema"
+
 // Update applies a specific schema change to a database, and returns an error
 // if anything goes wrong.
 type Update func(*sql.Tx) error
 
+// PendingUpdate is an update that Ensure would apply, as returned by Plan.
+type PendingUpdate struct {
+	Version int    // Version of the schema once the update is applied
+	SQL     string // SQL run by the update, if described with Describe
+}
+
 // Hook is a callback that gets fired when a update gets applied.
 type Hook func(int, *sql.Tx) error
 
+// Progress is a callback that gets fired when a update is about to be applied,
+// right after the Hook. It gets passed the version of the update, its position
+// among the updates being applied (starting from 1), the total number of those
+// updates, and the version the schema is being updated to.
+type Progress func(version int, n int, total int, target int)
+
 // Check is a callback that gets fired all the times Schema.Ensure is invoked,
 // before applying any update. It gets passed the version that the schema is
 // currently at and a handle to the transaction. If it returns nil, the update
@@ -36,10 +59,18 @@ type Hook func(int, *sql.Tx) error
 // perform state changes.
 type Check func(int, *sql.Tx) error
 
-// New creates a new schema Schema with the given updates.
+// New creates a new schema Schema with the given updates. It's required that
+// none of the updates is nil.
 func New(updates []Update) *Schema {
+	for i, update := range updates {
+		if update == nil {
+			panic(fmt.Sprintf("update at index %d (version %d) is nil", i, i+1))
+		}
+	}
+
 	return &Schema{
 		updates: updates,
+		table:   defaultTable,
 	}
 }
 
@@ -70,11 +101,16 @@ func NewFromMap(versionsToUpdates map[int]Update) *Schema {
 			panic(fmt.Sprintf("updates map misses version %d", i+1))
 		}
 
+		if versionsToUpdates[version] == nil {
+			panic(fmt.Sprintf("update for version %d is nil", version))
+		}
+
 		updates = append(updates, versionsToUpdates[version])
 	}
 
 	return &Schema{
 		updates: updates,
+		table:   defaultTable,
 	}
 }
 
@@ -84,8 +120,12 @@ func Empty() *Schema {
 }
 
 // Add a new update to the schema. It will be appended at the end of the
-// existing series.
+// existing series. It's required that the update is not nil.
 func (s *Schema) Add(update Update) {
+	if update == nil {
+		panic(fmt.Sprintf("update at index %d (version %d) is nil", len(s.updates), len(s.updates)+1))
+	}
+
 	s.updates = append(s.updates, update)
 }
 
@@ -98,6 +138,20 @@ func (s *Schema) Hook(hook Hook) {
 	s.hook = hook
 }
 
+// Progress instructs the schema to invoke the given function whenever a update
+// is about to be applied, so that the progress of long migrations can be
+// shown. Any previously installed progress callback will be replaced.
+func (s *Schema) Progress(progress Progress) {
+	s.progress = progress
+}
+
+// Table sets the name of the table tracking the applied updates, which is
+// "schema" by default. This makes it possible to namespace it when the
+// database is shared with other users.
+func (s *Schema) Table(name string) {
+	s.table = name
+}
+
 // Check instructs the schema to invoke the given function whenever Ensure is
 // invoked, before applying any due update. It can be used for aborting the
 // operation.
@@ -123,6 +177,108 @@ func (s *Schema) File(path string) {
 	s.path = path
 }
 
+// Describe records the SQL run by the update with the given version, for Plan
+// to return it. Any previous description of that version will be replaced.
+func (s *Schema) Describe(version int, statement string) {
+	if s.sql == nil {
+		s.sql = map[int]string{}
+	}
+
+	s.sql[version] = statement
+}
+
+// BackupBefore instructs Ensure to write a SQL dump of the tables of the
+// database and their rows to the given path before applying any pending
+// update, so that a failed update can be recovered from by loading the dump
+// into an empty database. The dump is the one returned by query.Dump, taken in
+// the same transaction the updates are applied in, after the queries set with
+// File have run. Nothing is written if there's no pending update. An empty
+// path disables the backup. It can't be used along with a custom schema table
+// name.
+func (s *Schema) BackupBefore(path string) {
+	s.backup = path
+}
+
+// Fingerprint declares a checksum of the update with the given version. It's
+// recorded in the schema table when the update is applied, and Ensure fails
+// if it doesn't match anymore, which catches updates changed without bumping
+// the version. Updates described with Describe are fingerprinted with the
+// SHA-256 hash of their SQL, unless a checksum is declared.
+func (s *Schema) Fingerprint(version int, checksum string) {
+	if s.checksums == nil {
+		s.checksums = map[int]string{}
+	}
+
+	s.checksums[version] = checksum
+}
+
+// Rollback registers a function reverting the changes of the update with the
+// given version, to be used by DowngradeTo. Any previously registered rollback
+// for that version will be replaced.
+//
+// Registering rollbacks has no effect on Ensure.
+func (s *Schema) Rollback(version int, rollback Update) {
+	if s.rollbacks == nil {
+		s.rollbacks = map[int]Update{}
+	}
+
+	s.rollbacks[version] = rollback
+}
+
+// AllowDowngrade enables DowngradeTo, which fails otherwise. This is meant for
+// development and for recovering from failed upgrades, so that a regular code
+// path can't downgrade a database by accident.
+func (s *Schema) AllowDowngrade() {
+	s.downgrade = true
+}
+
+// DowngradeTo reverts all updates applied after the given version, in reverse
+// order, using the rollbacks registered with Rollback.
+//
+// All rollbacks are applied transactionally. If any update to revert has no
+// rollback, or if any error occurs, the transaction will be rolled back and
+// the database will remain unchanged.
+//
+// If no error occurs, the integer returned by this method is the initial
+// version that the schema has been downgraded from.
+func (s *Schema) DowngradeTo(db *sql.DB, version int) (int, error) {
+	if !s.downgrade {
+		return -1, fmt.Errorf("schema downgrades are not allowed")
+	}
+
+	if version < 0 {
+		return -1, fmt.Errorf("invalid schema version '%d'", version)
+	}
+
+	var current int
+	err := query.Transaction(db, func(tx *sql.Tx) error {
+		exists, err := doesSchemaTableExist(tx, s.table)
+		if err != nil {
+			return fmt.Errorf("failed to check if schema table is there: %v", err)
+		}
+
+		if exists {
+			current, err = queryCurrentVersion(tx, s.table)
+			if err != nil {
+				return err
+			}
+		}
+
+		if version > current {
+			return fmt.Errorf(
+				"schema version '%d' is older than requested '%d'",
+				current, version)
+		}
+
+		return ensureUpdatesAreRolledBack(tx, s.table, current, version, s.rollbacks)
+	})
+	if err != nil {
+		return -1, err
+	}
+
+	return current, nil
+}
+
 // Ensure makes sure that the actual schema in the given database matches the
 // one defined by our updates.
 //
@@ -135,53 +291,98 @@ func (s *Schema) File(path string) {
 //
 // If no error occurs, the integer returned by this method is the
 // initial version that the schema has been upgraded from.
+//
+// Several processes, such as the nodes of a cluster starting at the same time,
+// can safely call Ensure against the same database. The transaction is retried
+// with query.RetryBackoff if the database is busy or locked, and the process losing
+// the race finds the updates already applied by the winning one.
 func (s *Schema) Ensure(db *sql.DB) (int, error) {
-	var current int
-	aborted := false
-	err := query.Transaction(db, func(tx *sql.Tx) error {
-		err := execFromFile(tx, s.path, s.hook)
-		if err != nil {
-			return errors.Wrapf(err, "failed to execute queries from %s", s.path)
-		}
-
-		err = ensureSchemaTableExists(tx)
-		if err != nil {
-			return err
-		}
+	return s.EnsureTo(db, len(s.updates))
+}
 
-		current, err = queryCurrentVersion(tx)
-		if err != nil {
-			return err
-		}
+// EnsureTo is like Ensure, but it applies only the updates up to the given
+// version, leaving any later ones pending. This makes it possible to stop at
+// an intermediate version, for example to migrate data before moving on.
+//
+// The fresh schema dump is only used when the given version is the latest
+// one, since it reflects the schema after all updates. If the database has
+// already been updated past the given version, for example by a peer, nothing
+// is applied.
+func (s *Schema) EnsureTo(db *sql.DB, version int) (int, error) {
+	if version < 0 || version > len(s.updates) {
+		return -1, fmt.Errorf("schema version '%d' is not between 0 and '%d'", version, len(s.updates))
+	}
 
-		if s.check != nil {
-			err := s.check(current, tx)
-			if err == ErrGracefulAbort {
-				// Abort the update gracefully, committing what
-				// we've done so far.
-				aborted = true
-				return nil
-			}
+	var current int
+	var aborted bool
+	err := query.RetryBackoff(func() error {
+		aborted = false
+		return query.Transaction(db, func(tx *sql.Tx) error {
+			err := execFromFile(tx, s.path, s.hook)
 			if err != nil {
-				return err
+				return errors.Wrapf(err, "failed to execute queries from %s", s.path)
 			}
-		}
 
-		// When creating the schema from scratch, use the fresh dump if
-		// available. Otherwise just apply all relevant updates.
-		if current == 0 && s.fresh != "" {
-			_, err = tx.Exec(s.fresh)
+			err = ensureSchemaTableExists(tx, s.table)
 			if err != nil {
-				return fmt.Errorf("cannot apply fresh schema: %v", err)
+				return err
 			}
-		} else {
-			err = ensureUpdatesAreApplied(tx, current, s.updates, s.hook)
+
+			current, err = queryCurrentVersion(tx, s.table)
 			if err != nil {
 				return err
 			}
-		}
 
-		return nil
+			if s.check != nil {
+				err := s.check(current, tx)
+				if err == ErrGracefulAbort {
+					// Abort the update gracefully, committing what
+					// we've done so far.
+					aborted = true
+					return nil
+				}
+				if err != nil {
+					return err
+				}
+			}
+
+			// When creating the schema from scratch, use the fresh dump if
+			// available. Otherwise just apply all relevant updates.
+			if current == 0 && s.fresh != "" && version == len(s.updates) {
+				_, err = tx.Exec(s.fresh)
+				if err != nil {
+					return fmt.Errorf("cannot apply fresh schema: %v", err)
+				}
+			} else {
+				fingerprints := s.fingerprints()
+
+				err = checkUpdateFingerprints(tx, s.table, fingerprints)
+				if err != nil {
+					return err
+				}
+
+				if s.backup != "" && current < version {
+					err = writeBackup(tx, s.table, s.backup)
+					if err != nil {
+						return errors.Wrapf(err, "failed to back up database to %s", s.backup)
+					}
+				}
+
+				// A peer sharing the database might have already
+				// updated it past the given version.
+				target := version
+				if current > target && current <= len(s.updates) {
+					target = current
+				}
+
+				err = ensureUpdatesAreApplied(tx, s.table, current, s.updates[:target], s.hook, s.progress, fingerprints)
+				if err != nil {
+					return err
+				}
+			}
+
+			return nil
+		})
 	})
 	if err != nil {
 		return -1, err
@@ -192,6 +393,108 @@ func (s *Schema) Ensure(db *sql.DB) (int, error) {
 	return current, nil
 }
 
+// Plan returns the updates that Ensure would apply to the given database,
+// without changing it. Neither the queries set with File nor the Check
+// callback are run.
+//
+// When the schema would be created from scratch using the statement set with
+// Fresh, a single update carrying that statement is returned.
+func (s *Schema) Plan(db *sql.DB) ([]PendingUpdate, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	exists, err := doesSchemaTableExist(tx, s.table)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check if schema table is there: %v", err)
+	}
+
+	current := 0
+	if exists {
+		versions, err := selectSchemaVersions(tx, s.table)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch update versions: %v", err)
+		}
+
+		if len(versions) > 0 {
+			err = checkSchemaVersionsHaveNoHoles(versions)
+			if err != nil {
+				return nil, err
+			}
+
+			current = versions[len(versions)-1]
+		}
+	}
+
+	if current > len(s.updates) {
+		return nil, fmt.Errorf(
+			"schema version '%d' is more recent than expected '%d'",
+			current, len(s.updates))
+	}
+
+	if current == 0 && s.fresh != "" {
+		return []PendingUpdate{{Version: len(s.updates), SQL: s.fresh}}, nil
+	}
+
+	pending := []PendingUpdate{}
+	for version := current + 1; version <= len(s.updates); version++ {
+		pending = append(pending, PendingUpdate{Version: version, SQL: s.sql[version]})
+	}
+
+	return pending, nil
+}
+
+// Repair rewrites the schema table so that it records the given version as
+// the current one, regardless of what it holds. This is meant to recover from
+// an interrupted upgrade which left the schema table empty or corrupt on an
+// otherwise populated database, given a version known to match its content.
+// The schema table is created if missing.
+//
+// The given tables, which are expected to exist at that version, are checked
+// first. The schema table is rewritten transactionally, and remains unchanged
+// if any of them is missing.
+func (s *Schema) Repair(db *sql.DB, version int, tables ...string) error {
+	if version < 1 || version > len(s.updates) {
+		return fmt.Errorf("schema version '%d' is not between 1 and '%d'", version, len(s.updates))
+	}
+
+	if len(tables) == 0 {
+		return fmt.Errorf("no tables to check the schema version against")
+	}
+
+	return query.Transaction(db, func(tx *sql.Tx) error {
+		for _, table := range tables {
+			count, err := query.Count(tx, "sqlite_master", "type = 'table' AND name = ?", table)
+			if err != nil {
+				return fmt.Errorf("failed to check if table %s exists: %v", table, err)
+			}
+
+			if count == 0 {
+				return fmt.Errorf("table %s doesn't exist at schema version '%d'", table, version)
+			}
+		}
+
+		err := ensureSchemaTableExists(tx, s.table)
+		if err != nil {
+			return err
+		}
+
+		err = deleteSchemaVersions(tx, s.table)
+		if err != nil {
+			return fmt.Errorf("failed to delete versions: %v", err)
+		}
+
+		err = insertSchemaVersion(tx, s.table, version)
+		if err != nil {
+			return fmt.Errorf("failed to insert version %d", version)
+		}
+
+		return nil
+	})
+}
+
 // Dump returns a text of SQL commands that can be used to create this schema
 // from scratch in one go, without going thorugh individual patches
 // (essentially flattening them).
@@ -201,11 +504,11 @@ func (s *Schema) Ensure(db *sql.DB) (int, error) {
 func (s *Schema) Dump(db *sql.DB) (string, error) {
 	var statements []string
 	err := query.Transaction(db, func(tx *sql.Tx) error {
-		err := checkAllUpdatesAreApplied(tx, s.updates)
+		err := checkAllUpdatesAreApplied(tx, s.table, s.updates)
 		if err != nil {
 			return err
 		}
-		statements, err = selectTablesSQL(tx)
+		statements, err = selectTablesSQL(tx, s.table)
 		return err
 	})
 	if err != nil {
@@ -219,11 +522,34 @@ func (s *Schema) Dump(db *sql.DB) (string, error) {
 	statements = append(
 		statements,
 		fmt.Sprintf(`
-INSERT INTO schema (version, updated_at) VALUES (%d, strftime("%%s"))
-`, len(s.updates)))
+INSERT INTO %s (version, updated_at) VALUES (%d, strftime("%%s"))
+`, s.table, len(s.updates)))
 	return strings.Join(statements, ";\n"), nil
 }
 
+// DumpFresh is like Dump, but instead of a live database it uses a pristine
+// in-memory one on which all the updates in this schema get applied, so the
+// result doesn't depend on the state of any real database.
+//
+// Any fresh schema dump, queries file or hook set on this schema are ignored.
+func (s *Schema) DumpFresh() (string, error) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		return "", fmt.Errorf("failed to open memory database: %v", err)
+	}
+	defer db.Close()
+
+	schema := New(s.updates)
+	schema.Table(s.table)
+
+	_, err = schema.Ensure(db)
+	if err != nil {
+		return "", fmt.Errorf("failed to apply updates: %v", err)
+	}
+
+	return schema.Dump(db)
+}
+
 // Trim the schema updates to the given version (included). Updates with higher
 // versions will be discarded. Any fresh schema dump previously set will be
 // unset, since it's assumed to no longer be applicable. Return all updates
@@ -272,14 +598,28 @@ func (s *Schema) ExerciseUpdate(version int, hook func(*sql.DB)) (*sql.DB, error
 	return db, nil
 }
 
+// Return the fingerprints of the updates, by version.
+func (s *Schema) fingerprints() map[int]string {
+	fingerprints := map[int]string{}
+	for version, statement := range s.sql {
+		fingerprints[version] = fmt.Sprintf("%x", sha256.Sum256([]byte(statement)))
+	}
+
+	for version, checksum := range s.checksums {
+		fingerprints[version] = checksum
+	}
+
+	return fingerprints
+}
+
 // Ensure that the schema exists.
-func ensureSchemaTableExists(tx *sql.Tx) error {
-	exists, err := DoesSchemaTableExist(tx)
+func ensureSchemaTableExists(tx *sql.Tx, table string) error {
+	exists, err := doesSchemaTableExist(tx, table)
 	if err != nil {
 		return fmt.Errorf("failed to check if schema table is there: %v", err)
 	}
 	if !exists {
-		err := createSchemaTable(tx)
+		err := createSchemaTable(tx, table)
 		if err != nil {
 			return fmt.Errorf("failed to create schema table: %v", err)
 		}
@@ -289,8 +629,8 @@ func ensureSchemaTableExists(tx *sql.Tx) error {
 
 // Return the highest update version currently applied. Zero means that no
 // updates have been applied yet.
-func queryCurrentVersion(tx *sql.Tx) (int, error) {
-	versions, err := selectSchemaVersions(tx)
+func queryCurrentVersion(tx *sql.Tx, table string) (int, error) {
+	versions, err := selectSchemaVersions(tx, table)
 	if err != nil {
 		return -1, fmt.Errorf("failed to fetch update versions: %v", err)
 	}
@@ -298,12 +638,12 @@ func queryCurrentVersion(tx *sql.Tx) (int, error) {
 	// Fix bad upgrade code between 30 and 32
 	hasVersion := func(v int) bool { return shared.IntInSlice(v, versions) }
 	if hasVersion(30) && hasVersion(32) && !hasVersion(31) {
-		err = insertSchemaVersion(tx, 31)
+		err = insertSchemaVersion(tx, table, 31)
 		if err != nil {
 			return -1, fmt.Errorf("failed to insert missing schema version 31")
 		}
 
-		versions, err = selectSchemaVersions(tx)
+		versions, err = selectSchemaVersions(tx, table)
 		if err != nil {
 			return -1, fmt.Errorf("failed to fetch update versions: %v", err)
 		}
@@ -317,7 +657,7 @@ func queryCurrentVersion(tx *sql.Tx) (int, error) {
 		}
 		if count == 1 {
 			// Insert the missing version.
-			err := insertSchemaVersion(tx, 38)
+			err := insertSchemaVersion(tx, table, 38)
 			if err != nil {
 				return -1, fmt.Errorf("Failed to insert missing schema version 38")
 			}
@@ -337,8 +677,9 @@ func queryCurrentVersion(tx *sql.Tx) (int, error) {
 	return current, nil
 }
 
-// Apply any pending update that was not yet applied.
-func ensureUpdatesAreApplied(tx *sql.Tx, current int, updates []Update, hook Hook) error {
+// Apply any pending update that was not yet applied, recording the
+// fingerprints of those having one.
+func ensureUpdatesAreApplied(tx *sql.Tx, table string, current int, updates []Update, hook Hook, progress Progress, fingerprints map[int]string) error {
 	if current > len(updates) {
 		return fmt.Errorf(
 			"schema version '%d' is more recent than expected '%d'",
@@ -351,24 +692,107 @@ func ensureUpdatesAreApplied(tx *sql.Tx, current int, updates []Update, hook Hoo
 	}
 
 	// Apply missing updates.
+	initial := current
 	for _, update := range updates[current:] {
 		if hook != nil {
 			err := hook(current, tx)
 			if err != nil {
-				return fmt.Errorf(
-					"failed to execute hook (version %d): %v", current, err)
+				return &UpdateError{Version: current + 1, Hook: true, Err: err}
 			}
 		}
+
+		if progress != nil {
+			progress(current+1, current+1-initial, len(updates)-initial, len(updates))
+		}
 		err := update(tx)
 		if err != nil {
-			return fmt.Errorf("failed to apply update %d: %v", current, err)
+			return &UpdateError{Version: current + 1, Err: err}
 		}
 		current++
 
-		err = insertSchemaVersion(tx, current)
+		err = insertSchemaVersion(tx, table, current)
 		if err != nil {
 			return fmt.Errorf("failed to insert version %d", current)
 		}
+
+		if fingerprints[current] != "" {
+			err = updateSchemaFingerprint(tx, table, current, fingerprints[current])
+			if err != nil {
+				return fmt.Errorf("failed to record fingerprint of version %d: %v", current, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Check that the applied updates still match their fingerprints. Updates
+// applied without a fingerprint, such as before one was declared, or from a
+// fresh dump, can't be checked.
+func checkUpdateFingerprints(tx *sql.Tx, table string, fingerprints map[int]string) error {
+	if len(fingerprints) == 0 {
+		return nil
+	}
+
+	applied, err := selectSchemaFingerprints(tx, table)
+	if err != nil {
+		return fmt.Errorf("failed to fetch update fingerprints: %v", err)
+	}
+
+	versions := []int{}
+	for version := range applied {
+		versions = append(versions, version)
+	}
+
+	sort.Ints(versions)
+
+	for _, version := range versions {
+		expected, ok := fingerprints[version]
+		if !ok || expected == applied[version] {
+			continue
+		}
+
+		return fmt.Errorf(
+			"update %d changed since it was applied: fingerprint '%s' doesn't match applied '%s'",
+			version, expected, applied[version])
+	}
+
+	return nil
+}
+
+// Revert the updates applied after the given version, latest first.
+func ensureUpdatesAreRolledBack(tx *sql.Tx, table string, current int, version int, rollbacks map[int]Update) error {
+	// Check upfront that all updates can be reverted.
+	for v := current; v > version; v-- {
+		if rollbacks[v] == nil {
+			return fmt.Errorf("update %d has no rollback", v)
+		}
+	}
+
+	for v := current; v > version; v-- {
+		err := rollbacks[v](tx)
+		if err != nil {
+			return fmt.Errorf("failed to roll back update %d: %v", v, err)
+		}
+
+		err = deleteSchemaVersion(tx, table, v)
+		if err != nil {
+			return fmt.Errorf("failed to delete version %d", v)
+		}
+	}
+
+	// A schema created from a fresh dump only records its latest version,
+	// which is gone now.
+	versions, err := selectSchemaVersions(tx, table)
+	if err != nil {
+		return fmt.Errorf("failed to fetch update versions: %v", err)
+	}
+
+	if version > 0 && !shared.IntInSlice(version, versions) {
+		err = insertSchemaVersion(tx, table, version)
+		if err != nil {
+			return fmt.Errorf("failed to insert version %d", version)
+		}
 	}
 
 	return nil
@@ -388,8 +812,8 @@ func checkSchemaVersionsHaveNoHoles(versions []int) error {
 }
 
 // Check that all the given updates are applied.
-func checkAllUpdatesAreApplied(tx *sql.Tx, updates []Update) error {
-	versions, err := selectSchemaVersions(tx)
+func checkAllUpdatesAreApplied(tx *sql.Tx, table string, updates []Update) error {
+	versions, err := selectSchemaVersions(tx, table)
 	if err != nil {
 		return fmt.Errorf("failed to fetch update versions: %v", err)
 	}
@@ -3,8 +3,12 @@ package schema_test
 import (
 	"database/sql"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -37,6 +41,32 @@ func TestNewFromMap_MissingVersions(t *testing.T) {
 	}, "updates map misses version 2")
 }
 
+// Panic if any of the given updates is nil, before touching any database.
+func TestNew_NilUpdate(t *testing.T) {
+	assert.PanicsWithValue(t, "update at index 1 (version 2) is nil", func() {
+		schema.New([]schema.Update{updateCreateTable, nil})
+	})
+}
+
+// Panic if the update being added is nil.
+func TestSchemaAdd_NilUpdate(t *testing.T) {
+	s := schema.Empty()
+	s.Add(updateCreateTable)
+	assert.PanicsWithValue(t, "update at index 1 (version 2) is nil", func() {
+		s.Add(nil)
+	})
+}
+
+// Panic if any of the updates in the map is nil.
+func TestNewFromMap_NilUpdate(t *testing.T) {
+	assert.PanicsWithValue(t, "update for version 2 is nil", func() {
+		schema.NewFromMap(map[int]schema.Update{
+			1: updateCreateTable,
+			2: nil,
+		})
+	})
+}
+
 // If the database schema version is more recent than our update series, an
 // error is returned.
 func TestSchemaEnsure_VersionMoreRecentThanExpected(t *testing.T) {
@@ -184,11 +214,17 @@ func TestSchemaEnsure_OnlyApplyMissing(t *testing.T) {
 // If a update fails, an error is returned, and all previous changes are rolled
 // back.
 func TestSchemaEnsure_FailingUpdate(t *testing.T) {
-	schema, db := newSchemaAndDB(t)
-	schema.Add(updateCreateTable)
-	schema.Add(updateBoom)
-	_, err := schema.Ensure(db)
-	assert.EqualError(t, err, "failed to apply update 1: boom")
+	s, db := newSchemaAndDB(t)
+	s.Add(updateCreateTable)
+	s.Add(updateBoom)
+	_, err := s.Ensure(db)
+	assert.EqualError(t, err, "failed to apply update 2: boom")
+
+	updateErr, ok := err.(*schema.UpdateError)
+	require.True(t, ok)
+	assert.Equal(t, 2, updateErr.Version)
+	assert.False(t, updateErr.Hook)
+	assert.EqualError(t, updateErr.Err, "boom")
 
 	tx, err := db.Begin()
 	assert.NoError(t, err)
@@ -203,11 +239,16 @@ func TestSchemaEnsure_FailingUpdate(t *testing.T) {
 // If a hook fails, an error is returned, and all previous changes are rolled
 // back.
 func TestSchemaEnsure_FailingHook(t *testing.T) {
-	schema, db := newSchemaAndDB(t)
-	schema.Add(updateCreateTable)
-	schema.Hook(func(int, *sql.Tx) error { return fmt.Errorf("boom") })
-	_, err := schema.Ensure(db)
-	assert.EqualError(t, err, "failed to execute hook (version 0): boom")
+	s, db := newSchemaAndDB(t)
+	s.Add(updateCreateTable)
+	s.Hook(func(int, *sql.Tx) error { return fmt.Errorf("boom") })
+	_, err := s.Ensure(db)
+	assert.EqualError(t, err, "failed to execute hook before update 1: boom")
+
+	updateErr, ok := err.(*schema.UpdateError)
+	require.True(t, ok)
+	assert.Equal(t, 1, updateErr.Version)
+	assert.True(t, updateErr.Hook)
 
 	tx, err := db.Begin()
 	assert.NoError(t, err)
@@ -219,6 +260,28 @@ func TestSchemaEnsure_FailingHook(t *testing.T) {
 	assert.NotContains(t, tables, "test")
 }
 
+// The progress callback is told about each update being applied, among all
+// pending updates.
+func TestSchemaEnsure_Progress(t *testing.T) {
+	schema, db := newSchemaAndDB(t)
+	schema.Add(updateCreateTable)
+	_, err := schema.Ensure(db)
+	require.NoError(t, err)
+
+	schema.Add(updateInsertValue)
+	schema.Add(updateAddColumn)
+	schema.Add(updateNoop)
+
+	calls := [][]int{}
+	schema.Progress(func(version int, n int, total int, target int) {
+		calls = append(calls, []int{version, n, total, target})
+	})
+
+	_, err = schema.Ensure(db)
+	require.NoError(t, err)
+	assert.Equal(t, [][]int{{2, 1, 3, 4}, {3, 2, 3, 4}, {4, 3, 3, 4}}, calls)
+}
+
 // If the schema check callback returns ErrGracefulAbort, the process is
 // aborted, although every change performed so far gets still committed.
 func TestSchemaEnsure_CheckGracefulAbort(t *testing.T) {
@@ -288,6 +351,26 @@ func TestSchemaDump_MissingUpdatees(t *testing.T) {
 	assert.EqualError(t, err, "update level is 1, expected 2")
 }
 
+// DumpFresh() flattens all updates regardless of the state of any database,
+// and matches what Dump() returns for a fully upgraded one.
+func TestSchemaDumpFresh(t *testing.T) {
+	schema, db := newSchemaAndDB(t)
+	schema.Add(updateCreateTable)
+	_, err := schema.Ensure(db)
+	require.NoError(t, err)
+	schema.Add(updateAddColumn)
+
+	dump, err := schema.DumpFresh()
+	require.NoError(t, err)
+
+	_, err = schema.Ensure(db)
+	require.NoError(t, err)
+
+	expected, err := schema.Dump(db)
+	require.NoError(t, err)
+	assert.Equal(t, expected, dump)
+}
+
 // After trimming a schema, only the updates up to the trim point are applied.
 func TestSchema_Trim(t *testing.T) {
 	updates := map[int]schema.Update{
@@ -434,6 +517,617 @@ func TestSchema_File_Hook(t *testing.T) {
 	assert.Equal(t, []int{1, 2}, ids)
 }
 
+// Plan returns the updates that are not applied yet, without applying them.
+func TestSchemaPlan(t *testing.T) {
+	s, db := newSchemaAndDB(t)
+	s.Add(updateCreateTable)
+	_, err := s.Ensure(db)
+	require.NoError(t, err)
+
+	s.Add(updateInsertValue)
+	s.Add(updateAddColumn)
+	s.Describe(3, "ALTER TABLE test ADD COLUMN name TEXT")
+
+	pending, err := s.Plan(db)
+	require.NoError(t, err)
+	assert.Equal(t, []schema.PendingUpdate{
+		{Version: 2},
+		{Version: 3, SQL: "ALTER TABLE test ADD COLUMN name TEXT"},
+	}, pending)
+
+	tx, err := db.Begin()
+	require.NoError(t, err)
+
+	// The schema version wasn't bumped, and no update was applied.
+	versions, err := query.SelectIntegers(tx, "SELECT version FROM schema")
+	require.NoError(t, err)
+	assert.Equal(t, []int{1}, versions)
+
+	ids, err := query.SelectIntegers(tx, "SELECT id FROM test")
+	require.NoError(t, err)
+	assert.Equal(t, []int{}, ids)
+	require.NoError(t, tx.Rollback())
+
+	// Nothing is pending once the updates are applied.
+	_, err = s.Ensure(db)
+	require.NoError(t, err)
+
+	pending, err = s.Plan(db)
+	require.NoError(t, err)
+	assert.Equal(t, []schema.PendingUpdate{}, pending)
+}
+
+// Planning against a new database doesn't create the schema table.
+func TestSchemaPlan_NewDatabase(t *testing.T) {
+	s, db := newSchemaAndDB(t)
+	s.Add(updateCreateTable)
+	s.Add(updateInsertValue)
+
+	pending, err := s.Plan(db)
+	require.NoError(t, err)
+	assert.Equal(t, []schema.PendingUpdate{{Version: 1}, {Version: 2}}, pending)
+
+	tx, err := db.Begin()
+	require.NoError(t, err)
+
+	tables, err := query.SelectStrings(tx, "SELECT name FROM sqlite_master WHERE type = 'table'")
+	require.NoError(t, err)
+	assert.NotContains(t, tables, "schema")
+}
+
+// When the schema would be created from a fresh dump, the dump is the only
+// pending update.
+func TestSchemaPlan_Fresh(t *testing.T) {
+	s, db := newSchemaAndDB(t)
+	s.Add(updateCreateTable)
+	s.Add(updateInsertValue)
+	s.Fresh("CREATE TABLE test (id INTEGER)")
+
+	pending, err := s.Plan(db)
+	require.NoError(t, err)
+	assert.Equal(t, []schema.PendingUpdate{{Version: 2, SQL: "CREATE TABLE test (id INTEGER)"}}, pending)
+}
+
+// The fingerprints of applied updates are recorded, and checked the next
+// times the schema is ensured.
+func TestSchemaEnsure_Fingerprint(t *testing.T) {
+	schema, db := newSchemaAndDB(t)
+	schema.Add(updateCreateTable)
+	schema.Add(updateInsertValue)
+	schema.Fingerprint(1, "abc")
+	schema.Describe(2, "INSERT INTO test VALUES (1)")
+
+	_, err := schema.Ensure(db)
+	require.NoError(t, err)
+
+	tx, err := db.Begin()
+	require.NoError(t, err)
+
+	fingerprints, err := query.SelectStrings(tx, "SELECT fingerprint FROM schema ORDER BY version")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"abc", "2a50dd105d4e2568c376511cacb58a4a1f3b91b5311b0cdd233362f2309c8ef0"}, fingerprints)
+	require.NoError(t, tx.Rollback())
+
+	// Nothing changed.
+	_, err = schema.Ensure(db)
+	require.NoError(t, err)
+
+	// The SQL of an applied update changed.
+	schema.Describe(2, "INSERT INTO test VALUES (2)")
+	_, err = schema.Ensure(db)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "update 2 changed since it was applied")
+
+	// The declared checksum of an applied update changed.
+	schema.Describe(2, "INSERT INTO test VALUES (1)")
+	schema.Fingerprint(1, "def")
+	_, err = schema.Ensure(db)
+	assert.EqualError(t, err, "update 1 changed since it was applied: fingerprint 'def' doesn't match applied 'abc'")
+}
+
+// Schema tables created before fingerprints were recorded get the fingerprint
+// column once an update with a fingerprint is applied. Updates applied before
+// can't be checked.
+func TestSchemaEnsure_FingerprintLegacyTable(t *testing.T) {
+	schema, db := newSchemaAndDB(t)
+	schema.Add(updateCreateTable)
+
+	_, err := schema.Ensure(db)
+	require.NoError(t, err)
+
+	schema.Fingerprint(1, "abc")
+	schema.Add(updateInsertValue)
+	schema.Fingerprint(2, "def")
+
+	_, err = schema.Ensure(db)
+	require.NoError(t, err)
+
+	tx, err := db.Begin()
+	require.NoError(t, err)
+
+	fingerprints, err := query.SelectStrings(tx, "SELECT COALESCE(fingerprint, '') FROM schema ORDER BY version")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"", "def"}, fingerprints)
+}
+
+// Before applying pending updates, a dump of the database is written, which
+// restores the database as it was before the updates.
+func TestSchemaEnsure_BackupBefore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lxd-db-schema-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "backup.sql")
+
+	schema, db := newSchemaAndDB(t)
+	schema.Add(updateCreateTable)
+	schema.Add(updateInsertValue)
+	_, err = schema.Ensure(db)
+	require.NoError(t, err)
+
+	_, err = db.Exec("INSERT INTO test VALUES (2)")
+	require.NoError(t, err)
+
+	schema.Add(updateAddColumn)
+	schema.BackupBefore(path)
+	_, err = schema.Ensure(db)
+	require.NoError(t, err)
+
+	dump, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+
+	db = newDB(t)
+	_, err = db.Exec(string(dump))
+	require.NoError(t, err)
+
+	tx, err := db.Begin()
+	require.NoError(t, err)
+
+	versions, err := query.SelectIntegers(tx, "SELECT version FROM schema")
+	require.NoError(t, err)
+	assert.Equal(t, []int{1, 2}, versions)
+
+	ids, err := query.SelectIntegers(tx, "SELECT id FROM test ORDER BY id")
+	require.NoError(t, err)
+	assert.Equal(t, []int{1, 2}, ids)
+
+	// The column added by the last update isn't there.
+	_, err = query.SelectStrings(tx, "SELECT name FROM test")
+	require.EqualError(t, err, "no such column: name")
+}
+
+// No backup is written if there's no pending update.
+func TestSchemaEnsure_BackupBeforeNoUpdates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lxd-db-schema-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "backup.sql")
+
+	schema, db := newSchemaAndDB(t)
+	schema.Add(updateCreateTable)
+	_, err = schema.Ensure(db)
+	require.NoError(t, err)
+
+	schema.BackupBefore(path)
+	_, err = schema.Ensure(db)
+	require.NoError(t, err)
+
+	assert.False(t, shared.PathExists(path))
+}
+
+// A backup can't be taken with a custom schema table, as query.Dump expects
+// the default one.
+func TestSchemaEnsure_BackupBeforeCustomTable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lxd-db-schema-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "backup.sql")
+
+	schema, db := newSchemaAndDB(t)
+	schema.Table("lxd_schema")
+	schema.Add(updateCreateTable)
+	_, err = schema.Ensure(db)
+	require.NoError(t, err)
+
+	schema.Add(updateInsertValue)
+	schema.BackupBefore(path)
+	_, err = schema.Ensure(db)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "cannot dump schema table lxd_schema")
+	assert.False(t, shared.PathExists(path))
+}
+
+// The applied updates are tracked in the table set with Table(), and Dump()
+// records the version in it.
+func TestSchemaEnsure_CustomTable(t *testing.T) {
+	s, db := newSchemaAndDB(t)
+	s.Table("lxd_schema")
+	s.Add(updateCreateTable)
+	s.Add(updateInsertValue)
+	_, err := s.Ensure(db)
+	require.NoError(t, err)
+
+	tx, err := db.Begin()
+	require.NoError(t, err)
+
+	versions, err := query.SelectIntegers(tx, "SELECT version FROM lxd_schema")
+	require.NoError(t, err)
+	assert.Equal(t, []int{1, 2}, versions)
+
+	exists, err := schema.DoesSchemaTableExist(tx)
+	require.NoError(t, err)
+	assert.False(t, exists)
+	require.NoError(t, tx.Rollback())
+
+	dump, err := s.Dump(db)
+	require.NoError(t, err)
+	assert.Contains(t, dump, "INSERT INTO lxd_schema (version, updated_at) VALUES (2,")
+	assert.NotContains(t, dump, "CREATE TABLE lxd_schema")
+
+	initial, err := s.Ensure(db)
+	require.NoError(t, err)
+	assert.Equal(t, 2, initial)
+}
+
+// Updates past the target version are left pending, and get applied by a
+// later call to Ensure.
+func TestSchemaEnsureTo(t *testing.T) {
+	schema, db := newSchemaAndDB(t)
+	schema.Add(updateCreateTable)
+	schema.Add(updateInsertValue)
+	schema.Add(updateAddColumn)
+
+	initial, err := schema.EnsureTo(db, 2)
+	require.NoError(t, err)
+	assert.Equal(t, 0, initial)
+
+	tx, err := db.Begin()
+	require.NoError(t, err)
+
+	versions, err := query.SelectIntegers(tx, "SELECT version FROM schema")
+	require.NoError(t, err)
+	assert.Equal(t, []int{1, 2}, versions)
+
+	// The column from the third update hasn't been added yet.
+	_, err = query.SelectIntegers(tx, "SELECT name FROM test")
+	require.EqualError(t, err, "no such column: name")
+	require.NoError(t, tx.Rollback())
+
+	initial, err = schema.Ensure(db)
+	require.NoError(t, err)
+	assert.Equal(t, 2, initial)
+
+	tx, err = db.Begin()
+	require.NoError(t, err)
+
+	versions, err = query.SelectIntegers(tx, "SELECT version FROM schema")
+	require.NoError(t, err)
+	assert.Equal(t, []int{1, 2, 3}, versions)
+	require.NoError(t, tx.Rollback())
+}
+
+// If the database was already updated past the target version, for example by
+// a peer, nothing is applied.
+func TestSchemaEnsureTo_AlreadyPastVersion(t *testing.T) {
+	schema, db := newSchemaAndDB(t)
+	schema.Add(updateCreateTable)
+	schema.Add(updateInsertValue)
+	_, err := schema.Ensure(db)
+	require.NoError(t, err)
+
+	initial, err := schema.EnsureTo(db, 1)
+	require.NoError(t, err)
+	assert.Equal(t, 2, initial)
+}
+
+// The fresh schema dump is not used when stopping at an intermediate
+// version, since it reflects the latest one.
+func TestSchemaEnsureTo_SkipFreshSchema(t *testing.T) {
+	schema, db := newSchemaAndDB(t)
+	schema.Add(updateCreateTable)
+	schema.Add(updateInsertValue)
+	schema.Fresh("garbage")
+
+	_, err := schema.EnsureTo(db, 1)
+	require.NoError(t, err)
+
+	tx, err := db.Begin()
+	require.NoError(t, err)
+
+	versions, err := query.SelectIntegers(tx, "SELECT version FROM schema")
+	require.NoError(t, err)
+	assert.Equal(t, []int{1}, versions)
+	require.NoError(t, tx.Rollback())
+}
+
+// The target version must be within the range of the defined updates.
+func TestSchemaEnsureTo_InvalidVersion(t *testing.T) {
+	schema, db := newSchemaAndDB(t)
+	schema.Add(updateCreateTable)
+
+	_, err := schema.EnsureTo(db, 2)
+	require.EqualError(t, err, "schema version '2' is not between 0 and '1'")
+}
+
+// Concurrent calls to Ensure against the same database, such as from cluster
+// nodes starting at the same time, apply the updates exactly once.
+func TestSchemaEnsure_Concurrent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lxd-db-schema-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "db.sqlite")
+
+	// Hold the write lock for a while, so the two transactions overlap.
+	updateSlow := func(tx *sql.Tx) error {
+		time.Sleep(100 * time.Millisecond)
+		return updateCreateTable(tx)
+	}
+
+	initials := make([]int, 2)
+	errs := make([]error, 2)
+
+	wg := sync.WaitGroup{}
+	for i := range initials {
+		db, err := sql.Open("sqlite3", path)
+		require.NoError(t, err)
+		defer db.Close()
+
+		wg.Add(1)
+		go func(i int, db *sql.DB) {
+			defer wg.Done()
+
+			s := schema.Empty()
+			s.Add(updateSlow)
+			s.Add(updateInsertValue)
+			initials[i], errs[i] = s.Ensure(db)
+		}(i, db)
+	}
+
+	wg.Wait()
+
+	require.NoError(t, errs[0])
+	require.NoError(t, errs[1])
+	assert.ElementsMatch(t, []int{0, 2}, initials)
+
+	db, err := sql.Open("sqlite3", path)
+	require.NoError(t, err)
+	defer db.Close()
+
+	tx, err := db.Begin()
+	require.NoError(t, err)
+
+	versions, err := query.SelectIntegers(tx, "SELECT version FROM schema")
+	require.NoError(t, err)
+	assert.Equal(t, []int{1, 2}, versions)
+
+	ids, err := query.SelectIntegers(tx, "SELECT id FROM test")
+	require.NoError(t, err)
+	assert.Equal(t, []int{1}, ids)
+	require.NoError(t, tx.Rollback())
+}
+
+// Repairing a schema table which lost its version rows records the given
+// version, from which the remaining updates are applied.
+func TestSchemaRepair(t *testing.T) {
+	schema, db := newSchemaAndDB(t)
+	schema.Add(updateCreateTable)
+	schema.Add(updateInsertValue)
+	_, err := schema.Ensure(db)
+	require.NoError(t, err)
+
+	_, err = db.Exec("DELETE FROM schema")
+	require.NoError(t, err)
+
+	_, err = schema.Ensure(db)
+	require.EqualError(t, err, "failed to apply update 1: table test already exists")
+
+	err = schema.Repair(db, 2, "test")
+	require.NoError(t, err)
+
+	tx, err := db.Begin()
+	require.NoError(t, err)
+
+	versions, err := query.SelectIntegers(tx, "SELECT version FROM schema")
+	require.NoError(t, err)
+	assert.Equal(t, []int{2}, versions)
+	require.NoError(t, tx.Rollback())
+
+	schema.Add(updateAddColumn)
+	initial, err := schema.Ensure(db)
+	require.NoError(t, err)
+	assert.Equal(t, 2, initial)
+}
+
+// The schema table is left alone if a table expected at the given version is
+// missing.
+func TestSchemaRepair_MissingTable(t *testing.T) {
+	schema, db := newSchemaAndDB(t)
+	schema.Add(updateCreateTable)
+	schema.Add(updateNoop)
+	_, err := schema.Ensure(db)
+	require.NoError(t, err)
+
+	err = schema.Repair(db, 1, "test", "other")
+	require.EqualError(t, err, "table other doesn't exist at schema version '1'")
+
+	tx, err := db.Begin()
+	require.NoError(t, err)
+
+	versions, err := query.SelectIntegers(tx, "SELECT version FROM schema")
+	require.NoError(t, err)
+	assert.Equal(t, []int{1, 2}, versions)
+}
+
+// The version to repair the schema table with must be a known one.
+func TestSchemaRepair_InvalidVersion(t *testing.T) {
+	schema, db := newSchemaAndDB(t)
+	schema.Add(updateCreateTable)
+
+	err := schema.Repair(db, 2, "test")
+	require.EqualError(t, err, "schema version '2' is not between 1 and '1'")
+}
+
+// Downgrades must be explicitly allowed.
+func TestSchemaDowngradeTo_NotAllowed(t *testing.T) {
+	schema, db := newSchemaAndDB(t)
+	schema.Add(updateCreateTable)
+	schema.Rollback(1, rollbackCreateTable)
+	_, err := schema.Ensure(db)
+	require.NoError(t, err)
+
+	_, err = schema.DowngradeTo(db, 0)
+	assert.EqualError(t, err, "schema downgrades are not allowed")
+}
+
+// Downgrading applies the rollbacks of the updates past the given version, in
+// reverse order.
+func TestSchemaDowngradeTo(t *testing.T) {
+	schema, db := newSchemaAndDB(t)
+	schema.Add(updateCreateTable)
+	schema.Add(updateInsertValue)
+	schema.Add(updateNoop)
+
+	rolledBack := []int{}
+	schema.Rollback(1, rollbackCreateTable)
+	schema.Rollback(2, func(tx *sql.Tx) error {
+		rolledBack = append(rolledBack, 2)
+		_, err := tx.Exec("DELETE FROM test WHERE id = 1")
+		return err
+	})
+	schema.Rollback(3, func(tx *sql.Tx) error {
+		rolledBack = append(rolledBack, 3)
+		return nil
+	})
+	schema.AllowDowngrade()
+
+	_, err := schema.Ensure(db)
+	require.NoError(t, err)
+
+	initial, err := schema.DowngradeTo(db, 1)
+	require.NoError(t, err)
+	assert.Equal(t, 3, initial)
+	assert.Equal(t, []int{3, 2}, rolledBack)
+
+	tx, err := db.Begin()
+	require.NoError(t, err)
+
+	versions, err := query.SelectIntegers(tx, "SELECT version FROM schema")
+	require.NoError(t, err)
+	assert.Equal(t, []int{1}, versions)
+
+	ids, err := query.SelectIntegers(tx, "SELECT id FROM test")
+	require.NoError(t, err)
+	assert.Equal(t, []int{}, ids)
+	require.NoError(t, tx.Rollback())
+
+	// The reverted updates are applied again by Ensure.
+	initial, err = schema.Ensure(db)
+	require.NoError(t, err)
+	assert.Equal(t, 1, initial)
+}
+
+// If an update to revert has no rollback, an error is returned and nothing is
+// reverted.
+func TestSchemaDowngradeTo_MissingRollback(t *testing.T) {
+	schema, db := newSchemaAndDB(t)
+	schema.Add(updateCreateTable)
+	schema.Add(updateInsertValue)
+	schema.Rollback(1, rollbackCreateTable)
+	schema.AllowDowngrade()
+
+	_, err := schema.Ensure(db)
+	require.NoError(t, err)
+
+	_, err = schema.DowngradeTo(db, 0)
+	assert.EqualError(t, err, "update 2 has no rollback")
+
+	tx, err := db.Begin()
+	require.NoError(t, err)
+
+	versions, err := query.SelectIntegers(tx, "SELECT version FROM schema")
+	require.NoError(t, err)
+	assert.Equal(t, []int{1, 2}, versions)
+}
+
+// If a rollback fails, an error is returned, and all previous changes are
+// rolled back.
+func TestSchemaDowngradeTo_FailingRollback(t *testing.T) {
+	schema, db := newSchemaAndDB(t)
+	schema.Add(updateCreateTable)
+	schema.Add(updateNoop)
+	schema.Rollback(1, updateBoom)
+	schema.Rollback(2, updateNoop)
+	schema.AllowDowngrade()
+
+	_, err := schema.Ensure(db)
+	require.NoError(t, err)
+
+	_, err = schema.DowngradeTo(db, 0)
+	assert.EqualError(t, err, "failed to roll back update 1: boom")
+
+	tx, err := db.Begin()
+	require.NoError(t, err)
+
+	versions, err := query.SelectIntegers(tx, "SELECT version FROM schema")
+	require.NoError(t, err)
+	assert.Equal(t, []int{1, 2}, versions)
+}
+
+// A schema created from a fresh dump keeps recording its version once
+// downgraded.
+func TestSchemaDowngradeTo_AfterInitialDumpCreation(t *testing.T) {
+	schema, db := newSchemaAndDB(t)
+	schema.Add(updateCreateTable)
+	schema.Add(updateAddColumn)
+	_, err := schema.Ensure(db)
+	require.NoError(t, err)
+
+	dump, err := schema.Dump(db)
+	require.NoError(t, err)
+
+	_, db = newSchemaAndDB(t)
+	schema.Fresh(dump)
+	schema.Rollback(2, func(tx *sql.Tx) error {
+		_, err := tx.Exec(`
+CREATE TABLE test2 (id INTEGER);
+DROP TABLE test;
+ALTER TABLE test2 RENAME TO test;
+`)
+		return err
+	})
+	schema.AllowDowngrade()
+
+	_, err = schema.Ensure(db)
+	require.NoError(t, err)
+
+	initial, err := schema.DowngradeTo(db, 1)
+	require.NoError(t, err)
+	assert.Equal(t, 2, initial)
+
+	tx, err := db.Begin()
+	require.NoError(t, err)
+
+	versions, err := query.SelectIntegers(tx, "SELECT version FROM schema")
+	require.NoError(t, err)
+	assert.Equal(t, []int{1}, versions)
+}
+
+// The database can't be downgraded to a version it's not at yet.
+func TestSchemaDowngradeTo_VersionMoreRecentThanCurrent(t *testing.T) {
+	schema, db := newSchemaAndDB(t)
+	schema.Add(updateCreateTable)
+	schema.AllowDowngrade()
+
+	_, err := schema.Ensure(db)
+	require.NoError(t, err)
+
+	_, err = schema.DowngradeTo(db, 2)
+	assert.EqualError(t, err, "schema version '1' is older than requested '2'")
+}
+
 // Return a new in-memory SQLite database.
 func newDB(t *testing.T) *sql.DB {
 	db, err := sql.Open("sqlite3", ":memory:")
@@ -473,3 +1167,9 @@ func updateAddColumn(tx *sql.Tx) error {
 func updateBoom(tx *sql.Tx) error {
 	return fmt.Errorf("boom")
 }
+
+// A rollback that drops the test table.
+func rollbackCreateTable(tx *sql.Tx) error {
+	_, err := tx.Exec("DROP TABLE test")
+	return err
+}
@@ -1,7 +1,6 @@
 package schema
 
 import (
-	"database/sql"
 	"fmt"
 	"os"
 	"path"
@@ -18,19 +17,7 @@ import (
 func DotGo(updates map[int]Update, name string) error {
 	// Apply all the updates that we have on a pristine database and dump
 	// the resulting schema.
-	db, err := sql.Open("sqlite3", ":memory:")
-	if err != nil {
-		return fmt.Errorf("failed to open schema.go for writing: %v", err)
-	}
-
-	schema := NewFromMap(updates)
-
-	_, err = schema.Ensure(db)
-	if err != nil {
-		return err
-	}
-
-	dump, err := schema.Dump(db)
+	dump, err := NewFromMap(updates).DumpFresh()
 	if err != nil {
 		return err
 	}
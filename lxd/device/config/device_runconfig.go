@@ -9,6 +9,21 @@ const MountOwnerShiftDynamic = "dynamic"
 // MountOwnerShiftStatic statically modify ownership.
 const MountOwnerShiftStatic = "static"
 
+// MountOptCDROM indicates that a VM drive should be presented as a read-only CD-ROM.
+const MountOptCDROM = "cdrom"
+
+// MountOptCache prefixes the option setting the host cache mode of a VM drive.
+const MountOptCache = "cache="
+
+// MountOptAIO prefixes the option setting the async I/O mode of a VM drive.
+const MountOptAIO = "aio="
+
+// MountOptBus prefixes the option setting the bus a VM drive is attached to.
+const MountOptBus = "bus="
+
+// MountOptFormat prefixes the option setting the image format of a VM drive, raw if not set.
+const MountOptFormat = "format="
+
 // RunConfigItem represents a single config item.
 type RunConfigItem struct {
 	Key   string
@@ -37,6 +52,11 @@ type RootFSEntryItem struct {
 type RunConfig struct {
 	RootFS           RootFSEntryItem  // RootFS to setup.
 	NetworkInterface []RunConfigItem  // Network interface configuration settings.
+	GPUDevice        []RunConfigItem  // GPU device configuration settings.
+	USBDevice        []RunConfigItem  // USB device configuration settings.
+	SerialDevice     []RunConfigItem  // Serial device configuration settings.
+	SharedMemDevice  []RunConfigItem  // Shared memory device configuration settings.
+	DiskResize       []RunConfigItem  // Disk devices whose volume was resized.
 	CGroups          []RunConfigItem  // Cgroup rules to setup.
 	Mounts           []MountEntryItem // Mounts to setup/remove.
 	Uevents          [][]string       // Uevents to inject.
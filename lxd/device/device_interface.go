@@ -50,6 +50,15 @@ type Device interface {
 	Remove() error
 }
 
+// DryRunner is implemented by devices able to describe how they are passed to a VM without setting
+// anything up on the host, for rendering the VM's configuration.
+type DryRunner interface {
+	// DryRun returns the run-time configuration Start would return for a VM, derived from the device
+	// config and the host's current state. Returns nil if that depends on host side resources which
+	// only Start resolves or sets up.
+	DryRun() (*deviceConfig.RunConfig, error)
+}
+
 // device represents a sealed interface that implements Device, but also contains some internal
 // setup functions for a Device that should only be called by device.New() to avoid exposing devices
 // that are not in a known configured state. This is separate from the Device interface so that
@@ -19,6 +19,8 @@ var devTypes = map[string]func(deviceConfig.Device) device{
 	"unix-block":   func(c deviceConfig.Device) device { return &unixCommon{} },
 	"unix-hotplug": func(c deviceConfig.Device) device { return &unixHotplug{} },
 	"disk":         func(c deviceConfig.Device) device { return &disk{} },
+	"serial":       func(c deviceConfig.Device) device { return &serial{} },
+	"shm":          func(c deviceConfig.Device) device { return &shm{} },
 	"none":         func(c deviceConfig.Device) device { return &none{} },
 }
 
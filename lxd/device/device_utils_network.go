@@ -294,9 +294,15 @@ func networkCreateVethPair(hostName string, m deviceConfig.Device) (string, erro
 	return peerName, nil
 }
 
-// networkCreateTap creates and configures a TAP device.
-func networkCreateTap(hostName string, m deviceConfig.Device) error {
-	_, err := shared.RunCommand("ip", "tuntap", "add", "name", hostName, "mode", "tap")
+// networkCreateTap creates and configures a TAP device. If multiQueue is true the TAP device is
+// created with support for multiple queues.
+func networkCreateTap(hostName string, m deviceConfig.Device, multiQueue bool) error {
+	args := []string{"tuntap", "add", "name", hostName, "mode", "tap"}
+	if multiQueue {
+		args = append(args, "multi_queue")
+	}
+
+	_, err := shared.RunCommand("ip", args...)
 	if err != nil {
 		return errors.Wrapf(err, "Failed to create the tap interfaces %s", hostName)
 	}
@@ -333,10 +339,40 @@ func networkCreateTap(hostName string, m deviceConfig.Device) error {
 		}
 	}
 
+	err = networkSetOffloads(hostName, m)
+	if err != nil {
+		return err
+	}
+
 	revert.Success()
 	return nil
 }
 
+// networkSetOffloads turns off the offloads disabled on a VM NIC on its host side interface. That's the
+// checksum and segmentation offloads of the packets sent to the VM with offload.rx, and the aggregation
+// of the ones it sends with offload.tx.
+func networkSetOffloads(hostName string, m deviceConfig.Device) error {
+	args := []string{"-K", hostName}
+	if nicOffloadDisabled(m, "offload.rx") {
+		args = append(args, "tx", "off", "tso", "off", "gso", "off")
+	}
+
+	if nicOffloadDisabled(m, "offload.tx") {
+		args = append(args, "gro", "off")
+	}
+
+	if len(args) == 2 {
+		return nil
+	}
+
+	_, err := shared.RunCommand("ethtool", args...)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to turn off the offloads of %s", hostName)
+	}
+
+	return nil
+}
+
 // networkSetupHostVethDevice configures a nic device's host side veth settings.
 func networkSetupHostVethDevice(device deviceConfig.Device, oldDevice deviceConfig.Device, v map[string]string) error {
 	// If not configured, check if volatile data contains the most recently added host_name.
@@ -464,7 +500,14 @@ func networkRemoveVethRoutes(m deviceConfig.Device) {
 	}
 }
 
+// networkTC runs tc with the given arguments and returns its output. Tests replace it to record the
+// commands instead.
+var networkTC = func(args ...string) (string, error) {
+	return shared.RunCommand("tc", args...)
+}
+
 // networkSetVethLimits applies any network rate limits to the veth device specified in the config.
+// For VMs, the host side device is the tap of the NIC.
 func networkSetVethLimits(m deviceConfig.Device) error {
 	var err error
 
@@ -497,34 +540,34 @@ func networkSetVethLimits(m deviceConfig.Device) error {
 	}
 
 	// Clean any existing entry
-	shared.RunCommand("tc", "qdisc", "del", "dev", veth, "root")
-	shared.RunCommand("tc", "qdisc", "del", "dev", veth, "ingress")
+	networkTC("qdisc", "del", "dev", veth, "root")
+	networkTC("qdisc", "del", "dev", veth, "ingress")
 
 	// Apply new limits
 	if m["limits.ingress"] != "" {
-		out, err := shared.RunCommand("tc", "qdisc", "add", "dev", veth, "root", "handle", "1:0", "htb", "default", "10")
+		out, err := networkTC("qdisc", "add", "dev", veth, "root", "handle", "1:0", "htb", "default", "10")
 		if err != nil {
 			return fmt.Errorf("Failed to create root tc qdisc: %s", out)
 		}
 
-		out, err = shared.RunCommand("tc", "class", "add", "dev", veth, "parent", "1:0", "classid", "1:10", "htb", "rate", fmt.Sprintf("%dbit", ingressInt))
+		out, err = networkTC("class", "add", "dev", veth, "parent", "1:0", "classid", "1:10", "htb", "rate", fmt.Sprintf("%dbit", ingressInt))
 		if err != nil {
 			return fmt.Errorf("Failed to create limit tc class: %s", out)
 		}
 
-		out, err = shared.RunCommand("tc", "filter", "add", "dev", veth, "parent", "1:0", "protocol", "all", "u32", "match", "u32", "0", "0", "flowid", "1:1")
+		out, err = networkTC("filter", "add", "dev", veth, "parent", "1:0", "protocol", "all", "u32", "match", "u32", "0", "0", "flowid", "1:1")
 		if err != nil {
 			return fmt.Errorf("Failed to create tc filter: %s", out)
 		}
 	}
 
 	if m["limits.egress"] != "" {
-		out, err := shared.RunCommand("tc", "qdisc", "add", "dev", veth, "handle", "ffff:0", "ingress")
+		out, err := networkTC("qdisc", "add", "dev", veth, "handle", "ffff:0", "ingress")
 		if err != nil {
 			return fmt.Errorf("Failed to create ingress tc qdisc: %s", out)
 		}
 
-		out, err = shared.RunCommand("tc", "filter", "add", "dev", veth, "parent", "ffff:0", "protocol", "all", "u32", "match", "u32", "0", "0", "police", "rate", fmt.Sprintf("%dbit", egressInt), "burst", "1024k", "mtu", "64kb", "drop")
+		out, err = networkTC("filter", "add", "dev", veth, "parent", "ffff:0", "protocol", "all", "u32", "match", "u32", "0", "0", "police", "rate", fmt.Sprintf("%dbit", egressInt), "burst", "1024k", "mtu", "64kb", "drop")
 		if err != nil {
 			return fmt.Errorf("Failed to create ingress tc qdisc: %s", out)
 		}
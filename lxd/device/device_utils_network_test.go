@@ -0,0 +1,79 @@
+package device
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	deviceConfig "github.com/lxc/lxd/lxd/device/config"
+)
+
+// Record the tc commands run, instead of running them, until the returned function is called.
+func recordTC() (*[]string, func()) {
+	commands := []string{}
+
+	orig := networkTC
+	networkTC = func(args ...string) (string, error) {
+		commands = append(commands, strings.Join(args, " "))
+		return "", nil
+	}
+
+	return &commands, func() { networkTC = orig }
+}
+
+func TestNetworkSetupHostVethDevice_Limits(t *testing.T) {
+	commands, restore := recordTC()
+	defer restore()
+
+	// The loopback interface stands for the tap of a VM NIC, which is found in the volatile data.
+	volatile := map[string]string{"host_name": "lo"}
+	config := deviceConfig.Device{"type": "nic", "nictype": "p2p", "limits.ingress": "10Mbit", "limits.egress": "1Mbit"}
+
+	// Starting the device installs the limits.
+	err := networkSetupHostVethDevice(config, nil, volatile)
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"qdisc del dev lo root",
+		"qdisc del dev lo ingress",
+		"qdisc add dev lo root handle 1:0 htb default 10",
+		"class add dev lo parent 1:0 classid 1:10 htb rate 10000000bit",
+		"filter add dev lo parent 1:0 protocol all u32 match u32 0 0 flowid 1:1",
+		"qdisc add dev lo handle ffff:0 ingress",
+		"filter add dev lo parent ffff:0 protocol all u32 match u32 0 0 police rate 1000000bit burst 1024k mtu 64kb drop",
+	}, *commands)
+
+	// Unsetting the limits on the running device removes them.
+	*commands = []string{}
+	oldConfig := config.Clone()
+	config = deviceConfig.Device{"type": "nic", "nictype": "p2p"}
+
+	err = networkSetupHostVethDevice(config, oldConfig, volatile)
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"qdisc del dev lo root",
+		"qdisc del dev lo ingress",
+	}, *commands)
+}
+
+func TestNicValidateNoLimits(t *testing.T) {
+	err := nicValidateNoLimits(deviceConfig.Device{"type": "nic", "nictype": "macvlan", "parent": "eth0"})
+	assert.NoError(t, err)
+
+	err = nicValidateNoLimits(deviceConfig.Device{"type": "nic", "nictype": "macvlan", "parent": "eth0", "limits.max": "10Mbit"})
+	assert.EqualError(t, err, `Bandwidth limits (limits.max) are unsupported for nictype "macvlan"`)
+}
+
+func TestNicValidateOffloads(t *testing.T) {
+	for _, config := range []deviceConfig.Device{
+		{"type": "nic", "nictype": "bridged", "offload.tx": "false", "offload.rx": "false"},
+		{"type": "nic", "nictype": "bridged", "model": "virtio-net", "offload.rx": "false"},
+		{"type": "nic", "nictype": "bridged", "model": "e1000e", "offload.rx": "true"},
+	} {
+		assert.NoError(t, nicValidateOffloads(config))
+	}
+
+	err := nicValidateOffloads(deviceConfig.Device{"type": "nic", "nictype": "bridged", "model": "e1000e", "offload.tx": "false"})
+	assert.EqualError(t, err, `Offloads (offload.tx) can only be turned off with the "virtio-net" model`)
+}
@@ -0,0 +1,63 @@
+package device
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// pciClassBridge is the PCI class code prefix used by PCI bridges.
+const pciClassBridge = "0x0604"
+
+// pciDeviceDriver returns the name of the driver a PCI device is bound to, or an empty string if the
+// device isn't bound to any driver.
+func pciDeviceDriver(slotName string) (string, error) {
+	driverPath, err := os.Readlink(fmt.Sprintf("/sys/bus/pci/devices/%s/driver", slotName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+
+		return "", errors.Wrapf(err, "Failed getting driver of PCI device %q", slotName)
+	}
+
+	return filepath.Base(driverPath), nil
+}
+
+// pciIOMMUGroupDevices returns the sorted PCI slot names of all the devices sharing an IOMMU group
+// with the supplied PCI device, including itself. PCI bridges are skipped as they cannot be passed
+// through to an instance.
+func pciIOMMUGroupDevices(slotName string) ([]string, error) {
+	groupPath := fmt.Sprintf("/sys/bus/pci/devices/%s/iommu_group/devices", slotName)
+	ents, err := ioutil.ReadDir(groupPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("PCI device %q has no IOMMU group, check that IOMMU is enabled on the host", slotName)
+		}
+
+		return nil, errors.Wrapf(err, "Failed listing IOMMU group of PCI device %q", slotName)
+	}
+
+	slotNames := []string{}
+	for _, ent := range ents {
+		class, err := ioutil.ReadFile(fmt.Sprintf("/sys/bus/pci/devices/%s/class", ent.Name()))
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed getting class of PCI device %q", ent.Name())
+		}
+
+		if strings.HasPrefix(strings.TrimSpace(string(class)), pciClassBridge) {
+			continue
+		}
+
+		slotNames = append(slotNames, ent.Name())
+	}
+
+	sort.Strings(slotNames)
+
+	return slotNames, nil
+}
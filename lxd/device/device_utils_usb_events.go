@@ -24,6 +24,8 @@ type USBEvent struct {
 	Path        string
 	Major       uint32
 	Minor       uint32
+	BusNum      int
+	DevNum      int
 	UeventParts []string
 	UeventLen   int
 }
@@ -106,17 +108,18 @@ func USBNewEvent(action string, vendor string, product string, major string, min
 		return USBEvent{}, err
 	}
 
+	busnumInt, err := strconv.Atoi(busnum)
+	if err != nil {
+		return USBEvent{}, err
+	}
+
+	devnumInt, err := strconv.Atoi(devnum)
+	if err != nil {
+		return USBEvent{}, err
+	}
+
 	path := devname
 	if devname == "" {
-		busnumInt, err := strconv.Atoi(busnum)
-		if err != nil {
-			return USBEvent{}, err
-		}
-
-		devnumInt, err := strconv.Atoi(devnum)
-		if err != nil {
-			return USBEvent{}, err
-		}
 		path = fmt.Sprintf("/dev/bus/usb/%03d/%03d", busnumInt, devnumInt)
 	} else {
 		if !filepath.IsAbs(devname) {
@@ -125,13 +128,15 @@ func USBNewEvent(action string, vendor string, product string, major string, min
 	}
 
 	return USBEvent{
-		action,
-		vendor,
-		product,
-		path,
-		uint32(majorInt),
-		uint32(minorInt),
-		ueventParts,
-		ueventLen,
+		Action:      action,
+		Vendor:      vendor,
+		Product:     product,
+		Path:        path,
+		Major:       uint32(majorInt),
+		Minor:       uint32(minorInt),
+		BusNum:      busnumInt,
+		DevNum:      devnumInt,
+		UeventParts: ueventParts,
+		UeventLen:   ueventLen,
 	}, nil
 }
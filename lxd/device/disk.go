@@ -34,6 +34,73 @@ import (
 // Special disk "source" value used for generating a VM cloud-init config ISO.
 const diskSourceCloudInit = "cloud-init:config"
 
+// diskIOCacheModes lists the host cache modes of VM disks.
+var diskIOCacheModes = []string{"none", "writeback", "writethrough", "unsafe", "directsync"}
+
+// diskIOModes lists the async I/O modes of VM disks.
+var diskIOModes = []string{"native", "threads", "io_uring"}
+
+// diskIOBuses lists the buses VM disks can be attached to.
+var diskIOBuses = []string{"virtio-scsi", "virtio-blk"}
+
+// diskShareMountOptions lists the guest mount options allowed for the directory shares of VMs, mapped
+// to the validator of their value. Options without value have no validator.
+var diskShareMountOptions = map[string]func(string) error{
+	"msize": shared.IsUint32,
+	"cache": func(value string) error {
+		return shared.IsOneOf(value, []string{"none", "loose", "fscache", "mmap"})
+	},
+	"access": func(value string) error {
+		if shared.StringInSlice(value, []string{"user", "client", "any"}) {
+			return nil
+		}
+
+		return shared.IsUint32(value)
+	},
+	"posixacl":   nil,
+	"noatime":    nil,
+	"nodiratime": nil,
+	"relatime":   nil,
+	"nodev":      nil,
+	"nosuid":     nil,
+	"noexec":     nil,
+}
+
+// validateShareMountOptions checks a comma separated list of guest mount options of a directory share.
+func validateShareMountOptions(value string) error {
+	if value == "" {
+		return nil
+	}
+
+	for _, opt := range strings.Split(value, ",") {
+		fields := strings.SplitN(opt, "=", 2)
+
+		validator, ok := diskShareMountOptions[fields[0]]
+		if !ok {
+			return fmt.Errorf("Mount option %q isn't supported", fields[0])
+		}
+
+		if validator == nil {
+			if len(fields) > 1 {
+				return fmt.Errorf("Mount option %q doesn't take a value", fields[0])
+			}
+
+			continue
+		}
+
+		if len(fields) < 2 || fields[1] == "" {
+			return fmt.Errorf("Mount option %q requires a value", fields[0])
+		}
+
+		err := validator(fields[1])
+		if err != nil {
+			return errors.Wrapf(err, "Invalid value for mount option %q", fields[0])
+		}
+	}
+
+	return nil
+}
+
 type diskBlockLimit struct {
 	readBps   int64
 	readIops  int64
@@ -91,6 +158,17 @@ func (d *disk) validateConfig(instConf instance.ConfigReader) error {
 		"ceph.user_name":    shared.IsAny,
 		"boot.priority":     shared.IsUint32,
 		"path":              shared.IsAny,
+		"cdrom":             shared.IsBool,
+		"io.cache": func(value string) error {
+			return shared.IsOneOf(value, diskIOCacheModes)
+		},
+		"io.mode": func(value string) error {
+			return shared.IsOneOf(value, diskIOModes)
+		},
+		"io.bus": func(value string) error {
+			return shared.IsOneOf(value, diskIOBuses)
+		},
+		"mount.options": validateShareMountOptions,
 	}
 
 	err := d.config.Validate(rules)
@@ -102,7 +180,15 @@ func (d *disk) validateConfig(instConf instance.ConfigReader) error {
 		return fmt.Errorf(`Cannot use both "required" and deprecated "optional" properties at the same time`)
 	}
 
-	if d.config["source"] == "" && d.config["path"] != "/" {
+	if shared.IsTrue(d.config["cdrom"]) {
+		if instConf.Type() == instancetype.Container {
+			return fmt.Errorf("CD-ROM disks are only supported by virtual machines")
+		}
+
+		if d.config["path"] == "/" || d.config["pool"] != "" || d.config["source"] == diskSourceCloudInit {
+			return fmt.Errorf("CD-ROM disks must use a host file as source")
+		}
+	} else if d.config["source"] == "" && d.config["path"] != "/" {
 		return fmt.Errorf(`Disk entry is missing the required "source" property`)
 	}
 
@@ -114,6 +200,23 @@ func (d *disk) validateConfig(instConf instance.ConfigReader) error {
 		return fmt.Errorf(`Root disk entry must have a "pool" property set`)
 	}
 
+	if d.config["io.cache"] != "" || d.config["io.mode"] != "" || d.config["io.bus"] != "" {
+		err := d.validateIOModes(instConf)
+		if err != nil {
+			return err
+		}
+	}
+
+	if d.config["mount.options"] != "" {
+		if instConf.Type() == instancetype.Container {
+			return fmt.Errorf("The mount.options property is only supported by virtual machines, use raw.mount.options for containers")
+		}
+
+		if d.config["path"] == "/" || shared.IsTrue(d.config["cdrom"]) || d.config["source"] == diskSourceCloudInit || (d.config["pool"] == "" && !shared.IsDir(shared.HostPath(d.config["source"]))) {
+			return fmt.Errorf("The mount.options property is only supported by directory shares")
+		}
+	}
+
 	if d.config["size"] != "" && d.config["path"] != "/" {
 		return fmt.Errorf("Only the root disk may have a size quota")
 	}
@@ -181,6 +284,43 @@ func (d *disk) validateConfig(instConf instance.ConfigReader) error {
 	return nil
 }
 
+// validateIOModes checks the io.cache, io.mode and io.bus settings, which only apply to the disks of VMs
+// backed by a storage volume, an image file or a block device. Native async I/O requires a cache mode
+// bypassing the host cache.
+func (d *disk) validateIOModes(instConf instance.ConfigReader) error {
+	if instConf.Type() == instancetype.Container {
+		return fmt.Errorf("The io.cache, io.mode and io.bus properties are only supported by virtual machines")
+	}
+
+	if shared.IsTrue(d.config["cdrom"]) || d.config["source"] == diskSourceCloudInit || (d.config["path"] != "/" && d.config["pool"] != "") || (d.config["source"] != "" && shared.IsDir(shared.HostPath(d.config["source"]))) {
+		return fmt.Errorf("The io.cache, io.mode and io.bus properties are only supported by disks backed by an image file or a block device")
+	}
+
+	if d.config["io.mode"] == "native" && d.config["io.cache"] != "" && !shared.StringInSlice(d.config["io.cache"], []string{"none", "directsync"}) {
+		return fmt.Errorf("Native async I/O requires io.cache to be none or directsync")
+	}
+
+	return nil
+}
+
+// ioModeOpts returns the drive options of a VM disk setting its cache and async I/O modes, and its bus.
+func (d *disk) ioModeOpts() []string {
+	opts := []string{}
+	if d.config["io.cache"] != "" {
+		opts = append(opts, deviceConfig.MountOptCache+d.config["io.cache"])
+	}
+
+	if d.config["io.mode"] != "" {
+		opts = append(opts, deviceConfig.MountOptAIO+d.config["io.mode"])
+	}
+
+	if d.config["io.bus"] != "" {
+		opts = append(opts, deviceConfig.MountOptBus+d.config["io.bus"])
+	}
+
+	return opts
+}
+
 // getDevicePath returns the absolute path on the host for this instance and supplied device config.
 func (d *disk) getDevicePath(devName string, devConfig deviceConfig.Device) string {
 	relativeDestPath := strings.TrimPrefix(devConfig["path"], "/")
@@ -204,6 +344,11 @@ func (d *disk) validateEnvironment() error {
 // CanHotPlug returns whether the device can be managed whilst the instance is running, it also
 // returns a list of fields that can be updated without triggering a device remove & add.
 func (d *disk) CanHotPlug() (bool, []string) {
+	// The media of CD-ROM drives can be swapped on running VMs.
+	if d.inst.Type() == instancetype.VM && shared.IsTrue(d.config["cdrom"]) {
+		return true, []string{"limits.max", "limits.read", "limits.write", "size", "source"}
+	}
+
 	return true, []string{"limits.max", "limits.read", "limits.write", "size"}
 }
 
@@ -370,28 +515,24 @@ func (d *disk) startVM() (*deviceConfig.RunConfig, error) {
 	isRequired := d.isRequired(d.config)
 
 	if shared.IsRootDiskDevice(d.config) {
-		runConf.Mounts = []deviceConfig.MountEntryItem{
-			{
-				TargetPath: d.config["path"], // Indicator used that this is the root device.
-				DevName:    d.name,
-			},
-		}
-
+		runConf.Mounts = []deviceConfig.MountEntryItem{d.vmRootMount()}
 		return &runConf, nil
 	} else if d.config["source"] == diskSourceCloudInit {
 		// This is a special virtual disk source that can be attached to a VM to provide cloud-init config.
-		isoPath, err := d.generateVMConfigDrive()
+		_, err := d.generateVMConfigDrive()
 		if err != nil {
 			return nil, err
 		}
 
-		runConf.Mounts = []deviceConfig.MountEntryItem{
-			{
-				DevPath: isoPath,
-				DevName: d.name,
-				FSType:  "iso9660",
-			},
+		runConf.Mounts = []deviceConfig.MountEntryItem{d.vmConfigDriveMount()}
+		return &runConf, nil
+	} else if shared.IsTrue(d.config["cdrom"]) {
+		mount, err := d.vmCDROMMount()
+		if err != nil {
+			return nil, err
 		}
+
+		runConf.Mounts = []deviceConfig.MountEntryItem{mount}
 		return &runConf, nil
 	} else if d.config["source"] != "" {
 		revert := revert.New()
@@ -421,57 +562,41 @@ func (d *disk) startVM() (*deviceConfig.RunConfig, error) {
 			return &runConf, nil
 		}
 
-		// Default to block device or image file passthrough first.
-		mount := deviceConfig.MountEntryItem{
-			DevPath: srcPath,
-			DevName: d.name,
-		}
-
-		// If the source being added is a directory, then we will be using 9p directory sharing to mount
-		// the directory inside the VM, as such we need to indicate to the VM the target path to mount to.
-		if shared.IsDir(srcPath) {
-			mount.TargetPath = d.config["path"]
-			mount.FSType = "9p"
+		mount := d.vmSourceMount(srcPath)
+		if mount.FSType == "9p" && mount.DevPath != srcPath {
+			sockPath := mount.DevPath
 
-			if shared.IsTrue(d.config["readonly"]) {
-				// Don't use proxy in readonly mode.
-				mount.Opts = append(mount.Opts, "ro")
-			} else {
-				sockPath := filepath.Join(d.inst.DevicesPath(), fmt.Sprintf("%s.sock", d.name))
-				mount.DevPath = sockPath // Use socket path as dev path so qemu connects to proxy.
+			// Remove old socket if needed.
+			os.Remove(sockPath)
 
-				// Remove old socket if needed.
-				os.Remove(sockPath)
+			// Start the virtfs-proxy-helper process in non-daemon mode and as root so that
+			// when the VM process is started as an unprivileged user, we can still share
+			// directories that process cannot access.
+			proc, err := subprocess.NewProcess("virtfs-proxy-helper", []string{"-n", "-u", "0", "-g", "0", "-s", sockPath, "-p", srcPath}, "", "")
+			if err != nil {
+				return nil, err
+			}
 
-				// Start the virtfs-proxy-helper process in non-daemon mode and as root so that
-				// when the VM process is started as an unprivileged user, we can still share
-				// directories that process cannot access.
-				proc, err := subprocess.NewProcess("virtfs-proxy-helper", []string{"-n", "-u", "0", "-g", "0", "-s", sockPath, "-p", srcPath}, "", "")
-				if err != nil {
-					return nil, err
-				}
+			err = proc.Start()
+			if err != nil {
+				return nil, errors.Wrapf(err, "Failed to start virtfs-proxy-helper for device %q", d.name)
+			}
 
-				err = proc.Start()
-				if err != nil {
-					return nil, errors.Wrapf(err, "Failed to start virtfs-proxy-helper for device %q", d.name)
-				}
+			revert.Add(func() { proc.Stop() })
 
-				revert.Add(func() { proc.Stop() })
+			pidPath := filepath.Join(d.inst.DevicesPath(), fmt.Sprintf("%s.pid", d.name))
+			err = proc.Save(pidPath)
+			if err != nil {
+				return nil, errors.Wrapf(err, "Failed to save virtfs-proxy-helper state for device %q", d.name)
+			}
 
-				pidPath := filepath.Join(d.inst.DevicesPath(), fmt.Sprintf("%s.pid", d.name))
-				err = proc.Save(pidPath)
-				if err != nil {
-					return nil, errors.Wrapf(err, "Failed to save virtfs-proxy-helper state for device %q", d.name)
+			// Wait for socket file to exist (as otherwise qemu can race the creation of this file).
+			for i := 0; i < 10; i++ {
+				if shared.PathExists(sockPath) {
+					break
 				}
 
-				// Wait for socket file to exist (as otherwise qemu can race the creation of this file).
-				for i := 0; i < 10; i++ {
-					if shared.PathExists(sockPath) {
-						break
-					}
-
-					time.Sleep(50 * time.Millisecond)
-				}
+				time.Sleep(50 * time.Millisecond)
 			}
 		}
 
@@ -483,6 +608,125 @@ func (d *disk) startVM() (*deviceConfig.RunConfig, error) {
 	return nil, fmt.Errorf("Disk type not supported for VMs")
 }
 
+// DryRun returns the run config Start would return for a VM, without generating the cloud-init config
+// drive or starting the 9p proxy. Storage volumes are only mounted when starting, so they're left out.
+func (d *disk) DryRun() (*deviceConfig.RunConfig, error) {
+	if d.inst.Type() != instancetype.VM {
+		return nil, nil
+	}
+
+	runConf := deviceConfig.RunConfig{}
+
+	if shared.IsRootDiskDevice(d.config) {
+		runConf.Mounts = []deviceConfig.MountEntryItem{d.vmRootMount()}
+	} else if d.config["source"] == diskSourceCloudInit {
+		runConf.Mounts = []deviceConfig.MountEntryItem{d.vmConfigDriveMount()}
+	} else if shared.IsTrue(d.config["cdrom"]) {
+		mount, err := d.vmCDROMMount()
+		if err != nil {
+			return nil, err
+		}
+
+		runConf.Mounts = []deviceConfig.MountEntryItem{mount}
+	} else if d.config["pool"] != "" {
+		return nil, nil
+	} else if d.config["source"] != "" {
+		srcPath := shared.HostPath(d.config["source"])
+		if !shared.PathExists(srcPath) {
+			if d.isRequired(d.config) {
+				return nil, fmt.Errorf("Source path %q doesn't exist for device %q", srcPath, d.name)
+			}
+
+			return &runConf, nil
+		}
+
+		runConf.Mounts = []deviceConfig.MountEntryItem{d.vmSourceMount(srcPath)}
+	} else {
+		return nil, fmt.Errorf("Disk type not supported for VMs")
+	}
+
+	return &runConf, nil
+}
+
+// vmRootMount returns the mount entry of the root disk of a VM, resolved by the instance driver.
+func (d *disk) vmRootMount() deviceConfig.MountEntryItem {
+	return deviceConfig.MountEntryItem{
+		TargetPath: d.config["path"], // Indicator used that this is the root device.
+		DevName:    d.name,
+		Opts:       d.ioModeOpts(),
+	}
+}
+
+// vmConfigDriveMount returns the mount entry of the cloud-init config drive generated by
+// generateVMConfigDrive.
+func (d *disk) vmConfigDriveMount() deviceConfig.MountEntryItem {
+	return deviceConfig.MountEntryItem{
+		DevPath: d.vmConfigDrivePath(),
+		DevName: d.name,
+		FSType:  "iso9660",
+	}
+}
+
+// vmCDROMMount returns the mount entry of a CD-ROM drive. An empty source results in an empty drive.
+func (d *disk) vmCDROMMount() (deviceConfig.MountEntryItem, error) {
+	mount := deviceConfig.MountEntryItem{
+		DevName: d.name,
+		FSType:  "iso9660",
+		Opts:    []string{"ro", deviceConfig.MountOptCDROM},
+	}
+
+	if d.config["source"] != "" {
+		srcPath := shared.HostPath(d.config["source"])
+		if shared.IsDir(srcPath) {
+			return mount, fmt.Errorf("Source path %q of CD-ROM device %q is a directory", srcPath, d.name)
+		}
+
+		if shared.PathExists(srcPath) {
+			mount.DevPath = srcPath
+		} else if d.isRequired(d.config) {
+			return mount, fmt.Errorf("Source path %q doesn't exist for device %q", srcPath, d.name)
+		}
+	}
+
+	return mount, nil
+}
+
+// vmSourceMount returns the mount entry of a disk backed by an existing host path. Block devices and
+// image files are passed through, directories are shared over 9p. When the VM process drops privileges,
+// 9p shares which aren't read-only go through a virtfs-proxy-helper, the entry then pointing to the
+// socket the proxy is to listen on.
+func (d *disk) vmSourceMount(srcPath string) deviceConfig.MountEntryItem {
+	// Default to block device or image file passthrough first.
+	mount := deviceConfig.MountEntryItem{
+		DevPath: srcPath,
+		DevName: d.name,
+		Opts:    d.ioModeOpts(),
+	}
+
+	// If the source being added is a directory, then we will be using 9p directory sharing to mount
+	// the directory inside the VM, as such we need to indicate to the VM the target path to mount to.
+	if shared.IsDir(srcPath) {
+		mount.TargetPath = d.config["path"]
+		mount.FSType = "9p"
+
+		// Pass the guest mount options along.
+		if d.config["mount.options"] != "" {
+			mount.Opts = append(mount.Opts, strings.Split(d.config["mount.options"], ",")...)
+		}
+
+		if shared.IsTrue(d.config["readonly"]) {
+			// Don't use proxy in readonly mode.
+			mount.Opts = append(mount.Opts, "ro")
+		} else if d.state.OS.UnprivUser != "" {
+			// Only use proxy when the VM process drops privileges, otherwise it can export the
+			// directory itself. Use socket path as dev path so qemu connects to proxy.
+			mount.DevPath = filepath.Join(d.inst.DevicesPath(), fmt.Sprintf("%s.sock", d.name))
+		}
+	}
+
+	return mount
+}
+
 // postStart is run after the instance is started.
 func (d *disk) postStart() error {
 	devPath := d.getDevicePath(d.name, d.config)
@@ -498,8 +742,15 @@ func (d *disk) postStart() error {
 
 // Update applies configuration changes to a started device.
 func (d *disk) Update(oldDevices deviceConfig.Devices, isRunning bool) error {
-	if d.inst.Type() == instancetype.VM && !shared.IsRootDiskDevice(d.config) {
-		return fmt.Errorf("Non-root disks not supported for VMs")
+	if d.inst.Type() == instancetype.VM {
+		// CD-ROM media changes are applied by the instance driver.
+		if shared.IsTrue(d.config["cdrom"]) {
+			return nil
+		}
+
+		if !shared.IsRootDiskDevice(d.config) {
+			return fmt.Errorf("Non-root disks not supported for VMs")
+		}
 	}
 
 	if shared.IsRootDiskDevice(d.config) {
@@ -532,6 +783,14 @@ func (d *disk) Update(oldDevices deviceConfig.Devices, isRunning bool) error {
 
 		// Apply disk quota changes.
 		if newRootDiskDeviceSize != oldRootDiskDeviceSize {
+			if d.inst.Type() == instancetype.VM {
+				err := d.checkVMRootDiskResize(oldRootDiskDeviceSize, newRootDiskDeviceSize)
+				if err != nil {
+					return err
+				}
+			}
+
+			deferred := false
 			err := d.applyQuota(newRootDiskDeviceSize)
 			if err == storagePools.ErrRunningQuotaResizeNotSupported {
 				// Save volatile apply_quota key for next boot if cannot apply now.
@@ -539,9 +798,24 @@ func (d *disk) Update(oldDevices deviceConfig.Devices, isRunning bool) error {
 				if err != nil {
 					return err
 				}
+
+				deferred = true
 			} else if err != nil {
 				return err
 			}
+
+			// Let the running VM know about the new size of its root disk.
+			if isRunning && !deferred && d.inst.Type() == instancetype.VM {
+				runConf := deviceConfig.RunConfig{}
+				runConf.DiskResize = []deviceConfig.RunConfigItem{
+					{Key: "devName", Value: d.name},
+				}
+
+				err = d.inst.DeviceEventHandler(&runConf)
+				if err != nil {
+					return err
+				}
+			}
 		}
 	}
 
@@ -576,6 +850,58 @@ func (d *disk) applyQuota(newSize string) error {
 	return nil
 }
 
+// checkVMRootDiskResize checks that the root disk of a VM can be resized to the new size. Block volumes
+// can't be shrunk and growing them must fit in the free space of the storage pool.
+func (d *disk) checkVMRootDiskResize(oldSize string, newSize string) error {
+	// Removing the size leaves the volume as it is.
+	if newSize == "" {
+		return nil
+	}
+
+	newSizeBytes, err := units.ParseByteSizeString(newSize)
+	if err != nil {
+		return err
+	}
+
+	pool, err := storagePools.GetPoolByInstance(d.state, d.inst)
+	if err != nil {
+		return err
+	}
+
+	// Without an old size, the disk has the default size of the pool, so use its actual size.
+	var oldSizeBytes int64
+	if oldSize != "" {
+		oldSizeBytes, err = units.ParseByteSizeString(oldSize)
+		if err != nil {
+			return err
+		}
+	} else {
+		diskPath, err := pool.GetInstanceDisk(d.inst)
+		if err == nil {
+			sizeBytes, err := storageDrivers.BlockFileSize(diskPath)
+			if err == nil {
+				oldSizeBytes = sizeBytes
+			}
+		}
+	}
+
+	if newSizeBytes < oldSizeBytes {
+		return fmt.Errorf("The root disk of a virtual machine can't be shrunk from %s to %s", units.GetByteSizeString(oldSizeBytes, 2), newSize)
+	}
+
+	res, err := pool.GetResources()
+	if err != nil {
+		// Not all storage pools report their usage.
+		return nil
+	}
+
+	if res.Space.Total > 0 && uint64(newSizeBytes-oldSizeBytes) > res.Space.Total-res.Space.Used {
+		return fmt.Errorf("Not enough free space in storage pool %q to grow the root disk to %s", pool.Name(), newSize)
+	}
+
+	return nil
+}
+
 // generateLimits adds a set of cgroup rules to apply specified limits to the supplied RunConfig.
 func (d *disk) generateLimits(runConf *deviceConfig.RunConfig) error {
 	// Disk priority limits.
@@ -1494,6 +1820,11 @@ func (d *disk) getParentBlocks(path string) ([]string, error) {
 	return devices, nil
 }
 
+// vmConfigDrivePath returns the path of the ISO generated by generateVMConfigDrive.
+func (d *disk) vmConfigDrivePath() string {
+	return filepath.Join(d.inst.Path(), "config.iso")
+}
+
 // generateVMConfigDrive generates an ISO containing the cloud init config for a VM.
 // Returns the path to the ISO.
 func (d *disk) generateVMConfigDrive() (string, error) {
@@ -1550,7 +1881,7 @@ local-hostname: %s
 	// as this is what cloud-init uses to detect, mount the drive and run the cloud-init
 	// templates on first boot. The vendor-data template then modifies the system so that the
 	// config drive is mounted and the agent is started on subsequent boots.
-	isoPath := filepath.Join(d.inst.Path(), "config.iso")
+	isoPath := d.vmConfigDrivePath()
 	_, err = shared.RunCommand(mkisofsPath, "-R", "-V", "cidata", "-o", isoPath, scratchDir)
 	if err != nil {
 		return "", err
@@ -33,7 +33,7 @@ type gpu struct {
 
 // validateConfig checks the supplied config for correctness.
 func (d *gpu) validateConfig(instConf instance.ConfigReader) error {
-	if !instanceSupported(instConf.Type(), instancetype.Container) {
+	if !instanceSupported(instConf.Type(), instancetype.Container, instancetype.VM) {
 		return ErrUnsupportedDevType
 	}
 
@@ -60,6 +60,18 @@ func (d *gpu) validateConfig(instConf instance.ConfigReader) error {
 		return fmt.Errorf("Cannot use pci, productid or vendorid when id is set")
 	}
 
+	if instConf.Type() == instancetype.VM {
+		if d.config["pci"] == "" {
+			return fmt.Errorf("The pci property is required for virtual machines")
+		}
+
+		for _, key := range []string{"uid", "gid", "mode"} {
+			if d.config[key] != "" {
+				return fmt.Errorf("Cannot use %s with virtual machines", key)
+			}
+		}
+	}
+
 	return nil
 }
 
@@ -72,13 +84,87 @@ func (d *gpu) validateEnvironment() error {
 	return nil
 }
 
-// Start is run when the device is added to the container.
+// CanHotPlug returns whether the device can be managed whilst the instance is running.
+func (d *gpu) CanHotPlug() (bool, []string) {
+	// PCI passthrough into a VM can only be setup when the VM is started.
+	if d.inst.Type() == instancetype.VM {
+		return false, []string{}
+	}
+
+	return true, []string{}
+}
+
+// Start is run when the device is added to the instance.
 func (d *gpu) Start() (*deviceConfig.RunConfig, error) {
 	err := d.validateEnvironment()
 	if err != nil {
 		return nil, err
 	}
 
+	if d.inst.Type() == instancetype.VM {
+		return d.startVM()
+	}
+
+	return d.startContainer()
+}
+
+// startVM passes the GPU and any other device sharing its IOMMU group to the VM using vfio-pci.
+// The devices must already be bound to the vfio-pci driver on the host.
+func (d *gpu) startVM() (*deviceConfig.RunConfig, error) {
+	runConf, err := d.DryRun()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, item := range runConf.GPUDevice {
+		if item.Key != "pciSlotName" {
+			continue
+		}
+
+		slotName := item.Value
+		driver, err := pciDeviceDriver(slotName)
+		if err != nil {
+			return nil, err
+		}
+
+		if driver != "vfio-pci" {
+			if driver == "" {
+				return nil, fmt.Errorf("PCI device %q isn't bound to any driver, bind it to vfio-pci before starting the instance", slotName)
+			}
+
+			return nil, fmt.Errorf("PCI device %q is bound to the host %q driver, unbind it and bind it to vfio-pci before starting the instance", slotName, driver)
+		}
+	}
+
+	return runConf, nil
+}
+
+// DryRun returns the run config Start would return for a VM, passing through the whole IOMMU group of
+// the GPU, without checking the host driver of its devices.
+func (d *gpu) DryRun() (*deviceConfig.RunConfig, error) {
+	if d.inst.Type() != instancetype.VM {
+		return nil, nil
+	}
+
+	slotNames, err := pciIOMMUGroupDevices(d.config["pci"])
+	if err != nil {
+		return nil, err
+	}
+
+	runConf := deviceConfig.RunConfig{}
+	runConf.GPUDevice = []deviceConfig.RunConfigItem{
+		{Key: "devName", Value: d.name},
+	}
+
+	for _, slotName := range slotNames {
+		runConf.GPUDevice = append(runConf.GPUDevice, deviceConfig.RunConfigItem{Key: "pciSlotName", Value: slotName})
+	}
+
+	return &runConf, nil
+}
+
+// startContainer sets up the GPU's unix devices inside the container.
+func (d *gpu) startContainer() (*deviceConfig.RunConfig, error) {
 	runConf := deviceConfig.RunConfig{}
 	gpus, err := resources.GetGPU()
 	if err != nil {
@@ -187,6 +273,10 @@ func (d *gpu) Start() (*deviceConfig.RunConfig, error) {
 
 // Stop is run when the device is removed from the instance.
 func (d *gpu) Stop() (*deviceConfig.RunConfig, error) {
+	if d.inst.Type() == instancetype.VM {
+		return &deviceConfig.RunConfig{}, nil
+	}
+
 	runConf := deviceConfig.RunConfig{
 		PostHooks: []func() error{d.postStop},
 	}
@@ -1,7 +1,12 @@
 package device
 
 import (
+	"fmt"
+	"strconv"
+
 	deviceConfig "github.com/lxc/lxd/lxd/device/config"
+	"github.com/lxc/lxd/lxd/instance"
+	"github.com/lxc/lxd/lxd/instance/instancetype"
 	"github.com/lxc/lxd/shared"
 )
 
@@ -16,6 +21,149 @@ var nicTypes = map[string]func() device{
 	"sriov":    func() device { return &nicSRIOV{} },
 }
 
+// nicModels lists the emulated NIC models VMs can use, the first one being the default.
+var nicModels = []string{"virtio-net", "e1000", "e1000e", "rtl8139"}
+
+// nicValidModel validates the NIC model used by a VM.
+func nicValidModel(value string) error {
+	return shared.IsOneOf(value, nicModels)
+}
+
+// nicMaxQueues is the maximum number of queues a tap device can be opened with.
+const nicMaxQueues = 256
+
+// nicValidQueues validates the number of queues used by a VM NIC, either a number or "auto".
+func nicValidQueues(value string) error {
+	if value == "auto" {
+		return nil
+	}
+
+	queues, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		return fmt.Errorf("Invalid number of queues %q, must be a number or \"auto\"", value)
+	}
+
+	if queues < 1 || queues > nicMaxQueues {
+		return fmt.Errorf("Number of queues must be between 1 and %d", nicMaxQueues)
+	}
+
+	return nil
+}
+
+// nicQueues returns the number of queues to use for a VM NIC. When set to "auto" one queue is used
+// per vCPU, as defined by the instance's limits.cpu.
+func nicQueues(value string, cpuLimit string) (int, error) {
+	if value == "" {
+		return 1, nil
+	}
+
+	if value != "auto" {
+		return strconv.Atoi(value)
+	}
+
+	if cpuLimit == "" {
+		return 1, nil
+	}
+
+	queues, err := strconv.Atoi(cpuLimit)
+	if err != nil {
+		pins, err := instance.ParseCpuset(cpuLimit)
+		if err != nil {
+			return -1, err
+		}
+
+		queues = len(pins)
+	}
+
+	if queues > nicMaxQueues {
+		queues = nicMaxQueues
+	}
+
+	return queues, nil
+}
+
+// nicVMRunConfigItems returns the run config items describing a NIC to the VM, besides its host side link.
+func nicVMRunConfigItems(devName string, config deviceConfig.Device, hwaddr string, queues int) []deviceConfig.RunConfigItem {
+	return []deviceConfig.RunConfigItem{
+		{Key: "devName", Value: devName},
+		{Key: "hwaddr", Value: hwaddr},
+		{Key: "model", Value: config["model"]},
+		{Key: "queues", Value: strconv.Itoa(queues)},
+		{Key: "offload.tx", Value: config["offload.tx"]},
+		{Key: "offload.rx", Value: config["offload.rx"]},
+	}
+}
+
+// nicVMDryRun returns the run config Start returns for a VM NIC backed by a host interface, using the
+// configured host interface name or else the one of the last start.
+func nicVMDryRun(inst instance.Instance, devName string, config deviceConfig.Device, volatile map[string]string) (*deviceConfig.RunConfig, error) {
+	if inst.Type() != instancetype.VM {
+		return nil, nil
+	}
+
+	link := config["host_name"]
+	if link == "" {
+		link = volatile["host_name"]
+	}
+
+	// The MAC address is only generated when first starting.
+	hwaddr := config["hwaddr"]
+	if hwaddr == "" {
+		hwaddr = inst.LocalConfig()[fmt.Sprintf("volatile.%s.hwaddr", devName)]
+	}
+
+	queues, err := nicQueues(config["queues"], inst.ExpandedConfig()["limits.cpu"])
+	if err != nil {
+		return nil, err
+	}
+
+	runConf := deviceConfig.RunConfig{}
+	runConf.NetworkInterface = append([]deviceConfig.RunConfigItem{{Key: "link", Value: link}}, nicVMRunConfigItems(devName, config, hwaddr, queues)...)
+
+	return &runConf, nil
+}
+
+// nicLimitKeys lists the bandwidth limit properties of NICs, which are applied with tc on the host side
+// interface of the NIC (the veth of containers and the tap of VMs).
+var nicLimitKeys = []string{"limits.ingress", "limits.egress", "limits.max"}
+
+// nicValidateNoLimits returns an error if bandwidth limits are set on a NIC type lacking a host side
+// interface to apply them on.
+func nicValidateNoLimits(config deviceConfig.Device) error {
+	for _, key := range nicLimitKeys {
+		if config[key] != "" {
+			return fmt.Errorf("Bandwidth limits (%s) are unsupported for nictype %q", key, config.NICType())
+		}
+	}
+
+	return nil
+}
+
+// nicOffloadKeys lists the offload properties of VM NICs, offload.tx for the packets sent by the VM and
+// offload.rx for the ones it receives.
+var nicOffloadKeys = []string{"offload.tx", "offload.rx"}
+
+// nicOffloadDisabled returns whether an offload property of a NIC is turned off, they are on by default.
+func nicOffloadDisabled(config deviceConfig.Device, key string) bool {
+	return config[key] != "" && !shared.IsTrue(config[key])
+}
+
+// nicValidateOffloads checks that offloads are only turned off on NICs using the virtio-net model, the
+// only one they can be controlled on.
+func nicValidateOffloads(config deviceConfig.Device) error {
+	if config["model"] == "" || config["model"] == nicModels[0] {
+		return nil
+	}
+
+	for _, key := range nicOffloadKeys {
+		if nicOffloadDisabled(config, key) {
+			return fmt.Errorf("Offloads (%s) can only be turned off with the %q model", key, nicModels[0])
+		}
+	}
+
+	return nil
+}
+
 // nicLoadByType returns a NIC device instantiated with supplied config.
 func nicLoadByType(c deviceConfig.Device) device {
 	f := nicTypes[c.NICType()]
@@ -49,6 +197,10 @@ func nicValidationRules(requiredFields []string, optionalFields []string) map[st
 		"ipv4.routes":             NetworkValidNetworkV4List,
 		"ipv6.routes":             NetworkValidNetworkV6List,
 		"boot.priority":           shared.IsUint32,
+		"model":                   nicValidModel,
+		"queues":                  nicValidQueues,
+		"offload.tx":              shared.IsBool,
+		"offload.rx":              shared.IsBool,
 		"ipv4.gateway":            NetworkValidGateway,
 		"ipv6.gateway":            NetworkValidGateway,
 	}
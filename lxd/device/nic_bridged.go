@@ -70,6 +70,10 @@ func (d *nicBridged) validateConfig(instConf instance.ConfigReader) error {
 		"boot.priority",
 	}
 
+	if instConf.Type() == instancetype.VM {
+		optionalFields = append(optionalFields, "model", "queues", "offload.tx", "offload.rx")
+	}
+
 	// Check that if network proeperty is set that conflicting keys are not present.
 	if d.config["network"] != "" {
 		requiredFields = append(requiredFields, "network")
@@ -149,6 +153,11 @@ func (d *nicBridged) validateConfig(instConf instance.ConfigReader) error {
 		return err
 	}
 
+	err = nicValidateOffloads(d.config)
+	if err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -193,6 +202,7 @@ func (d *nicBridged) Start() (*deviceConfig.RunConfig, error) {
 	saveData["host_name"] = d.config["host_name"]
 
 	var peerName string
+	var queues int
 
 	// Create veth pair and configure the peer end with custom hwaddr and mtu if supplied.
 	if d.inst.Type() == instancetype.Container {
@@ -205,7 +215,13 @@ func (d *nicBridged) Start() (*deviceConfig.RunConfig, error) {
 			saveData["host_name"] = networkRandomDevName("tap")
 		}
 		peerName = saveData["host_name"] // VMs use the host_name to link to the TAP FD.
-		err = networkCreateTap(saveData["host_name"], d.config)
+
+		queues, err = nicQueues(d.config["queues"], d.inst.ExpandedConfig()["limits.cpu"])
+		if err != nil {
+			return nil, err
+		}
+
+		err = networkCreateTap(saveData["host_name"], d.config, queues > 1)
 	}
 
 	if err != nil {
@@ -255,10 +271,7 @@ func (d *nicBridged) Start() (*deviceConfig.RunConfig, error) {
 
 	if d.inst.Type() == instancetype.VM {
 		runConf.NetworkInterface = append(runConf.NetworkInterface,
-			[]deviceConfig.RunConfigItem{
-				{Key: "devName", Value: d.name},
-				{Key: "hwaddr", Value: d.config["hwaddr"]},
-			}...)
+			nicVMRunConfigItems(d.name, d.config, d.config["hwaddr"], queues)...)
 	}
 
 	return &runConf, nil
@@ -324,6 +337,11 @@ func (d *nicBridged) Update(oldDevices deviceConfig.Devices, isRunning bool) err
 	return nil
 }
 
+// DryRun returns the run config Start would return for a VM, without creating its host interface.
+func (d *nicBridged) DryRun() (*deviceConfig.RunConfig, error) {
+	return nicVMDryRun(d.inst, d.name, d.config, d.volatileGet())
+}
+
 // Stop is run when the device is removed from the instance.
 func (d *nicBridged) Stop() (*deviceConfig.RunConfig, error) {
 	runConf := deviceConfig.RunConfig{
@@ -409,24 +427,12 @@ func (d *nicBridged) rebuildDnsmasqEntry() error {
 	}
 
 	netConfig := dbInfo.Config
-	ipv4Address := d.config["ipv4.address"]
-	ipv6Address := d.config["ipv6.address"]
-
-	// If IP filtering is enabled, and no static IP in config, check if there is already a
-	// dynamically assigned static IP in dnsmasq config and write that back out in new config.
-	if (shared.IsTrue(d.config["security.ipv4_filtering"]) && ipv4Address == "") || (shared.IsTrue(d.config["security.ipv6_filtering"]) && ipv6Address == "") {
-		curIPv4, curIPv6, err := dnsmasq.DHCPStaticIPs(d.config["parent"], d.inst.Project(), d.inst.Name())
-		if err != nil && !os.IsNotExist(err) {
-			return err
-		}
 
-		if ipv4Address == "" && curIPv4.IP != nil {
-			ipv4Address = curIPv4.IP.String()
-		}
-
-		if ipv6Address == "" && curIPv6.IP != nil {
-			ipv6Address = curIPv6.IP.String()
-		}
+	// If IP filtering is enabled, and no static IP in config, keep any dynamically assigned static IP
+	// already in the dnsmasq config.
+	ipv4Address, ipv6Address, err := dnsmasq.StaticAllocation(d.config["parent"], d.inst.Project(), d.inst.Name(), d.config)
+	if err != nil {
+		return err
 	}
 
 	err = dnsmasq.UpdateStaticEntry(d.config["parent"], d.inst.Project(), d.inst.Name(), netConfig, d.config["hwaddr"], ipv4Address, ipv6Address)
@@ -2,12 +2,16 @@ package device
 
 import (
 	"fmt"
+	"io/ioutil"
 	"strings"
 
+	"github.com/pkg/errors"
+
 	deviceConfig "github.com/lxc/lxd/lxd/device/config"
 	"github.com/lxc/lxd/lxd/instance"
 	"github.com/lxc/lxd/lxd/instance/instancetype"
 	"github.com/lxc/lxd/lxd/network"
+	"github.com/lxc/lxd/lxd/revert"
 	"github.com/lxc/lxd/lxd/util"
 	"github.com/lxc/lxd/shared"
 )
@@ -22,7 +26,7 @@ func (d *nicIPVLAN) CanHotPlug() (bool, []string) {
 
 // validateConfig checks the supplied config for correctness.
 func (d *nicIPVLAN) validateConfig(instConf instance.ConfigReader) error {
-	if !instanceSupported(instConf.Type(), instancetype.Container) {
+	if !instanceSupported(instConf.Type(), instancetype.Container, instancetype.VM) {
 		return ErrUnsupportedDevType
 	}
 
@@ -34,6 +38,10 @@ func (d *nicIPVLAN) validateConfig(instConf instance.ConfigReader) error {
 		"vlan",
 	}
 
+	if instConf.Type() == instancetype.VM {
+		optionalFields = append(optionalFields, "boot.priority", "model", "queues", "offload.tx", "offload.rx")
+	}
+
 	rules := nicValidationRules(requiredFields, optionalFields)
 	rules["ipv4.address"] = func(value string) error {
 		if value == "" {
@@ -55,6 +63,11 @@ func (d *nicIPVLAN) validateConfig(instConf instance.ConfigReader) error {
 		return err
 	}
 
+	err = nicValidateOffloads(d.config)
+	if err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -68,9 +81,11 @@ func (d *nicIPVLAN) validateEnvironment() error {
 		return fmt.Errorf("Parent device '%s' doesn't exist", d.config["parent"])
 	}
 
-	extensions := d.state.OS.LXCFeatures
-	if !extensions["network_ipvlan"] || !extensions["network_l2proxy"] || !extensions["network_gateway_device_route"] {
-		return fmt.Errorf("Requires liblxc has following API extensions: network_ipvlan, network_l2proxy, network_gateway_device_route")
+	if d.inst.Type() == instancetype.Container {
+		extensions := d.state.OS.LXCFeatures
+		if !extensions["network_ipvlan"] || !extensions["network_l2proxy"] || !extensions["network_gateway_device_route"] {
+			return fmt.Errorf("Requires liblxc has following API extensions: network_ipvlan, network_l2proxy, network_gateway_device_route")
+		}
 	}
 
 	if d.config["ipv4.address"] != "" {
@@ -141,6 +156,10 @@ func (d *nicIPVLAN) Start() (*deviceConfig.RunConfig, error) {
 		}
 	}
 
+	if d.inst.Type() == instancetype.VM {
+		return d.startVM(parentName, saveData)
+	}
+
 	err = d.volatileSet(saveData)
 	if err != nil {
 		return nil, err
@@ -183,6 +202,133 @@ func (d *nicIPVLAN) Start() (*deviceConfig.RunConfig, error) {
 	return &runConf, nil
 }
 
+// startVM creates the IPVTAP interface of a VM, in the same L3S mode as the IPVLAN interface of
+// containers. The addresses of the instance are set up on it as done by nicIPVLANVMAddrCommands and
+// proxied on the parent, as liblxc does with l2proxy. The VM gets the MAC address of the interface,
+// which is the one of the parent.
+func (d *nicIPVLAN) startVM(parentName string, saveData map[string]string) (*deviceConfig.RunConfig, error) {
+	revert := revert.New()
+	defer revert.Fail()
+
+	// Record the temporary device name used for deletion later.
+	saveData["host_name"] = networkRandomDevName("ipv")
+
+	_, err := shared.RunCommand("ip", "link", "add", "dev", saveData["host_name"], "link", parentName, "type", "ipvtap", "mode", "l3s", "bridge")
+	if err != nil {
+		return nil, err
+	}
+
+	revert.Add(func() { NetworkRemoveInterface(saveData["host_name"]) })
+
+	if d.config["mtu"] != "" {
+		_, err := shared.RunCommand("ip", "link", "set", "dev", saveData["host_name"], "mtu", d.config["mtu"])
+		if err != nil {
+			return nil, fmt.Errorf("Failed to set the MTU: %s", err)
+		}
+	}
+
+	err = networkSetOffloads(saveData["host_name"], d.config)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, addr := range d.addresses() {
+		for _, args := range nicIPVLANVMAddrCommands(saveData["host_name"], parentName, addr) {
+			_, err := shared.RunCommand("ip", args...)
+			if err != nil {
+				return nil, fmt.Errorf("Failed to set up address %q: %v", addr, err)
+			}
+
+			if args[0] == "neigh" {
+				ip := args[3]
+				revert.Add(func() { shared.RunCommand("ip", "neigh", "delete", "proxy", ip, "dev", parentName) })
+			}
+		}
+	}
+
+	// Bring the interface up on host side.
+	_, err = shared.RunCommand("ip", "link", "set", "dev", saveData["host_name"], "up")
+	if err != nil {
+		return nil, fmt.Errorf("Failed to bring up interface %s: %v", saveData["host_name"], err)
+	}
+
+	// The local routes of the addresses are only added once the interface is up.
+	for _, addr := range d.addresses() {
+		_, err := shared.RunCommand("ip", nicIPVLANVMLocalRouteArgs(saveData["host_name"], addr)...)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to remove the local route of address %q: %v", addr, err)
+		}
+	}
+
+	hwaddr, err := ioutil.ReadFile(fmt.Sprintf("/sys/class/net/%s/address", saveData["host_name"]))
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed getting the MAC address of %q", saveData["host_name"])
+	}
+
+	// IPVTAP devices get a new queue each time they are opened, qemu takes care of that.
+	queues, err := nicQueues(d.config["queues"], d.inst.ExpandedConfig()["limits.cpu"])
+	if err != nil {
+		return nil, err
+	}
+
+	err = d.volatileSet(saveData)
+	if err != nil {
+		return nil, err
+	}
+
+	runConf := deviceConfig.RunConfig{}
+	runConf.NetworkInterface = append([]deviceConfig.RunConfigItem{{Key: "link", Value: saveData["host_name"]}}, nicVMRunConfigItems(d.name, d.config, strings.TrimSpace(string(hwaddr)), queues)...)
+
+	revert.Success()
+	return &runConf, nil
+}
+
+// nicIPVLANVMAddrCommands returns the ip command arguments setting up an address of a VM on its IPVTAP
+// interface. IPVLAN only hands the packets it receives over to the slave interface holding their
+// destination address, routes aren't considered, so the address is added to the interface. The
+// address is also proxied on the parent.
+func nicIPVLANVMAddrCommands(hostName string, parentName string, addr string) [][]string {
+	ip := strings.Split(addr, "/")[0]
+
+	addrArgs := []string{"addr", "add", addr, "dev", hostName}
+	if strings.HasSuffix(addr, "/128") {
+		addrArgs = append(addrArgs, "nodad")
+	}
+
+	return [][]string{
+		addrArgs,
+		{"neigh", "add", "proxy", ip, "dev", parentName},
+	}
+}
+
+// nicIPVLANVMLocalRouteArgs returns the ip command arguments removing the route in the local table of an
+// address of a VM on its IPVTAP interface, for the host not to own the address of the VM. The route
+// only exists once the interface is up.
+func nicIPVLANVMLocalRouteArgs(hostName string, addr string) []string {
+	return []string{"route", "del", "table", "local", strings.Split(addr, "/")[0], "dev", hostName}
+}
+
+// addresses returns the configured IPv4 and IPv6 addresses of the instance as host routes.
+func (d *nicIPVLAN) addresses() []string {
+	addresses := []string{}
+	for _, key := range []string{"ipv4.address", "ipv6.address"} {
+		if d.config[key] == "" {
+			continue
+		}
+
+		prefix := 32
+		if key == "ipv6.address" {
+			prefix = 128
+		}
+
+		for _, addr := range strings.Split(d.config[key], ",") {
+			addresses = append(addresses, fmt.Sprintf("%s/%d", strings.TrimSpace(addr), prefix))
+		}
+	}
+
+	return addresses
+}
+
 // setupParentSysctls configures the required sysctls on the parent to allow l2proxy to work.
 // Because of our policy not to modify sysctls on existing interfaces, this should only be called
 // if we created the parent interface.
@@ -226,14 +372,29 @@ func (d *nicIPVLAN) Stop() (*deviceConfig.RunConfig, error) {
 // postStop is run after the device is removed from the instance.
 func (d *nicIPVLAN) postStop() error {
 	defer d.volatileSet(map[string]string{
+		"host_name":          "",
 		"last_state.created": "",
 	})
 
 	v := d.volatileGet()
+	parentName := network.GetHostDevice(d.config["parent"], d.config["vlan"])
+
+	// Remove the IPVTAP interface of VMs and the neighbour proxy entries of its addresses.
+	if v["host_name"] != "" {
+		for _, addr := range d.addresses() {
+			shared.RunCommand("ip", "neigh", "delete", "proxy", strings.Split(addr, "/")[0], "dev", parentName)
+		}
+
+		if shared.PathExists(fmt.Sprintf("/sys/class/net/%s", v["host_name"])) {
+			err := NetworkRemoveInterface(v["host_name"])
+			if err != nil {
+				return err
+			}
+		}
+	}
 
 	// This will delete the parent interface if we created it for VLAN parent.
 	if shared.IsTrue(v["last_state.created"]) {
-		parentName := network.GetHostDevice(d.config["parent"], d.config["vlan"])
 		err := networkRemoveInterfaceIfNeeded(d.state, parentName, d.inst, d.config["parent"], d.config["vlan"])
 		if err != nil {
 			return err
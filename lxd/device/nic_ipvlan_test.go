@@ -0,0 +1,26 @@
+package device
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNICIPVLANVMAddrCommands(t *testing.T) {
+	assert.Equal(t, [][]string{
+		{"addr", "add", "192.0.2.10/32", "dev", "ipv1234"},
+		{"neigh", "add", "proxy", "192.0.2.10", "dev", "eth0"},
+	}, nicIPVLANVMAddrCommands("ipv1234", "eth0", "192.0.2.10/32"))
+
+	// IPv6 addresses skip duplicate address detection.
+	assert.Equal(t, [][]string{
+		{"addr", "add", "2001:db8::10/128", "dev", "ipv1234", "nodad"},
+		{"neigh", "add", "proxy", "2001:db8::10", "dev", "eth0"},
+	}, nicIPVLANVMAddrCommands("ipv1234", "eth0", "2001:db8::10/128"))
+}
+
+func TestNICIPVLANVMLocalRouteArgs(t *testing.T) {
+	// The host keeps no local route to the address of the VM, which IPVLAN needs on the interface.
+	assert.Equal(t, []string{"route", "del", "table", "local", "192.0.2.10", "dev", "ipv1234"}, nicIPVLANVMLocalRouteArgs("ipv1234", "192.0.2.10/32"))
+	assert.Equal(t, []string{"route", "del", "table", "local", "2001:db8::10", "dev", "ipv1234"}, nicIPVLANVMLocalRouteArgs("ipv1234", "2001:db8::10/128"))
+}
@@ -31,7 +31,22 @@ func (d *nicMACVLAN) validateConfig(instConf instance.ConfigReader) error {
 		"maas.subnet.ipv6",
 		"boot.priority",
 	}
-	err := d.config.Validate(nicValidationRules(requiredFields, optionalFields))
+
+	if instConf.Type() == instancetype.VM {
+		optionalFields = append(optionalFields, "model", "queues", "offload.tx", "offload.rx")
+	}
+
+	err := nicValidateNoLimits(d.config)
+	if err != nil {
+		return err
+	}
+
+	err = d.config.Validate(nicValidationRules(requiredFields, optionalFields))
+	if err != nil {
+		return err
+	}
+
+	err = nicValidateOffloads(d.config)
 	if err != nil {
 		return err
 	}
@@ -122,6 +137,11 @@ func (d *nicMACVLAN) Start() (*deviceConfig.RunConfig, error) {
 	}
 
 	if d.inst.Type() == instancetype.VM {
+		err = networkSetOffloads(saveData["host_name"], d.config)
+		if err != nil {
+			return nil, err
+		}
+
 		// Bring the interface up on host side.
 		_, err := shared.RunCommand("ip", "link", "set", "dev", saveData["host_name"], "up")
 		if err != nil {
@@ -143,17 +163,25 @@ func (d *nicMACVLAN) Start() (*deviceConfig.RunConfig, error) {
 	}
 
 	if d.inst.Type() == instancetype.VM {
+		// Macvtap devices get a new queue each time they are opened, qemu takes care of that.
+		queues, err := nicQueues(d.config["queues"], d.inst.ExpandedConfig()["limits.cpu"])
+		if err != nil {
+			return nil, err
+		}
+
 		runConf.NetworkInterface = append(runConf.NetworkInterface,
-			[]deviceConfig.RunConfigItem{
-				{Key: "devName", Value: d.name},
-				{Key: "hwaddr", Value: d.config["hwaddr"]},
-			}...)
+			nicVMRunConfigItems(d.name, d.config, d.config["hwaddr"], queues)...)
 	}
 
 	revert.Success()
 	return &runConf, nil
 }
 
+// DryRun returns the run config Start would return for a VM, without creating its host interface.
+func (d *nicMACVLAN) DryRun() (*deviceConfig.RunConfig, error) {
+	return nicVMDryRun(d.inst, d.name, d.config, d.volatileGet())
+}
+
 // Stop is run when the device is removed from the instance.
 func (d *nicMACVLAN) Stop() (*deviceConfig.RunConfig, error) {
 	v := d.volatileGet()
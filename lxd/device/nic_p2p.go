@@ -31,11 +31,21 @@ func (d *nicP2P) validateConfig(instConf instance.ConfigReader) error {
 		"ipv6.routes",
 		"boot.priority",
 	}
+
+	if instConf.Type() == instancetype.VM {
+		optionalFields = append(optionalFields, "model", "queues", "offload.tx", "offload.rx")
+	}
+
 	err := d.config.Validate(nicValidationRules([]string{}, optionalFields))
 	if err != nil {
 		return err
 	}
 
+	err = nicValidateOffloads(d.config)
+	if err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -65,6 +75,7 @@ func (d *nicP2P) Start() (*deviceConfig.RunConfig, error) {
 	saveData["host_name"] = d.config["host_name"]
 
 	var peerName string
+	var queues int
 
 	// Create veth pair and configure the peer end with custom hwaddr and mtu if supplied.
 	if d.inst.Type() == instancetype.Container {
@@ -77,7 +88,13 @@ func (d *nicP2P) Start() (*deviceConfig.RunConfig, error) {
 			saveData["host_name"] = networkRandomDevName("tap")
 		}
 		peerName = saveData["host_name"] // VMs use the host_name to link to the TAP FD.
-		err = networkCreateTap(saveData["host_name"], d.config)
+
+		queues, err = nicQueues(d.config["queues"], d.inst.ExpandedConfig()["limits.cpu"])
+		if err != nil {
+			return nil, err
+		}
+
+		err = networkCreateTap(saveData["host_name"], d.config, queues > 1)
 	}
 
 	if err != nil {
@@ -106,10 +123,7 @@ func (d *nicP2P) Start() (*deviceConfig.RunConfig, error) {
 
 	if d.inst.Type() == instancetype.VM {
 		runConf.NetworkInterface = append(runConf.NetworkInterface,
-			[]deviceConfig.RunConfigItem{
-				{Key: "devName", Value: d.name},
-				{Key: "hwaddr", Value: d.config["hwaddr"]},
-			}...)
+			nicVMRunConfigItems(d.name, d.config, d.config["hwaddr"], queues)...)
 	}
 
 	return &runConf, nil
@@ -139,6 +153,11 @@ func (d *nicP2P) Update(oldDevices deviceConfig.Devices, isRunning bool) error {
 	return nil
 }
 
+// DryRun returns the run config Start would return for a VM, without creating its host interface.
+func (d *nicP2P) DryRun() (*deviceConfig.RunConfig, error) {
+	return nicVMDryRun(d.inst, d.name, d.config, d.volatileGet())
+}
+
 // Stop is run when the device is removed from the instance.
 func (d *nicP2P) Stop() (*deviceConfig.RunConfig, error) {
 	runConf := deviceConfig.RunConfig{
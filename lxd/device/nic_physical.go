@@ -36,7 +36,12 @@ func (d *nicPhysical) validateConfig(instConf instance.ConfigReader) error {
 		optionalFields = append(optionalFields, "mtu", "hwaddr", "vlan")
 	}
 
-	err := d.config.Validate(nicValidationRules(requiredFields, optionalFields))
+	err := nicValidateNoLimits(d.config)
+	if err != nil {
+		return err
+	}
+
+	err = d.config.Validate(nicValidationRules(requiredFields, optionalFields))
 	if err != nil {
 		return err
 	}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os/exec"
+	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
@@ -46,7 +47,12 @@ func (d *nicSRIOV) validateConfig(instConf instance.ConfigReader) error {
 		optionalFields = append(optionalFields, "mtu")
 	}
 
-	err := d.config.Validate(nicValidationRules(requiredFields, optionalFields))
+	err := nicValidateNoLimits(d.config)
+	if err != nil {
+		return err
+	}
+
+	err = d.config.Validate(nicValidationRules(requiredFields, optionalFields))
 	if err != nil {
 		return err
 	}
@@ -184,24 +190,40 @@ func (d *nicSRIOV) postStop() error {
 	return nil
 }
 
+// sriovSysClassNet is where the parent and virtual function interfaces are looked up.
+var sriovSysClassNet = "/sys/class/net"
+
 // findFreeVirtualFunction looks on the specified parent device for an unused virtual function.
 // Returns the name of the interface and virtual function index ID if found, error if not.
 func (d *nicSRIOV) findFreeVirtualFunction(reservedDevices map[string]struct{}) (string, int, error) {
-	sriovNumVFs := fmt.Sprintf("/sys/class/net/%s/device/sriov_numvfs", d.config["parent"])
-	sriovTotalVFs := fmt.Sprintf("/sys/class/net/%s/device/sriov_totalvfs", d.config["parent"])
-
 	// Verify that this is indeed a SR-IOV enabled device.
-	if !shared.PathExists(sriovTotalVFs) {
+	if !shared.PathExists(filepath.Join(sriovSysClassNet, d.config["parent"], "device", "sriov_totalvfs")) {
 		return "", 0, fmt.Errorf("Parent device '%s' doesn't support SR-IOV", d.config["parent"])
 	}
 
+	// Ensure parent is up (needed for Intel at least).
+	_, err := shared.RunCommand("ip", "link", "set", "dev", d.config["parent"], "up")
+	if err != nil {
+		return "", 0, err
+	}
+
+	return d.scanVirtualFunctions(reservedDevices)
+}
+
+// scanVirtualFunctions looks for an unused virtual function of the parent device, enabling all of
+// its virtual functions if none of the enabled ones are free.
+func (d *nicSRIOV) scanVirtualFunctions(reservedDevices map[string]struct{}) (string, int, error) {
+	parentPath := filepath.Join(sriovSysClassNet, d.config["parent"])
+	sriovNumVFs := filepath.Join(parentPath, "device", "sriov_numvfs")
+	sriovTotalVFs := filepath.Join(parentPath, "device", "sriov_totalvfs")
+
 	// Get parent dev_port and dev_id values.
-	pfDevPort, err := ioutil.ReadFile(fmt.Sprintf("/sys/class/net/%s/dev_port", d.config["parent"]))
+	pfDevPort, err := ioutil.ReadFile(filepath.Join(parentPath, "dev_port"))
 	if err != nil {
 		return "", 0, err
 	}
 
-	pfDevID, err := ioutil.ReadFile(fmt.Sprintf("/sys/class/net/%s/dev_id", d.config["parent"]))
+	pfDevID, err := ioutil.ReadFile(filepath.Join(parentPath, "dev_id"))
 	if err != nil {
 		return "", 0, err
 	}
@@ -228,22 +250,17 @@ func (d *nicSRIOV) findFreeVirtualFunction(reservedDevices map[string]struct{})
 		return "", 0, err
 	}
 
-	// Ensure parent is up (needed for Intel at least).
-	_, err = shared.RunCommand("ip", "link", "set", "dev", d.config["parent"], "up")
-	if err != nil {
-		return "", 0, err
-	}
-
 	// Check if any VFs are already enabled.
 	nicName := ""
 	vfID := 0
 	for i := 0; i < sriovNum; i++ {
-		if !shared.PathExists(fmt.Sprintf("/sys/class/net/%s/device/virtfn%d/net", d.config["parent"], i)) {
+		vfListPath := filepath.Join(parentPath, "device", fmt.Sprintf("virtfn%d", i), "net")
+		if !shared.PathExists(vfListPath) {
 			continue
 		}
 
 		// Check if VF is already in use.
-		empty, err := shared.PathIsEmpty(fmt.Sprintf("/sys/class/net/%s/device/virtfn%d/net", d.config["parent"], i))
+		empty, err := shared.PathIsEmpty(vfListPath)
 		if err != nil {
 			return "", 0, err
 		}
@@ -251,7 +268,6 @@ func (d *nicSRIOV) findFreeVirtualFunction(reservedDevices map[string]struct{})
 			continue
 		}
 
-		vfListPath := fmt.Sprintf("/sys/class/net/%s/device/virtfn%d/net", d.config["parent"], i)
 		nicName, err = d.getFreeVFInterface(reservedDevices, vfListPath, pfDevID, pfDevPort)
 		if err != nil {
 			return "", 0, err
@@ -275,9 +291,9 @@ func (d *nicSRIOV) findFreeVirtualFunction(reservedDevices map[string]struct{})
 			return "", 0, err
 		}
 
-		// Use next free VF index.
-		for i := sriovNum + 1; i < sriovTotal; i++ {
-			vfListPath := fmt.Sprintf("/sys/class/net/%s/device/virtfn%d/net", d.config["parent"], i)
+		// Use the first of the newly enabled VFs, whose indexes follow the ones already enabled.
+		for i := sriovNum; i < sriovTotal; i++ {
+			vfListPath := filepath.Join(parentPath, "device", fmt.Sprintf("virtfn%d", i), "net")
 			nicName, err = d.getFreeVFInterface(reservedDevices, vfListPath, pfDevID, pfDevPort)
 			if err != nil {
 				return "", 0, err
@@ -315,12 +331,12 @@ func (d *nicSRIOV) getFreeVFInterface(reservedDevices map[string]struct{}, vfLis
 		}
 
 		// Get VF dev_port and dev_id values.
-		vfDevPort, err := ioutil.ReadFile(fmt.Sprintf("%s/%s/dev_port", vfListPath, ent.Name()))
+		vfDevPort, err := ioutil.ReadFile(filepath.Join(vfListPath, ent.Name(), "dev_port"))
 		if err != nil {
 			return "", err
 		}
 
-		vfDevID, err := ioutil.ReadFile(fmt.Sprintf("%s/%s/dev_id", vfListPath, ent.Name()))
+		vfDevID, err := ioutil.ReadFile(filepath.Join(vfListPath, ent.Name(), "dev_id"))
 		if err != nil {
 			return "", err
 		}
@@ -543,7 +559,7 @@ func (d *nicSRIOV) networkGetVirtFuncInfo(devName string, vfID int) (vf virtFunc
 
 // networkGetVFDevicePCISlot returns the PCI slot name for a network virtual function device.
 func (d *nicSRIOV) networkGetVFDevicePCISlot(vfID string) (pciDevice, error) {
-	ueventFile := fmt.Sprintf("/sys/class/net/%s/device/virtfn%s/uevent", d.config["parent"], vfID)
+	ueventFile := filepath.Join(sriovSysClassNet, d.config["parent"], "device", fmt.Sprintf("virtfn%s", vfID), "uevent")
 	pciDev, err := networkGetDevicePCIDevice(ueventFile)
 	if err != nil {
 		return pciDev, err
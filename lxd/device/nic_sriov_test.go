@@ -0,0 +1,100 @@
+package device
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	deviceConfig "github.com/lxc/lxd/lxd/device/config"
+)
+
+// Build a fake SR-IOV parent "eth0" and use it until the returned function is called. The virtual
+// functions are given by index with their interfaces, none for those passed through to a VM.
+func mockSRIOVParent(t *testing.T, numVFs int, totalVFs int, vfs map[int][]string) (string, func()) {
+	dir, err := ioutil.TempDir("", "lxd-sriov-test-")
+	require.NoError(t, err)
+
+	files := map[string]string{
+		"eth0/dev_port":              "0\n",
+		"eth0/dev_id":                "0x0\n",
+		"eth0/device/sriov_numvfs":   fmt.Sprintf("%d\n", numVFs),
+		"eth0/device/sriov_totalvfs": fmt.Sprintf("%d\n", totalVFs),
+	}
+
+	for i, names := range vfs {
+		vfPath := fmt.Sprintf("eth0/device/virtfn%d", i)
+		files[vfPath+"/uevent"] = fmt.Sprintf("DRIVER=ixgbevf\nPCI_SLOT_NAME=0000:05:10.%d\n", i)
+		require.NoError(t, os.MkdirAll(filepath.Join(dir, vfPath, "net"), 0755))
+
+		for _, name := range names {
+			files[fmt.Sprintf("%s/net/%s/dev_port", vfPath, name)] = "0\n"
+			files[fmt.Sprintf("%s/net/%s/dev_id", vfPath, name)] = "0x0\n"
+		}
+	}
+
+	for path, content := range files {
+		path = filepath.Join(dir, path)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, ioutil.WriteFile(path, []byte(content), 0644))
+	}
+
+	orig := sriovSysClassNet
+	sriovSysClassNet = dir
+
+	return dir, func() {
+		sriovSysClassNet = orig
+		os.RemoveAll(dir)
+	}
+}
+
+func TestNicSRIOVScanVirtualFunctions(t *testing.T) {
+	d := &nicSRIOV{}
+	d.config = deviceConfig.Device{"type": "nic", "nictype": "sriov", "parent": "eth0"}
+
+	// A free VF among the enabled ones is used.
+	_, restore := mockSRIOVParent(t, 2, 4, map[int][]string{0: {"eth0v0"}, 1: {"eth0v1"}})
+	vfDev, vfID, err := d.scanVirtualFunctions(map[string]struct{}{"eth0v0": {}})
+	restore()
+	require.NoError(t, err)
+	assert.Equal(t, "eth0v1", vfDev)
+	assert.Equal(t, 1, vfID)
+
+	// Otherwise all the VFs are enabled and the first new one is used. VFs passed through to a VM
+	// have no interface on the host.
+	dir, restore := mockSRIOVParent(t, 2, 4, map[int][]string{0: {"eth0v0"}, 1: {}, 2: {"eth0v2"}, 3: {"eth0v3"}})
+	vfDev, vfID, err = d.scanVirtualFunctions(map[string]struct{}{"eth0v0": {}})
+	numVFs, _ := ioutil.ReadFile(filepath.Join(dir, "eth0", "device", "sriov_numvfs"))
+	restore()
+	require.NoError(t, err)
+	assert.Equal(t, "eth0v2", vfDev)
+	assert.Equal(t, 2, vfID)
+	assert.Equal(t, "4", string(numVFs))
+
+	// VFs of another port of the card are skipped.
+	dir, restore = mockSRIOVParent(t, 2, 2, map[int][]string{0: {"eth0v0"}, 1: {"eth1v1"}})
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "eth0", "device", "virtfn1", "net", "eth1v1", "dev_port"), []byte("1\n"), 0644))
+	_, _, err = d.scanVirtualFunctions(map[string]struct{}{"eth0v0": {}})
+	restore()
+	assert.EqualError(t, err, "All virtual functions of sriov device 'eth0' seem to be in use")
+}
+
+func TestNicSRIOVGetVFDevicePCISlot(t *testing.T) {
+	_, restore := mockSRIOVParent(t, 2, 2, map[int][]string{0: {"eth0v0"}, 1: {}})
+	defer restore()
+
+	d := &nicSRIOV{}
+	d.config = deviceConfig.Device{"type": "nic", "nictype": "sriov", "parent": "eth0"}
+
+	pciDev, err := d.networkGetVFDevicePCISlot("1")
+	require.NoError(t, err)
+	assert.Equal(t, "0000:05:10.1", pciDev.SlotName)
+	assert.Equal(t, "ixgbevf", pciDev.Driver)
+
+	_, err = d.networkGetVFDevicePCISlot("2")
+	assert.Error(t, err)
+}
@@ -25,6 +25,11 @@ func (d *none) Start() (*deviceConfig.RunConfig, error) {
 	return nil, nil
 }
 
+// DryRun returns the run config Start would return, there being nothing to pass to the instance.
+func (d *none) DryRun() (*deviceConfig.RunConfig, error) {
+	return &deviceConfig.RunConfig{}, nil
+}
+
 // Stop is run when the device is removed from the instance.
 func (d *none) Stop() (*deviceConfig.RunConfig, error) {
 	return nil, nil
@@ -0,0 +1,94 @@
+package device
+
+import (
+	"fmt"
+	"os"
+
+	deviceConfig "github.com/lxc/lxd/lxd/device/config"
+	"github.com/lxc/lxd/lxd/instance"
+	"github.com/lxc/lxd/lxd/instance/instancetype"
+	"github.com/lxc/lxd/shared"
+	"github.com/lxc/lxd/shared/osarch"
+)
+
+type serial struct {
+	deviceCommon
+}
+
+// validateConfig checks the supplied config for correctness.
+func (d *serial) validateConfig(instConf instance.ConfigReader) error {
+	if !instanceSupported(instConf.Type(), instancetype.VM) {
+		return ErrUnsupportedDevType
+	}
+
+	rules := map[string]func(string) error{
+		"source": shared.IsNotEmpty,
+		"bus": func(value string) error {
+			if value == "" {
+				return nil
+			}
+
+			return shared.IsOneOf(value, []string{"virtio", "isa"})
+		},
+	}
+
+	err := d.config.Validate(rules)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// bus returns the bus the serial port is attached to in the VM.
+func (d *serial) bus() string {
+	if d.config["bus"] == "" {
+		return "virtio"
+	}
+
+	return d.config["bus"]
+}
+
+// CanHotPlug returns whether the device can be managed whilst the instance is running. Only virtio
+// serial ports can be hot-plugged.
+func (d *serial) CanHotPlug() (bool, []string) {
+	return d.bus() == "virtio", []string{}
+}
+
+// Start is run when the device is added to the instance.
+func (d *serial) Start() (*deviceConfig.RunConfig, error) {
+	if d.bus() == "isa" && d.inst.Architecture() != osarch.ARCH_64BIT_INTEL_X86 {
+		return nil, fmt.Errorf("The isa bus is only available on x86_64")
+	}
+
+	srcPath := shared.HostPath(d.config["source"])
+
+	info, err := os.Stat(srcPath)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to find serial device %q: %v", d.config["source"], err)
+	}
+
+	if info.Mode()&os.ModeCharDevice == 0 {
+		return nil, fmt.Errorf("Serial device %q isn't a character device", d.config["source"])
+	}
+
+	runConf := deviceConfig.RunConfig{}
+	runConf.SerialDevice = []deviceConfig.RunConfigItem{
+		{Key: "devName", Value: d.name},
+		{Key: "devPath", Value: srcPath},
+		{Key: "bus", Value: d.bus()},
+	}
+
+	return &runConf, nil
+}
+
+// Stop is run when the device is removed from the instance.
+func (d *serial) Stop() (*deviceConfig.RunConfig, error) {
+	runConf := deviceConfig.RunConfig{}
+	runConf.SerialDevice = []deviceConfig.RunConfigItem{
+		{Key: "devName", Value: d.name},
+		{Key: "bus", Value: d.bus()},
+	}
+
+	return &runConf, nil
+}
@@ -0,0 +1,172 @@
+package device
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	deviceConfig "github.com/lxc/lxd/lxd/device/config"
+	"github.com/lxc/lxd/lxd/instance"
+	"github.com/lxc/lxd/lxd/instance/instancetype"
+	"github.com/lxc/lxd/lxd/project"
+	"github.com/lxc/lxd/shared"
+	"github.com/lxc/lxd/shared/units"
+)
+
+// shmDevPath is where POSIX shared memory objects live on the host.
+var shmDevPath = "/dev/shm"
+
+// shmLock serializes the creation and removal of shared memory objects along with their users.
+var shmLock sync.Mutex
+
+type shm struct {
+	deviceCommon
+}
+
+// validateConfig checks the supplied config for correctness.
+func (d *shm) validateConfig(instConf instance.ConfigReader) error {
+	if !instanceSupported(instConf.Type(), instancetype.VM) {
+		return ErrUnsupportedDevType
+	}
+
+	rules := map[string]func(string) error{
+		"name": shared.ValidHostname,
+		"size": shmValidateSize,
+	}
+
+	err := d.config.Validate(rules)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// shmValidateSize checks that the size of a shared memory object is a power of two of at least 4KiB,
+// as it's exposed to the VM through a PCI BAR.
+func shmValidateSize(value string) error {
+	sizeBytes, err := units.ParseByteSizeString(value)
+	if err != nil {
+		return err
+	}
+
+	if sizeBytes < 4096 || sizeBytes&(sizeBytes-1) != 0 {
+		return fmt.Errorf("Shared memory size must be a power of two of at least 4KiB")
+	}
+
+	return nil
+}
+
+// CanHotPlug returns whether the device can be managed whilst the instance is running.
+func (d *shm) CanHotPlug() (bool, []string) {
+	return false, []string{}
+}
+
+// objectName returns the name of the shared memory object, which is shared by all the instances of the
+// project using a device with the same name.
+func (d *shm) objectName() string {
+	return fmt.Sprintf("lxd.%s", project.Instance(d.inst.Project(), d.config["name"]))
+}
+
+// usersPath returns the directory recording the instances using the shared memory object.
+func (d *shm) usersPath() string {
+	return shared.VarPath("shm", d.objectName())
+}
+
+// Start is run when the device is added to the instance.
+func (d *shm) Start() (*deviceConfig.RunConfig, error) {
+	sizeBytes, err := units.ParseByteSizeString(d.config["size"])
+	if err != nil {
+		return nil, err
+	}
+
+	shmLock.Lock()
+	defer shmLock.Unlock()
+
+	// Create the shared memory object for its first user, others must agree on its size.
+	shmPath := filepath.Join(shmDevPath, d.objectName())
+	f, err := os.OpenFile(shmPath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed opening shared memory %q", d.config["name"])
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	if info.Size() == 0 {
+		err = f.Truncate(sizeBytes)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed sizing shared memory %q", d.config["name"])
+		}
+	} else if info.Size() != sizeBytes {
+		return nil, fmt.Errorf("Shared memory %q already exists with a size of %s", d.config["name"], units.GetByteSizeString(info.Size(), 0))
+	}
+
+	err = os.MkdirAll(d.usersPath(), 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	err = ioutil.WriteFile(filepath.Join(d.usersPath(), project.Instance(d.inst.Project(), d.inst.Name())), nil, 0600)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed recording user of shared memory %q", d.config["name"])
+	}
+
+	runConf := deviceConfig.RunConfig{}
+	runConf.SharedMemDevice = []deviceConfig.RunConfigItem{
+		{Key: "devName", Value: d.name},
+		{Key: "devPath", Value: shmPath},
+		{Key: "size", Value: fmt.Sprintf("%d", sizeBytes)},
+	}
+
+	return &runConf, nil
+}
+
+// Stop is run when the device is removed from the instance.
+func (d *shm) Stop() (*deviceConfig.RunConfig, error) {
+	runConf := deviceConfig.RunConfig{
+		PostHooks: []func() error{d.postStop},
+	}
+
+	return &runConf, nil
+}
+
+// postStop is run after the device is removed from the instance. The shared memory object is removed
+// along with its last user.
+func (d *shm) postStop() error {
+	shmLock.Lock()
+	defer shmLock.Unlock()
+
+	err := os.Remove(filepath.Join(d.usersPath(), project.Instance(d.inst.Project(), d.inst.Name())))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	users, err := ioutil.ReadDir(d.usersPath())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if len(users) > 0 {
+		return nil
+	}
+
+	err = os.Remove(filepath.Join(shmDevPath, d.objectName()))
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "Failed removing shared memory %q", d.config["name"])
+	}
+
+	err = os.Remove(d.usersPath())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
@@ -11,6 +11,8 @@ import (
 	"github.com/lxc/lxd/lxd/instance"
 	"github.com/lxc/lxd/lxd/instance/instancetype"
 	"github.com/lxc/lxd/shared"
+	log "github.com/lxc/lxd/shared/log15"
+	"github.com/lxc/lxd/shared/logger"
 )
 
 // usbDevPath is the path where USB devices can be enumerated.
@@ -44,7 +46,7 @@ func (d *usb) isRequired() bool {
 
 // validateConfig checks the supplied config for correctness.
 func (d *usb) validateConfig(instConf instance.ConfigReader) error {
-	if !instanceSupported(instConf.Type(), instancetype.Container) {
+	if !instanceSupported(instConf.Type(), instancetype.Container, instancetype.VM) {
 		return ErrUnsupportedDevType
 	}
 
@@ -62,11 +64,23 @@ func (d *usb) validateConfig(instConf instance.ConfigReader) error {
 		return err
 	}
 
+	if instConf.Type() == instancetype.VM {
+		for _, key := range []string{"uid", "gid", "mode"} {
+			if d.config[key] != "" {
+				return fmt.Errorf("Cannot use %s with virtual machines", key)
+			}
+		}
+	}
+
 	return nil
 }
 
 // Register is run after the device is started or when LXD starts.
 func (d *usb) Register() error {
+	if d.inst.Type() == instancetype.VM {
+		return d.registerVM()
+	}
+
 	// Extract variables needed to run the event hook so that the reference to this device
 	// struct is not needed to be kept in memory.
 	devicesPath := d.inst.DevicesPath()
@@ -115,8 +129,84 @@ func (d *usb) Register() error {
 	return nil
 }
 
+// registerVM registers a handler which passes matching host USB devices plugged in while the VM is
+// running through to it, and removes the ones unplugged from the host.
+func (d *usb) registerVM() error {
+	devConfig := d.config
+	deviceName := d.name
+	projectName := d.inst.Project()
+	instanceName := d.inst.Name()
+
+	f := func(e USBEvent) (*deviceConfig.RunConfig, error) {
+		if !usbIsOurDevice(devConfig, &e) {
+			return nil, nil
+		}
+
+		if e.Action != "add" && e.Action != "remove" {
+			return nil, nil
+		}
+
+		logger.Debug("USB device event for instance", log.Ctx{"project": projectName, "instance": instanceName, "device": deviceName, "action": e.Action, "bus": e.BusNum, "addr": e.DevNum})
+
+		runConf := deviceConfig.RunConfig{}
+		runConf.USBDevice = []deviceConfig.RunConfigItem{
+			{Key: "devName", Value: deviceName},
+			{Key: "hostDevice", Value: fmt.Sprintf("%d:%d", e.BusNum, e.DevNum)},
+			{Key: "action", Value: e.Action},
+		}
+
+		return &runConf, nil
+	}
+
+	usbRegisterHandler(d.inst, d.name, f)
+
+	return nil
+}
+
 // Start is run when the device is added to the instance.
 func (d *usb) Start() (*deviceConfig.RunConfig, error) {
+	if d.inst.Type() == instancetype.VM {
+		return d.startVM()
+	}
+
+	return d.startContainer()
+}
+
+// startVM passes the matching host USB devices to the VM. The qemu driver adds a USB controller
+// along with the first USB device.
+func (d *usb) startVM() (*deviceConfig.RunConfig, error) {
+	usbs, err := d.loadUsb()
+	if err != nil {
+		return nil, err
+	}
+
+	runConf := deviceConfig.RunConfig{}
+	runConf.USBDevice = []deviceConfig.RunConfigItem{
+		{Key: "devName", Value: d.name},
+	}
+
+	for _, usb := range usbs {
+		if !usbIsOurDevice(d.config, &usb) {
+			continue
+		}
+
+		runConf.USBDevice = append(runConf.USBDevice, deviceConfig.RunConfigItem{Key: "hostDevice", Value: fmt.Sprintf("%d:%d", usb.BusNum, usb.DevNum)})
+	}
+
+	if d.isRequired() && len(runConf.USBDevice) <= 1 {
+		return nil, fmt.Errorf("Required USB device not found")
+	}
+
+	err = d.Register()
+	if err != nil {
+		return nil, err
+	}
+
+	return &runConf, nil
+}
+
+// startContainer sets up the USB device's unix devices inside the container.
+func (d *usb) startContainer() (*deviceConfig.RunConfig, error) {
 	usbs, err := d.loadUsb()
 	if err != nil {
 		return nil, err
@@ -148,6 +238,15 @@ func (d *usb) Stop() (*deviceConfig.RunConfig, error) {
 	// Unregister any USB event handlers for this device.
 	usbUnregisterHandler(d.inst, d.name)
 
+	if d.inst.Type() == instancetype.VM {
+		runConf := deviceConfig.RunConfig{}
+		runConf.USBDevice = []deviceConfig.RunConfigItem{
+			{Key: "devName", Value: d.name},
+		}
+
+		return &runConf, nil
+	}
+
 	runConf := deviceConfig.RunConfig{
 		PostHooks: []func() error{d.postStop},
 	}
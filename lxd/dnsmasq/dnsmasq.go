@@ -149,6 +149,31 @@ func DHCPStaticIPs(network, projectName, instanceName string) (DHCPAllocation, D
 	return IPv4, IPv6, nil
 }
 
+// StaticAllocation returns the IPv4 and IPv6 addresses to statically allocate to a NIC of an instance.
+// These are the addresses of the NIC config and, when IP filtering is enabled for a family without one,
+// the address already allocated in the dnsmasq config so that it's kept. The caller must hold ConfigMutex.
+func StaticAllocation(network, projectName, instanceName string, nicConfig map[string]string) (string, string, error) {
+	ipv4Address := nicConfig["ipv4.address"]
+	ipv6Address := nicConfig["ipv6.address"]
+
+	if (shared.IsTrue(nicConfig["security.ipv4_filtering"]) && ipv4Address == "") || (shared.IsTrue(nicConfig["security.ipv6_filtering"]) && ipv6Address == "") {
+		curIPv4, curIPv6, err := DHCPStaticIPs(network, projectName, instanceName)
+		if err != nil && !os.IsNotExist(err) {
+			return "", "", err
+		}
+
+		if ipv4Address == "" && curIPv4.IP != nil {
+			ipv4Address = curIPv4.IP.String()
+		}
+
+		if ipv6Address == "" && curIPv6.IP != nil {
+			ipv6Address = curIPv6.IP.String()
+		}
+	}
+
+	return ipv4Address, ipv6Address, nil
+}
+
 // DHCPAllocatedIPs returns a map of IPs currently allocated (statically and dynamically)
 // in dnsmasq for a specific network. The returned map is keyed by a 16 byte array representing
 // the net.IP format. The value of each map item is a DHCPAllocation struct containing at least
@@ -22,6 +22,7 @@ import (
 	deviceConfig "github.com/lxc/lxd/lxd/device/config"
 	"github.com/lxc/lxd/lxd/instance"
 	"github.com/lxc/lxd/lxd/instance/instancetype"
+	"github.com/lxc/lxd/lxd/instance/operationlock"
 	"github.com/lxc/lxd/lxd/operations"
 	"github.com/lxc/lxd/lxd/project"
 	"github.com/lxc/lxd/lxd/state"
@@ -358,6 +359,12 @@ func instanceCreateAsSnapshot(s *state.State, args db.InstanceArgs, sourceInstan
 		return nil, fmt.Errorf("Source instance and snapshot instance types do not match")
 	}
 
+	// Some storage drivers pause and resume running VMs while snapshotting, which would resume a
+	// VM that was paused by the user.
+	if sourceInstance.Type() == instancetype.VM && sourceInstance.IsFrozen() {
+		return nil, fmt.Errorf("Unable to create a snapshot of a paused virtual machine")
+	}
+
 	// Deal with state.
 	if args.Stateful {
 		if !sourceInstance.IsRunning() {
@@ -873,29 +880,8 @@ func pruneExpiredContainerSnapshotsTask(d *Daemon) (task.Func, task.Schedule) {
 			return
 		}
 
-		// Figure out which need snapshotting (if any)
-		expiredSnapshots := []instance.Instance{}
-		for _, c := range allInstances {
-			snapshots, err := c.Snapshots()
-			if err != nil {
-				logger.Error("Failed to list instance snapshots", log.Ctx{"err": err, "instance": c.Name(), "project": c.Project()})
-				continue
-			}
-
-			for _, snapshot := range snapshots {
-				// Since zero time causes some issues due to timezones, we check the
-				// unix timestamp instead of IsZero().
-				if snapshot.ExpiryDate().Unix() <= 0 {
-					// Snapshot doesn't expire
-					continue
-				}
-
-				if time.Now().Unix()-snapshot.ExpiryDate().Unix() >= 0 {
-					expiredSnapshots = append(expiredSnapshots, snapshot)
-				}
-			}
-		}
-
+		// Figure out which snapshots have expired (if any)
+		expiredSnapshots := expiredInstanceSnapshots(allInstances, time.Now())
 		if len(expiredSnapshots) == 0 {
 			return
 		}
@@ -935,6 +921,118 @@ func pruneExpiredContainerSnapshotsTask(d *Daemon) (task.Func, task.Schedule) {
 	return f, schedule
 }
 
+// instanceHealthCheckTask runs the health checks of the local VMs. Only the VMs registered by the
+// driver as having a health check due are loaded, so this is the resolution of the intervals.
+func instanceHealthCheckTask(d *Daemon) (task.Func, task.Schedule) {
+	f := func(ctx context.Context) {
+		for _, id := range instance.HealthChecksDue() {
+			inst, err := instance.LoadByID(d.State(), id)
+			if err != nil {
+				logger.Warn("Failed to load instance for health check", log.Ctx{"id": id, "err": err})
+				continue
+			}
+
+			vm, ok := inst.(instance.VM)
+			if !ok {
+				continue
+			}
+
+			// Don't let a slow check hold back the others, the VM skips its check while one is running.
+			go func(vm instance.VM) {
+				restart, err := vm.HealthCheck()
+				if err != nil {
+					logger.Warn("Failed to check instance health", log.Ctx{"project": vm.Project(), "instance": vm.Name(), "err": err})
+					return
+				}
+
+				if restart {
+					instanceRestartUnhealthy(d, vm)
+				}
+			}(vm)
+		}
+	}
+
+	return f, task.Every(5 * time.Second)
+}
+
+// instanceRestartUnhealthy restarts an unhealthy instance through a restart operation, as for forced
+// restarts through the API. Instances busy with another operation, such as being stopped by the user,
+// are left alone.
+func instanceRestartUnhealthy(d *Daemon, inst instance.Instance) {
+	if operationlock.Get(inst.ID()) != nil {
+		logger.Warn("Not restarting unhealthy instance busy with another operation", log.Ctx{"project": inst.Project(), "instance": inst.Name()})
+		return
+	}
+
+	logger.Warn("Restarting unhealthy instance", log.Ctx{"project": inst.Project(), "instance": inst.Name()})
+
+	do := func(op *operations.Operation) error {
+		inst.SetOperation(op)
+
+		err := inst.Stop(false)
+		if err != nil {
+			return errors.Wrap(err, "Failed stopping unhealthy instance")
+		}
+
+		err = inst.Start(false)
+		if err != nil {
+			return errors.Wrap(err, "Failed starting unhealthy instance")
+		}
+
+		return nil
+	}
+
+	resources := map[string][]string{}
+	resources["containers"] = []string{inst.Name()}
+
+	op, err := operations.OperationCreate(d.State(), inst.Project(), operations.OperationClassTask, db.OperationContainerRestart, resources, nil, do, nil, nil)
+	if err != nil {
+		logger.Error("Failed to create restart operation for unhealthy instance", log.Ctx{"project": inst.Project(), "instance": inst.Name(), "err": err})
+		return
+	}
+
+	_, err = op.Run()
+	if err != nil {
+		logger.Error("Failed to restart unhealthy instance", log.Ctx{"project": inst.Project(), "instance": inst.Name(), "err": err})
+	}
+}
+
+// expiredInstanceSnapshots returns the snapshots of the instances, containers and virtual machines
+// alike, which are past their expiry date. The snapshots of delete protected instances are kept.
+func expiredInstanceSnapshots(instances []instance.Instance, now time.Time) []instance.Instance {
+	expiredSnapshots := []instance.Instance{}
+	for _, c := range instances {
+		snapshots, err := c.Snapshots()
+		if err != nil {
+			logger.Error("Failed to list instance snapshots", log.Ctx{"err": err, "instance": c.Name(), "project": c.Project()})
+			continue
+		}
+
+		protected := shared.IsTrue(c.ExpandedConfig()["security.protection.delete"])
+		for _, snapshot := range snapshots {
+			// Since zero time causes some issues due to timezones, we check the
+			// unix timestamp instead of IsZero().
+			if snapshot.ExpiryDate().Unix() <= 0 {
+				// Snapshot doesn't expire
+				continue
+			}
+
+			if now.Unix()-snapshot.ExpiryDate().Unix() < 0 {
+				continue
+			}
+
+			if protected {
+				logger.Debug("Keeping expired snapshot of protected instance", log.Ctx{"instance": c.Name(), "project": c.Project(), "snapshot": snapshot.Name()})
+				continue
+			}
+
+			expiredSnapshots = append(expiredSnapshots, snapshot)
+		}
+	}
+
+	return expiredSnapshots
+}
+
 func pruneExpiredContainerSnapshots(ctx context.Context, d *Daemon, snapshots []instance.Instance) error {
 	// Find snapshots to delete
 	for _, snapshot := range snapshots {
@@ -5,6 +5,7 @@ import (
 	deviceConfig "github.com/lxc/lxd/lxd/device/config"
 	"github.com/lxc/lxd/lxd/instance/instancetype"
 	"github.com/lxc/lxd/lxd/state"
+	"github.com/lxc/lxd/shared"
 	"github.com/lxc/lxd/shared/api"
 )
 
@@ -45,6 +46,29 @@ func (c *common) LocalDevices() deviceConfig.Devices {
 	return c.localDevices
 }
 
+// configKeysChanged returns the keys whose value differs between the given configs, including keys
+// set in only one of them.
+func configKeysChanged(oldConfig map[string]string, newConfig map[string]string) []string {
+	changedConfig := []string{}
+	for key := range oldConfig {
+		if oldConfig[key] != newConfig[key] {
+			if !shared.StringInSlice(key, changedConfig) {
+				changedConfig = append(changedConfig, key)
+			}
+		}
+	}
+
+	for key := range newConfig {
+		if oldConfig[key] != newConfig[key] {
+			if !shared.StringInSlice(key, changedConfig) {
+				changedConfig = append(changedConfig, key)
+			}
+		}
+	}
+
+	return changedConfig
+}
+
 func (c *common) expandConfig(profiles []api.Profile) error {
 	if profiles == nil && len(c.profiles) > 0 {
 		var err error
@@ -1184,15 +1184,8 @@ func (c *lxc) initLXC(config bool) error {
 			}
 		}
 
-		if cpuCfsPeriod != "-1" {
-			err = cg.SetCPUCfsPeriod(cpuCfsPeriod)
-			if err != nil {
-				return err
-			}
-		}
-
 		if cpuCfsQuota != "-1" {
-			err = cg.SetCPUCfsQuota(cpuCfsQuota)
+			err = cg.SetCPUCfsLimit(cpuCfsPeriod, cpuCfsQuota)
 			if err != nil {
 				return err
 			}
@@ -3121,6 +3114,11 @@ func (c *lxc) RenderFull() (*api.InstanceFull, interface{}, error) {
 	return &ct, etag, nil
 }
 
+// Metrics is not implemented for containers.
+func (c *lxc) Metrics() (*api.InstanceMetrics, error) {
+	return nil, instance.ErrNotImplemented
+}
+
 // RenderState renders just the running state of the instance.
 func (c *lxc) RenderState() (*api.InstanceState, error) {
 	cState, err := c.getLxcState()
@@ -3146,6 +3144,11 @@ func (c *lxc) RenderState() (*api.InstanceState, error) {
 	return &status, nil
 }
 
+// SnapshotDisk is not implemented for containers.
+func (c *lxc) SnapshotDisk(devName string, snapshotName string) error {
+	return instance.ErrNotImplemented
+}
+
 // Snapshots returns the snapshots of the instance.
 func (c *lxc) Snapshots() ([]instance.Instance, error) {
 	var snaps []db.Instance
@@ -3893,22 +3896,7 @@ func (c *lxc) Update(args db.InstanceArgs, userRequested bool) error {
 	}
 
 	// Diff the configurations
-	changedConfig := []string{}
-	for key := range oldExpandedConfig {
-		if oldExpandedConfig[key] != c.expandedConfig[key] {
-			if !shared.StringInSlice(key, changedConfig) {
-				changedConfig = append(changedConfig, key)
-			}
-		}
-	}
-
-	for key := range c.expandedConfig {
-		if oldExpandedConfig[key] != c.expandedConfig[key] {
-			if !shared.StringInSlice(key, changedConfig) {
-				changedConfig = append(changedConfig, key)
-			}
-		}
-	}
+	changedConfig := configKeysChanged(oldExpandedConfig, c.expandedConfig)
 
 	// Diff the devices
 	removeDevices, addDevices, updateDevices, updateDiff := oldExpandedDevices.Update(c.expandedDevices, func(oldDevice deviceConfig.Device, newDevice deviceConfig.Device) []string {
@@ -4263,12 +4251,7 @@ func (c *lxc) Update(args db.InstanceArgs, userRequested bool) error {
 				if err != nil {
 					return err
 				}
-				err = cg.SetCPUCfsPeriod(cpuCfsPeriod)
-				if err != nil {
-					return err
-				}
-
-				err = cg.SetCPUCfsQuota(cpuCfsQuota)
+				err = cg.SetCPUCfsLimit(cpuCfsPeriod, cpuCfsQuota)
 				if err != nil {
 					return err
 				}
@@ -5408,6 +5391,16 @@ func (c *lxc) FilePush(fileType string, srcpath string, dstpath string, uid int6
 	return nil
 }
 
+// FilePullTree is not implemented for containers.
+func (c *lxc) FilePullTree(srcPath string, w io.Writer) error {
+	return instance.ErrNotImplemented
+}
+
+// FilePushTree is not implemented for containers.
+func (c *lxc) FilePushTree(r io.Reader, dstPath string, uid int64, gid int64) error {
+	return instance.ErrNotImplemented
+}
+
 // FileRemove removes a file inside the instance.
 func (c *lxc) FileRemove(path string) error {
 	var errStr string
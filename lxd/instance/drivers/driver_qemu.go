@@ -1,22 +1,31 @@
 package drivers
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
 	"net"
 	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"text/template"
 	"time"
+	"unicode"
+	"unicode/utf8"
+	"unsafe"
 
 	"github.com/flosch/pongo2"
 	"github.com/gorilla/websocket"
@@ -27,11 +36,13 @@ import (
 
 	lxdClient "github.com/lxc/lxd/client"
 	"github.com/lxc/lxd/lxd/backup"
+	"github.com/lxc/lxd/lxd/cgroup"
 	"github.com/lxc/lxd/lxd/cluster"
 	"github.com/lxc/lxd/lxd/db"
 	"github.com/lxc/lxd/lxd/db/query"
 	"github.com/lxc/lxd/lxd/device"
 	deviceConfig "github.com/lxc/lxd/lxd/device/config"
+	"github.com/lxc/lxd/lxd/dnsmasq"
 	"github.com/lxc/lxd/lxd/instance"
 	"github.com/lxc/lxd/lxd/instance/drivers/qmp"
 	"github.com/lxc/lxd/lxd/instance/instancetype"
@@ -56,16 +67,82 @@ import (
 	"github.com/lxc/lxd/shared/osarch"
 	"github.com/lxc/lxd/shared/termios"
 	"github.com/lxc/lxd/shared/units"
+	"github.com/lxc/lxd/shared/version"
 )
 
 // qemuAsyncIO is used to indicate disk should use unsafe cache I/O.
 const qemuUnsafeIO = "unsafeio"
 
+// qemuRebootTimeout is how long to wait for the guest to come back after an in-place reboot when no
+// timeout is supplied.
+const qemuRebootTimeout = 30 * time.Second
+
+// qemuKillTimeout is how long to wait for a killed qemu process to exit.
+const qemuKillTimeout = 5 * time.Second
+
+// qemuStopTimeout is how long Stop waits for qemu to exit before terminating it. This must leave enough
+// time for terminating qemu within the 30s the stop operation lock lasts.
+const qemuStopTimeout = 15 * time.Second
+
+// qemuStartTimeout is how long a qemu process started without -daemonize has to set up the VM.
+const qemuStartTimeout = 30 * time.Second
+
+// qemuBootDiagnosticsSize is how much of the console output and of the qemu log is included in the error
+// of a failed start when boot.diagnostics_size isn't set.
+const qemuBootDiagnosticsSize = 4096
+
+// qemuConsoleLogSize is how much of the console output of a boot is kept in ConsoleBufferLogPath. Its
+// start is kept, covering the firmware, boot loader and kernel output of a boot that fails or hangs.
+const qemuConsoleLogSize = 1024 * 1024
+
+// qemuConsoleLogInterval is how often the console log of a running VM is cut back to qemuConsoleLogSize.
+var qemuConsoleLogInterval = 5 * time.Second
+
+// qemuBootHangTimeout is how long the agent has to report in after the boot before the boot diagnostics
+// are logged.
+var qemuBootHangTimeout = 5 * time.Minute
+
+// qemuEscapeSequence matches the terminal escape sequences the firmware uses to draw on the console.
+var qemuEscapeSequence = regexp.MustCompile(`\x1b(\[[0-9;?]*[ -/]*[@-~]|[()][0-9A-Za-z]|[=>78])`)
+
+// qemuAgentConnectAttempts is how many times connecting to the lxd-agent is tried before running a
+// command, qemuAgentConnectRetryDelay apart.
+const qemuAgentConnectAttempts = 3
+
+var qemuAgentConnectRetryDelay = time.Second
+
+// qemuExecKeepaliveInterval is how often the lxd-agent is pinged while a command runs. The command fails
+// once qemuExecKeepaliveMisses pings in a row went unanswered.
+var qemuExecKeepaliveInterval = 10 * time.Second
+
+const qemuExecKeepaliveMisses = 3
+
 var errQemuAgentOffline = fmt.Errorf("LXD VM agent isn't currently running")
 
+var errQemuAgentLost = fmt.Errorf("Lost the connection to the LXD VM agent while the command was running, the VM may have crashed")
+
 var vmConsole = map[int]bool{}
 var vmConsoleLock sync.Mutex
 
+var vmWatchdogReset = map[int]bool{}
+var vmWatchdogResetLock sync.Mutex
+
+var vmShutdown = map[int]int{}
+var vmShutdownLock sync.Mutex
+
+// vmSupervised records the qemu process being supervised for each VM, by instance ID.
+var vmSupervised = map[int]int{}
+var vmSupervisedLock sync.Mutex
+
+var vmForceStop = map[int]bool{}
+var vmForceStopLock sync.Mutex
+
+var vmOnStop = map[int]*operationlock.InstanceOperation{}
+var vmOnStopLock sync.Mutex
+
+// vmGuestLogLock serializes the draining of the guest logs into their files.
+var vmGuestLogLock sync.Mutex
+
 // qemuLoad creates a Qemu instance from the supplied InstanceArgs.
 func qemuLoad(s *state.State, args db.InstanceArgs, profiles []api.Profile) (instance.Instance, error) {
 	// Create the instance struct.
@@ -302,8 +379,11 @@ type qemu struct {
 	// Do not use these variables directly, instead use their associated get functions so they
 	// will be initialised on demand.
 	agentClient      *http.Client
+	monitor          *qmp.Monitor
+	monitorLock      sync.Mutex
 	storagePool      storagePools.Pool
 	architectureName string
+	firmware         *qemuFirmware
 }
 
 // getAgentClient returns the current agent client handle. To avoid TLS setup each time this
@@ -327,6 +407,28 @@ func (vm *qemu) getAgentClient() (*http.Client, error) {
 	return agent, nil
 }
 
+// getMonitor returns the current QMP monitor handle. To avoid looking up or establishing the
+// connection each time this function is called, the handle is cached internally in the Qemu struct
+// until it gets disconnected. The cache is locked as concurrent requests can share the struct.
+func (vm *qemu) getMonitor() (*qmp.Monitor, error) {
+	vm.monitorLock.Lock()
+	defer vm.monitorLock.Unlock()
+
+	if vm.monitor != nil && !vm.monitor.Disconnected() {
+		return vm.monitor, nil
+	}
+
+	vm.monitor = nil
+
+	monitor, err := qmp.Connect(vm.getMonitorPath(), vm.getMonitorEventHandler())
+	if err != nil {
+		return nil, err
+	}
+	vm.monitor = monitor
+
+	return vm.monitor, nil
+}
+
 // getStoragePool returns the current storage pool handle. To avoid a DB lookup each time this
 // function is called, the handle is cached internally in the Qemu struct.
 func (vm *qemu) getStoragePool() (storagePools.Pool, error) {
@@ -343,12 +445,37 @@ func (vm *qemu) getStoragePool() (storagePools.Pool, error) {
 	return vm.storagePool, nil
 }
 
+// checkRootDiskPool checks that the storage pool referenced by the root disk of the VM exists. When it
+// doesn't, the error names the pool the instance volume is now on, if any, as happens after a rename.
+func (vm *qemu) checkRootDiskPool() error {
+	rootDiskName, rootDiskDevice, err := shared.GetRootDiskDevice(vm.expandedDevices.CloneNative())
+	if err != nil {
+		return err
+	}
+
+	_, err = vm.state.Cluster.StoragePoolGetID(rootDiskDevice["pool"])
+	if err == nil {
+		return nil
+	}
+
+	if err != db.ErrNoSuchObject {
+		return errors.Wrapf(err, "Failed loading storage pool %q of root disk %q", rootDiskDevice["pool"], rootDiskName)
+	}
+
+	poolName, err := vm.state.Cluster.InstancePool(vm.project, vm.name)
+	if err == nil && poolName != rootDiskDevice["pool"] {
+		return fmt.Errorf("Storage pool %q of root disk %q doesn't exist, the instance volume is on pool %q: set the pool property of the root disk to %q", rootDiskDevice["pool"], rootDiskName, poolName, poolName)
+	}
+
+	return fmt.Errorf("Storage pool %q of root disk %q doesn't exist", rootDiskDevice["pool"], rootDiskName)
+}
+
 func (vm *qemu) getMonitorEventHandler() func(event string, data map[string]interface{}) {
 	id := vm.id
 	state := vm.state
 
 	return func(event string, data map[string]interface{}) {
-		if !shared.StringInSlice(event, []string{"SHUTDOWN"}) {
+		if !shared.StringInSlice(event, []string{"SHUTDOWN", "WATCHDOG", "RESET", "BLOCK_IO_ERROR"}) {
 			return
 		}
 
@@ -358,13 +485,84 @@ func (vm *qemu) getMonitorEventHandler() func(event string, data map[string]inte
 			return
 		}
 
+		if event == "WATCHDOG" {
+			action, _ := data["action"].(string)
+			logger.Warn("Instance watchdog expired", log.Ctx{"project": inst.Project(), "instance": inst.Name(), "action": action})
+
+			// Record the reset so that the upcoming shutdown is handled as a reboot.
+			if action == "reset" {
+				vmWatchdogResetLock.Lock()
+				vmWatchdogReset[id] = true
+				vmWatchdogResetLock.Unlock()
+			}
+
+			return
+		}
+
+		if event == "BLOCK_IO_ERROR" {
+			// Only errors pausing the VM are recorded, others are reported to the guest.
+			reason, paused := qemuBlockIOErrorReason(data)
+			if !paused {
+				return
+			}
+
+			// qemu reports each failed request, only the first one is of interest.
+			vm := inst.(*qemu)
+			if vm.localConfig["volatile.vm.pause_reason"] == reason {
+				return
+			}
+
+			logger.Warn("Instance paused by an I/O error", log.Ctx{"project": vm.project, "instance": vm.name, "reason": reason})
+
+			err = vm.VolatileSet(map[string]string{"volatile.vm.pause_reason": reason})
+			if err != nil {
+				logger.Warn("Failed recording why the instance paused", log.Ctx{"project": vm.project, "instance": vm.name, "err": err})
+			}
+
+			state.Events.SendLifecycle(vm.project, "virtual-machine-paused", fmt.Sprintf("/1.0/virtual-machines/%s", vm.name), map[string]interface{}{"reason": reason})
+			return
+		}
+
+		if event == "RESET" {
+			// The guest was reset in place, any pending watchdog reset has now been handled.
+			vmWatchdogResetLock.Lock()
+			delete(vmWatchdogReset, id)
+			vmWatchdogResetLock.Unlock()
+
+			inst.(*qemu).setBootTime(time.Now())
+			state.Events.SendLifecycle(inst.Project(), "virtual-machine-rebooted", fmt.Sprintf("/1.0/virtual-machines/%s", inst.Name()), nil)
+			return
+		}
+
 		if event == "SHUTDOWN" {
+			// A forced stop cleans up by itself once qemu is gone.
+			vmForceStopLock.Lock()
+			forced := vmForceStop[id]
+			vmForceStopLock.Unlock()
+			if forced {
+				return
+			}
+
+			// Let the process supervisor know that the upcoming exit is expected.
+			pid, _ := inst.(*qemu).pid()
+			vmShutdownLock.Lock()
+			vmShutdown[id] = pid
+			vmShutdownLock.Unlock()
+
 			target := "stop"
 			entry, ok := data["reason"]
 			if ok && entry == "guest-reset" {
 				target = "reboot"
 			}
 
+			// A watchdog triggered reset is treated the same way as a guest reset.
+			vmWatchdogResetLock.Lock()
+			if vmWatchdogReset[id] {
+				target = "reboot"
+				delete(vmWatchdogReset, id)
+			}
+			vmWatchdogResetLock.Unlock()
+
 			err = inst.(*qemu).OnStop(target)
 			if err != nil {
 				logger.Errorf("Failed to cleanly stop instance '%s': %v", project.Instance(inst.Project(), inst.Name()), err)
@@ -374,6 +572,34 @@ func (vm *qemu) getMonitorEventHandler() func(event string, data map[string]inte
 	}
 }
 
+// qemuBlockIOErrorReason returns why qemu paused the VM from the data of a BLOCK_IO_ERROR event, and
+// whether it was paused at all.
+func qemuBlockIOErrorReason(data map[string]interface{}) (string, bool) {
+	action, _ := data["action"].(string)
+	if action != "stop" {
+		return "", false
+	}
+
+	// Drives are named after their disk device, prefixed with "lxd_".
+	devName, _ := data["device"].(string)
+	if devName == "" {
+		devName, _ = data["node-name"].(string)
+	}
+
+	devName = strings.TrimPrefix(devName, "lxd_")
+
+	operation, _ := data["operation"].(string)
+	cause, _ := data["reason"].(string)
+	nospace, _ := data["nospace"].(bool)
+	if nospace {
+		cause = "No space left on device"
+	} else if cause == "" {
+		cause = "Unknown error"
+	}
+
+	return fmt.Sprintf("I/O error on disk %q during %s: %s", devName, operation, cause), true
+}
+
 // mount the instance's config volume if needed.
 func (vm *qemu) mount() (bool, error) {
 	var pool storagePools.Pool
@@ -460,51 +686,116 @@ func (vm *qemu) generateAgentCert() (string, string, string, string, error) {
 
 // Freeze freezes the instance.
 func (vm *qemu) Freeze() error {
+	// Check that we're running.
+	if !vm.IsRunning() {
+		return fmt.Errorf("The instance isn't running")
+	}
+
+	// Check that we're not already paused.
+	if vm.IsFrozen() {
+		return fmt.Errorf("The instance is already paused")
+	}
+
+	// Setup a new operation, preventing a concurrent stop from racing with the pause.
+	op, err := operationlock.Create(vm.id, "freeze", false, false)
+	if err != nil {
+		return err
+	}
+
 	// Connect to the monitor.
-	monitor, err := qmp.Connect(vm.getMonitorPath(), vm.getMonitorEventHandler())
+	monitor, err := vm.getMonitor()
 	if err != nil {
+		op.Done(err)
 		return err
 	}
 
 	// Send the stop command.
 	err = monitor.Pause()
 	if err != nil {
+		op.Done(err)
 		return err
 	}
 
+	op.Done(nil)
+	vm.state.Events.SendLifecycle(vm.project, "virtual-machine-paused", fmt.Sprintf("/1.0/virtual-machines/%s", vm.name), nil)
 	return nil
 }
 
 // OnStop is run when the instance stops.
 func (vm *qemu) OnStop(target string) error {
-	// Pick up the existing stop operation lock created in Stop() function.
+	// Pick up the existing stop operation lock created in Stop() function. If the instance stopped
+	// on its own, e.g. the guest powered off or qemu crashed, create one so that concurrent
+	// callers are serialized.
 	op := operationlock.Get(vm.id)
 	if op != nil && op.Action() != "stop" {
 		return fmt.Errorf("Instance is already running a %s operation", op.Action())
 	}
 
+	if op == nil {
+		var err error
+		op, err = operationlock.Create(vm.id, "stop", false, false)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Only one caller cleans up for a given stop operation, others wait for it to complete, such
+	// as when qemu reports its shutdown while it's being terminated.
+	vmOnStopLock.Lock()
+	if vmOnStop[vm.id] == op {
+		vmOnStopLock.Unlock()
+		return op.Wait()
+	}
+
+	vmOnStop[vm.id] = op
+	vmOnStopLock.Unlock()
+
+	defer func() {
+		vmOnStopLock.Lock()
+		if vmOnStop[vm.id] == op {
+			delete(vmOnStop, vm.id)
+		}
+		vmOnStopLock.Unlock()
+	}()
+
 	// Cleanup.
 	vm.cleanupDevices()
+
+	err := vm.stopTPM()
+	if err != nil {
+		logger.Warn("Failed to stop swtpm", log.Ctx{"project": vm.project, "instance": vm.name, "err": err})
+	}
+
 	os.Remove(vm.pidFilePath())
 	os.Remove(vm.getMonitorPath())
+	vm.removeCgroup()
+
+	vm.monitorLock.Lock()
+	vm.monitor = nil
+	vm.monitorLock.Unlock()
+
 	vm.unmount()
+	vm.setBootTime(time.Time{})
+	vm.clearHealth()
+	vm.clearPauseReason()
 
 	// Record power state.
-	err := vm.state.Cluster.ContainerSetState(vm.id, "STOPPED")
+	err = vm.state.Cluster.ContainerSetState(vm.id, "STOPPED")
 	if err != nil {
 		op.Done(err)
 		return err
 	}
 
+	// The stop is complete, release the lock so that the instance can be started again.
+	op.Done(nil)
+
 	if target == "reboot" {
 		err := vm.Start(false)
 		if err != nil {
 			return err
 		}
-	}
 
-	if op != nil {
-		op.Done(nil)
+		vm.state.Events.SendLifecycle(vm.project, "virtual-machine-rebooted", fmt.Sprintf("/1.0/virtual-machines/%s", vm.name), nil)
 	}
 
 	return nil
@@ -523,7 +814,7 @@ func (vm *qemu) Shutdown(timeout time.Duration) error {
 	}
 
 	// Connect to the monitor.
-	monitor, err := qmp.Connect(vm.getMonitorPath(), vm.getMonitorEventHandler())
+	monitor, err := vm.getMonitor()
 	if err != nil {
 		op.Done(err)
 		return err
@@ -541,6 +832,12 @@ func (vm *qemu) Shutdown(timeout time.Duration) error {
 		return err
 	}
 
+	// Keep what the guest logged before its ringbuf goes away with qemu.
+	err = vm.drainGuestLog(monitor)
+	if err != nil {
+		logger.Warn("Failed saving the guest log", log.Ctx{"project": vm.project, "instance": vm.name, "err": err})
+	}
+
 	// Send the system_powerdown command.
 	err = monitor.Powerdown()
 	if err != nil {
@@ -553,188 +850,463 @@ func (vm *qemu) Shutdown(timeout time.Duration) error {
 		return err
 	}
 
+	// Guests ignoring the first ACPI event may be asked again, every boot.shutdown_retry_interval seconds.
+	var retry <-chan time.Time
+	retryInterval, _ := strconv.Atoi(vm.expandedConfig["boot.shutdown_retry_interval"])
+	if retryInterval > 0 {
+		ticker := time.NewTicker(time.Duration(retryInterval) * time.Second)
+		defer ticker.Stop()
+		retry = ticker.C
+	}
+
 	// If timeout provided, block until the VM is not running or the timeout has elapsed.
+	// Otherwise block until the VM is not running.
+	var deadline <-chan time.Time
 	if timeout > 0 {
+		deadline = time.After(timeout)
+	}
+
+	for {
 		select {
 		case <-chDisconnect:
 			op.Done(nil)
 			vm.state.Events.SendLifecycle(vm.project, "instance-shutdown", fmt.Sprintf("/1.0/virtual-machines/%s", vm.name), nil)
 			return nil
-		case <-time.After(timeout):
+		case <-deadline:
 			op.Done(fmt.Errorf("Instance was not shutdown after timeout"))
 			return fmt.Errorf("Instance was not shutdown after timeout")
+		case <-retry:
+			vm.retryShutdown(monitor)
 		}
-	} else {
-		<-chDisconnect // Block until VM is not running if no timeout provided.
 	}
-
-	op.Done(nil)
-	vm.state.Events.SendLifecycle(vm.project, "instance-shutdown", fmt.Sprintf("/1.0/virtual-machines/%s", vm.name), nil)
-	return nil
 }
 
-func (vm *qemu) ovmfPath() string {
-	if os.Getenv("LXD_OVMF_PATH") != "" {
-		return os.Getenv("LXD_OVMF_PATH")
+// retryShutdown sends the guest another ACPI power button event and, if boot.shutdown_retry_agent is
+// enabled, also asks the lxd-agent to power it off. Failures are only logged, as the guest may already
+// be going away.
+func (vm *qemu) retryShutdown(monitor *qmp.Monitor) {
+	logger.Debug("Instance still running, asking it to shutdown again", log.Ctx{"project": vm.project, "instance": vm.name})
+
+	err := monitor.Powerdown()
+	if err != nil && err != qmp.ErrMonitorDisconnect {
+		logger.Warn("Failed to send powerdown to instance", log.Ctx{"project": vm.project, "instance": vm.name, "err": err})
 	}
 
-	return "/usr/share/OVMF"
-}
+	if !shared.IsTrue(vm.expandedConfig["boot.shutdown_retry_agent"]) || !monitor.AgentReady() {
+		return
+	}
 
-// Start starts the instance.
-func (vm *qemu) Start(stateful bool) error {
-	// Ensure the correct vhost_vsock kernel module is loaded before establishing the vsock.
-	err := util.LoadModule("vhost_vsock")
+	devNull, err := os.OpenFile(os.DevNull, os.O_RDWR, 0)
 	if err != nil {
-		return err
+		logger.Warn("Failed to power off instance through the agent", log.Ctx{"project": vm.project, "instance": vm.name, "err": err})
+		return
 	}
 
-	if vm.IsRunning() {
-		return fmt.Errorf("The instance is already running")
+	cmd, err := vm.Exec(api.InstanceExecPost{Command: []string{"poweroff"}}, devNull, devNull, devNull)
+	if err != nil {
+		devNull.Close()
+		logger.Warn("Failed to power off instance through the agent", log.Ctx{"project": vm.project, "instance": vm.name, "err": err})
+		return
 	}
 
-	// Setup a new operation
-	op, err := operationlock.Create(vm.id, "start", false, false)
+	// The command is lost along with the agent once the guest powers off, so don't wait on it.
+	go func() {
+		cmd.Wait()
+		devNull.Close()
+	}()
+}
+
+// Reboot reboots the instance. If qemu was started with in-place reboots enabled, the guest is reset
+// while keeping the qemu process and its devices around. The instance is only stopped and started
+// again if the guest doesn't come back within the timeout.
+func (vm *qemu) Reboot(timeout time.Duration) error {
+	if !vm.IsRunning() {
+		return fmt.Errorf("The instance isn't running")
+	}
+
+	inPlace, err := vm.canRebootInPlace()
 	if err != nil {
-		return errors.Wrap(err, "Create instance start operation")
+		return err
 	}
-	defer op.Done(nil)
 
-	revert := revert.New()
-	defer revert.Fail()
+	if inPlace {
+		err = vm.resetInPlace(timeout)
+		if err == nil {
+			return nil
+		}
 
-	// Mount the instance's config volume.
-	_, err = vm.mount()
+		logger.Warn("Failed to reboot instance in place, restarting it", log.Ctx{"project": vm.project, "instance": vm.name, "err": err})
+
+		// The guest is unresponsive, no point in asking it to shutdown.
+		err = vm.Stop(false)
+		if err != nil {
+			return err
+		}
+	} else {
+		err = vm.Shutdown(timeout)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = vm.Start(false)
 	if err != nil {
-		op.Done(err)
 		return err
 	}
 
-	revert.Add(func() { vm.unmount() })
+	vm.state.Events.SendLifecycle(vm.project, "virtual-machine-rebooted", fmt.Sprintf("/1.0/virtual-machines/%s", vm.name), nil)
+	return nil
+}
 
-	err = vm.generateConfigShare()
+// canRebootInPlace returns whether the running qemu process resets the guest in place rather than
+// exiting when the guest reboots.
+func (vm *qemu) canRebootInPlace() (bool, error) {
+	args, err := vm.processArgs()
 	if err != nil {
-		op.Done(err)
-		return err
+		return false, err
 	}
 
-	err = os.MkdirAll(vm.LogPath(), 0700)
+	if args == nil {
+		return false, nil
+	}
+
+	return !shared.StringInSlice("-no-reboot", args), nil
+}
+
+// resetInPlace resets the guest through QMP and waits for it to come back. The guest is considered
+// back once the agent reports in again, or once the VM is running if no agent was ever detected.
+func (vm *qemu) resetInPlace(timeout time.Duration) error {
+	op, err := operationlock.Create(vm.id, "restart", false, false)
 	if err != nil {
-		op.Done(err)
 		return err
 	}
 
-	err = os.MkdirAll(vm.DevicesPath(), 0711)
+	// Connect to the monitor.
+	monitor, err := vm.getMonitor()
 	if err != nil {
 		op.Done(err)
 		return err
 	}
 
-	err = os.MkdirAll(vm.ShmountsPath(), 0711)
+	agentReady := monitor.AgentReady()
+
+	err = monitor.Reset()
 	if err != nil {
 		op.Done(err)
 		return err
 	}
 
-	// Get a UUID for Qemu.
-	vmUUID := vm.localConfig["volatile.vm.uuid"]
-	if vmUUID == "" {
-		vmUUID = uuid.New()
-		vm.VolatileSet(map[string]string{"volatile.vm.uuid": vmUUID})
+	if timeout <= 0 {
+		timeout = qemuRebootTimeout
 	}
 
-	// Copy OVMF settings firmware to nvram file.
-	// This firmware file can be modified by the VM so it must be copied from the defaults.
-	if !shared.PathExists(vm.getNvramPath()) {
-		err = vm.setupNvram()
-		if err != nil {
+	deadline := time.Now().Add(timeout)
+	for {
+		if agentReady {
+			if monitor.AgentReady() {
+				break
+			}
+		} else {
+			status, err := monitor.Status()
+			if err != nil {
+				op.Done(err)
+				return err
+			}
+
+			if status == "running" {
+				break
+			}
+		}
+
+		if time.Now().After(deadline) {
+			err = fmt.Errorf("Instance didn't come back after reboot within %v", timeout)
 			op.Done(err)
 			return err
 		}
+
+		time.Sleep(time.Second)
 	}
 
-	devConfs := make([]*deviceConfig.RunConfig, 0, len(vm.expandedDevices))
+	op.Done(nil)
+	return nil
+}
 
-	// Setup devices in sorted order, this ensures that device mounts are added in path order.
-	for _, dev := range vm.expandedDevices.Sorted() {
-		// Start the device.
-		runConf, err := vm.deviceStart(dev.Name, dev.Config, false)
-		if err != nil {
-			op.Done(err)
-			return errors.Wrapf(err, "Failed to start device %q", dev.Name)
-		}
+// qemuFirmware is an EFI firmware code file along with the settings file NVRAMs are created from.
+type qemuFirmware struct {
+	code       string
+	vars       string
+	secureBoot bool // Whether the settings have the Microsoft secure boot keys enrolled.
+}
 
-		if runConf == nil {
-			continue
-		}
+// qemuFirmwareDirs lists the directories the EFI firmware is searched in, by architecture.
+var qemuFirmwareDirs = map[int][]string{
+	osarch.ARCH_64BIT_INTEL_X86:           {"/usr/share/OVMF", "/usr/share/edk2/ovmf", "/usr/share/edk2/x64", "/usr/share/edk2-ovmf/x64", "/usr/share/qemu"},
+	osarch.ARCH_64BIT_ARMV8_LITTLE_ENDIAN: {"/usr/share/AAVMF", "/usr/share/edk2/aarch64", "/usr/share/edk2-armvirt/aarch64", "/usr/share/qemu"},
+}
 
-		// Use a local function argument to ensure the current device is added to the reverter.
-		func(localDev deviceConfig.DeviceNamed) {
-			revert.Add(func() {
-				err := vm.deviceStop(localDev.Name, localDev.Config)
-				if err != nil {
-					logger.Errorf("Failed to cleanup device %q: %v", localDev.Name, err)
-				}
-			})
-		}(dev)
+// qemuFirmwares lists the known EFI firmware file names by architecture, in order of preference.
+var qemuFirmwares = map[int][]qemuFirmware{
+	osarch.ARCH_64BIT_INTEL_X86: {
+		{code: "OVMF_CODE.fd", vars: "OVMF_VARS.ms.fd", secureBoot: true},
+		{code: "OVMF_CODE_4M.ms.fd", vars: "OVMF_VARS_4M.ms.fd", secureBoot: true},
+		{code: "OVMF_CODE.secboot.fd", vars: "OVMF_VARS.secboot.fd", secureBoot: true},
+		{code: "OVMF_CODE.fd", vars: "OVMF_VARS.fd"},
+		{code: "OVMF_CODE_4M.fd", vars: "OVMF_VARS_4M.fd"},
+		{code: "OVMF_CODE.4m.fd", vars: "OVMF_VARS.4m.fd"},
+		{code: "edk2-x86_64-code.fd", vars: "edk2-i386-vars.fd"},
+	},
+	osarch.ARCH_64BIT_ARMV8_LITTLE_ENDIAN: {
+		{code: "OVMF_CODE.fd", vars: "OVMF_VARS.ms.fd", secureBoot: true},
+		{code: "AAVMF_CODE.ms.fd", vars: "AAVMF_VARS.ms.fd", secureBoot: true},
+		{code: "AAVMF_CODE.fd", vars: "AAVMF_VARS.ms.fd", secureBoot: true},
+		{code: "OVMF_CODE.fd", vars: "OVMF_VARS.fd"},
+		{code: "AAVMF_CODE.fd", vars: "AAVMF_VARS.fd"},
+		{code: "QEMU_EFI-pflash.raw", vars: "vars-template-pflash.raw"},
+		{code: "edk2-aarch64-code.fd", vars: "edk2-arm-vars.fd"},
+	},
+}
 
-		devConfs = append(devConfs, runConf)
+// qemuFindFirmware searches the known locations for an EFI firmware of the architecture, with or
+// without the secure boot keys enrolled. Only the directory in LXD_OVMF_PATH is searched when set.
+func qemuFindFirmware(architecture int, secureBoot bool) (*qemuFirmware, error) {
+	dirs := qemuFirmwareDirs[architecture]
+	if os.Getenv("LXD_OVMF_PATH") != "" {
+		dirs = []string{os.Getenv("LXD_OVMF_PATH")}
 	}
 
-	// Get qemu configuration.
-	qemuBinary, err := vm.qemuArchConfig()
-	if err != nil {
-		op.Done(err)
-		return err
-	}
+	searched := []string{}
+	for _, dir := range dirs {
+		for _, firmware := range qemuFirmwares[architecture] {
+			if firmware.secureBoot != secureBoot {
+				continue
+			}
 
-	// Define a set of files to open and pass their file descriptors to qemu command.
-	fdFiles := make([]string, 0)
+			code := filepath.Join(dir, firmware.code)
+			vars := filepath.Join(dir, firmware.vars)
+			if shared.PathExists(code) && shared.PathExists(vars) {
+				return &qemuFirmware{code: code, vars: vars, secureBoot: secureBoot}, nil
+			}
 
-	confFile, err := vm.generateQemuConfigFile(devConfs, &fdFiles)
-	if err != nil {
-		op.Done(err)
-		return err
+			searched = append(searched, fmt.Sprintf("%s and %s", code, vars))
+		}
 	}
 
-	// Check qemu is installed.
-	qemuPath, err := exec.LookPath(qemuBinary)
-	if err != nil {
-		op.Done(err)
-		return err
+	if len(searched) == 0 {
+		return nil, fmt.Errorf("No known EFI firmware for this architecture")
 	}
 
-	qemuCmd := []string{
-		"--",
-		qemuPath,
-		"-S",
-		"-name", vm.Name(),
-		"-uuid", vmUUID,
-		"-daemonize",
-		"-cpu", "host",
-		"-nographic",
-		"-serial", "chardev:console",
-		"-nodefaults",
-		"-no-reboot",
-		"-no-user-config",
-		"-sandbox", "on,obsolete=deny,elevateprivileges=allow,spawn=deny,resourcecontrol=deny",
-		"-readconfig", confFile,
-		"-pidfile", vm.pidFilePath(),
-		"-D", vm.LogFilePath(),
-		"-chroot", vm.Path(),
+	return nil, fmt.Errorf("Required EFI firmware not found, searched for: %s", strings.Join(searched, ", "))
+}
+
+// getFirmware returns the EFI firmware to use for the VM based on its secure boot setting. To avoid
+// searching the filesystem each time this function is called, the result is cached internally in
+// the Qemu struct.
+func (vm *qemu) getFirmware() (*qemuFirmware, error) {
+	secureBoot := vm.expandedConfig["security.secureboot"] == "" || shared.IsTrue(vm.expandedConfig["security.secureboot"])
+	if vm.firmware != nil && vm.firmware.secureBoot == secureBoot {
+		return vm.firmware, nil
 	}
 
-	// Attempt to drop privileges.
-	if vm.state.OS.UnprivUser != "" {
-		qemuCmd = append(qemuCmd, "-runas", vm.state.OS.UnprivUser)
+	firmware, err := qemuFindFirmware(vm.architecture, secureBoot)
+	if err != nil {
+		return nil, err
+	}
+	vm.firmware = firmware
+
+	return vm.firmware, nil
+}
+
+// Start starts the instance.
+func (vm *qemu) Start(stateful bool) (err error) {
+	// Ensure the correct vhost_vsock kernel module is loaded before establishing the vsock.
+	err = util.LoadModule("vhost_vsock")
+	if err != nil {
+		return err
+	}
+
+	if vm.IsRunning() {
+		return fmt.Errorf("The instance is already running")
+	}
+
+	// Setup a new operation
+	op, err := operationlock.Create(vm.id, "start", false, false)
+	if err != nil {
+		return errors.Wrap(err, "Create instance start operation")
+	}
+	defer op.Done(nil)
+
+	revert := revert.New()
+	defer revert.Fail()
+
+	// Once qemu has been run, point failures to what the firmware, the guest and qemu output meanwhile.
+	launched := false
+	defer func() {
+		if err != nil && launched {
+			err = vm.bootDiagnostics(err)
+		}
+	}()
+
+	// Mention the configuration the VM last started with if it was changed since.
+	defer func() {
+		if err != nil {
+			err = vm.lastGoodConfigHint(err)
+		}
+	}()
+
+	// Check the project limits still allow for the VM to run alongside the other running instances.
+	err = vm.state.Cluster.Transaction(func(tx *db.ClusterTx) error {
+		return project.AllowInstanceStart(tx, vm.project, vm.name)
+	})
+	if err != nil {
+		op.Done(err)
+		return err
+	}
+
+	// The storage pool of the root disk may have been removed or renamed while the VM was stopped.
+	err = vm.checkRootDiskPool()
+	if err != nil {
+		op.Done(err)
+		return err
+	}
+
+	// Fail early with all the features the host's qemu lacks, rather than on the first one qemu reports.
+	err = vm.checkQemuCapabilities()
+	if err != nil {
+		op.Done(err)
+		return err
+	}
+
+	// Mount the instance's config volume.
+	_, err = vm.mount()
+	if err != nil {
+		op.Done(err)
+		return err
+	}
+
+	revert.Add(func() { vm.unmount() })
+
+	err = os.MkdirAll(vm.LogPath(), 0700)
+	if err != nil {
+		op.Done(err)
+		return err
+	}
+
+	err = os.MkdirAll(vm.DevicesPath(), 0711)
+	if err != nil {
+		op.Done(err)
+		return err
+	}
+
+	err = os.MkdirAll(vm.ShmountsPath(), 0711)
+	if err != nil {
+		op.Done(err)
+		return err
+	}
+
+	// Get a UUID for Qemu.
+	vmUUID := vm.localConfig["volatile.vm.uuid"]
+	if vmUUID == "" {
+		vmUUID = uuid.New()
+		vm.VolatileSet(map[string]string{"volatile.vm.uuid": vmUUID})
+	}
+
+	// Copy OVMF settings firmware to nvram file, unless booting a kernel directly without the firmware.
+	// This firmware file can be modified by the VM so it must be copied from the defaults.
+	if vm.expandedConfig["raw.qemu.kernel"] == "" && !shared.PathExists(vm.getNvramPath()) {
+		err = vm.setupNvram()
+		if err != nil {
+			op.Done(err)
+			return err
+		}
+	}
+
+	devConfs, err := vm.startDevices(revert)
+	if err != nil {
+		op.Done(err)
+		return err
+	}
+
+	// The config share is generated once the NICs got their addresses, such as those allocated for
+	// IP filtering, for the cloud-init network config to match them.
+	err = vm.generateConfigShare()
+	if err != nil {
+		op.Done(err)
+		return err
+	}
+
+	// Start the TPM emulator.
+	if shared.IsTrue(vm.expandedConfig["security.tpm"]) {
+		err = vm.startTPM()
+		if err != nil {
+			op.Done(err)
+			return err
+		}
+
+		revert.Add(func() { vm.stopTPM() })
+	}
 
+	// Pick the vsock context ID before it's used in the qemu config.
+	err = vm.allocateVsockID()
+	if err != nil {
+		op.Done(err)
+		return err
+	}
+
+	// Get qemu configuration.
+	qemuBinary, err := vm.qemuArchConfig()
+	if err != nil {
+		op.Done(err)
+		return err
+	}
+
+	// Define a set of files to open and pass their file descriptors to qemu command.
+	fdFiles := make([]string, 0)
+
+	confFile, err := vm.generateQemuConfigFile(devConfs, &fdFiles)
+	if err != nil {
+		op.Done(err)
+		return err
+	}
+
+	// Check qemu is installed.
+	qemuPath, err := exec.LookPath(qemuBinary)
+	if err != nil {
+		op.Done(err)
+		return err
+	}
+
+	qemuCmd, shadowed, err := vm.qemuCommand(qemuPath, confFile, vmUUID, false)
+	if err != nil {
+		op.Done(err)
+		return err
+	}
+
+	// Keep the raw.qemu arguments, already checked when building the command, to relate failures to them.
+	rawArgs, _ := shared.SplitShellArgs(vm.expandedConfig["raw.qemu"])
+	rawOverrides := qemuRawOverrides(rawArgs)
+
+	sandboxOpts := qemuSandboxOpts(vm.expandedConfig)
+	if sandboxOpts != qemuSandboxOpts(nil) {
+		logger.Warn("Starting VM with a relaxed qemu sandbox, this should only be used for debugging", log.Ctx{"project": vm.project, "instance": vm.name, "sandbox": sandboxOpts})
+	}
+
+	for _, name := range shadowed {
+		logger.Warn("raw.qemu overrides an LXD managed qemu argument", log.Ctx{"project": vm.project, "instance": vm.name, "argument": name, "value": rawOverrides[name]})
+	}
+
+	// Supervised qemu processes don't daemonize, staying children of LXD.
+	supervised := shared.IsTrue(vm.expandedConfig["boot.supervised"])
+
+	// Prepare for qemu dropping privileges.
+	if vm.state.OS.UnprivUser != "" {
 		// Change ownership of config directory files so they are accessible to the
 		// unprivileged qemu process so that the 9p share can work.
 		//
 		// Security note: The 9P share will present the UID owner of these files on the host
 		// to the VM. In order to ensure that non-root users in the VM cannot access these
 		// files be sure to mount the 9P share in the VM with the "access=0" option to allow
-		// only root user in VM to access the mounted share.
+		// only root user in VM to access the mounted share. The same applies when qemu keeps
+		// running as root and the files are presented as owned by root.
 		err := filepath.Walk(filepath.Join(vm.Path(), "config"),
 			func(path string, info os.FileInfo, err error) error {
 				if err != nil {
@@ -754,15 +1326,43 @@ func (vm *qemu) Start(stateful bool) error {
 			op.Done(err)
 			return err
 		}
-	}
 
-	if shared.IsTrue(vm.expandedConfig["limits.memory.hugepages"]) {
-		qemuCmd = append(qemuCmd, "-mem-path", "/dev/hugepages/", "-mem-prealloc")
+		// Create the log file ahead of time so that the unprivileged qemu process can write to it.
+		logFile, err := os.OpenFile(vm.LogFilePath(), os.O_WRONLY|os.O_CREATE, 0600)
+		if err != nil {
+			op.Done(err)
+			return err
+		}
+
+		logFile.Close()
+
+		err = os.Chown(vm.LogFilePath(), vm.state.OS.UnprivUID, -1)
+		if err != nil {
+			op.Done(err)
+			return err
+		}
+
+		// Same for the console log.
+		logFile, err = os.OpenFile(vm.ConsoleBufferLogPath(), os.O_WRONLY|os.O_CREATE, 0600)
+		if err != nil {
+			op.Done(err)
+			return err
+		}
+
+		logFile.Close()
+
+		err = os.Chown(vm.ConsoleBufferLogPath(), vm.state.OS.UnprivUID, -1)
+		if err != nil {
+			op.Done(err)
+			return err
+		}
 	}
 
-	if vm.expandedConfig["raw.qemu"] != "" {
-		fields := strings.Split(vm.expandedConfig["raw.qemu"], " ")
-		qemuCmd = append(qemuCmd, fields...)
+	// The guest log only covers the current boot.
+	err = os.Remove(vm.GuestLogPath())
+	if err != nil && !os.IsNotExist(err) {
+		op.Done(err)
+		return err
 	}
 
 	// Run the qemu command via forklimits so we can selectively increase ulimits.
@@ -809,8 +1409,25 @@ func (vm *qemu) Start(stateful bool) error {
 			}
 			defer c.Close()
 			defer f.Close() // Close file after qemu has started.
+		} else if mode&os.ModeCharDevice != 0 {
+			// Don't wait for the carrier of serial ports nor make them LXD's controlling terminal.
+			f, err = os.OpenFile(file, os.O_RDWR|unix.O_NOCTTY|unix.O_NONBLOCK, 0)
+			if err != nil {
+				err = errors.Wrapf(err, "Error opening extra file %q", file)
+				op.Done(err)
+				return err
+			}
+			defer f.Close() // Close file after qemu has started.
 		} else {
 			f, err = os.OpenFile(file, os.O_RDWR, 0)
+			if err != nil {
+				// Fallback to read-only for files such as CD-ROM media.
+				errno, isErrno := shared.GetErrno(err)
+				if os.IsPermission(err) || (isErrno && errno == unix.EROFS) {
+					f, err = os.Open(file)
+				}
+			}
+
 			if err != nil {
 				err = errors.Wrapf(err, "Error opening exta file %q", file)
 				op.Done(err)
@@ -822,85 +1439,133 @@ func (vm *qemu) Start(stateful bool) error {
 		cmd.ExtraFiles = append(cmd.ExtraFiles, f)
 	}
 
-	err = cmd.Run()
-	if err != nil {
-		err = errors.Wrapf(err, "Failed to run: %s: %s", strings.Join(cmd.Args, " "), strings.TrimSpace(string(stderr.Bytes())))
+	// Truncate the console log, so that it only holds the output of this boot.
+	err = os.Truncate(vm.ConsoleBufferLogPath(), 0)
+	if err != nil && !os.IsNotExist(err) {
 		op.Done(err)
 		return err
 	}
 
-	pid, err := vm.pid()
-	if err != nil {
-		logger.Errorf(`Failed to get VM process ID "%d"`, pid)
-		return err
-	}
+	launched = true
 
-	revert.Add(func() {
-		proc, err := os.FindProcess(pid)
+	var pid int
+	var exited chan *os.ProcessState
+	if supervised {
+		// Keep qemu as a child of LXD in its own session, so that its exit status can be collected.
+		// Its output goes to a file rather than to LXD, which it may outlive.
+		outFile, err := os.OpenFile(vm.stderrFilePath(), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
 		if err != nil {
-			logger.Errorf(`Failed to find VM process "%d"`, pid)
-			return
+			op.Done(err)
+			return err
 		}
+		defer outFile.Close()
 
-		proc.Kill()
+		cmd.Stdout = outFile
+		cmd.Stderr = outFile
+		cmd.SysProcAttr = &unix.SysProcAttr{Setsid: true}
+
+		err = cmd.Start()
 		if err != nil {
-			logger.Errorf(`Failed to kill VM process "%d"`, pid)
+			err = errors.Wrapf(err, "Failed to run: %s", strings.Join(cmd.Args, " "))
+			op.Done(err)
+			return err
 		}
-	})
 
-	// Start QMP monitoring.
-	monitor, err := qmp.Connect(vm.getMonitorPath(), vm.getMonitorEventHandler())
-	if err != nil {
-		op.Done(err)
-		return err
-	}
+		pid = cmd.Process.Pid
+		exited = make(chan *os.ProcessState, 1)
+		go func() {
+			cmd.Wait()
+			exited <- cmd.ProcessState
+		}()
 
-	// Apply CPU pinning.
-	cpuLimit, ok := vm.expandedConfig["limits.cpu"]
-	if ok && cpuLimit != "" {
-		_, err := strconv.Atoi(cpuLimit)
+		err = vm.waitQemuStart(exited, qemuStartTimeout)
 		if err != nil {
-			// Expand to a set of CPU identifiers and get the pinning map.
-			_, _, _, pins, err := vm.cpuTopology(cpuLimit)
-			if err != nil {
-				op.Done(err)
-				return err
-			}
-
-			// Get the list of PIDs from the VM.
-			pids, err := monitor.GetCPUs()
-			if err != nil {
-				op.Done(err)
-				return err
+			output, _ := ioutil.ReadFile(vm.stderrFilePath())
+			rawErr := qemuRawArgError(rawArgs, string(output))
+			if rawErr != nil {
+				err = rawErr
+			} else {
+				err = errors.Wrapf(err, "Failed to run: %s: %s", strings.Join(cmd.Args, " "), strings.TrimSpace(string(output)))
 			}
 
-			// Confirm nothing weird is going on.
-			if len(pins) != len(pids) {
-				return fmt.Errorf("QEMU has less vCPUs than configured")
+			qemuKill(pid, qemuKillTimeout)
+			op.Done(err)
+			return err
+		}
+	} else {
+		err = cmd.Run()
+		if err != nil {
+			rawErr := qemuRawArgError(rawArgs, stderr.String())
+			if rawErr != nil {
+				err = rawErr
+			} else {
+				err = errors.Wrapf(err, "Failed to run: %s: %s", strings.Join(cmd.Args, " "), strings.TrimSpace(string(stderr.Bytes())))
 			}
 
-			for i, pid := range pids {
-				set := unix.CPUSet{}
-				set.Set(int(pins[uint64(i)]))
+			op.Done(err)
+			return err
+		}
 
-				// Apply the pin.
-				err := unix.SchedSetaffinity(pid, &set)
-				if err != nil {
-					op.Done(err)
-					return err
-				}
+		pid, err = vm.pid()
+		if err != nil || pid <= 0 {
+			if err == nil {
+				err = fmt.Errorf("Missing qemu pid file %q", vm.pidFilePath())
 			}
+
+			logger.Errorf(`Failed to get VM process ID "%d"`, pid)
+			op.Done(err)
+			return err
 		}
 	}
 
-	// Start the VM.
-	err = monitor.Start()
+	// Make sure the qemu process is gone and doesn't leave behind files confusing the next start
+	// if any of the following steps fail.
+	revert.Add(func() {
+		err := qemuKill(pid, qemuKillTimeout)
+		if err != nil {
+			logger.Error("Failed to kill VM process", log.Ctx{"project": vm.project, "instance": vm.name, "pid": pid, "err": err})
+			return
+		}
+
+		os.Remove(vm.pidFilePath())
+		os.Remove(vm.getMonitorPath())
+		vm.removeCgroup()
+	})
+
+	// Start QMP monitoring.
+	monitor, err := vm.getMonitor()
 	if err != nil {
 		op.Done(err)
 		return err
 	}
 
-	// Database updates
+	// Apply CPU pinning, unless raw.qemu overrides the vCPUs.
+	_, found := rawOverrides["-smp"]
+	if !found {
+		err = vm.setCPUPinning(monitor, vm.expandedConfig["limits.cpu"])
+		if err != nil {
+			op.Done(err)
+			return err
+		}
+	}
+
+	// Move qemu into its own cgroup and apply the CPU and memory limits.
+	err = vm.setupCgroup(pid)
+	if err != nil {
+		op.Done(err)
+		return err
+	}
+
+	// Start the VM.
+	err = monitor.Start()
+	if err != nil {
+		op.Done(err)
+		return err
+	}
+
+	vm.setBootTime(time.Now())
+
+	// Database updates
 	err = vm.state.Cluster.Transaction(func(tx *db.ClusterTx) error {
 		// Record current state
 		err = tx.ContainerSetState(vm.id, "RUNNING")
@@ -925,2785 +1590,8184 @@ func (vm *qemu) Start(stateful bool) error {
 		return err
 	}
 
+	// The boot once device has been booted, go back to the usual boot order from the next start.
+	if vm.localConfig["boot.once"] != "" {
+		err = vm.state.Cluster.ContainerConfigRemove(vm.id, "boot.once")
+		if err != nil {
+			logger.Warn("Failed to clear boot.once", log.Ctx{"project": vm.project, "instance": vm.name, "err": err})
+		} else {
+			delete(vm.localConfig, "boot.once")
+		}
+	}
+
+	// Remember this configuration works, to be able to go back to it.
+	vm.recordLastGoodConfig()
+
+	vm.registerHealthCheck()
+
+	// Keep saving what the guest logs, qemu takes its ringbuf with it when the guest powers off.
+	go vm.watchGuestLog(monitor)
+
+	// Keep the console log to the boot window and report boot hangs.
+	go vm.watchConsoleLog(monitor)
+
+	// Watch the qemu process for unexpected exits.
+	go vm.supervise(pid, exited)
+
 	revert.Success()
 	vm.state.Events.SendLifecycle(vm.project, "virtual-machine-started", fmt.Sprintf("/1.0/virtual-machines/%s", vm.name), nil)
 	return nil
 }
 
-// openUnixSocket connects to a UNIX socket and returns the connection.
-func (vm *qemu) openUnixSocket(sockPath string) (*net.UnixConn, error) {
-	addr, err := net.ResolveUnixAddr("unix", sockPath)
+// qemuCommand returns the arguments qemu is run with, for the given config file and UUID, along with the
+// names of the LXD managed arguments raw.qemu overrides. In a dry run, the CPU model and debug log items
+// aren't checked against what qemu supports, as that requires running it.
+func (vm *qemu) qemuCommand(qemuPath string, confFile string, vmUUID string, dryRun bool) ([]string, []string, error) {
+	cpuModel, err := vm.cpuModel(qemuPath, dryRun)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	c, err := net.DialUnix("unix", nil, addr)
+	debugItems, err := vm.debugItems(qemuPath, dryRun)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	return c, nil
-}
+	sandboxOpts := qemuSandboxOpts(vm.expandedConfig)
 
-func (vm *qemu) setupNvram() error {
-	// No UEFI nvram for ppc64le.
-	if vm.architecture == osarch.ARCH_64BIT_POWERPC_LITTLE_ENDIAN {
-		return nil
+	qemuCmd := []string{
+		"--",
+		qemuPath,
+		"-S",
+		"-name", vm.Name(),
+		"-uuid", vmUUID,
+		"-cpu", cpuModel,
+		"-nographic",
+		"-serial", "chardev:console",
+		"-nodefaults",
+		"-no-user-config",
+		"-sandbox", sandboxOpts,
+		"-readconfig", confFile,
+		"-pidfile", vm.pidFilePath(),
+		"-D", vm.LogFilePath(),
+		"-chroot", vm.Path(),
 	}
 
-	// Mount the instance's config volume.
-	ourMount, err := vm.mount()
-	if err != nil {
-		return err
+	// Unless supervised, qemu daemonizes once it's set up, reporting start up failures through its
+	// exit status.
+	if !shared.IsTrue(vm.expandedConfig["boot.supervised"]) {
+		qemuCmd = append(qemuCmd, "-daemonize")
 	}
 
-	if ourMount {
-		defer vm.unmount()
+	if debugItems != "" {
+		qemuCmd = append(qemuCmd, "-d", debugItems)
 	}
 
-	srcOvmfFile := filepath.Join(vm.ovmfPath(), "OVMF_VARS.fd")
-	if vm.expandedConfig["security.secureboot"] == "" || shared.IsTrue(vm.expandedConfig["security.secureboot"]) {
-		srcOvmfFile = filepath.Join(vm.ovmfPath(), "OVMF_VARS.ms.fd")
+	// Unless in-place reboots are enabled, have qemu exit when the guest resets so that the instance
+	// goes through a full stop and start.
+	if !shared.IsTrue(vm.expandedConfig["boot.in_place_reboot"]) {
+		qemuCmd = append(qemuCmd, "-no-reboot")
 	}
 
-	if !shared.PathExists(srcOvmfFile) {
-		return fmt.Errorf("Required EFI firmware settings file missing: %s", srcOvmfFile)
+	// Attempt to drop privileges.
+	if vm.state.OS.UnprivUser != "" {
+		qemuCmd = append(qemuCmd, "-runas", vm.state.OS.UnprivUser)
 	}
 
-	os.Remove(vm.getNvramPath())
-	err = shared.FileCopy(srcOvmfFile, vm.getNvramPath())
+	hugepagesPath, err := vm.hugepagesPath()
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 
-	return nil
-}
+	// The memory backends of guest NUMA nodes are already backed by hugepages, which qemu doesn't
+	// allow along with -mem-path.
+	if hugepagesPath != "" {
+		numa, err := vm.usesNUMANodes(resources.GetCPU)
+		if err != nil {
+			return nil, nil, err
+		}
 
-func (vm *qemu) qemuArchConfig() (string, error) {
-	if vm.architecture == osarch.ARCH_64BIT_INTEL_X86 {
-		return "qemu-system-x86_64", nil
-	} else if vm.architecture == osarch.ARCH_64BIT_ARMV8_LITTLE_ENDIAN {
-		return "qemu-system-aarch64", nil
-	} else if vm.architecture == osarch.ARCH_64BIT_POWERPC_LITTLE_ENDIAN {
-		return "qemu-system-ppc64", nil
+		if !numa {
+			qemuCmd = append(qemuCmd, "-mem-path", hugepagesPath, "-mem-prealloc")
+		}
 	}
 
-	return "", fmt.Errorf("Architecture isn't supported for virtual machines")
-}
+	smbios, err := vm.smbiosArg()
+	if err != nil {
+		return nil, nil, err
+	}
 
-// deviceVolatileGetFunc returns a function that retrieves a named device's volatile config and
-// removes its device prefix from the keys.
-func (vm *qemu) deviceVolatileGetFunc(devName string) func() map[string]string {
-	return func() map[string]string {
-		volatile := make(map[string]string)
-		prefix := fmt.Sprintf("volatile.%s.", devName)
-		for k, v := range vm.localConfig {
-			if strings.HasPrefix(k, prefix) {
-				volatile[strings.TrimPrefix(k, prefix)] = v
-			}
-		}
-		return volatile
+	if smbios != "" {
+		qemuCmd = append(qemuCmd, "-smbios", smbios)
 	}
-}
 
-// deviceVolatileSetFunc returns a function that can be called to save a named device's volatile
-// config using keys that do not have the device's name prefixed.
-func (vm *qemu) deviceVolatileSetFunc(devName string) func(save map[string]string) error {
-	return func(save map[string]string) error {
-		volatileSave := make(map[string]string)
-		for k, v := range save {
-			volatileSave[fmt.Sprintf("volatile.%s.%s", devName, k)] = v
+	if vm.expandedConfig["security.watchdog.action"] != "" {
+		qemuCmd = append(qemuCmd, "-watchdog-action", vm.expandedConfig["security.watchdog.action"])
+	}
+
+	if shared.IsTrue(vm.expandedConfig["boot.menu"]) {
+		bootOpts := "menu=on"
+
+		// The splash time is how long the firmware shows its boot menu prompt, in milliseconds.
+		if vm.expandedConfig["boot.menu.timeout"] != "" {
+			timeout, err := strconv.Atoi(vm.expandedConfig["boot.menu.timeout"])
+			if err != nil {
+				return nil, nil, errors.Wrap(err, "Invalid boot.menu.timeout")
+			}
+
+			bootOpts = fmt.Sprintf("%s,splash-time=%d", bootOpts, timeout*1000)
 		}
 
-		return vm.VolatileSet(volatileSave)
+		qemuCmd = append(qemuCmd, "-boot", bootOpts)
 	}
-}
 
-// RegisterDevices is not used by VMs.
-func (vm *qemu) RegisterDevices() {
-	return
-}
+	rawArgs, err := shared.SplitShellArgs(vm.expandedConfig["raw.qemu"])
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "Invalid raw.qemu")
+	}
 
-// SaveConfigFile is not used by VMs.
-func (vm *qemu) SaveConfigFile() error {
-	return instance.ErrNotImplemented
-}
+	// Let raw.qemu override the arguments qemu only takes once. Memory and CPUs are set in the
+	// config file, which leaves them out when overridden.
+	qemuCmd, shadowed := qemuMergeRawArgs(qemuCmd, rawArgs)
+	rawOverrides := qemuRawOverrides(rawArgs)
+	for _, name := range []string{"-m", "-smp"} {
+		_, found := rawOverrides[name]
+		if found {
+			shadowed = append(shadowed, name)
+		}
+	}
 
-// OnHook is the top-level hook handler.
-func (vm *qemu) OnHook(hookName string, args map[string]string) error {
-	return instance.ErrNotImplemented
+	return qemuCmd, shadowed, nil
 }
 
-// deviceLoad instantiates and validates a new device and returns it along with enriched config.
-func (vm *qemu) deviceLoad(deviceName string, rawConfig deviceConfig.Device) (device.Device, deviceConfig.Device, error) {
-	var configCopy deviceConfig.Device
-	var err error
+// QemuConfig returns the qemu config file and arguments the VM would be started with, for troubleshooting.
+// Nothing is started, mounted or probed and the instance's files are left untouched, the config file
+// being written to a temporary path. Device sections are rendered from the DryRun of the devices, host
+// side resources only set up when starting the VM (e.g. NIC host interfaces) being shown as configured
+// or last used. Devices only resolved when starting (e.g. USB devices, SR-IOV VFs and storage pool
+// volumes) are listed as comments at the end of the config.
+func (vm *qemu) QemuConfig() (*api.InstanceQemuConfig, error) {
+	qemuBinary, err := vm.qemuArchConfig()
+	if err != nil {
+		return nil, err
+	}
 
-	// Create copy of config and load some fields from volatile if device is nic or infiniband.
-	if shared.StringInSlice(rawConfig["type"], []string{"nic", "infiniband"}) {
-		configCopy, err = vm.FillNetworkDevice(deviceName, rawConfig)
+	qemuPath, err := exec.LookPath(qemuBinary)
+	if err != nil {
+		return nil, err
+	}
+
+	devConfs := []*deviceConfig.RunConfig{}
+	pending := []string{}
+	for _, dev := range vm.expandedDevices.Sorted() {
+		runConf, err := vm.deviceDryRun(dev.Name, dev.Config)
 		if err != nil {
-			return nil, nil, err
+			pending = append(pending, fmt.Sprintf("# Device %q (%s) can't be set up: %v", dev.Name, dev.Config["type"], err))
+			continue
 		}
-	} else {
-		// Othewise copy the config so it cannot be modified by device.
-		configCopy = rawConfig.Clone()
+
+		if runConf == nil {
+			pending = append(pending, fmt.Sprintf("# Device %q (%s) is set up when the VM starts", dev.Name, dev.Config["type"]))
+			continue
+		}
+
+		devConfs = append(devConfs, runConf)
+	}
+
+	fdFiles := []string{}
+	conf, _, err := vm.generateQemuConfig(devConfs, &fdFiles, true)
+	if err != nil {
+		return nil, err
 	}
 
-	d, err := device.New(vm, vm.state, deviceName, configCopy, vm.deviceVolatileGetFunc(deviceName), vm.deviceVolatileSetFunc(deviceName))
+	if len(pending) > 0 {
+		conf = fmt.Sprintf("%s\n%s\n", conf, strings.Join(pending, "\n"))
+	}
 
-	// Return device and config copy even if error occurs as caller may still use device.
-	return d, configCopy, err
-}
+	f, err := ioutil.TempFile("", "lxd-qemu-conf-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
 
-// deviceStart loads a new device and calls its Start() function. After processing the runtime
-// config returned from Start(), it also runs the device's Register() function irrespective of
-// whether the instance is running or not.
-func (vm *qemu) deviceStart(deviceName string, rawConfig deviceConfig.Device, isRunning bool) (*deviceConfig.RunConfig, error) {
-	d, _, err := vm.deviceLoad(deviceName, rawConfig)
+	_, err = f.WriteString(conf)
+	f.Close()
 	if err != nil {
 		return nil, err
 	}
 
-	if canHotPlug, _ := d.CanHotPlug(); isRunning && !canHotPlug {
-		return nil, fmt.Errorf("Device cannot be started when instance is running")
+	// A VM gets its UUID when first started.
+	vmUUID := vm.localConfig["volatile.vm.uuid"]
+	if vmUUID == "" {
+		vmUUID = uuid.New()
 	}
 
-	runConf, err := d.Start()
+	qemuCmd, _, err := vm.qemuCommand(qemuPath, f.Name(), vmUUID, true)
 	if err != nil {
 		return nil, err
 	}
 
-	return runConf, nil
+	return &api.InstanceQemuConfig{
+		Config:  conf,
+		Command: qemuCmd[1:], // Drop the separator from the forklimits arguments.
+	}, nil
 }
 
-// deviceStop loads a new device and calls its Stop() function.
-func (vm *qemu) deviceStop(deviceName string, rawConfig deviceConfig.Device) error {
-	d, _, err := vm.deviceLoad(deviceName, rawConfig)
-
-	// If deviceLoad fails with unsupported device type then return.
-	if err == device.ErrUnsupportedDevType {
-		return err
+// deviceDryRun returns the run config of a device as Start would return it, without setting up anything
+// on the host. Unlike deviceLoad, no MAC address is generated for NICs and the volatile config is only
+// read. Returns nil for devices only resolved when starting.
+func (vm *qemu) deviceDryRun(devName string, devConfig deviceConfig.Device) (*deviceConfig.RunConfig, error) {
+	volatileSet := func(map[string]string) error {
+		return fmt.Errorf("Volatile config can't be changed in a dry run")
 	}
 
-	// If deviceLoad fails for any other reason then just log the error and proceed, as in the
-	// scenario that a new version of LXD has additional validation restrictions than older
-	// versions we still need to allow previously valid devices to be stopped.
+	d, err := device.New(vm, vm.state, devName, devConfig.Clone(), vm.deviceVolatileGetFunc(devName), volatileSet)
 	if err != nil {
-		// If there is no device returned, then we cannot proceed, so return as error.
-		if d == nil {
-			return fmt.Errorf("Device stop validation failed for '%s': %v", deviceName, err)
-
-		}
+		return nil, err
+	}
 
-		logger.Errorf("Device stop validation failed for '%s': %v", deviceName, err)
+	dryRunner, ok := d.(device.DryRunner)
+	if !ok {
+		return nil, nil
 	}
 
-	canHotPlug, _ := d.CanHotPlug()
+	return dryRunner.DryRun()
+}
 
-	if vm.IsRunning() && !canHotPlug {
-		return fmt.Errorf("Device cannot be stopped when instance is running")
+// qemuSandboxDefaults are the qemu seccomp sandbox actions used unless relaxed by the instance config.
+// Privileges must be elevated for qemu to drop them to the unprivileged user.
+var qemuSandboxDefaults = []string{"obsolete=deny", "elevateprivileges=allow", "spawn=deny", "resourcecontrol=deny"}
+
+// qemuSandboxOpts returns the value of the qemu -sandbox argument for the instance config. The sandbox
+// is disabled when security.sandbox is false and the actions listed in security.sandbox.allow are
+// allowed.
+func qemuSandboxOpts(config map[string]string) string {
+	if config["security.sandbox"] != "" && !shared.IsTrue(config["security.sandbox"]) {
+		return "off"
 	}
 
-	runConf, err := d.Stop()
-	if err != nil {
-		return err
+	if config["security.sandbox.allow"] == "" {
+		return "on," + strings.Join(qemuSandboxDefaults, ",")
 	}
 
-	if runConf != nil {
-		// Run post stop hooks irrespective of run state of instance.
-		err = vm.runHooks(runConf.PostHooks)
-		if err != nil {
-			return err
+	allowed := []string{}
+	for _, item := range strings.Split(config["security.sandbox.allow"], ",") {
+		allowed = append(allowed, strings.TrimSpace(item))
+	}
+
+	opts := []string{"on"}
+	for _, opt := range qemuSandboxDefaults {
+		name := strings.SplitN(opt, "=", 2)[0]
+		if shared.StringInSlice(name, allowed) {
+			opt = name + "=allow"
 		}
+
+		opts = append(opts, opt)
 	}
 
-	return nil
+	return strings.Join(opts, ",")
 }
 
-// runHooks executes the callback functions returned from a function.
-func (vm *qemu) runHooks(hooks []func() error) error {
-	// Run any post start hooks.
-	if len(hooks) > 0 {
-		for _, hook := range hooks {
-			err := hook()
-			if err != nil {
-				return err
-			}
-		}
+// qemuSingularArgs are the qemu arguments set by LXD which qemu only takes once, so raw.qemu can
+// override them. -m and -smp are set through the config file.
+var qemuSingularArgs = []string{"-cpu", "-m", "-smp", "-name", "-uuid", "-sandbox", "-boot", "-watchdog-action", "-d", "-mem-path"}
+
+// qemuArgName returns the name of a qemu argument in its single dash form, qemu also accepting two.
+func qemuArgName(arg string) string {
+	if strings.HasPrefix(arg, "--") && len(arg) > 2 {
+		return arg[1:]
 	}
 
-	return nil
+	return arg
 }
 
-func (vm *qemu) getMonitorPath() string {
-	return filepath.Join(vm.LogPath(), "qemu.monitor")
-}
+// qemuRawOverrides returns the singular qemu arguments found in the raw.qemu arguments, mapped to
+// their last value.
+func qemuRawOverrides(rawArgs []string) map[string]string {
+	overrides := map[string]string{}
+	for i := 0; i+1 < len(rawArgs); i++ {
+		name := qemuArgName(rawArgs[i])
+		if shared.StringInSlice(name, qemuSingularArgs) {
+			overrides[name] = rawArgs[i+1]
+		}
+	}
 
-func (vm *qemu) getNvramPath() string {
-	return filepath.Join(vm.Path(), "qemu.nvram")
+	return overrides
 }
 
-// generateConfigShare generates the config share directory that will be exported to the VM via
-// a 9P share. Due to the unknown size of templates inside the images this directory is created
-// inside the VM's config volume so that it can be restricted by quota.
-func (vm *qemu) generateConfigShare() error {
-	// Mount the instance's config volume if needed.
-	ourMount, err := vm.mount()
-	if err != nil {
-		return err
+// qemuMergeRawArgs appends the raw.qemu arguments to the qemu command line, first dropping the
+// singular arguments raw.qemu overrides along with their value. Returns the merged command line
+// and the names of the dropped arguments.
+func qemuMergeRawArgs(args []string, rawArgs []string) ([]string, []string) {
+	overrides := qemuRawOverrides(rawArgs)
+
+	merged := make([]string, 0, len(args)+len(rawArgs))
+	shadowed := []string{}
+	for i := 0; i < len(args); i++ {
+		name := qemuArgName(args[i])
+		_, found := overrides[name]
+		if found && i+1 < len(args) {
+			shadowed = append(shadowed, name)
+			i++
+			continue
+		}
+
+		merged = append(merged, args[i])
 	}
 
-	if ourMount {
-		defer vm.unmount()
+	return append(merged, rawArgs...), shadowed
+}
+
+// bootDiagnostics adds to the error of a failed boot where the console output and qemu log of the boot
+// are, along with the last boot.diagnostics_size bytes of each. As the console log only holds the boot
+// window, that's where the boot stopped. Boot hangs and firmware or kernel failures don't make qemu
+// print anything to its stderr.
+func (vm *qemu) bootDiagnostics(startErr error) error {
+	size := int64(qemuBootDiagnosticsSize)
+	if vm.expandedConfig["boot.diagnostics_size"] != "" {
+		var err error
+		size, err = units.ParseByteSizeString(vm.expandedConfig["boot.diagnostics_size"])
+		if err != nil {
+			return startErr
+		}
 	}
 
-	configDrivePath := filepath.Join(vm.Path(), "config")
+	var sb strings.Builder
+	sb.WriteString(startErr.Error())
 
-	// Create config drive dir.
-	os.RemoveAll(configDrivePath)
-	err = os.MkdirAll(configDrivePath, 0500)
-	if err != nil {
-		return err
+	logs := []struct {
+		title string
+		path  string
+	}{
+		{title: "Console output", path: vm.ConsoleBufferLogPath()},
+		{title: "Qemu log", path: vm.LogFilePath()},
 	}
 
-	// Generate the cloud-init config.
-	err = os.MkdirAll(filepath.Join(configDrivePath, "cloud-init"), 0500)
-	if err != nil {
-		return err
-	}
-
-	if vm.ExpandedConfig()["user.user-data"] != "" {
-		err = ioutil.WriteFile(filepath.Join(configDrivePath, "cloud-init", "user-data"), []byte(vm.ExpandedConfig()["user.user-data"]), 0400)
+	for _, l := range logs {
+		excerpt, err := qemuLogExcerpt(l.path, size)
 		if err != nil {
-			return err
+			logger.Warn("Failed to read log for boot diagnostics", log.Ctx{"project": vm.project, "instance": vm.name, "path": l.path, "err": err})
+			continue
 		}
-	} else {
-		err = ioutil.WriteFile(filepath.Join(configDrivePath, "cloud-init", "user-data"), []byte("#cloud-config\n"), 0400)
-		if err != nil {
-			return err
+
+		fmt.Fprintf(&sb, "\n\n%s (%s):", l.title, l.path)
+		if excerpt != "" {
+			fmt.Fprintf(&sb, "\n%s", excerpt)
 		}
 	}
 
-	if vm.ExpandedConfig()["user.vendor-data"] != "" {
-		err = ioutil.WriteFile(filepath.Join(configDrivePath, "cloud-init", "vendor-data"), []byte(vm.ExpandedConfig()["user.vendor-data"]), 0400)
-		if err != nil {
-			return err
-		}
-	} else {
-		err = ioutil.WriteFile(filepath.Join(configDrivePath, "cloud-init", "vendor-data"), []byte("#cloud-config\n"), 0400)
-		if err != nil {
-			return err
-		}
+	return fmt.Errorf("%s", sb.String())
+}
+
+// watchConsoleLog cuts the console log of the running VM back to the first qemuConsoleLogSize bytes of the
+// boot every qemuConsoleLogInterval until the monitor disconnects. qemu appends to it, so truncating it
+// only drops the output past the boot window. As a boot hang doesn't fail the start, the boot
+// diagnostics are logged if the agent didn't report in within qemuBootHangTimeout of the boot.
+func (vm *qemu) watchConsoleLog(monitor *qmp.Monitor) {
+	chDisconnect, err := monitor.Wait()
+	if err != nil {
+		return
 	}
 
-	if vm.ExpandedConfig()["user.network-config"] != "" {
-		err = ioutil.WriteFile(filepath.Join(configDrivePath, "cloud-init", "network-config"), []byte(vm.ExpandedConfig()["user.network-config"]), 0400)
-		if err != nil {
-			return err
+	ticker := time.NewTicker(qemuConsoleLogInterval)
+	defer ticker.Stop()
+
+	var chBootHang <-chan time.Time
+	bootTime := vm.bootTime()
+	if !bootTime.IsZero() {
+		chBootHang = time.After(time.Until(bootTime.Add(qemuBootHangTimeout)))
+	}
+
+	for {
+		select {
+		case <-chDisconnect:
+			return
+		case <-chBootHang:
+			if !monitor.AgentReady() {
+				err := vm.bootDiagnostics(fmt.Errorf("LXD VM agent didn't start within %v of the boot", qemuBootHangTimeout))
+				logger.Warn("Instance may have failed to boot", log.Ctx{"project": vm.project, "instance": vm.name, "err": err})
+			}
+		case <-ticker.C:
+			err := qemuCapLog(vm.ConsoleBufferLogPath(), qemuConsoleLogSize)
+			if err != nil {
+				logger.Warn("Failed capping the console log", log.Ctx{"project": vm.project, "instance": vm.name, "err": err})
+			}
 		}
-	} else {
-		os.Remove(filepath.Join(configDrivePath, "cloud-init", "network-config"))
 	}
+}
 
-	// Append any user.meta-data to our predefined meta-data config.
-	err = ioutil.WriteFile(filepath.Join(configDrivePath, "cloud-init", "meta-data"), []byte(fmt.Sprintf("instance-id: %s\nlocal-hostname: %s\n%s\n", vm.Name(), vm.Name(), vm.ExpandedConfig()["user.meta-data"])), 0400)
+// qemuCapLog truncates a log to its first size bytes. A missing log is left alone.
+func qemuCapLog(path string, size int64) error {
+	info, err := os.Stat(path)
 	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+
 		return err
 	}
 
-	// Add the VM agent.
-	path, err := exec.LookPath("lxd-agent")
-	if err != nil {
-		logger.Warnf("lxd-agent not found, skipping its inclusion in the VM config drive: %v", err)
-	} else {
-		// Install agent into config drive dir if found.
-		err = shared.FileCopy(path, filepath.Join(configDrivePath, "lxd-agent"))
-		if err != nil {
-			return err
-		}
+	if info.Size() <= size {
+		return nil
+	}
 
-		err = os.Chmod(filepath.Join(configDrivePath, "lxd-agent"), 0500)
-		if err != nil {
-			return err
-		}
+	return os.Truncate(path, size)
+}
 
-		err = os.Chown(filepath.Join(configDrivePath, "lxd-agent"), 0, 0)
-		if err != nil {
-			return err
+// qemuLastGoodConfig is the configuration a VM last started successfully with, recorded in
+// volatile.vm.last_good_config so that RollbackConfig can restore it after changes preventing the VM
+// from starting.
+type qemuLastGoodConfig struct {
+	Config   map[string]string            `json:"config"`
+	Devices  map[string]map[string]string `json:"devices"`
+	Profiles []string                     `json:"profiles"`
+}
+
+// lastGoodConfig returns the current configuration of the VM as recorded in
+// volatile.vm.last_good_config. Volatile keys are left out as they're never rolled back.
+func (vm *qemu) lastGoodConfig() (string, error) {
+	config := map[string]string{}
+	for k, v := range vm.localConfig {
+		if !strings.HasPrefix(k, "volatile.") {
+			config[k] = v
 		}
 	}
 
-	agentCert, agentKey, clientCert, _, err := vm.generateAgentCert()
+	data, err := json.Marshal(qemuLastGoodConfig{
+		Config:   config,
+		Devices:  vm.localDevices.CloneNative(),
+		Profiles: append([]string{}, vm.profiles...),
+	})
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	err = ioutil.WriteFile(filepath.Join(configDrivePath, "server.crt"), []byte(clientCert), 0400)
-	if err != nil {
-		return err
-	}
+	return string(data), nil
+}
 
-	err = ioutil.WriteFile(filepath.Join(configDrivePath, "agent.crt"), []byte(agentCert), 0400)
-	if err != nil {
-		return err
+// recordLastGoodConfig records the configuration the VM just started with, unless unchanged.
+func (vm *qemu) recordLastGoodConfig() {
+	value, err := vm.lastGoodConfig()
+	if err == nil && value != vm.localConfig["volatile.vm.last_good_config"] {
+		err = vm.VolatileSet(map[string]string{"volatile.vm.last_good_config": value})
 	}
 
-	err = ioutil.WriteFile(filepath.Join(configDrivePath, "agent.key"), []byte(agentKey), 0400)
 	if err != nil {
-		return err
+		logger.Warn("Failed recording VM config of successful start", log.Ctx{"project": vm.project, "instance": vm.name, "err": err})
 	}
+}
 
-	// Systemd units.
-	err = os.MkdirAll(filepath.Join(configDrivePath, "systemd"), 0500)
-	if err != nil {
-		return err
+// lastGoodConfigHint points a start failure to the configuration rollback when the configuration of
+// the VM was changed since it last started successfully.
+func (vm *qemu) lastGoodConfigHint(startErr error) error {
+	lastGood := vm.localConfig["volatile.vm.last_good_config"]
+	if lastGood == "" {
+		return startErr
 	}
 
-	lxdAgentServiceUnit := `[Unit]
-Description=LXD - agent
-Documentation=https://linuxcontainers.org/lxd
-ConditionPathExists=/dev/virtio-ports/org.linuxcontainers.lxd
-Requires=lxd-agent-9p.service
-After=lxd-agent-9p.service
-Before=cloud-init.target
+	current, err := vm.lastGoodConfig()
+	if err != nil || current == lastGood {
+		return startErr
+	}
 
-[Service]
-Type=simple
-WorkingDirectory=/run/lxd_config/9p
-ExecStart=/run/lxd_config/9p/lxd-agent
+	return fmt.Errorf(`%v (the configuration changed since the instance last started, the "rollback-config" state action restores it)`, startErr)
+}
 
-[Install]
-WantedBy=multi-user.target
-`
+// LastGoodConfig returns the arguments to update the VM with to restore the configuration it last
+// started successfully with, keeping its current volatile keys.
+func (vm *qemu) LastGoodConfig() (db.InstanceArgs, error) {
+	lastGood := vm.localConfig["volatile.vm.last_good_config"]
+	if lastGood == "" {
+		return db.InstanceArgs{}, fmt.Errorf("The instance hasn't started successfully since recording its configuration")
+	}
 
-	err = ioutil.WriteFile(filepath.Join(configDrivePath, "systemd", "lxd-agent.service"), []byte(lxdAgentServiceUnit), 0400)
+	lastConfig := qemuLastGoodConfig{}
+	err := json.Unmarshal([]byte(lastGood), &lastConfig)
 	if err != nil {
-		return err
+		return db.InstanceArgs{}, errors.Wrap(err, "Failed to parse the configuration of the last successful start")
 	}
 
-	lxdConfigShareMountUnit := `[Unit]
-Description=LXD - agent - 9p mount
-Documentation=https://linuxcontainers.org/lxd
-ConditionPathExists=/dev/virtio-ports/org.linuxcontainers.lxd
+	config := map[string]string{}
+	for k, v := range lastConfig.Config {
+		config[k] = v
+	}
 
-[Service]
-Type=oneshot
-RemainAfterExit=yes
-ExecStartPre=-/sbin/modprobe 9pnet_virtio
-ExecStartPre=/bin/mkdir -p /run/lxd_config/9p
-ExecStartPre=/bin/chmod 0700 /run/lxd_config/
-ExecStart=/bin/mount -t 9p config /run/lxd_config/9p -o access=0,trans=virtio
+	for k, v := range vm.localConfig {
+		if strings.HasPrefix(k, "volatile.") {
+			config[k] = v
+		}
+	}
 
-[Install]
-WantedBy=multi-user.target
-`
+	return db.InstanceArgs{
+		Architecture: vm.Architecture(),
+		Config:       config,
+		Description:  vm.Description(),
+		Devices:      deviceConfig.NewDevices(lastConfig.Devices),
+		Ephemeral:    vm.IsEphemeral(),
+		Profiles:     lastConfig.Profiles,
+		Project:      vm.Project(),
+		Type:         vm.Type(),
+		Snapshot:     vm.IsSnapshot(),
+	}, nil
+}
 
-	err = ioutil.WriteFile(filepath.Join(configDrivePath, "systemd", "lxd-agent-9p.service"), []byte(lxdConfigShareMountUnit), 0400)
+// RollbackConfig restores the configuration, devices and profiles the VM last started successfully
+// with, undoing the changes made since. Unlike restoring a snapshot, the VM's data isn't touched.
+func (vm *qemu) RollbackConfig() error {
+	args, err := vm.LastGoodConfig()
 	if err != nil {
 		return err
 	}
 
-	// Install script for manual installs.
-	lxdConfigShareInstall := `#!/bin/sh
-if [ ! -e "systemd" ] || [ ! -e "lxd-agent" ]; then
-    echo "This script must be run from within the 9p mount"
-    exit 1
-fi
+	return vm.Update(args, true)
+}
 
-if [ ! -e "/lib/systemd/system" ]; then
-    echo "This script only works on systemd systems"
-    exit 1
-fi
+// qemuLogExcerpt returns the last size bytes of a log, starting at a line boundary and stripped of
+// terminal escape sequences and control characters. A missing log is empty.
+func qemuLogExcerpt(path string, size int64) (string, error) {
+	if size <= 0 {
+		return "", nil
+	}
 
-cp systemd/lxd-agent.service /lib/systemd/system/
-cp systemd/lxd-agent-9p.service /lib/systemd/system/
-systemctl daemon-reload
-systemctl enable lxd-agent.service lxd-agent-9p.service
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
 
-echo ""
-echo "LXD agent has been installed, reboot to confirm setup."
-echo "To start it now, unmount this filesystem and run: systemctl start lxd-agent-9p lxd-agent"
-`
+		return "", err
+	}
+	defer f.Close()
 
-	err = ioutil.WriteFile(filepath.Join(configDrivePath, "install.sh"), []byte(lxdConfigShareInstall), 0700)
+	info, err := f.Stat()
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	// Templated files.
-	err = os.MkdirAll(filepath.Join(configDrivePath, "files"), 0500)
-	if err != nil {
-		return err
+	offset := info.Size() - size
+	if offset < 0 {
+		offset = 0
 	}
 
-	// Template anything that needs templating.
-	key := "volatile.apply_template"
-	if vm.localConfig[key] != "" {
-		// Run any template that needs running.
-		err = vm.templateApplyNow(vm.localConfig[key], filepath.Join(configDrivePath, "files"))
-		if err != nil {
-			return err
+	buf := make([]byte, info.Size()-offset)
+	_, err = f.ReadAt(buf, offset)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+
+	excerpt := qemuEscapeSequence.ReplaceAllString(string(buf), "")
+	excerpt = strings.Replace(excerpt, "\r\n", "\n", -1)
+	excerpt = strings.Map(func(r rune) rune {
+		switch {
+		case r == '\r':
+			return '\n'
+		case r == '\n' || r == '\t':
+			return r
+		case r == utf8.RuneError || unicode.IsControl(r):
+			return -1
 		}
 
-		// Remove the volatile key from the DB.
-		err := vm.state.Cluster.ContainerConfigRemove(vm.id, key)
-		if err != nil {
-			return err
+		return r
+	}, excerpt)
+
+	// Don't start with a partial line.
+	if offset > 0 {
+		idx := strings.Index(excerpt, "\n")
+		if idx >= 0 {
+			excerpt = excerpt[idx+1:]
 		}
-	}
 
-	err = vm.templateApplyNow("start", filepath.Join(configDrivePath, "files"))
-	if err != nil {
-		return err
+		excerpt = "[...]\n" + excerpt
 	}
 
-	// Copy the template metadata itself too.
-	metaPath := filepath.Join(vm.Path(), "metadata.yaml")
-	if shared.PathExists(metaPath) {
-		err = shared.FileCopy(metaPath, filepath.Join(configDrivePath, "files/metadata.yaml"))
-		if err != nil {
-			return err
+	return strings.TrimRight(excerpt, "\n\t "), nil
+}
+
+// qemuRawArgError returns an error pointing at the raw.qemu option which caused qemu to fail, using
+// qemu's habit of prefixing its errors with the offending option and its value. Returns nil if the
+// failure can't be traced back to raw.qemu.
+func qemuRawArgError(rawArgs []string, stderr string) error {
+	for _, line := range strings.Split(stderr, "\n") {
+		for i, arg := range rawArgs {
+			if !strings.HasPrefix(arg, "-") {
+				continue
+			}
+
+			option := arg
+			if i+1 < len(rawArgs) && !strings.HasPrefix(rawArgs[i+1], "-") {
+				option = fmt.Sprintf("%s %s", arg, rawArgs[i+1])
+			}
+
+			for _, prefix := range []string{option, arg} {
+				idx := strings.Index(line, fmt.Sprintf(": %s: ", prefix))
+				if idx < 0 {
+					continue
+				}
+
+				msg := line[idx+len(prefix)+4:]
+				return fmt.Errorf("Invalid raw.qemu argument %d (%q): %s", i+1, option, strings.TrimSpace(msg))
+			}
 		}
 	}
 
 	return nil
 }
 
-func (vm *qemu) templateApplyNow(trigger string, path string) error {
-	// If there's no metadata, just return.
-	fname := filepath.Join(vm.Path(), "metadata.yaml")
-	if !shared.PathExists(fname) {
-		return nil
-	}
+// waitQemuStart waits for a qemu process started without -daemonize to be done setting up the VM,
+// which is when its monitor answers. Fails if qemu exits first.
+func (vm *qemu) waitQemuStart(exited <-chan *os.ProcessState, timeout time.Duration) error {
+	for start := time.Now(); time.Since(start) < timeout; time.Sleep(100 * time.Millisecond) {
+		select {
+		case exitState := <-exited:
+			return fmt.Errorf("qemu exited during start up (%s)", exitState)
+		default:
+		}
 
-	// Parse the metadata.
-	content, err := ioutil.ReadFile(fname)
-	if err != nil {
-		return errors.Wrap(err, "Failed to read metadata")
-	}
+		if !shared.PathExists(vm.getMonitorPath()) {
+			continue
+		}
 
-	metadata := new(api.ImageMetadata)
-	err = yaml.Unmarshal(content, &metadata)
-	if err != nil {
-		return errors.Wrapf(err, "Could not parse %s", fname)
+		_, err := vm.getMonitor()
+		if err == nil {
+			return nil
+		}
 	}
 
-	// Figure out the instance architecture.
-	arch, err := osarch.ArchitectureName(vm.architecture)
-	if err != nil {
-		arch, err = osarch.ArchitectureName(vm.state.OS.Architectures[0])
-		if err != nil {
-			return errors.Wrap(err, "Failed to detect system architecture")
-		}
+	return fmt.Errorf("qemu didn't start within %v", timeout)
+}
+
+// qemuExitDetails returns how a qemu process exited, as its exit code or -1 along with the name of
+// the signal which killed it.
+func qemuExitDetails(exitState *os.ProcessState) map[string]interface{} {
+	details := map[string]interface{}{"exit_code": exitState.ExitCode(), "signal": ""}
+
+	status, ok := exitState.Sys().(syscall.WaitStatus)
+	if ok && status.Signaled() {
+		details["signal"] = unix.SignalName(status.Signal())
 	}
 
-	// Generate the container metadata.
-	instanceMeta := make(map[string]string)
-	instanceMeta["name"] = vm.name
-	instanceMeta["architecture"] = arch
+	return details
+}
 
-	if vm.ephemeral {
-		instanceMeta["ephemeral"] = "true"
-	} else {
-		instanceMeta["ephemeral"] = "false"
+// supervise waits for the qemu process to exit. If it exits without having gone through a clean
+// shutdown, e.g. because it crashed or was killed by the OOM killer, the instance is cleaned up
+// and marked as stopped. The exit status is only known when qemu runs as a child of LXD, exited
+// then receiving it. Otherwise the process is polled, telling it apart from a later process reusing
+// its PID by its start time. A daemonized qemu is reparented to init, which alone can collect its
+// exit status. Making LXD a child subreaper instead would have it reap the orphans of all its
+// children, and still lose qemu across LXD restarts, hence boot.supervised.
+func (vm *qemu) supervise(pid int, exited <-chan *os.ProcessState) {
+	id := vm.id
+	state := vm.state
+
+	// Only supervise each qemu process once.
+	vmSupervisedLock.Lock()
+	if vmSupervised[id] == pid {
+		vmSupervisedLock.Unlock()
+		return
 	}
 
-	// Go through the templates.
-	for tplPath, tpl := range metadata.Templates {
-		var w *os.File
+	vmSupervised[id] = pid
+	vmSupervisedLock.Unlock()
 
-		// Check if the template should be applied now.
-		found := false
-		for _, tplTrigger := range tpl.When {
-			if tplTrigger == trigger {
-				found = true
+	defer func() {
+		vmSupervisedLock.Lock()
+		if vmSupervised[id] == pid {
+			delete(vmSupervised, id)
+		}
+		vmSupervisedLock.Unlock()
+	}()
+
+	var exitState *os.ProcessState
+	if exited != nil {
+		exitState = <-exited
+	} else {
+		startTime, err := qemuProcessStartTime(pid)
+		for err == nil {
+			time.Sleep(time.Second)
+
+			var currentStartTime uint64
+			currentStartTime, err = qemuProcessStartTime(pid)
+			if err == nil && currentStartTime != startTime {
 				break
 			}
 		}
+	}
 
-		if !found {
-			continue
-		}
+	// Clean shutdowns are announced by qemu through the SHUTDOWN event, or driven by a stop
+	// operation in case the event got lost along with the monitor.
+	vmShutdownLock.Lock()
+	clean := vmShutdown[id] == pid
+	if clean {
+		delete(vmShutdown, id)
+	}
+	vmShutdownLock.Unlock()
 
-		// Create the file itself.
-		w, err = os.Create(filepath.Join(path, fmt.Sprintf("%s.out", tpl.Template)))
-		if err != nil {
-			return err
-		}
+	op := operationlock.Get(id)
+	if clean || (op != nil && op.Action() == "stop") {
+		return
+	}
 
-		// Fix ownership and mode.
-		w.Chmod(0644)
-		defer w.Close()
+	inst, err := instance.LoadByID(state, id)
+	if err != nil {
+		logger.Errorf("Failed to load instance with id=%d", id)
+		return
+	}
 
-		// Read the template.
-		tplString, err := ioutil.ReadFile(filepath.Join(vm.TemplatesPath(), tpl.Template))
-		if err != nil {
-			return errors.Wrap(err, "Failed to read template file")
-		}
-
-		// Restrict filesystem access to within the container's rootfs.
-		tplSet := pongo2.NewSet(fmt.Sprintf("%s-%s", vm.name, tpl.Template), pongoTemplate.ChrootLoader{Path: vm.TemplatesPath()})
-		tplRender, err := tplSet.FromString("{% autoescape off %}" + string(tplString) + "{% endautoescape %}")
-		if err != nil {
-			return errors.Wrap(err, "Failed to render template")
-		}
-
-		configGet := func(confKey, confDefault *pongo2.Value) *pongo2.Value {
-			val, ok := vm.expandedConfig[confKey.String()]
-			if !ok {
-				return confDefault
-			}
-
-			return pongo2.AsValue(strings.TrimRight(val, "\r\n"))
-		}
+	vm = inst.(*qemu)
 
-		// Render the template.
-		tplRender.ExecuteWriter(pongo2.Context{"trigger": trigger,
-			"path":       tplPath,
-			"instance":   instanceMeta,
-			"container":  instanceMeta, // FIXME: remove once most images have moved away.
-			"config":     vm.expandedConfig,
-			"devices":    vm.expandedDevices,
-			"properties": tpl.Properties,
-			"config_get": configGet}, w)
+	// Leave alone a new qemu process that was started in the meantime.
+	if vm.monitorAlive() {
+		return
 	}
 
-	return nil
-}
-
-// deviceBootPriorities returns a map keyed on device name containing the boot index to use.
-// Qemu tries to boot devices in order of boot index (lowest first).
-func (vm *qemu) deviceBootPriorities() (map[string]int, error) {
-	type devicePrios struct {
-		Name     string
-		BootPrio uint32
+	// Check whether qemu went over its memory limit before OnStop removes its cgroup.
+	oomKilled := vm.cgroupOOMKilled()
+	reason := "exited unexpectedly"
+	if oomKilled {
+		reason = "was killed for exceeding its memory limit"
 	}
 
-	devices := []devicePrios{}
-
-	for devName, devConf := range vm.expandedDevices {
-		if devConf["type"] != "disk" && devConf["type"] != "nic" {
-			continue
+	metadata := map[string]interface{}{"pid": pid, "oom_killed": oomKilled}
+	if exitState != nil {
+		reason = fmt.Sprintf("%s (%s)", reason, exitState)
+		for k, v := range qemuExitDetails(exitState) {
+			metadata[k] = v
 		}
+	} else {
+		reason = fmt.Sprintf("%s (exit status unknown, boot.supervised isn't enabled)", reason)
+	}
 
-		bootPrio := uint32(0) // Default to lowest priority.
-		if devConf["boot.priority"] != "" {
-			prio, err := strconv.ParseInt(devConf["boot.priority"], 10, 32)
-			if err != nil {
-				return nil, errors.Wrapf(err, "Invalid boot.priority for device %q", devName)
-			}
-			bootPrio = uint32(prio)
-		} else if devConf["path"] == "/" {
-			bootPrio = 1 // Set boot priority of root disk higher than any device without a boot prio.
-		}
+	logger.Warn(fmt.Sprintf("Instance process %s", reason), log.Ctx{"project": vm.project, "instance": vm.name, "pid": pid})
 
-		devices = append(devices, devicePrios{Name: devName, BootPrio: bootPrio})
+	// Record the crash in the instance log alongside qemu's own output.
+	logFile, err := os.OpenFile(vm.LogFilePath(), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err == nil {
+		fmt.Fprintf(logFile, "%s: LXD: qemu process %d %s\n", time.Now().UTC().Format(time.RFC3339), pid, reason)
+		logFile.Close()
 	}
 
-	sort.SliceStable(devices, func(i, j int) bool { return devices[i].BootPrio > devices[j].BootPrio })
+	// Setup a stop operation for OnStop to pick up.
+	op, err = operationlock.Create(id, "stop", false, true)
+	if err != nil {
+		logger.Error("Failed to clean up after crashed instance", log.Ctx{"project": vm.project, "instance": vm.name, "err": err})
+		return
+	}
 
-	sortedDevs := make(map[string]int, len(devices))
-	for bootIndex, dev := range devices {
-		sortedDevs[dev.Name] = bootIndex
+	err = vm.OnStop("stop")
+	if err != nil {
+		op.Done(err)
+		logger.Error("Failed to clean up after crashed instance", log.Ctx{"project": vm.project, "instance": vm.name, "err": err})
 	}
 
-	return sortedDevs, nil
+	vm.state.Events.SendLifecycle(vm.project, "virtual-machine-crashed", fmt.Sprintf("/1.0/virtual-machines/%s", vm.name), metadata)
 }
 
-// generateQemuConfigFile writes the qemu config file and returns its location.
-// It writes the config file inside the VM's log path.
-func (vm *qemu) generateQemuConfigFile(devConfs []*deviceConfig.RunConfig, fdFiles *[]string) (string, error) {
-	var sb *strings.Builder = &strings.Builder{}
+// setCPUPinning pins each of the VM's vCPU threads to its host CPU when limits.cpu is a set of CPUs.
+func (vm *qemu) setCPUPinning(monitor *qmp.Monitor, cpuLimit string) error {
+	if cpuLimit == "" {
+		return nil
+	}
 
-	err := qemuBase.Execute(sb, map[string]interface{}{
-		"architecture":     vm.architectureName,
-		"ringbufSizeBytes": qmp.RingbufSize,
-	})
-	if err != nil {
-		return "", err
+	_, err := strconv.Atoi(cpuLimit)
+	if err == nil {
+		return nil // Not pinned.
 	}
 
-	// Now add the dynamic parts of the config.
-	err = vm.addMemoryConfig(sb)
+	// Get CPU topology.
+	cpuInfo, err := resources.GetCPU()
 	if err != nil {
-		return "", err
+		return err
 	}
 
-	err = vm.addCPUConfig(sb)
+	// Expand to a set of CPU identifiers and get the pinning map.
+	nrSockets, nrCores, nrThreads, pins, _, err := vm.cpuTopology(cpuInfo, cpuLimit)
 	if err != nil {
-		return "", err
+		return err
 	}
 
-	err = vm.addFirmwareConfig(sb)
+	// Get the thread of each vCPU from the VM.
+	cpus, err := qemuGetVCPUs(monitor)
 	if err != nil {
-		return "", err
+		return err
 	}
 
-	err = vm.addVsockConfig(sb)
+	threads, err := qemuVCPUThreads(cpus, nrSockets, nrCores, nrThreads)
 	if err != nil {
-		return "", err
+		return err
 	}
 
-	err = vm.addMonitorConfig(sb)
-	if err != nil {
-		return "", err
+	// Confirm nothing weird is going on.
+	if len(pins) != len(threads) {
+		return fmt.Errorf("QEMU has %d vCPUs rather than the %d configured", len(threads), len(pins))
 	}
 
-	err = vm.addConfDriveConfig(sb)
-	if err != nil {
-		return "", err
+	for i := uint64(0); i < uint64(len(pins)); i++ {
+		pid, ok := threads[i]
+		if !ok {
+			return fmt.Errorf("QEMU has no vCPU %d", i)
+		}
+
+		set := unix.CPUSet{}
+		set.Set(int(pins[i]))
+
+		// Apply the pin.
+		err := unix.SchedSetaffinity(pid, &set)
+		if err != nil {
+			return errors.Wrapf(err, "Failed pinning vCPU %d to CPU %d", i, pins[i])
+		}
 	}
 
-	nicIndex := 0
-	bootIndexes, err := vm.deviceBootPriorities()
+	// Record the pins so that the VM gets the same layout when restarted.
+	cpuPins := qemuFormatCPUPins(pins)
+	if vm.localConfig["volatile.vm.cpu_pins"] != cpuPins {
+		err = vm.VolatileSet(map[string]string{"volatile.vm.cpu_pins": cpuPins})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// qemuGetVCPUs returns the vCPUs of the VM using query-cpus-fast. Older qemu versions lacking it fall back
+// to query-cpus, which only gives the vCPU threads in the order of their index.
+func qemuGetVCPUs(monitor *qmp.Monitor) ([]qmp.CPU, error) {
+	cpus, err := monitor.GetCPUsFast()
+	if err == nil {
+		return cpus, nil
+	}
+
+	pids, err := monitor.GetCPUs()
 	if err != nil {
-		return "", errors.Wrap(err, "Error calculating boot indexes")
+		return nil, err
 	}
 
-	// Record the mounts we are going to do inside the VM using the agent.
-	agentMounts := []instancetype.VMAgentMount{}
+	cpus = make([]qmp.CPU, 0, len(pids))
+	for i, pid := range pids {
+		cpus = append(cpus, qmp.CPU{Index: i, ThreadID: pid})
+	}
 
-	for _, runConf := range devConfs {
-		// Add drive devices.
-		if len(runConf.Mounts) > 0 {
-			for _, drive := range runConf.Mounts {
-				if drive.TargetPath == "/" {
-					err = vm.addRootDriveConfig(sb, bootIndexes, drive)
-				} else if drive.FSType == "9p" {
-					err = vm.addDriveDirConfig(sb, fdFiles, &agentMounts, drive)
-				} else {
-					err = vm.addDriveConfig(sb, bootIndexes, drive)
-				}
-				if err != nil {
-					return "", err
-				}
+	return cpus, nil
+}
+
+// qemuVCPUThreads maps the index of each vCPU, as used for the CPU pinning, to its thread. The index is
+// derived from the socket, core and thread of the vCPU within a topology of nrSockets sockets, nrCores
+// cores per socket and nrThreads threads per core. This matches the qemu CPU index, which is used when the
+// vCPU position isn't reported, and checks that the vCPUs fit the topology the pinning was computed for.
+func qemuVCPUThreads(cpus []qmp.CPU, nrSockets int, nrCores int, nrThreads int) (map[uint64]int, error) {
+	threads := make(map[uint64]int, len(cpus))
+	for _, cpu := range cpus {
+		index := uint64(cpu.Index)
+
+		socketID, hasSocket := cpu.Props["socket-id"]
+		coreID, hasCore := cpu.Props["core-id"]
+		threadID, hasThread := cpu.Props["thread-id"]
+		if hasSocket && hasCore && hasThread {
+			if socketID >= nrSockets || coreID >= nrCores || threadID >= nrThreads {
+				return nil, fmt.Errorf("vCPU %d is outside of the configured topology (socket %d, core %d, thread %d)", cpu.Index, socketID, coreID, threadID)
 			}
+
+			index = uint64((socketID*nrCores+coreID)*nrThreads + threadID)
 		}
 
-		// Add network device.
-		if len(runConf.NetworkInterface) > 0 {
-			err = vm.addNetDevConfig(sb, nicIndex, bootIndexes, runConf.NetworkInterface, fdFiles)
-			if err != nil {
-				return "", err
-			}
-			nicIndex++
+		_, found := threads[index]
+		if found {
+			return nil, fmt.Errorf("Multiple vCPUs found with index %d", index)
 		}
-	}
 
-	// Write the agent mount config.
-	agentMountJSON, err := json.Marshal(agentMounts)
-	if err != nil {
-		return "", errors.Wrapf(err, "Failed marshalling agent mounts to JSON")
+		threads[index] = cpu.ThreadID
 	}
 
-	agentMountFile := filepath.Join(vm.Path(), "config", "agent-mounts.json")
-	err = ioutil.WriteFile(agentMountFile, agentMountJSON, 0400)
+	return threads, nil
+}
+
+// setCPUs hot-plugs or hot-unplugs vCPUs so that the running VM matches the CPU limit and then
+// re-applies the CPU pinning. The VM must have been started with limits.cpu.max set.
+func (vm *qemu) setCPUs(cpuLimit string) error {
+	cpuCount, err := vm.cpuCount(cpuLimit)
 	if err != nil {
-		return "", errors.Wrapf(err, "Failed writing agent mounts file")
+		return err
 	}
 
-	// Write the config file to disk.
-	configPath := filepath.Join(vm.LogPath(), "qemu.conf")
-	return configPath, ioutil.WriteFile(configPath, []byte(sb.String()), 0640)
-}
-
-// addMemoryConfig adds the qemu config required for setting the size of the VM's memory.
-func (vm *qemu) addMemoryConfig(sb *strings.Builder) error {
-	// Configure memory limit.
-	memSize := vm.expandedConfig["limits.memory"]
-	if memSize == "" {
-		memSize = "1GiB" // Default to 1GiB if no memory limit specified.
+	monitor, err := vm.getMonitor()
+	if err != nil {
+		return err
 	}
 
-	memSizeBytes, err := units.ParseByteSizeString(memSize)
+	slots, err := monitor.GetHotpluggableCPUs()
 	if err != nil {
-		return fmt.Errorf("limits.memory invalid: %v", err)
+		return errors.Wrap(err, "The VM doesn't support CPU hotplug")
 	}
 
-	return qemuMemory.Execute(sb, map[string]interface{}{
-		"architecture": vm.architectureName,
-		"memSizeBytes": memSizeBytes,
-	})
-}
+	// Split the vCPU slots between the plugged and free ones, lowest vCPU first.
+	sort.SliceStable(slots, func(i, j int) bool {
+		for _, prop := range []string{"node-id", "socket-id", "core-id", "thread-id"} {
+			if slots[i].Props[prop] != slots[j].Props[prop] {
+				return slots[i].Props[prop] < slots[j].Props[prop]
+			}
+		}
 
-// addVsockConfig adds the qemu config required for setting up the host->VM vsock socket.
-func (vm *qemu) addVsockConfig(sb *strings.Builder) error {
-	return qemuVsock.Execute(sb, map[string]interface{}{
-		"architecture": vm.architectureName,
-		"vsockID":      vm.vsockID(),
+		return false
 	})
-}
 
-// addCPUConfig adds the qemu config required for setting the number of virtualised CPUs.
-func (vm *qemu) addCPUConfig(sb *strings.Builder) error {
-	// Default to a single core.
-	cpus := vm.expandedConfig["limits.cpu"]
-	if cpus == "" {
-		cpus = "1"
+	plugged := []qmp.HotpluggableCPU{}
+	free := []qmp.HotpluggableCPU{}
+	for _, slot := range slots {
+		if slot.QOMPath != "" {
+			plugged = append(plugged, slot)
+		} else {
+			free = append(free, slot)
+		}
 	}
 
-	ctx := map[string]interface{}{
-		"architecture": vm.architectureName,
+	if cpuCount > len(slots) {
+		return fmt.Errorf("The VM was started with room for %d vCPUs at most (limits.cpu.max)", len(slots))
 	}
 
-	cpuCount, err := strconv.Atoi(cpus)
-	if err == nil {
-		// If not pinning, default to exposing cores.
-		ctx["cpuCount"] = cpuCount
-		ctx["cpuSockets"] = 1
-		ctx["cpuCores"] = cpuCount
-		ctx["cpuThreads"] = 1
-	} else {
-		// Expand to a set of CPU identifiers and get the pinning map.
-		nrSockets, nrCores, nrThreads, vcpus, err := vm.cpuTopology(cpus)
+	// Add the missing vCPUs.
+	for i := len(plugged); i < cpuCount; i++ {
+		slot := free[i-len(plugged)]
+
+		cpuDev := map[string]interface{}{
+			"driver": slot.Type,
+			"id":     fmt.Sprintf("qemu_cpu%d", i),
+		}
+
+		for prop, value := range slot.Props {
+			cpuDev[prop] = value
+		}
+
+		err = monitor.AddDevice(cpuDev)
 		if err != nil {
-			return err
+			return errors.Wrap(err, "Failed adding vCPU, the guest may not support CPU hotplug")
 		}
+	}
 
-		ctx["cpuCount"] = len(vcpus)
-		ctx["cpuSockets"] = nrSockets
-		ctx["cpuCores"] = nrCores
-		ctx["cpuThreads"] = nrThreads
+	// Remove the extra vCPUs, the guest has to release them.
+	for i := len(plugged) - 1; i >= cpuCount; i-- {
+		err = monitor.RemoveDevice(plugged[i].QOMPath)
+		if err != nil {
+			return errors.Wrap(err, "Failed removing vCPU, the guest may not support CPU hotplug")
+		}
 	}
 
-	return qemuCPU.Execute(sb, ctx)
-}
+	// Wait for the vCPU threads to match the new count.
+	for i := 0; ; i++ {
+		cpus, err := qemuGetVCPUs(monitor)
+		if err != nil {
+			return err
+		}
 
-// addMonitorConfig adds the qemu config required for setting up the host side VM monitor device.
-func (vm *qemu) addMonitorConfig(sb *strings.Builder) error {
-	return qemuControlSocket.Execute(sb, map[string]interface{}{
-		"architecture": vm.architectureName,
-		"path":         vm.getMonitorPath(),
-	})
-}
+		if len(cpus) == cpuCount {
+			break
+		}
 
-// addFirmwareConfig adds the qemu config required for adding a secure boot compatible EFI firmware.
-func (vm *qemu) addFirmwareConfig(sb *strings.Builder) error {
-	// No UEFI nvram for ppc64le.
-	if vm.architecture == osarch.ARCH_64BIT_POWERPC_LITTLE_ENDIAN {
-		return nil
-	}
+		if i == 30 {
+			return fmt.Errorf("The guest didn't release the removed vCPUs, it may not support CPU hot-unplug")
+		}
 
-	return qemuDriveFirmware.Execute(sb, map[string]interface{}{
-		"architecture": vm.architectureName,
-		"roPath":       filepath.Join(vm.ovmfPath(), "OVMF_CODE.fd"),
-		"nvramPath":    vm.getNvramPath(),
-	})
-}
+		time.Sleep(time.Second)
+	}
 
-// addConfDriveConfig adds the qemu config required for adding the config drive.
-func (vm *qemu) addConfDriveConfig(sb *strings.Builder) error {
-	return qemuDriveConfig.Execute(sb, map[string]interface{}{
-		"architecture": vm.architectureName,
-		"path":         filepath.Join(vm.Path(), "config"),
-	})
+	return vm.setCPUPinning(monitor, cpuLimit)
 }
 
-// addFileDescriptor adds a file path to the list of files to open and pass file descriptor to qemu.
-// Returns the file descriptor number that qemu will receive.
-func (vm *qemu) addFileDescriptor(fdFiles *[]string, filePath string) int {
-	// Append the tap device file path to the list of files to be opened and passed to qemu.
-	*fdFiles = append(*fdFiles, filePath)
-	return 2 + len(*fdFiles) // Use 2+fdFiles count, as first user file descriptor is 3.
-}
+// cpuCount returns the number of vCPUs for a limits.cpu value, defaulting to a single vCPU.
+func (vm *qemu) cpuCount(cpuLimit string) (int, error) {
+	if cpuLimit == "" {
+		return 1, nil
+	}
 
-// addRootDriveConfig adds the qemu config required for adding the root drive.
-func (vm *qemu) addRootDriveConfig(sb *strings.Builder, bootIndexes map[string]int, rootDriveConf deviceConfig.MountEntryItem) error {
-	if rootDriveConf.TargetPath != "/" {
-		return fmt.Errorf("Non-root drive config supplied")
+	cpuCount, err := strconv.Atoi(cpuLimit)
+	if err == nil {
+		return cpuCount, nil
 	}
 
-	pool, err := vm.getStoragePool()
+	pins, err := instance.ParseCpuset(cpuLimit)
 	if err != nil {
-		return err
+		return -1, err
 	}
 
-	rootDrivePath, err := pool.GetInstanceDisk(vm)
+	return len(pins), nil
+}
+
+// openUnixSocket connects to a UNIX socket and returns the connection.
+func (vm *qemu) openUnixSocket(sockPath string) (*net.UnixConn, error) {
+	addr, err := net.ResolveUnixAddr("unix", sockPath)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	// Generate a new device config with the root device path expanded.
-	driveConf := deviceConfig.MountEntryItem{
-		DevName: rootDriveConf.DevName,
-		DevPath: rootDrivePath,
+	c, err := net.DialUnix("unix", nil, addr)
+	if err != nil {
+		return nil, err
 	}
 
-	// If the storage pool is on ZFS and backed by a loop file and we can't use DirectIO, then resort to
-	// unsafe async I/O to avoid kernel hangs when running ZFS storage pools in an image file on another FS.
-	driverInfo := pool.Driver().Info()
-	driverConf := pool.Driver().Config()
-	if driverInfo.Name == "zfs" && !driverInfo.DirectIO && shared.PathExists(driverConf["source"]) && !shared.IsBlockdevPath(driverConf["source"]) {
-		driveConf.Opts = append(driveConf.Opts, qemuUnsafeIO)
-	}
-
-	return vm.addDriveConfig(sb, bootIndexes, driveConf)
+	return c, nil
 }
 
-// addDriveDirConfig adds the qemu config required for adding a supplementary drive directory share.
-func (vm *qemu) addDriveDirConfig(sb *strings.Builder, fdFiles *[]string, agentMounts *[]instancetype.VMAgentMount, driveConf deviceConfig.MountEntryItem) error {
-	mountTag := fmt.Sprintf("lxd_%s", driveConf.DevName)
+func (vm *qemu) setupNvram() error {
+	// No UEFI nvram for ppc64le.
+	if vm.architecture == osarch.ARCH_64BIT_POWERPC_LITTLE_ENDIAN {
+		return nil
+	}
 
-	agentMount := instancetype.VMAgentMount{
-		Source: mountTag,
-		Target: driveConf.TargetPath,
-		FSType: driveConf.FSType,
+	// Mount the instance's config volume.
+	ourMount, err := vm.mount()
+	if err != nil {
+		return err
 	}
 
-	// Indicate to agent to mount this readonly. Note: This is purely to indicate to VM guest that this is
-	// readonly, it should *not* be used as a security measure, as the VM guest could remount it R/W.
-	if shared.StringInSlice("ro", driveConf.Opts) {
-		agentMount.Options = append(agentMount.Options, "ro")
+	if ourMount {
+		defer vm.unmount()
 	}
 
-	// Record the 9p mount for the agent.
-	*agentMounts = append(*agentMounts, agentMount)
+	firmware, err := vm.getFirmware()
+	if err != nil {
+		return err
+	}
 
-	// For read only shares, do not use proxy.
-	if shared.StringInSlice("ro", driveConf.Opts) {
-		return qemuDriveDir.Execute(sb, map[string]interface{}{
-			"devName":  driveConf.DevName,
-			"mountTag": mountTag,
-			"path":     driveConf.DevPath,
-			"readonly": true,
-		})
+	os.Remove(vm.getNvramPath())
+	err = shared.FileCopy(firmware.vars, vm.getNvramPath())
+	if err != nil {
+		return err
 	}
 
-	// Only use proxy for writable shares.
-	proxyFD := vm.addFileDescriptor(fdFiles, driveConf.DevPath)
-	return qemuDriveDir.Execute(sb, map[string]interface{}{
-		"devName":  driveConf.DevName,
-		"mountTag": mountTag,
-		"proxyFD":  proxyFD,
-		"readonly": false,
-	})
-}
+	// Record which firmware settings the NVRAM was created from.
+	err = vm.VolatileSet(map[string]string{"volatile.vm.firmware": firmware.vars})
+	if err != nil {
+		return err
+	}
 
-// addDriveConfig adds the qemu config required for adding a supplementary drive.
-func (vm *qemu) addDriveConfig(sb *strings.Builder, bootIndexes map[string]int, driveConf deviceConfig.MountEntryItem) error {
-	// Use native kernel async IO and O_DIRECT by default.
-	aioMode := "native"
-	cacheMode := "none" // Bypass host cache, use O_DIRECT semantics.
+	return nil
+}
 
-	// If drive config indicates we need to use unsafe I/O then use it.
-	if shared.StringInSlice(qemuUnsafeIO, driveConf.Opts) {
-		logger.Warnf("Using unsafe cache I/O with %s", driveConf.DevPath)
-		aioMode = "threads"
-		cacheMode = "unsafe" // Use host cache, but ignore all sync requests from guest.
-	} else if shared.PathExists(driveConf.DevPath) && !shared.IsBlockdevPath(driveConf.DevPath) {
-		// Disk dev path is a file, check whether it is located on a ZFS filesystem.
-		fsType, err := util.FilesystemDetect(driveConf.DevPath)
-		if err != nil {
-			return errors.Wrapf(err, "Failed detecting filesystem type of %q", driveConf.DevPath)
-		}
+// nvramHasCustomKeys returns whether the secure boot keys in the VM's NVRAM differ from those of the
+// OVMF settings file it was created from, meaning that they would be lost by re-generating it.
+func (vm *qemu) nvramHasCustomKeys() (bool, error) {
+	// Mount the instance's config volume.
+	ourMount, err := vm.mount()
+	if err != nil {
+		return false, err
+	}
 
-		// If FS is ZFS, avoid using direct I/O and use host page cache only.
-		if fsType == "zfs" {
-			if driveConf.FSType != "iso9660" {
-				logger.Warnf("Using writeback cache I/O with %s", driveConf.DevPath)
-			}
-			aioMode = "threads"
-			cacheMode = "writeback" // Use host cache, with neither O_DSYNC nor O_DIRECT semantics.
-		}
+	if ourMount {
+		defer vm.unmount()
 	}
 
-	return qemuDrive.Execute(sb, map[string]interface{}{
-		"devName":   driveConf.DevName,
-		"devPath":   driveConf.DevPath,
-		"bootIndex": bootIndexes[driveConf.DevName],
-		"cacheMode": cacheMode,
-		"aioMode":   aioMode,
-	})
-}
+	if !shared.PathExists(vm.getNvramPath()) {
+		return false, nil
+	}
 
-// addNetDevConfig adds the qemu config required for adding a network device.
-func (vm *qemu) addNetDevConfig(sb *strings.Builder, nicIndex int, bootIndexes map[string]int, nicConfig []deviceConfig.RunConfigItem, fdFiles *[]string) error {
-	var devName, nicName, devHwaddr, pciSlotName string
-	for _, nicItem := range nicConfig {
-		if nicItem.Key == "devName" {
-			devName = nicItem.Value
-		} else if nicItem.Key == "link" {
-			nicName = nicItem.Value
-		} else if nicItem.Key == "hwaddr" {
-			devHwaddr = nicItem.Value
-		} else if nicItem.Key == "pciSlotName" {
-			pciSlotName = nicItem.Value
-		}
+	keys, err := efiSecureBootKeys(vm.getNvramPath())
+	if err != nil {
+		return false, err
 	}
 
-	var tpl *template.Template
-	tplFields := map[string]interface{}{
-		"architecture": vm.architectureName,
-		"devName":      devName,
-		"devHwaddr":    devHwaddr,
-		"bootIndex":    bootIndexes[devName],
-		"chassisIndex": 5 + nicIndex,
-		"portIndex":    14 + nicIndex,
-		"pcieAddr":     4 + nicIndex,
+	// NVRAM files created before the firmware was recorded could come from either settings file.
+	templates := []string{}
+	if vm.localConfig["volatile.vm.firmware"] != "" {
+		templates = append(templates, vm.localConfig["volatile.vm.firmware"])
+	} else {
+		for _, secureBoot := range []bool{true, false} {
+			firmware, err := qemuFindFirmware(vm.architecture, secureBoot)
+			if err == nil {
+				templates = append(templates, firmware.vars)
+			}
+		}
 	}
 
-	// Detect MACVTAP interface types and figure out which tap device is being used.
-	// This is so we can open a file handle to the tap device and pass it to the qemu process.
-	if shared.PathExists(fmt.Sprintf("/sys/class/net/%s/macvtap", nicName)) {
-		content, err := ioutil.ReadFile(fmt.Sprintf("/sys/class/net/%s/ifindex", nicName))
-		if err != nil {
-			return errors.Wrapf(err, "Error getting tap device ifindex")
+	for _, template := range templates {
+		if !shared.PathExists(template) {
+			continue
 		}
 
-		ifindex, err := strconv.Atoi(strings.TrimSpace(string(content)))
+		templateKeys, err := efiSecureBootKeys(template)
 		if err != nil {
-			return errors.Wrapf(err, "Error parsing tap device ifindex")
+			return false, err
 		}
 
-		// Append the tap device file path to the list of files to be opened and passed to qemu.
-		tplFields["tapFD"] = vm.addFileDescriptor(fdFiles, fmt.Sprintf("/dev/tap%d", ifindex))
-		tpl = qemuNetdevTapFD
-	} else if shared.PathExists(fmt.Sprintf("/sys/class/net/%s/tun_flags", nicName)) {
-		// Detect TAP (via TUN driver) device.
-		tplFields["ifName"] = nicName
-		tpl = qemuNetDevTapTun
-	} else if pciSlotName != "" {
-		// Detect physical passthrough device.
-		tplFields["pciSlotName"] = pciSlotName
-		tpl = qemuNetdevPhysical
+		if efiSameSecureBootKeys(keys, templateKeys) {
+			return false, nil
+		}
 	}
 
-	if tpl != nil {
-		return tpl.Execute(sb, tplFields)
+	return true, nil
+}
+
+func (vm *qemu) qemuArchConfig() (string, error) {
+	if vm.architecture == osarch.ARCH_64BIT_INTEL_X86 {
+		return "qemu-system-x86_64", nil
+	} else if vm.architecture == osarch.ARCH_64BIT_ARMV8_LITTLE_ENDIAN {
+		return "qemu-system-aarch64", nil
+	} else if vm.architecture == osarch.ARCH_64BIT_POWERPC_LITTLE_ENDIAN {
+		return "qemu-system-ppc64", nil
 	}
 
-	return fmt.Errorf("Unrecognised device type")
+	return "", fmt.Errorf("Architecture isn't supported for virtual machines")
 }
 
-// pidFilePath returns the path where the qemu process should write its PID.
-func (vm *qemu) pidFilePath() string {
-	return filepath.Join(vm.LogPath(), "qemu.pid")
+// qemuMachineTypes are the machine types used for each architecture, as set in the base config.
+var qemuMachineTypes = map[string]string{
+	"x86_64":  "q35",
+	"aarch64": "virt",
+	"ppc64le": "pseries",
 }
 
-// pid gets the PID of the running qemu process.
-func (vm *qemu) pid() (int, error) {
-	pidStr, err := ioutil.ReadFile(vm.pidFilePath())
-	if os.IsNotExist(err) {
-		return 0, nil
-	}
+// qemuNUMAMinVersion is the first qemu version able to back guest NUMA nodes with memory objects.
+const qemuNUMAMinVersion = "2.1.0"
+
+// qemuMemoryHotplugMinVersion is the first qemu version able to hot-add memory as DIMMs.
+const qemuMemoryHotplugMinVersion = "2.1.0"
 
+// qemuSecureBootMinVersion is the first qemu version emulating SMM, which secure boot firmware relies on.
+const qemuSecureBootMinVersion = "2.4.0"
+
+// qemuProbeTimeout is how long qemu has to complete a probe of what it supports.
+var qemuProbeTimeout = 10 * time.Second
+
+// qemuCapabilities is what a qemu binary was found to support.
+type qemuCapabilities struct {
+	modTime  time.Time              // Modification time of the binary when it was probed.
+	version  *version.DottedVersion // Nil if the version couldn't be parsed.
+	machines []string
+	devices  []string
+	ioUring  error // Why io_uring can't be used, nil if both qemu and the host kernel support it.
+}
+
+// qemuCapabilitiesCache records the capabilities of each qemu binary, keyed by path.
+var qemuCapabilitiesCache = map[string]*qemuCapabilities{}
+var qemuCapabilitiesCacheLock sync.Mutex
+
+// qemuGetCapabilities returns the capabilities of a qemu binary. It's only probed again if the binary
+// was modified since, such as when qemu was upgraded. Each run of qemu is bounded by qemuProbeTimeout,
+// so that a stuck probe doesn't hold up the VMs waiting on the lock.
+func qemuGetCapabilities(qemuPath string) (*qemuCapabilities, error) {
+	fi, err := os.Stat(qemuPath)
 	if err != nil {
-		return -1, err
+		return nil, err
 	}
 
-	pid, err := strconv.Atoi(strings.TrimSpace(string(pidStr)))
+	qemuCapabilitiesCacheLock.Lock()
+	defer qemuCapabilitiesCacheLock.Unlock()
+
+	caps, ok := qemuCapabilitiesCache[qemuPath]
+	if ok && caps.modTime.Equal(fi.ModTime()) {
+		return caps, nil
+	}
+
+	caps, err = qemuProbeCapabilities(qemuPath)
 	if err != nil {
-		return -1, err
+		return nil, err
 	}
 
-	return pid, nil
+	caps.modTime = fi.ModTime()
+	qemuCapabilitiesCache[qemuPath] = caps
+
+	return caps, nil
 }
 
-// Stop stops the VM.
-func (vm *qemu) Stop(stateful bool) error {
-	// Check that we're not already stopped.
-	if !vm.IsRunning() {
-		return fmt.Errorf("The instance is already stopped")
-	}
+// qemuProbeCapabilities gets the version, machine types, devices and async I/O modes supported by a qemu
+// binary.
+func qemuProbeCapabilities(qemuPath string) (*qemuCapabilities, error) {
+	caps := &qemuCapabilities{}
 
-	// Check that no stateful stop was requested.
-	if stateful {
-		return fmt.Errorf("Stateful stop isn't supported for VMs at this time")
+	out, err := qemuProbe(qemuPath, "", "-version")
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to get the version of %s", filepath.Base(qemuPath))
 	}
 
-	// Setup a new operation.
-	op, err := operationlock.Create(vm.id, "stop", false, true)
+	caps.version = qemuParseVersion(out)
+
+	out, err = qemuProbe(qemuPath, "", "-machine", "help")
 	if err != nil {
-		return err
+		return nil, errors.Wrapf(err, "Failed to get the machine types supported by %s", filepath.Base(qemuPath))
 	}
 
-	// Connect to the monitor.
-	monitor, err := qmp.Connect(vm.getMonitorPath(), vm.getMonitorEventHandler())
+	caps.machines = qemuParseMachines(out)
+
+	out, err = qemuProbe(qemuPath, "", "-device", "help")
 	if err != nil {
-		// If we fail to connect, it's most likely because the VM is already off.
-		op.Done(nil)
-		return nil
+		return nil, errors.Wrapf(err, "Failed to get the devices supported by %s", filepath.Base(qemuPath))
 	}
 
-	// Get the wait channel.
-	chDisconnect, err := monitor.Wait()
-	if err != nil {
-		if err == qmp.ErrMonitorDisconnect {
-			op.Done(nil)
-			return nil
-		}
+	caps.devices = qemuParseDevices(out)
 
-		op.Done(err)
-		return err
-	}
+	// Lacking io_uring isn't fatal, disks then fall back to threaded async I/O.
+	caps.ioUring = qemuProbeIOUring(qemuPath)
 
-	// Send the quit command.
-	err = monitor.Quit()
-	if err != nil {
-		if err == qmp.ErrMonitorDisconnect {
-			op.Done(nil)
-			return nil
-		}
+	return caps, nil
+}
 
-		op.Done(err)
-		return err
+// qemuProbe runs qemu with the given arguments and input, returning its output. It is killed if it takes
+// longer than qemuProbeTimeout.
+func qemuProbe(qemuPath string, stdin string, args ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), qemuProbeTimeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, qemuPath, args...)
+	cmd.Stdin = strings.NewReader(stdin)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		return "", fmt.Errorf("%s didn't complete within %v", filepath.Base(qemuPath), qemuProbeTimeout)
 	}
 
-	// Wait for QEMU to exit (can take a while if pending I/O).
-	<-chDisconnect
+	if err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if msg == "" {
+			return "", err
+		}
 
-	// Wait for OnStop.
-	err = op.Wait()
-	if err != nil && vm.IsRunning() {
-		return err
+		return "", fmt.Errorf("%v: %s", err, msg)
 	}
 
-	vm.state.Events.SendLifecycle(vm.project, "virtual-machine-stopped", fmt.Sprintf("/1.0/virtual-machines/%s", vm.name), nil)
-	return nil
+	return stdout.String(), nil
 }
 
-// Unfreeze restores the instance to running.
-func (vm *qemu) Unfreeze() error {
-	// Connect to the monitor.
-	monitor, err := qmp.Connect(vm.getMonitorPath(), vm.getMonitorEventHandler())
-	if err != nil {
-		return err
+// qemuParseVersion parses the output of qemu -version, such as "QEMU emulator version 4.2.1 (Debian 1:4.2-3ubuntu6)".
+func qemuParseVersion(out string) *version.DottedVersion {
+	firstLine := strings.SplitN(strings.TrimSpace(out), "\n", 2)[0]
+
+	idx := strings.Index(firstLine, "version ")
+	if idx < 0 {
+		return nil
 	}
 
-	// Send the cont command.
-	err = monitor.Start()
+	v, err := version.Parse(firstLine[idx+len("version "):])
 	if err != nil {
-		return err
+		return nil
 	}
 
-	return nil
+	return v
 }
 
-// IsPrivileged does not apply to virtual machines. Always returns false.
-func (vm *qemu) IsPrivileged() bool {
-	return false
+// qemuParseMachines parses the output of qemu -machine help, listing a machine type per line after a header.
+func qemuParseMachines(out string) []string {
+	machines := []string{}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || strings.HasSuffix(line, ":") {
+			continue
+		}
+
+		machines = append(machines, fields[0])
+	}
+
+	return machines
 }
 
-// Restore restores an instance snapshot.
-func (vm *qemu) Restore(source instance.Instance, stateful bool) error {
-	if stateful {
-		return fmt.Errorf("Stateful snapshots of VMs aren't supported yet")
+// qemuParseDevices parses the output of qemu -device help, where devices are listed as `name "virtio-net-pci", bus PCI`.
+func qemuParseDevices(out string) []string {
+	devices := []string{}
+	for _, line := range strings.Split(out, "\n") {
+		if !strings.HasPrefix(line, "name \"") {
+			continue
+		}
+
+		fields := strings.SplitN(line, "\"", 3)
+		if len(fields) < 3 {
+			continue
+		}
+
+		devices = append(devices, fields[1])
 	}
 
-	var ctxMap log.Ctx
+	return devices
+}
 
-	// Load the storage driver.
-	pool, err := storagePools.GetPoolByInstance(vm.state, vm)
+// checkQemuCapabilities checks the host's qemu supports the features the VM requires, reporting all the
+// missing ones at once.
+func (vm *qemu) checkQemuCapabilities() error {
+	qemuBinary, err := vm.qemuArchConfig()
 	if err != nil {
 		return err
 	}
 
-	// Ensure that storage is mounted for backup.yaml updates.
-	ourStart, err := pool.MountInstance(vm, nil)
+	qemuPath, err := exec.LookPath(qemuBinary)
 	if err != nil {
 		return err
 	}
-	if ourStart {
-		defer pool.UnmountInstance(vm, nil)
+
+	caps, err := qemuGetCapabilities(qemuPath)
+	if err != nil {
+		return err
 	}
 
-	// Stop the instance.
-	wasRunning := false
-	if vm.IsRunning() {
-		wasRunning = true
+	missing := qemuMissingCapabilities(caps, vm.architectureName, vm.expandedConfig)
+	if len(missing) > 0 {
+		return fmt.Errorf("The host's %s lacks %s", qemuBinary, strings.Join(missing, ", "))
+	}
 
-		ephemeral := vm.IsEphemeral()
-		if ephemeral {
-			// Unset ephemeral flag.
-			args := db.InstanceArgs{
-				Architecture: vm.Architecture(),
-				Config:       vm.LocalConfig(),
-				Description:  vm.Description(),
-				Devices:      vm.LocalDevices(),
-				Ephemeral:    false,
-				Profiles:     vm.Profiles(),
-				Project:      vm.Project(),
-				Type:         vm.Type(),
-				Snapshot:     vm.IsSnapshot(),
-			}
+	return nil
+}
 
-			err := vm.Update(args, false)
-			if err != nil {
-				return err
-			}
+// qemuMissingCapabilities returns the features required by a VM of the given architecture and config
+// which qemu lacks.
+func qemuMissingCapabilities(caps *qemuCapabilities, architectureName string, config map[string]string) []string {
+	missing := []string{}
 
-			// On function return, set the flag back on.
-			defer func() {
-				args.Ephemeral = ephemeral
-				vm.Update(args, true)
-			}()
-		}
+	machine := qemuMachineTypes[architectureName]
+	if machine != "" && !shared.StringInSlice(machine, caps.machines) {
+		missing = append(missing, fmt.Sprintf("the %q machine type", machine))
+	}
 
-		// This will unmount the instance storage.
-		err := vm.Stop(false)
-		if err != nil {
-			return err
-		}
+	// The agent is reached through vsock.
+	if !shared.StringInSlice("vhost-vsock-pci", caps.devices) {
+		missing = append(missing, "vhost-vsock support (vhost-vsock-pci device)")
 	}
 
-	ctxMap = log.Ctx{
-		"project":   vm.project,
-		"name":      vm.name,
-		"created":   vm.creationDate,
-		"ephemeral": vm.ephemeral,
-		"used":      vm.lastUsedDate,
-		"source":    source.Name()}
+	atLeast := func(minVersion string) bool {
+		// Assume unknown versions are recent enough, leaving qemu to report the failure.
+		if caps.version == nil {
+			return true
+		}
 
-	logger.Info("Restoring instance", ctxMap)
+		v, _ := version.NewDottedVersion(minVersion)
+		return caps.version.Compare(v) >= 0
+	}
 
-	// Restore the rootfs.
-	err = pool.RestoreInstanceSnapshot(vm, source, nil)
-	if err != nil {
-		return err
+	secureBoot := config["security.secureboot"] == "" || shared.IsTrue(config["security.secureboot"])
+	if secureBoot && architectureName == "x86_64" && !atLeast(qemuSecureBootMinVersion) {
+		missing = append(missing, fmt.Sprintf("secure boot support (requires qemu %s, found %s)", qemuSecureBootMinVersion, caps.version))
 	}
 
-	// Restore the configuration.
-	args := db.InstanceArgs{
-		Architecture: source.Architecture(),
-		Config:       source.LocalConfig(),
-		Description:  source.Description(),
-		Devices:      source.LocalDevices(),
-		Ephemeral:    source.IsEphemeral(),
-		Profiles:     source.Profiles(),
-		Project:      source.Project(),
-		Type:         source.Type(),
-		Snapshot:     source.IsSnapshot(),
+	// Pinned CPUs spanning multiple host NUMA nodes are mirrored as guest NUMA nodes.
+	cpus := config["limits.cpu"]
+	_, err := strconv.Atoi(cpus)
+	if cpus != "" && err != nil && !atLeast(qemuNUMAMinVersion) {
+		missing = append(missing, fmt.Sprintf("NUMA support (requires qemu %s, found %s)", qemuNUMAMinVersion, caps.version))
 	}
 
-	err = vm.Update(args, false)
-	if err != nil {
-		logger.Error("Failed restoring instance configuration", ctxMap)
-		return err
+	if config["limits.memory.max"] != "" && !atLeast(qemuMemoryHotplugMinVersion) {
+		missing = append(missing, fmt.Sprintf("memory hotplug support (requires qemu %s, found %s)", qemuMemoryHotplugMinVersion, caps.version))
 	}
 
-	// The old backup file may be out of date (e.g. it doesn't have all the current snapshots of
-	// the instance listed); let's write a new one to be safe.
-	err = vm.UpdateBackupFile()
+	return missing
+}
+
+// debugItems returns the value of the -d argument to pass to qemu, after checking the log items
+// requested in raw.qemu.debug against the ones qemu supports, unless in a dry run.
+func (vm *qemu) debugItems(qemuPath string, dryRun bool) (string, error) {
+	items := vm.expandedConfig["raw.qemu.debug"]
+	if items == "" || dryRun {
+		return strings.Replace(items, " ", "", -1), nil
+	}
+
+	out, err := qemuProbe(qemuPath, "", "-d", "help")
 	if err != nil {
-		return err
+		return "", errors.Wrap(err, "Failed to get supported debug log items")
 	}
 
-	vm.state.Events.SendLifecycle(vm.project, "virtual-machine-snapshot-restored", fmt.Sprintf("/1.0/virtual-machines/%s", vm.name), map[string]interface{}{"snapshot_name": vm.name})
+	supported := qemuParseDebugItems(out)
+	for _, item := range strings.Split(items, ",") {
+		item = strings.TrimSpace(item)
 
-	// Restart the insance.
-	if wasRunning {
-		logger.Info("Restored instance", ctxMap)
-		return vm.Start(false)
+		// Trace events are matched against a pattern, so can't be checked.
+		if strings.HasPrefix(item, "trace:") {
+			continue
+		}
+
+		if !shared.StringInSlice(item, supported) {
+			return "", fmt.Errorf("Debug log item %q isn't supported by %s (supported: %s)", item, filepath.Base(qemuPath), strings.Join(supported, ", "))
+		}
 	}
 
-	logger.Info("Restored instance", ctxMap)
-	return nil
+	return strings.Replace(items, " ", "", -1), nil
 }
 
-// Snapshots returns a list of snapshots.
-func (vm *qemu) Snapshots() ([]instance.Instance, error) {
-	var snaps []db.Instance
+// qemuParseDebugItems parses the output of "qemu -d help" into the list of supported log items. Each
+// item is listed with its description starting on the 17th column, some descriptions being wrapped.
+func qemuParseDebugItems(out string) []string {
+	items := []string{}
+	for _, line := range strings.Split(out, "\n") {
+		if len(line) < 17 || line[15] != ' ' || line[0] == ' ' {
+			continue
+		}
 
-	if vm.IsSnapshot() {
-		return []instance.Instance{}, nil
+		// Skip the header and footer sentences as well as the trace pattern entry.
+		item := strings.TrimSpace(line[:15])
+		if strings.Contains(item, " ") || item != strings.ToLower(item) || strings.HasPrefix(item, "trace:") {
+			continue
+		}
+
+		items = append(items, item)
 	}
 
-	// Get all the snapshots
-	err := vm.state.Cluster.Transaction(func(tx *db.ClusterTx) error {
-		var err error
-		snaps, err = tx.ContainerGetSnapshotsFull(vm.Project(), vm.name)
+	return items
+}
+
+// cpuModel returns the value of the -cpu argument to pass to qemu. This defaults to "host" unless a
+// specific CPU model is requested in which case it is validated against the models qemu supports,
+// unless in a dry run.
+func (vm *qemu) cpuModel(qemuPath string, dryRun bool) (string, error) {
+	model := vm.expandedConfig["limits.cpu.model"]
+	if model == "" {
+		model = "host"
+	}
+
+	if model != "host" && !dryRun {
+		out, err := qemuProbe(qemuPath, "", "-cpu", "help")
 		if err != nil {
-			return err
+			return "", errors.Wrap(err, "Failed to get supported CPU models")
 		}
 
-		return nil
-	})
-	if err != nil {
-		return nil, err
-	}
+		found := false
+		for _, line := range strings.Split(out, "\n") {
+			// Models are listed either on their own or prefixed with the architecture.
+			fields := strings.Fields(line)
+			if (len(fields) > 0 && fields[0] == model) || (len(fields) > 1 && fields[1] == model) {
+				found = true
+				break
+			}
+		}
 
-	// Build the snapshot list
-	snapshots, err := instance.LoadAllInternal(vm.state, snaps)
-	if err != nil {
-		return nil, err
+		if !found {
+			return "", fmt.Errorf("CPU model %q isn't supported by %s", model, filepath.Base(qemuPath))
+		}
 	}
 
-	instances := make([]instance.Instance, len(snapshots))
-	for k, v := range snapshots {
-		instances[k] = instance.Instance(v)
+	features := vm.expandedConfig["limits.cpu.features"]
+	if features != "" {
+		model = fmt.Sprintf("%s,%s", model, features)
 	}
 
-	return instances, nil
-}
-
-// Backups returns a list of backups.
-func (vm *qemu) Backups() ([]backup.Backup, error) {
-	return []backup.Backup{}, nil
+	return model, nil
 }
 
-// Rename the instance.
-func (vm *qemu) Rename(newName string) error {
-	oldName := vm.Name()
-	ctxMap := log.Ctx{
-		"project":   vm.project,
-		"name":      vm.name,
-		"created":   vm.creationDate,
-		"ephemeral": vm.ephemeral,
-		"used":      vm.lastUsedDate,
-		"newname":   newName}
-
-	logger.Info("Renaming instance", ctxMap)
-
-	// Sanity checks.
-	err := instance.ValidName(newName, vm.IsSnapshot())
-	if err != nil {
-		return err
-	}
+// hugepagesPath returns the hugetlbfs mount path used to back the instance's memory, or an empty
+// string if hugepages are not enabled. If a specific hugepage size is requested, then a hugetlbfs
+// mount for that size must exist and have enough free pages to hold the instance's memory.
+func (vm *qemu) hugepagesPath() (string, error) {
+	hugepages := vm.expandedConfig["limits.memory.hugepages"]
+	if shared.IsBool(hugepages) == nil {
+		if shared.IsTrue(hugepages) {
+			return "/dev/hugepages/", nil
+		}
 
-	if vm.IsRunning() {
-		return fmt.Errorf("Renaming of running instance not allowed")
+		return "", nil
 	}
 
-	// Clean things up.
-	vm.cleanup()
-
-	pool, err := storagePools.GetPoolByInstance(vm.state, vm)
+	// Hugepage sizes are expressed as "2MB" or "1GB" but are binary units.
+	pageSizeBytes, err := units.ParseByteSizeString(fmt.Sprintf("%siB", strings.TrimSuffix(hugepages, "B")))
 	if err != nil {
-		return errors.Wrap(err, "Load instance storage pool")
+		return "", errors.Wrapf(err, "Invalid hugepage size %q", hugepages)
 	}
 
-	if vm.IsSnapshot() {
-		_, newSnapName, _ := shared.InstanceGetParentAndSnapshotName(newName)
-		err = pool.RenameInstanceSnapshot(vm, newSnapName, nil)
-		if err != nil {
-			return errors.Wrap(err, "Rename instance snapshot")
-		}
-	} else {
-		err = pool.RenameInstance(vm, newName, nil)
-		if err != nil {
-			return errors.Wrap(err, "Rename instance")
-		}
+	// Check the host has a pool of hugepages of the requested size.
+	poolPath := fmt.Sprintf("/sys/kernel/mm/hugepages/hugepages-%dkB", pageSizeBytes/1024)
+	if !shared.PathExists(poolPath) {
+		return "", fmt.Errorf("Hugepage size %q isn't supported by the host", hugepages)
 	}
 
-	if !vm.IsSnapshot() {
-		// Rename all the instance snapshot database entries.
-		results, err := vm.state.Cluster.ContainerGetSnapshots(vm.project, oldName)
-		if err != nil {
-			logger.Error("Failed to get instance snapshots", ctxMap)
-			return err
-		}
-
-		for _, sname := range results {
-			// Rename the snapshot.
-			oldSnapName := strings.SplitN(sname, shared.SnapshotDelimiter, 2)[1]
-			baseSnapName := filepath.Base(sname)
-			err := vm.state.Cluster.Transaction(func(tx *db.ClusterTx) error {
-				return tx.InstanceSnapshotRename(vm.project, oldName, oldSnapName, baseSnapName)
-			})
-			if err != nil {
-				logger.Error("Failed renaming snapshot", ctxMap)
-				return err
-			}
-		}
+	content, err := ioutil.ReadFile(filepath.Join(poolPath, "free_hugepages"))
+	if err != nil {
+		return "", errors.Wrapf(err, "Failed to read free hugepages for size %q", hugepages)
 	}
 
-	// Rename the instance database entry.
-	err = vm.state.Cluster.Transaction(func(tx *db.ClusterTx) error {
-		if vm.IsSnapshot() {
-			oldParts := strings.SplitN(oldName, shared.SnapshotDelimiter, 2)
-			newParts := strings.SplitN(newName, shared.SnapshotDelimiter, 2)
-			return tx.InstanceSnapshotRename(vm.project, oldParts[0], oldParts[1], newParts[1])
-		}
-
-		return tx.InstanceRename(vm.project, oldName, newName)
-	})
+	freePages, err := strconv.ParseInt(strings.TrimSpace(string(content)), 10, 64)
 	if err != nil {
-		logger.Error("Failed renaming instance", ctxMap)
-		return err
+		return "", errors.Wrapf(err, "Failed to parse free hugepages for size %q", hugepages)
 	}
 
-	// Rename the logging path.
-	os.RemoveAll(shared.LogPath(newName))
-	if shared.PathExists(vm.LogPath()) {
-		err := os.Rename(vm.LogPath(), shared.LogPath(newName))
-		if err != nil {
-			logger.Error("Failed renaming instance", ctxMap)
-			return err
-		}
+	memSizeBytes, err := vm.memorySizeBytes()
+	if err != nil {
+		return "", err
 	}
 
-	// Rename the MAAS entry.
-	if !vm.IsSnapshot() {
-		err = vm.maasRename(newName)
-		if err != nil {
-			return err
-		}
+	if freePages*pageSizeBytes < memSizeBytes {
+		return "", fmt.Errorf("Not enough free hugepages of size %q (%d available, %d required)", hugepages, freePages, memSizeBytes/pageSizeBytes)
 	}
 
-	// Rename the backups.
-	backups, err := vm.Backups()
+	// Find a hugetlbfs mount using the requested page size.
+	f, err := os.Open("/proc/self/mountinfo")
 	if err != nil {
-		return err
+		return "", err
 	}
+	defer f.Close()
 
-	for _, backup := range backups {
-		backupName := strings.Split(backup.Name(), "/")[1]
-		newName := fmt.Sprintf("%s/%s", newName, backupName)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
 
-		err = backup.Rename(newName)
-		if err != nil {
-			return err
+		// Skip the optional fields to get to the filesystem type and super block options.
+		sep := -1
+		for i, field := range fields {
+			if field == "-" {
+				sep = i
+				break
+			}
 		}
-	}
 
-	// Set the new name in the struct.
-	vm.name = newName
+		if sep < 5 || len(fields) < sep+4 || fields[sep+1] != "hugetlbfs" {
+			continue
+		}
 
-	// Update lease files.
-	network.UpdateDNSMasqStatic(vm.state, "")
+		for _, opt := range strings.Split(fields[sep+3], ",") {
+			if !strings.HasPrefix(opt, "pagesize=") {
+				continue
+			}
 
-	logger.Info("Renamed instance", ctxMap)
+			mountPageSize, err := units.ParseByteSizeString(fmt.Sprintf("%siB", strings.TrimPrefix(opt, "pagesize=")))
+			if err != nil {
+				continue
+			}
 
-	if vm.IsSnapshot() {
-		vm.state.Events.SendLifecycle(vm.project, "virtual-machine-snapshot-renamed",
-			fmt.Sprintf("/1.0/virtual-machines/%s", oldName), map[string]interface{}{
-				"new_name":      newName,
-				"snapshot_name": oldName,
-			})
-	} else {
-		vm.state.Events.SendLifecycle(vm.project, "virtual-machine-renamed",
-			fmt.Sprintf("/1.0/virtual-machines/%s", oldName), map[string]interface{}{
-				"new_name": newName,
-			})
+			if mountPageSize == pageSizeBytes {
+				return fields[4], nil
+			}
+		}
 	}
 
-	return nil
+	return "", fmt.Errorf("No hugetlbfs mount point found for hugepage size %q", hugepages)
 }
 
-// Update the instance config.
-func (vm *qemu) Update(args db.InstanceArgs, userRequested bool) error {
-	if vm.IsRunning() {
-		return fmt.Errorf("Update whilst running not supported")
-	}
-
-	// Set sane defaults for unset keys.
-	if args.Project == "" {
-		args.Project = project.Default
+// deviceVolatileGetFunc returns a function that retrieves a named device's volatile config and
+// removes its device prefix from the keys.
+func (vm *qemu) deviceVolatileGetFunc(devName string) func() map[string]string {
+	return func() map[string]string {
+		volatile := make(map[string]string)
+		prefix := fmt.Sprintf("volatile.%s.", devName)
+		for k, v := range vm.localConfig {
+			if strings.HasPrefix(k, prefix) {
+				volatile[strings.TrimPrefix(k, prefix)] = v
+			}
+		}
+		return volatile
 	}
+}
 
-	if args.Architecture == 0 {
-		args.Architecture = vm.architecture
-	}
+// deviceVolatileSetFunc returns a function that can be called to save a named device's volatile
+// config using keys that do not have the device's name prefixed.
+func (vm *qemu) deviceVolatileSetFunc(devName string) func(save map[string]string) error {
+	return func(save map[string]string) error {
+		volatileSave := make(map[string]string)
+		for k, v := range save {
+			volatileSave[fmt.Sprintf("volatile.%s.%s", devName, k)] = v
+		}
 
-	if args.Config == nil {
-		args.Config = map[string]string{}
+		return vm.VolatileSet(volatileSave)
 	}
+}
 
-	if args.Devices == nil {
-		args.Devices = deviceConfig.Devices{}
-	}
+// qemuDeviceVolatile buffers the volatile config changes of devices started or stopped concurrently,
+// as the instance's config maps aren't safe for concurrent use. The changes are then applied at once.
+type qemuDeviceVolatile struct {
+	vm      *qemu
+	lock    sync.Mutex
+	changes map[string]string
+}
 
-	if args.Profiles == nil {
-		args.Profiles = []string{}
+// newDeviceVolatile returns a buffer for the volatile config changes of the VM's devices.
+func (vm *qemu) newDeviceVolatile() *qemuDeviceVolatile {
+	return &qemuDeviceVolatile{vm: vm, changes: map[string]string{}}
+}
+
+// getFunc returns a function getting a named device's volatile config, including buffered changes.
+func (v *qemuDeviceVolatile) getFunc(devName string) func() map[string]string {
+	return func() map[string]string {
+		v.lock.Lock()
+		defer v.lock.Unlock()
+
+		volatile := make(map[string]string)
+		prefix := fmt.Sprintf("volatile.%s.", devName)
+		for k, value := range v.vm.localConfig {
+			if strings.HasPrefix(k, prefix) {
+				volatile[strings.TrimPrefix(k, prefix)] = value
+			}
+		}
+
+		for k, value := range v.changes {
+			if !strings.HasPrefix(k, prefix) {
+				continue
+			}
+
+			if value == "" {
+				delete(volatile, strings.TrimPrefix(k, prefix))
+			} else {
+				volatile[strings.TrimPrefix(k, prefix)] = value
+			}
+		}
+
+		return volatile
 	}
+}
 
-	// Validate the new config.
-	err := instance.ValidConfig(vm.state.OS, args.Config, false, false)
-	if err != nil {
-		return errors.Wrap(err, "Invalid config")
+// setFunc returns a function buffering changes to a named device's volatile config.
+func (v *qemuDeviceVolatile) setFunc(devName string) func(save map[string]string) error {
+	return func(save map[string]string) error {
+		v.lock.Lock()
+		defer v.lock.Unlock()
+
+		for k, value := range save {
+			v.changes[fmt.Sprintf("volatile.%s.%s", devName, k)] = value
+		}
+
+		return nil
 	}
+}
 
-	// Validate the new devices without using expanded devices validation (expensive checks disabled).
-	err = instance.ValidDevices(vm.state, vm.state.Cluster, vm.Type(), args.Devices, false)
-	if err != nil {
-		return errors.Wrap(err, "Invalid devices")
+// apply records the buffered changes in the VM's config.
+func (v *qemuDeviceVolatile) apply() error {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if len(v.changes) == 0 {
+		return nil
 	}
 
-	// Validate the new profiles.
-	profiles, err := vm.state.Cluster.Profiles(args.Project)
+	err := v.vm.VolatileSet(v.changes)
 	if err != nil {
-		return errors.Wrap(err, "Failed to get profiles")
+		return err
 	}
 
-	checkedProfiles := []string{}
-	for _, profile := range args.Profiles {
-		if !shared.StringInSlice(profile, profiles) {
-			return fmt.Errorf("Requested profile '%s' doesn't exist", profile)
+	v.changes = map[string]string{}
+	return nil
+}
+
+// RegisterDevices calls the Register() function on all of the instance's devices, such as USB devices
+// listening for hotplug events.
+func (vm *qemu) RegisterDevices() {
+	devices := vm.ExpandedDevices()
+	for _, dev := range devices.Sorted() {
+		d, _, err := vm.deviceLoad(dev.Name, dev.Config)
+		if err == device.ErrUnsupportedDevType {
+			continue
 		}
 
-		if shared.StringInSlice(profile, checkedProfiles) {
-			return fmt.Errorf("Duplicate profile found in request")
+		if err != nil {
+			logger.Error("Failed to load device to register", log.Ctx{"err": err, "instance": vm.Name(), "device": dev.Name})
+			continue
 		}
 
-		checkedProfiles = append(checkedProfiles, profile)
+		// Check whether device wants to register for any events.
+		err = d.Register()
+		if err != nil {
+			logger.Error("Failed to register device", log.Ctx{"err": err, "instance": vm.Name(), "device": dev.Name})
+			continue
+		}
 	}
+}
 
-	// Validate the new architecture.
-	if args.Architecture != 0 {
-		_, err = osarch.ArchitectureName(args.Architecture)
+// SaveConfigFile is not used by VMs.
+func (vm *qemu) SaveConfigFile() error {
+	return instance.ErrNotImplemented
+}
+
+// OnHook is the top-level hook handler.
+func (vm *qemu) OnHook(hookName string, args map[string]string) error {
+	return instance.ErrNotImplemented
+}
+
+// deviceLoad instantiates and validates a new device and returns it along with enriched config.
+func (vm *qemu) deviceLoad(deviceName string, rawConfig deviceConfig.Device) (device.Device, deviceConfig.Device, error) {
+	return vm.deviceLoadVolatile(deviceName, rawConfig, vm.deviceVolatileGetFunc(deviceName), vm.deviceVolatileSetFunc(deviceName))
+}
+
+// deviceLoadVolatile loads a device the same way as deviceLoad, using the supplied functions to access
+// its volatile config.
+func (vm *qemu) deviceLoadVolatile(deviceName string, rawConfig deviceConfig.Device, volatileGet func() map[string]string, volatileSet func(map[string]string) error) (device.Device, deviceConfig.Device, error) {
+	var configCopy deviceConfig.Device
+	var err error
+
+	// Create copy of config and load some fields from volatile if device is nic or infiniband.
+	if shared.StringInSlice(rawConfig["type"], []string{"nic", "infiniband"}) {
+		configCopy, err = vm.FillNetworkDevice(deviceName, rawConfig)
 		if err != nil {
-			return fmt.Errorf("Invalid architecture ID: %s", err)
+			return nil, nil, err
 		}
+	} else {
+		// Othewise copy the config so it cannot be modified by device.
+		configCopy = rawConfig.Clone()
 	}
 
-	// Check that volatile and image keys weren't modified.
-	if userRequested {
-		for k, v := range args.Config {
-			if strings.HasPrefix(k, "volatile.") && vm.localConfig[k] != v {
-				return fmt.Errorf("Volatile keys are read-only")
-			}
+	d, err := device.New(vm, vm.state, deviceName, configCopy, volatileGet, volatileSet)
 
-			if strings.HasPrefix(k, "image.") && vm.localConfig[k] != v {
-				return fmt.Errorf("Image keys are read-only")
-			}
+	// Return device and config copy even if error occurs as caller may still use device.
+	return d, configCopy, err
+}
+
+// qemuDeviceClaimsHostDevice returns whether starting the device picks a free host device to pass
+// through to the VM.
+func qemuDeviceClaimsHostDevice(dev deviceConfig.Device) bool {
+	switch dev["type"] {
+	case "gpu", "infiniband", "usb":
+		return true
+	case "nic":
+		return shared.StringInSlice(dev.NICType(), []string{"physical", "sriov"})
+	}
+
+	return false
+}
+
+// startDevices starts the VM's devices, returning their runtime config in sorted order. Disks are
+// started one after the other in sorted order, which ensures that device mounts are added in path
+// order. Devices picking a free host device are also started one after the other, while the other
+// devices are started concurrently. The started devices are added to the reverter, to be stopped in
+// reverse order.
+func (vm *qemu) startDevices(reverter *revert.Reverter) ([]*deviceConfig.RunConfig, error) {
+	devices := vm.expandedDevices.Sorted()
+	volatile := vm.newDeviceVolatile()
+
+	// Load all the devices first, as loading NICs may record their generated MAC address directly.
+	loaded := make([]device.Device, len(devices))
+	for i, dev := range devices {
+		d, _, err := vm.deviceLoadVolatile(dev.Name, dev.Config, volatile.getFunc(dev.Name), volatile.setFunc(dev.Name))
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to start device %q", dev.Name)
 		}
 
-		for k, v := range vm.localConfig {
-			if strings.HasPrefix(k, "volatile.") && args.Config[k] != v {
-				return fmt.Errorf("Volatile keys are read-only")
+		loaded[i] = d
+	}
+
+	runConfs := make([]*deviceConfig.RunConfig, len(devices))
+	errs := make([]error, len(devices))
+	started := make([]bool, len(devices))
+
+	start := func(i int) {
+		runConfs[i], errs[i] = loaded[i].Start()
+		started[i] = errs[i] == nil
+	}
+
+	wg := sync.WaitGroup{}
+
+	// Devices picking a free host device, such as a virtual function of an SR-IOV card, would
+	// otherwise pick the same one when started concurrently.
+	startSequence := func(match func(dev deviceConfig.Device) bool) {
+		defer wg.Done()
+
+		for i, dev := range devices {
+			if !match(dev.Config) {
+				continue
 			}
 
-			if strings.HasPrefix(k, "image.") && args.Config[k] != v {
-				return fmt.Errorf("Image keys are read-only")
+			start(i)
+			if errs[i] != nil {
+				return
 			}
 		}
 	}
 
-	// Get a copy of the old configuration.
-	oldDescription := vm.Description()
-	oldArchitecture := 0
-	err = shared.DeepCopy(&vm.architecture, &oldArchitecture)
-	if err != nil {
-		return err
-	}
+	isDisk := func(dev deviceConfig.Device) bool { return dev["type"] == "disk" }
 
-	oldEphemeral := false
-	err = shared.DeepCopy(&vm.ephemeral, &oldEphemeral)
-	if err != nil {
-		return err
-	}
+	wg.Add(2)
+	go startSequence(isDisk)
+	go startSequence(qemuDeviceClaimsHostDevice)
 
-	oldExpandedDevices := deviceConfig.Devices{}
-	err = shared.DeepCopy(&vm.expandedDevices, &oldExpandedDevices)
-	if err != nil {
-		return err
-	}
+	for i, dev := range devices {
+		if isDisk(dev.Config) || qemuDeviceClaimsHostDevice(dev.Config) {
+			continue
+		}
 
-	oldExpandedConfig := map[string]string{}
-	err = shared.DeepCopy(&vm.expandedConfig, &oldExpandedConfig)
-	if err != nil {
-		return err
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			start(i)
+		}(i)
 	}
 
-	oldLocalDevices := deviceConfig.Devices{}
-	err = shared.DeepCopy(&vm.localDevices, &oldLocalDevices)
-	if err != nil {
-		return err
+	wg.Wait()
+
+	// Record the devices' volatile config before anything else, as it's needed to stop them.
+	err := volatile.apply()
+
+	for i, dev := range devices {
+		if !started[i] {
+			continue
+		}
+
+		// Use a local function argument to ensure the current device is added to the reverter.
+		func(localDev deviceConfig.DeviceNamed) {
+			reverter.Add(func() {
+				err := vm.deviceStop(localDev.Name, localDev.Config)
+				if err != nil {
+					logger.Errorf("Failed to cleanup device %q: %v", localDev.Name, err)
+				}
+			})
+		}(dev)
 	}
 
-	oldLocalConfig := map[string]string{}
-	err = shared.DeepCopy(&vm.localConfig, &oldLocalConfig)
 	if err != nil {
-		return err
+		return nil, errors.Wrap(err, "Failed to record the volatile config of the devices")
 	}
 
-	oldProfiles := []string{}
-	err = shared.DeepCopy(&vm.profiles, &oldProfiles)
-	if err != nil {
-		return err
+	failures := []string{}
+	for i, dev := range devices {
+		if errs[i] != nil {
+			failures = append(failures, fmt.Sprintf("Failed to start device %q: %v", dev.Name, errs[i]))
+		}
 	}
 
-	oldExpiryDate := vm.expiryDate
+	if len(failures) > 0 {
+		return nil, fmt.Errorf("%s", strings.Join(failures, "; "))
+	}
 
-	// Define a function which reverts everything.  Defer this function
-	// so that it doesn't need to be explicitly called in every failing
-	// return path.  Track whether or not we want to undo the changes
-	// using a closure.
-	undoChanges := true
-	defer func() {
-		if undoChanges {
-			vm.description = oldDescription
-			vm.architecture = oldArchitecture
-			vm.ephemeral = oldEphemeral
-			vm.expandedConfig = oldExpandedConfig
-			vm.expandedDevices = oldExpandedDevices
-			vm.localConfig = oldLocalConfig
-			vm.localDevices = oldLocalDevices
-			vm.profiles = oldProfiles
-			vm.expiryDate = oldExpiryDate
+	devConfs := make([]*deviceConfig.RunConfig, 0, len(devices))
+	for _, runConf := range runConfs {
+		if runConf != nil {
+			devConfs = append(devConfs, runConf)
 		}
-	}()
+	}
 
-	// Apply the various changes.
-	vm.description = args.Description
-	vm.architecture = args.Architecture
-	vm.ephemeral = args.Ephemeral
-	vm.localConfig = args.Config
-	vm.localDevices = args.Devices
-	vm.profiles = args.Profiles
-	vm.expiryDate = args.ExpiryDate
+	return devConfs, nil
+}
 
-	// Expand the config and refresh the LXC config.
-	err = vm.expandConfig(nil)
+// deviceStart loads a new device and calls its Start() function. After processing the runtime
+// config returned from Start(), it also runs the device's Register() function irrespective of
+// whether the instance is running or not.
+func (vm *qemu) deviceStart(deviceName string, rawConfig deviceConfig.Device, isRunning bool) (*deviceConfig.RunConfig, error) {
+	d, _, err := vm.deviceLoad(deviceName, rawConfig)
 	if err != nil {
-		return errors.Wrap(err, "Expand config")
+		return nil, err
 	}
 
-	err = vm.expandDevices(nil)
+	if canHotPlug, _ := d.CanHotPlug(); isRunning && !canHotPlug {
+		return nil, fmt.Errorf("Device cannot be started when instance is running")
+	}
+
+	runConf, err := d.Start()
 	if err != nil {
-		return errors.Wrap(err, "Expand devices")
+		return nil, err
 	}
 
-	// Diff the configurations.
-	changedConfig := []string{}
-	for key := range oldExpandedConfig {
-		if oldExpandedConfig[key] != vm.expandedConfig[key] {
-			if !shared.StringInSlice(key, changedConfig) {
-				changedConfig = append(changedConfig, key)
-			}
+	// Hot-plug USB devices into the running VM.
+	if isRunning && runConf != nil && len(runConf.USBDevice) > 0 {
+		err = vm.deviceAttachUSB(runConf.USBDevice)
+		if err != nil {
+			d.Stop()
+			return nil, err
 		}
 	}
 
-	for key := range vm.expandedConfig {
-		if oldExpandedConfig[key] != vm.expandedConfig[key] {
-			if !shared.StringInSlice(key, changedConfig) {
-				changedConfig = append(changedConfig, key)
-			}
+	// Hot-plug serial ports into the running VM.
+	if isRunning && runConf != nil && len(runConf.SerialDevice) > 0 {
+		err = vm.deviceAttachSerial(runConf.SerialDevice)
+		if err != nil {
+			d.Stop()
+			return nil, err
 		}
 	}
 
-	// Diff the devices.
-	removeDevices, addDevices, updateDevices, updateDiff := oldExpandedDevices.Update(vm.expandedDevices, func(oldDevice deviceConfig.Device, newDevice deviceConfig.Device) []string {
-		// This function needs to return a list of fields that are excluded from differences
-		// between oldDevice and newDevice. The result of this is that as long as the
-		// devices are otherwise identical except for the fields returned here, then the
-		// device is considered to be being "updated" rather than "added & removed".
-		if oldDevice["type"] != newDevice["type"] || oldDevice.NICType() != newDevice.NICType() {
-			return []string{} // Device types aren't the same, so this cannot be an update.
-		}
+	return runConf, nil
+}
 
-		d, err := device.New(vm, vm.state, "", newDevice, nil, nil)
-		if err != nil {
-			return []string{} // Couldn't create Device, so this cannot be an update.
-		}
+// deviceStop loads a new device and calls its Stop() function.
+func (vm *qemu) deviceStop(deviceName string, rawConfig deviceConfig.Device) error {
+	d, _, err := vm.deviceLoad(deviceName, rawConfig)
 
-		_, updateFields := d.CanHotPlug()
-		return updateFields
-	})
+	// If deviceLoad fails with unsupported device type then return.
+	if err == device.ErrUnsupportedDevType {
+		return err
+	}
 
-	// Do some validation of the config diff.
-	err = instance.ValidConfig(vm.state.OS, vm.expandedConfig, false, true)
+	// If deviceLoad fails for any other reason then just log the error and proceed, as in the
+	// scenario that a new version of LXD has additional validation restrictions than older
+	// versions we still need to allow previously valid devices to be stopped.
 	if err != nil {
-		return errors.Wrap(err, "Invalid expanded config")
+		// If there is no device returned, then we cannot proceed, so return as error.
+		if d == nil {
+			return fmt.Errorf("Device stop validation failed for '%s': %v", deviceName, err)
+
+		}
+
+		logger.Errorf("Device stop validation failed for '%s': %v", deviceName, err)
 	}
 
-	// Do full expanded validation of the devices diff.
-	err = instance.ValidDevices(vm.state, vm.state.Cluster, vm.Type(), vm.expandedDevices, true)
-	if err != nil {
-		return errors.Wrap(err, "Invalid expanded devices")
+	return vm.deviceStopLoaded(d, vm.IsRunning())
+}
+
+// deviceStopLoaded calls the Stop() function of a loaded device, hot-unplugging it if the instance
+// is running, and runs its post stop hooks.
+func (vm *qemu) deviceStopLoaded(d device.Device, isRunning bool) error {
+	canHotPlug, _ := d.CanHotPlug()
+
+	if isRunning && !canHotPlug {
+		return fmt.Errorf("Device cannot be stopped when instance is running")
 	}
 
-	// Use the device interface to apply update changes.
-	err = vm.updateDevices(removeDevices, addDevices, updateDevices, oldExpandedDevices)
+	runConf, err := d.Stop()
 	if err != nil {
 		return err
 	}
 
-	// Update MAAS (must run after the MAC addresses have been generated).
-	updateMAAS := false
-	for _, key := range []string{"maas.subnet.ipv4", "maas.subnet.ipv6", "ipv4.address", "ipv6.address"} {
-		if shared.StringInSlice(key, updateDiff) {
-			updateMAAS = true
-			break
-		}
-	}
-
-	if !vm.IsSnapshot() && updateMAAS {
-		err = vm.maasUpdate(oldExpandedDevices.CloneNative())
+	// Hot-unplug USB devices from the running VM.
+	if isRunning && runConf != nil && len(runConf.USBDevice) > 0 {
+		err = vm.deviceDetachUSB(runConf.USBDevice)
 		if err != nil {
 			return err
 		}
 	}
 
-	if shared.StringInSlice("security.secureboot", changedConfig) {
-		// Re-generate the NVRAM.
-		err = vm.setupNvram()
+	// Hot-unplug serial ports from the running VM.
+	if isRunning && runConf != nil && len(runConf.SerialDevice) > 0 {
+		err = vm.deviceDetachSerial(runConf.SerialDevice)
 		if err != nil {
 			return err
 		}
 	}
 
-	// Finally, apply the changes to the database.
-	err = query.Retry(func() error {
-		tx, err := vm.state.Cluster.Begin()
+	if runConf != nil {
+		// Run post stop hooks irrespective of run state of instance.
+		err = vm.runHooks(runConf.PostHooks)
 		if err != nil {
 			return err
 		}
+	}
 
-		// Snapshots should update only their descriptions and expiry date.
-		if vm.IsSnapshot() {
-			err = db.InstanceSnapshotUpdate(tx, vm.id, vm.description, vm.expiryDate)
-			if err != nil {
-				tx.Rollback()
-				return errors.Wrap(err, "Snapshot update")
-			}
-		} else {
-			err = db.ContainerConfigClear(tx, vm.id)
-			if err != nil {
-				tx.Rollback()
-				return err
+	return nil
+}
 
-			}
-			err = db.ContainerConfigInsert(tx, vm.id, vm.localConfig)
+// runHooks executes the callback functions returned from a function.
+func (vm *qemu) runHooks(hooks []func() error) error {
+	// Run any post start hooks.
+	if len(hooks) > 0 {
+		for _, hook := range hooks {
+			err := hook()
 			if err != nil {
-				tx.Rollback()
-				return errors.Wrap(err, "Config insert")
+				return err
 			}
+		}
+	}
 
-			err = db.ContainerProfilesInsert(tx, vm.id, vm.project, vm.profiles)
-			if err != nil {
-				tx.Rollback()
-				return errors.Wrap(err, "Profiles insert")
-			}
+	return nil
+}
 
-			err = db.DevicesAdd(tx, "instance", int64(vm.id), vm.localDevices)
-			if err != nil {
-				tx.Rollback()
-				return errors.Wrap(err, "Device add")
-			}
+func (vm *qemu) getMonitorPath() string {
+	return filepath.Join(vm.LogPath(), "qemu.monitor")
+}
 
-			err = db.ContainerUpdate(tx, vm.id, vm.description, vm.architecture, vm.ephemeral, vm.expiryDate)
-			if err != nil {
-				tx.Rollback()
-				return errors.Wrap(err, "Instance update")
-			}
+func (vm *qemu) getNvramPath() string {
+	return filepath.Join(vm.Path(), "qemu.nvram")
+}
 
-		}
+// qemuCloudInitKeys lists the config keys making up the cloud-init config of a VM.
+var qemuCloudInitKeys = []string{"user.user-data", "user.vendor-data", "user.network-config", "user.meta-data", "boot.cloud_init_network_config"}
 
-		if err := db.TxCommit(tx); err != nil {
-			return err
-		}
-		return nil
-	})
+// generateCloudInitConfig writes the cloud-init NoCloud config files of the VM into path.
+func (vm *qemu) generateCloudInitConfig(path string) error {
+	err := os.MkdirAll(path, 0500)
 	if err != nil {
-		return errors.Wrap(err, "Failed to update database")
+		return err
 	}
 
-	err = vm.UpdateBackupFile()
-	if err != nil && !os.IsNotExist(err) {
-		return errors.Wrap(err, "Failed to write backup file")
+	if vm.expandedConfig["user.user-data"] != "" {
+		err = ioutil.WriteFile(filepath.Join(path, "user-data"), []byte(vm.expandedConfig["user.user-data"]), 0400)
+		if err != nil {
+			return err
+		}
+	} else {
+		err = ioutil.WriteFile(filepath.Join(path, "user-data"), []byte("#cloud-config\n"), 0400)
+		if err != nil {
+			return err
+		}
 	}
 
-	// Success, update the closure to mark that the changes should be kept.
-	undoChanges = false
+	if vm.expandedConfig["user.vendor-data"] != "" {
+		err = ioutil.WriteFile(filepath.Join(path, "vendor-data"), []byte(vm.expandedConfig["user.vendor-data"]), 0400)
+		if err != nil {
+			return err
+		}
+	} else {
+		err = ioutil.WriteFile(filepath.Join(path, "vendor-data"), []byte("#cloud-config\n"), 0400)
+		if err != nil {
+			return err
+		}
+	}
 
-	var endpoint string
+	networkConfig, err := vm.cloudInitNetworkConfig()
+	if err != nil {
+		return err
+	}
 
-	if vm.IsSnapshot() {
-		parentName, snapName, _ := shared.InstanceGetParentAndSnapshotName(vm.name)
-		endpoint = fmt.Sprintf("/1.0/virtual-machines/%s/snapshots/%s", parentName, snapName)
+	if networkConfig != "" {
+		err = ioutil.WriteFile(filepath.Join(path, "network-config"), []byte(networkConfig), 0400)
+		if err != nil {
+			return err
+		}
 	} else {
-		endpoint = fmt.Sprintf("/1.0/virtual-machines/%s", vm.name)
+		os.Remove(filepath.Join(path, "network-config"))
+	}
+
+	// Append any user.meta-data to our predefined meta-data config.
+	err = ioutil.WriteFile(filepath.Join(path, "meta-data"), []byte(fmt.Sprintf("instance-id: %s\nlocal-hostname: %s\n%s\n", vm.Name(), vm.Name(), vm.expandedConfig["user.meta-data"])), 0400)
+	if err != nil {
+		return err
 	}
 
-	vm.state.Events.SendLifecycle(vm.project, "virtual-machine-updated", endpoint, nil)
 	return nil
 }
 
-func (vm *qemu) updateDevices(removeDevices deviceConfig.Devices, addDevices deviceConfig.Devices, updateDevices deviceConfig.Devices, oldExpandedDevices deviceConfig.Devices) error {
-	isRunning := vm.IsRunning()
+// cloudInitNetworkConfig returns the cloud-init network-config of the VM. With
+// boot.cloud_init_network_config enabled, it's generated from the bridged and ipvlan NICs of the VM and
+// merged with user.network-config, which is otherwise used as is.
+func (vm *qemu) cloudInitNetworkConfig() (string, error) {
+	if !shared.IsTrue(vm.expandedConfig["boot.cloud_init_network_config"]) {
+		return vm.expandedConfig["user.network-config"], nil
+	}
 
-	// Remove devices in reverse order to how they were added.
-	for _, dev := range removeDevices.Reversed() {
-		if isRunning {
-			err := vm.deviceStop(dev.Name, dev.Config)
-			if err == device.ErrUnsupportedDevType {
-				continue // No point in trying to remove device below.
-			} else if err != nil {
-				return errors.Wrapf(err, "Failed to stop device %q", dev.Name)
+	ethernets := map[string]interface{}{}
+	for _, dev := range vm.expandedDevices.Sorted() {
+		if dev.Config["type"] != "nic" {
+			continue
+		}
+
+		// The IPVTAP interface of ipvlan NICs has the MAC address of their parent.
+		if dev.Config.NICType() == "ipvlan" {
+			hwaddr, err := ioutil.ReadFile(filepath.Join(qemuSysClassNet, dev.Config["parent"], "address"))
+			if err != nil {
+				return "", errors.Wrapf(err, "Failed getting the MAC address of %q", dev.Config["parent"])
 			}
+
+			ethernets[dev.Name] = qemuCloudInitIPVLANEthernet(strings.TrimSpace(string(hwaddr)), dev.Config)
+			continue
 		}
 
-		err := vm.deviceRemove(dev.Name, dev.Config)
-		if err != nil && err != device.ErrUnsupportedDevType {
-			return errors.Wrapf(err, "Failed to remove device %q", dev.Name)
+		if dev.Config.NICType() != "bridged" {
+			continue
 		}
 
-		// Check whether we are about to add the same device back with updated config and
-		// if not, or if the device type has changed, then remove all volatile keys for
-		// this device (as its an actual removal or a device type change).
-		err = vm.deviceResetVolatile(dev.Name, dev.Config, addDevices[dev.Name])
+		// Fill the MAC address.
+		m, err := vm.FillNetworkDevice(dev.Name, dev.Config)
 		if err != nil {
-			return errors.Wrapf(err, "Failed to reset volatile data for device %q", dev.Name)
+			return "", err
 		}
-	}
 
-	// Add devices in sorted order, this ensures that device mounts are added in path order.
-	for _, dev := range addDevices.Sorted() {
-		err := vm.deviceAdd(dev.Name, dev.Config)
-		if err == device.ErrUnsupportedDevType {
-			continue // No point in trying to start device below.
-		} else if err != nil {
-			return errors.Wrapf(err, "Failed to add device %q", dev.Name)
+		// Static addresses and the MTU come from the network when the NIC is on a managed one.
+		netName := m["network"]
+		if netName == "" {
+			netName = m["parent"]
 		}
 
-		if isRunning {
-			_, err := vm.deviceStart(dev.Name, dev.Config, isRunning)
-			if err != nil && err != device.ErrUnsupportedDevType {
-				return errors.Wrapf(err, "Failed to start device %q", dev.Name)
+		var netConfig map[string]string
+		n, err := network.LoadByName(vm.state, netName)
+		if err == nil {
+			netConfig = n.Config()
+
+			m, err = qemuNICStaticAllocation(m, netName, vm.Project(), vm.Name())
+			if err != nil {
+				return "", err
 			}
+		} else if err != db.ErrNoSuchObject {
+			return "", errors.Wrapf(err, "Failed loading network %q", netName)
 		}
-	}
 
-	for _, dev := range updateDevices.Sorted() {
-		err := vm.deviceUpdate(dev.Name, dev.Config, oldExpandedDevices, isRunning)
-		if err != nil && err != device.ErrUnsupportedDevType {
-			return errors.Wrapf(err, "Failed to update device %q", dev.Name)
-		}
+		ethernets[dev.Name] = qemuCloudInitEthernet(m, netConfig)
 	}
 
-	return nil
+	return qemuMergeCloudInitNetworkConfig(ethernets, vm.expandedConfig["user.network-config"])
 }
 
-// deviceUpdate loads a new device and calls its Update() function.
-func (vm *qemu) deviceUpdate(deviceName string, rawConfig deviceConfig.Device, oldDevices deviceConfig.Devices, isRunning bool) error {
-	d, _, err := vm.deviceLoad(deviceName, rawConfig)
-	if err != nil {
-		return err
-	}
+// qemuNICStaticAllocation returns a copy of a NIC config with the addresses statically allocated to it
+// on its managed network, including those kept in the dnsmasq config for IP filtering. This makes the
+// generated cloud-init config match the DHCP reservation of the NIC.
+func qemuNICStaticAllocation(m deviceConfig.Device, netName string, projectName string, instanceName string) (deviceConfig.Device, error) {
+	dnsmasq.ConfigMutex.Lock()
+	defer dnsmasq.ConfigMutex.Unlock()
 
-	err = d.Update(oldDevices, isRunning)
+	ipv4Address, ipv6Address, err := dnsmasq.StaticAllocation(netName, projectName, instanceName, m)
 	if err != nil {
-		return err
+		return nil, errors.Wrapf(err, "Failed getting the static allocation of network %q", netName)
 	}
 
-	return nil
+	m = m.Clone()
+	m["ipv4.address"] = ipv4Address
+	m["ipv6.address"] = ipv6Address
+
+	return m, nil
 }
 
-// deviceResetVolatile resets a device's volatile data when its removed or updated in such a way
-// that it is removed then added immediately afterwards.
-func (vm *qemu) deviceResetVolatile(devName string, oldConfig, newConfig deviceConfig.Device) error {
-	volatileClear := make(map[string]string)
-	devicePrefix := fmt.Sprintf("volatile.%s.", devName)
+// qemuCloudInitEthernet returns the cloud-init v2 config of a bridged NIC, matched by its MAC address.
+// The static addresses of the NIC are configured along with the gateway and DNS server of its network,
+// otherwise DHCP is used. netConfig is nil for unmanaged bridges.
+func qemuCloudInitEthernet(m deviceConfig.Device, netConfig map[string]string) map[string]interface{} {
+	ethernet := map[string]interface{}{
+		"match": map[string]interface{}{"macaddress": strings.ToLower(m["hwaddr"])},
+	}
 
-	// If the device type has changed, remove all old volatile keys.
-	// This will occur if the newConfig is empty (i.e the device is actually being removed) or
-	// if the device type is being changed but keeping the same name.
-	if newConfig["type"] != oldConfig["type"] || newConfig.NICType() != oldConfig.NICType() {
-		for k := range vm.localConfig {
-			if !strings.HasPrefix(k, devicePrefix) {
-				continue
-			}
+	mtu := m["mtu"]
+	if mtu == "" {
+		mtu = netConfig["bridge.mtu"]
+	}
 
-			volatileClear[k] = ""
+	if mtu != "" {
+		mtuInt, err := strconv.Atoi(mtu)
+		if err == nil {
+			ethernet["mtu"] = mtuInt
 		}
-
-		return vm.VolatileSet(volatileClear)
 	}
 
-	// If the device type remains the same, then just remove any volatile keys that have
-	// the same key name present in the new config (i.e the new config is replacing the
-	// old volatile key).
-	for k := range vm.localConfig {
-		if !strings.HasPrefix(k, devicePrefix) {
+	addresses := []string{}
+	nameservers := []string{}
+	for _, family := range []string{"ipv4", "ipv6"} {
+		ip := net.ParseIP(m[fmt.Sprintf("%s.address", family)])
+		netIP, subnet, err := net.ParseCIDR(netConfig[fmt.Sprintf("%s.address", family)])
+		if ip == nil || err != nil {
 			continue
 		}
 
-		devKey := strings.TrimPrefix(k, devicePrefix)
-		if _, found := newConfig[devKey]; found {
-			volatileClear[k] = ""
+		ones, _ := subnet.Mask.Size()
+		addresses = append(addresses, fmt.Sprintf("%s/%d", ip.String(), ones))
+		nameservers = append(nameservers, netIP.String())
+		if family == "ipv4" {
+			ethernet["gateway4"] = netIP.String()
+		} else {
+			ethernet["gateway6"] = netIP.String()
 		}
 	}
 
-	return vm.VolatileSet(volatileClear)
-}
+	if len(addresses) > 0 {
+		ethernet["addresses"] = addresses
 
-func (vm *qemu) removeUnixDevices() error {
-	// Check that we indeed have devices to remove.
-	if !shared.PathExists(vm.DevicesPath()) {
-		return nil
-	}
+		domain := netConfig["dns.domain"]
+		if domain == "" {
+			domain = "lxd"
+		}
 
-	// Load the directory listing.
-	dents, err := ioutil.ReadDir(vm.DevicesPath())
-	if err != nil {
-		return err
+		ethernet["nameservers"] = map[string]interface{}{
+			"addresses": nameservers,
+			"search":    []string{domain},
+		}
 	}
 
-	// Go through all the unix devices.
-	for _, f := range dents {
-		// Skip non-Unix devices.
-		if !strings.HasPrefix(f.Name(), "forkmknod.unix.") && !strings.HasPrefix(f.Name(), "unix.") && !strings.HasPrefix(f.Name(), "infiniband.unix.") {
-			continue
-		}
+	if ethernet["gateway4"] == nil {
+		ethernet["dhcp4"] = true
+	}
 
-		// Remove the entry
-		devicePath := filepath.Join(vm.DevicesPath(), f.Name())
-		err := os.Remove(devicePath)
-		if err != nil {
-			logger.Error("Failed removing unix device", log.Ctx{"err": err, "path": devicePath})
-		}
+	if ethernet["gateway6"] == nil && netConfig != nil && shared.IsTrue(netConfig["ipv6.dhcp.stateful"]) {
+		ethernet["dhcp6"] = true
 	}
 
-	return nil
+	return ethernet
 }
 
-func (vm *qemu) removeDiskDevices() error {
-	// Check that we indeed have devices to remove.vm
-	if !shared.PathExists(vm.DevicesPath()) {
-		return nil
+// qemuCloudInitIPVLANEthernet returns the cloud-init v2 config of an ipvlan NIC, matched by its MAC
+// address. Its addresses are configured as host routes, along with default routes through the
+// interface as IPVLAN in L3S mode routes the traffic of the VM on the host.
+func qemuCloudInitIPVLANEthernet(hwaddr string, m deviceConfig.Device) map[string]interface{} {
+	ethernet := map[string]interface{}{
+		"match": map[string]interface{}{"macaddress": strings.ToLower(hwaddr)},
 	}
 
-	// Load the directory listing.
-	dents, err := ioutil.ReadDir(vm.DevicesPath())
-	if err != nil {
-		return err
+	if m["mtu"] != "" {
+		mtuInt, err := strconv.Atoi(m["mtu"])
+		if err == nil {
+			ethernet["mtu"] = mtuInt
+		}
 	}
 
-	// Go through all the unix devices
-	for _, f := range dents {
-		// Skip non-disk devices
-		if !strings.HasPrefix(f.Name(), "disk.") {
+	addresses := []string{}
+	routes := []interface{}{}
+	for _, family := range []string{"ipv4", "ipv6"} {
+		value := m[fmt.Sprintf("%s.address", family)]
+		if value == "" {
 			continue
 		}
 
-		// Always try to unmount the host side
-		_ = unix.Unmount(filepath.Join(vm.DevicesPath(), f.Name()), unix.MNT_DETACH)
+		prefix, defaultRoute := 32, "0.0.0.0/0"
+		if family == "ipv6" {
+			prefix, defaultRoute = 128, "::/0"
+		}
 
-		// Remove the entry
-		diskPath := filepath.Join(vm.DevicesPath(), f.Name())
-		err := os.Remove(diskPath)
-		if err != nil {
-			logger.Error("Failed to remove disk device path", log.Ctx{"err": err, "path": diskPath})
+		for _, addr := range strings.Split(value, ",") {
+			addresses = append(addresses, fmt.Sprintf("%s/%d", strings.TrimSpace(addr), prefix))
 		}
+
+		routes = append(routes, map[string]interface{}{"to": defaultRoute, "scope": "link"})
 	}
 
-	return nil
+	if len(addresses) > 0 {
+		ethernet["addresses"] = addresses
+		ethernet["routes"] = routes
+	}
+
+	return ethernet
 }
 
-func (vm *qemu) cleanup() {
-	// Unmount any leftovers
-	vm.removeUnixDevices()
-	vm.removeDiskDevices()
+// qemuMergeCloudInitNetworkConfig merges the user supplied cloud-init network config into a v2 one
+// made of the generated ethernets. The ethernets of the user config replace the generated ones of the
+// same name or MAC address and its other keys take precedence. A user config in another format than v2
+// is used as is.
+func qemuMergeCloudInitNetworkConfig(ethernets map[string]interface{}, userConfig string) (string, error) {
+	if len(ethernets) == 0 {
+		return userConfig, nil
+	}
 
-	// Remove the devices path
-	os.Remove(vm.DevicesPath())
+	merged := map[string]interface{}{"version": 2}
+	if userConfig != "" {
+		user := map[string]interface{}{}
+		err := yaml.Unmarshal([]byte(userConfig), &user)
+		if err != nil {
+			return "", errors.Wrap(err, "Failed parsing user.network-config")
+		}
 
-	// Remove the shmounts path
-	os.RemoveAll(vm.ShmountsPath())
-}
+		// The config may be nested under a network key.
+		nested := qemuYAMLMap(user["network"])
+		if nested != nil {
+			user = nested
+		}
 
-// cleanupDevices performs any needed device cleanup steps when instance is stopped.
-func (vm *qemu) cleanupDevices() {
-	for _, dev := range vm.expandedDevices.Sorted() {
-		// Use the device interface if device supports it.
-		err := vm.deviceStop(dev.Name, dev.Config)
-		if err == device.ErrUnsupportedDevType {
-			continue
-		} else if err != nil {
-			logger.Errorf("Failed to stop device '%s': %v", dev.Name, err)
+		if fmt.Sprintf("%v", user["version"]) != "2" {
+			return userConfig, nil
 		}
-	}
-}
 
-func (vm *qemu) init() error {
-	// Compute the expanded config and device list.
-	err := vm.expandConfig(nil)
-	if err != nil {
-		return err
+		for key, value := range user {
+			merged[key] = value
+		}
+
+		for name, userEthernet := range qemuYAMLMap(user["ethernets"]) {
+			userMAC := qemuCloudInitMAC(userEthernet)
+			for genName, genEthernet := range ethernets {
+				if genName == name || (userMAC != "" && qemuCloudInitMAC(genEthernet) == userMAC) {
+					delete(ethernets, genName)
+				}
+			}
+
+			ethernets[name] = userEthernet
+		}
 	}
 
-	err = vm.expandDevices(nil)
+	merged["ethernets"] = ethernets
+
+	out, err := yaml.Marshal(merged)
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	return nil
+	return string(out), nil
 }
 
-// Delete the instance.
-func (vm *qemu) Delete() error {
-	ctxMap := log.Ctx{
-		"project":   vm.project,
-		"name":      vm.name,
-		"created":   vm.creationDate,
-		"ephemeral": vm.ephemeral,
-		"used":      vm.lastUsedDate}
+// qemuCloudInitMAC returns the lower case MAC address an ethernet of a cloud-init v2 config matches on.
+func qemuCloudInitMAC(ethernet interface{}) string {
+	mac, _ := qemuYAMLMap(qemuYAMLMap(ethernet)["match"])["macaddress"].(string)
+	return strings.ToLower(mac)
+}
 
-	logger.Info("Deleting instance", ctxMap)
+// qemuYAMLMap returns a YAML mapping with string keys, or nil if value isn't a mapping.
+func qemuYAMLMap(value interface{}) map[string]interface{} {
+	switch m := value.(type) {
+	case map[string]interface{}:
+		return m
+	case map[interface{}]interface{}:
+		out := make(map[string]interface{}, len(m))
+		for k, v := range m {
+			out[fmt.Sprintf("%v", k)] = v
+		}
 
-	// Check if instance is delete protected.
-	if shared.IsTrue(vm.expandedConfig["security.protection.delete"]) && !vm.IsSnapshot() {
-		return fmt.Errorf("Instance is protected")
+		return out
 	}
 
-	// Check if we're dealing with "lxd import".
-	// TODO consider lxd import detection for VMs.
-	isImport := false
+	return nil
+}
 
-	// Attempt to initialize storage interface for the instance.
-	pool, err := vm.getStoragePool()
-	if err != nil && err != db.ErrNoSuchObject {
-		return err
-	} else if pool != nil {
-		if vm.IsSnapshot() {
-			if !isImport {
-				// Remove snapshot volume and database record.
-				err = pool.DeleteInstanceSnapshot(vm, nil)
-				if err != nil {
-					return err
-				}
-			}
-		} else {
-			// Remove all snapshots by initialising each snapshot as an Instance and
-			// calling its Delete function.
-			err := instance.DeleteSnapshots(vm.state, vm.Project(), vm.Name())
-			if err != nil {
-				return err
-			}
+// cloudInitISOPath returns the path of the cloud-init NoCloud ISO.
+func (vm *qemu) cloudInitISOPath() string {
+	return filepath.Join(vm.Path(), "cloud-init.iso")
+}
 
-			if !isImport {
-				// Remove the storage volume, snapshot volumes and database records.
-				err = pool.DeleteInstance(vm, nil)
-				if err != nil {
-					return err
-				}
-			}
+// generateCloudInitISO builds the cloud-init NoCloud ISO. The "cidata" volume label is what
+// cloud-init looks for when detecting the drive. The ISO is built next to the existing one and then
+// renamed over it, so that a running VM keeps reading consistent media until it is swapped.
+func (vm *qemu) generateCloudInitISO() error {
+	var isoTool string
+	for _, name := range []string{"genisoimage", "mkisofs", "xorriso"} {
+		path, err := exec.LookPath(name)
+		if err == nil {
+			isoTool = path
+			break
 		}
 	}
 
-	// Perform other cleanup steps if not snapshot.
-	if !vm.IsSnapshot() {
-		// Remove all backups.
-		backups, err := vm.Backups()
-		if err != nil {
-			return err
-		}
-
-		for _, backup := range backups {
-			err = backup.Delete()
-			if err != nil {
-				return err
-			}
-		}
-
-		// Delete the MAAS entry.
-		err = vm.maasDelete()
-		if err != nil {
-			logger.Error("Failed deleting instance MAAS record", log.Ctx{"project": vm.Project(), "instance": vm.Name(), "err": err})
-			return err
-		}
-
-		// Run device removal function for each device.
-		for k, m := range vm.expandedDevices {
-			err = vm.deviceRemove(k, m)
-			if err != nil && err != device.ErrUnsupportedDevType {
-				return errors.Wrapf(err, "Failed to remove device '%s'", k)
-			}
-		}
-
-		// Clean things up.
-		vm.cleanup()
+	if isoTool == "" {
+		return fmt.Errorf("Unable to find genisoimage, mkisofs or xorriso to build the cloud-init ISO")
 	}
 
-	// Remove the database record of the instance or snapshot instance.
-	if err := vm.state.Cluster.InstanceRemove(vm.Project(), vm.Name()); err != nil {
-		logger.Error("Failed deleting instance entry", log.Ctx{"project": vm.Project(), "instance": vm.Name(), "err": err})
+	scratchDir := filepath.Join(vm.Path(), "cloud-init")
+	os.RemoveAll(scratchDir)
+	defer os.RemoveAll(scratchDir)
+
+	err := vm.generateCloudInitConfig(scratchDir)
+	if err != nil {
 		return err
 	}
 
-	logger.Info("Deleted instance", ctxMap)
+	isoPath := vm.cloudInitISOPath()
+	args := []string{"-R", "-J", "-V", "cidata", "-o", isoPath + ".new", scratchDir}
+	if filepath.Base(isoTool) == "xorriso" {
+		args = append([]string{"-as", "mkisofs"}, args...)
+	}
 
-	if vm.IsSnapshot() {
-		vm.state.Events.SendLifecycle(vm.project, "virtual-machine-snapshot-deleted",
-			fmt.Sprintf("/1.0/virtual-machines/%s", vm.name), map[string]interface{}{
-				"snapshot_name": vm.name,
-			})
-	} else {
-		vm.state.Events.SendLifecycle(vm.project, "virtual-machine-deleted",
-			fmt.Sprintf("/1.0/virtual-machines/%s", vm.name), nil)
+	_, err = shared.RunCommand(isoTool, args...)
+	if err != nil {
+		os.Remove(isoPath + ".new")
+		return errors.Wrap(err, "Failed building the cloud-init ISO")
 	}
 
-	return nil
+	return os.Rename(isoPath+".new", isoPath)
 }
 
-func (vm *qemu) deviceAdd(deviceName string, rawConfig deviceConfig.Device) error {
-	d, _, err := vm.deviceLoad(deviceName, rawConfig)
+// updateCloudInitISO re-generates the cloud-init NoCloud ISO and swaps it into the running VM.
+func (vm *qemu) updateCloudInitISO() error {
+	err := vm.generateCloudInitISO()
 	if err != nil {
 		return err
 	}
 
-	return d.Add()
-}
-
-func (vm *qemu) deviceRemove(deviceName string, rawConfig deviceConfig.Device) error {
-	d, _, err := vm.deviceLoad(deviceName, rawConfig)
-
-	// If deviceLoad fails with unsupported device type then return.
-	if err == device.ErrUnsupportedDevType {
+	monitor, err := vm.getMonitor()
+	if err != nil {
 		return err
 	}
 
-	// If deviceLoad fails for any other reason then just log the error and proceed, as in the
-	// scenario that a new version of LXD has additional validation restrictions than older
-	// versions we still need to allow previously valid devices to be stopped.
+	// As qemu runs chrooted, the new media is passed as a file descriptor.
+	f, err := os.Open(vm.cloudInitISOPath())
 	if err != nil {
-		logger.Errorf("Device remove validation failed for '%s': %v", deviceName, err)
+		return errors.Wrap(err, "Failed opening the cloud-init ISO")
 	}
+	defer f.Close()
 
-	return d.Remove()
+	return monitor.ChangeMedia("qemu_cloud_init", f)
 }
 
-// Export publishes the instance.
-func (vm *qemu) Export(w io.Writer, properties map[string]string) error {
-	ctxMap := log.Ctx{
-		"project":   vm.project,
-		"name":      vm.name,
-		"created":   vm.creationDate,
-		"ephemeral": vm.ephemeral,
-		"used":      vm.lastUsedDate}
+// generateConfigShare generates the config share directory that will be exported to the VM via
+// a 9P share. Due to the unknown size of templates inside the images this directory is created
+// inside the VM's config volume so that it can be restricted by quota.
+func (vm *qemu) generateConfigShare() error {
+	// Mount the instance's config volume if needed.
+	ourMount, err := vm.mount()
+	if err != nil {
+		return err
+	}
 
-	if vm.IsRunning() {
-		return fmt.Errorf("Cannot export a running instance as an image")
+	if ourMount {
+		defer vm.unmount()
 	}
 
-	logger.Info("Exporting instance", ctxMap)
+	// The config share is generated in a staging directory and then synced to the config drive dir,
+	// only replacing the files that changed so that restarts don't rewrite it all.
+	configDrivePath := filepath.Join(vm.Path(), "config.new")
 
-	// Start the storage.
-	ourStart, err := vm.mount()
+	// Create config drive staging dir.
+	os.RemoveAll(configDrivePath)
+	err = os.MkdirAll(configDrivePath, 0500)
 	if err != nil {
-		logger.Error("Failed exporting instance", ctxMap)
 		return err
 	}
-	if ourStart {
-		defer vm.unmount()
-	}
+	defer os.RemoveAll(configDrivePath)
 
-	// Create the tarball.
-	ctw := containerwriter.NewContainerTarWriter(w, nil)
-
-	// Path inside the tar image is the pathname starting after cDir.
-	cDir := vm.Path()
-	offset := len(cDir) + 1
+	// Generate the cloud-init config.
+	err = vm.generateCloudInitConfig(filepath.Join(configDrivePath, "cloud-init"))
+	if err != nil {
+		return err
+	}
 
-	writeToTar := func(path string, fi os.FileInfo, err error) error {
+	// Also provide it as a NoCloud ISO for images which don't use the config share.
+	if shared.IsTrue(vm.expandedConfig["boot.cloud_init_iso"]) {
+		err = vm.generateCloudInitISO()
 		if err != nil {
 			return err
 		}
+	}
 
-		err = ctw.WriteFile(offset, path, fi)
-		if err != nil {
-			logger.Debugf("Error tarring up %s: %s", path, err)
-			return err
-		}
+	agentCert, agentKey, clientCert, _, err := vm.generateAgentCert()
+	if err != nil {
+		return err
+	}
 
-		return nil
+	err = ioutil.WriteFile(filepath.Join(configDrivePath, "server.crt"), []byte(clientCert), 0400)
+	if err != nil {
+		return err
 	}
 
-	// Look for metadata.yaml.
-	fnam := filepath.Join(cDir, "metadata.yaml")
-	if !shared.PathExists(fnam) {
-		// Generate a new metadata.yaml.
-		tempDir, err := ioutil.TempDir("", "lxd_lxd_metadata_")
+	err = ioutil.WriteFile(filepath.Join(configDrivePath, "agent.crt"), []byte(agentCert), 0400)
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(filepath.Join(configDrivePath, "agent.key"), []byte(agentKey), 0400)
+	if err != nil {
+		return err
+	}
+
+	// Systemd units.
+	err = os.MkdirAll(filepath.Join(configDrivePath, "systemd"), 0500)
+	if err != nil {
+		return err
+	}
+
+	lxdAgentServiceUnit := `[Unit]
+Description=LXD - agent
+Documentation=https://linuxcontainers.org/lxd
+ConditionPathExists=/dev/virtio-ports/org.linuxcontainers.lxd
+Requires=lxd-agent-9p.service
+After=lxd-agent-9p.service
+Before=cloud-init.target
+
+[Service]
+Type=simple
+WorkingDirectory=/run/lxd_config/9p
+ExecStart=/run/lxd_config/9p/lxd-agent
+
+[Install]
+WantedBy=multi-user.target
+`
+
+	err = ioutil.WriteFile(filepath.Join(configDrivePath, "systemd", "lxd-agent.service"), []byte(lxdAgentServiceUnit), 0400)
+	if err != nil {
+		return err
+	}
+
+	lxdConfigShareMountUnit := `[Unit]
+Description=LXD - agent - 9p mount
+Documentation=https://linuxcontainers.org/lxd
+ConditionPathExists=/dev/virtio-ports/org.linuxcontainers.lxd
+
+[Service]
+Type=oneshot
+RemainAfterExit=yes
+ExecStartPre=-/sbin/modprobe 9pnet_virtio
+ExecStartPre=/bin/mkdir -p /run/lxd_config/9p
+ExecStartPre=/bin/chmod 0700 /run/lxd_config/
+# The share presents the host owner of its files, access=0 restricts it to root whichever user runs qemu.
+ExecStart=/bin/mount -t 9p config /run/lxd_config/9p -o access=0,trans=virtio
+
+[Install]
+WantedBy=multi-user.target
+`
+
+	err = ioutil.WriteFile(filepath.Join(configDrivePath, "systemd", "lxd-agent-9p.service"), []byte(lxdConfigShareMountUnit), 0400)
+	if err != nil {
+		return err
+	}
+
+	// Install script for manual installs.
+	lxdConfigShareInstall := `#!/bin/sh
+if [ ! -e "systemd" ] || [ ! -e "lxd-agent" ]; then
+    echo "This script must be run from within the 9p mount"
+    exit 1
+fi
+
+if [ ! -e "/lib/systemd/system" ]; then
+    echo "This script only works on systemd systems"
+    exit 1
+fi
+
+cp systemd/lxd-agent.service /lib/systemd/system/
+cp systemd/lxd-agent-9p.service /lib/systemd/system/
+systemctl daemon-reload
+systemctl enable lxd-agent.service lxd-agent-9p.service
+
+echo ""
+echo "LXD agent has been installed, reboot to confirm setup."
+echo "To start it now, unmount this filesystem and run: systemctl start lxd-agent-9p lxd-agent"
+`
+
+	err = ioutil.WriteFile(filepath.Join(configDrivePath, "install.sh"), []byte(lxdConfigShareInstall), 0700)
+	if err != nil {
+		return err
+	}
+
+	// Templated files.
+	err = os.MkdirAll(filepath.Join(configDrivePath, "files"), 0500)
+	if err != nil {
+		return err
+	}
+
+	// Template anything that needs templating.
+	key := "volatile.apply_template"
+	if vm.localConfig[key] != "" {
+		// Run any template that needs running.
+		err = vm.templateApplyNow(vm.localConfig[key], filepath.Join(configDrivePath, "files"))
 		if err != nil {
-			ctw.Close()
-			logger.Error("Failed exporting instance", ctxMap)
 			return err
 		}
-		defer os.RemoveAll(tempDir)
 
-		// Get the instance's architecture.
-		var arch string
-		if vm.IsSnapshot() {
-			parentName, _, _ := shared.InstanceGetParentAndSnapshotName(vm.name)
-			parent, err := instance.LoadByProjectAndName(vm.state, vm.project, parentName)
-			if err != nil {
-				ctw.Close()
-				logger.Error("Failed exporting instance", ctxMap)
-				return err
-			}
+		// Remove the volatile key from the DB.
+		err := vm.state.Cluster.ContainerConfigRemove(vm.id, key)
+		if err != nil {
+			return err
+		}
+	}
 
-			arch, _ = osarch.ArchitectureName(parent.Architecture())
-		} else {
-			arch, _ = osarch.ArchitectureName(vm.architecture)
+	err = vm.templateApplyNow("start", filepath.Join(configDrivePath, "files"))
+	if err != nil {
+		return err
+	}
+
+	// Copy the template metadata itself too.
+	metaPath := filepath.Join(vm.Path(), "metadata.yaml")
+	if shared.PathExists(metaPath) {
+		err = shared.FileCopy(metaPath, filepath.Join(configDrivePath, "files/metadata.yaml"))
+		if err != nil {
+			return err
 		}
+	}
 
-		if arch == "" {
-			arch, err = osarch.ArchitectureName(vm.state.OS.Architectures[0])
+	// Apply the changes to the config drive dir, leaving the agent which is handled below.
+	configSharePath := filepath.Join(vm.Path(), "config")
+	err = qemuSyncDir(configDrivePath, configSharePath, []string{"lxd-agent"})
+	if err != nil {
+		return errors.Wrap(err, "Failed updating the config share")
+	}
+
+	// Add the VM agent. As it's large and hashing it costs about as much as copying it, it's only
+	// copied when the size or modification time of the existing copy differ, the copy being given the
+	// modification time of the original.
+	agentPath := filepath.Join(configSharePath, "lxd-agent")
+	path, err := exec.LookPath("lxd-agent")
+	if err != nil {
+		logger.Warnf("lxd-agent not found, skipping its inclusion in the VM config drive: %v", err)
+		os.Remove(agentPath)
+		return nil
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	agentInfo, err := os.Stat(agentPath)
+	if err != nil || agentInfo.Size() != info.Size() || !agentInfo.ModTime().Equal(info.ModTime()) {
+		// Install agent into config drive dir if found.
+		err = shared.FileCopy(path, agentPath)
+		if err != nil {
+			return err
+		}
+
+		err = os.Chtimes(agentPath, info.ModTime(), info.ModTime())
+		if err != nil {
+			return err
+		}
+	}
+
+	err = os.Chmod(agentPath, 0500)
+	if err != nil {
+		return err
+	}
+
+	err = os.Chown(agentPath, 0, 0)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// qemuFileHash returns the SHA256 hash of a file's content.
+func qemuFileHash(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	_, err = io.Copy(hash, f)
+	if err != nil {
+		return nil, err
+	}
+
+	return hash.Sum(nil), nil
+}
+
+// qemuSameContent returns whether two files have the same content, a missing file never matching.
+func qemuSameContent(path string, otherPath string) (bool, error) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return false, err
+	}
+
+	otherInfo, err := os.Lstat(otherPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	if !info.Mode().IsRegular() || !otherInfo.Mode().IsRegular() || info.Size() != otherInfo.Size() {
+		return false, nil
+	}
+
+	hash, err := qemuFileHash(path)
+	if err != nil {
+		return false, err
+	}
+
+	otherHash, err := qemuFileHash(otherPath)
+	if err != nil {
+		return false, err
+	}
+
+	return bytes.Equal(hash, otherHash), nil
+}
+
+// qemuSyncDir makes the content of the target directory the same as the source one. The files whose
+// content changed are moved over from the source, those that are gone are removed and the unchanged
+// ones are left untouched. The entries of the target directory in keep are left alone.
+func qemuSyncDir(srcDir string, dstDir string, keep []string) error {
+	err := os.MkdirAll(dstDir, 0500)
+	if err != nil {
+		return err
+	}
+
+	// Remove the entries that are gone, or changed between file and directory.
+	err = filepath.Walk(dstDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		relPath, err := filepath.Rel(dstDir, path)
+		if err != nil {
+			return err
+		}
+
+		if relPath == "." || shared.StringInSlice(relPath, keep) {
+			return nil
+		}
+
+		srcInfo, err := os.Lstat(filepath.Join(srcDir, relPath))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		if err == nil && srcInfo.IsDir() == info.IsDir() {
+			return nil
+		}
+
+		err = os.RemoveAll(path)
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			return filepath.SkipDir
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Move the new and changed files over.
+	return filepath.Walk(srcDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		relPath, err := filepath.Rel(srcDir, path)
+		if err != nil {
+			return err
+		}
+
+		dstPath := filepath.Join(dstDir, relPath)
+		if info.IsDir() {
+			err = os.MkdirAll(dstPath, info.Mode().Perm())
 			if err != nil {
-				logger.Error("Failed exporting instance", ctxMap)
 				return err
 			}
+
+			return os.Chmod(dstPath, info.Mode().Perm())
 		}
 
-		// Fill in the metadata.
-		meta := api.ImageMetadata{}
-		meta.Architecture = arch
-		meta.CreationDate = time.Now().UTC().Unix()
-		meta.Properties = properties
+		same, err := qemuSameContent(path, dstPath)
+		if err != nil {
+			return err
+		}
+
+		if same {
+			return os.Chmod(dstPath, info.Mode().Perm())
+		}
+
+		return os.Rename(path, dstPath)
+	})
+}
+
+func (vm *qemu) templateApplyNow(trigger string, path string) error {
+	// If there's no metadata, just return.
+	fname := filepath.Join(vm.Path(), "metadata.yaml")
+	if !shared.PathExists(fname) {
+		return nil
+	}
+
+	// Parse the metadata.
+	content, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return errors.Wrap(err, "Failed to read metadata")
+	}
+
+	metadata := new(api.ImageMetadata)
+	err = yaml.Unmarshal(content, &metadata)
+	if err != nil {
+		return errors.Wrapf(err, "Could not parse %s", fname)
+	}
+
+	// Figure out the instance architecture.
+	arch, err := osarch.ArchitectureName(vm.architecture)
+	if err != nil {
+		arch, err = osarch.ArchitectureName(vm.state.OS.Architectures[0])
+		if err != nil {
+			return errors.Wrap(err, "Failed to detect system architecture")
+		}
+	}
+
+	// Generate the container metadata.
+	instanceMeta := make(map[string]string)
+	instanceMeta["name"] = vm.name
+	instanceMeta["architecture"] = arch
+
+	if vm.ephemeral {
+		instanceMeta["ephemeral"] = "true"
+	} else {
+		instanceMeta["ephemeral"] = "false"
+	}
+
+	// Go through the templates.
+	for tplPath, tpl := range metadata.Templates {
+		var w *os.File
+
+		// Check if the template should be applied now.
+		found := false
+		for _, tplTrigger := range tpl.When {
+			if tplTrigger == trigger {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			continue
+		}
+
+		// Create the file itself.
+		w, err = os.Create(filepath.Join(path, fmt.Sprintf("%s.out", tpl.Template)))
+		if err != nil {
+			return err
+		}
+
+		// Fix ownership and mode.
+		w.Chmod(0644)
+		defer w.Close()
+
+		// Read the template.
+		tplString, err := ioutil.ReadFile(filepath.Join(vm.TemplatesPath(), tpl.Template))
+		if err != nil {
+			return errors.Wrap(err, "Failed to read template file")
+		}
+
+		// Restrict filesystem access to within the container's rootfs.
+		tplSet := pongo2.NewSet(fmt.Sprintf("%s-%s", vm.name, tpl.Template), pongoTemplate.ChrootLoader{Path: vm.TemplatesPath()})
+		tplRender, err := tplSet.FromString("{% autoescape off %}" + string(tplString) + "{% endautoescape %}")
+		if err != nil {
+			return errors.Wrap(err, "Failed to render template")
+		}
+
+		configGet := func(confKey, confDefault *pongo2.Value) *pongo2.Value {
+			val, ok := vm.expandedConfig[confKey.String()]
+			if !ok {
+				return confDefault
+			}
+
+			return pongo2.AsValue(strings.TrimRight(val, "\r\n"))
+		}
+
+		// Render the template.
+		tplRender.ExecuteWriter(pongo2.Context{"trigger": trigger,
+			"path":       tplPath,
+			"instance":   instanceMeta,
+			"container":  instanceMeta, // FIXME: remove once most images have moved away.
+			"config":     vm.expandedConfig,
+			"devices":    vm.expandedDevices,
+			"properties": tpl.Properties,
+			"config_get": configGet}, w)
+	}
+
+	return nil
+}
+
+// deviceBootPriorities returns a map keyed on device name containing the boot index to use.
+// Qemu tries to boot devices in order of boot index (lowest first). The device set in the instance's
+// boot.once key, which must be a disk or nic device, is always tried first.
+func (vm *qemu) deviceBootPriorities() (map[string]int, error) {
+	type devicePrios struct {
+		Name     string
+		BootPrio uint32
+	}
+
+	bootOnce := vm.localConfig["boot.once"]
+	devices := []devicePrios{}
+
+	for devName, devConf := range vm.expandedDevices {
+		if devConf["type"] != "disk" && devConf["type"] != "nic" {
+			continue
+		}
+
+		bootPrio := uint32(0) // Default to lowest priority.
+		if devConf["boot.priority"] != "" {
+			prio, err := strconv.ParseInt(devConf["boot.priority"], 10, 32)
+			if err != nil {
+				return nil, errors.Wrapf(err, "Invalid boot.priority for device %q", devName)
+			}
+			bootPrio = uint32(prio)
+		} else if devConf["path"] == "/" {
+			bootPrio = 1 // Set boot priority of root disk higher than any device without a boot prio.
+		}
+
+		devices = append(devices, devicePrios{Name: devName, BootPrio: bootPrio})
+	}
+
+	sort.SliceStable(devices, func(i, j int) bool {
+		if devices[i].Name == bootOnce || devices[j].Name == bootOnce {
+			return devices[i].Name == bootOnce
+		}
+
+		return devices[i].BootPrio > devices[j].BootPrio
+	})
+
+	if bootOnce != "" && (len(devices) == 0 || devices[0].Name != bootOnce) {
+		return nil, fmt.Errorf("Invalid boot.once, %q isn't a disk or nic device of the instance", bootOnce)
+	}
+
+	sortedDevs := make(map[string]int, len(devices))
+	for bootIndex, dev := range devices {
+		sortedDevs[dev.Name] = bootIndex
+	}
+
+	return sortedDevs, nil
+}
+
+// generateQemuConfigFile writes the qemu config file and returns its location.
+// It writes the config file inside the VM's log path.
+func (vm *qemu) generateQemuConfigFile(devConfs []*deviceConfig.RunConfig, fdFiles *[]string) (string, error) {
+	conf, agentMounts, err := vm.generateQemuConfig(devConfs, fdFiles, false)
+	if err != nil {
+		return "", err
+	}
+
+	// Write the agent mount config.
+	agentMountJSON, err := json.Marshal(agentMounts)
+	if err != nil {
+		return "", errors.Wrapf(err, "Failed marshalling agent mounts to JSON")
+	}
+
+	agentMountFile := filepath.Join(vm.Path(), "config", "agent-mounts.json")
+	err = ioutil.WriteFile(agentMountFile, agentMountJSON, 0400)
+	if err != nil {
+		return "", errors.Wrapf(err, "Failed writing agent mounts file")
+	}
+
+	// Write the config file to disk.
+	configPath := filepath.Join(vm.LogPath(), "qemu.conf")
+	return configPath, ioutil.WriteFile(configPath, []byte(conf), 0640)
+}
+
+// generateQemuConfig returns the qemu config for the given device run configs, along with the mounts
+// the agent is to perform inside the VM. Nothing is written to disk.
+func (vm *qemu) generateQemuConfig(devConfs []*deviceConfig.RunConfig, fdFiles *[]string, dryRun bool) (string, []instancetype.VMAgentMount, error) {
+	var sb *strings.Builder = &strings.Builder{}
+
+	err := qemuBase.Execute(sb, map[string]interface{}{
+		"architecture":     vm.architectureName,
+		"ringbufSizeBytes": qmp.RingbufSize,
+		"consoleLogPath":   vm.ConsoleBufferLogPath(),
+	})
+	if err != nil {
+		return "", nil, err
+	}
+
+	rawArgs, err := shared.SplitShellArgs(vm.expandedConfig["raw.qemu"])
+	if err != nil {
+		return "", nil, errors.Wrap(err, "Invalid raw.qemu")
+	}
+
+	rawOverrides := qemuRawOverrides(rawArgs)
+
+	// Now add the dynamic parts of the config, leaving out what raw.qemu overrides.
+	_, found := rawOverrides["-m"]
+	if !found {
+		err = vm.addMemoryConfig(sb)
+		if err != nil {
+			return "", nil, err
+		}
+	}
+
+	_, found = rawOverrides["-smp"]
+	if !found {
+		err = vm.addCPUConfig(sb)
+		if err != nil {
+			return "", nil, err
+		}
+	}
+
+	err = vm.addFirmwareConfig(sb, fdFiles)
+	if err != nil {
+		return "", nil, err
+	}
+
+	err = vm.addVsockConfig(sb)
+	if err != nil {
+		return "", nil, err
+	}
+
+	err = vm.addMonitorConfig(sb)
+	if err != nil {
+		return "", nil, err
+	}
+
+	err = vm.addConfDriveConfig(sb)
+	if err != nil {
+		return "", nil, err
+	}
+
+	err = vm.addCloudInitDriveConfig(sb)
+	if err != nil {
+		return "", nil, err
+	}
+
+	err = vm.addWatchdogConfig(sb)
+	if err != nil {
+		return "", nil, err
+	}
+
+	err = vm.addTPMConfig(sb)
+	if err != nil {
+		return "", nil, err
+	}
+
+	err = vm.addGuestLogConfig(sb)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// Index of the next PCIe root port to use by NICs. Drives on virtio-blk use the ones following
+	// all the NICs, so that changing the bus of a drive doesn't move the NICs to other slots, which
+	// guests name their interfaces after.
+	nicIndex := 0
+	driveIndex := 0
+	for _, runConf := range devConfs {
+		if len(runConf.NetworkInterface) > 0 {
+			driveIndex++
+		}
+	}
+
+	usbController := false
+	bootIndexes, err := vm.deviceBootPriorities()
+	if err != nil {
+		return "", nil, errors.Wrap(err, "Error calculating boot indexes")
+	}
+
+	// Record the mounts we are going to do inside the VM using the agent.
+	agentMounts := []instancetype.VMAgentMount{}
+
+	for _, runConf := range devConfs {
+		// Add drive devices.
+		if len(runConf.Mounts) > 0 {
+			for _, drive := range runConf.Mounts {
+				if drive.TargetPath == "/" {
+					err = vm.addRootDriveConfig(sb, bootIndexes, &driveIndex, drive, dryRun)
+				} else if drive.FSType == "9p" {
+					err = vm.addDriveDirConfig(sb, fdFiles, &agentMounts, drive)
+				} else if shared.StringInSlice(deviceConfig.MountOptCDROM, drive.Opts) {
+					err = vm.addDriveCDROMConfig(sb, bootIndexes, fdFiles, drive)
+				} else {
+					err = vm.addDriveConfig(sb, bootIndexes, &driveIndex, drive, dryRun)
+				}
+				if err != nil {
+					return "", nil, err
+				}
+			}
+		}
+
+		// Add network device.
+		if len(runConf.NetworkInterface) > 0 {
+			err = vm.addNetDevConfig(sb, nicIndex, bootIndexes, runConf.NetworkInterface, fdFiles, dryRun)
+			if err != nil {
+				return "", nil, err
+			}
+			nicIndex++
+		}
+
+		// Add GPU device.
+		if len(runConf.GPUDevice) > 0 {
+			err = vm.addGPUDevConfig(sb, runConf.GPUDevice)
+			if err != nil {
+				return "", nil, err
+			}
+		}
+
+		// Add serial device.
+		if len(runConf.SerialDevice) > 0 {
+			err = vm.addSerialDevConfig(sb, fdFiles, runConf.SerialDevice)
+			if err != nil {
+				return "", nil, err
+			}
+		}
+
+		// Add shared memory device.
+		if len(runConf.SharedMemDevice) > 0 {
+			err = vm.addSharedMemDevConfig(sb, fdFiles, runConf.SharedMemDevice)
+			if err != nil {
+				return "", nil, err
+			}
+		}
+
+		// Add USB device, along with the USB controller for the first one.
+		if len(runConf.USBDevice) > 0 {
+			if !usbController {
+				err = qemuUSB.Execute(sb, map[string]interface{}{
+					"architecture": vm.architectureName,
+				})
+				if err != nil {
+					return "", nil, err
+				}
+
+				usbController = true
+			}
+
+			err = vm.addUSBDevConfig(sb, runConf.USBDevice)
+			if err != nil {
+				return "", nil, err
+			}
+		}
+	}
+
+	return sb.String(), agentMounts, nil
+}
+
+// qemuMemorySlots is the number of DIMM slots available for hot-adding memory when limits.memory.max is set.
+const qemuMemorySlots = 16
+
+// qemuMemoryBlockSize is the granularity of hot-added memory, matching the memory block size used by Linux
+// guests to bring memory online.
+const qemuMemoryBlockSize = 128 * 1024 * 1024
+
+// addMemoryConfig adds the qemu config required for setting the size of the VM's memory.
+func (vm *qemu) addMemoryConfig(sb *strings.Builder) error {
+	// Configure memory limit.
+	memSizeBytes, err := vm.memorySizeBytes()
+	if err != nil {
+		return err
+	}
+
+	ctx := map[string]interface{}{
+		"architecture": vm.architectureName,
+		"memSizeBytes": memSizeBytes,
+	}
+
+	// Reserve room for hot-adding memory as DIMMs.
+	if vm.expandedConfig["limits.memory.max"] != "" {
+		memMaxBytes, err := vm.memoryMaxBytes()
+		if err != nil {
+			return err
+		}
+
+		if memMaxBytes < memSizeBytes {
+			return fmt.Errorf("limits.memory.max (%d bytes) is lower than limits.memory (%d bytes)", memMaxBytes, memSizeBytes)
+		}
+
+		if shared.IsTrue(vm.expandedConfig["limits.memory.hugepages"]) {
+			return fmt.Errorf("limits.memory.max can't be used with limits.memory.hugepages")
+		}
+
+		ctx["memMaxBytes"] = memMaxBytes
+		ctx["memSlots"] = qemuMemorySlots
+	}
+
+	return qemuMemory.Execute(sb, ctx)
+}
+
+// memoryMaxBytes returns the maximum size of the VM's memory in bytes, set by limits.memory.max.
+func (vm *qemu) memoryMaxBytes() (int64, error) {
+	memMaxBytes, err := units.ParseByteSizeString(vm.expandedConfig["limits.memory.max"])
+	if err != nil {
+		return -1, fmt.Errorf("limits.memory.max invalid: %v", err)
+	}
+
+	return memMaxBytes, nil
+}
+
+// setMemory hot-adds memory to the running VM as DIMMs so that it matches the memory limit. One DIMM is
+// added to each guest NUMA node, bound to the same host node and sized in proportion to the node's boot
+// memory. The VM must have been started with limits.memory.max set and the guest needs to support ACPI
+// memory hotplug, which is checked from the status it reports for the new DIMMs. The memory limit of the
+// cgroup, if supplied, is raised before adding the DIMMs so that the guest can use them straight away.
+func (vm *qemu) setMemory(cg *cgroup.CGroup) error {
+	memSizeBytes, err := vm.memorySizeBytes()
+	if err != nil {
+		return err
+	}
+
+	monitor, err := vm.getMonitor()
+	if err != nil {
+		return err
+	}
+
+	curSizeBytes, err := monitor.GetMemorySize()
+	if err != nil {
+		return errors.Wrap(err, "Failed getting the memory size of the VM")
+	}
+
+	if memSizeBytes < curSizeBytes {
+		return fmt.Errorf("Memory can't be removed from a running VM (%d bytes in use), restart it instead", curSizeBytes)
+	}
+
+	addBytes := memSizeBytes - curSizeBytes
+	if addBytes == 0 {
+		return nil
+	}
+
+	if addBytes%qemuMemoryBlockSize != 0 {
+		return fmt.Errorf("Memory can only be added to a running VM in multiples of %dMiB", qemuMemoryBlockSize/1024/1024)
+	}
+
+	memMaxBytes, err := vm.memoryMaxBytes()
+	if err != nil {
+		return err
+	}
+
+	if memSizeBytes > memMaxBytes {
+		return fmt.Errorf("The VM was started with room for %d bytes of memory at most (limits.memory.max)", memMaxBytes)
+	}
+
+	// Find the guest NUMA nodes and their host nodes from their memory backends.
+	type numaNode struct {
+		hostNodes []int
+		sizeBytes int64
+	}
+
+	nodes := []numaNode{}
+	nodesBytes := int64(0)
+	for i := 0; ; i++ {
+		node := numaNode{}
+		path := fmt.Sprintf("/objects/qemu_numa%d", i)
+
+		err = monitor.GetObjectProperty(path, "size", &node.sizeBytes)
+		if err != nil {
+			break
+		}
+
+		err = monitor.GetObjectProperty(path, "host-nodes", &node.hostNodes)
+		if err != nil {
+			return errors.Wrapf(err, "Failed getting the host node of guest NUMA node %d", i)
+		}
+
+		nodes = append(nodes, node)
+		nodesBytes += node.sizeBytes
+	}
+
+	// Number the DIMMs after the existing ones.
+	devices, err := monitor.GetDevices()
+	if err != nil {
+		return err
+	}
+
+	dimmIndex := 0
+	for _, device := range devices {
+		if strings.HasPrefix(device, "qemu_dimm") {
+			dimmIndex++
+		}
+	}
+
+	dimmCount := len(nodes)
+	if dimmCount == 0 {
+		dimmCount = 1
+	}
+
+	if dimmIndex+dimmCount > qemuMemorySlots {
+		return fmt.Errorf("All the %d memory slots of the VM are in use, restart it to add more memory", qemuMemorySlots)
+	}
+
+	if cg != nil {
+		err = vm.setCgroupMemoryLimit(cg)
+		if err != nil {
+			return errors.Wrap(err, "Failed to update memory limit")
+		}
+	}
+
+	// Split the memory between the nodes in blocks, any remainder going to the last node.
+	dimms := []string{}
+	remainingBytes := addBytes
+	for i := 0; i < dimmCount; i++ {
+		dimmBytes := remainingBytes
+		props := map[string]interface{}{}
+		if len(nodes) > 0 {
+			if i < dimmCount-1 {
+				dimmBytes = (addBytes / qemuMemoryBlockSize) * nodes[i].sizeBytes / nodesBytes * qemuMemoryBlockSize
+			}
+
+			props["host-nodes"] = nodes[i].hostNodes
+			props["policy"] = "bind"
+		}
+
+		remainingBytes -= dimmBytes
+		if dimmBytes == 0 {
+			continue
+		}
+
+		dimmID := fmt.Sprintf("qemu_dimm%d", dimmIndex+len(dimms))
+		props["size"] = dimmBytes
+		err = monitor.AddObject("memory-backend-ram", dimmID+"_mem", props)
+		if err != nil {
+			return errors.Wrap(err, "Failed adding memory backend")
+		}
+
+		dimmDev := map[string]interface{}{
+			"driver": "pc-dimm",
+			"id":     dimmID,
+			"memdev": dimmID + "_mem",
+		}
+
+		if len(nodes) > 0 {
+			dimmDev["node"] = i
+		}
+
+		err = monitor.AddDevice(dimmDev)
+		if err != nil {
+			monitor.RemoveObject(dimmID + "_mem")
+			return errors.Wrap(err, "Failed adding memory, the guest may not support memory hotplug")
+		}
+
+		dimms = append(dimms, dimmID)
+	}
+
+	// Wait for the guest to report the outcome of adding the DIMMs.
+	for i := 0; ; i++ {
+		statuses, err := monitor.GetACPIOSPMStatus()
+		if err != nil {
+			return err
+		}
+
+		pending := 0
+		for _, status := range statuses {
+			if !shared.StringInSlice(status.Device, dimms) {
+				continue
+			}
+
+			if status.Source == 0 {
+				pending++
+			} else if status.Status != 0 {
+				return fmt.Errorf("The guest failed to add memory %q (ACPI status %d)", status.Device, status.Status)
+			}
+		}
+
+		if pending == 0 {
+			return nil
+		}
+
+		if i == 30 {
+			return fmt.Errorf("The guest didn't acknowledge the added memory, it may not support memory hotplug")
+		}
+
+		time.Sleep(time.Second)
+	}
+}
+
+// memorySizeBytes returns the size of the VM's memory in bytes.
+func (vm *qemu) memorySizeBytes() (int64, error) {
+	memSize := vm.expandedConfig["limits.memory"]
+	if memSize == "" {
+		memSize = "1GiB" // Default to 1GiB if no memory limit specified.
+	}
+
+	memSizeBytes, err := units.ParseByteSizeString(memSize)
+	if err != nil {
+		return -1, fmt.Errorf("limits.memory invalid: %v", err)
+	}
+
+	return memSizeBytes, nil
+}
+
+// addVsockConfig adds the qemu config required for setting up the host->VM vsock socket.
+func (vm *qemu) addVsockConfig(sb *strings.Builder) error {
+	return qemuVsock.Execute(sb, map[string]interface{}{
+		"architecture": vm.architectureName,
+		"vsockID":      vm.vsockID(),
+	})
+}
+
+// addCPUConfig adds the qemu config required for setting the number of virtualised CPUs.
+func (vm *qemu) addCPUConfig(sb *strings.Builder) error {
+	// Default to a single core.
+	cpus := vm.expandedConfig["limits.cpu"]
+	if cpus == "" {
+		cpus = "1"
+	}
+
+	// Reserve room for hot-plugging vCPUs. The topology is then kept flat with every vCPU being a
+	// core of a single socket so that vCPUs can be added one at a time.
+	if vm.expandedConfig["limits.cpu.max"] != "" {
+		cpuCount, err := vm.cpuCount(cpus)
+		if err != nil {
+			return err
+		}
+
+		cpuMaxCount, err := strconv.Atoi(vm.expandedConfig["limits.cpu.max"])
+		if err != nil {
+			return err
+		}
+
+		if cpuCount > cpuMaxCount {
+			return fmt.Errorf("limits.cpu.max (%d) is lower than the number of vCPUs (%d)", cpuMaxCount, cpuCount)
+		}
+
+		return qemuCPU.Execute(sb, map[string]interface{}{
+			"architecture": vm.architectureName,
+			"cpuCount":     cpuCount,
+			"cpuMaxCount":  cpuMaxCount,
+			"cpuSockets":   1,
+			"cpuCores":     cpuMaxCount,
+			"cpuThreads":   1,
+		})
+	}
+
+	cpuCount, err := strconv.Atoi(cpus)
+	if err == nil {
+		// If not pinning, default to exposing cores.
+		return qemuCPU.Execute(sb, map[string]interface{}{
+			"architecture": vm.architectureName,
+			"cpuCount":     cpuCount,
+			"cpuSockets":   1,
+			"cpuCores":     cpuCount,
+			"cpuThreads":   1,
+		})
+	}
+
+	// Get CPU topology.
+	cpuInfo, err := resources.GetCPU()
+	if err != nil {
+		return err
+	}
+
+	return vm.addCPUPinnedConfig(sb, cpuInfo, cpus)
+}
+
+// addCPUPinnedConfig adds the qemu config required for a set of pinned CPUs. The virtualised CPU
+// topology mirrors the host's and if the pinned CPUs span multiple host NUMA nodes, a guest NUMA
+// node is created for each of them with the VM's memory split proportionally between them.
+func (vm *qemu) addCPUPinnedConfig(sb *strings.Builder, cpuInfo *api.ResourcesCPU, limit string) error {
+	// Expand to a set of CPU identifiers and get the pinning map.
+	nrSockets, nrCores, nrThreads, vcpus, numaNodes, err := vm.cpuTopology(cpuInfo, limit)
+	if err != nil {
+		return err
+	}
+
+	ctx := map[string]interface{}{
+		"architecture": vm.architectureName,
+		"cpuCount":     len(vcpus),
+		"cpuSockets":   nrSockets,
+		"cpuCores":     nrCores,
+		"cpuThreads":   nrThreads,
+	}
+
+	if len(numaNodes) > 1 {
+		memSizeBytes, err := vm.memorySizeBytes()
+		if err != nil {
+			return err
+		}
+
+		hugepagesPath, err := vm.hugepagesPath()
+		if err != nil {
+			return err
+		}
+
+		hostNodes := make([]uint64, 0, len(numaNodes))
+		for hostNode := range numaNodes {
+			hostNodes = append(hostNodes, hostNode)
+		}
+
+		sort.Slice(hostNodes, func(i, j int) bool { return hostNodes[i] < hostNodes[j] })
+
+		// Split the memory proportionally to the number of vCPUs in each node, aligned to 1MiB.
+		// Any remainder is given to the last node so that the total matches the memory size.
+		nodes := make([]map[string]interface{}, 0, len(hostNodes))
+		remainingBytes := memSizeBytes
+		for i, hostNode := range hostNodes {
+			nodeMemBytes := remainingBytes
+			if i < len(hostNodes)-1 {
+				nodeMemBytes = memSizeBytes * int64(len(numaNodes[hostNode])) / int64(len(vcpus))
+				nodeMemBytes -= nodeMemBytes % (1024 * 1024)
+			}
+			remainingBytes -= nodeMemBytes
+
+			nodes = append(nodes, map[string]interface{}{
+				"hostNode":     hostNode,
+				"cpuRanges":    qemuCPURanges(numaNodes[hostNode]),
+				"memSizeBytes": nodeMemBytes,
+			})
+		}
+
+		ctx["numaNodes"] = nodes
+		ctx["hugepagesPath"] = hugepagesPath
+	}
+
+	return qemuCPU.Execute(sb, ctx)
+}
+
+// usesNUMANodes returns whether addCPUConfig splits the VM's memory into guest NUMA nodes with a
+// memory backend each, which happens when its pinned CPUs span several host NUMA nodes. The host
+// CPU topology is only fetched through getCPU when the CPUs are pinned.
+func (vm *qemu) usesNUMANodes(getCPU func() (*api.ResourcesCPU, error)) (bool, error) {
+	cpus := vm.expandedConfig["limits.cpu"]
+	if cpus == "" || vm.expandedConfig["limits.cpu.max"] != "" {
+		return false, nil
+	}
+
+	_, err := strconv.Atoi(cpus)
+	if err == nil {
+		return false, nil
+	}
+
+	cpuInfo, err := getCPU()
+	if err != nil {
+		return false, err
+	}
+
+	_, _, _, _, numaNodes, err := vm.cpuTopology(cpuInfo, cpus)
+	if err != nil {
+		return false, err
+	}
+
+	return len(numaNodes) > 1, nil
+}
+
+// qemuParseCPUPins parses a map of vCPU index to host CPU formatted by qemuFormatCPUPins.
+func qemuParseCPUPins(value string) (map[uint64]uint64, error) {
+	if value == "" {
+		return nil, fmt.Errorf("No CPU pins")
+	}
+
+	pins := map[uint64]uint64{}
+	for _, entry := range strings.Split(value, ",") {
+		fields := strings.SplitN(entry, ":", 2)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("Invalid CPU pin %q", entry)
+		}
+
+		vcpu, err := strconv.ParseUint(fields[0], 10, 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid CPU pin %q", entry)
+		}
+
+		pin, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid CPU pin %q", entry)
+		}
+
+		pins[vcpu] = pin
+	}
+
+	// The vCPU indexes must be contiguous.
+	for i := 0; i < len(pins); i++ {
+		_, ok := pins[uint64(i)]
+		if !ok {
+			return nil, fmt.Errorf("Missing pin for vCPU %d", i)
+		}
+	}
+
+	return pins, nil
+}
+
+// qemuFormatCPUPins formats a map of vCPU index to host CPU as a comma separated list of
+// <vCPU>:<host CPU> pairs ordered by vCPU index.
+func qemuFormatCPUPins(pins map[uint64]uint64) string {
+	entries := make([]string, 0, len(pins))
+	for i := 0; i < len(pins); i++ {
+		entries = append(entries, fmt.Sprintf("%d:%d", i, pins[uint64(i)]))
+	}
+
+	return strings.Join(entries, ",")
+}
+
+// qemuSameHostCPUs returns whether two maps of vCPU index to host CPU use the same set of host CPUs.
+func qemuSameHostCPUs(a map[uint64]uint64, b map[uint64]uint64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	hostCPUs := map[uint64]bool{}
+	for _, pin := range a {
+		hostCPUs[pin] = true
+	}
+
+	for _, pin := range b {
+		if !hostCPUs[pin] {
+			return false
+		}
+
+		delete(hostCPUs, pin)
+	}
+
+	return len(hostCPUs) == 0
+}
+
+// qemuCPURanges converts a list of vCPU indexes into a sorted list of ranges suitable for qemu.
+func qemuCPURanges(vcpus []uint64) []string {
+	sorted := append([]uint64{}, vcpus...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	ranges := []string{}
+	for i := 0; i < len(sorted); {
+		j := i
+		for j+1 < len(sorted) && sorted[j+1] == sorted[j]+1 {
+			j++
+		}
+
+		if i == j {
+			ranges = append(ranges, fmt.Sprintf("%d", sorted[i]))
+		} else {
+			ranges = append(ranges, fmt.Sprintf("%d-%d", sorted[i], sorted[j]))
+		}
+
+		i = j + 1
+	}
+
+	return ranges
+}
+
+// addMonitorConfig adds the qemu config required for setting up the host side VM monitor device.
+func (vm *qemu) addMonitorConfig(sb *strings.Builder) error {
+	return qemuControlSocket.Execute(sb, map[string]interface{}{
+		"architecture": vm.architectureName,
+		"path":         vm.getMonitorPath(),
+	})
+}
+
+// addFirmwareConfig adds the qemu config required for adding a secure boot compatible EFI firmware.
+// The firmware is skipped when a kernel is booted directly.
+func (vm *qemu) addFirmwareConfig(sb *strings.Builder, fdFiles *[]string) error {
+	if vm.expandedConfig["raw.qemu.kernel"] != "" {
+		return vm.addDirectKernelConfig(sb, fdFiles)
+	}
+
+	// No UEFI nvram for ppc64le, it boots using the SLOF firmware built into qemu.
+	if vm.architecture == osarch.ARCH_64BIT_POWERPC_LITTLE_ENDIAN {
+		return nil
+	}
+
+	firmware, err := vm.getFirmware()
+	if err != nil {
+		return err
+	}
+
+	return qemuDriveFirmware.Execute(sb, map[string]interface{}{
+		"architecture": vm.architectureName,
+		"roPath":       firmware.code,
+		"nvramPath":    vm.getNvramPath(),
+	})
+}
+
+// addDirectKernelConfig adds the qemu config required for booting the kernel in raw.qemu.kernel directly,
+// with the initrd in raw.qemu.initrd and the command line in raw.qemu.cmdline. As qemu runs chrooted,
+// the files are passed as file descriptors.
+func (vm *qemu) addDirectKernelConfig(sb *strings.Builder, fdFiles *[]string) error {
+	tplFields := map[string]interface{}{
+		"cmdline": vm.expandedConfig["raw.qemu.cmdline"],
+	}
+
+	for _, key := range []string{"kernel", "initrd"} {
+		configKey := fmt.Sprintf("raw.qemu.%s", key)
+		if vm.expandedConfig[configKey] == "" {
+			continue
+		}
+
+		path := shared.HostPath(vm.expandedConfig[configKey])
+		err := qemuCheckBootFile(path)
+		if err != nil {
+			return errors.Wrapf(err, "Invalid %s", configKey)
+		}
+
+		tplFields[key] = fmt.Sprintf("/proc/self/fd/%d", vm.addFileDescriptor(fdFiles, path))
+	}
+
+	return qemuDirectKernel.Execute(sb, tplFields)
+}
+
+// qemuCheckBootFile checks that a file to boot from directly is a regular file LXD can read.
+func qemuCheckBootFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%q isn't a regular file", path)
+	}
+
+	return nil
+}
+
+// addConfDriveConfig adds the qemu config required for adding the config drive.
+func (vm *qemu) addConfDriveConfig(sb *strings.Builder) error {
+	return qemuDriveConfig.Execute(sb, map[string]interface{}{
+		"architecture": vm.architectureName,
+		"path":         filepath.Join(vm.Path(), "config"),
+	})
+}
+
+// addCloudInitDriveConfig adds the qemu config required for adding the cloud-init ISO if enabled.
+func (vm *qemu) addCloudInitDriveConfig(sb *strings.Builder) error {
+	if !shared.IsTrue(vm.expandedConfig["boot.cloud_init_iso"]) {
+		return nil
+	}
+
+	return qemuDriveCloudInit.Execute(sb, map[string]interface{}{
+		"path": vm.cloudInitISOPath(),
+	})
+}
+
+// addWatchdogConfig adds the qemu config required for adding a watchdog device if enabled.
+func (vm *qemu) addWatchdogConfig(sb *strings.Builder) error {
+	if vm.expandedConfig["security.watchdog.action"] == "" {
+		return nil
+	}
+
+	return qemuWatchdog.Execute(sb, map[string]interface{}{
+		"architecture": vm.architectureName,
+	})
+}
+
+// addTPMConfig adds the qemu config required for adding a TPM device backed by swtpm if enabled.
+func (vm *qemu) addTPMConfig(sb *strings.Builder) error {
+	if !shared.IsTrue(vm.expandedConfig["security.tpm"]) {
+		return nil
+	}
+
+	return qemuTPM.Execute(sb, map[string]interface{}{
+		"architecture": vm.architectureName,
+		"path":         vm.tpmSocketPath(),
+	})
+}
+
+// qemuSerialPortPrefix prefixes the names of the virtio serial ports set up by LXD, which the guest
+// finds them by.
+const qemuSerialPortPrefix = "org.linuxcontainers.lxd"
+
+// qemuGuestLogPort is the name of the virtio serial port the guest can write its logs to.
+const qemuGuestLogPort = qemuSerialPortPrefix + ".log"
+
+// qemuGuestLogSize is the size in bytes of the guest log kept, both in qemu and in GuestLogPath.
+const qemuGuestLogSize = 1024 * 1024
+
+// qemuGuestLogInterval is how often the guest log of a running VM is drained into GuestLogPath.
+var qemuGuestLogInterval = 5 * time.Second
+
+// addGuestLogConfig adds the qemu config required for the virtio serial port the guest can write its
+// logs to, if enabled. The port is output only, backed by a ringbuf drained into GuestLogPath by
+// drainGuestLog, so that the guest can't fill up the host's disk.
+func (vm *qemu) addGuestLogConfig(sb *strings.Builder) error {
+	if !shared.IsTrue(vm.expandedConfig["log.guest"]) {
+		return nil
+	}
+
+	return qemuGuestLog.Execute(sb, map[string]interface{}{
+		"size": qemuGuestLogSize,
+		"name": qemuGuestLogPort,
+	})
+}
+
+// drainGuestLog moves what the guest wrote to its log serial port from the ringbuf of the running VM to
+// GuestLogPath, keeping its last qemuGuestLogSize bytes.
+func (vm *qemu) drainGuestLog(monitor *qmp.Monitor) error {
+	if !shared.IsTrue(vm.expandedConfig["log.guest"]) {
+		return nil
+	}
+
+	// Read and save under the lock, so that concurrent drains don't reorder the log.
+	vmGuestLogLock.Lock()
+	defer vmGuestLogLock.Unlock()
+
+	data, err := monitor.RingbufRead("qemu_guest-log")
+	if err != nil {
+		return err
+	}
+
+	if len(data) == 0 {
+		return nil
+	}
+
+	content, err := ioutil.ReadFile(vm.GuestLogPath())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	content = append(content, data...)
+	if len(content) > qemuGuestLogSize {
+		content = content[len(content)-qemuGuestLogSize:]
+	}
+
+	return ioutil.WriteFile(vm.GuestLogPath(), content, 0600)
+}
+
+// watchGuestLog drains the guest log of the running VM every qemuGuestLogInterval until the monitor
+// disconnects. qemu exits as soon as the guest powers off, without leaving a chance to read the ringbuf,
+// so this bounds what is lost then to what the guest logged since the last drain.
+func (vm *qemu) watchGuestLog(monitor *qmp.Monitor) {
+	if !shared.IsTrue(vm.expandedConfig["log.guest"]) {
+		return
+	}
+
+	chDisconnect, err := monitor.Wait()
+	if err != nil {
+		return
+	}
+
+	ticker := time.NewTicker(qemuGuestLogInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-chDisconnect:
+			return
+		case <-ticker.C:
+			err := vm.drainGuestLog(monitor)
+			if err != nil && err != qmp.ErrMonitorDisconnect {
+				logger.Warn("Failed saving the guest log", log.Ctx{"project": vm.project, "instance": vm.name, "err": err})
+			}
+		}
+	}
+}
+
+// GuestLog returns what the guest wrote to its log serial port since it was last started.
+func (vm *qemu) GuestLog() (string, error) {
+	if vm.IsRunning() {
+		monitor, err := vm.getMonitor()
+		if err == nil {
+			err = vm.drainGuestLog(monitor)
+			if err != nil {
+				return "", err
+			}
+		}
+	}
+
+	content, err := ioutil.ReadFile(vm.GuestLogPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+
+		return "", err
+	}
+
+	return string(content), nil
+}
+
+// qemuCheckSerialPortName checks the name of a user serial port doesn't clash with those set up by LXD.
+func qemuCheckSerialPortName(name string) error {
+	if strings.HasPrefix(name, qemuSerialPortPrefix) {
+		return fmt.Errorf("Serial port names starting with %q are reserved", qemuSerialPortPrefix)
+	}
+
+	return nil
+}
+
+// qemuSMBIOSFields are the SMBIOS system information (type 1) fields which can be set through smbios.* keys.
+var qemuSMBIOSFields = []string{"family", "manufacturer", "product", "serial", "sku", "uuid", "version"}
+
+// smbiosArg returns the value of the qemu -smbios argument setting the SMBIOS system information of the
+// VM, empty when not configured. The system UUID defaults to the VM's UUID, which qemu otherwise uses as is.
+// The -readconfig file can't hold SMBIOS settings, so they are passed on the command line.
+func (vm *qemu) smbiosArg() (string, error) {
+	fields := map[string]string{}
+	for _, field := range qemuSMBIOSFields {
+		value := vm.expandedConfig[fmt.Sprintf("smbios.%s", field)]
+		if value != "" {
+			fields[field] = value
+		}
+	}
+
+	if len(fields) == 0 {
+		return "", nil
+	}
+
+	if vm.architectureName == "ppc64le" {
+		return "", fmt.Errorf("SMBIOS isn't supported on %s", vm.architectureName)
+	}
+
+	if fields["uuid"] == "" && vm.localConfig["volatile.vm.uuid"] != "" {
+		fields["uuid"] = vm.localConfig["volatile.vm.uuid"]
+	}
+
+	opts := []string{"type=1"}
+	for _, field := range qemuSMBIOSFields {
+		value, found := fields[field]
+		if found {
+			// Commas are escaped by doubling them in qemu options.
+			opts = append(opts, fmt.Sprintf("%s=%s", field, strings.Replace(value, ",", ",,", -1)))
+		}
+	}
+
+	return strings.Join(opts, ","), nil
+}
+
+// addFileDescriptor adds a file path to the list of files to open and pass file descriptor to qemu.
+// Returns the file descriptor number that qemu will receive.
+func (vm *qemu) addFileDescriptor(fdFiles *[]string, filePath string) int {
+	// Append the tap device file path to the list of files to be opened and passed to qemu.
+	*fdFiles = append(*fdFiles, filePath)
+	return 2 + len(*fdFiles) // Use 2+fdFiles count, as first user file descriptor is 3.
+}
+
+// addRootDriveConfig adds the qemu config required for adding the root drive.
+func (vm *qemu) addRootDriveConfig(sb *strings.Builder, bootIndexes map[string]int, pcieIndex *int, rootDriveConf deviceConfig.MountEntryItem, dryRun bool) error {
+	if rootDriveConf.TargetPath != "/" {
+		return fmt.Errorf("Non-root drive config supplied")
+	}
+
+	pool, err := vm.getStoragePool()
+	if err != nil {
+		return err
+	}
+
+	rootDrivePath, err := pool.GetInstanceDisk(vm)
+	if err != nil {
+		// Some storage drivers only expose the disk once the instance's storage is mounted.
+		if dryRun {
+			fmt.Fprintf(sb, "\n# Root disk %q is only available once the instance's storage is mounted: %v\n", rootDriveConf.DevName, err)
+			return nil
+		}
+
+		return err
+	}
+
+	// Generate a new device config with the root device path expanded.
+	driveConf := deviceConfig.MountEntryItem{
+		DevName: rootDriveConf.DevName,
+		DevPath: rootDrivePath,
+		Opts:    rootDriveConf.Opts,
+	}
+
+	// Root disks created as qcow2 overlays over their image have their backing chain checked before use.
+	format := storageDrivers.BlockFileFormat(rootDrivePath)
+	if format != "raw" {
+		if !dryRun {
+			err = storageDrivers.ValidateBlockOverlay(rootDrivePath)
+			if err != nil {
+				return errors.Wrapf(err, "Invalid root disk")
+			}
+		}
+
+		driveConf.Opts = append(driveConf.Opts, deviceConfig.MountOptFormat+format)
+	}
+
+	// If the storage pool is on ZFS and backed by a loop file and we can't use DirectIO, then resort to
+	// unsafe async I/O to avoid kernel hangs when running ZFS storage pools in an image file on another FS.
+	// This is skipped when the I/O modes of the disk are explicitly configured.
+	driverInfo := pool.Driver().Info()
+	driverConf := pool.Driver().Config()
+	cacheMode, aioMode := qemuDriveIOModes(driveConf.Opts)
+	if cacheMode == "" && aioMode == "" && driverInfo.Name == "zfs" && !driverInfo.DirectIO && shared.PathExists(driverConf["source"]) && !shared.IsBlockdevPath(driverConf["source"]) {
+		driveConf.Opts = append(driveConf.Opts, qemuUnsafeIO)
+	}
+
+	return vm.addDriveConfig(sb, bootIndexes, pcieIndex, driveConf, dryRun)
+}
+
+// addDriveDirConfig adds the qemu config required for adding a supplementary drive directory share.
+func (vm *qemu) addDriveDirConfig(sb *strings.Builder, fdFiles *[]string, agentMounts *[]instancetype.VMAgentMount, driveConf deviceConfig.MountEntryItem) error {
+	mountTag := fmt.Sprintf("lxd_%s", driveConf.DevName)
+
+	agentMount := instancetype.VMAgentMount{
+		Source: mountTag,
+		Target: driveConf.TargetPath,
+		FSType: driveConf.FSType,
+	}
+
+	// Pass the mount options to the agent, including whether to mount this readonly. Note: This is purely
+	// to indicate to VM guest that this is readonly, it should *not* be used as a security measure, as the
+	// VM guest could remount it R/W.
+	agentMount.Options = append(agentMount.Options, driveConf.Opts...)
+
+	// Record the 9p mount for the agent.
+	*agentMounts = append(*agentMounts, agentMount)
+
+	// For read only shares, do not use proxy.
+	if shared.StringInSlice("ro", driveConf.Opts) {
+		return qemuDriveDir.Execute(sb, map[string]interface{}{
+			"devName":  driveConf.DevName,
+			"mountTag": mountTag,
+			"path":     driveConf.DevPath,
+			"readonly": true,
+		})
+	}
+
+	// Writable shares of directories are exported directly when qemu runs as root. Guest file ownership
+	// is then passed through, as done by the proxy.
+	if shared.IsDir(driveConf.DevPath) {
+		return qemuDriveDir.Execute(sb, map[string]interface{}{
+			"devName":  driveConf.DevName,
+			"mountTag": mountTag,
+			"path":     driveConf.DevPath,
+			"readonly": false,
+		})
+	}
+
+	// Otherwise the dev path is the socket of the proxy.
+	proxyFD := vm.addFileDescriptor(fdFiles, driveConf.DevPath)
+	return qemuDriveDir.Execute(sb, map[string]interface{}{
+		"devName":  driveConf.DevName,
+		"mountTag": mountTag,
+		"proxyFD":  proxyFD,
+		"readonly": false,
+	})
+}
+
+// addDriveConfig adds the qemu config required for adding a supplementary drive. Drives using virtio-blk
+// take the PCIe root port with the given index, which is then incremented.
+func (vm *qemu) addDriveConfig(sb *strings.Builder, bootIndexes map[string]int, pcieIndex *int, driveConf deviceConfig.MountEntryItem, dryRun bool) error {
+	// Use native kernel async IO and O_DIRECT by default.
+	aioMode := "native"
+	cacheMode := "none" // Bypass host cache, use O_DIRECT semantics.
+	driver := "scsi-hd"
+
+	bus := qemuDriveBus(driveConf.Opts)
+	if bus == "virtio-blk" {
+		driver = "virtio-blk-pci"
+	} else if shared.IsBlockdevPath(driveConf.DevPath) && qemuIsSCSIBlockdev(driveConf.DevPath) {
+		// Host SCSI disks (e.g. iSCSI LUNs) are passed through using SCSI commands, which requires
+		// bypassing the host cache. Other block devices (e.g. LVM LVs) are emulated SCSI disks.
+		driver = "scsi-block"
+	}
+
+	userCacheMode, userAIOMode := qemuDriveIOModes(driveConf.Opts)
+	if userCacheMode != "" || userAIOMode != "" {
+		// The I/O modes are explicitly configured, so don't apply any heuristics.
+		if userCacheMode != "" {
+			cacheMode = userCacheMode
+		}
+
+		if userAIOMode != "" {
+			aioMode = userAIOMode
+		} else if !qemuIsDirectCacheMode(cacheMode) {
+			aioMode = "threads" // Native async I/O requires O_DIRECT.
+		}
+
+		if aioMode == "native" && !qemuIsDirectCacheMode(cacheMode) {
+			return fmt.Errorf("Native async I/O requires a direct cache mode for %q, got %q", driveConf.DevName, cacheMode)
+		}
+
+		if driver == "scsi-block" && !qemuIsDirectCacheMode(cacheMode) {
+			return fmt.Errorf("SCSI passthrough of %q requires a direct cache mode, got %q", driveConf.DevName, cacheMode)
+		}
+
+		if qemuIsDirectCacheMode(cacheMode) {
+			err := qemuCheckDirectIO(driveConf.DevPath)
+			if err != nil {
+				return errors.Wrapf(err, "Cache mode %q cannot be used for %q", cacheMode, driveConf.DevName)
+			}
+		}
+
+		if cacheMode == "unsafe" {
+			logger.Warnf("Using unsafe cache I/O with %s as configured, data may be lost on host crash", driveConf.DevPath)
+		}
+	} else if driver != "scsi-block" && shared.StringInSlice(qemuUnsafeIO, driveConf.Opts) {
+		// If drive config indicates we need to use unsafe I/O then use it. SCSI passthrough is left
+		// bypassing the host cache, as it requires.
+		logger.Warnf("Using unsafe cache I/O with %s", driveConf.DevPath)
+		aioMode = "threads"
+		cacheMode = "unsafe" // Use host cache, but ignore all sync requests from guest.
+	} else if !shared.IsBlockdevPath(driveConf.DevPath) && shared.PathExists(driveConf.DevPath) {
+		// Disk dev path is a file, check whether it is located on a ZFS filesystem.
+		fsType, err := util.FilesystemDetect(driveConf.DevPath)
+		if err != nil {
+			return errors.Wrapf(err, "Failed detecting filesystem type of %q", driveConf.DevPath)
+		}
+
+		// If FS is ZFS, avoid using direct I/O and use host page cache only. Otherwise check that the
+		// filesystem supports direct I/O, as some network filesystems don't and qemu would then fail.
+		if fsType == "zfs" {
+			if driveConf.FSType != "iso9660" {
+				logger.Warnf("Using writeback cache I/O with %s", driveConf.DevPath)
+			}
+			aioMode = "threads"
+			cacheMode = "writeback" // Use host cache, with neither O_DSYNC nor O_DIRECT semantics.
+		} else {
+			err = qemuCheckDirectIO(driveConf.DevPath)
+			if err != nil {
+				logger.Warn("Using writeback cache I/O as direct I/O is unavailable", log.Ctx{"devPath": driveConf.DevPath, "fsType": fsType, "err": err})
+				aioMode = "threads"
+				cacheMode = "writeback"
+			}
+		}
+	}
+
+	// Use io_uring only when both the host kernel and qemu support it, as found when probing the
+	// capabilities of qemu. A dry run shows the configured mode.
+	if aioMode == "io_uring" && !dryRun {
+		err := vm.checkIOUring()
+		if err != nil {
+			logger.Warn("Using threaded async I/O as io_uring is unavailable", log.Ctx{"devPath": driveConf.DevPath, "err": err})
+			aioMode = "threads"
+		}
+	}
+
+	tplFields := map[string]interface{}{
+		"architecture": vm.architectureName,
+		"devName":      driveConf.DevName,
+		"devPath":      driveConf.DevPath,
+		"bootIndex":    bootIndexes[driveConf.DevName],
+		"cacheMode":    cacheMode,
+		"aioMode":      aioMode,
+		"driver":       driver,
+		"format":       qemuDriveFormat(driveConf.Opts),
+	}
+
+	if bus == "virtio-blk" {
+		// The first four PCIe root ports are used by the base devices.
+		port, addr, multifunction := qemuPCIeRootPort(4 + *pcieIndex)
+		tplFields["virtioBlk"] = true
+		tplFields["chassisIndex"] = 5 + *pcieIndex
+		tplFields["portIndex"] = port
+		tplFields["pcieAddr"] = addr
+		tplFields["multifunction"] = multifunction
+		*pcieIndex++
+	}
+
+	return qemuDrive.Execute(sb, tplFields)
+}
+
+// qemuDriveBus returns the bus set in the options of a drive, defaulting to virtio-scsi.
+func qemuDriveBus(opts []string) string {
+	for _, opt := range opts {
+		if strings.HasPrefix(opt, deviceConfig.MountOptBus) {
+			return strings.TrimPrefix(opt, deviceConfig.MountOptBus)
+		}
+	}
+
+	return "virtio-scsi"
+}
+
+// qemuDriveFormat returns the image format set in the options of a drive, defaulting to raw.
+func qemuDriveFormat(opts []string) string {
+	for _, opt := range opts {
+		if strings.HasPrefix(opt, deviceConfig.MountOptFormat) {
+			return strings.TrimPrefix(opt, deviceConfig.MountOptFormat)
+		}
+	}
+
+	return "raw"
+}
+
+// qemuDriveIOModes returns the cache and async I/O modes set in the options of a drive, if any.
+func qemuDriveIOModes(opts []string) (string, string) {
+	cacheMode := ""
+	aioMode := ""
+	for _, opt := range opts {
+		if strings.HasPrefix(opt, deviceConfig.MountOptCache) {
+			cacheMode = strings.TrimPrefix(opt, deviceConfig.MountOptCache)
+		} else if strings.HasPrefix(opt, deviceConfig.MountOptAIO) {
+			aioMode = strings.TrimPrefix(opt, deviceConfig.MountOptAIO)
+		}
+	}
+
+	return cacheMode, aioMode
+}
+
+// qemuIsDirectCacheMode returns whether a drive cache mode bypasses the host page cache.
+func qemuIsDirectCacheMode(cacheMode string) bool {
+	return cacheMode == "none" || cacheMode == "directsync"
+}
+
+// qemuCheckDirectIO checks that a disk path can be opened and read with O_DIRECT. A read is attempted
+// as some network filesystems accept the flag when opening the file but then fail the I/O.
+func qemuCheckDirectIO(devPath string) error {
+	fd, err := unix.Open(devPath, unix.O_RDONLY|unix.O_DIRECT|unix.O_CLOEXEC, 0)
+	if err != nil {
+		if err == unix.EINVAL {
+			return fmt.Errorf("The backing filesystem of %q doesn't support direct I/O", devPath)
+		}
+
+		return errors.Wrapf(err, "Failed opening %q", devPath)
+	}
+	defer unix.Close(fd)
+
+	// Direct I/O requires a buffer aligned to the logical block size, which a page always is.
+	buf, err := unix.Mmap(-1, 0, os.Getpagesize(), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_ANON|unix.MAP_PRIVATE)
+	if err != nil {
+		return errors.Wrapf(err, "Failed allocating direct I/O buffer")
+	}
+	defer unix.Munmap(buf)
+
+	_, err = unix.Pread(fd, buf, 0)
+	if err != nil {
+		return errors.Wrapf(err, "The backing filesystem of %q doesn't support direct I/O", devPath)
+	}
+
+	return nil
+}
+
+// checkIOUring checks that both the host kernel and the qemu binary of the VM support io_uring, as probed
+// along with the other capabilities of qemu.
+func (vm *qemu) checkIOUring() error {
+	qemuBinary, err := vm.qemuArchConfig()
+	if err != nil {
+		return err
+	}
+
+	qemuPath, err := exec.LookPath(qemuBinary)
+	if err != nil {
+		return err
+	}
+
+	caps, err := qemuGetCapabilities(qemuPath)
+	if err != nil {
+		return err
+	}
+
+	return caps.ioUring
+}
+
+// qemuProbeIOUring checks whether a qemu binary was built with io_uring support, which also requires the
+// host kernel to provide it. It is started without a machine, opening a file with io_uring, and then told
+// to quit through its monitor. Builds lacking io_uring support fail to open the file and exit with an error.
+func qemuProbeIOUring(qemuPath string) error {
+	f, err := ioutil.TempFile("", "lxd-qemu-io_uring-")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	_, err = qemuProbe(qemuPath, "quit\n", "-machine", "none", "-nodefaults", "-no-user-config", "-display", "none", "-S", "-monitor", "stdio", "-blockdev", fmt.Sprintf("driver=file,node-name=probe,aio=io_uring,filename=%s", f.Name()))
+	if err != nil {
+		return errors.Wrapf(err, "%s doesn't support io_uring", filepath.Base(qemuPath))
+	}
+
+	return nil
+}
+
+// qemuIsSCSIBlockdev returns whether a block device is a whole SCSI disk, which can be passed
+// through to the VM as a SCSI LUN.
+func qemuIsSCSIBlockdev(devPath string) bool {
+	var stat unix.Stat_t
+	err := unix.Stat(devPath, &stat)
+	if err != nil {
+		return false
+	}
+
+	major := unix.Major(uint64(stat.Rdev))
+	minor := unix.Minor(uint64(stat.Rdev))
+
+	return shared.PathExists(fmt.Sprintf("/sys/dev/block/%d:%d/device/scsi_device", major, minor))
+}
+
+// addDriveCDROMConfig adds the qemu config required for adding a CD-ROM drive. The media is passed to
+// qemu as a file descriptor, the same way it is when changing it on the running VM.
+func (vm *qemu) addDriveCDROMConfig(sb *strings.Builder, bootIndexes map[string]int, fdFiles *[]string, driveConf deviceConfig.MountEntryItem) error {
+	devPath := ""
+	if driveConf.DevPath != "" {
+		devPath = fmt.Sprintf("/proc/self/fd/%d", vm.addFileDescriptor(fdFiles, driveConf.DevPath))
+	}
+
+	return qemuDriveCDROM.Execute(sb, map[string]interface{}{
+		"devName":   driveConf.DevName,
+		"devPath":   devPath,
+		"bootIndex": bootIndexes[driveConf.DevName],
+	})
+}
+
+// deviceChangeMedia swaps the media of a CD-ROM drive on the running VM. An empty source ejects it.
+func (vm *qemu) deviceChangeMedia(deviceName string, source string) error {
+	monitor, err := vm.getMonitor()
+	if err != nil {
+		return err
+	}
+
+	driveID := fmt.Sprintf("lxd_%s", deviceName)
+	if source == "" {
+		return monitor.Eject(driveID)
+	}
+
+	// As qemu runs chrooted, the new media is passed as a file descriptor.
+	f, err := os.Open(shared.HostPath(source))
+	if err != nil {
+		return errors.Wrapf(err, "Failed opening media for device %q", deviceName)
+	}
+	defer f.Close()
+
+	return monitor.ChangeMedia(driveID, f)
+}
+
+// addNetDevConfig adds the qemu config required for adding a network device. On dry runs, a host interface
+// that isn't set up yet is rendered as a tap device.
+func (vm *qemu) addNetDevConfig(sb *strings.Builder, pcieIndex int, bootIndexes map[string]int, nicConfig []deviceConfig.RunConfigItem, fdFiles *[]string, dryRun bool) error {
+	var devName, nicName, devHwaddr, pciSlotName, model, offloadTX, offloadRX string
+	queues := 1
+	for _, nicItem := range nicConfig {
+		if nicItem.Key == "devName" {
+			devName = nicItem.Value
+		} else if nicItem.Key == "link" {
+			nicName = nicItem.Value
+		} else if nicItem.Key == "hwaddr" {
+			devHwaddr = nicItem.Value
+		} else if nicItem.Key == "pciSlotName" {
+			pciSlotName = nicItem.Value
+		} else if nicItem.Key == "model" {
+			model = nicItem.Value
+		} else if nicItem.Key == "offload.tx" {
+			offloadTX = nicItem.Value
+		} else if nicItem.Key == "offload.rx" {
+			offloadRX = nicItem.Value
+		} else if nicItem.Key == "queues" && nicItem.Value != "" {
+			var err error
+			queues, err = strconv.Atoi(nicItem.Value)
+			if err != nil {
+				return errors.Wrapf(err, "Invalid number of queues for device %q", devName)
+			}
+		}
+	}
+
+	nicDriver, err := vm.nicDriver(model)
+	if err != nil {
+		return errors.Wrapf(err, "Invalid model for device %q", devName)
+	}
+
+	if queues > 1 && nicDriver != "virtio-net-pci" {
+		return fmt.Errorf("Multiple queues are only supported with the virtio-net model on device %q", devName)
+	}
+
+	offloads := qemuNICOffloads(offloadTX, offloadRX)
+	if len(offloads) > 0 && nicDriver != "virtio-net-pci" {
+		return fmt.Errorf("Offloads can only be turned off with the virtio-net model on device %q", devName)
+	}
+
+	romFile, err := vm.nicROM(devName, nicDriver)
+	if err != nil {
+		return err
+	}
+
+	// The first four PCIe root ports are used by the base devices.
+	port, addr, multifunction := qemuPCIeRootPort(4 + pcieIndex)
+
+	var tpl *template.Template
+	tplFields := map[string]interface{}{
+		"architecture":  vm.architectureName,
+		"devName":       devName,
+		"devHwaddr":     devHwaddr,
+		"bootIndex":     bootIndexes[devName],
+		"chassisIndex":  5 + pcieIndex,
+		"portIndex":     port,
+		"pcieAddr":      addr,
+		"multifunction": multifunction,
+		"nicDriver":     nicDriver,
+		"romFile":       romFile,
+		"offloads":      offloads,
+	}
+
+	// Multi-queue virtio-net needs an MSI-X vector per TX and RX queue plus one for config and control.
+	if queues > 1 {
+		tplFields["queues"] = queues
+		tplFields["vectors"] = 2*queues + 2
+	}
+
+	// Devices other than physical passthrough ones are backed by an interface on the host.
+	if pciSlotName == "" && (nicName == "" || !shared.PathExists(filepath.Join(qemuSysClassNet, nicName))) {
+		if !dryRun {
+			return fmt.Errorf("Host interface %q of device %q doesn't exist", nicName, devName)
+		}
+
+		tplFields["ifName"] = nicName
+		return qemuNetDevTapTun.Execute(sb, tplFields)
+	}
+
+	// Detect MACVTAP and IPVTAP interface types and figure out which tap device is being used.
+	// This is so we can open a file handle to the tap device and pass it to the qemu process.
+	if qemuIsTapCharDev(nicName) {
+		content, err := ioutil.ReadFile(filepath.Join(qemuSysClassNet, nicName, "ifindex"))
+		if err != nil {
+			return errors.Wrapf(err, "Error getting tap device ifindex")
+		}
+
+		ifindex, err := strconv.Atoi(strings.TrimSpace(string(content)))
+		if err != nil {
+			return errors.Wrapf(err, "Error parsing tap device ifindex")
+		}
+
+		// Append the tap device file path to the list of files to be opened and passed to qemu.
+		// Each time the tap device is opened a new queue is attached to it.
+		tapFDs := make([]string, 0, queues)
+		for i := 0; i < queues; i++ {
+			tapFDs = append(tapFDs, strconv.Itoa(vm.addFileDescriptor(fdFiles, fmt.Sprintf("/dev/tap%d", ifindex))))
+		}
+
+		tplFields["tapFD"] = strings.Join(tapFDs, ":")
+		tpl = qemuNetdevTapFD
+	} else if shared.PathExists(filepath.Join(qemuSysClassNet, nicName, "tun_flags")) {
+		// Detect TAP (via TUN driver) device.
+		if queues > 1 {
+			err := vm.checkTapMultiQueue(nicName)
+			if err != nil {
+				return err
+			}
+		}
+
+		tplFields["ifName"] = nicName
+		tpl = qemuNetDevTapTun
+	} else if pciSlotName != "" {
+		// Detect physical passthrough device.
+		tplFields["pciSlotName"] = pciSlotName
+		tpl = qemuNetdevPhysical
+	}
+
+	if tpl != nil {
+		return tpl.Execute(sb, tplFields)
+	}
+
+	return fmt.Errorf("Unrecognised device type")
+}
+
+// qemuNICOffloads returns the virtio-net properties to turn off for the offloads disabled on a NIC, given
+// its offload.tx and offload.rx settings. The segmentation offloads depend on checksum offloading and so
+// are turned off along with it.
+func qemuNICOffloads(tx string, rx string) []string {
+	offloads := []string{}
+	if tx != "" && !shared.IsTrue(tx) {
+		offloads = append(offloads, "csum", "host_tso4", "host_tso6", "host_ecn", "host_ufo")
+	}
+
+	if rx != "" && !shared.IsTrue(rx) {
+		offloads = append(offloads, "guest_csum", "guest_tso4", "guest_tso6", "guest_ecn", "guest_ufo")
+	}
+
+	return offloads
+}
+
+// qemuSysClassNet is where the network interfaces of the host are looked up.
+var qemuSysClassNet = "/sys/class/net"
+
+// qemuIsTapCharDev returns whether a host interface is a MACVTAP or IPVTAP, whose queues are opened
+// through the /dev/tapN character device matching its ifindex.
+func qemuIsTapCharDev(nicName string) bool {
+	for _, kind := range []string{"macvtap", "ipvtap"} {
+		if shared.PathExists(filepath.Join(qemuSysClassNet, nicName, kind)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// qemuPCIeRootPort returns the port number and the address on pcie.0 of the PCIe root port with the
+// given index. Root ports are grouped by eight as functions of a multifunction slot. The first slot
+// is slot 2, further ones are allocated downwards from slot 0x1e so that they don't collide with the
+// slots qemu assigns to devices without an explicit address, which are allocated upwards.
+func qemuPCIeRootPort(index int) (string, string, bool) {
+	slot := 0x2
+	if index >= 8 {
+		slot = 0x1e - (index/8 - 1)
+	}
+
+	return fmt.Sprintf("0x%x", 0x10+index), fmt.Sprintf("0x%x.0x%x", slot, index%8), index%8 == 0
+}
+
+// checkTapMultiQueue checks that a TAP device was created with support for multiple queues.
+func (vm *qemu) checkTapMultiQueue(nicName string) error {
+	content, err := ioutil.ReadFile(filepath.Join(qemuSysClassNet, nicName, "tun_flags"))
+	if err != nil {
+		return errors.Wrapf(err, "Error getting tap device flags")
+	}
+
+	flags, err := strconv.ParseUint(strings.TrimSpace(string(content)), 0, 32)
+	if err != nil {
+		return errors.Wrapf(err, "Error parsing tap device flags")
+	}
+
+	if flags&unix.IFF_MULTI_QUEUE == 0 {
+		return fmt.Errorf("Tap device %q doesn't support multiple queues", nicName)
+	}
+
+	return nil
+}
+
+// qemuNICDrivers maps the NIC models supported by each architecture to their qemu device driver.
+var qemuNICDrivers = map[string]map[string]string{
+	"x86_64": {
+		"virtio-net": "virtio-net-pci",
+		"e1000":      "e1000",
+		"e1000e":     "e1000e",
+		"rtl8139":    "rtl8139",
+	},
+	"aarch64": {
+		"virtio-net": "virtio-net-pci",
+		"e1000":      "e1000",
+		"e1000e":     "e1000e",
+	},
+	"ppc64le": {
+		"virtio-net": "virtio-net-pci",
+		"e1000":      "e1000",
+		"rtl8139":    "rtl8139",
+	},
+}
+
+// nicDriver returns the qemu device driver of a NIC model, defaulting to virtio.
+func (vm *qemu) nicDriver(model string) (string, error) {
+	if model == "" {
+		model = "virtio-net"
+	}
+
+	driver, ok := qemuNICDrivers[vm.architectureName][model]
+	if !ok {
+		return "", fmt.Errorf("NIC model %q isn't supported on %s", model, vm.architectureName)
+	}
+
+	return driver, nil
+}
+
+// qemuNICROMs maps the qemu device drivers of NICs to the network boot ROM shipped with qemu for them.
+var qemuNICROMs = map[string]string{
+	"virtio-net-pci": "efi-virtio.rom",
+	"e1000":          "efi-e1000.rom",
+	"e1000e":         "efi-e1000e.rom",
+	"rtl8139":        "efi-rtl8139.rom",
+}
+
+// nicROM returns the network boot ROM of a NIC. It's only set for the NICs the VM may boot from, those
+// with a boot.priority or used by boot.once. The ROM in boot.ipxe_rom is used when set, otherwise the
+// one shipped with qemu for the NIC's driver, with physically passed through NICs keeping their own.
+func (vm *qemu) nicROM(devName string, nicDriver string) (string, error) {
+	if vm.expandedDevices[devName]["boot.priority"] == "" && vm.localConfig["boot.once"] != devName {
+		return "", nil
+	}
+
+	romPath := vm.expandedConfig["boot.ipxe_rom"]
+	if romPath != "" {
+		romPath = shared.HostPath(romPath)
+		if !shared.PathExists(romPath) || shared.IsDir(romPath) {
+			return "", fmt.Errorf("Network boot ROM %q set in boot.ipxe_rom doesn't exist", vm.expandedConfig["boot.ipxe_rom"])
+		}
+
+		return romPath, nil
+	}
+
+	return qemuNICROMs[nicDriver], nil
+}
+
+// addGPUDevConfig adds the qemu config required for passing a GPU device through to the VM. All the
+// PCI devices sharing the GPU's IOMMU group are passed through along with it.
+func (vm *qemu) addGPUDevConfig(sb *strings.Builder, gpuConfig []deviceConfig.RunConfigItem) error {
+	var devName string
+	pciSlotNames := []string{}
+	for _, gpuItem := range gpuConfig {
+		if gpuItem.Key == "devName" {
+			devName = gpuItem.Value
+		} else if gpuItem.Key == "pciSlotName" {
+			pciSlotNames = append(pciSlotNames, gpuItem.Value)
+		}
+	}
+
+	for i, pciSlotName := range pciSlotNames {
+		err := qemuGPUDevPhysical.Execute(sb, map[string]interface{}{
+			"devName":     devName,
+			"index":       i,
+			"pciSlotName": pciSlotName,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// addSharedMemDevConfig adds the qemu config required for mapping a shared memory object into the VM
+// as an ivshmem device. The object is passed to qemu as a file descriptor, as it runs chrooted.
+func (vm *qemu) addSharedMemDevConfig(sb *strings.Builder, fdFiles *[]string, shmConfig []deviceConfig.RunConfigItem) error {
+	var devName, devPath, size string
+	for _, shmItem := range shmConfig {
+		if shmItem.Key == "devName" {
+			devName = shmItem.Value
+		} else if shmItem.Key == "devPath" {
+			devPath = shmItem.Value
+		} else if shmItem.Key == "size" {
+			size = shmItem.Value
+		}
+	}
+
+	return qemuSharedMemDev.Execute(sb, map[string]interface{}{
+		"devName": devName,
+		"path":    fmt.Sprintf("/proc/self/fd/%d", vm.addFileDescriptor(fdFiles, devPath)),
+		"size":    size,
+	})
+}
+
+// qemuUSBHostDevices returns the device name and the host bus and address pairs of a USB device config.
+func qemuUSBHostDevices(usbConfig []deviceConfig.RunConfigItem) (string, [][2]string) {
+	var devName string
+	hostDevices := [][2]string{}
+	for _, usbItem := range usbConfig {
+		if usbItem.Key == "devName" {
+			devName = usbItem.Value
+		} else if usbItem.Key == "hostDevice" {
+			fields := strings.SplitN(usbItem.Value, ":", 2)
+			if len(fields) == 2 {
+				hostDevices = append(hostDevices, [2]string{fields[0], fields[1]})
+			}
+		}
+	}
+
+	return devName, hostDevices
+}
+
+// qemuUSBRemoved returns whether a USB device run config is for host USB devices unplugged from the
+// host, as reported by USB events.
+func qemuUSBRemoved(usbConfig []deviceConfig.RunConfigItem) bool {
+	for _, usbItem := range usbConfig {
+		if usbItem.Key == "action" {
+			return usbItem.Value == "remove"
+		}
+	}
+
+	return false
+}
+
+// qemuUSBDeviceID returns the qemu device ID of a host USB device passed through to the VM.
+func qemuUSBDeviceID(devName string, hostBus string, hostAddr string) string {
+	return fmt.Sprintf("dev-lxd_%s-%s-%s", devName, hostBus, hostAddr)
+}
+
+// addUSBDevConfig adds the qemu config required for passing host USB devices through to the VM.
+func (vm *qemu) addUSBDevConfig(sb *strings.Builder, usbConfig []deviceConfig.RunConfigItem) error {
+	devName, hostDevices := qemuUSBHostDevices(usbConfig)
+	for _, hostDevice := range hostDevices {
+		err := qemuUSBDevHost.Execute(sb, map[string]interface{}{
+			"devName":  devName,
+			"devID":    qemuUSBDeviceID(devName, hostDevice[0], hostDevice[1]),
+			"hostBus":  hostDevice[0],
+			"hostAddr": hostDevice[1],
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// deviceAttachUSB hot-plugs host USB devices into the running VM. The USB controller is added first
+// if the VM was started without any USB device.
+func (vm *qemu) deviceAttachUSB(usbConfig []deviceConfig.RunConfigItem) error {
+	monitor, err := vm.getMonitor()
+	if err != nil {
+		return err
+	}
+
+	devices, err := monitor.GetDevices()
+	if err != nil {
+		return errors.Wrap(err, "Failed listing VM devices")
+	}
+
+	if !shared.StringInSlice("qemu_usb", devices) {
+		bus := "pcie.0"
+		if vm.architectureName == "ppc64le" {
+			bus = "pci.0"
+		}
+
+		err = monitor.AddDevice(map[string]interface{}{
+			"driver": "qemu-xhci",
+			"id":     "qemu_usb",
+			"bus":    bus,
+		})
+		if err != nil {
+			return errors.Wrap(err, "Failed adding USB controller, restart the instance to add it")
+		}
+	}
+
+	devName, hostDevices := qemuUSBHostDevices(usbConfig)
+	for _, hostDevice := range hostDevices {
+		devID := qemuUSBDeviceID(devName, hostDevice[0], hostDevice[1])
+		if shared.StringInSlice(devID, devices) {
+			continue
+		}
+
+		hostBus, err := strconv.Atoi(hostDevice[0])
+		if err != nil {
+			return err
+		}
+
+		hostAddr, err := strconv.Atoi(hostDevice[1])
+		if err != nil {
+			return err
+		}
+
+		err = monitor.AddDevice(map[string]interface{}{
+			"driver":   "usb-host",
+			"id":       devID,
+			"bus":      "qemu_usb.0",
+			"hostbus":  hostBus,
+			"hostaddr": hostAddr,
+		})
+		if err != nil {
+			return errors.Wrapf(err, "Failed adding USB device %q", devID)
+		}
+	}
+
+	return nil
+}
+
+// deviceDetachUSB hot-unplugs the host USB devices listed in the run config of a device from the
+// running VM, or all of them if none is listed.
+func (vm *qemu) deviceDetachUSB(usbConfig []deviceConfig.RunConfigItem) error {
+	monitor, err := vm.getMonitor()
+	if err != nil {
+		return err
+	}
+
+	devices, err := monitor.GetDevices()
+	if err != nil {
+		return errors.Wrap(err, "Failed listing VM devices")
+	}
+
+	devName, hostDevices := qemuUSBHostDevices(usbConfig)
+	devIDs := []string{}
+	for _, hostDevice := range hostDevices {
+		devIDs = append(devIDs, qemuUSBDeviceID(devName, hostDevice[0], hostDevice[1]))
+	}
+
+	prefix := fmt.Sprintf("dev-lxd_%s-", devName)
+	for _, devID := range devices {
+		// Skip devices of other instance devices whose name starts with the same prefix.
+		if !strings.HasPrefix(devID, prefix) || len(strings.Split(strings.TrimPrefix(devID, prefix), "-")) != 2 {
+			continue
+		}
+
+		if len(devIDs) > 0 && !shared.StringInSlice(devID, devIDs) {
+			continue
+		}
+
+		err = monitor.RemoveDevice(devID)
+		if err != nil {
+			return errors.Wrapf(err, "Failed removing USB device %q", devID)
+		}
+	}
+
+	return nil
+}
+
+// qemuSerialDevice returns the device name, host path and bus of a serial device from its run config.
+func qemuSerialDevice(serialConfig []deviceConfig.RunConfigItem) (string, string, string) {
+	var devName, devPath, bus string
+	for _, serialItem := range serialConfig {
+		if serialItem.Key == "devName" {
+			devName = serialItem.Value
+		} else if serialItem.Key == "devPath" {
+			devPath = serialItem.Value
+		} else if serialItem.Key == "bus" {
+			bus = serialItem.Value
+		}
+	}
+
+	return devName, devPath, bus
+}
+
+// addSerialDevConfig adds the qemu config required for passing a host serial port through to the VM.
+// The port is passed to qemu as a file descriptor, the same way it is when hot-plugging it.
+func (vm *qemu) addSerialDevConfig(sb *strings.Builder, fdFiles *[]string, serialConfig []deviceConfig.RunConfigItem) error {
+	devName, devPath, bus := qemuSerialDevice(serialConfig)
+
+	err := qemuCheckSerialPortName(devName)
+	if err != nil {
+		return err
+	}
+
+	return qemuSerialDev.Execute(sb, map[string]interface{}{
+		"devName": devName,
+		"path":    fmt.Sprintf("/proc/self/fd/%d", vm.addFileDescriptor(fdFiles, devPath)),
+		"bus":     bus,
+	})
+}
+
+// deviceAttachSerial hot-plugs a host serial port into the running VM as a virtio serial port.
+func (vm *qemu) deviceAttachSerial(serialConfig []deviceConfig.RunConfigItem) error {
+	devName, devPath, _ := qemuSerialDevice(serialConfig)
+
+	err := qemuCheckSerialPortName(devName)
+	if err != nil {
+		return err
+	}
+
+	monitor, err := vm.getMonitor()
+	if err != nil {
+		return err
+	}
+
+	// Don't wait for the carrier nor make the port LXD's controlling terminal.
+	f, err := os.OpenFile(devPath, os.O_RDWR|unix.O_NOCTTY|unix.O_NONBLOCK, 0)
+	if err != nil {
+		return errors.Wrapf(err, "Failed opening serial device %q", devPath)
+	}
+	defer f.Close()
+
+	charDevID := fmt.Sprintf("lxd_%s", devName)
+	err = monitor.AddSerialCharDevice(charDevID, f)
+	if err != nil {
+		return errors.Wrapf(err, "Failed adding serial character device %q", charDevID)
+	}
+
+	err = monitor.AddDevice(map[string]interface{}{
+		"driver":  "virtserialport",
+		"id":      fmt.Sprintf("dev-lxd_%s", devName),
+		"bus":     "qemu_serial.0",
+		"name":    devName,
+		"chardev": charDevID,
+	})
+	if err != nil {
+		monitor.RemoveCharDevice(charDevID)
+		return errors.Wrapf(err, "Failed adding serial port %q", devName)
+	}
+
+	return nil
+}
+
+// deviceDetachSerial hot-unplugs a serial port from the running VM along with its character device.
+func (vm *qemu) deviceDetachSerial(serialConfig []deviceConfig.RunConfigItem) error {
+	devName, _, _ := qemuSerialDevice(serialConfig)
+
+	monitor, err := vm.getMonitor()
+	if err != nil {
+		return err
+	}
+
+	err = monitor.RemoveDevice(fmt.Sprintf("dev-lxd_%s", devName))
+	if err != nil {
+		return errors.Wrapf(err, "Failed removing serial port %q", devName)
+	}
+
+	// The character device stays busy until the port is gone.
+	charDevID := fmt.Sprintf("lxd_%s", devName)
+	for i := 0; ; i++ {
+		err = monitor.RemoveCharDevice(charDevID)
+		if err == nil || i >= 10 {
+			break
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	if err != nil {
+		return errors.Wrapf(err, "Failed removing serial character device %q", charDevID)
+	}
+
+	return nil
+}
+
+// tpmPath returns the path of the swtpm state directory. It lives on the config volume so that the
+// TPM state persists across reboots.
+func (vm *qemu) tpmPath() string {
+	return filepath.Join(vm.Path(), "tpm")
+}
+
+// tpmSocketPath returns the path of the swtpm control socket qemu connects to.
+func (vm *qemu) tpmSocketPath() string {
+	return filepath.Join(vm.tpmPath(), "swtpm.sock")
+}
+
+// tpmPidFilePath returns the path where the swtpm process should write its PID.
+func (vm *qemu) tpmPidFilePath() string {
+	return filepath.Join(vm.LogPath(), "swtpm.pid")
+}
+
+// startTPM launches the swtpm process backing the VM's TPM device. The process exits on its own
+// once qemu disconnects from it.
+func (vm *qemu) startTPM() error {
+	swtpmPath, err := exec.LookPath("swtpm")
+	if err != nil {
+		return errors.Wrap(err, "The swtpm tool is required for security.tpm")
+	}
+
+	err = os.MkdirAll(vm.tpmPath(), 0700)
+	if err != nil {
+		return errors.Wrap(err, "Failed creating TPM state directory")
+	}
+
+	// Remove any leftover socket from a previous run.
+	err = os.Remove(vm.tpmSocketPath())
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "Failed removing stale TPM socket")
+	}
+
+	_, err = shared.RunCommand(swtpmPath, "socket",
+		"--tpm2",
+		"--daemon",
+		"--terminate",
+		"--tpmstate", fmt.Sprintf("dir=%s", vm.tpmPath()),
+		"--ctrl", fmt.Sprintf("type=unixio,path=%s", vm.tpmSocketPath()),
+		"--pid", fmt.Sprintf("file=%s", vm.tpmPidFilePath()),
+		"--log", fmt.Sprintf("file=%s", filepath.Join(vm.LogPath(), "swtpm.log")),
+	)
+	if err != nil {
+		return errors.Wrap(err, "Failed starting swtpm")
+	}
+
+	return nil
+}
+
+// stopTPM kills the swtpm process if it is still running.
+func (vm *qemu) stopTPM() error {
+	pidStr, err := ioutil.ReadFile(vm.tpmPidFilePath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(vm.tpmPidFilePath())
+
+	pid, err := strconv.Atoi(strings.TrimSpace(string(pidStr)))
+	if err != nil {
+		return err
+	}
+
+	// Check the PID still belongs to swtpm before killing it.
+	comm, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/comm", pid))
+	if err != nil || strings.TrimSpace(string(comm)) != "swtpm" {
+		return nil
+	}
+
+	proc, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+
+	return proc.Kill()
+}
+
+// stderrFilePath returns the path of the file receiving the output of a qemu process started without
+// -daemonize.
+func (vm *qemu) stderrFilePath() string {
+	return filepath.Join(vm.LogPath(), "qemu.stderr")
+}
+
+// pidFilePath returns the path where the qemu process should write its PID.
+func (vm *qemu) pidFilePath() string {
+	return filepath.Join(vm.LogPath(), "qemu.pid")
+}
+
+// pid gets the PID of the running qemu process.
+func (vm *qemu) pid() (int, error) {
+	pidStr, err := ioutil.ReadFile(vm.pidFilePath())
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+
+	if err != nil {
+		return -1, err
+	}
+
+	pid, err := strconv.Atoi(strings.TrimSpace(string(pidStr)))
+	if err != nil {
+		return -1, err
+	}
+
+	return pid, nil
+}
+
+// qemuTerminate asks a qemu process to exit with SIGTERM, killing it if it's still running after
+// timeout, and waits for it to exit.
+func qemuTerminate(pid int, timeout time.Duration) error {
+	err := unix.Kill(pid, unix.SIGTERM)
+	if err == unix.ESRCH {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	for start := time.Now(); time.Since(start) < timeout; time.Sleep(100 * time.Millisecond) {
+		if unix.Kill(pid, 0) == unix.ESRCH {
+			return nil
+		}
+	}
+
+	return qemuKill(pid, timeout)
+}
+
+// qemuKill kills a qemu process and waits for it to exit. As qemu may have daemonized it isn't
+// necessarily a child of LXD, so the exit is detected by polling. A qemu child is reaped by the
+// goroutine waiting for it.
+func qemuKill(pid int, timeout time.Duration) error {
+	err := unix.Kill(pid, unix.SIGKILL)
+	if err == unix.ESRCH {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	for start := time.Now(); time.Since(start) < timeout; time.Sleep(100 * time.Millisecond) {
+		if unix.Kill(pid, 0) == unix.ESRCH {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("Process %d still running %v after being killed", pid, timeout)
+}
+
+// processArgs returns the command line arguments of the running qemu process, or nil if there is
+// no such process.
+func (vm *qemu) processArgs() ([]string, error) {
+	pid, err := vm.pid()
+	if err != nil {
+		return nil, err
+	}
+
+	if pid <= 0 {
+		return nil, nil
+	}
+
+	cmdline, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	return strings.Split(strings.TrimRight(string(cmdline), "\x00"), "\x00"), nil
+}
+
+// monitorAlive returns whether the qemu process behind the monitor is still around. It is used to
+// tell a transient monitor failure apart from a stopped VM.
+func (vm *qemu) monitorAlive() bool {
+	args, err := vm.processArgs()
+	if err != nil || args == nil {
+		return false
+	}
+
+	// Guard against the PID having been reused by an unrelated process.
+	return shared.StringInSlice(vm.pidFilePath(), args)
+}
+
+// Stop stops the VM.
+func (vm *qemu) Stop(stateful bool) error {
+	// Check that we're not already stopped.
+	if !vm.IsRunning() {
+		return fmt.Errorf("The instance is already stopped")
+	}
+
+	// Check that no stateful stop was requested.
+	if stateful {
+		return fmt.Errorf("Stateful stop isn't supported for VMs at this time")
+	}
+
+	// Setup a new operation.
+	op, err := operationlock.Create(vm.id, "stop", false, true)
+	if err != nil {
+		return err
+	}
+
+	// Connect to the monitor.
+	monitor, err := vm.getMonitor()
+	if err != nil {
+		// The VM is still running but its monitor can't be reached, so it can only be terminated.
+		if vm.monitorAlive() {
+			logger.Warn("Failed to connect to the monitor of the running instance, terminating it", log.Ctx{"project": vm.project, "instance": vm.name, "err": err})
+
+			err = vm.forceStop(op)
+			if err != nil {
+				return err
+			}
+
+			vm.state.Events.SendLifecycle(vm.project, "virtual-machine-stopped", fmt.Sprintf("/1.0/virtual-machines/%s", vm.name), nil)
+			return nil
+		}
+
+		// If we fail to connect, it's most likely because the VM is already off.
+		op.Done(nil)
+		return nil
+	}
+
+	// Get the wait channel.
+	chDisconnect, err := monitor.Wait()
+	if err != nil {
+		if err == qmp.ErrMonitorDisconnect {
+			op.Done(nil)
+			return nil
+		}
+
+		op.Done(err)
+		return err
+	}
+
+	// Keep what the guest logged before its ringbuf goes away with qemu.
+	err = vm.drainGuestLog(monitor)
+	if err != nil {
+		logger.Warn("Failed saving the guest log", log.Ctx{"project": vm.project, "instance": vm.name, "err": err})
+	}
+
+	// Send the quit command.
+	err = monitor.Quit()
+	if err != nil {
+		if err == qmp.ErrMonitorDisconnect {
+			op.Done(nil)
+			return nil
+		}
+
+		op.Done(err)
+		return err
+	}
+
+	// Wait for QEMU to exit (can take a while if pending I/O), terminating it if it's stuck.
+	select {
+	case <-chDisconnect:
+	case <-time.After(qemuStopTimeout):
+		logger.Warn("Instance didn't stop in time, terminating it", log.Ctx{"project": vm.project, "instance": vm.name, "timeout": qemuStopTimeout})
+
+		err = vm.forceStop(op)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Wait for OnStop.
+	err = op.Wait()
+	if err != nil && vm.IsRunning() {
+		return err
+	}
+
+	vm.state.Events.SendLifecycle(vm.project, "virtual-machine-stopped", fmt.Sprintf("/1.0/virtual-machines/%s", vm.name), nil)
+	return nil
+}
+
+// forceStop terminates the qemu process, first with SIGTERM and then SIGKILL if it doesn't exit in
+// time, and runs OnStop itself as qemu may not get to report its shutdown. The stop operation is
+// completed, also on failure.
+func (vm *qemu) forceStop(op *operationlock.InstanceOperation) error {
+	vmForceStopLock.Lock()
+	vmForceStop[vm.id] = true
+	vmForceStopLock.Unlock()
+
+	defer func() {
+		vmForceStopLock.Lock()
+		delete(vmForceStop, vm.id)
+		vmForceStopLock.Unlock()
+	}()
+
+	pid, err := vm.pid()
+	if err != nil {
+		op.Done(err)
+		return err
+	}
+
+	if pid > 0 {
+		// Let the process supervisor know that the upcoming exit is expected.
+		vmShutdownLock.Lock()
+		vmShutdown[vm.id] = pid
+		vmShutdownLock.Unlock()
+
+		err = qemuTerminate(pid, qemuKillTimeout)
+		if err != nil {
+			op.Done(err)
+			return err
+		}
+	}
+
+	// qemu may have reported its shutdown before being terminated, in which case the stop
+	// operation was already completed by OnStop.
+	if operationlock.Get(vm.id) != op {
+		return op.Wait()
+	}
+
+	// OnStop completes the stop operation.
+	return vm.OnStop("stop")
+}
+
+// Unfreeze restores the instance to running.
+func (vm *qemu) Unfreeze() error {
+	// Check that we're paused.
+	if !vm.IsFrozen() {
+		return fmt.Errorf("The instance isn't paused")
+	}
+
+	// Setup a new operation, preventing a concurrent stop from racing with the resume.
+	op, err := operationlock.Create(vm.id, "unfreeze", false, false)
+	if err != nil {
+		return err
+	}
+
+	// Connect to the monitor.
+	monitor, err := vm.getMonitor()
+	if err != nil {
+		op.Done(err)
+		return err
+	}
+
+	// Send the cont command.
+	err = monitor.Start()
+	if err != nil {
+		op.Done(err)
+		return err
+	}
+
+	// The cause of an I/O error pause is expected to be fixed, qemu pauses the VM again otherwise.
+	vm.clearPauseReason()
+
+	op.Done(nil)
+	vm.state.Events.SendLifecycle(vm.project, "virtual-machine-resumed", fmt.Sprintf("/1.0/virtual-machines/%s", vm.name), nil)
+	return nil
+}
+
+// IsPrivileged does not apply to virtual machines. Always returns false.
+func (vm *qemu) IsPrivileged() bool {
+	return false
+}
+
+// Restore restores an instance snapshot.
+func (vm *qemu) Restore(source instance.Instance, stateful bool) error {
+	if stateful {
+		return fmt.Errorf("Stateful snapshots of VMs aren't supported yet")
+	}
+
+	var ctxMap log.Ctx
+
+	// Load the storage driver.
+	pool, err := vm.getStoragePool()
+	if err != nil {
+		return err
+	}
+
+	// Ensure that storage is mounted for backup.yaml updates.
+	ourStart, err := pool.MountInstance(vm, nil)
+	if err != nil {
+		return err
+	}
+	if ourStart {
+		defer pool.UnmountInstance(vm, nil)
+	}
+
+	// Stop the instance.
+	wasRunning := false
+	if vm.IsRunning() {
+		wasRunning = true
+
+		ephemeral := vm.IsEphemeral()
+		if ephemeral {
+			// Unset ephemeral flag.
+			args := db.InstanceArgs{
+				Architecture: vm.Architecture(),
+				Config:       vm.LocalConfig(),
+				Description:  vm.Description(),
+				Devices:      vm.LocalDevices(),
+				Ephemeral:    false,
+				Profiles:     vm.Profiles(),
+				Project:      vm.Project(),
+				Type:         vm.Type(),
+				Snapshot:     vm.IsSnapshot(),
+			}
+
+			err := vm.Update(args, false)
+			if err != nil {
+				return err
+			}
+
+			// On function return, set the flag back on.
+			defer func() {
+				args.Ephemeral = ephemeral
+				vm.Update(args, true)
+			}()
+		}
+
+		// This will unmount the instance storage.
+		err := vm.Stop(false)
+		if err != nil {
+			return err
+		}
+	}
+
+	ctxMap = log.Ctx{
+		"project":   vm.project,
+		"name":      vm.name,
+		"created":   vm.creationDate,
+		"ephemeral": vm.ephemeral,
+		"used":      vm.lastUsedDate,
+		"source":    source.Name()}
+
+	logger.Info("Restoring instance", ctxMap)
+
+	// Restore the rootfs.
+	err = pool.RestoreInstanceSnapshot(vm, source, nil)
+	if err != nil {
+		return err
+	}
+
+	// Restore the configuration, keeping the VM's identity.
+	args := db.InstanceArgs{
+		Architecture: source.Architecture(),
+		Config:       qemuRestoredConfig(vm.localConfig, source.LocalConfig()),
+		Description:  source.Description(),
+		Devices:      source.LocalDevices(),
+		Ephemeral:    source.IsEphemeral(),
+		Profiles:     source.Profiles(),
+		Project:      source.Project(),
+		Type:         source.Type(),
+		Snapshot:     source.IsSnapshot(),
+	}
+
+	err = vm.Update(args, false)
+	if err != nil {
+		logger.Error("Failed restoring instance configuration", ctxMap)
+		return err
+	}
+
+	// The old backup file may be out of date (e.g. it doesn't have all the current snapshots of
+	// the instance listed); let's write a new one to be safe.
+	err = vm.UpdateBackupFile()
+	if err != nil {
+		return err
+	}
+
+	vm.state.Events.SendLifecycle(vm.project, "virtual-machine-snapshot-restored", fmt.Sprintf("/1.0/virtual-machines/%s", vm.name), map[string]interface{}{"snapshot_name": vm.name})
+
+	// Restart the insance.
+	if wasRunning {
+		logger.Info("Restored instance", ctxMap)
+		return vm.Start(false)
+	}
+
+	logger.Info("Restored instance", ctxMap)
+	return nil
+}
+
+// qemuRestoredConfig returns the config of a VM restored from a snapshot. The VM keeps its UUID, as the
+// guest may rely on it not changing (such as for licensing), which the snapshot might lack or predate.
+func qemuRestoredConfig(config map[string]string, snapshotConfig map[string]string) map[string]string {
+	restored := make(map[string]string, len(snapshotConfig))
+	for k, v := range snapshotConfig {
+		restored[k] = v
+	}
+
+	if config["volatile.vm.uuid"] != "" {
+		restored["volatile.vm.uuid"] = config["volatile.vm.uuid"]
+	}
+
+	return restored
+}
+
+// SnapshotDiff lists the configuration keys and devices which differ between an instance and one of
+// its snapshots. Added entries are only on the instance, removed ones only on the snapshot.
+type SnapshotDiff struct {
+	ConfigAdded    []string
+	ConfigRemoved  []string
+	ConfigChanged  []string
+	DevicesAdded   []string
+	DevicesRemoved []string
+	DevicesChanged []string
+}
+
+// DiffSnapshot compares the expanded config and devices of the VM with those of the snapshot with the
+// given name, showing what restoring it would revert.
+func (vm *qemu) DiffSnapshot(name string) (*SnapshotDiff, error) {
+	snap, err := instance.LoadByProjectAndName(vm.state, vm.project, vm.name+shared.SnapshotDelimiter+name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed loading snapshot %q", name)
+	}
+
+	return qemuSnapshotDiff(snap.ExpandedConfig(), snap.ExpandedDevices(), vm.expandedConfig, vm.expandedDevices), nil
+}
+
+// qemuSnapshotDiff compares the given snapshot config and devices with the instance ones. Volatile
+// keys are left out, as they hold runtime state rather than config restoring would revert.
+func qemuSnapshotDiff(snapConfig map[string]string, snapDevices deviceConfig.Devices, config map[string]string, devices deviceConfig.Devices) *SnapshotDiff {
+	diff := &SnapshotDiff{
+		ConfigAdded:    []string{},
+		ConfigRemoved:  []string{},
+		ConfigChanged:  []string{},
+		DevicesAdded:   []string{},
+		DevicesRemoved: []string{},
+		DevicesChanged: []string{},
+	}
+
+	for _, key := range configKeysChanged(snapConfig, config) {
+		if strings.HasPrefix(key, "volatile.") {
+			continue
+		}
+
+		_, inSnap := snapConfig[key]
+		_, inConfig := config[key]
+
+		if !inSnap {
+			diff.ConfigAdded = append(diff.ConfigAdded, key)
+		} else if !inConfig {
+			diff.ConfigRemoved = append(diff.ConfigRemoved, key)
+		} else {
+			diff.ConfigChanged = append(diff.ConfigChanged, key)
+		}
+	}
+
+	// No field is excluded from the comparison, so any difference in a device means it changed.
+	removeDevices, addDevices, _, _ := snapDevices.Update(devices, func(oldDevice deviceConfig.Device, newDevice deviceConfig.Device) []string {
+		return []string{}
+	})
+
+	for name := range addDevices {
+		_, ok := removeDevices[name]
+		if ok {
+			diff.DevicesChanged = append(diff.DevicesChanged, name)
+		} else {
+			diff.DevicesAdded = append(diff.DevicesAdded, name)
+		}
+	}
+
+	for name := range removeDevices {
+		_, ok := addDevices[name]
+		if !ok {
+			diff.DevicesRemoved = append(diff.DevicesRemoved, name)
+		}
+	}
+
+	sort.Strings(diff.ConfigAdded)
+	sort.Strings(diff.ConfigRemoved)
+	sort.Strings(diff.ConfigChanged)
+	sort.Strings(diff.DevicesAdded)
+	sort.Strings(diff.DevicesRemoved)
+	sort.Strings(diff.DevicesChanged)
+
+	return diff
+}
+
+// Snapshots returns a list of snapshots.
+func (vm *qemu) Snapshots() ([]instance.Instance, error) {
+	var snaps []db.Instance
+
+	if vm.IsSnapshot() {
+		return []instance.Instance{}, nil
+	}
+
+	// Get all the snapshots
+	err := vm.state.Cluster.Transaction(func(tx *db.ClusterTx) error {
+		var err error
+		snaps, err = tx.ContainerGetSnapshotsFull(vm.Project(), vm.name)
+		if err != nil {
+			return err
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Build the snapshot list
+	snapshots, err := instance.LoadAllInternal(vm.state, snaps)
+	if err != nil {
+		return nil, err
+	}
+
+	instances := make([]instance.Instance, len(snapshots))
+	for k, v := range snapshots {
+		instances[k] = instance.Instance(v)
+	}
+
+	return instances, nil
+}
+
+// snapshotDiskDevice returns the config of a disk device which can be snapshotted on its own.
+func (vm *qemu) snapshotDiskDevice(devName string) (deviceConfig.Device, error) {
+	dev, found := vm.expandedDevices[devName]
+	if !found {
+		return nil, fmt.Errorf("Device %q doesn't exist", devName)
+	}
+
+	if dev["type"] != "disk" {
+		return nil, fmt.Errorf("Device %q isn't a disk", devName)
+	}
+
+	if shared.IsRootDiskDevice(dev) {
+		return nil, fmt.Errorf("The root disk %q can only be snapshotted along with the instance", devName)
+	}
+
+	if dev["source"] == "" || dev["source"] == "cloud-init:config" || shared.IsTrue(dev["cdrom"]) {
+		return nil, fmt.Errorf("Disk device %q has no writable storage to snapshot", devName)
+	}
+
+	if dev["pool"] == "" && shared.IsDir(shared.HostPath(dev["source"])) {
+		return nil, fmt.Errorf("Disk device %q is a 9p directory share and can't be snapshotted", devName)
+	}
+
+	return dev, nil
+}
+
+// SnapshotDisk takes a snapshot of a single disk device of the VM. Disks of a running VM are snapshotted
+// by qemu within their image, which requires an image format supporting internal snapshots. Disks of
+// a stopped VM are snapshotted by their storage pool when they're custom volumes, or with qemu-img.
+// The root disk is only ever snapshotted along with the rest of the VM.
+func (vm *qemu) SnapshotDisk(devName string, snapshotName string) error {
+	err := storagePools.ValidName(snapshotName)
+	if err != nil {
+		return err
+	}
+
+	dev, err := vm.snapshotDiskDevice(devName)
+	if err != nil {
+		return err
+	}
+
+	if vm.IsRunning() {
+		// Custom volumes are shared with VMs as 9p directory shares.
+		if dev["pool"] != "" {
+			return fmt.Errorf("Disk device %q is a 9p directory share and can't be snapshotted while running", devName)
+		}
+
+		monitor, err := vm.getMonitor()
+		if err != nil {
+			return err
+		}
+
+		err = monitor.SnapshotDrive(fmt.Sprintf("lxd_%s", devName), snapshotName)
+		if err != nil {
+			return errors.Wrapf(err, "Failed snapshotting disk device %q", devName)
+		}
+
+		return nil
+	}
+
+	if dev["pool"] != "" {
+		pool, err := storagePools.GetPoolByName(vm.state, dev["pool"])
+		if err != nil {
+			return err
+		}
+
+		projectName, err := project.StorageVolumeProject(vm.state.Cluster, vm.project, db.StoragePoolVolumeTypeCustom)
+		if err != nil {
+			return err
+		}
+
+		volName := strings.TrimPrefix(dev["source"], fmt.Sprintf("%s/", db.StoragePoolVolumeTypeNameCustom))
+		err = pool.CreateCustomVolumeSnapshot(projectName, volName, snapshotName, nil)
+		if err != nil {
+			return errors.Wrapf(err, "Failed snapshotting disk device %q", devName)
+		}
+
+		return nil
+	}
+
+	_, err = shared.RunCommand("qemu-img", "snapshot", "-c", snapshotName, shared.HostPath(dev["source"]))
+	if err != nil {
+		return errors.Wrapf(err, "Failed snapshotting disk device %q", devName)
+	}
+
+	return nil
+}
+
+// Backups returns a list of backups.
+func (vm *qemu) Backups() ([]backup.Backup, error) {
+	return []backup.Backup{}, nil
+}
+
+// Rename the instance.
+func (vm *qemu) Rename(newName string) error {
+	oldName := vm.Name()
+	ctxMap := log.Ctx{
+		"project":   vm.project,
+		"name":      vm.name,
+		"created":   vm.creationDate,
+		"ephemeral": vm.ephemeral,
+		"used":      vm.lastUsedDate,
+		"newname":   newName}
+
+	logger.Info("Renaming instance", ctxMap)
+
+	// Sanity checks.
+	err := instance.ValidName(newName, vm.IsSnapshot())
+	if err != nil {
+		return err
+	}
+
+	if vm.IsRunning() {
+		return fmt.Errorf("Renaming of running instance not allowed")
+	}
+
+	// Clean things up.
+	vm.cleanup()
+
+	pool, err := storagePools.GetPoolByInstance(vm.state, vm)
+	if err != nil {
+		return errors.Wrap(err, "Load instance storage pool")
+	}
+
+	if vm.IsSnapshot() {
+		_, newSnapName, _ := shared.InstanceGetParentAndSnapshotName(newName)
+		err = pool.RenameInstanceSnapshot(vm, newSnapName, nil)
+		if err != nil {
+			return errors.Wrap(err, "Rename instance snapshot")
+		}
+	} else {
+		err = pool.RenameInstance(vm, newName, nil)
+		if err != nil {
+			return errors.Wrap(err, "Rename instance")
+		}
+	}
+
+	if !vm.IsSnapshot() {
+		// Rename all the instance snapshot database entries.
+		results, err := vm.state.Cluster.ContainerGetSnapshots(vm.project, oldName)
+		if err != nil {
+			logger.Error("Failed to get instance snapshots", ctxMap)
+			return err
+		}
+
+		for _, sname := range results {
+			// Rename the snapshot.
+			oldSnapName := strings.SplitN(sname, shared.SnapshotDelimiter, 2)[1]
+			baseSnapName := filepath.Base(sname)
+			err := vm.state.Cluster.Transaction(func(tx *db.ClusterTx) error {
+				return tx.InstanceSnapshotRename(vm.project, oldName, oldSnapName, baseSnapName)
+			})
+			if err != nil {
+				logger.Error("Failed renaming snapshot", ctxMap)
+				return err
+			}
+		}
+	}
+
+	// Rename the instance database entry.
+	err = vm.state.Cluster.Transaction(func(tx *db.ClusterTx) error {
+		if vm.IsSnapshot() {
+			oldParts := strings.SplitN(oldName, shared.SnapshotDelimiter, 2)
+			newParts := strings.SplitN(newName, shared.SnapshotDelimiter, 2)
+			return tx.InstanceSnapshotRename(vm.project, oldParts[0], oldParts[1], newParts[1])
+		}
+
+		return tx.InstanceRename(vm.project, oldName, newName)
+	})
+	if err != nil {
+		logger.Error("Failed renaming instance", ctxMap)
+		return err
+	}
+
+	// Rename the logging path.
+	os.RemoveAll(shared.LogPath(newName))
+	if shared.PathExists(vm.LogPath()) {
+		err := os.Rename(vm.LogPath(), shared.LogPath(newName))
+		if err != nil {
+			logger.Error("Failed renaming instance", ctxMap)
+			return err
+		}
+	}
+
+	// Rename the MAAS entry.
+	if !vm.IsSnapshot() {
+		err = vm.maasRename(newName)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Rename the backups.
+	backups, err := vm.Backups()
+	if err != nil {
+		return err
+	}
+
+	for _, backup := range backups {
+		backupName := strings.Split(backup.Name(), "/")[1]
+		newName := fmt.Sprintf("%s/%s", newName, backupName)
+
+		err = backup.Rename(newName)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Set the new name in the struct.
+	vm.name = newName
+
+	// Update lease files.
+	network.UpdateDNSMasqStatic(vm.state, "")
+
+	logger.Info("Renamed instance", ctxMap)
+
+	if vm.IsSnapshot() {
+		vm.state.Events.SendLifecycle(vm.project, "virtual-machine-snapshot-renamed",
+			fmt.Sprintf("/1.0/virtual-machines/%s", oldName), map[string]interface{}{
+				"new_name":      newName,
+				"snapshot_name": oldName,
+			})
+	} else {
+		vm.state.Events.SendLifecycle(vm.project, "virtual-machine-renamed",
+			fmt.Sprintf("/1.0/virtual-machines/%s", oldName), map[string]interface{}{
+				"new_name": newName,
+			})
+	}
+
+	return nil
+}
+
+// Update the instance config.
+func (vm *qemu) Update(args db.InstanceArgs, userRequested bool) error {
+	// Set sane defaults for unset keys.
+	if args.Project == "" {
+		args.Project = project.Default
+	}
+
+	if args.Architecture == 0 {
+		args.Architecture = vm.architecture
+	}
+
+	if args.Config == nil {
+		args.Config = map[string]string{}
+	}
+
+	if args.Devices == nil {
+		args.Devices = deviceConfig.Devices{}
+	}
+
+	if args.Profiles == nil {
+		args.Profiles = []string{}
+	}
+
+	// Validate the new config.
+	err := instance.ValidConfig(vm.state.OS, args.Config, false, false)
+	if err != nil {
+		return errors.Wrap(err, "Invalid config")
+	}
+
+	// Validate the new devices without using expanded devices validation (expensive checks disabled).
+	err = instance.ValidDevices(vm.state, vm.state.Cluster, vm.Type(), args.Devices, false)
+	if err != nil {
+		return errors.Wrap(err, "Invalid devices")
+	}
+
+	// Validate the new profiles.
+	profiles, err := vm.state.Cluster.Profiles(args.Project)
+	if err != nil {
+		return errors.Wrap(err, "Failed to get profiles")
+	}
+
+	checkedProfiles := []string{}
+	for _, profile := range args.Profiles {
+		if !shared.StringInSlice(profile, profiles) {
+			return fmt.Errorf("Requested profile '%s' doesn't exist", profile)
+		}
+
+		if shared.StringInSlice(profile, checkedProfiles) {
+			return fmt.Errorf("Duplicate profile found in request")
+		}
+
+		checkedProfiles = append(checkedProfiles, profile)
+	}
+
+	// Validate the new architecture.
+	if args.Architecture != 0 {
+		_, err = osarch.ArchitectureName(args.Architecture)
+		if err != nil {
+			return fmt.Errorf("Invalid architecture ID: %s", err)
+		}
+	}
+
+	// Check that volatile and image keys weren't modified.
+	if userRequested {
+		for k, v := range args.Config {
+			if strings.HasPrefix(k, "volatile.") && vm.localConfig[k] != v {
+				return fmt.Errorf("Volatile keys are read-only")
+			}
+
+			if strings.HasPrefix(k, "image.") && vm.localConfig[k] != v {
+				return fmt.Errorf("Image keys are read-only")
+			}
+		}
+
+		for k, v := range vm.localConfig {
+			if strings.HasPrefix(k, "volatile.") && args.Config[k] != v {
+				return fmt.Errorf("Volatile keys are read-only")
+			}
+
+			if strings.HasPrefix(k, "image.") && args.Config[k] != v {
+				return fmt.Errorf("Image keys are read-only")
+			}
+		}
+	}
+
+	// Get a copy of the old configuration.
+	oldDescription := vm.Description()
+	oldArchitecture := 0
+	err = shared.DeepCopy(&vm.architecture, &oldArchitecture)
+	if err != nil {
+		return err
+	}
+
+	oldEphemeral := false
+	err = shared.DeepCopy(&vm.ephemeral, &oldEphemeral)
+	if err != nil {
+		return err
+	}
+
+	oldExpandedDevices := deviceConfig.Devices{}
+	err = shared.DeepCopy(&vm.expandedDevices, &oldExpandedDevices)
+	if err != nil {
+		return err
+	}
+
+	oldExpandedConfig := map[string]string{}
+	err = shared.DeepCopy(&vm.expandedConfig, &oldExpandedConfig)
+	if err != nil {
+		return err
+	}
+
+	oldLocalDevices := deviceConfig.Devices{}
+	err = shared.DeepCopy(&vm.localDevices, &oldLocalDevices)
+	if err != nil {
+		return err
+	}
+
+	oldLocalConfig := map[string]string{}
+	err = shared.DeepCopy(&vm.localConfig, &oldLocalConfig)
+	if err != nil {
+		return err
+	}
+
+	oldProfiles := []string{}
+	err = shared.DeepCopy(&vm.profiles, &oldProfiles)
+	if err != nil {
+		return err
+	}
+
+	oldExpiryDate := vm.expiryDate
+
+	// Define a function which reverts everything.  Defer this function
+	// so that it doesn't need to be explicitly called in every failing
+	// return path.  Track whether or not we want to undo the changes
+	// using a closure.
+	undoChanges := true
+	defer func() {
+		if undoChanges {
+			vm.description = oldDescription
+			vm.architecture = oldArchitecture
+			vm.ephemeral = oldEphemeral
+			vm.expandedConfig = oldExpandedConfig
+			vm.expandedDevices = oldExpandedDevices
+			vm.localConfig = oldLocalConfig
+			vm.localDevices = oldLocalDevices
+			vm.profiles = oldProfiles
+			vm.expiryDate = oldExpiryDate
+		}
+	}()
+
+	// Apply the various changes.
+	vm.description = args.Description
+	vm.architecture = args.Architecture
+	vm.ephemeral = args.Ephemeral
+	vm.localConfig = args.Config
+	vm.localDevices = args.Devices
+	vm.profiles = args.Profiles
+	vm.expiryDate = args.ExpiryDate
+
+	// Expand the config and refresh the LXC config.
+	err = vm.expandConfig(nil)
+	if err != nil {
+		return errors.Wrap(err, "Expand config")
+	}
+
+	err = vm.expandDevices(nil)
+	if err != nil {
+		return errors.Wrap(err, "Expand devices")
+	}
+
+	// Diff the configurations.
+	changedConfig := configKeysChanged(oldExpandedConfig, vm.expandedConfig)
+
+	// Diff the devices.
+	removeDevices, addDevices, updateDevices, updateDiff := oldExpandedDevices.Update(vm.expandedDevices, func(oldDevice deviceConfig.Device, newDevice deviceConfig.Device) []string {
+		// This function needs to return a list of fields that are excluded from differences
+		// between oldDevice and newDevice. The result of this is that as long as the
+		// devices are otherwise identical except for the fields returned here, then the
+		// device is considered to be being "updated" rather than "added & removed".
+		if oldDevice["type"] != newDevice["type"] || oldDevice.NICType() != newDevice.NICType() {
+			return []string{} // Device types aren't the same, so this cannot be an update.
+		}
+
+		d, err := device.New(vm, vm.state, "", newDevice, nil, nil)
+		if err != nil {
+			return []string{} // Couldn't create Device, so this cannot be an update.
+		}
+
+		_, updateFields := d.CanHotPlug()
+		return updateFields
+	})
+
+	// The root disk may now use another storage pool, so drop the cached pool handle.
+	_, oldRootDiskDevice, _ := shared.GetRootDiskDevice(oldExpandedDevices.CloneNative())
+	_, newRootDiskDevice, _ := shared.GetRootDiskDevice(vm.expandedDevices.CloneNative())
+	if oldRootDiskDevice["pool"] != newRootDiskDevice["pool"] {
+		vm.storagePool = nil
+	}
+
+	// Do some validation of the config diff.
+	err = instance.ValidConfig(vm.state.OS, vm.expandedConfig, false, true)
+	if err != nil {
+		return errors.Wrap(err, "Invalid expanded config")
+	}
+
+	// Do full expanded validation of the devices diff.
+	err = instance.ValidDevices(vm.state, vm.state.Cluster, vm.Type(), vm.expandedDevices, true)
+	if err != nil {
+		return errors.Wrap(err, "Invalid expanded devices")
+	}
+
+	// Check the boot priorities, including that boot.once refers to a bootable device.
+	_, err = vm.deviceBootPriorities()
+	if err != nil {
+		return err
+	}
+
+	// Only some keys and devices can be changed on a running VM.
+	isRunning := vm.IsRunning()
+	if isRunning {
+		err = qemuCheckLiveUpdate(oldExpandedConfig, changedConfig, removeDevices, addDevices)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Re-generating the NVRAM for a secure boot change would discard any keys enrolled by the user.
+	if shared.StringInSlice("security.secureboot", changedConfig) {
+		customKeys, err := vm.nvramHasCustomKeys()
+		if err != nil {
+			return errors.Wrap(err, "Failed checking the secure boot keys of the NVRAM")
+		}
+
+		if customKeys {
+			return fmt.Errorf("Can't change security.secureboot as custom secure boot keys are enrolled in the VM's NVRAM")
+		}
+	}
+
+	// Use the device interface to apply update changes.
+	err = vm.updateDevices(removeDevices, addDevices, updateDevices, oldExpandedDevices)
+	if err != nil {
+		return err
+	}
+
+	// Update MAAS (must run after the MAC addresses have been generated).
+	updateMAAS := false
+	for _, key := range []string{"maas.subnet.ipv4", "maas.subnet.ipv6", "ipv4.address", "ipv6.address"} {
+		if shared.StringInSlice(key, updateDiff) {
+			updateMAAS = true
+			break
+		}
+	}
+
+	if !vm.IsSnapshot() && updateMAAS {
+		err = vm.maasUpdate(oldExpandedDevices.CloneNative())
+		if err != nil {
+			return err
+		}
+	}
+
+	// Hot-plug vCPUs within the room the VM was started with.
+	if isRunning && shared.StringInSlice("limits.cpu", changedConfig) {
+		err = vm.setCPUs(vm.expandedConfig["limits.cpu"])
+		if err != nil {
+			return errors.Wrap(err, "Failed to update vCPUs")
+		}
+	}
+
+	// Hot-add memory within the room the VM was started with.
+	if isRunning && shared.StringInSlice("limits.memory", changedConfig) {
+		cg, err := vm.cgroup()
+		if err != nil {
+			return err
+		}
+
+		err = vm.setMemory(cg)
+		if err != nil {
+			return errors.Wrap(err, "Failed to update memory")
+		}
+	}
+
+	// Apply the new memory overhead to the running VM.
+	if isRunning && shared.StringInSlice("limits.memory.overhead", changedConfig) {
+		cg, err := vm.cgroup()
+		if err != nil {
+			return err
+		}
+
+		err = vm.setCgroupMemoryLimit(cg)
+		if err != nil {
+			return errors.Wrap(err, "Failed to update memory limit")
+		}
+	}
+
+	// Apply the new CPU allowance and priority to the running VM.
+	if isRunning && (shared.StringInSlice("limits.cpu.allowance", changedConfig) || shared.StringInSlice("limits.cpu.priority", changedConfig)) {
+		cg, err := vm.cgroup()
+		if err != nil {
+			return err
+		}
+
+		err = vm.setCgroupCPULimits(cg)
+		if err != nil {
+			return errors.Wrap(err, "Failed to update CPU limits")
+		}
+	}
+
+	// Swap the cloud-init ISO of the running VM for one with the new config. Turning the ISO on or
+	// off only applies on next start.
+	if isRunning && shared.IsTrue(vm.expandedConfig["boot.cloud_init_iso"]) && !shared.StringInSlice("boot.cloud_init_iso", changedConfig) {
+		for _, key := range qemuCloudInitKeys {
+			if shared.StringInSlice(key, changedConfig) {
+				err = vm.updateCloudInitISO()
+				if err != nil {
+					return errors.Wrap(err, "Failed to update the cloud-init ISO")
+				}
+
+				break
+			}
+		}
+	}
+
+	if shared.StringInSlice("security.secureboot", changedConfig) {
+		// Re-generate the NVRAM.
+		err = vm.setupNvram()
+		if err != nil {
+			return err
+		}
+	}
+
+	// Finally, apply the changes to the database.
+	err = query.Retry(func() error {
+		tx, err := vm.state.Cluster.Begin()
+		if err != nil {
+			return err
+		}
+
+		// Snapshots should update only their descriptions and expiry date.
+		if vm.IsSnapshot() {
+			err = db.InstanceSnapshotUpdate(tx, vm.id, vm.description, vm.expiryDate)
+			if err != nil {
+				tx.Rollback()
+				return errors.Wrap(err, "Snapshot update")
+			}
+		} else {
+			err = db.ContainerConfigClear(tx, vm.id)
+			if err != nil {
+				tx.Rollback()
+				return err
+
+			}
+			err = db.ContainerConfigInsert(tx, vm.id, vm.localConfig)
+			if err != nil {
+				tx.Rollback()
+				return errors.Wrap(err, "Config insert")
+			}
+
+			err = db.ContainerProfilesInsert(tx, vm.id, vm.project, vm.profiles)
+			if err != nil {
+				tx.Rollback()
+				return errors.Wrap(err, "Profiles insert")
+			}
+
+			err = db.DevicesAdd(tx, "instance", int64(vm.id), vm.localDevices)
+			if err != nil {
+				tx.Rollback()
+				return errors.Wrap(err, "Device add")
+			}
+
+			err = db.ContainerUpdate(tx, vm.id, vm.description, vm.architecture, vm.ephemeral, vm.expiryDate)
+			if err != nil {
+				tx.Rollback()
+				return errors.Wrap(err, "Instance update")
+			}
+
+		}
+
+		if err := db.TxCommit(tx); err != nil {
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "Failed to update database")
+	}
+
+	err = vm.UpdateBackupFile()
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "Failed to write backup file")
+	}
+
+	// Success, update the closure to mark that the changes should be kept.
+	undoChanges = false
+
+	// Pick up changes of the health check.
+	if !vm.IsSnapshot() && isRunning {
+		vm.registerHealthCheck()
+	}
+
+	var endpoint string
+
+	if vm.IsSnapshot() {
+		parentName, snapName, _ := shared.InstanceGetParentAndSnapshotName(vm.name)
+		endpoint = fmt.Sprintf("/1.0/virtual-machines/%s/snapshots/%s", parentName, snapName)
+	} else {
+		endpoint = fmt.Sprintf("/1.0/virtual-machines/%s", vm.name)
+	}
+
+	vm.state.Events.SendLifecycle(vm.project, "virtual-machine-updated", endpoint, nil)
+	return nil
+}
+
+// qemuLiveUpdateKeys are the config keys applied to a running VM by Update.
+var qemuLiveUpdateKeys = []string{"limits.cpu", "limits.cpu.allowance", "limits.cpu.priority", "limits.memory", "limits.memory.overhead", "security.protection.delete", "security.protection.shift"}
+
+// qemuLiveUpdatePrefixes are the prefixes of the config keys which can be changed on a running VM as
+// they're either only used by LXD or only apply on next start.
+var qemuLiveUpdatePrefixes = []string{"boot.", "environment.", "health_check.", "image.", "snapshots.", "user.", "volatile."}
+
+// qemuHotPlugDevices are the types of the devices which can be added to and removed from a running VM.
+var qemuHotPlugDevices = []string{"serial", "usb"}
+
+// qemuCheckLiveUpdate checks that the config changes and the devices added and removed by an update
+// can be applied to a running VM.
+func qemuCheckLiveUpdate(oldExpandedConfig map[string]string, changedConfig []string, removeDevices deviceConfig.Devices, addDevices deviceConfig.Devices) error {
+	for _, key := range changedConfig {
+		liveUpdate := shared.StringInSlice(key, qemuLiveUpdateKeys)
+		for _, prefix := range qemuLiveUpdatePrefixes {
+			if strings.HasPrefix(key, prefix) {
+				liveUpdate = true
+				break
+			}
+		}
+
+		if !liveUpdate {
+			return fmt.Errorf("Key %q cannot be changed whilst the VM is running", key)
+		}
+	}
+
+	// vCPUs and memory can only be added within the room reserved at start.
+	if shared.StringInSlice("limits.cpu", changedConfig) && oldExpandedConfig["limits.cpu.max"] == "" {
+		return fmt.Errorf("limits.cpu can only be changed whilst the VM is running when it was started with limits.cpu.max")
+	}
+
+	if shared.StringInSlice("limits.memory", changedConfig) && oldExpandedConfig["limits.memory.max"] == "" {
+		return fmt.Errorf("limits.memory can only be changed whilst the VM is running when it was started with limits.memory.max")
+	}
+
+	for _, devices := range []deviceConfig.Devices{removeDevices, addDevices} {
+		for _, dev := range devices.Sorted() {
+			if !shared.StringInSlice(dev.Config["type"], qemuHotPlugDevices) {
+				return fmt.Errorf("Device %q of type %q cannot be added or removed whilst the VM is running", dev.Name, dev.Config["type"])
+			}
+		}
+	}
+
+	return nil
+}
+
+func (vm *qemu) updateDevices(removeDevices deviceConfig.Devices, addDevices deviceConfig.Devices, updateDevices deviceConfig.Devices, oldExpandedDevices deviceConfig.Devices) error {
+	isRunning := vm.IsRunning()
+
+	// Remove devices in reverse order to how they were added.
+	for _, dev := range removeDevices.Reversed() {
+		if isRunning {
+			err := vm.deviceStop(dev.Name, dev.Config)
+			if err == device.ErrUnsupportedDevType {
+				continue // No point in trying to remove device below.
+			} else if err != nil {
+				return errors.Wrapf(err, "Failed to stop device %q", dev.Name)
+			}
+		}
+
+		err := vm.deviceRemove(dev.Name, dev.Config)
+		if err != nil && err != device.ErrUnsupportedDevType {
+			return errors.Wrapf(err, "Failed to remove device %q", dev.Name)
+		}
+
+		// Check whether we are about to add the same device back with updated config and
+		// if not, or if the device type has changed, then remove all volatile keys for
+		// this device (as its an actual removal or a device type change).
+		err = vm.deviceResetVolatile(dev.Name, dev.Config, addDevices[dev.Name])
+		if err != nil {
+			return errors.Wrapf(err, "Failed to reset volatile data for device %q", dev.Name)
+		}
+	}
+
+	// Add devices in sorted order, this ensures that device mounts are added in path order.
+	for _, dev := range addDevices.Sorted() {
+		err := vm.deviceAdd(dev.Name, dev.Config)
+		if err == device.ErrUnsupportedDevType {
+			continue // No point in trying to start device below.
+		} else if err != nil {
+			return errors.Wrapf(err, "Failed to add device %q", dev.Name)
+		}
+
+		if isRunning {
+			_, err := vm.deviceStart(dev.Name, dev.Config, isRunning)
+			if err != nil && err != device.ErrUnsupportedDevType {
+				return errors.Wrapf(err, "Failed to start device %q", dev.Name)
+			}
+		}
+	}
+
+	for _, dev := range updateDevices.Sorted() {
+		err := vm.deviceUpdate(dev.Name, dev.Config, oldExpandedDevices, isRunning)
+		if err != nil && err != device.ErrUnsupportedDevType {
+			return errors.Wrapf(err, "Failed to update device %q", dev.Name)
+		}
+	}
+
+	return nil
+}
+
+// deviceUpdate loads a new device and calls its Update() function.
+func (vm *qemu) deviceUpdate(deviceName string, rawConfig deviceConfig.Device, oldDevices deviceConfig.Devices, isRunning bool) error {
+	d, _, err := vm.deviceLoad(deviceName, rawConfig)
+	if err != nil {
+		return err
+	}
+
+	err = d.Update(oldDevices, isRunning)
+	if err != nil {
+		return err
+	}
+
+	// Swap the media of CD-ROM drives.
+	if isRunning && rawConfig["type"] == "disk" && shared.IsTrue(rawConfig["cdrom"]) && oldDevices[deviceName]["source"] != rawConfig["source"] {
+		err = vm.deviceChangeMedia(deviceName, rawConfig["source"])
+		if err != nil {
+			return errors.Wrapf(err, "Failed changing media of device %q", deviceName)
+		}
+	}
+
+	return nil
+}
+
+// deviceResetVolatile resets a device's volatile data when its removed or updated in such a way
+// that it is removed then added immediately afterwards.
+func (vm *qemu) deviceResetVolatile(devName string, oldConfig, newConfig deviceConfig.Device) error {
+	volatileClear := make(map[string]string)
+	devicePrefix := fmt.Sprintf("volatile.%s.", devName)
+
+	// If the device type has changed, remove all old volatile keys.
+	// This will occur if the newConfig is empty (i.e the device is actually being removed) or
+	// if the device type is being changed but keeping the same name.
+	if newConfig["type"] != oldConfig["type"] || newConfig.NICType() != oldConfig.NICType() {
+		for k := range vm.localConfig {
+			if !strings.HasPrefix(k, devicePrefix) {
+				continue
+			}
+
+			volatileClear[k] = ""
+		}
+
+		return vm.VolatileSet(volatileClear)
+	}
+
+	// If the device type remains the same, then just remove any volatile keys that have
+	// the same key name present in the new config (i.e the new config is replacing the
+	// old volatile key).
+	for k := range vm.localConfig {
+		if !strings.HasPrefix(k, devicePrefix) {
+			continue
+		}
+
+		devKey := strings.TrimPrefix(k, devicePrefix)
+		if _, found := newConfig[devKey]; found {
+			volatileClear[k] = ""
+		}
+	}
+
+	return vm.VolatileSet(volatileClear)
+}
+
+func (vm *qemu) removeUnixDevices() error {
+	// Check that we indeed have devices to remove.
+	if !shared.PathExists(vm.DevicesPath()) {
+		return nil
+	}
+
+	// Load the directory listing.
+	dents, err := ioutil.ReadDir(vm.DevicesPath())
+	if err != nil {
+		return err
+	}
+
+	// Go through all the unix devices.
+	for _, f := range dents {
+		// Skip non-Unix devices.
+		if !strings.HasPrefix(f.Name(), "forkmknod.unix.") && !strings.HasPrefix(f.Name(), "unix.") && !strings.HasPrefix(f.Name(), "infiniband.unix.") {
+			continue
+		}
+
+		// Remove the entry
+		devicePath := filepath.Join(vm.DevicesPath(), f.Name())
+		err := os.Remove(devicePath)
+		if err != nil {
+			logger.Error("Failed removing unix device", log.Ctx{"err": err, "path": devicePath})
+		}
+	}
+
+	return nil
+}
+
+func (vm *qemu) removeDiskDevices() error {
+	// Check that we indeed have devices to remove.vm
+	if !shared.PathExists(vm.DevicesPath()) {
+		return nil
+	}
+
+	// Load the directory listing.
+	dents, err := ioutil.ReadDir(vm.DevicesPath())
+	if err != nil {
+		return err
+	}
+
+	// Go through all the unix devices
+	for _, f := range dents {
+		// Skip non-disk devices
+		if !strings.HasPrefix(f.Name(), "disk.") {
+			continue
+		}
+
+		// Always try to unmount the host side
+		_ = unix.Unmount(filepath.Join(vm.DevicesPath(), f.Name()), unix.MNT_DETACH)
+
+		// Remove the entry
+		diskPath := filepath.Join(vm.DevicesPath(), f.Name())
+		err := os.Remove(diskPath)
+		if err != nil {
+			logger.Error("Failed to remove disk device path", log.Ctx{"err": err, "path": diskPath})
+		}
+	}
+
+	return nil
+}
+
+func (vm *qemu) cleanup() {
+	// Unmount any leftovers
+	vm.removeUnixDevices()
+	vm.removeDiskDevices()
+
+	// Remove the devices path
+	os.Remove(vm.DevicesPath())
+
+	// Remove the shmounts path
+	os.RemoveAll(vm.ShmountsPath())
+}
+
+// cleanupDevices performs any needed device cleanup steps when instance is stopped. Disks are stopped
+// one after the other in sorted order while the other devices are stopped concurrently.
+func (vm *qemu) cleanupDevices() {
+	devices := vm.expandedDevices.Sorted()
+	volatile := vm.newDeviceVolatile()
+
+	// Load all the devices first, as loading NICs may update their volatile config.
+	loaded := make([]device.Device, len(devices))
+	for i, dev := range devices {
+		d, _, err := vm.deviceLoadVolatile(dev.Name, dev.Config, volatile.getFunc(dev.Name), volatile.setFunc(dev.Name))
+		if err == device.ErrUnsupportedDevType {
+			continue
+		}
+
+		// Previously valid devices may fail the validation of a newer LXD, still stop them if possible.
+		if err != nil {
+			logger.Errorf("Device stop validation failed for '%s': %v", dev.Name, err)
+			if d == nil {
+				continue
+			}
+		}
+
+		loaded[i] = d
+	}
+
+	isRunning := vm.IsRunning()
+	stop := func(i int) {
+		err := vm.deviceStopLoaded(loaded[i], isRunning)
+		if err != nil {
+			logger.Errorf("Failed to stop device '%s': %v", devices[i].Name, err)
+		}
+	}
+
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		for i, dev := range devices {
+			if loaded[i] != nil && dev.Config["type"] == "disk" {
+				stop(i)
+			}
+		}
+	}()
+
+	for i, dev := range devices {
+		if loaded[i] == nil || dev.Config["type"] == "disk" {
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			stop(i)
+		}(i)
+	}
+
+	wg.Wait()
+
+	err := volatile.apply()
+	if err != nil {
+		logger.Error("Failed to record the volatile config of the devices", log.Ctx{"project": vm.project, "instance": vm.name, "err": err})
+	}
+}
+
+func (vm *qemu) init() error {
+	// Compute the expanded config and device list.
+	err := vm.expandConfig(nil)
+	if err != nil {
+		return err
+	}
+
+	err = vm.expandDevices(nil)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Delete the instance.
+func (vm *qemu) Delete() error {
+	ctxMap := log.Ctx{
+		"project":   vm.project,
+		"name":      vm.name,
+		"created":   vm.creationDate,
+		"ephemeral": vm.ephemeral,
+		"used":      vm.lastUsedDate}
+
+	logger.Info("Deleting instance", ctxMap)
+
+	// Check if instance is delete protected.
+	if shared.IsTrue(vm.expandedConfig["security.protection.delete"]) && !vm.IsSnapshot() {
+		return fmt.Errorf("Instance is protected")
+	}
+
+	// Check if we're dealing with "lxd import".
+	// TODO consider lxd import detection for VMs.
+	isImport := false
+
+	// Attempt to initialize storage interface for the instance.
+	pool, err := vm.getStoragePool()
+	if err != nil && err != db.ErrNoSuchObject {
+		return err
+	} else if pool != nil {
+		if vm.IsSnapshot() {
+			if !isImport {
+				// Remove snapshot volume and database record.
+				err = pool.DeleteInstanceSnapshot(vm, nil)
+				if err != nil {
+					return err
+				}
+			}
+		} else {
+			// Remove all snapshots by initialising each snapshot as an Instance and
+			// calling its Delete function.
+			err := instance.DeleteSnapshots(vm.state, vm.Project(), vm.Name())
+			if err != nil {
+				return err
+			}
+
+			if !isImport {
+				// Remove the storage volume, snapshot volumes and database records.
+				err = pool.DeleteInstance(vm, nil)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	// Perform other cleanup steps if not snapshot.
+	if !vm.IsSnapshot() {
+		// Remove all backups.
+		backups, err := vm.Backups()
+		if err != nil {
+			return err
+		}
+
+		for _, backup := range backups {
+			err = backup.Delete()
+			if err != nil {
+				return err
+			}
+		}
+
+		// Delete the MAAS entry.
+		err = vm.maasDelete()
+		if err != nil {
+			logger.Error("Failed deleting instance MAAS record", log.Ctx{"project": vm.Project(), "instance": vm.Name(), "err": err})
+			return err
+		}
+
+		// Run device removal function for each device.
+		for k, m := range vm.expandedDevices {
+			err = vm.deviceRemove(k, m)
+			if err != nil && err != device.ErrUnsupportedDevType {
+				return errors.Wrapf(err, "Failed to remove device '%s'", k)
+			}
+		}
+
+		// Clean things up.
+		vm.cleanup()
+	}
+
+	// Remove the database record of the instance or snapshot instance.
+	if err := vm.state.Cluster.InstanceRemove(vm.Project(), vm.Name()); err != nil {
+		logger.Error("Failed deleting instance entry", log.Ctx{"project": vm.Project(), "instance": vm.Name(), "err": err})
+		return err
+	}
+
+	logger.Info("Deleted instance", ctxMap)
+
+	if vm.IsSnapshot() {
+		vm.state.Events.SendLifecycle(vm.project, "virtual-machine-snapshot-deleted",
+			fmt.Sprintf("/1.0/virtual-machines/%s", vm.name), map[string]interface{}{
+				"snapshot_name": vm.name,
+			})
+	} else {
+		vm.state.Events.SendLifecycle(vm.project, "virtual-machine-deleted",
+			fmt.Sprintf("/1.0/virtual-machines/%s", vm.name), nil)
+	}
+
+	return nil
+}
+
+func (vm *qemu) deviceAdd(deviceName string, rawConfig deviceConfig.Device) error {
+	d, _, err := vm.deviceLoad(deviceName, rawConfig)
+	if err != nil {
+		return err
+	}
+
+	return d.Add()
+}
+
+func (vm *qemu) deviceRemove(deviceName string, rawConfig deviceConfig.Device) error {
+	d, _, err := vm.deviceLoad(deviceName, rawConfig)
+
+	// If deviceLoad fails with unsupported device type then return.
+	if err == device.ErrUnsupportedDevType {
+		return err
+	}
+
+	// If deviceLoad fails for any other reason then just log the error and proceed, as in the
+	// scenario that a new version of LXD has additional validation restrictions than older
+	// versions we still need to allow previously valid devices to be stopped.
+	if err != nil {
+		logger.Errorf("Device remove validation failed for '%s': %v", deviceName, err)
+	}
+
+	return d.Remove()
+}
+
+// Export publishes the instance.
+func (vm *qemu) Export(w io.Writer, properties map[string]string) error {
+	ctxMap := log.Ctx{
+		"project":   vm.project,
+		"name":      vm.name,
+		"created":   vm.creationDate,
+		"ephemeral": vm.ephemeral,
+		"used":      vm.lastUsedDate}
+
+	if vm.IsRunning() {
+		return fmt.Errorf("Cannot export a running instance as an image")
+	}
+
+	// Separate the export options from the image properties and validate them.
+	format, compression, properties := qemuExportOptions(properties)
+
+	formats := []string{"raw"}
+	if format != "raw" {
+		var err error
+		formats, err = qemuImgFormats()
+		if err != nil {
+			return err
+		}
+	}
+
+	convertArgs, err := qemuExportConvertArgs(format, compression, formats)
+	if err != nil {
+		return err
+	}
+
+	logger.Info("Exporting instance", ctxMap)
+
+	// Start the storage.
+	ourStart, err := vm.mount()
+	if err != nil {
+		logger.Error("Failed exporting instance", ctxMap)
+		return err
+	}
+	if ourStart {
+		defer vm.unmount()
+	}
+
+	// Create the tarball.
+	ctw := containerwriter.NewContainerTarWriter(w, nil)
+
+	// Path inside the tar image is the pathname starting after cDir.
+	cDir := vm.Path()
+	offset := len(cDir) + 1
+
+	writeToTar := func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		err = ctw.WriteFile(offset, path, fi)
+		if err != nil {
+			logger.Debugf("Error tarring up %s: %s", path, err)
+			return err
+		}
+
+		return nil
+	}
+
+	// Look for metadata.yaml.
+	fnam := filepath.Join(cDir, "metadata.yaml")
+	if !shared.PathExists(fnam) {
+		// Generate a new metadata.yaml.
+		tempDir, err := ioutil.TempDir("", "lxd_lxd_metadata_")
+		if err != nil {
+			ctw.Close()
+			logger.Error("Failed exporting instance", ctxMap)
+			return err
+		}
+		defer os.RemoveAll(tempDir)
+
+		// Get the instance's architecture.
+		var arch string
+		if vm.IsSnapshot() {
+			parentName, _, _ := shared.InstanceGetParentAndSnapshotName(vm.name)
+			parent, err := instance.LoadByProjectAndName(vm.state, vm.project, parentName)
+			if err != nil {
+				ctw.Close()
+				logger.Error("Failed exporting instance", ctxMap)
+				return err
+			}
+
+			arch, _ = osarch.ArchitectureName(parent.Architecture())
+		} else {
+			arch, _ = osarch.ArchitectureName(vm.architecture)
+		}
+
+		if arch == "" {
+			arch, err = osarch.ArchitectureName(vm.state.OS.Architectures[0])
+			if err != nil {
+				logger.Error("Failed exporting instance", ctxMap)
+				return err
+			}
+		}
+
+		// Fill in the metadata.
+		meta := api.ImageMetadata{}
+		meta.Architecture = arch
+		meta.CreationDate = time.Now().UTC().Unix()
+		meta.Properties = properties
+
+		data, err := yaml.Marshal(&meta)
+		if err != nil {
+			ctw.Close()
+			logger.Error("Failed exporting instance", ctxMap)
+			return err
+		}
+
+		// Write the actual file.
+		fnam = filepath.Join(tempDir, "metadata.yaml")
+		err = ioutil.WriteFile(fnam, data, 0644)
+		if err != nil {
+			ctw.Close()
+			logger.Error("Failed exporting instance", ctxMap)
+			return err
+		}
+
+		fi, err := os.Lstat(fnam)
+		if err != nil {
+			ctw.Close()
+			logger.Error("Failed exporting instance", ctxMap)
+			return err
+		}
+
+		tmpOffset := len(filepath.Dir(fnam)) + 1
+		if err := ctw.WriteFile(tmpOffset, fnam, fi); err != nil {
+			ctw.Close()
+			logger.Error("Failed exporting instance", ctxMap)
+			return err
+		}
+	} else {
+		if properties != nil {
+			// Parse the metadata.
+			content, err := ioutil.ReadFile(fnam)
+			if err != nil {
+				ctw.Close()
+				logger.Error("Failed exporting instance", ctxMap)
+				return err
+			}
+
+			metadata := new(api.ImageMetadata)
+			err = yaml.Unmarshal(content, &metadata)
+			if err != nil {
+				ctw.Close()
+				logger.Error("Failed exporting instance", ctxMap)
+				return err
+			}
+			metadata.Properties = properties
+
+			// Generate a new metadata.yaml.
+			tempDir, err := ioutil.TempDir("", "lxd_lxd_metadata_")
+			if err != nil {
+				ctw.Close()
+				logger.Error("Failed exporting instance", ctxMap)
+				return err
+			}
+			defer os.RemoveAll(tempDir)
+
+			data, err := yaml.Marshal(&metadata)
+			if err != nil {
+				ctw.Close()
+				logger.Error("Failed exporting instance", ctxMap)
+				return err
+			}
+
+			// Write the actual file.
+			fnam = filepath.Join(tempDir, "metadata.yaml")
+			err = ioutil.WriteFile(fnam, data, 0644)
+			if err != nil {
+				ctw.Close()
+				logger.Error("Failed exporting instance", ctxMap)
+				return err
+			}
+		}
+
+		// Include metadata.yaml in the tarball.
+		fi, err := os.Lstat(fnam)
+		if err != nil {
+			ctw.Close()
+			logger.Debugf("Error statting %s during export", fnam)
+			logger.Error("Failed exporting instance", ctxMap)
+			return err
+		}
+
+		if properties != nil {
+			tmpOffset := len(filepath.Dir(fnam)) + 1
+			err = ctw.WriteFile(tmpOffset, fnam, fi)
+		} else {
+			err = ctw.WriteFile(offset, fnam, fi)
+		}
+		if err != nil {
+			ctw.Close()
+			logger.Debugf("Error writing to tarfile: %s", err)
+			logger.Error("Failed exporting instance", ctxMap)
+			return err
+		}
+	}
+
+	// Convert and include the root image.
+	pool, err := vm.getStoragePool()
+	if err != nil {
+		return err
+	}
+
+	rootDrivePath, err := pool.GetInstanceDisk(vm)
+	if err != nil {
+		return err
+	}
+
+	// Convert the root image to the export format and add to tarball. Raw images are streamed as is, root
+	// disks created as qcow2 overlays are always converted to flatten them with their base.
+	srcFormat := storageDrivers.BlockFileFormat(rootDrivePath)
+	var img *os.File
+	if format == "raw" && srcFormat == "raw" {
+		img, err = os.Open(rootDrivePath)
+	} else {
+		// qemu-img needs a seekable target, so the image is converted into a scratch file first.
+		var size int64
+		size, err = qemuMeasureImage(rootDrivePath, srcFormat, format)
+		if err == nil {
+			convertArgs = append([]string{"-f", srcFormat}, convertArgs...)
+			img, err = qemuConvertImage(shared.VarPath("images"), rootDrivePath, size, convertArgs...)
+		}
+		err = errors.Wrapf(err, "Failed converting image to %s", format)
+	}
+	if err != nil {
+		logger.Error("Failed exporting instance", ctxMap)
+		return err
+	}
+	defer img.Close()
+
+	// Seeking to the end gets the size of both files and block devices.
+	imgSize, err := img.Seek(0, io.SeekEnd)
+	if err != nil {
+		logger.Error("Failed exporting instance", ctxMap)
+		return err
+	}
+
+	_, err = img.Seek(0, io.SeekStart)
+	if err != nil {
+		logger.Error("Failed exporting instance", ctxMap)
+		return err
+	}
+
+	err = ctw.WriteFileFromReader("rootfs.img", imgSize, 0600, img)
+	if err != nil {
+		logger.Error("Failed exporting instance", ctxMap)
+		return err
+	}
+
+	// Include all the templates.
+	fnam = vm.TemplatesPath()
+	if shared.PathExists(fnam) {
+		err = filepath.Walk(fnam, writeToTar)
+		if err != nil {
+			logger.Error("Failed exporting instance", ctxMap)
+			return err
+		}
+	}
+
+	err = ctw.Close()
+	if err != nil {
+		logger.Error("Failed exporting instance", ctxMap)
+		return err
+	}
+
+	logger.Info("Exported instance", ctxMap)
+	return nil
+}
+
+// qemuExportOptions separates the export.format and export.compression options from the image
+// properties passed to Export, returning the options and the remaining properties. The format
+// defaults to qcow2.
+func qemuExportOptions(properties map[string]string) (string, string, map[string]string) {
+	if properties == nil {
+		return "qcow2", "", nil
+	}
+
+	imageProperties := make(map[string]string, len(properties))
+	for k, v := range properties {
+		if k == "export.format" || k == "export.compression" {
+			continue
+		}
+
+		imageProperties[k] = v
+	}
+
+	format := properties["export.format"]
+	if format == "" {
+		format = "qcow2"
+	}
+
+	return format, properties["export.compression"], imageProperties
+}
+
+// qemuImgFormats returns the image formats supported by qemu-img.
+func qemuImgFormats() ([]string, error) {
+	out, err := shared.RunCommand("qemu-img", "--help")
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed getting the formats supported by qemu-img")
+	}
+
+	return qemuParseImgFormats(out), nil
+}
+
+// qemuParseImgFormats parses the "Supported formats:" line of qemu-img --help.
+func qemuParseImgFormats(out string) []string {
+	for _, line := range strings.Split(out, "\n") {
+		if strings.HasPrefix(line, "Supported formats:") {
+			return strings.Fields(strings.TrimPrefix(line, "Supported formats:"))
+		}
+	}
+
+	return []string{}
+}
+
+// qemuExportConvertArgs validates the export format and compression against the formats supported
+// by qemu-img and returns the matching qemu-img convert arguments. qcow2 defaults to zlib compression,
+// compression is only available with qcow2.
+func qemuExportConvertArgs(format string, compression string, formats []string) ([]string, error) {
+	if !shared.StringInSlice(format, formats) {
+		return nil, fmt.Errorf("Unsupported export format %q", format)
+	}
+
+	if compression == "" {
+		compression = "none"
+		if format == "qcow2" {
+			compression = "zlib"
+		}
+	}
+
+	args := []string{}
+	if format != "qcow2" {
+		if compression != "none" {
+			return nil, fmt.Errorf("Compression isn't supported with the %q export format", format)
+		}
+	} else {
+		switch compression {
+		case "zlib":
+			args = append(args, "-c")
+		case "zstd":
+			args = append(args, "-c", "-o", "compression_type=zstd")
+		case "none":
+		default:
+			return nil, fmt.Errorf("Unsupported export compression %q", compression)
+		}
+	}
+
+	return append(args, "-O", format), nil
+}
+
+// qemuMeasureImage returns the size the disk at srcPath can take at most once converted to format, as
+// measured by qemu-img.
+func qemuMeasureImage(srcPath string, srcFormat string, format string) (int64, error) {
+	out, err := shared.RunCommand("qemu-img", "measure", "--output=json", "-f", srcFormat, "-O", format, srcPath)
+	if err != nil {
+		return -1, errors.Wrapf(err, "Failed measuring %q", srcPath)
+	}
+
+	measure := struct {
+		Required int64 `json:"required"`
+	}{}
+
+	err = json.Unmarshal([]byte(out), &measure)
+	if err != nil {
+		return -1, errors.Wrapf(err, "Invalid qemu-img measure output")
+	}
+
+	return measure.Required, nil
+}
+
+// qemuConvertImage converts the disk at srcPath using qemu-img convert with the supplied arguments. The
+// result is written to a scratch file in dir which is unlinked straight away, qemu-img writes to it
+// through an inherited file descriptor. This way the converted image is never visible on disk and is
+// released as soon as the returned file is closed, whether the export succeeds or not. As the scratch
+// file takes up to size bytes, the conversion is refused when dir has less space available.
+func qemuConvertImage(dir string, srcPath string, size int64, args ...string) (*os.File, error) {
+	st, err := shared.Statvfs(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	available := int64(st.Bavail) * int64(st.Bsize)
+	if available < size {
+		return nil, fmt.Errorf("Not enough space in %q to convert the image, %s needed but only %s available", dir, units.GetByteSizeString(size, 2), units.GetByteSizeString(available, 2))
+	}
+
+	f, err := ioutil.TempFile(dir, "lxd_export_")
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.Remove(f.Name())
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	// The scratch file is the first extra file, so fd 3 in qemu-img.
+	cmdArgs := append([]string{"convert"}, args...)
+	cmdArgs = append(cmdArgs, srcPath, "/proc/self/fd/3")
+
+	cmd := exec.Command("qemu-img", cmdArgs...)
+	cmd.ExtraFiles = []*os.File{f}
+
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("Failed to run qemu-img: %v (%s)", err, strings.TrimSpace(string(out)))
+	}
+
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// Migrate migrates the instance to another node.
+func (vm *qemu) Migrate(args *instance.CriuMigrationArgs) error {
+	return instance.ErrNotImplemented
+}
+
+// CGroupSet is not implemented for VMs.
+func (vm *qemu) CGroupSet(key string, value string) error {
+	return instance.ErrNotImplemented
+}
+
+// VolatileSet sets one or more volatile config keys.
+func (vm *qemu) VolatileSet(changes map[string]string) error {
+	// Sanity check.
+	for key := range changes {
+		if !strings.HasPrefix(key, "volatile.") {
+			return fmt.Errorf("Only volatile keys can be modified with VolatileSet")
+		}
+	}
+
+	// Update the database.
+	var err error
+	if vm.IsSnapshot() {
+		err = vm.state.Cluster.Transaction(func(tx *db.ClusterTx) error {
+			return tx.InstanceSnapshotConfigUpdate(vm.id, changes)
+		})
+	} else {
+		err = vm.state.Cluster.Transaction(func(tx *db.ClusterTx) error {
+			return tx.ContainerConfigUpdate(vm.id, changes)
+		})
+	}
+	if err != nil {
+		return errors.Wrap(err, "Failed to volatile config")
+	}
+
+	// Apply the change locally.
+	for key, value := range changes {
+		if value == "" {
+			delete(vm.expandedConfig, key)
+			delete(vm.localConfig, key)
+			continue
+		}
+
+		vm.expandedConfig[key] = value
+		vm.localConfig[key] = value
+	}
+
+	return nil
+}
+
+// FileExists is not implemented for VMs.
+func (vm *qemu) FileExists(path string) error {
+	return instance.ErrNotImplemented
+}
+
+// FilePull retrieves a file from the instance.
+func (vm *qemu) FilePull(srcPath string, dstPath string) (int64, int64, os.FileMode, string, []string, error) {
+	client, err := vm.getAgentClient()
+	if err != nil {
+		return 0, 0, 0, "", nil, err
+	}
+
+	agent, err := lxdClient.ConnectLXDHTTP(nil, client)
+	if err != nil {
+		logger.Errorf("Failed to connect to lxd-agent on %s: %v", vm.Name(), err)
+		return 0, 0, 0, "", nil, fmt.Errorf("Failed to connect to lxd-agent")
+	}
+	defer agent.Disconnect()
+
+	content, resp, err := agent.GetInstanceFile("", srcPath)
+	if err != nil {
+		return 0, 0, 0, "", nil, err
+	}
+
+	switch resp.Type {
+	case "file", "symlink":
+		data, err := ioutil.ReadAll(content)
+		if err != nil {
+			return 0, 0, 0, "", nil, err
+		}
+
+		err = ioutil.WriteFile(dstPath, data, os.FileMode(resp.Mode))
+		if err != nil {
+			return 0, 0, 0, "", nil, err
+		}
+
+		err = os.Lchown(dstPath, int(resp.UID), int(resp.GID))
+		if err != nil {
+			return 0, 0, 0, "", nil, err
+		}
+
+		return resp.UID, resp.GID, os.FileMode(resp.Mode), resp.Type, nil, nil
+	case "directory":
+		return resp.UID, resp.GID, os.FileMode(resp.Mode), resp.Type, resp.Entries, nil
+	}
+
+	return 0, 0, 0, "", nil, fmt.Errorf("bad file type %s", resp.Type)
+}
+
+// FilePush pushes a file into the instance.
+func (vm *qemu) FilePush(fileType string, srcPath string, dstPath string, uid int64, gid int64, mode int, write string) error {
+	client, err := vm.getAgentClient()
+	if err != nil {
+		return err
+	}
+
+	agent, err := lxdClient.ConnectLXDHTTP(nil, client)
+	if err != nil {
+		logger.Errorf("Failed to connect to lxd-agent on %s: %v", vm.Name(), err)
+		return fmt.Errorf("Failed to connect to lxd-agent")
+	}
+	defer agent.Disconnect()
+
+	args := lxdClient.InstanceFileArgs{
+		GID:       gid,
+		Mode:      mode,
+		Type:      fileType,
+		UID:       uid,
+		WriteMode: write,
+	}
+
+	if fileType == "file" {
+		f, err := os.Open(srcPath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		args.Content = f
+	} else if fileType == "symlink" {
+		symlinkTarget, err := os.Readlink(dstPath)
+		if err != nil {
+			return err
+		}
+
+		args.Content = bytes.NewReader([]byte(symlinkTarget))
+	}
+
+	err = agent.CreateInstanceFile("", dstPath, args)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// FilePullTree writes the file tree at srcPath in the instance to w as a tar archive, preserving
+// modes, ownership and symlinks. The whole tree is transferred in a single request.
+func (vm *qemu) FilePullTree(srcPath string, w io.Writer) error {
+	client, err := vm.getAgentClient()
+	if err != nil {
+		return err
+	}
+
+	agent, err := lxdClient.ConnectLXDHTTP(nil, client)
+	if err != nil {
+		logger.Errorf("Failed to connect to lxd-agent on %s: %v", vm.Name(), err)
+		return fmt.Errorf("Failed to connect to lxd-agent")
+	}
+	defer agent.Disconnect()
+
+	content, err := agent.GetInstanceFileTree("", srcPath)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+
+	_, err = io.Copy(w, content)
+	if err != nil {
+		return errors.Wrapf(err, "Failed pulling %q", srcPath)
+	}
+
+	return nil
+}
+
+// FilePushTree extracts the tar archive read from r into dstPath in the instance, preserving modes
+// and symlinks, with all the entries owned by uid and gid (as in the archive if -1). The whole tree is
+// transferred in a single request. If the transfer fails, the agent removes the entries it created
+// in dstPath again.
+func (vm *qemu) FilePushTree(r io.Reader, dstPath string, uid int64, gid int64) error {
+	client, err := vm.getAgentClient()
+	if err != nil {
+		return err
+	}
+
+	agent, err := lxdClient.ConnectLXDHTTP(nil, client)
+	if err != nil {
+		logger.Errorf("Failed to connect to lxd-agent on %s: %v", vm.Name(), err)
+		return fmt.Errorf("Failed to connect to lxd-agent")
+	}
+	defer agent.Disconnect()
+
+	args := lxdClient.InstanceFileTreeArgs{
+		Content: r,
+		UID:     uid,
+		GID:     gid,
+	}
+
+	err = agent.CreateInstanceFileTree("", dstPath, args)
+	if err != nil {
+		return errors.Wrapf(err, "Failed pushing to %q", dstPath)
+	}
+
+	return nil
+}
+
+// FileRemove removes a file from the instance.
+func (vm *qemu) FileRemove(path string) error {
+	// Connect to the agent.
+	client, err := vm.getAgentClient()
+	if err != nil {
+		return err
+	}
+
+	agent, err := lxdClient.ConnectLXDHTTP(nil, client)
+	if err != nil {
+		return fmt.Errorf("Failed to connect to lxd-agent")
+	}
+	defer agent.Disconnect()
+
+	// Delete instance file.
+	err = agent.DeleteInstanceFile("", path)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Console gets access to the instance's console.
+func (vm *qemu) Console() (*os.File, chan error, error) {
+	chDisconnect := make(chan error, 1)
+
+	// Avoid duplicate connects.
+	vmConsoleLock.Lock()
+	if vmConsole[vm.id] {
+		vmConsoleLock.Unlock()
+		return nil, nil, fmt.Errorf("There is already an active console for this instance")
+	}
+	vmConsoleLock.Unlock()
+
+	// Connect to the monitor.
+	monitor, err := vm.getMonitor()
+	if err != nil {
+		return nil, nil, err // The VM isn't running as no monitor socket available.
+	}
+
+	// Get the console.
+	console, err := monitor.Console("console")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Record the console is in use.
+	vmConsoleLock.Lock()
+	vmConsole[vm.id] = true
+	vmConsoleLock.Unlock()
+
+	// Handle console disconnection.
+	go func() {
+		<-chDisconnect
+
+		vmConsoleLock.Lock()
+		delete(vmConsole, vm.id)
+		vmConsoleLock.Unlock()
+	}()
+
+	return console, chDisconnect, nil
+}
+
+// Exec a command inside the instance.
+func (vm *qemu) Exec(req api.InstanceExecPost, stdin *os.File, stdout *os.File, stderr *os.File) (instance.Cmd, error) {
+	revert := revert.New()
+	defer revert.Fail()
+
+	err := qemuValidateExec(req)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := vm.getAgentClient()
+	if err != nil {
+		return nil, err
+	}
+
+	// The vsock connection may briefly fail, such as while the agent restarts, so retry a few times.
+	var agent lxdClient.InstanceServer
+	for i := 0; i < qemuAgentConnectAttempts; i++ {
+		if i > 0 {
+			time.Sleep(qemuAgentConnectRetryDelay)
+		}
+
+		agent, err = lxdClient.ConnectLXDHTTP(nil, client)
+		if err == nil {
+			break
+		}
+	}
+
+	if err != nil {
+		logger.Errorf("Failed to connect to lxd-agent on %s: %v", vm.Name(), err)
+		return nil, fmt.Errorf("Failed to connect to lxd-agent")
+	}
+	revert.Add(agent.Disconnect)
+
+	if (req.User > 0 || req.Group > 0 || req.Cwd != "") && !agent.HasExtension("container_exec_user_group_cwd") {
+		return nil, fmt.Errorf("The lxd-agent doesn't support running commands as another user or group or in another directory, please update it")
+	}
+
+	req.WaitForWS = true
+	if req.Interactive {
+		// Default the initial terminal size to the one of stdin.
+		if req.Width == 0 || req.Height == 0 {
+			width, height, err := termios.GetSize(int(stdin.Fd()))
+			if err == nil {
+				req.Width = width
+				req.Height = height
+			}
+		}
+
+		// Set console to raw.
+		oldttystate, err := termios.MakeRaw(int(stdin.Fd()))
+		if err != nil {
+			return nil, err
+		}
+
+		revert.Add(func() { termios.Restore(int(stdin.Fd()), oldttystate) })
+	}
+
+	dataDone := make(chan bool)
+	controlSendCh := make(chan api.InstanceExecControl)
+	controlResCh := make(chan error)
+
+	// This is the signal control handler, it receives signals from lxc CLI and forwards them to the VM agent.
+	controlHandler := func(control *websocket.Conn) {
+		defer control.Close()
+
+		closeMsg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+		defer control.WriteMessage(websocket.CloseMessage, closeMsg)
+
+		// Send the initial terminal size as a window resize, so it also applies when the agent
+		// set up the command's terminal before the size was known.
+		if req.Interactive && req.Width > 0 && req.Height > 0 {
+			err := control.WriteJSON(api.InstanceExecControl{
+				Command: "window-resize",
+				Args: map[string]string{
+					"width":  strconv.Itoa(req.Width),
+					"height": strconv.Itoa(req.Height),
+				},
+			})
+			if err != nil {
+				logger.Warn("Failed to send initial window size to lxd-agent", log.Ctx{"project": vm.project, "instance": vm.name, "err": err})
+			}
+		}
+
+		qemuExecControl(func(cmd api.InstanceExecControl) error { return control.WriteJSON(cmd) }, controlSendCh, controlResCh, dataDone)
+	}
+
+	args := lxdClient.InstanceExecArgs{
+		Stdin:    stdin,
+		Stdout:   stdout,
+		Stderr:   stderr,
+		DataDone: dataDone,
+		Control:  controlHandler,
+	}
+
+	op, err := agent.ExecInstance("", req, &args)
+	if err != nil {
+		return nil, err
+	}
+
+	// Ping the agent over its own connections with a timeout, as those of the command may hang rather
+	// than fail when the VM goes away.
+	pingClient := *client
+	pingClient.Timeout = qemuExecKeepaliveInterval
+	pinger, err := lxdClient.ConnectLXDHTTP(&lxdClient.ConnectionArgs{SkipGetServer: true}, &pingClient)
+	if err != nil {
+		return nil, err
+	}
+
+	ping := func() error {
+		_, _, err := pinger.GetServer()
+		return err
+	}
+
+	agentLost := make(chan struct{})
+	keepaliveStop := make(chan struct{})
+	go qemuExecKeepalive(ping, qemuExecKeepaliveInterval, qemuExecKeepaliveMisses, keepaliveStop, agentLost)
+	revert.Add(func() { close(keepaliveStop) })
+
+	instCmd := &qemuCmd{
+		cmd:              op,
+		attachedChildPid: 0, // Process is not running on LXD host.
+		dataDone:         args.DataDone,
+		cleanupFunc:      revert.Clone().Fail, // Pass revert function clone as clean up function.
+		controlSendCh:    controlSendCh,
+		controlResCh:     controlResCh,
+		ping:             ping,
+		agentLost:        agentLost,
+	}
+
+	revert.Success()
+	return instCmd, nil
+}
+
+// qemuValidateExec checks the fields of an exec request before it is forwarded to the lxd-agent.
+func qemuValidateExec(req api.InstanceExecPost) error {
+	if len(req.Command) == 0 {
+		return fmt.Errorf("No command specified")
+	}
+
+	for k, v := range req.Environment {
+		if k == "" || strings.ContainsAny(k, "=\x00") {
+			return fmt.Errorf("Invalid environment variable name %q", k)
+		}
+
+		if strings.Contains(v, "\x00") {
+			return fmt.Errorf("Invalid value for environment variable %q", k)
+		}
+	}
+
+	if req.Cwd != "" && (!filepath.IsAbs(req.Cwd) || strings.Contains(req.Cwd, "\x00")) {
+		return fmt.Errorf("Working directory %q isn't an absolute path", req.Cwd)
+	}
+
+	if req.Width < 0 || req.Height < 0 {
+		return fmt.Errorf("Invalid terminal size %dx%d", req.Width, req.Height)
+	}
+
+	return nil
+}
+
+// Render returns info about the instance.
+func (vm *qemu) Render() (interface{}, interface{}, error) {
+	if vm.IsSnapshot() {
+		// Prepare the ETag
+		etag := []interface{}{vm.expiryDate}
+
+		vmSnap := api.InstanceSnapshot{
+			CreatedAt:       vm.creationDate,
+			ExpandedConfig:  vm.expandedConfig,
+			ExpandedDevices: vm.expandedDevices.CloneNative(),
+			LastUsedAt:      vm.lastUsedDate,
+			Name:            strings.SplitN(vm.name, "/", 2)[1],
+			Stateful:        vm.stateful,
+		}
+		vmSnap.Architecture = vm.architectureName
+		vmSnap.Config = vm.localConfig
+		vmSnap.Devices = vm.localDevices.CloneNative()
+		vmSnap.Ephemeral = vm.ephemeral
+		vmSnap.Profiles = vm.profiles
+		vmSnap.ExpiresAt = vm.expiryDate
+
+		return &vmSnap, etag, nil
+	}
+
+	// Prepare the ETag
+	etag := []interface{}{vm.architecture, vm.localConfig, vm.localDevices, vm.ephemeral, vm.profiles}
+
+	vmState := api.Instance{
+		ExpandedConfig:  vm.expandedConfig,
+		ExpandedDevices: vm.expandedDevices.CloneNative(),
+		Name:            vm.name,
+		Status:          vm.statusCode().String(),
+		StatusCode:      vm.statusCode(),
+		Location:        vm.node,
+		Type:            vm.Type().String(),
+	}
+
+	vmState.Description = vm.description
+	vmState.Architecture = vm.architectureName
+	vmState.Config = vm.localConfig
+	vmState.CreatedAt = vm.creationDate
+	vmState.Devices = vm.localDevices.CloneNative()
+	vmState.Ephemeral = vm.ephemeral
+	vmState.LastUsedAt = vm.lastUsedDate
+	vmState.Profiles = vm.profiles
+	vmState.Stateful = vm.stateful
+
+	return &vmState, etag, nil
+}
+
+// RenderFull returns all info about the instance.
+func (vm *qemu) RenderFull() (*api.InstanceFull, interface{}, error) {
+	if vm.IsSnapshot() {
+		return nil, nil, fmt.Errorf("RenderFull doesn't work with snapshots")
+	}
+
+	// Get the Instance struct.
+	base, etag, err := vm.Render()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Convert to InstanceFull.
+	vmState := api.InstanceFull{Instance: *base.(*api.Instance)}
+
+	// Add the InstanceState.
+	vmState.State, err = vm.RenderState()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Add the InstanceSnapshots.
+	snaps, err := vm.Snapshots()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, snap := range snaps {
+		render, _, err := snap.Render()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if vmState.Snapshots == nil {
+			vmState.Snapshots = []api.InstanceSnapshot{}
+		}
+
+		vmState.Snapshots = append(vmState.Snapshots, *render.(*api.InstanceSnapshot))
+	}
+
+	// Add the InstanceBackups.
+	backups, err := vm.Backups()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, backup := range backups {
+		render := backup.Render()
+
+		if vmState.Backups == nil {
+			vmState.Backups = []api.InstanceBackup{}
+		}
+
+		vmState.Backups = append(vmState.Backups, *render)
+	}
+
+	return &vmState, etag, nil
+}
+
+// RenderState returns just state info about the instance.
+func (vm *qemu) RenderState() (*api.InstanceState, error) {
+	statusCode := vm.statusCode()
+	pid, _ := vm.pid()
+
+	if statusCode == api.Running {
+		status, err := vm.agentGetState()
+		if err != nil {
+			// The agent not having started yet is expected, any other failure to reach it isn't.
+			if err == errQemuAgentOffline {
+				logger.Debug("VM agent is offline", log.Ctx{"project": vm.Project(), "instance": vm.Name()})
+			} else {
+				logger.Warn("Could not get VM state from agent", log.Ctx{"project": vm.Project(), "instance": vm.Name(), "err": err})
+			}
+
+			// Fallback data.
+			status = &api.InstanceState{}
+			status.Processes = -1
+			networks := map[string]api.InstanceStateNetwork{}
+			for k, m := range vm.ExpandedDevices() {
+				// We only care about nics.
+				if m["type"] != "nic" || m.NICType() != "bridged" {
+					continue
+				}
 
-		data, err := yaml.Marshal(&meta)
-		if err != nil {
-			ctw.Close()
-			logger.Error("Failed exporting instance", ctxMap)
-			return err
-		}
+				// Fill the MAC address.
+				m, err := vm.FillNetworkDevice(k, m)
+				if err != nil {
+					return nil, err
+				}
 
-		// Write the actual file.
-		fnam = filepath.Join(tempDir, "metadata.yaml")
-		err = ioutil.WriteFile(fnam, data, 0644)
-		if err != nil {
-			ctw.Close()
-			logger.Error("Failed exporting instance", ctxMap)
-			return err
-		}
+				// Parse the lease file.
+				addresses, err := network.GetLeaseAddresses(vm.state, m["parent"], m["hwaddr"])
+				if err != nil {
+					return nil, err
+				}
 
-		fi, err := os.Lstat(fnam)
-		if err != nil {
-			ctw.Close()
-			logger.Error("Failed exporting instance", ctxMap)
-			return err
-		}
+				if len(addresses) == 0 {
+					continue
+				}
 
-		tmpOffset := len(filepath.Dir(fnam)) + 1
-		if err := ctw.WriteFile(tmpOffset, fnam, fi); err != nil {
-			ctw.Close()
-			logger.Error("Failed exporting instance", ctxMap)
-			return err
-		}
-	} else {
-		if properties != nil {
-			// Parse the metadata.
-			content, err := ioutil.ReadFile(fnam)
-			if err != nil {
-				ctw.Close()
-				logger.Error("Failed exporting instance", ctxMap)
-				return err
-			}
+				// Get MTU.
+				iface, err := net.InterfaceByName(m["parent"])
+				if err != nil {
+					return nil, err
+				}
 
-			metadata := new(api.ImageMetadata)
-			err = yaml.Unmarshal(content, &metadata)
-			if err != nil {
-				ctw.Close()
-				logger.Error("Failed exporting instance", ctxMap)
-				return err
-			}
-			metadata.Properties = properties
+				if m["host_name"] == "" {
+					m["host_name"] = vm.localConfig[fmt.Sprintf("volatile.%s.host_name", k)]
+				}
 
-			// Generate a new metadata.yaml.
-			tempDir, err := ioutil.TempDir("", "lxd_lxd_metadata_")
-			if err != nil {
-				ctw.Close()
-				logger.Error("Failed exporting instance", ctxMap)
-				return err
-			}
-			defer os.RemoveAll(tempDir)
+				// Retrieve the host counters, as we report the values
+				// from the instance's point of view, those counters need to be reversed below.
+				hostCounters := shared.NetworkGetCounters(m["host_name"])
 
-			data, err := yaml.Marshal(&metadata)
-			if err != nil {
-				ctw.Close()
-				logger.Error("Failed exporting instance", ctxMap)
-				return err
+				networks[k] = api.InstanceStateNetwork{
+					Addresses: addresses,
+					Counters: api.InstanceStateNetworkCounters{
+						BytesReceived:   hostCounters.BytesSent,
+						BytesSent:       hostCounters.BytesReceived,
+						PacketsReceived: hostCounters.PacketsSent,
+						PacketsSent:     hostCounters.PacketsReceived,
+					},
+					Hwaddr:   m["hwaddr"],
+					HostName: m["host_name"],
+					Mtu:      iface.MTU,
+					State:    "up",
+					Type:     "broadcast",
+				}
 			}
 
-			// Write the actual file.
-			fnam = filepath.Join(tempDir, "metadata.yaml")
-			err = ioutil.WriteFile(fnam, data, 0644)
-			if err != nil {
-				ctw.Close()
-				logger.Error("Failed exporting instance", ctxMap)
-				return err
-			}
+			status.Network = networks
+		} else {
+			status.AgentConnected = true
 		}
 
-		// Include metadata.yaml in the tarball.
-		fi, err := os.Lstat(fnam)
-		if err != nil {
-			ctw.Close()
-			logger.Debugf("Error statting %s during export", fnam)
-			logger.Error("Failed exporting instance", ctxMap)
-			return err
+		status.Pid = int64(pid)
+		status.Status = statusCode.String()
+		status.StatusCode = statusCode
+		status.BootTime = vm.bootTime()
+		status.VsockID = int64(vm.vsockID())
+		status.Health = vm.health()
+		status.Disk, err = vm.diskState()
+		if err != nil && err != storageDrivers.ErrNotSupported {
+			logger.Warn("Error getting disk usage", log.Ctx{"project": vm.Project(), "instance": vm.Name(), "err": err})
 		}
 
-		if properties != nil {
-			tmpOffset := len(filepath.Dir(fnam)) + 1
-			err = ctw.WriteFile(tmpOffset, fnam, fi)
-		} else {
-			err = ctw.WriteFile(offset, fnam, fi)
-		}
-		if err != nil {
-			ctw.Close()
-			logger.Debugf("Error writing to tarfile: %s", err)
-			logger.Error("Failed exporting instance", ctxMap)
-			return err
-		}
+		return status, nil
 	}
 
-	// Convert and include the root image.
-	pool, err := vm.getStoragePool()
-	if err != nil {
-		return err
+	// At least return the Status and StatusCode if we couldn't get any
+	// information for the VM agent.
+	status := &api.InstanceState{
+		Pid:        int64(pid),
+		Status:     statusCode.String(),
+		StatusCode: statusCode,
 	}
 
-	rootDrivePath, err := pool.GetInstanceDisk(vm)
-	if err != nil {
-		return err
+	if statusCode == api.Frozen {
+		status.PauseReason = vm.localConfig["volatile.vm.pause_reason"]
 	}
 
-	// Convert from raw to qcow2 and add to tarball.
-	tmpPath, err := ioutil.TempDir("", "lxd_export_")
-	if err != nil {
-		return err
+	return status, nil
+}
+
+// setBootTime records when the guest was last booted, either by starting qemu or by being reset in
+// place. A zero time clears it once the VM is stopped.
+func (vm *qemu) setBootTime(bootTime time.Time) {
+	value := ""
+	if !bootTime.IsZero() {
+		value = bootTime.UTC().Format(time.RFC3339)
 	}
-	defer os.RemoveAll(tmpPath)
 
-	fPath := fmt.Sprintf("%s/rootfs.img", tmpPath)
-	_, err = shared.RunCommand("qemu-img", "convert", "-c", "-O", "qcow2", rootDrivePath, fPath)
+	err := vm.VolatileSet(map[string]string{"volatile.vm.boot_time": value})
 	if err != nil {
-		return fmt.Errorf("Failed converting image to qcow2: %v", err)
+		logger.Warn("Failed recording VM boot time", log.Ctx{"project": vm.project, "instance": vm.name, "err": err})
 	}
+}
 
-	fi, err := os.Lstat(fPath)
-	if err != nil {
-		return err
+// clearHealth forgets the health of the VM once stopped, so it's checked anew when started again.
+func (vm *qemu) clearHealth() {
+	qemuHealthChecksLock.Lock()
+	delete(qemuHealthChecks, vm.id)
+	qemuHealthChecksLock.Unlock()
+
+	if vm.localConfig["volatile.vm.health"] == "" {
+		return
 	}
 
-	err = ctw.WriteFile(len(tmpPath)+1, fPath, fi)
+	err := vm.VolatileSet(map[string]string{"volatile.vm.health": ""})
 	if err != nil {
-		return err
+		logger.Warn("Failed clearing VM health", log.Ctx{"project": vm.project, "instance": vm.name, "err": err})
 	}
+}
 
-	// Include all the templates.
-	fnam = vm.TemplatesPath()
-	if shared.PathExists(fnam) {
-		err = filepath.Walk(fnam, writeToTar)
-		if err != nil {
-			logger.Error("Failed exporting instance", ctxMap)
-			return err
-		}
+// clearPauseReason forgets why qemu paused the VM, once resumed or stopped.
+func (vm *qemu) clearPauseReason() {
+	if vm.localConfig["volatile.vm.pause_reason"] == "" {
+		return
 	}
 
-	err = ctw.Close()
+	err := vm.VolatileSet(map[string]string{"volatile.vm.pause_reason": ""})
 	if err != nil {
-		logger.Error("Failed exporting instance", ctxMap)
-		return err
+		logger.Warn("Failed clearing why the VM paused", log.Ctx{"project": vm.project, "instance": vm.name, "err": err})
 	}
-
-	logger.Info("Exported instance", ctxMap)
-	return nil
 }
 
-// Migrate migrates the instance to another node.
-func (vm *qemu) Migrate(args *instance.CriuMigrationArgs) error {
-	return instance.ErrNotImplemented
+// bootTime returns when the guest was last booted, or a zero time if unknown.
+func (vm *qemu) bootTime() time.Time {
+	bootTime, err := time.Parse(time.RFC3339, vm.localConfig["volatile.vm.boot_time"])
+	if err != nil {
+		return time.Time{}
+	}
+
+	return bootTime
 }
 
-// CGroupSet is not implemented for VMs.
-func (vm *qemu) CGroupSet(key string, value string) error {
-	return instance.ErrNotImplemented
+// qemuHealthCheckInterval is how often the health check command of a VM is run when no interval is set.
+const qemuHealthCheckInterval = 30 * time.Second
+
+// qemuHealthCheckRetries is how many consecutive health check failures mark a VM as unhealthy when
+// no number of retries is set.
+const qemuHealthCheckRetries = 3
+
+// qemuHealthCheck tracks the health check of a running VM.
+type qemuHealthCheck struct {
+	interval time.Duration
+	lastRun  time.Time
+	running  bool
+	failures int
 }
 
-// VolatileSet sets one or more volatile config keys.
-func (vm *qemu) VolatileSet(changes map[string]string) error {
-	// Sanity check.
-	for key := range changes {
-		if !strings.HasPrefix(key, "volatile.") {
-			return fmt.Errorf("Only volatile keys can be modified with VolatileSet")
-		}
-	}
+// qemuHealthChecks registers the running VMs with a health check, keyed by instance ID. VMs are added
+// when started, or when LXD starts for those already running, and removed once stopped.
+var qemuHealthChecks = map[int]*qemuHealthCheck{}
+var qemuHealthChecksLock sync.Mutex
 
-	// Update the database.
-	var err error
-	if vm.IsSnapshot() {
-		err = vm.state.Cluster.Transaction(func(tx *db.ClusterTx) error {
-			return tx.InstanceSnapshotConfigUpdate(vm.id, changes)
-		})
-	} else {
-		err = vm.state.Cluster.Transaction(func(tx *db.ClusterTx) error {
-			return tx.ContainerConfigUpdate(vm.id, changes)
-		})
-	}
-	if err != nil {
-		return errors.Wrap(err, "Failed to volatile config")
-	}
+// healthChecksDue returns the IDs of the VMs whose health check interval elapsed since their last check,
+// skipping those with a check still running.
+func healthChecksDue() []int {
+	qemuHealthChecksLock.Lock()
+	defer qemuHealthChecksLock.Unlock()
 
-	// Apply the change locally.
-	for key, value := range changes {
-		if value == "" {
-			delete(vm.expandedConfig, key)
-			delete(vm.localConfig, key)
-			continue
+	ids := []int{}
+	for id, check := range qemuHealthChecks {
+		if !check.running && time.Since(check.lastRun) >= check.interval {
+			ids = append(ids, id)
 		}
-
-		vm.expandedConfig[key] = value
-		vm.localConfig[key] = value
 	}
 
-	return nil
+	return ids
 }
 
-// FileExists is not implemented for VMs.
-func (vm *qemu) FileExists(path string) error {
-	return instance.ErrNotImplemented
-}
+// healthCheckInterval returns how often the health check command of the VM is run.
+func (vm *qemu) healthCheckInterval() (time.Duration, error) {
+	if vm.expandedConfig["health_check.interval"] == "" {
+		return qemuHealthCheckInterval, nil
+	}
 
-// FilePull retrieves a file from the instance.
-func (vm *qemu) FilePull(srcPath string, dstPath string) (int64, int64, os.FileMode, string, []string, error) {
-	client, err := vm.getAgentClient()
+	seconds, err := strconv.Atoi(vm.expandedConfig["health_check.interval"])
 	if err != nil {
-		return 0, 0, 0, "", nil, err
+		return -1, err
 	}
 
-	agent, err := lxdClient.ConnectLXDHTTP(nil, client)
-	if err != nil {
-		logger.Errorf("Failed to connect to lxd-agent on %s: %v", vm.Name(), err)
-		return 0, 0, 0, "", nil, fmt.Errorf("Failed to connect to lxd-agent")
+	return time.Duration(seconds) * time.Second, nil
+}
+
+// registerHealthCheck adds the running VM to qemuHealthChecks if it has a health check, keeping the state
+// of the check if already registered, and removes it otherwise.
+func (vm *qemu) registerHealthCheck() {
+	interval, err := vm.healthCheckInterval()
+	if vm.expandedConfig["health_check.command"] == "" || err != nil {
+		qemuHealthChecksLock.Lock()
+		delete(qemuHealthChecks, vm.id)
+		qemuHealthChecksLock.Unlock()
+		return
 	}
-	defer agent.Disconnect()
 
-	content, resp, err := agent.GetInstanceFile("", srcPath)
-	if err != nil {
-		return 0, 0, 0, "", nil, err
+	qemuHealthChecksLock.Lock()
+	defer qemuHealthChecksLock.Unlock()
+
+	check, ok := qemuHealthChecks[vm.id]
+	if !ok {
+		check = &qemuHealthCheck{}
+		qemuHealthChecks[vm.id] = check
 	}
 
-	switch resp.Type {
-	case "file", "symlink":
-		data, err := ioutil.ReadAll(content)
-		if err != nil {
-			return 0, 0, 0, "", nil, err
-		}
+	check.interval = interval
+}
 
-		err = ioutil.WriteFile(dstPath, data, os.FileMode(resp.Mode))
-		if err != nil {
-			return 0, 0, 0, "", nil, err
-		}
+// Reattach sets up the tracking of a VM left running by a previous LXD process, resuming its health
+// checks and the supervision of its qemu process.
+func (vm *qemu) Reattach() {
+	if !vm.IsRunning() {
+		return
+	}
 
-		err = os.Lchown(dstPath, int(resp.UID), int(resp.GID))
-		if err != nil {
-			return 0, 0, 0, "", nil, err
-		}
+	vm.registerHealthCheck()
 
-		return resp.UID, resp.GID, os.FileMode(resp.Mode), resp.Type, nil, nil
-	case "directory":
-		return resp.UID, resp.GID, os.FileMode(resp.Mode), resp.Type, resp.Entries, nil
+	monitor, err := vm.getMonitor()
+	if err == nil {
+		go vm.watchGuestLog(monitor)
+		go vm.watchConsoleLog(monitor)
+	}
+
+	pid, err := vm.pid()
+	if err != nil || pid <= 0 {
+		logger.Warn("Failed to find the qemu process to supervise", log.Ctx{"project": vm.project, "instance": vm.name, "err": err})
+		return
 	}
 
-	return 0, 0, 0, "", nil, fmt.Errorf("bad file type %s", resp.Type)
+	go vm.supervise(pid, nil)
 }
 
-// FilePush pushes a file into the instance.
-func (vm *qemu) FilePush(fileType string, srcPath string, dstPath string, uid int64, gid int64, mode int, write string) error {
-	client, err := vm.getAgentClient()
+// HealthCheck runs the VM's health check command through the agent if its interval elapsed since the
+// last run, recording the VM's health in volatile.vm.health. The VM becomes unhealthy after a number
+// of consecutive failures. Checks which can't be run, such as while the agent is offline, aren't
+// counted as failures. Returns whether the VM just became unhealthy and is to be restarted according
+// to health_check.action, which is left to the caller.
+func (vm *qemu) HealthCheck() (bool, error) {
+	command, err := shared.SplitShellArgs(vm.expandedConfig["health_check.command"])
 	if err != nil {
-		return err
+		return false, err
 	}
 
-	agent, err := lxdClient.ConnectLXDHTTP(nil, client)
-	if err != nil {
-		logger.Errorf("Failed to connect to lxd-agent on %s: %v", vm.Name(), err)
-		return fmt.Errorf("Failed to connect to lxd-agent")
+	if len(command) == 0 || !vm.IsRunning() {
+		return false, nil
 	}
-	defer agent.Disconnect()
 
-	args := lxdClient.InstanceFileArgs{
-		GID:       gid,
-		Mode:      mode,
-		Type:      fileType,
-		UID:       uid,
-		WriteMode: write,
+	interval, err := vm.healthCheckInterval()
+	if err != nil {
+		return false, err
 	}
 
-	if fileType == "file" {
-		f, err := os.Open(srcPath)
-		if err != nil {
-			return err
-		}
-		defer f.Close()
-
-		args.Content = f
-	} else if fileType == "symlink" {
-		symlinkTarget, err := os.Readlink(dstPath)
+	retries := qemuHealthCheckRetries
+	if vm.expandedConfig["health_check.retries"] != "" {
+		retries, err = strconv.Atoi(vm.expandedConfig["health_check.retries"])
 		if err != nil {
-			return err
+			return false, err
 		}
+	}
 
-		args.Content = bytes.NewReader([]byte(symlinkTarget))
+	qemuHealthChecksLock.Lock()
+	check, ok := qemuHealthChecks[vm.id]
+	if !ok {
+		check = &qemuHealthCheck{interval: interval}
+		qemuHealthChecks[vm.id] = check
 	}
 
-	err = agent.CreateInstanceFile("", dstPath, args)
-	if err != nil {
-		return err
+	if check.running || time.Since(check.lastRun) < interval {
+		qemuHealthChecksLock.Unlock()
+		return false, nil
 	}
 
-	return nil
-}
+	check.running = true
+	check.lastRun = time.Now()
+	qemuHealthChecksLock.Unlock()
 
-// FileRemove removes a file from the instance.
-func (vm *qemu) FileRemove(path string) error {
-	// Connect to the agent.
-	client, err := vm.getAgentClient()
-	if err != nil {
-		return err
+	// The command must complete within the interval.
+	exitCode, err := vm.runHealthCheck(command, interval)
+
+	qemuHealthChecksLock.Lock()
+	check.running = false
+	if err == nil {
+		if exitCode == 0 {
+			check.failures = 0
+		} else {
+			check.failures++
+		}
 	}
+	failures := check.failures
+	qemuHealthChecksLock.Unlock()
 
-	agent, err := lxdClient.ConnectLXDHTTP(nil, client)
 	if err != nil {
-		return fmt.Errorf("Failed to connect to lxd-agent")
+		if err == errQemuAgentOffline {
+			logger.Debug("Skipping health check as the VM agent is offline", log.Ctx{"project": vm.project, "instance": vm.name})
+			return false, nil
+		}
+
+		return false, errors.Wrap(err, "Failed running health check")
 	}
-	defer agent.Disconnect()
 
-	// Delete instance file.
-	err = agent.DeleteInstanceFile("", path)
-	if err != nil {
-		return err
+	if exitCode != 0 {
+		logger.Debug("Health check failed", log.Ctx{"project": vm.project, "instance": vm.name, "exitCode": exitCode, "failures": failures})
 	}
 
-	return nil
+	health := qemuNextHealth(vm.localConfig["volatile.vm.health"], failures, retries)
+	if vm.localConfig["volatile.vm.health"] != health {
+		err = vm.VolatileSet(map[string]string{"volatile.vm.health": health})
+		if err != nil {
+			return false, err
+		}
+
+		if health == "unhealthy" {
+			logger.Warn("Instance is unhealthy", log.Ctx{"project": vm.project, "instance": vm.name, "failures": failures})
+		} else {
+			logger.Info("Instance is healthy", log.Ctx{"project": vm.project, "instance": vm.name})
+		}
+	}
+
+	// Only act when becoming unhealthy, rather than on each failure after that.
+	return failures == retries && vm.expandedConfig["health_check.action"] == "restart", nil
 }
 
-// Console gets access to the instance's console.
-func (vm *qemu) Console() (*os.File, chan error, error) {
-	chDisconnect := make(chan error, 1)
+// qemuNextHealth returns the health of a VM after a health check, given the number of consecutive
+// failures so far. An unhealthy VM stays so until a check succeeds.
+func qemuNextHealth(health string, failures int, retries int) string {
+	if failures >= retries || (failures > 0 && health == "unhealthy") {
+		return "unhealthy"
+	}
 
-	// Avoid duplicate connects.
-	vmConsoleLock.Lock()
-	if vmConsole[vm.id] {
-		vmConsoleLock.Unlock()
-		return nil, nil, fmt.Errorf("There is already an active console for this instance")
+	return "healthy"
+}
+
+// runHealthCheck runs a health check command through the agent and returns its exit code. A command
+// still running after timeout is killed and reported as failed.
+func (vm *qemu) runHealthCheck(command []string, timeout time.Duration) (int, error) {
+	monitor, err := vm.getMonitor()
+	if err != nil {
+		return -1, err
 	}
-	vmConsoleLock.Unlock()
 
-	// Connect to the monitor.
-	monitor, err := qmp.Connect(vm.getMonitorPath(), vm.getMonitorEventHandler())
+	if !monitor.AgentReady() {
+		return -1, errQemuAgentOffline
+	}
+
+	devNull, err := os.OpenFile(os.DevNull, os.O_RDWR, 0)
 	if err != nil {
-		return nil, nil, err // The VM isn't running as no monitor socket available.
+		return -1, err
 	}
+	defer devNull.Close()
 
-	// Get the console.
-	console, err := monitor.Console("console")
+	cmd, err := vm.Exec(api.InstanceExecPost{Command: command}, devNull, devNull, devNull)
 	if err != nil {
-		return nil, nil, err
+		return -1, err
 	}
 
-	// Record the console is in use.
-	vmConsoleLock.Lock()
-	vmConsole[vm.id] = true
-	vmConsoleLock.Unlock()
+	type result struct {
+		exitCode int
+		err      error
+	}
 
-	// Handle console disconnection.
+	done := make(chan result, 1)
 	go func() {
-		<-chDisconnect
-
-		vmConsoleLock.Lock()
-		delete(vmConsole, vm.id)
-		vmConsoleLock.Unlock()
+		exitCode, err := cmd.Wait()
+		done <- result{exitCode: exitCode, err: err}
 	}()
 
-	return console, chDisconnect, nil
+	select {
+	case res := <-done:
+		return res.exitCode, res.err
+	case <-time.After(timeout):
+		err = cmd.Signal(unix.SIGKILL)
+		if err != nil {
+			logger.Warn("Failed to kill timed out health check", log.Ctx{"project": vm.project, "instance": vm.name, "err": err})
+		}
+
+		return -1, nil
+	}
 }
 
-// Exec a command inside the instance.
-func (vm *qemu) Exec(req api.InstanceExecPost, stdin *os.File, stdout *os.File, stderr *os.File) (instance.Cmd, error) {
-	revert := revert.New()
-	defer revert.Fail()
+// health returns the health of the VM as reported in its state, which is empty without a health check.
+func (vm *qemu) health() string {
+	if vm.expandedConfig["health_check.command"] == "" {
+		return ""
+	}
 
-	client, err := vm.getAgentClient()
+	health := vm.localConfig["volatile.vm.health"]
+	if health == "" {
+		return "starting" // No conclusive check yet.
+	}
+
+	return health
+}
+
+// diskState gets disk usage info.
+func (vm *qemu) diskState() (map[string]api.InstanceStateDisk, error) {
+	pool, err := vm.getStoragePool()
 	if err != nil {
 		return nil, err
 	}
 
-	agent, err := lxdClient.ConnectLXDHTTP(nil, client)
+	// Get the root disk device config.
+	rootDiskName, _, err := shared.GetRootDiskDevice(vm.ExpandedDevices().CloneNative())
 	if err != nil {
-		logger.Errorf("Failed to connect to lxd-agent on %s: %v", vm.Name(), err)
-		return nil, fmt.Errorf("Failed to connect to lxd-agent")
+		return nil, err
 	}
-	revert.Add(agent.Disconnect)
-
-	req.WaitForWS = true
-	if req.Interactive {
-		// Set console to raw.
-		oldttystate, err := termios.MakeRaw(int(stdin.Fd()))
-		if err != nil {
-			return nil, err
-		}
 
-		revert.Add(func() { termios.Restore(int(stdin.Fd()), oldttystate) })
+	usage, err := pool.GetInstanceUsage(vm)
+	if err != nil {
+		return nil, err
 	}
 
-	dataDone := make(chan bool)
-	controlSendCh := make(chan api.InstanceExecControl)
-	controlResCh := make(chan error)
-
-	// This is the signal control handler, it receives signals from lxc CLI and forwards them to the VM agent.
-	controlHandler := func(control *websocket.Conn) {
-		closeMsg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
-		defer control.WriteMessage(websocket.CloseMessage, closeMsg)
+	disk := map[string]api.InstanceStateDisk{}
+	disk[rootDiskName] = api.InstanceStateDisk{Usage: usage}
 
-		for {
-			select {
-			case cmd := <-controlSendCh:
-				controlResCh <- control.WriteJSON(cmd)
-			case <-dataDone:
-				return
-			}
+	// Add the I/O counters of the running VM's disks, only reporting usage if they can't be retrieved.
+	if vm.IsRunning() {
+		err = vm.diskIOState(disk)
+		if err != nil {
+			logger.Warn("Error getting disk I/O statistics", log.Ctx{"project": vm.Project(), "instance": vm.Name(), "err": err})
 		}
 	}
 
-	args := lxdClient.InstanceExecArgs{
-		Stdin:    stdin,
-		Stdout:   stdout,
-		Stderr:   stderr,
-		DataDone: dataDone,
-		Control:  controlHandler,
+	return disk, nil
+}
+
+// diskIOState adds the I/O counters reported by qemu to the disk state of each of the VM's disks.
+func (vm *qemu) diskIOState(disk map[string]api.InstanceStateDisk) error {
+	monitor, err := vm.getMonitor()
+	if err != nil {
+		return err
 	}
 
-	op, err := agent.ExecInstance("", req, &args)
+	diskStats, err := vm.diskIOStats(monitor)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	instCmd := &qemuCmd{
-		cmd:              op,
-		attachedChildPid: 0, // Process is not running on LXD host.
-		dataDone:         args.DataDone,
-		cleanupFunc:      revert.Clone().Fail, // Pass revert function clone as clean up function.
-		controlSendCh:    controlSendCh,
-		controlResCh:     controlResCh,
+	for devName, stats := range diskStats {
+		diskState := disk[devName]
+		diskState.BytesRead = stats.BytesRead
+		diskState.BytesWritten = stats.BytesWritten
+		diskState.ReadOperations = stats.ReadOperations
+		diskState.WriteOperations = stats.WriteOperations
+		disk[devName] = diskState
 	}
 
-	revert.Success()
-	return instCmd, nil
+	return nil
 }
 
-// Render returns info about the instance.
-func (vm *qemu) Render() (interface{}, interface{}, error) {
-	if vm.IsSnapshot() {
-		// Prepare the ETag
-		etag := []interface{}{vm.expiryDate}
+// diskIOStats returns the I/O counters reported by qemu for each of the VM's disk devices.
+func (vm *qemu) diskIOStats(monitor *qmp.Monitor) (map[string]qmp.BlockStats, error) {
+	blockStats, err := monitor.GetBlockStats()
+	if err != nil {
+		return nil, err
+	}
 
-		vmSnap := api.InstanceSnapshot{
-			CreatedAt:       vm.creationDate,
-			ExpandedConfig:  vm.expandedConfig,
-			ExpandedDevices: vm.expandedDevices.CloneNative(),
-			LastUsedAt:      vm.lastUsedDate,
-			Name:            strings.SplitN(vm.name, "/", 2)[1],
-			Stateful:        vm.stateful,
+	diskStats := map[string]qmp.BlockStats{}
+	for name, stats := range blockStats {
+		// Map the drive or device ID back to the LXD device name.
+		var devName string
+		if strings.HasPrefix(name, "lxd_") {
+			devName = strings.TrimPrefix(name, "lxd_")
+		} else if strings.HasPrefix(name, "dev-lxd_") {
+			devName = strings.TrimPrefix(name, "dev-lxd_")
+		} else {
+			continue // Not a disk device (e.g. the firmware).
 		}
-		vmSnap.Architecture = vm.architectureName
-		vmSnap.Config = vm.localConfig
-		vmSnap.Devices = vm.localDevices.CloneNative()
-		vmSnap.Ephemeral = vm.ephemeral
-		vmSnap.Profiles = vm.profiles
-		vmSnap.ExpiresAt = vm.expiryDate
-
-		return &vmSnap, etag, nil
-	}
 
-	// Prepare the ETag
-	etag := []interface{}{vm.architecture, vm.localConfig, vm.localDevices, vm.ephemeral, vm.profiles}
+		dev, ok := vm.expandedDevices[devName]
+		if !ok || dev["type"] != "disk" {
+			continue
+		}
 
-	vmState := api.Instance{
-		ExpandedConfig:  vm.expandedConfig,
-		ExpandedDevices: vm.expandedDevices.CloneNative(),
-		Name:            vm.name,
-		Status:          vm.statusCode().String(),
-		StatusCode:      vm.statusCode(),
-		Location:        vm.node,
-		Type:            vm.Type().String(),
+		diskStats[devName] = stats
 	}
 
-	vmState.Description = vm.description
-	vmState.Architecture = vm.architectureName
-	vmState.Config = vm.localConfig
-	vmState.CreatedAt = vm.creationDate
-	vmState.Devices = vm.localDevices.CloneNative()
-	vmState.Ephemeral = vm.ephemeral
-	vmState.LastUsedAt = vm.lastUsedDate
-	vmState.Profiles = vm.profiles
-	vmState.Stateful = vm.stateful
-
-	return &vmState, etag, nil
+	return diskStats, nil
 }
 
-// RenderFull returns all info about the instance.
-func (vm *qemu) RenderFull() (*api.InstanceFull, interface{}, error) {
-	if vm.IsSnapshot() {
-		return nil, nil, fmt.Errorf("RenderFull doesn't work with snapshots")
+// Metrics returns the resource usage of the running VM. The CPU, memory and network figures come
+// from the agent when it's connected, otherwise from what the host sees of the qemu process and of
+// the VM's NICs.
+func (vm *qemu) Metrics() (*api.InstanceMetrics, error) {
+	if !vm.IsRunning() {
+		return nil, fmt.Errorf("The instance isn't running")
 	}
 
-	// Get the Instance struct.
-	base, etag, err := vm.Render()
+	monitor, err := vm.getMonitor()
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
-	// Convert to InstanceFull.
-	vmState := api.InstanceFull{Instance: *base.(*api.Instance)}
-
-	// Add the InstanceState.
-	vmState.State, err = vm.RenderState()
+	pid, err := vm.pid()
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
-	// Add the InstanceSnapshots.
-	snaps, err := vm.Snapshots()
+	metrics := &api.InstanceMetrics{
+		CPU:     api.InstanceMetricsCPU{Usage: -1},
+		Disk:    map[string]api.InstanceMetricsDisk{},
+		Network: map[string]api.InstanceMetricsNetwork{},
+	}
+
+	status, err := vm.agentGetState()
 	if err != nil {
-		return nil, nil, err
+		if err != errQemuAgentOffline {
+			logger.Warn("Could not get VM state from agent", log.Ctx{"project": vm.Project(), "instance": vm.Name(), "err": err})
+		}
+
+		status = nil
+	} else {
+		metrics.AgentConnected = true
+		metrics.CPU.Usage = status.CPU.Usage
+		metrics.Memory.Usage = status.Memory.Usage
+		metrics.Memory.UsagePeak = status.Memory.UsagePeak
 	}
 
-	for _, snap := range snaps {
-		render, _, err := snap.Render()
+	// Fall back to the CPU time and resident memory of the qemu process.
+	if metrics.CPU.Usage < 0 {
+		metrics.CPU.Usage, err = qemuProcessCPUTime(pid)
 		if err != nil {
-			return nil, nil, err
+			return nil, err
+		}
+	}
+
+	if !metrics.AgentConnected {
+		metrics.Memory.Usage, err = qemuProcessMemory(pid)
+		if err != nil {
+			return nil, err
 		}
+	}
 
-		if vmState.Snapshots == nil {
-			vmState.Snapshots = []api.InstanceSnapshot{}
-		}
+	// Older qemu versions lack the memory size summary, leave the total unknown then.
+	total, err := monitor.GetMemorySize()
+	if err == nil {
+		metrics.Memory.Total = total
+	}
 
-		vmState.Snapshots = append(vmState.Snapshots, *render.(*api.InstanceSnapshot))
+	balloon, err := monitor.GetBalloonSize()
+	if err == nil {
+		metrics.Memory.Balloon = balloon
 	}
 
-	// Add the InstanceBackups.
-	backups, err := vm.Backups()
+	diskStats, err := vm.diskIOStats(monitor)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
-	for _, backup := range backups {
-		render := backup.Render()
+	for devName, stats := range diskStats {
+		metrics.Disk[devName] = api.InstanceMetricsDisk{
+			BytesRead:       stats.BytesRead,
+			BytesWritten:    stats.BytesWritten,
+			ReadOperations:  stats.ReadOperations,
+			WriteOperations: stats.WriteOperations,
+		}
+	}
 
-		if vmState.Backups == nil {
-			vmState.Backups = []api.InstanceBackup{}
+	for devName, m := range vm.ExpandedDevices() {
+		if m["type"] != "nic" {
+			continue
 		}
 
-		vmState.Backups = append(vmState.Backups, *render)
+		counters, ok := vm.nicMetrics(devName, m, status)
+		if ok {
+			metrics.Network[devName] = counters
+		}
 	}
 
-	return &vmState, etag, nil
+	return metrics, nil
 }
 
-// RenderState returns just state info about the instance.
-func (vm *qemu) RenderState() (*api.InstanceState, error) {
-	statusCode := vm.statusCode()
-	pid, _ := vm.pid()
-
-	if statusCode == api.Running {
-		status, err := vm.agentGetState()
-		if err != nil {
-			if err != errQemuAgentOffline {
-				logger.Warn("Could not get VM state from agent", log.Ctx{"project": vm.Project(), "instance": vm.Name(), "err": err})
+// nicMetrics returns the counters of a NIC device, using those of the interface with the same MAC
+// address in the agent state when provided, or the reversed counters of its host side interface.
+func (vm *qemu) nicMetrics(devName string, m deviceConfig.Device, status *api.InstanceState) (api.InstanceMetricsNetwork, bool) {
+	hwaddr := m["hwaddr"]
+	if hwaddr == "" {
+		hwaddr = vm.localConfig[fmt.Sprintf("volatile.%s.hwaddr", devName)]
+	}
+
+	if status != nil && hwaddr != "" {
+		for _, iface := range status.Network {
+			if strings.EqualFold(iface.Hwaddr, hwaddr) {
+				return api.InstanceMetricsNetwork{
+					BytesReceived:   iface.Counters.BytesReceived,
+					BytesSent:       iface.Counters.BytesSent,
+					PacketsReceived: iface.Counters.PacketsReceived,
+					PacketsSent:     iface.Counters.PacketsSent,
+				}, true
 			}
+		}
+	}
 
-			// Fallback data.
-			status = &api.InstanceState{}
-			status.Processes = -1
-			networks := map[string]api.InstanceStateNetwork{}
-			for k, m := range vm.ExpandedDevices() {
-				// We only care about nics.
-				if m["type"] != "nic" || m.NICType() != "bridged" {
-					continue
-				}
+	hostName := m["host_name"]
+	if hostName == "" {
+		hostName = vm.localConfig[fmt.Sprintf("volatile.%s.host_name", devName)]
+	}
 
-				// Fill the MAC address.
-				m, err := vm.FillNetworkDevice(k, m)
-				if err != nil {
-					return nil, err
-				}
+	if hostName == "" {
+		return api.InstanceMetricsNetwork{}, false
+	}
 
-				// Parse the lease file.
-				addresses, err := network.GetLeaseAddresses(vm.state, m["parent"], m["hwaddr"])
-				if err != nil {
-					return nil, err
-				}
+	// The host counters are reversed to report them from the instance's point of view.
+	hostCounters := shared.NetworkGetCounters(hostName)
 
-				if len(addresses) == 0 {
-					continue
-				}
+	return api.InstanceMetricsNetwork{
+		BytesReceived:   hostCounters.BytesSent,
+		BytesSent:       hostCounters.BytesReceived,
+		PacketsReceived: hostCounters.PacketsSent,
+		PacketsSent:     hostCounters.PacketsReceived,
+	}, true
+}
 
-				// Get MTU.
-				iface, err := net.InterfaceByName(m["parent"])
-				if err != nil {
-					return nil, err
-				}
+// qemuUserHZ is the unit of the CPU times exposed in /proc, in ticks per second.
+const qemuUserHZ = 100
 
-				if m["host_name"] == "" {
-					m["host_name"] = vm.localConfig[fmt.Sprintf("volatile.%s.host_name", k)]
-				}
+// qemuProcessCPUTime returns the CPU time in nanoseconds used by all the threads of a process.
+func qemuProcessCPUTime(pid int) (int64, error) {
+	content, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return -1, err
+	}
 
-				// Retrieve the host counters, as we report the values
-				// from the instance's point of view, those counters need to be reversed below.
-				hostCounters := shared.NetworkGetCounters(m["host_name"])
+	return qemuParseProcStat(string(content))
+}
 
-				networks[k] = api.InstanceStateNetwork{
-					Addresses: addresses,
-					Counters: api.InstanceStateNetworkCounters{
-						BytesReceived:   hostCounters.BytesSent,
-						BytesSent:       hostCounters.BytesReceived,
-						PacketsReceived: hostCounters.PacketsSent,
-						PacketsSent:     hostCounters.PacketsReceived,
-					},
-					Hwaddr:   m["hwaddr"],
-					HostName: m["host_name"],
-					Mtu:      iface.MTU,
-					State:    "up",
-					Type:     "broadcast",
-				}
-			}
+// qemuParseProcStat returns the user and system CPU time in nanoseconds from the content of a
+// /proc/<pid>/stat file.
+func qemuParseProcStat(content string) (int64, error) {
+	// The command name may contain spaces and parentheses, the fields following it start with
+	// the state, making the user and system times the 12th and 13th ones.
+	end := strings.LastIndex(content, ")")
+	if end < 0 {
+		return -1, fmt.Errorf("Invalid process stat")
+	}
 
-			status.Network = networks
-		}
+	fields := strings.Fields(content[end+1:])
+	if len(fields) < 13 {
+		return -1, fmt.Errorf("Invalid process stat")
+	}
 
-		status.Pid = int64(pid)
-		status.Status = statusCode.String()
-		status.StatusCode = statusCode
-		status.Disk, err = vm.diskState()
-		if err != nil && err != storageDrivers.ErrNotSupported {
-			logger.Warn("Error getting disk usage", log.Ctx{"project": vm.Project(), "instance": vm.Name(), "err": err})
+	var ticks int64
+	for _, field := range fields[11:13] {
+		value, err := strconv.ParseInt(field, 10, 64)
+		if err != nil {
+			return -1, errors.Wrap(err, "Invalid process stat")
 		}
 
-		return status, nil
+		ticks += value
 	}
 
-	// At least return the Status and StatusCode if we couldn't get any
-	// information for the VM agent.
-	return &api.InstanceState{
-		Pid:        int64(pid),
-		Status:     statusCode.String(),
-		StatusCode: statusCode,
-	}, nil
+	return ticks * int64(time.Second) / qemuUserHZ, nil
 }
 
-// diskState gets disk usage info.
-func (vm *qemu) diskState() (map[string]api.InstanceStateDisk, error) {
-	pool, err := vm.getStoragePool()
+// qemuProcessStartTime returns the start time of a process in clock ticks since boot, which tells it
+// apart from a later process reusing its PID.
+func qemuProcessStartTime(pid int) (uint64, error) {
+	content, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
 
-	// Get the root disk device config.
-	rootDiskName, _, err := shared.GetRootDiskDevice(vm.ExpandedDevices().CloneNative())
+	return qemuParseProcStartTime(string(content))
+}
+
+// qemuParseProcStartTime returns the start time of a process from the content of its /proc/<pid>/stat
+// file. It's the 22nd field, the 20th following the command name.
+func qemuParseProcStartTime(content string) (uint64, error) {
+	end := strings.LastIndex(content, ")")
+	if end < 0 {
+		return 0, fmt.Errorf("Invalid process stat")
+	}
+
+	fields := strings.Fields(content[end+1:])
+	if len(fields) < 20 {
+		return 0, fmt.Errorf("Invalid process stat")
+	}
+
+	startTime, err := strconv.ParseUint(fields[19], 10, 64)
 	if err != nil {
-		return nil, err
+		return 0, errors.Wrap(err, "Invalid process stat")
 	}
 
-	usage, err := pool.GetInstanceUsage(vm)
+	return startTime, nil
+}
+
+// qemuProcessMemory returns the resident memory of a process in bytes.
+func qemuProcessMemory(pid int) (int64, error) {
+	content, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/status", pid))
 	if err != nil {
-		return nil, err
+		return -1, err
 	}
 
-	disk := map[string]api.InstanceStateDisk{}
-	disk[rootDiskName] = api.InstanceStateDisk{Usage: usage}
-	return disk, nil
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 || fields[0] != "VmRSS:" {
+			continue
+		}
+
+		value, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return -1, errors.Wrap(err, "Invalid VmRSS")
+		}
+
+		return value * 1024, nil
+	}
+
+	return -1, fmt.Errorf("No VmRSS for process %d", pid)
 }
 
 // agentGetState connects to the agent inside of the VM and does
 // an API call to get the current state.
 func (vm *qemu) agentGetState() (*api.InstanceState, error) {
 	// Check if the agent is running.
-	monitor, err := qmp.Connect(vm.getMonitorPath(), vm.getMonitorEventHandler())
+	monitor, err := vm.getMonitor()
 	if err != nil {
 		return nil, err
 	}
@@ -3757,9 +9821,81 @@ func (vm *qemu) IsStateful() bool {
 	return vm.stateful
 }
 
-// DeviceEventHandler handles events occurring on the instance's devices.
+// DeviceEventHandler handles events occurring on the instance's devices, passing host devices
+// plugged in after the VM started through to it and removing the ones unplugged from the host.
 func (vm *qemu) DeviceEventHandler(runConf *deviceConfig.RunConfig) error {
-	return fmt.Errorf("DeviceEventHandler Not implemented")
+	// Device events can only be processed when the VM is running.
+	if !vm.IsRunning() {
+		return nil
+	}
+
+	if runConf == nil {
+		return nil
+	}
+
+	// Hot-plug or hot-unplug host USB devices.
+	if len(runConf.USBDevice) > 0 {
+		var err error
+		if qemuUSBRemoved(runConf.USBDevice) {
+			err = vm.deviceDetachUSB(runConf.USBDevice)
+		} else {
+			err = vm.deviceAttachUSB(runConf.USBDevice)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	// Tell qemu about the new size of the drives whose volume was grown.
+	for _, item := range runConf.DiskResize {
+		if item.Key != "devName" {
+			continue
+		}
+
+		err := vm.deviceResizeDrive(item.Value)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Run any post hooks requested.
+	return vm.runHooks(runConf.PostHooks)
+}
+
+// deviceResizeDrive resizes a drive of the running VM to the current size of its volume, so that the
+// guest sees the larger disk without a restart.
+func (vm *qemu) deviceResizeDrive(devName string) error {
+	if !shared.IsRootDiskDevice(vm.expandedDevices[devName]) {
+		return fmt.Errorf("Only the root disk can be resized whilst running")
+	}
+
+	pool, err := vm.getStoragePool()
+	if err != nil {
+		return err
+	}
+
+	diskPath, err := pool.GetInstanceDisk(vm)
+	if err != nil {
+		return err
+	}
+
+	size, err := storageDrivers.BlockFileSize(diskPath)
+	if err != nil {
+		return err
+	}
+
+	monitor, err := vm.getMonitor()
+	if err != nil {
+		return err
+	}
+
+	err = monitor.ResizeDrive(fmt.Sprintf("lxd_%s", devName), size)
+	if err != nil {
+		return errors.Wrapf(err, "Failed resizing disk device %q", devName)
+	}
+
+	return nil
 }
 
 // ID returns the instance's ID.
@@ -3767,9 +9903,115 @@ func (vm *qemu) ID() int {
 	return vm.id
 }
 
-// vsockID returns the vsock context ID, 3 being the first ID that can be used.
-func (vm *qemu) vsockID() int {
-	return vm.id + 3
+// qemuVsockMinID and qemuVsockMaxID bound the vsock context IDs usable by VMs, as the lower ones are
+// reserved for the hypervisor and the host, and the highest 32bit one is VMADDR_CID_ANY.
+const qemuVsockMinID uint32 = 3
+const qemuVsockMaxID uint32 = math.MaxUint32 - 1
+
+// qemuVsockProbes is how many vsock context IDs are tried at start before giving up.
+const qemuVsockProbes = 1024
+
+// qemuVhostVsockSetGuestCID is the VHOST_VSOCK_SET_GUEST_CID ioctl, _IOW(VHOST_VIRTIO, 0x60, __u64).
+const qemuVhostVsockSetGuestCID = 0x4008af60
+
+// qemuVsockLock serializes the allocation of vsock context IDs, so that VMs starting together can't
+// pick the same one.
+var qemuVsockLock sync.Mutex
+
+// vsockID returns the vsock context ID of the VM, as allocated at start in volatile.vm.vsock_id.
+func (vm *qemu) vsockID() uint32 {
+	vsockID, err := strconv.ParseUint(vm.localConfig["volatile.vm.vsock_id"], 10, 32)
+	if err != nil || uint32(vsockID) < qemuVsockMinID {
+		// VMs not started since context IDs are allocated use the one derived from their ID.
+		return uint32(vm.id) + qemuVsockMinID
+	}
+
+	return uint32(vsockID)
+}
+
+// allocateVsockID picks the vsock context ID of the VM at start and records it. It's the one the VM used
+// last, unless it's taken by another VM of this host or by another vsock user, in which case the next
+// free one is picked.
+func (vm *qemu) allocateVsockID() error {
+	qemuVsockLock.Lock()
+	defer qemuVsockLock.Unlock()
+
+	values, err := vm.state.Cluster.InstancesNodeConfigValues("volatile.vm.vsock_id")
+	if err != nil {
+		return errors.Wrap(err, "Failed getting the vsock context IDs in use")
+	}
+
+	allocated := map[uint32]bool{}
+	for instanceID, value := range values {
+		vsockID, err := strconv.ParseUint(value, 10, 32)
+		if err == nil && instanceID != vm.id {
+			allocated[uint32(vsockID)] = true
+		}
+	}
+
+	vsockID, err := qemuNextVsockID(vm.vsockID(), func(vsockID uint32) (bool, error) {
+		if allocated[vsockID] {
+			return true, nil
+		}
+
+		return qemuVsockIDInUse(vsockID)
+	})
+	if err != nil {
+		return err
+	}
+
+	value := strconv.FormatUint(uint64(vsockID), 10)
+	if vm.localConfig["volatile.vm.vsock_id"] == value {
+		return nil
+	}
+
+	return vm.VolatileSet(map[string]string{"volatile.vm.vsock_id": value})
+}
+
+// qemuNextVsockID returns the first vsock context ID from start on which isn't in use, wrapping around
+// after the highest one.
+func qemuNextVsockID(start uint32, inUse func(vsockID uint32) (bool, error)) (uint32, error) {
+	vsockID := start
+	for i := 0; i < qemuVsockProbes; i++ {
+		if vsockID < qemuVsockMinID || vsockID > qemuVsockMaxID {
+			vsockID = qemuVsockMinID
+		}
+
+		used, err := inUse(vsockID)
+		if err != nil {
+			return 0, err
+		}
+
+		if !used {
+			return vsockID, nil
+		}
+
+		vsockID++
+	}
+
+	return 0, fmt.Errorf("No free vsock context ID found after trying %d from %d", qemuVsockProbes, start)
+}
+
+// qemuVsockIDInUse returns whether a vsock context ID is taken on the host, by assigning it to a new
+// vhost-vsock instance. It's released as soon as the instance is closed.
+func qemuVsockIDInUse(vsockID uint32) (bool, error) {
+	f, err := os.OpenFile("/dev/vhost-vsock", os.O_RDWR, 0)
+	if err != nil {
+		return false, errors.Wrap(err, "Failed opening /dev/vhost-vsock")
+	}
+	defer f.Close()
+
+	cid := uint64(vsockID)
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), qemuVhostVsockSetGuestCID, uintptr(unsafe.Pointer(&cid)))
+	if errno == unix.EADDRINUSE {
+		return true, nil
+	}
+
+	if errno != 0 {
+		return false, errors.Wrapf(errno, "Failed probing vsock context ID %d", vsockID)
+	}
+
+	return false, nil
 }
 
 // Location returns instance's location.
@@ -3820,25 +10062,39 @@ func (vm *qemu) InitPID() int {
 
 func (vm *qemu) statusCode() api.StatusCode {
 	// Connect to the monitor.
-	monitor, err := qmp.Connect(vm.getMonitorPath(), vm.getMonitorEventHandler())
+	monitor, err := vm.getMonitor()
 	if err != nil {
-		// If we fail to connect, chances are the VM isn't running.
+		// If we fail to connect, chances are the VM isn't running, unless its process is still around.
+		if vm.monitorAlive() {
+			return api.Error
+		}
+
 		return api.Stopped
 	}
 
 	status, err := monitor.Status()
 	if err != nil {
-		if err == qmp.ErrMonitorDisconnect {
+		if err == qmp.ErrMonitorDisconnect && !vm.monitorAlive() {
 			return api.Stopped
 		}
 
 		return api.Error
 	}
 
-	if status == "running" {
+	return qemuRunStateStatusCode(status)
+}
+
+// qemuRunStateStatusCode returns the instance status code matching a qemu run state. The states in
+// which the vCPUs were stopped without the VM going away, such as on an I/O error, are reported as
+// frozen as the VM can be resumed from them. A guest which crashed can't be resumed, so is in error.
+func qemuRunStateStatusCode(status string) api.StatusCode {
+	switch status {
+	case "running":
 		return api.Running
-	} else if status == "paused" {
+	case "paused", "io-error", "suspended", "watchdog", "debug":
 		return api.Frozen
+	case "internal-error", "guest-panicked":
+		return api.Error
 	}
 
 	return api.Stopped
@@ -3887,6 +10143,11 @@ func (vm *qemu) LogFilePath() string {
 	return filepath.Join(vm.LogPath(), "qemu.log")
 }
 
+// GuestLogPath returns the path of the log the guest writes to through its log serial port.
+func (vm *qemu) GuestLogPath() string {
+	return filepath.Join(vm.LogPath(), "guest.log")
+}
+
 // ConsoleBufferLogPath returns the instance's console buffer log path.
 func (vm *qemu) ConsoleBufferLogPath() string {
 	return filepath.Join(vm.LogPath(), "console.log")
@@ -4189,33 +10450,37 @@ func (vm *qemu) UpdateBackupFile() error {
 	return pool.UpdateInstanceBackupFile(vm, nil)
 }
 
-func (vm *qemu) cpuTopology(limit string) (int, int, int, map[uint64]uint64, error) {
-	// Get CPU topology.
-	cpus, err := resources.GetCPU()
-	if err != nil {
-		return -1, -1, -1, nil, err
-	}
-
+// cpuTopology returns the number of sockets, cores and threads of the virtualised CPU topology for
+// the supplied CPU limit, along with the map of vCPU index to host CPU and a map of host NUMA node to
+// the vCPU indexes it contains. The map of vCPU index to host CPU recorded on a previous start is
+// reused when it pins the same host CPUs, so that the VM sees the same layout across reboots.
+func (vm *qemu) cpuTopology(cpus *api.ResourcesCPU, limit string) (int, int, int, map[uint64]uint64, map[uint64][]uint64, error) {
 	// Expand the pins.
 	pins, err := instance.ParseCpuset(limit)
 	if err != nil {
-		return -1, -1, -1, nil, err
+		return -1, -1, -1, nil, nil, err
 	}
 
 	// Match tracking.
 	vcpus := map[uint64]uint64{}
 	sockets := map[uint64][]uint64{}
 	cores := map[uint64][]uint64{}
+	hostNodes := map[uint64]uint64{}
 
-	// Go through the physical CPUs looking for matches.
+	// Go through the online physical CPUs looking for matches.
 	i := uint64(0)
 	for _, cpu := range cpus.Sockets {
 		for _, core := range cpu.Cores {
 			for _, thread := range core.Threads {
+				if !thread.Online {
+					continue
+				}
+
 				for _, pin := range pins {
 					if thread.ID == int64(pin) {
 						// Found a matching CPU.
 						vcpus[i] = uint64(pin)
+						hostNodes[uint64(pin)] = core.NUMANode
 						i++
 
 						// Track cores per socket.
@@ -4241,9 +10506,28 @@ func (vm *qemu) cpuTopology(limit string) (int, int, int, map[uint64]uint64, err
 		}
 	}
 
-	// Confirm we're getting the expected number of CPUs.
+	// Confirm we're getting the expected number of CPUs, rather than silently using a different
+	// topology when some went offline or were removed from the host.
 	if len(pins) != len(vcpus) {
-		return -1, -1, -1, nil, fmt.Errorf("Unavailable CPUs requested: %s", limit)
+		missing := []string{}
+		for _, pin := range pins {
+			_, ok := hostNodes[uint64(pin)]
+			if !ok {
+				missing = append(missing, strconv.Itoa(pin))
+			}
+		}
+
+		return -1, -1, -1, nil, nil, fmt.Errorf("Unavailable CPUs requested in %q, CPUs offline or missing on the host: %s", limit, strings.Join(missing, ","))
+	}
+
+	cachedVCPUs, err := qemuParseCPUPins(vm.localConfig["volatile.vm.cpu_pins"])
+	if err == nil && qemuSameHostCPUs(cachedVCPUs, vcpus) {
+		vcpus = cachedVCPUs
+	}
+
+	numaNodes := map[uint64][]uint64{}
+	for vcpu, pin := range vcpus {
+		numaNodes[hostNodes[pin]] = append(numaNodes[hostNodes[pin]], vcpu)
 	}
 
 	// Validate the topology.
@@ -4293,5 +10577,5 @@ func (vm *qemu) cpuTopology(limit string) (int, int, int, map[uint64]uint64, err
 		nrThreads = 1
 	}
 
-	return nrSockets, nrCores, nrThreads, vcpus, nil
+	return nrSockets, nrCores, nrThreads, vcpus, numaNodes, nil
 }
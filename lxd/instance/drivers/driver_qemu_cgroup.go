@@ -0,0 +1,338 @@
+package drivers
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/lxc/lxd/lxd/cgroup"
+	"github.com/lxc/lxd/lxd/project"
+	"github.com/lxc/lxd/shared"
+	log "github.com/lxc/lxd/shared/log15"
+	"github.com/lxc/lxd/shared/logger"
+	"github.com/lxc/lxd/shared/units"
+)
+
+// qemuCgroupRoot is where the cgroup hierarchies are mounted.
+var qemuCgroupRoot = "/sys/fs/cgroup"
+
+// qemuSelfCgroup lists the cgroups LXD itself is in.
+var qemuSelfCgroup = "/proc/self/cgroup"
+
+// qemuCgroupControllers maps the resources limited through the VM's cgroup to their controller.
+var qemuCgroupControllers = map[cgroup.Resource]string{
+	cgroup.CPU:    "cpu",
+	cgroup.Memory: "memory",
+}
+
+// qemuMemoryOverheadDefault is the memory allowed to the qemu process on top of the VM's memory when
+// limits.memory.overhead isn't set.
+const qemuMemoryOverheadDefault = "256MiB"
+
+// qemuCgroupReadWriter reads and writes the settings of the cgroup the qemu process of a VM is placed
+// in, using the same name in each hierarchy. The cgroup is a child of LXD's own cgroup in each
+// hierarchy, as listed in parents by controller name, or under "" for the unified hierarchy.
+type qemuCgroupReadWriter struct {
+	name    string
+	hybrid  bool
+	parents map[string]string
+}
+
+// parentPath returns the path of a file of LXD's own cgroup in the hierarchy of the controller.
+func (rw *qemuCgroupReadWriter) parentPath(version cgroup.Backend, controller string, key string) string {
+	if version == cgroup.V2 {
+		// On hybrid systems, the unified hierarchy is mounted below the legacy ones.
+		if rw.hybrid {
+			return filepath.Join(qemuCgroupRoot, "unified", rw.parents[""], key)
+		}
+
+		return filepath.Join(qemuCgroupRoot, rw.parents[""], key)
+	}
+
+	return filepath.Join(qemuCgroupRoot, controller, rw.parents[controller], key)
+}
+
+// path returns the path of a file of the cgroup in the hierarchy of the controller.
+func (rw *qemuCgroupReadWriter) path(version cgroup.Backend, controller string, key string) string {
+	return rw.parentPath(version, controller, filepath.Join(rw.name, key))
+}
+
+// hasController returns whether the controller is available in the cgroup. On cgroup v2, it is only
+// once it was enabled in the subtree of LXD's cgroup.
+func (rw *qemuCgroupReadWriter) hasController(version cgroup.Backend, controller string) bool {
+	if version != cgroup.V2 {
+		return true
+	}
+
+	controllers, err := rw.Get(version, controller, "cgroup.controllers")
+	if err != nil {
+		return false
+	}
+
+	return shared.StringInSlice(controller, strings.Fields(controllers))
+}
+
+// enableController enables the controller in the subtree of LXD's cgroup on cgroup v2, so that the
+// VM's cgroup gets it.
+func (rw *qemuCgroupReadWriter) enableController(version cgroup.Backend, controller string) error {
+	if version != cgroup.V2 {
+		return nil
+	}
+
+	return ioutil.WriteFile(rw.parentPath(version, controller, "cgroup.subtree_control"), []byte(fmt.Sprintf("+%s", controller)), 0600)
+}
+
+// qemuParseSelfCgroup returns the paths of the cgroups listed in the content of a /proc/<pid>/cgroup
+// file, by controller name for cgroup v1 and under "" for the unified hierarchy.
+func qemuParseSelfCgroup(content string) map[string]string {
+	paths := map[string]string{}
+	for _, line := range strings.Split(content, "\n") {
+		fields := strings.SplitN(strings.TrimSpace(line), ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+
+		if fields[1] == "" {
+			paths[""] = fields[2]
+			continue
+		}
+
+		for _, controller := range strings.Split(fields[1], ",") {
+			paths[controller] = fields[2]
+		}
+	}
+
+	return paths
+}
+
+// Get reads a cgroup key.
+func (rw *qemuCgroupReadWriter) Get(version cgroup.Backend, controller string, key string) (string, error) {
+	value, err := ioutil.ReadFile(rw.path(version, controller, key))
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(value)), nil
+}
+
+// Set writes a cgroup key.
+func (rw *qemuCgroupReadWriter) Set(version cgroup.Backend, controller string, key string, value string) error {
+	return ioutil.WriteFile(rw.path(version, controller, key), []byte(value), 0600)
+}
+
+// cgroupReadWriter returns the read/writer of the VM's cgroup.
+func (vm *qemu) cgroupReadWriter() *qemuCgroupReadWriter {
+	parents := map[string]string{}
+	content, err := ioutil.ReadFile(qemuSelfCgroup)
+	if err == nil {
+		parents = qemuParseSelfCgroup(string(content))
+	}
+
+	return &qemuCgroupReadWriter{
+		name:    fmt.Sprintf("lxd.vm.%s", project.Instance(vm.project, vm.name)),
+		hybrid:  vm.state.OS.CGInfo.Layout == cgroup.CgroupsHybrid,
+		parents: parents,
+	}
+}
+
+// cgroup returns the cgroup abstraction of the VM's cgroup.
+func (vm *qemu) cgroup() (*cgroup.CGroup, error) {
+	cg, err := cgroup.New(vm.cgroupReadWriter())
+	if err != nil {
+		return nil, err
+	}
+
+	cg.UnifiedCapable = true
+	return cg, nil
+}
+
+// setupCgroup moves the qemu process into the VM's own cgroup, creating it below LXD's cgroup in each
+// of the hierarchies in use, and applies the VM's limits to it.
+func (vm *qemu) setupCgroup(pid int) error {
+	rw := vm.cgroupReadWriter()
+	for resource, controller := range qemuCgroupControllers {
+		version, ok := vm.state.OS.CGInfo.SupportsVersion(resource)
+		if !ok {
+			continue
+		}
+
+		// A cgroup v2 controller can't be enabled while LXD's cgroup holds processes of its own, in
+		// which case the limits using it are skipped.
+		err := rw.enableController(version, controller)
+		if err != nil {
+			logger.Warn("Failed enabling cgroup controller for VMs, its limits will be ignored", log.Ctx{"project": vm.project, "instance": vm.name, "controller": controller, "err": err})
+		}
+
+		err = os.MkdirAll(filepath.Dir(rw.path(version, controller, "cgroup.procs")), 0755)
+		if err != nil {
+			return errors.Wrapf(err, "Failed creating the %s cgroup", controller)
+		}
+
+		err = rw.Set(version, controller, "cgroup.procs", fmt.Sprintf("%d", pid))
+		if err != nil {
+			return errors.Wrapf(err, "Failed moving qemu into the %s cgroup", controller)
+		}
+	}
+
+	cg, err := vm.cgroup()
+	if err != nil {
+		return err
+	}
+
+	err = vm.setCgroupCPULimits(cg)
+	if err != nil {
+		return err
+	}
+
+	return vm.setCgroupMemoryLimit(cg)
+}
+
+// cgroupControllerUsable returns whether the resource can be limited in the VM's cgroup.
+func (vm *qemu) cgroupControllerUsable(cg *cgroup.CGroup, resource cgroup.Resource) bool {
+	if !vm.state.OS.CGInfo.Supports(resource, cg) {
+		return false
+	}
+
+	version, _ := vm.state.OS.CGInfo.SupportsVersion(resource)
+	return vm.cgroupReadWriter().hasController(version, qemuCgroupControllers[resource])
+}
+
+// setCgroupCPULimits applies limits.cpu.allowance and limits.cpu.priority to the VM's cgroup. They are
+// ignored if the CPU controller is missing, as they are for containers.
+func (vm *qemu) setCgroupCPULimits(cg *cgroup.CGroup) error {
+	if !vm.cgroupControllerUsable(cg, cgroup.CPU) {
+		return nil
+	}
+
+	cpuShares, cpuCfsQuota, cpuCfsPeriod, err := cgroup.ParseCPU(vm.expandedConfig["limits.cpu.allowance"], vm.expandedConfig["limits.cpu.priority"])
+	if err != nil {
+		return err
+	}
+
+	err = cg.SetCPUShare(cpuShares)
+	if err != nil {
+		return err
+	}
+
+	return cg.SetCPUCfsLimit(cpuCfsPeriod, cpuCfsQuota)
+}
+
+// cgroupMemoryLimit returns the memory limit in bytes of the VM's cgroup, that is the VM's memory plus
+// the overhead of qemu itself. Hugepages aren't accounted in the memory cgroup, so only the overhead
+// is limited when the VM's memory is backed by them. Returns -1 when raw.qemu overrides the memory
+// size of the VM, leaving it unknown.
+func (vm *qemu) cgroupMemoryLimit() (int64, error) {
+	overhead := vm.expandedConfig["limits.memory.overhead"]
+	if overhead == "" {
+		overhead = qemuMemoryOverheadDefault
+	}
+
+	limit, err := units.ParseByteSizeString(overhead)
+	if err != nil {
+		return -1, errors.Wrap(err, "Invalid limits.memory.overhead")
+	}
+
+	rawArgs, err := shared.SplitShellArgs(vm.expandedConfig["raw.qemu"])
+	if err != nil {
+		return -1, errors.Wrap(err, "Invalid raw.qemu")
+	}
+
+	_, found := qemuRawOverrides(rawArgs)["-m"]
+	if found {
+		return -1, nil
+	}
+
+	hugepages := vm.expandedConfig["limits.memory.hugepages"]
+	if hugepages != "" && (shared.IsBool(hugepages) != nil || shared.IsTrue(hugepages)) {
+		return limit, nil
+	}
+
+	memSizeBytes, err := vm.memorySizeBytes()
+	if err != nil {
+		return -1, err
+	}
+
+	return limit + memSizeBytes, nil
+}
+
+// setCgroupMemoryLimit limits the memory of the VM's cgroup, so that qemu can't use much more than the
+// VM's memory. The memory qemu allocated before being moved into the cgroup isn't accounted, which
+// leaves out little more than its own start up as the VM is still paused then.
+func (vm *qemu) setCgroupMemoryLimit(cg *cgroup.CGroup) error {
+	if !vm.cgroupControllerUsable(cg, cgroup.Memory) {
+		return nil
+	}
+
+	limit, err := vm.cgroupMemoryLimit()
+	if err != nil {
+		return err
+	}
+
+	if limit < 0 {
+		return nil
+	}
+
+	return cg.SetMemoryMaxUsage(fmt.Sprintf("%d", limit))
+}
+
+// cgroupOOMKilled returns whether a process of the VM's cgroup was killed for reaching its memory
+// limit. It must be called before the cgroup is removed.
+func (vm *qemu) cgroupOOMKilled() bool {
+	version, ok := vm.state.OS.CGInfo.SupportsVersion(cgroup.Memory)
+	if !ok {
+		return false
+	}
+
+	key := "memory.events"
+	if version == cgroup.V1 {
+		key = "memory.oom_control"
+	}
+
+	content, err := vm.cgroupReadWriter().Get(version, "memory", key)
+	if err != nil {
+		return false
+	}
+
+	return qemuParseOOMKills(content) > 0
+}
+
+// qemuParseOOMKills returns the number of OOM kills recorded in the content of a memory.events or
+// memory.oom_control cgroup file.
+func qemuParseOOMKills(content string) int64 {
+	for _, line := range strings.Split(content, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 || fields[0] != "oom_kill" {
+			continue
+		}
+
+		count, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return 0
+		}
+
+		return count
+	}
+
+	return 0
+}
+
+// removeCgroup removes the VM's cgroup from each hierarchy once qemu is gone.
+func (vm *qemu) removeCgroup() {
+	rw := vm.cgroupReadWriter()
+	for resource, controller := range qemuCgroupControllers {
+		version, ok := vm.state.OS.CGInfo.SupportsVersion(resource)
+		if !ok {
+			continue
+		}
+
+		err := os.Remove(filepath.Dir(rw.path(version, controller, "cgroup.procs")))
+		if err != nil && !os.IsNotExist(err) {
+			logger.Warn("Failed removing VM cgroup", log.Ctx{"project": vm.project, "instance": vm.name, "controller": controller, "err": err})
+		}
+	}
+}
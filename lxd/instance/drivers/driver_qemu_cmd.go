@@ -1,11 +1,15 @@
 package drivers
 
 import (
+	"fmt"
 	"strconv"
+	"strings"
+	"time"
 
 	"golang.org/x/sys/unix"
 
 	lxdClient "github.com/lxc/lxd/client"
+	"github.com/lxc/lxd/shared"
 	"github.com/lxc/lxd/shared/api"
 	"github.com/lxc/lxd/shared/logger"
 )
@@ -18,6 +22,8 @@ type qemuCmd struct {
 	controlSendCh    chan api.InstanceExecControl
 	controlResCh     chan error
 	cleanupFunc      func()
+	ping             func() error
+	agentLost        chan struct{}
 }
 
 // PID returns the attached child's process ID.
@@ -25,6 +31,93 @@ func (c *qemuCmd) PID() int {
 	return c.attachedChildPid
 }
 
+// qemuMaxSignal is the highest signal number on Linux, the last real-time signal.
+const qemuMaxSignal = 64
+
+// qemuExecSignal returns the signal number of a signal control message. The signal can be given by
+// name, with or without the SIG prefix, or by number in the "signal" argument, or by number in the
+// Signal field.
+func qemuExecSignal(command api.InstanceExecControl) (int, error) {
+	sig := command.Signal
+
+	value := command.Args["signal"]
+	if value != "" {
+		num, err := strconv.Atoi(value)
+		if err == nil {
+			sig = num
+		} else {
+			name := strings.ToUpper(value)
+			if !strings.HasPrefix(name, "SIG") {
+				name = "SIG" + name
+			}
+
+			sig = int(unix.SignalNum(name))
+			if sig == 0 {
+				return -1, fmt.Errorf("Unknown signal %q", value)
+			}
+		}
+	}
+
+	if sig < 1 || sig > qemuMaxSignal {
+		return -1, fmt.Errorf("Invalid signal number %d", sig)
+	}
+
+	return sig, nil
+}
+
+// qemuExecControl forwards the control messages received on sendCh to the lxd-agent using write,
+// replying on resCh with the result of each, until dataDone is closed. Signal messages are validated
+// and sent to the agent by number.
+func qemuExecControl(write func(api.InstanceExecControl) error, sendCh <-chan api.InstanceExecControl, resCh chan<- error, dataDone <-chan bool) {
+	for {
+		select {
+		case cmd := <-sendCh:
+			if cmd.Command == "signal" {
+				sig, err := qemuExecSignal(cmd)
+				if err != nil {
+					resCh <- err
+					continue
+				}
+
+				cmd.Signal = sig
+				delete(cmd.Args, "signal")
+			}
+
+			resCh <- write(cmd)
+		case <-dataDone:
+			return
+		}
+	}
+}
+
+// qemuExecKeepalive calls ping every interval until stop is closed, closing lost once misses pings in a
+// row failed.
+func qemuExecKeepalive(ping func() error, interval time.Duration, misses int, stop <-chan struct{}, lost chan<- struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	failures := 0
+	for {
+		select {
+		case <-ticker.C:
+			err := ping()
+			if err == nil {
+				failures = 0
+				continue
+			}
+
+			failures++
+			logger.Debugf("Failed to ping lxd-agent (%d/%d): %v", failures, misses, err)
+			if failures >= misses {
+				close(lost)
+				return
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
 // Signal sends a signal to the command.
 func (c *qemuCmd) Signal(sig unix.Signal) error {
 	command := api.InstanceExecControl{
@@ -32,8 +125,7 @@ func (c *qemuCmd) Signal(sig unix.Signal) error {
 		Signal:  int(sig),
 	}
 
-	c.controlSendCh <- command
-	err := <-c.controlResCh
+	err := c.sendControl(command)
 	if err != nil {
 		return err
 	}
@@ -48,20 +140,44 @@ func (c *qemuCmd) Wait() (int, error) {
 		defer c.cleanupFunc()
 	}
 
-	err := c.cmd.Wait()
-	if err != nil {
-		return -1, err
+	// The operation and data streams of the command may hang rather than fail when the agent goes away,
+	// so give up once the agent stopped answering pings.
+	waitErr := make(chan error, 1)
+	go func() { waitErr <- c.cmd.Wait() }()
+
+	select {
+	case err := <-waitErr:
+		if err != nil {
+			// Tell a lost agent apart from the command failing.
+			if c.ping != nil && c.ping() != nil {
+				return -1, errQemuAgentLost
+			}
+
+			return -1, err
+		}
+	case <-c.agentLost:
+		return -1, errQemuAgentLost
 	}
 
 	opAPI := c.cmd.Get()
-	<-c.dataDone
+	select {
+	case <-c.dataDone:
+	case <-c.agentLost:
+		return -1, errQemuAgentLost
+	}
+
 	exitCode := int(opAPI.Metadata["return"].(float64))
 
 	return exitCode, nil
 }
 
-// WindowResize resizes the running command's window.
+// WindowResize resizes the running command's window, both on the local terminal and in the guest.
 func (c *qemuCmd) WindowResize(fd, winchWidth, winchHeight int) error {
+	err := shared.SetSize(fd, winchWidth, winchHeight)
+	if err != nil {
+		return err
+	}
+
 	command := api.InstanceExecControl{
 		Command: "window-resize",
 		Args: map[string]string{
@@ -70,11 +186,27 @@ func (c *qemuCmd) WindowResize(fd, winchWidth, winchHeight int) error {
 		},
 	}
 
-	c.controlSendCh <- command
-	err := <-c.controlResCh
+	err = c.sendControl(command)
 	if err != nil {
 		return err
 	}
+
 	logger.Debugf(`Forwarded window resize "%dx%d" to lxd-agent`, winchWidth, winchHeight)
 	return nil
 }
+
+// sendControl forwards a control message to the lxd-agent and returns the result of sending it.
+// Signals and window resizes share the control channel, the handler replies to each message before
+// accepting the next one. Once the command's data streams are done the handler has exited, so fail
+// rather than block forever.
+func (c *qemuCmd) sendControl(command api.InstanceExecControl) error {
+	select {
+	case c.controlSendCh <- command:
+	case <-c.dataDone:
+		return fmt.Errorf("Command has already finished")
+	case <-c.agentLost:
+		return errQemuAgentLost
+	}
+
+	return <-c.controlResCh
+}
@@ -0,0 +1,101 @@
+package drivers
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"unicode/utf16"
+)
+
+// efiAuthVariableGUID is the signature of variable stores using authenticated variables, as used by
+// OVMF builds supporting secure boot.
+var efiAuthVariableGUID = []byte{0x78, 0x2c, 0xf3, 0xaa, 0x7b, 0x94, 0x9a, 0x43, 0xa1, 0x80, 0x2e, 0x14, 0x4e, 0xc3, 0x77, 0x92}
+
+// efiSecureBootKeyVars lists the EFI variables holding the secure boot keys and signature databases.
+var efiSecureBootKeyVars = []string{"PK", "KEK", "db", "dbx"}
+
+const (
+	efiVariableStartID     = 0x55aa
+	efiVariableStateAdded  = 0x3f
+	efiVariableStoreHdrLen = 28
+	efiVariableHdrLen      = 32
+	efiAuthVariableHdrLen  = 60
+)
+
+// efiSecureBootKeys parses the OVMF variable store at path and returns the content of the secure boot
+// key variables it holds.
+func efiSecureBootKeys(path string) (map[string][]byte, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// The variable store follows the firmware volume header.
+	if len(content) < 50 || string(content[40:44]) != "_FVH" {
+		return nil, fmt.Errorf("Invalid firmware volume in %q", path)
+	}
+
+	offset := int(binary.LittleEndian.Uint16(content[48:50]))
+	if len(content) < offset+efiVariableStoreHdrLen {
+		return nil, fmt.Errorf("Invalid variable store in %q", path)
+	}
+
+	hdrLen := efiVariableHdrLen
+	if bytes.Equal(content[offset:offset+16], efiAuthVariableGUID) {
+		hdrLen = efiAuthVariableHdrLen
+	}
+
+	keys := map[string][]byte{}
+	offset += efiVariableStoreHdrLen
+	for offset+hdrLen <= len(content) {
+		hdr := content[offset : offset+hdrLen]
+		if binary.LittleEndian.Uint16(hdr[0:2]) != efiVariableStartID {
+			break
+		}
+
+		// The name and data sizes are the fields preceding the vendor GUID ending the header.
+		nameSize := int(binary.LittleEndian.Uint32(hdr[hdrLen-24 : hdrLen-20]))
+		dataSize := int(binary.LittleEndian.Uint32(hdr[hdrLen-20 : hdrLen-16]))
+
+		end := offset + hdrLen + nameSize + dataSize
+		if end > len(content) {
+			return nil, fmt.Errorf("Truncated variable in %q", path)
+		}
+
+		if hdr[2] == efiVariableStateAdded {
+			nameRaw := content[offset+hdrLen : offset+hdrLen+nameSize]
+			name := make([]uint16, 0, nameSize/2)
+			for i := 0; i+1 < len(nameRaw); i += 2 {
+				c := binary.LittleEndian.Uint16(nameRaw[i : i+2])
+				if c == 0 {
+					break
+				}
+
+				name = append(name, c)
+			}
+
+			for _, keyVar := range efiSecureBootKeyVars {
+				if string(utf16.Decode(name)) == keyVar {
+					keys[keyVar] = content[offset+hdrLen+nameSize : end]
+				}
+			}
+		}
+
+		// Variables are 4 bytes aligned.
+		offset = (end + 3) &^ 3
+	}
+
+	return keys, nil
+}
+
+// efiSameSecureBootKeys returns whether two sets of secure boot keys are identical.
+func efiSameSecureBootKeys(a map[string][]byte, b map[string][]byte) bool {
+	for _, keyVar := range efiSecureBootKeyVars {
+		if !bytes.Equal(a[keyVar], b[keyVar]) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -39,7 +39,7 @@ value = "1"
 strict = "on"
 
 # LXD serial identifier
-[device]
+[device "qemu_serial"]
 driver = "virtio-serial"
 
 [device]
@@ -117,12 +117,31 @@ addr = "0x0"
 # Console
 [chardev "console"]
 backend = "pty"
+logfile = "{{.consoleLogPath}}"
+logappend = "on"
+`))
+
+var qemuGuestLog = template.Must(template.New("qemuGuestLog").Parse(`
+# Guest log
+[chardev "qemu_guest-log"]
+backend = "ringbuf"
+size = "{{.size}}B"
+
+[device "qemu_guest-log"]
+driver = "virtserialport"
+bus = "qemu_serial.0"
+name = "{{.name}}"
+chardev = "qemu_guest-log"
 `))
 
 var qemuMemory = template.Must(template.New("qemuMemory").Parse(`
 # Memory
 [memory]
 size = "{{.memSizeBytes}}B"
+{{- if .memMaxBytes}}
+slots = "{{.memSlots}}"
+maxmem = "{{.memMaxBytes}}B"
+{{- end}}
 `))
 
 var qemuVsock = template.Must(template.New("qemuVsock").Parse(`
@@ -151,9 +170,34 @@ var qemuCPU = template.Must(template.New("qemuCPU").Parse(`
 # CPU
 [smp-opts]
 cpus = "{{.cpuCount}}"
+{{- if .cpuMaxCount}}
+maxcpus = "{{.cpuMaxCount}}"
+{{- end}}
 sockets = "{{.cpuSockets}}"
 cores = "{{.cpuCores}}"
 threads = "{{.cpuThreads}}"
+{{range $index, $node := .numaNodes}}
+# NUMA node {{$index}} (host node {{$node.hostNode}})
+[object "qemu_numa{{$index}}"]
+{{- if $.hugepagesPath}}
+qom-type = "memory-backend-file"
+mem-path = "{{$.hugepagesPath}}"
+prealloc = "on"
+{{- else}}
+qom-type = "memory-backend-ram"
+{{- end}}
+size = "{{$node.memSizeBytes}}B"
+host-nodes = "{{$node.hostNode}}"
+policy = "bind"
+
+[numa]
+type = "node"
+nodeid = "{{$index}}"
+{{- range $node.cpuRanges}}
+cpus = "{{.}}"
+{{- end}}
+memdev = "qemu_numa{{$index}}"
+{{end -}}
 `))
 
 var qemuControlSocket = template.Must(template.New("qemuControlSocket").Parse(`
@@ -186,6 +230,18 @@ format = "raw"
 unit = "1"
 `))
 
+var qemuDirectKernel = template.Must(template.New("qemuDirectKernel").Parse(`
+# Direct kernel boot
+[machine]
+kernel = "{{.kernel}}"
+{{if .initrd -}}
+initrd = "{{.initrd}}"
+{{end -}}
+{{if .cmdline -}}
+append = "{{.cmdline}}"
+{{end -}}
+`))
+
 // Devices use "qemu_" prefix indicating that this is a internally named device.
 var qemuDriveConfig = template.Must(template.New("qemuDriveConfig").Parse(`
 # Config drive
@@ -201,6 +257,57 @@ fsdev = "qemu_config"
 mount_tag = "config"
 `))
 
+// The cloud-init drive uses the last SCSI target, out of the range of the device boot indexes.
+var qemuDriveCloudInit = template.Must(template.New("qemuDriveCloudInit").Parse(`
+# cloud-init NoCloud drive
+[drive "qemu_cloud_init"]
+file = "{{.path}}"
+format = "raw"
+if = "none"
+media = "cdrom"
+readonly = "on"
+
+[device "dev-qemu_cloud_init"]
+driver = "scsi-cd"
+bus = "qemu_scsi.0"
+channel = "0"
+scsi-id = "255"
+lun = "1"
+drive = "qemu_cloud_init"
+`))
+
+var qemuWatchdog = template.Must(template.New("qemuWatchdog").Parse(`
+# Watchdog
+[device "qemu_watchdog"]
+driver = "i6300esb"
+{{- if eq .architecture "ppc64le"}}
+bus = "pci.0"
+{{- else}}
+bus = "pcie.0"
+{{- end}}
+`))
+
+var qemuTPM = template.Must(template.New("qemuTPM").Parse(`
+# TPM
+[chardev "qemu_tpm-chardev"]
+backend = "socket"
+path = "{{.path}}"
+
+[tpmdev "qemu_tpm"]
+type = "emulator"
+chardev = "qemu_tpm-chardev"
+
+[device "dev-qemu_tpm"]
+{{- if eq .architecture "ppc64le"}}
+driver = "tpm-spapr"
+{{- else if eq .architecture "aarch64"}}
+driver = "tpm-tis-device"
+{{- else}}
+driver = "tpm-crb"
+{{- end}}
+tpmdev = "qemu_tpm"
+`))
+
 // Devices use "lxd_" prefix indicating that this is a internally named device.
 var qemuDriveDir = template.Must(template.New("qemuDriveDir").Parse(`
 # {{.devName}} drive
@@ -210,10 +317,15 @@ readonly = "on"
 fsdriver = "local"
 security_model = "none"
 path = "{{.path}}"
-{{- else}}
+{{- else if .proxyFD}}
 readonly = "off"
 fsdriver = "proxy"
 sock_fd = "{{.proxyFD}}"
+{{- else}}
+readonly = "off"
+fsdriver = "local"
+security_model = "passthrough"
+path = "{{.path}}"
 {{- end}}
 
 [device "dev-lxd_{{.devName}}"]
@@ -223,18 +335,58 @@ mount_tag = "{{.mountTag}}"
 `))
 
 // Devices use "lxd_" prefix indicating that this is a user named device.
+// Drives are attached to the SCSI controller, unless they use virtio-blk, which takes a PCIe root port.
 var qemuDrive = template.Must(template.New("qemuDrive").Parse(`
 # {{.devName}} drive
 [drive "lxd_{{.devName}}"]
 file = "{{.devPath}}"
-format = "raw"
+format = "{{.format}}"
 if = "none"
 cache = "{{.cacheMode}}"
 aio = "{{.aioMode}}"
 discard = "on"
+{{if and .virtioBlk (ne .architecture "ppc64le") }}
+[device "qemu_pcie{{.chassisIndex}}"]
+driver = "pcie-root-port"
+port = "{{.portIndex}}"
+chassis = "{{.chassisIndex}}"
+bus = "pcie.0"
+{{- if .multifunction}}
+multifunction = "on"
+{{- end}}
+addr = "{{.pcieAddr}}"
+{{end}}
+[device "dev-lxd_{{.devName}}"]
+driver = "{{.driver}}"
+{{- if not .virtioBlk}}
+bus = "qemu_scsi.0"
+channel = "0"
+scsi-id = "{{.bootIndex}}"
+lun = "1"
+{{- else if eq .architecture "ppc64le"}}
+bus = "pci.0"
+{{- else}}
+bus = "qemu_pcie{{.chassisIndex}}"
+addr = "0x0"
+{{- end}}
+drive = "lxd_{{.devName}}"
+bootindex = "{{.bootIndex}}"
+`))
+
+// Devices use "lxd_" prefix indicating that this is a user named device.
+var qemuDriveCDROM = template.Must(template.New("qemuDriveCDROM").Parse(`
+# {{.devName}} CD-ROM drive
+[drive "lxd_{{.devName}}"]
+{{- if .devPath}}
+file = "{{.devPath}}"
+format = "raw"
+{{- end}}
+if = "none"
+media = "cdrom"
+readonly = "on"
 
 [device "dev-lxd_{{.devName}}"]
-driver = "scsi-hd"
+driver = "scsi-cd"
 bus = "qemu_scsi.0"
 channel = "0"
 scsi-id = "{{.bootIndex}}"
@@ -248,16 +400,26 @@ var qemuDevTapCommon = template.Must(template.New("qemuDevTapCommon").Parse(`
 {{if ne .architecture "ppc64le" -}}
 [device "qemu_pcie{{.chassisIndex}}"]
 driver = "pcie-root-port"
-port = "0x{{.portIndex}}"
+port = "{{.portIndex}}"
 chassis = "{{.chassisIndex}}"
 bus = "pcie.0"
-addr = "0x2.0x{{.pcieAddr}}"
+{{- if .multifunction}}
+multifunction = "on"
+{{- end}}
+addr = "{{.pcieAddr}}"
 {{- end }}
 
 [device "dev-lxd_{{.devName}}"]
-driver = "virtio-net-pci"
+driver = "{{.nicDriver}}"
 netdev = "lxd_{{.devName}}"
 mac = "{{.devHwaddr}}"
+{{if .queues -}}
+mq = "on"
+vectors = "{{.vectors}}"
+{{end -}}
+{{range .offloads -}}
+{{.}} = "off"
+{{end -}}
 {{if eq .architecture "ppc64le" -}}
 bus = "pci.0"
 {{else -}}
@@ -265,6 +427,9 @@ bus = "qemu_pcie{{.chassisIndex}}"
 addr = "0x0"
 {{end -}}
 bootindex = "{{.bootIndex}}"
+{{if .romFile -}}
+romfile = "{{.romFile}}"
+{{end -}}
 `))
 
 // Devices use "lxd_" prefix indicating that this is a user named device.
@@ -274,6 +439,9 @@ var qemuNetDevTapTun = template.Must(qemuDevTapCommon.New("qemuNetDevTapTun").Pa
 type = "tap"
 vhost = "on"
 ifname = "{{.ifName}}"
+{{if .queues -}}
+queues = "{{.queues}}"
+{{end -}}
 script = "no"
 downscript = "no"
 {{ template "qemuDevTapCommon" . -}}
@@ -285,7 +453,11 @@ var qemuNetdevTapFD = template.Must(qemuDevTapCommon.New("qemuNetdevTapFD").Pars
 [netdev "lxd_{{.devName}}"]
 type = "tap"
 vhost = "on"
+{{if .queues -}}
+fds = "{{.tapFD}}"
+{{else -}}
 fd = "{{.tapFD}}"
+{{end -}}
 {{ template "qemuDevTapCommon" . -}}
 `))
 
@@ -296,4 +468,68 @@ var qemuNetdevPhysical = template.Must(template.New("qemuNetdevPhysical").Parse(
 driver = "vfio-pci"
 host = "{{.pciSlotName}}"
 bootindex = "{{.bootIndex}}"
+{{if .romFile -}}
+romfile = "{{.romFile}}"
+{{end -}}
+`))
+
+// Devices use "lxd_" prefix indicating that this is a user named device.
+var qemuGPUDevPhysical = template.Must(template.New("qemuGPUDevPhysical").Parse(`
+# GPU card ("{{.devName}}" device, PCI device {{.pciSlotName}})
+[device "dev-lxd_{{.devName}}{{if .index}}-{{.index}}{{end}}"]
+driver = "vfio-pci"
+host = "{{.pciSlotName}}"
+`))
+
+var qemuUSB = template.Must(template.New("qemuUSB").Parse(`
+# USB controller
+[device "qemu_usb"]
+driver = "qemu-xhci"
+{{- if eq .architecture "ppc64le"}}
+bus = "pci.0"
+{{- else}}
+bus = "pcie.0"
+{{- end}}
+`))
+
+// Devices use "lxd_" prefix indicating that this is a user named device.
+var qemuSerialDev = template.Must(template.New("qemuSerialDev").Parse(`
+# Serial device ("{{.devName}}" device)
+[chardev "lxd_{{.devName}}"]
+backend = "serial"
+path = "{{.path}}"
+
+[device "dev-lxd_{{.devName}}"]
+{{- if eq .bus "isa"}}
+driver = "isa-serial"
+{{- else}}
+driver = "virtserialport"
+bus = "qemu_serial.0"
+name = "{{.devName}}"
+{{- end}}
+chardev = "lxd_{{.devName}}"
+`))
+
+// Devices use "lxd_" prefix indicating that this is a user named device.
+var qemuSharedMemDev = template.Must(template.New("qemuSharedMemDev").Parse(`
+# Shared memory ("{{.devName}}" device)
+[object "lxd_{{.devName}}"]
+qom-type = "memory-backend-file"
+mem-path = "{{.path}}"
+size = "{{.size}}"
+share = "on"
+
+[device "dev-lxd_{{.devName}}"]
+driver = "ivshmem-plain"
+memdev = "lxd_{{.devName}}"
+`))
+
+// Devices use "lxd_" prefix indicating that this is a user named device.
+var qemuUSBDevHost = template.Must(template.New("qemuUSBDevHost").Parse(`
+# USB device ("{{.devName}}" device, host bus {{.hostBus}} address {{.hostAddr}})
+[device "{{.devID}}"]
+driver = "usb-host"
+bus = "qemu_usb.0"
+hostbus = "{{.hostBus}}"
+hostaddr = "{{.hostAddr}}"
 `))
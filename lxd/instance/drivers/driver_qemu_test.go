@@ -0,0 +1,3942 @@
+package drivers
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unicode/utf16"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+
+	"github.com/lxc/lxd/lxd/cgroup"
+	"github.com/lxc/lxd/lxd/db"
+	deviceConfig "github.com/lxc/lxd/lxd/device/config"
+	"github.com/lxc/lxd/lxd/dnsmasq"
+	"github.com/lxc/lxd/lxd/events"
+	"github.com/lxc/lxd/lxd/instance"
+	"github.com/lxc/lxd/lxd/instance/drivers/qmp"
+	"github.com/lxc/lxd/lxd/instance/instancetype"
+	"github.com/lxc/lxd/lxd/instance/operationlock"
+	"github.com/lxc/lxd/lxd/operations"
+	"github.com/lxc/lxd/lxd/state"
+	storagePools "github.com/lxc/lxd/lxd/storage"
+	"github.com/lxc/lxd/lxd/sys"
+	"github.com/lxc/lxd/shared"
+	"github.com/lxc/lxd/shared/api"
+	"github.com/lxc/lxd/shared/osarch"
+	"github.com/lxc/lxd/shared/termios"
+	"github.com/lxc/lxd/shared/version"
+)
+
+// qemuTestCPUInfo returns a host with two sockets, each on their own NUMA node and made of two cores
+// with two threads each. Host CPU IDs 0-3 are on the first socket and 4-7 on the second.
+func qemuTestCPUInfo() *api.ResourcesCPU {
+	cpuInfo := &api.ResourcesCPU{}
+
+	id := int64(0)
+	for socket := uint64(0); socket < 2; socket++ {
+		cpuSocket := api.ResourcesCPUSocket{Socket: socket}
+
+		for core := uint64(0); core < 2; core++ {
+			cpuCore := api.ResourcesCPUCore{Core: core, NUMANode: socket}
+
+			for thread := uint64(0); thread < 2; thread++ {
+				cpuCore.Threads = append(cpuCore.Threads, api.ResourcesCPUThread{ID: id, Thread: thread, Online: true})
+				id++
+			}
+
+			cpuSocket.Cores = append(cpuSocket.Cores, cpuCore)
+		}
+
+		cpuInfo.Sockets = append(cpuInfo.Sockets, cpuSocket)
+	}
+
+	cpuInfo.Total = uint64(id)
+
+	return cpuInfo
+}
+
+// Test that pinning across two sockets generates a NUMA node per socket.
+func TestQemuAddCPUPinnedConfig_NUMA(t *testing.T) {
+	vm := &qemu{
+		common: common{
+			expandedConfig: map[string]string{
+				"limits.cpu":    "0-7",
+				"limits.memory": "4GiB",
+			},
+		},
+		architectureName: "x86_64",
+	}
+
+	sb := &strings.Builder{}
+	err := vm.addCPUPinnedConfig(sb, qemuTestCPUInfo(), vm.expandedConfig["limits.cpu"])
+	assert.NoError(t, err)
+
+	conf := sb.String()
+	assert.Contains(t, conf, `sockets = "2"`)
+	assert.Contains(t, conf, `cores = "2"`)
+	assert.Contains(t, conf, `threads = "2"`)
+	assert.Equal(t, 2, strings.Count(conf, "[numa]"))
+	assert.Contains(t, conf, "nodeid = \"0\"\ncpus = \"0-3\"\nmemdev = \"qemu_numa0\"")
+	assert.Contains(t, conf, "nodeid = \"1\"\ncpus = \"4-7\"\nmemdev = \"qemu_numa1\"")
+	assert.Equal(t, 2, strings.Count(conf, `size = "2147483648B"`))
+	assert.Contains(t, conf, `host-nodes = "0"`)
+	assert.Contains(t, conf, `host-nodes = "1"`)
+}
+
+// Test that pinning within a single socket doesn't generate any NUMA node.
+func TestQemuAddCPUPinnedConfig_SingleNode(t *testing.T) {
+	vm := &qemu{
+		common: common{
+			expandedConfig: map[string]string{
+				"limits.cpu": "0-3",
+			},
+		},
+		architectureName: "x86_64",
+	}
+
+	sb := &strings.Builder{}
+	err := vm.addCPUPinnedConfig(sb, qemuTestCPUInfo(), vm.expandedConfig["limits.cpu"])
+	assert.NoError(t, err)
+
+	conf := sb.String()
+	assert.Contains(t, conf, `cpus = "4"`)
+	assert.NotContains(t, conf, "[numa]")
+}
+
+// Test that guest NUMA nodes are only used when the pinned CPUs span several host NUMA nodes.
+func TestQemuUsesNUMANodes(t *testing.T) {
+	getCPU := func() (*api.ResourcesCPU, error) { return qemuTestCPUInfo(), nil }
+
+	tests := []struct {
+		config map[string]string
+		numa   bool
+	}{
+		{map[string]string{}, false},
+		{map[string]string{"limits.cpu": "8"}, false},
+		{map[string]string{"limits.cpu": "0-3"}, false},
+		{map[string]string{"limits.cpu": "0-7"}, true},
+		{map[string]string{"limits.cpu": "2-5"}, true},
+		{map[string]string{"limits.cpu": "0-7", "limits.cpu.max": "16"}, false},
+	}
+
+	for _, test := range tests {
+		vm := &qemu{common: common{expandedConfig: test.config}}
+		numa, err := vm.usesNUMANodes(getCPU)
+		require.NoError(t, err)
+		assert.Equal(t, test.numa, numa, test.config)
+	}
+}
+
+// Test that limits.cpu.max reserves room for hot-plugging vCPUs.
+func TestQemuAddCPUConfig_MaxCPUs(t *testing.T) {
+	vm := &qemu{
+		common: common{
+			expandedConfig: map[string]string{
+				"limits.cpu":     "2",
+				"limits.cpu.max": "8",
+			},
+		},
+		architectureName: "x86_64",
+	}
+
+	sb := &strings.Builder{}
+	err := vm.addCPUConfig(sb)
+	assert.NoError(t, err)
+	assert.Contains(t, sb.String(), "cpus = \"2\"\nmaxcpus = \"8\"\nsockets = \"1\"\ncores = \"8\"\nthreads = \"1\"")
+
+	vm.expandedConfig["limits.cpu"] = "10"
+	err = vm.addCPUConfig(&strings.Builder{})
+	assert.Error(t, err)
+}
+
+// qemuTestVM returns the VM vm1 of the default project, with LXD_DIR set to a temporary directory
+// holding its log directory. The returned function removes them.
+func qemuTestVM(t *testing.T) (*qemu, func()) {
+	dir, err := ioutil.TempDir("", "lxd-qemu-test-")
+	require.NoError(t, err)
+
+	os.Setenv("LXD_DIR", dir)
+	cleanup := func() {
+		os.Unsetenv("LXD_DIR")
+		os.RemoveAll(dir)
+	}
+
+	vm := &qemu{common: common{project: "default"}, name: "vm1"}
+	err = os.MkdirAll(vm.LogPath(), 0700)
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+
+	return vm, cleanup
+}
+
+// Test that vCPUs are matched by their socket, core and thread rather than the order qemu lists them in.
+func TestQemuVCPUThreads(t *testing.T) {
+	vm, cleanup := qemuTestVM(t)
+	defer cleanup()
+
+	stop := qemuTestQMPServer(t, vm.getMonitorPath())
+	defer stop()
+
+	monitor, err := vm.getMonitor()
+	require.NoError(t, err)
+	defer monitor.Disconnect()
+
+	// One socket of two cores of two threads each, numbered by qemu in socket, core and thread order.
+	cpus, err := qemuGetVCPUs(monitor)
+	require.NoError(t, err)
+	require.Len(t, cpus, 4)
+
+	threads, err := qemuVCPUThreads(cpus, 1, 2, 2)
+	require.NoError(t, err)
+	assert.Equal(t, map[uint64]int{0: 1000, 1: 1001, 2: 1002, 3: 1003}, threads)
+
+	// The order the vCPUs are listed in doesn't matter.
+	reversed := []qmp.CPU{cpus[3], cpus[2], cpus[1], cpus[0]}
+	threads, err = qemuVCPUThreads(reversed, 1, 2, 2)
+	require.NoError(t, err)
+	assert.Equal(t, map[uint64]int{0: 1000, 1: 1001, 2: 1002, 3: 1003}, threads)
+
+	// The vCPUs don't fit a topology with a single thread per core.
+	_, err = qemuVCPUThreads(cpus, 1, 4, 1)
+	assert.Error(t, err)
+
+	// Nor one with fewer sockets than reported.
+	cpus = append(cpus, qmp.CPU{Index: 4, ThreadID: 1004, Props: map[string]int{"socket-id": 1, "core-id": 0, "thread-id": 0}})
+	_, err = qemuVCPUThreads(cpus, 1, 2, 2)
+	assert.EqualError(t, err, "vCPU 4 is outside of the configured topology (socket 1, core 0, thread 0)")
+
+	// The qemu CPU index is used when the position of the vCPUs isn't reported.
+	threads, err = qemuVCPUThreads([]qmp.CPU{{Index: 0, ThreadID: 1000}, {Index: 1, ThreadID: 1001}}, 1, 2, 1)
+	require.NoError(t, err)
+	assert.Equal(t, map[uint64]int{0: 1000, 1: 1001}, threads)
+
+	_, err = qemuVCPUThreads([]qmp.CPU{{Index: 0, ThreadID: 1000}, {Index: 0, ThreadID: 1001}}, 1, 2, 1)
+	assert.Error(t, err)
+}
+
+// Test that limits.memory.max reserves room for hot-adding memory.
+func TestQemuAddMemoryConfig_MaxMemory(t *testing.T) {
+	vm := &qemu{
+		common: common{
+			expandedConfig: map[string]string{
+				"limits.memory":     "1GiB",
+				"limits.memory.max": "4GiB",
+			},
+		},
+		architectureName: "x86_64",
+	}
+
+	sb := &strings.Builder{}
+	err := vm.addMemoryConfig(sb)
+	assert.NoError(t, err)
+	assert.Contains(t, sb.String(), "size = \"1073741824B\"\nslots = \"16\"\nmaxmem = \"4294967296B\"")
+
+	vm.expandedConfig["limits.memory"] = "8GiB"
+	err = vm.addMemoryConfig(&strings.Builder{})
+	assert.Error(t, err)
+
+	// Without limits.memory.max, no memory can be hot-added.
+	delete(vm.expandedConfig, "limits.memory.max")
+	sb = &strings.Builder{}
+	err = vm.addMemoryConfig(sb)
+	assert.NoError(t, err)
+	assert.NotContains(t, sb.String(), "maxmem")
+}
+
+// Test that memory is hot-added as a DIMM once the guest acknowledged it.
+func TestQemuSetMemory(t *testing.T) {
+	vm, cleanup := qemuTestVM(t)
+	defer cleanup()
+
+	vm.expandedConfig = map[string]string{
+		"limits.memory":     "2GiB",
+		"limits.memory.max": "4GiB",
+	}
+
+	stop := qemuTestQMPServer(t, vm.getMonitorPath())
+	defer stop()
+
+	// The VM has 1.5GiB of memory, so a 512MiB DIMM is added.
+	err := vm.setMemory(nil)
+	require.NoError(t, err)
+	defer qemuTestDisconnect(vm)
+
+	// Memory can't be removed, added beyond limits.memory.max or in partial blocks.
+	vm.expandedConfig["limits.memory"] = "1GiB"
+	assert.Error(t, vm.setMemory(nil))
+
+	vm.expandedConfig["limits.memory"] = "5GiB"
+	assert.Error(t, vm.setMemory(nil))
+
+	vm.expandedConfig["limits.memory"] = "1600MiB"
+	assert.Error(t, vm.setMemory(nil))
+
+	// Nothing is added when the memory already matches.
+	vm.expandedConfig["limits.memory"] = "1536MiB"
+	assert.NoError(t, vm.setMemory(nil))
+}
+
+// Test that the monitor is only considered alive while the process in the pidfile is the VM's own.
+func TestQemuMonitorAlive(t *testing.T) {
+	vm, cleanup := qemuTestVM(t)
+	defer cleanup()
+
+	// No pidfile.
+	assert.False(t, vm.monitorAlive())
+
+	// PID reused by an unrelated process.
+	require.NoError(t, ioutil.WriteFile(vm.pidFilePath(), []byte(fmt.Sprintf("%d\n", os.Getpid())), 0600))
+	assert.False(t, vm.monitorAlive())
+
+	// Process started with the VM's pidfile.
+	cmd := exec.Command("sh", "-c", "sleep 60; :", "sh", "-pidfile", vm.pidFilePath())
+	require.NoError(t, cmd.Start())
+	defer cmd.Process.Kill()
+
+	require.NoError(t, ioutil.WriteFile(vm.pidFilePath(), []byte(fmt.Sprintf("%d\n", cmd.Process.Pid)), 0600))
+	assert.True(t, vm.monitorAlive())
+}
+
+// Test that qemuKill only returns once the process is gone.
+func TestQemuKill(t *testing.T) {
+	cmd := exec.Command("sleep", "60")
+	require.NoError(t, cmd.Start())
+
+	// Reap the process as qemu would be reaped by init once daemonized.
+	go cmd.Wait()
+
+	require.NoError(t, qemuKill(cmd.Process.Pid, 5*time.Second))
+	assert.Equal(t, unix.ESRCH, unix.Kill(cmd.Process.Pid, 0))
+
+	// Killing a process which already exited isn't an error.
+	assert.NoError(t, qemuKill(cmd.Process.Pid, 5*time.Second))
+}
+
+// Test that qemuTerminate falls back to SIGKILL for a process ignoring SIGTERM, as qemu stuck on I/O would.
+func TestQemuTerminate(t *testing.T) {
+	cmd := exec.Command("sleep", "60")
+	require.NoError(t, cmd.Start())
+	go cmd.Wait()
+
+	start := time.Now()
+	require.NoError(t, qemuTerminate(cmd.Process.Pid, 5*time.Second))
+	assert.Equal(t, unix.ESRCH, unix.Kill(cmd.Process.Pid, 0))
+	assert.True(t, time.Since(start) < 5*time.Second)
+
+	// The ignored signal disposition is kept across exec.
+	cmd = exec.Command("sh", "-c", `trap "" TERM; exec sleep 60`)
+	require.NoError(t, cmd.Start())
+
+	exited := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(exited)
+	}()
+
+	// Let the shell set up the trap.
+	time.Sleep(200 * time.Millisecond)
+
+	start = time.Now()
+	require.NoError(t, qemuTerminate(cmd.Process.Pid, time.Second))
+	<-exited
+	assert.True(t, time.Since(start) >= time.Second)
+	assert.Equal(t, "signal: killed", cmd.ProcessState.String())
+}
+
+func TestQemuExitDetails(t *testing.T) {
+	cmd := exec.Command("sh", "-c", "exit 3")
+	cmd.Run()
+	assert.Equal(t, map[string]interface{}{"exit_code": 3, "signal": ""}, qemuExitDetails(cmd.ProcessState))
+
+	cmd = exec.Command("sh", "-c", "kill -SEGV $$")
+	cmd.Run()
+	assert.Equal(t, map[string]interface{}{"exit_code": -1, "signal": "SIGSEGV"}, qemuExitDetails(cmd.ProcessState))
+}
+
+func TestQemuWaitQemuStart(t *testing.T) {
+	vm, cleanup := qemuTestVM(t)
+	defer cleanup()
+
+	// qemu exiting during start up.
+	cmd := exec.Command("sh", "-c", "exit 1")
+	cmd.Run()
+	exited := make(chan *os.ProcessState, 1)
+	exited <- cmd.ProcessState
+	err := vm.waitQemuStart(exited, 5*time.Second)
+	assert.EqualError(t, err, "qemu exited during start up (exit status 1)")
+
+	// qemu not done setting up.
+	err = vm.waitQemuStart(make(chan *os.ProcessState), 300*time.Millisecond)
+	assert.Error(t, err)
+
+	// qemu's monitor answering.
+	stop := qemuTestQMPServer(t, vm.getMonitorPath())
+	defer stop()
+
+	err = vm.waitQemuStart(make(chan *os.ProcessState), 5*time.Second)
+	require.NoError(t, err)
+	qemuTestDisconnect(vm)
+}
+
+// qemuTestVar is a variable stored in a test OVMF variable store.
+type qemuTestVar struct {
+	name  string
+	state byte
+	data  []byte
+}
+
+// qemuTestVarStore builds an OVMF authenticated variable store holding the supplied variables.
+func qemuTestVarStore(vars []qemuTestVar) []byte {
+	buf := make([]byte, 72)
+	copy(buf[40:44], "_FVH")
+	binary.LittleEndian.PutUint16(buf[48:50], 72)
+
+	storeHdr := make([]byte, efiVariableStoreHdrLen)
+	copy(storeHdr, efiAuthVariableGUID)
+	buf = append(buf, storeHdr...)
+
+	for _, v := range vars {
+		name := []byte{}
+		for _, c := range utf16.Encode([]rune(v.name + "\x00")) {
+			name = append(name, byte(c), byte(c>>8))
+		}
+
+		hdr := make([]byte, efiAuthVariableHdrLen)
+		binary.LittleEndian.PutUint16(hdr[0:2], efiVariableStartID)
+		hdr[2] = v.state
+		binary.LittleEndian.PutUint32(hdr[36:40], uint32(len(name)))
+		binary.LittleEndian.PutUint32(hdr[40:44], uint32(len(v.data)))
+
+		buf = append(buf, hdr...)
+		buf = append(buf, name...)
+		buf = append(buf, v.data...)
+		for len(buf)%4 != 0 {
+			buf = append(buf, 0xff)
+		}
+	}
+
+	return append(buf, 0xff, 0xff, 0xff, 0xff)
+}
+
+// Test that only the live secure boot key variables are extracted from an OVMF variable store.
+func TestEFISecureBootKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lxd-qemu-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "qemu.nvram")
+	store := qemuTestVarStore([]qemuTestVar{
+		{name: "PK", state: efiVariableStateAdded, data: []byte("platform key")},
+		{name: "db", state: 0x3c, data: []byte("deleted")},
+		{name: "Boot0000", state: efiVariableStateAdded, data: []byte("boot entry")},
+		{name: "db", state: efiVariableStateAdded, data: []byte("signatures")},
+	})
+	require.NoError(t, ioutil.WriteFile(path, store, 0600))
+
+	keys, err := efiSecureBootKeys(path)
+	require.NoError(t, err)
+	assert.Equal(t, map[string][]byte{"PK": []byte("platform key"), "db": []byte("signatures")}, keys)
+
+	assert.True(t, efiSameSecureBootKeys(keys, map[string][]byte{"PK": []byte("platform key"), "db": []byte("signatures")}))
+	assert.False(t, efiSameSecureBootKeys(keys, map[string][]byte{"PK": []byte("platform key")}))
+}
+
+// Test that the EFI firmware is looked up by file name variant and that the searched paths are reported.
+func TestQemuFindFirmware(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lxd-qemu-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	os.Setenv("LXD_OVMF_PATH", dir)
+	defer os.Unsetenv("LXD_OVMF_PATH")
+
+	for _, name := range []string{"OVMF_CODE_4M.fd", "OVMF_VARS_4M.fd", "OVMF_VARS.ms.fd"} {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), nil, 0600))
+	}
+
+	firmware, err := qemuFindFirmware(osarch.ARCH_64BIT_INTEL_X86, false)
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, "OVMF_CODE_4M.fd"), firmware.code)
+	assert.Equal(t, filepath.Join(dir, "OVMF_VARS_4M.fd"), firmware.vars)
+
+	// The secure boot settings are there but not the matching code.
+	_, err = qemuFindFirmware(osarch.ARCH_64BIT_INTEL_X86, true)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), filepath.Join(dir, "OVMF_CODE.fd"))
+}
+
+// qemuTestCheckConfig checks the consistency of a generated qemu config file. Named sections must
+// be unique, devices must be plugged into known buses and no two devices may share an address.
+func qemuTestCheckConfig(t *testing.T, conf string) {
+	sectionRegex := regexp.MustCompile(`^\[([a-z-]+)(?: "([^"]+)")?\]$`)
+	valueRegex := regexp.MustCompile(`^([a-z0-9_-]+) = "(.*)"$`)
+
+	type device struct {
+		id   string
+		bus  string
+		addr string
+	}
+
+	sections := map[string]bool{}
+	buses := map[string]bool{}
+	devices := []*device{}
+
+	var current *device
+	for _, line := range strings.Split(conf, "\n") {
+		match := sectionRegex.FindStringSubmatch(line)
+		if match != nil {
+			current = nil
+			if match[2] != "" {
+				key := match[1] + " " + match[2]
+				assert.False(t, sections[key], "Duplicate section %q", key)
+				sections[key] = true
+			}
+
+			if match[1] == "device" {
+				current = &device{id: match[2]}
+				devices = append(devices, current)
+				buses[match[2]] = true
+				buses[match[2]+".0"] = true
+			}
+
+			continue
+		}
+
+		match = valueRegex.FindStringSubmatch(line)
+		if match == nil || current == nil {
+			continue
+		}
+
+		if match[1] == "bus" {
+			current.bus = match[2]
+		} else if match[1] == "addr" {
+			current.addr = match[2]
+		}
+	}
+
+	addrs := map[string]string{}
+	for _, dev := range devices {
+		if dev.bus == "" {
+			continue
+		}
+
+		if dev.bus != "pcie.0" && dev.bus != "pci.0" {
+			assert.True(t, buses[dev.bus], "Device %q plugged into unknown bus %q", dev.id, dev.bus)
+		}
+
+		if dev.addr == "" {
+			continue
+		}
+
+		// An address without a function refers to function 0.
+		addr := dev.addr
+		if !strings.Contains(addr, ".") {
+			addr += ".0x0"
+		}
+
+		key := dev.bus + "/" + addr
+		assert.Equal(t, "", addrs[key], "Devices %q and %q share address %q", addrs[key], dev.id, key)
+		addrs[key] = dev.id
+	}
+}
+
+// Test that a consistent config file is generated for each supported architecture.
+func TestQemuGenerateConfigFile_Architectures(t *testing.T) {
+	vm, cleanup := qemuTestVM(t)
+	defer cleanup()
+
+	vm.dbType = instancetype.VM
+	vm.expandedConfig = map[string]string{
+		"limits.cpu":               "2",
+		"security.tpm":             "true",
+		"security.watchdog.action": "reset",
+	}
+
+	require.NoError(t, os.MkdirAll(filepath.Join(vm.Path(), "config"), 0700))
+
+	ovmfDir := shared.VarPath("ovmf")
+	require.NoError(t, os.MkdirAll(ovmfDir, 0700))
+	for _, name := range []string{"OVMF_CODE.fd", "OVMF_VARS.ms.fd"} {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(ovmfDir, name), nil, 0600))
+	}
+
+	os.Setenv("LXD_OVMF_PATH", ovmfDir)
+	defer os.Unsetenv("LXD_OVMF_PATH")
+
+	tests := []struct {
+		architecture     int
+		architectureName string
+		machine          string
+		pcie             bool
+		firmware         bool
+	}{
+		{osarch.ARCH_64BIT_INTEL_X86, "x86_64", "q35", true, true},
+		{osarch.ARCH_64BIT_ARMV8_LITTLE_ENDIAN, "aarch64", "virt", true, true},
+		{osarch.ARCH_64BIT_POWERPC_LITTLE_ENDIAN, "ppc64le", "pseries", false, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.architectureName, func(t *testing.T) {
+			vm.architecture = test.architecture
+			vm.architectureName = test.architectureName
+
+			confPath, err := vm.generateQemuConfigFile(nil, &[]string{})
+			require.NoError(t, err)
+
+			content, err := ioutil.ReadFile(confPath)
+			require.NoError(t, err)
+			conf := string(content)
+
+			assert.Contains(t, conf, fmt.Sprintf("type = %q", test.machine))
+			assert.Equal(t, test.pcie, strings.Contains(conf, `bus = "pcie.0"`))
+			assert.Equal(t, !test.pcie, strings.Contains(conf, `bus = "pci.0"`))
+			assert.Equal(t, test.firmware, strings.Contains(conf, `if = "pflash"`))
+			qemuTestCheckConfig(t, conf)
+		})
+	}
+}
+
+// Test that PCIe root ports get unique ports and valid addresses, spilling over to new slots.
+func TestQemuPCIeRootPort(t *testing.T) {
+	addrs := map[string]bool{}
+	ports := map[string]bool{}
+	for i := 0; i < 32; i++ {
+		port, addr, multifunction := qemuPCIeRootPort(i)
+		assert.False(t, addrs[addr])
+		assert.False(t, ports[port])
+		assert.Equal(t, i%8 == 0, multifunction)
+		addrs[addr] = true
+		ports[port] = true
+	}
+
+	port, addr, _ := qemuPCIeRootPort(4)
+	assert.Equal(t, "0x14", port)
+	assert.Equal(t, "0x2.0x4", addr)
+
+	_, addr, multifunction := qemuPCIeRootPort(8)
+	assert.Equal(t, "0x1e.0x0", addr)
+	assert.True(t, multifunction)
+}
+
+// Test that qemu errors are traced back to the raw.qemu argument causing them.
+func TestQemuRawArgError(t *testing.T) {
+	rawArgs := []string{"-smbios", "type=1,product=My VM", "-no-hpet", "-device", "foo,bar=1"}
+
+	err := qemuRawArgError(rawArgs, "qemu-system-x86_64: -device foo,bar=1: 'foo' is not a valid device model name\n")
+	assert.EqualError(t, err, `Invalid raw.qemu argument 4 ("-device foo,bar=1"): 'foo' is not a valid device model name`)
+
+	err = qemuRawArgError(rawArgs, "qemu-system-x86_64: -no-hpet: invalid option\n")
+	assert.EqualError(t, err, `Invalid raw.qemu argument 3 ("-no-hpet"): invalid option`)
+
+	err = qemuRawArgError(rawArgs, "qemu-system-x86_64: -drive file=/tmp/foo: Could not open '/tmp/foo'\n")
+	assert.Nil(t, err)
+}
+
+// Test parsing the debug log items supported by qemu.
+func TestQemuParseDebugItems(t *testing.T) {
+	out := `Log items (comma separated):
+out_asm         show generated host assembly code for each compiled TB
+in_asm          show target assembly code for each compiled TB
+int             show interrupts/exceptions in short format
+guest_errors    log when the guest OS does something invalid (eg accessing a
+non-existent register)
+unimp           log unimplemented functionality
+trace:PATTERN   enable trace events
+
+Use "-d trace:help" to get a list of trace events.
+`
+
+	items := qemuParseDebugItems(out)
+	assert.Equal(t, []string{"out_asm", "in_asm", "int", "guest_errors", "unimp"}, items)
+}
+
+// Test that OnStop can clean up after a VM which stopped without going through Stop, taking and
+// releasing its own stop lock rather than panicking on a missing one.
+func TestQemuOnStop_NoLock(t *testing.T) {
+	vm, cleanup := qemuTestVM(t)
+	defer cleanup()
+
+	s, cleanupState := state.NewTestState(t)
+	defer cleanupState()
+
+	vm.dbType = instancetype.VM
+	vm.state = s
+	vm.id = 1000
+
+	require.Nil(t, operationlock.Get(vm.id))
+
+	// The instance doesn't exist in the database, whether recording its state fails or not the
+	// stop lock must be released.
+	vm.OnStop("stop")
+	assert.Nil(t, operationlock.Get(vm.id))
+
+	// A concurrent operation isn't stepped on.
+	op, err := operationlock.Create(vm.id, "start", false, false)
+	require.NoError(t, err)
+	defer op.Done(nil)
+
+	err = vm.OnStop("stop")
+	assert.EqualError(t, err, "Instance is already running a start operation")
+}
+
+// Test that a concurrent OnStop for the same stop operation waits for the one cleaning up rather
+// than cleaning up again.
+func TestQemuOnStop_Concurrent(t *testing.T) {
+	vm := &qemu{common: common{dbType: instancetype.VM, project: "default"}, id: 1001, name: "vm-onstop"}
+
+	op, err := operationlock.Create(vm.id, "stop", false, true)
+	require.NoError(t, err)
+
+	// Another caller is cleaning up for the operation.
+	vmOnStopLock.Lock()
+	vmOnStop[vm.id] = op
+	vmOnStopLock.Unlock()
+
+	defer func() {
+		vmOnStopLock.Lock()
+		delete(vmOnStop, vm.id)
+		vmOnStopLock.Unlock()
+	}()
+
+	done := make(chan error)
+	go func() {
+		done <- vm.OnStop("stop")
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("OnStop didn't wait for the ongoing stop")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	op.Done(nil)
+	assert.NoError(t, <-done)
+}
+
+// Test that a VM is paused and resumed under the instance operation lock, so that it can't race with
+// a stop, and only from the states it applies to.
+func TestQemuFreeze(t *testing.T) {
+	var lock sync.Mutex
+	status := "running"
+	commands := []string{}
+
+	vm, cleanup := qemuTestRunningVM(t, map[string]string{}, func(command string, args map[string]interface{}) string {
+		lock.Lock()
+		defer lock.Unlock()
+
+		switch command {
+		case "query-status":
+			return fmt.Sprintf(`{"return": {"status": %q, "running": %v, "singlestep": false}}`, status, status == "running")
+		case "stop":
+			status = "paused"
+		case "cont":
+			status = "running"
+		default:
+			return ""
+		}
+
+		commands = append(commands, command)
+		return `{"return": {}}`
+	})
+	defer cleanup()
+
+	assert.EqualError(t, vm.Unfreeze(), "The instance isn't paused")
+
+	// A stop in progress keeps the VM from being paused.
+	stopOp, err := operationlock.Create(vm.id, "stop", false, true)
+	require.NoError(t, err)
+	assert.EqualError(t, vm.Freeze(), "Instance is busy running a stop operation")
+	stopOp.Done(nil)
+
+	require.NoError(t, vm.Freeze())
+	assert.True(t, vm.IsFrozen())
+	assert.Nil(t, operationlock.Get(vm.id))
+
+	assert.EqualError(t, vm.Freeze(), "The instance is already paused")
+
+	// A stop in progress keeps the VM from being resumed.
+	stopOp, err = operationlock.Create(vm.id, "stop", false, true)
+	require.NoError(t, err)
+	assert.EqualError(t, vm.Unfreeze(), "Instance is busy running a stop operation")
+	stopOp.Done(nil)
+
+	require.NoError(t, vm.Unfreeze())
+	assert.False(t, vm.IsFrozen())
+	assert.True(t, vm.IsRunning())
+	assert.Nil(t, operationlock.Get(vm.id))
+
+	lock.Lock()
+	assert.Equal(t, []string{"stop", "cont"}, commands)
+	lock.Unlock()
+}
+
+// Test that a guest ignoring the ACPI power button event is sent another one every
+// boot.shutdown_retry_interval seconds, until the shutdown times out.
+func TestQemuShutdown_Retry(t *testing.T) {
+	tests := []struct {
+		name       string
+		config     map[string]string
+		timeout    time.Duration
+		powerdowns int
+	}{
+		{"no retries", map[string]string{}, 1500 * time.Millisecond, 1},
+		{"retries", map[string]string{"boot.shutdown_retry_interval": "1"}, 2500 * time.Millisecond, 3},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var lock sync.Mutex
+			powerdowns := 0
+
+			vm, cleanup := qemuTestRunningVM(t, test.config, func(command string, args map[string]interface{}) string {
+				if command == "system_powerdown" {
+					lock.Lock()
+					powerdowns++
+					lock.Unlock()
+				}
+
+				return ""
+			})
+			defer cleanup()
+
+			err := vm.Shutdown(test.timeout)
+			assert.EqualError(t, err, "Instance was not shutdown after timeout")
+
+			lock.Lock()
+			assert.Equal(t, test.powerdowns, powerdowns)
+			lock.Unlock()
+
+			// The stop lock is released for the next attempt.
+			assert.Nil(t, operationlock.Get(vm.id))
+		})
+	}
+}
+
+// qemuTestQMPServer serves a minimal QMP monitor on path, reporting a running VM. The returned
+// function stops the server.
+func qemuTestQMPServer(t testing.TB, path string) func() {
+	return qemuTestQMPServerStatus(t, path, "running")
+}
+
+// qemuTestQMPServerStatus serves a minimal QMP monitor on path, reporting the VM in the given run
+// state. The returned function stops the server.
+func qemuTestQMPServerStatus(t testing.TB, path string, status string) func() {
+	return qemuTestQMPServerHandler(t, path, status, nil)
+}
+
+// qemuTestQMPServerHandler serves a minimal QMP monitor on path, reporting the VM in the given run
+// state. Commands are passed to handler first, if any, which returns the reply to send or an empty
+// string for the default one. The returned function stops the server.
+func qemuTestQMPServerHandler(t testing.TB, path string, status string, handler func(command string, args map[string]interface{}) string) func() {
+	l, err := net.Listen("unix", path)
+	require.NoError(t, err)
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func(conn net.Conn) {
+				defer conn.Close()
+
+				fmt.Fprintln(conn, `{"QMP": {"version": {"qemu": {"micro": 0, "minor": 0, "major": 5}, "package": ""}, "capabilities": []}}`)
+
+				decoder := json.NewDecoder(conn)
+				for {
+					var req struct {
+						Execute   string                 `json:"execute"`
+						Arguments map[string]interface{} `json:"arguments"`
+					}
+
+					err := decoder.Decode(&req)
+					if err != nil {
+						return
+					}
+
+					if handler != nil {
+						reply := handler(req.Execute, req.Arguments)
+						if reply != "" {
+							fmt.Fprintln(conn, reply)
+							continue
+						}
+					}
+
+					switch req.Execute {
+					case "query-status":
+						fmt.Fprintf(conn, `{"return": {"status": %q, "running": %v, "singlestep": false}}`+"\n", status, status == "running")
+					case "ringbuf-read":
+						if req.Arguments["device"] == "qemu_guest-log" {
+							fmt.Fprintf(conn, `{"return": %q}`+"\n", base64.StdEncoding.EncodeToString([]byte("guest booted\n")))
+						} else {
+							fmt.Fprintln(conn, `{"return": ""}`)
+						}
+					case "query-balloon":
+						fmt.Fprintln(conn, `{"return": {"actual": 1073741824}}`)
+					case "query-memory-size-summary":
+						fmt.Fprintln(conn, `{"return": {"base-memory": 1073741824, "plugged-memory": 536870912}}`)
+					case "query-cpus-fast":
+						fmt.Fprintln(conn, `{"return": [`+
+							`{"cpu-index": 0, "thread-id": 1000, "props": {"socket-id": 0, "core-id": 0, "thread-id": 0}},`+
+							`{"cpu-index": 1, "thread-id": 1001, "props": {"socket-id": 0, "core-id": 0, "thread-id": 1}},`+
+							`{"cpu-index": 2, "thread-id": 1002, "props": {"socket-id": 0, "core-id": 1, "thread-id": 0}},`+
+							`{"cpu-index": 3, "thread-id": 1003, "props": {"socket-id": 0, "core-id": 1, "thread-id": 1}}]}`)
+					case "qom-list":
+						fmt.Fprintln(conn, `{"return": []}`)
+					case "qom-get":
+						fmt.Fprintln(conn, `{"error": {"class": "DeviceNotFound", "desc": "Device not found"}}`)
+					case "query-acpi-ospm-status":
+						fmt.Fprintln(conn, `{"return": [{"device": "qemu_dimm0", "slot": "0", "slot-type": "DIMM", "source": 1, "status": 0}, {"device": "", "slot": "1", "slot-type": "DIMM", "source": 0, "status": 0}]}`)
+					case "query-blockstats":
+						fmt.Fprintln(conn, `{"return": [{"device": "lxd_root", "stats": {"rd_bytes": 512, "wr_bytes": 1024, "rd_operations": 1, "wr_operations": 2}}, {"device": "pflash0", "stats": {}}]}`)
+					default:
+						fmt.Fprintln(conn, `{"return": {}}`)
+					}
+				}
+			}(conn)
+		}
+	}()
+
+	return func() { l.Close() }
+}
+
+// qemuTestDisconnect disconnects from the monitor of a test VM, if connected.
+func qemuTestDisconnect(vm *qemu) {
+	monitor, err := vm.getMonitor()
+	if err == nil {
+		monitor.Disconnect()
+	}
+}
+
+// Test that the monitor handle is cached and shared until it gets disconnected.
+func TestQemuGetMonitor(t *testing.T) {
+	vm, cleanup := qemuTestVM(t)
+	defer cleanup()
+
+	// No monitor socket.
+	_, err := vm.getMonitor()
+	assert.Error(t, err)
+	assert.Equal(t, api.Stopped, vm.statusCode())
+
+	stop := qemuTestQMPServer(t, vm.getMonitorPath())
+	defer stop()
+
+	monitor, err := vm.getMonitor()
+	require.NoError(t, err)
+	assert.Equal(t, api.Running, vm.statusCode())
+	assert.True(t, monitor == vm.monitor)
+
+	// Another handle on the same VM shares the connection.
+	other := &qemu{common: common{project: "default"}, name: "vm1"}
+	otherMonitor, err := other.getMonitor()
+	require.NoError(t, err)
+	assert.True(t, otherMonitor == monitor)
+
+	// A disconnected handle is replaced.
+	monitor.Disconnect()
+	newMonitor, err := vm.getMonitor()
+	require.NoError(t, err)
+	assert.False(t, newMonitor == monitor)
+	newMonitor.Disconnect()
+}
+
+// Benchmark getting the status of many running VMs using their cached monitor handle against looking
+// up the monitor of each VM every time.
+func BenchmarkQemuStatusCode(b *testing.B) {
+	dir, err := ioutil.TempDir("", "lxd-qemu-test-")
+	require.NoError(b, err)
+	defer os.RemoveAll(dir)
+
+	os.Setenv("LXD_DIR", dir)
+	defer os.Unsetenv("LXD_DIR")
+
+	vms := []*qemu{}
+	for i := 0; i < 50; i++ {
+		vm := &qemu{common: common{project: "default"}, name: fmt.Sprintf("vm%d", i)}
+		require.NoError(b, os.MkdirAll(vm.LogPath(), 0700))
+
+		stop := qemuTestQMPServer(b, vm.getMonitorPath())
+		defer stop()
+		defer qemuTestDisconnect(vm)
+
+		vms = append(vms, vm)
+	}
+
+	b.Run("cached", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, vm := range vms {
+				vm.statusCode()
+			}
+		}
+	})
+
+	b.Run("lookup", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, vm := range vms {
+				vm.monitor = nil
+				vm.statusCode()
+			}
+		}
+	})
+}
+
+// Test that the run states qemu pauses the VM in are reported as frozen, along with the reason.
+func TestQemuStatusCodeRunStates(t *testing.T) {
+	vm, cleanup := qemuTestVM(t)
+	defer cleanup()
+
+	vm.localConfig = map[string]string{"volatile.vm.pause_reason": "I/O error"}
+
+	tests := map[string]api.StatusCode{
+		"running":        api.Running,
+		"paused":         api.Frozen,
+		"io-error":       api.Frozen,
+		"suspended":      api.Frozen,
+		"watchdog":       api.Frozen,
+		"guest-panicked": api.Error,
+		"internal-error": api.Error,
+		"shutdown":       api.Stopped,
+		"postmigrate":    api.Stopped,
+	}
+
+	for runState, statusCode := range tests {
+		stop := qemuTestQMPServerStatus(t, vm.getMonitorPath(), runState)
+		assert.Equal(t, statusCode, vm.statusCode(), runState)
+
+		if statusCode != api.Running {
+			state, err := vm.RenderState()
+			require.NoError(t, err)
+			assert.Equal(t, statusCode, state.StatusCode, runState)
+
+			if statusCode == api.Frozen {
+				assert.Equal(t, "I/O error", state.PauseReason, runState)
+			} else {
+				assert.Equal(t, "", state.PauseReason, runState)
+			}
+		}
+
+		qemuTestDisconnect(vm)
+		stop()
+		os.Remove(vm.getMonitorPath())
+	}
+}
+
+// qemuTestAgent is a minimal lxd-agent recording the exec requests and control messages it receives.
+// It can be made flaky, failing a number of connections, or unreachable.
+type qemuTestAgent struct {
+	extensions []string
+	exec       chan api.InstanceExecPost
+	control    chan api.InstanceExecControl
+
+	dialFailures int32
+	down         int32
+}
+
+func (a *qemuTestAgent) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/1.0":
+		server := api.Server{}
+		server.APIExtensions = a.extensions
+		json.NewEncoder(w).Encode(api.ResponseRaw{Type: api.SyncResponse, Status: "Success", StatusCode: 200, Metadata: server})
+	case "/1.0/exec":
+		req := api.InstanceExecPost{}
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		a.exec <- req
+
+		fds := map[string]string{"control": "control", "0": "0"}
+		if !req.Interactive {
+			fds["1"] = "1"
+			fds["2"] = "2"
+		}
+
+		op := api.Operation{ID: "exec", Class: "websocket", Status: "Running", StatusCode: api.Running, Metadata: map[string]interface{}{"fds": fds}}
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(api.ResponseRaw{Type: api.AsyncResponse, Status: "Operation created", StatusCode: 100, Operation: "/1.0/operations/exec", Metadata: op})
+	case "/1.0/operations/exec/websocket":
+		conn, err := shared.WebsocketUpgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		if r.FormValue("secret") != "control" {
+			return
+		}
+
+		for {
+			control := api.InstanceExecControl{}
+			err := conn.ReadJSON(&control)
+			if err != nil {
+				return
+			}
+
+			a.control <- control
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// qemuTestAgentVM returns a VM whose agent client is connected to a test agent, along with a function
+// stopping the agent.
+func qemuTestAgentVM(extensions []string) (*qemu, *qemuTestAgent, func()) {
+	agent := &qemuTestAgent{
+		extensions: extensions,
+		exec:       make(chan api.InstanceExecPost, 1),
+		control:    make(chan api.InstanceExecControl, 10),
+	}
+
+	server := httptest.NewTLSServer(agent)
+
+	client := &http.Client{Transport: &http.Transport{
+		Dial: func(network string, addr string) (net.Conn, error) {
+			if atomic.LoadInt32(&agent.down) != 0 || atomic.AddInt32(&agent.dialFailures, -1) >= 0 {
+				return nil, fmt.Errorf("Connection reset by peer")
+			}
+
+			return net.Dial("tcp", server.Listener.Addr().String())
+		},
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+
+	return &qemu{agentClient: client}, agent, server.Close
+}
+
+func TestQemuExec_Fields(t *testing.T) {
+	vm, agent, cleanup := qemuTestAgentVM([]string{"container_exec_user_group_cwd"})
+	defer cleanup()
+
+	stdin, err := os.Open(os.DevNull)
+	require.NoError(t, err)
+	defer stdin.Close()
+
+	stdout, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	require.NoError(t, err)
+	defer stdout.Close()
+
+	req := api.InstanceExecPost{
+		Command:     []string{"id"},
+		Environment: map[string]string{"FOO": "bar"},
+		User:        1000,
+		Group:       1001,
+		Cwd:         "/tmp",
+	}
+
+	cmd, err := vm.Exec(req, stdin, stdout, stdout)
+	require.NoError(t, err)
+	defer cmd.(*qemuCmd).cleanupFunc()
+
+	select {
+	case got := <-agent.exec:
+		assert.Equal(t, req.Command, got.Command)
+		assert.Equal(t, req.Environment, got.Environment)
+		assert.Equal(t, req.User, got.User)
+		assert.Equal(t, req.Group, got.Group)
+		assert.Equal(t, req.Cwd, got.Cwd)
+		assert.True(t, got.WaitForWS)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Exec request didn't reach the agent")
+	}
+}
+
+func TestQemuExec_InitialResize(t *testing.T) {
+	vm, agent, cleanup := qemuTestAgentVM([]string{"container_exec_user_group_cwd"})
+	defer cleanup()
+
+	pty, tty, err := shared.OpenPty(int64(os.Getuid()), int64(os.Getgid()))
+	require.NoError(t, err)
+	defer pty.Close()
+	defer tty.Close()
+
+	req := api.InstanceExecPost{
+		Command:     []string{"bash"},
+		Interactive: true,
+		Width:       120,
+		Height:      40,
+	}
+
+	cmd, err := vm.Exec(req, tty, tty, tty)
+	require.NoError(t, err)
+	defer cmd.(*qemuCmd).cleanupFunc()
+
+	select {
+	case control := <-agent.control:
+		assert.Equal(t, "window-resize", control.Command)
+		assert.Equal(t, map[string]string{"width": "120", "height": "40"}, control.Args)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Initial window size didn't reach the agent")
+	}
+}
+
+func TestQemuExec_ConnectRetry(t *testing.T) {
+	oldDelay := qemuAgentConnectRetryDelay
+	qemuAgentConnectRetryDelay = 10 * time.Millisecond
+	defer func() { qemuAgentConnectRetryDelay = oldDelay }()
+
+	req := api.InstanceExecPost{Command: []string{"id"}}
+
+	// A briefly unreachable agent is retried.
+	vm, agent, cleanup := qemuTestAgentVM([]string{})
+	defer cleanup()
+
+	agent.dialFailures = qemuAgentConnectAttempts - 1
+	cmd, err := vm.Exec(req, nil, nil, nil)
+	require.NoError(t, err)
+	cmd.(*qemuCmd).cleanupFunc()
+
+	// But not forever.
+	agent.dialFailures = qemuAgentConnectAttempts
+	_, err = vm.Exec(req, nil, nil, nil)
+	assert.Error(t, err)
+}
+
+func TestQemuExec_AgentLost(t *testing.T) {
+	vm, agent, cleanup := qemuTestAgentVM([]string{})
+	defer cleanup()
+
+	cmd, err := vm.Exec(api.InstanceExecPost{Command: []string{"id"}}, nil, nil, nil)
+	require.NoError(t, err)
+
+	// The agent going away is reported as such rather than as the command failing.
+	atomic.StoreInt32(&agent.down, 1)
+	_, err = cmd.Wait()
+	assert.Equal(t, errQemuAgentLost, err)
+}
+
+func TestQemuExecKeepalive(t *testing.T) {
+	// The agent misses pings but never as many in a row as allowed.
+	var pings int32
+	flaky := func() error {
+		if atomic.AddInt32(&pings, 1)%3 != 0 {
+			return fmt.Errorf("Connection reset by peer")
+		}
+
+		return nil
+	}
+
+	stop := make(chan struct{})
+	lost := make(chan struct{})
+	go qemuExecKeepalive(flaky, time.Millisecond, 3, stop, lost)
+
+	time.Sleep(50 * time.Millisecond)
+	close(stop)
+	select {
+	case <-lost:
+		t.Fatal("Flaky agent reported as lost")
+	default:
+	}
+
+	assert.True(t, atomic.LoadInt32(&pings) > 3)
+
+	// The agent stops answering.
+	stop = make(chan struct{})
+	lost = make(chan struct{})
+	go qemuExecKeepalive(func() error { return fmt.Errorf("Timeout") }, time.Millisecond, 3, stop, lost)
+	defer close(stop)
+
+	select {
+	case <-lost:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Unreachable agent not reported as lost")
+	}
+}
+
+func TestQemuExec_Invalid(t *testing.T) {
+	tests := map[string]api.InstanceExecPost{
+		"no command":      {},
+		"empty env name":  {Command: []string{"id"}, Environment: map[string]string{"": "bar"}},
+		"env name with =": {Command: []string{"id"}, Environment: map[string]string{"FOO=BAR": "bar"}},
+		"env value NUL":   {Command: []string{"id"}, Environment: map[string]string{"FOO": "b\x00r"}},
+		"relative cwd":    {Command: []string{"id"}, Cwd: "tmp"},
+		"negative width":  {Command: []string{"id"}, Interactive: true, Width: -1, Height: 24},
+		"old agent cwd":   {Command: []string{"id"}, Cwd: "/tmp"},
+		"old agent user":  {Command: []string{"id"}, User: 1000},
+		"old agent group": {Command: []string{"id"}, Group: 1000},
+	}
+
+	for name, req := range tests {
+		vm, agent, cleanup := qemuTestAgentVM([]string{})
+
+		_, err := vm.Exec(req, nil, nil, nil)
+		cleanup()
+		assert.Error(t, err, name)
+
+		select {
+		case <-agent.exec:
+			t.Errorf("%s: invalid exec request reached the agent", name)
+		default:
+		}
+	}
+}
+
+func TestQemuCmdWindowResize(t *testing.T) {
+	pty, tty, err := shared.OpenPty(int64(os.Getuid()), int64(os.Getgid()))
+	require.NoError(t, err)
+	defer pty.Close()
+	defer tty.Close()
+
+	cmd := &qemuCmd{
+		dataDone:      make(chan bool),
+		controlSendCh: make(chan api.InstanceExecControl),
+		controlResCh:  make(chan error),
+	}
+
+	forwarded := make(chan api.InstanceExecControl, 1)
+	go func() {
+		control := <-cmd.controlSendCh
+		forwarded <- control
+		cmd.controlResCh <- nil
+	}()
+
+	err = cmd.WindowResize(int(pty.Fd()), 100, 30)
+	require.NoError(t, err)
+
+	control := <-forwarded
+	assert.Equal(t, "window-resize", control.Command)
+	assert.Equal(t, map[string]string{"width": "100", "height": "30"}, control.Args)
+
+	width, height, err := termios.GetSize(int(pty.Fd()))
+	require.NoError(t, err)
+	assert.Equal(t, 100, width)
+	assert.Equal(t, 30, height)
+
+	// Once the command is done, resizing must fail rather than block on the exited control handler.
+	close(cmd.dataDone)
+	err = cmd.WindowResize(int(pty.Fd()), 80, 24)
+	assert.Error(t, err)
+}
+
+func TestQemuExecControl(t *testing.T) {
+	sendCh := make(chan api.InstanceExecControl)
+	resCh := make(chan error)
+	dataDone := make(chan bool)
+
+	written := []api.InstanceExecControl{}
+	write := func(cmd api.InstanceExecControl) error {
+		written = append(written, cmd)
+		return nil
+	}
+
+	exited := make(chan struct{})
+	go func() {
+		qemuExecControl(write, sendCh, resCh, dataDone)
+		close(exited)
+	}()
+
+	tests := []struct {
+		command api.InstanceExecControl
+		signal  int
+		err     string
+	}{
+		{command: api.InstanceExecControl{Command: "signal", Signal: 15}, signal: 15},
+		{command: api.InstanceExecControl{Command: "signal", Args: map[string]string{"signal": "SIGKILL"}}, signal: 9},
+		{command: api.InstanceExecControl{Command: "signal", Args: map[string]string{"signal": "winch"}}, signal: int(unix.SIGWINCH)},
+		{command: api.InstanceExecControl{Command: "signal", Args: map[string]string{"signal": "2"}}, signal: 2},
+		{command: api.InstanceExecControl{Command: "signal", Args: map[string]string{"signal": "SIGFOO"}}, err: `Unknown signal "SIGFOO"`},
+		{command: api.InstanceExecControl{Command: "signal", Signal: 0}, err: "Invalid signal number 0"},
+		{command: api.InstanceExecControl{Command: "signal", Signal: 65}, err: "Invalid signal number 65"},
+		{command: api.InstanceExecControl{Command: "window-resize", Args: map[string]string{"width": "80", "height": "24"}}},
+	}
+
+	expected := []api.InstanceExecControl{}
+	for _, test := range tests {
+		sendCh <- test.command
+		err := <-resCh
+
+		if test.err != "" {
+			assert.EqualError(t, err, test.err)
+			continue
+		}
+
+		require.NoError(t, err)
+
+		if test.command.Command == "signal" {
+			expected = append(expected, api.InstanceExecControl{Command: "signal", Args: test.command.Args, Signal: test.signal})
+		} else {
+			expected = append(expected, test.command)
+		}
+	}
+
+	assert.Equal(t, len(expected), len(written))
+	for i := range expected {
+		assert.Equal(t, expected[i].Command, written[i].Command)
+		assert.Equal(t, expected[i].Signal, written[i].Signal)
+		assert.Equal(t, "", written[i].Args["signal"])
+	}
+
+	// The control loop must exit once the data streams are done.
+	close(dataDone)
+	select {
+	case <-exited:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Control loop didn't exit after data was done")
+	}
+}
+
+func TestQemuConvertImage(t *testing.T) {
+	binDir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(binDir)
+
+	scratchDir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(scratchDir)
+
+	// Fake qemu-img copying the source, the second to last argument, to the target, the last one. It
+	// measures the converted image as twice the size of the source.
+	script := `#!/bin/sh
+if [ "$1" = "measure" ]; then
+	for arg; do src="$arg"; done
+	size=$(stat -c %s "$src")
+	echo "{\"required\": $((size * 2)), \"fully-allocated\": $((size * 4))}"
+	exit 0
+fi
+[ "$1" = "convert" ] || exit 1
+for arg; do src="$dst"; dst="$arg"; done
+[ "$src" = "fail" ] && { echo "conversion failed" >&2; exit 1; }
+cat "$src" > "$dst"
+`
+	err = ioutil.WriteFile(filepath.Join(binDir, "qemu-img"), []byte(script), 0755)
+	require.NoError(t, err)
+
+	oldPath := os.Getenv("PATH")
+	defer os.Setenv("PATH", oldPath)
+	os.Setenv("PATH", binDir+":"+oldPath)
+
+	srcPath := filepath.Join(binDir, "disk.img")
+	err = ioutil.WriteFile(srcPath, []byte("disk content"), 0600)
+	require.NoError(t, err)
+
+	size, err := qemuMeasureImage(srcPath, "raw", "qcow2")
+	require.NoError(t, err)
+	assert.Equal(t, int64(2*len("disk content")), size)
+
+	img, err := qemuConvertImage(scratchDir, srcPath, size, "-c", "-O", "qcow2")
+	require.NoError(t, err)
+	defer img.Close()
+
+	// The converted image must only be reachable through the returned file.
+	ents, err := ioutil.ReadDir(scratchDir)
+	require.NoError(t, err)
+	assert.Equal(t, 0, len(ents))
+
+	info, err := img.Stat()
+	require.NoError(t, err)
+	assert.Equal(t, int64(len("disk content")), info.Size())
+
+	content, err := ioutil.ReadAll(img)
+	require.NoError(t, err)
+	assert.Equal(t, "disk content", string(content))
+
+	_, err = qemuConvertImage(scratchDir, "fail", 0, "-O", "qcow2")
+	assert.Error(t, err)
+	assert.True(t, strings.Contains(err.Error(), "conversion failed"))
+
+	// The conversion isn't started without enough space for the scratch file.
+	_, err = qemuConvertImage(scratchDir, srcPath, math.MaxInt64, "-O", "qcow2")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "Not enough space")
+
+	ents, err = ioutil.ReadDir(scratchDir)
+	require.NoError(t, err)
+	assert.Equal(t, 0, len(ents))
+}
+
+func TestQemuParseImgFormats(t *testing.T) {
+	out := `qemu-img version 4.2.1 (Debian 1:4.2-3ubuntu6.4)
+usage: qemu-img [standard options] command [command options]
+
+Supported formats: blkdebug blklogwrites blkreplay blkverify bochs cloop copy-on-read dmg file ftp ftps host_cdrom host_device http https iscsi iser luks nbd null-aio null-co nvme parallels qcow qcow2 qed quorum raw rbd replication sheepdog ssh throttle vdi vhdx vmdk vpc vvfat
+`
+	formats := qemuParseImgFormats(out)
+	assert.True(t, shared.StringInSlice("qcow2", formats))
+	assert.True(t, shared.StringInSlice("vmdk", formats))
+	assert.True(t, shared.StringInSlice("raw", formats))
+	assert.False(t, shared.StringInSlice("Supported", formats))
+
+	assert.Equal(t, []string{}, qemuParseImgFormats("qemu-img version 4.2.1\n"))
+}
+
+func TestQemuExportConvertArgs(t *testing.T) {
+	formats := []string{"qcow2", "raw", "vmdk"}
+
+	tests := []struct {
+		properties map[string]string
+		args       []string
+		err        string
+	}{
+		{properties: nil, args: []string{"-c", "-O", "qcow2"}},
+		{properties: map[string]string{"os": "Ubuntu"}, args: []string{"-c", "-O", "qcow2"}},
+		{properties: map[string]string{"export.compression": "zstd"}, args: []string{"-c", "-o", "compression_type=zstd", "-O", "qcow2"}},
+		{properties: map[string]string{"export.compression": "none"}, args: []string{"-O", "qcow2"}},
+		{properties: map[string]string{"export.format": "vmdk"}, args: []string{"-O", "vmdk"}},
+		{properties: map[string]string{"export.format": "raw"}, args: []string{"-O", "raw"}},
+		{properties: map[string]string{"export.format": "vdi"}, err: `Unsupported export format "vdi"`},
+		{properties: map[string]string{"export.format": "vmdk", "export.compression": "zlib"}, err: `Compression isn't supported with the "vmdk" export format`},
+		{properties: map[string]string{"export.compression": "lz4"}, err: `Unsupported export compression "lz4"`},
+	}
+
+	for _, test := range tests {
+		format, compression, properties := qemuExportOptions(test.properties)
+		_, found := properties["export.format"]
+		assert.False(t, found)
+
+		args, err := qemuExportConvertArgs(format, compression, formats)
+		if test.err != "" {
+			assert.EqualError(t, err, test.err)
+			continue
+		}
+
+		require.NoError(t, err)
+		assert.Equal(t, test.args, args)
+	}
+}
+
+func TestQemuDeviceBootPriorities(t *testing.T) {
+	vm := &qemu{}
+	vm.expandedDevices = deviceConfig.Devices{
+		"root":  deviceConfig.Device{"type": "disk", "path": "/", "pool": "default"},
+		"eth0":  deviceConfig.Device{"type": "nic", "network": "lxdbr0"},
+		"iso":   deviceConfig.Device{"type": "disk", "source": "/tmp/install.iso", "boot.priority": "10"},
+		"shell": deviceConfig.Device{"type": "unix-char", "path": "/dev/ttyS0"},
+	}
+
+	vm.localConfig = map[string]string{}
+	prios, err := vm.deviceBootPriorities()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{"iso": 0, "root": 1, "eth0": 2}, prios)
+
+	// The boot once device goes first, whatever its priority.
+	vm.localConfig["boot.once"] = "eth0"
+	prios, err = vm.deviceBootPriorities()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{"eth0": 0, "iso": 1, "root": 2}, prios)
+
+	for _, devName := range []string{"missing", "shell"} {
+		vm.localConfig["boot.once"] = devName
+		_, err = vm.deviceBootPriorities()
+		assert.Error(t, err)
+	}
+}
+
+func TestQemuSandboxOpts(t *testing.T) {
+	tests := []struct {
+		config map[string]string
+		opts   string
+	}{
+		{config: nil, opts: "on,obsolete=deny,elevateprivileges=allow,spawn=deny,resourcecontrol=deny"},
+		{config: map[string]string{"security.sandbox": "true"}, opts: "on,obsolete=deny,elevateprivileges=allow,spawn=deny,resourcecontrol=deny"},
+		{config: map[string]string{"security.sandbox": "false"}, opts: "off"},
+		{config: map[string]string{"security.sandbox": "false", "security.sandbox.allow": "spawn"}, opts: "off"},
+		{config: map[string]string{"security.sandbox.allow": "spawn"}, opts: "on,obsolete=deny,elevateprivileges=allow,spawn=allow,resourcecontrol=deny"},
+		{config: map[string]string{"security.sandbox.allow": "obsolete, resourcecontrol"}, opts: "on,obsolete=allow,elevateprivileges=allow,spawn=deny,resourcecontrol=allow"},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.opts, qemuSandboxOpts(test.config))
+	}
+}
+
+// Test that raw.qemu overrides the singular qemu arguments LXD sets.
+func TestQemuMergeRawArgs(t *testing.T) {
+	args := []string{"--", "/usr/bin/qemu-system-x86_64", "-S", "-name", "vm", "-cpu", "host", "-boot", "strict=on"}
+
+	merged, shadowed := qemuMergeRawArgs(args, []string{"-cpu", "qemu64"})
+	assert.Equal(t, []string{"--", "/usr/bin/qemu-system-x86_64", "-S", "-name", "vm", "-boot", "strict=on", "-cpu", "qemu64"}, merged)
+	assert.Equal(t, []string{"-cpu"}, shadowed)
+
+	merged, shadowed = qemuMergeRawArgs(args, []string{"--cpu", "qemu64", "-device", "virtio-rng-pci"})
+	assert.Equal(t, []string{"--", "/usr/bin/qemu-system-x86_64", "-S", "-name", "vm", "-boot", "strict=on", "--cpu", "qemu64", "-device", "virtio-rng-pci"}, merged)
+	assert.Equal(t, []string{"-cpu"}, shadowed)
+
+	// Memory and CPUs are set in the config file, so there is nothing to drop from the arguments.
+	merged, shadowed = qemuMergeRawArgs(args, []string{"-m", "2G", "-smp", "4"})
+	assert.Equal(t, append(append([]string{}, args...), "-m", "2G", "-smp", "4"), merged)
+	assert.Empty(t, shadowed)
+	assert.Equal(t, map[string]string{"-m": "2G", "-smp": "4"}, qemuRawOverrides([]string{"-m", "2G", "-smp", "4", "-device", "virtio-rng-pci"}))
+}
+
+// Test that the memory and CPU config sections are left out when overridden by raw.qemu.
+func TestQemuGenerateConfigFile_RawOverrides(t *testing.T) {
+	vm, cleanup := qemuTestVM(t)
+	defer cleanup()
+
+	vm.dbType = instancetype.VM
+	vm.architecture = osarch.ARCH_64BIT_POWERPC_LITTLE_ENDIAN
+	vm.architectureName = "ppc64le"
+
+	require.NoError(t, os.MkdirAll(filepath.Join(vm.Path(), "config"), 0700))
+
+	tests := []struct {
+		rawQemu string
+		memory  bool
+		smp     bool
+	}{
+		{"", true, true},
+		{"-m 2G", false, true},
+		{"-smp 4", true, false},
+		{"-cpu host -m 2G --smp 4", false, false},
+	}
+
+	for _, test := range tests {
+		vm.expandedConfig = map[string]string{
+			"limits.cpu": "2",
+			"raw.qemu":   test.rawQemu,
+		}
+
+		confPath, err := vm.generateQemuConfigFile(nil, &[]string{})
+		require.NoError(t, err)
+
+		content, err := ioutil.ReadFile(confPath)
+		require.NoError(t, err)
+		conf := string(content)
+
+		assert.Equal(t, test.memory, strings.Contains(conf, "[memory]"), test.rawQemu)
+		assert.Equal(t, test.smp, strings.Contains(conf, "[smp-opts]"), test.rawQemu)
+	}
+}
+
+// Test parsing the CPU time of a process, including a command name with spaces and parentheses.
+func TestQemuParseProcStat(t *testing.T) {
+	usage, err := qemuParseProcStat("1234 (qemu (x) 1) S 1 1234 1234 0 -1 4194560 100 0 0 0 250 50 0 0 20 0 5 0 100 1000 10\n")
+	require.NoError(t, err)
+	assert.Equal(t, int64(3*time.Second), usage)
+
+	_, err = qemuParseProcStat("1234 (qemu) S 1")
+	assert.Error(t, err)
+
+	_, err = qemuParseProcStat("1234 qemu")
+	assert.Error(t, err)
+}
+
+// Test parsing the start time of a process, which tells it apart from a later one reusing its PID.
+func TestQemuProcessStartTime(t *testing.T) {
+	startTime, err := qemuParseProcStartTime("1234 (qemu (x) 1) S 1 1234 1234 0 -1 4194560 100 0 0 0 250 50 0 0 20 0 5 0 100 1000 10\n")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(100), startTime)
+
+	_, err = qemuParseProcStartTime("1234 (qemu) S 1")
+	assert.Error(t, err)
+
+	// The start time of a running process stays the same.
+	cmd := exec.Command("sleep", "60")
+	require.NoError(t, cmd.Start())
+	defer cmd.Process.Kill()
+
+	startTime, err = qemuProcessStartTime(cmd.Process.Pid)
+	require.NoError(t, err)
+
+	sameStartTime, err := qemuProcessStartTime(cmd.Process.Pid)
+	require.NoError(t, err)
+	assert.Equal(t, startTime, sameStartTime)
+}
+
+// Test that the metrics of a VM without a connected agent come from qemu and the host.
+func TestQemuMetrics_AgentOffline(t *testing.T) {
+	vm, cleanup := qemuTestVM(t)
+	defer cleanup()
+
+	vm.expandedDevices = deviceConfig.Devices{
+		"root": deviceConfig.Device{"type": "disk", "path": "/", "pool": "default"},
+	}
+
+	// Not running.
+	_, err := vm.Metrics()
+	assert.Error(t, err)
+
+	stop := qemuTestQMPServer(t, vm.getMonitorPath())
+	defer stop()
+
+	// Use the test process in place of qemu.
+	require.NoError(t, ioutil.WriteFile(vm.pidFilePath(), []byte(fmt.Sprintf("%d\n", os.Getpid())), 0600))
+
+	metrics, err := vm.Metrics()
+	require.NoError(t, err)
+	defer qemuTestDisconnect(vm)
+
+	assert.False(t, metrics.AgentConnected)
+	assert.True(t, metrics.CPU.Usage >= 0)
+	assert.True(t, metrics.Memory.Usage > 0)
+	assert.Equal(t, int64(1610612736), metrics.Memory.Total)
+	assert.Equal(t, int64(1073741824), metrics.Memory.Balloon)
+	assert.Equal(t, map[string]api.InstanceMetricsDisk{"root": {BytesRead: 512, BytesWritten: 1024, ReadOperations: 1, WriteOperations: 2}}, metrics.Disk)
+	assert.Empty(t, metrics.Network)
+}
+
+// Test that pinning an offline CPU fails rather than using a different topology.
+func TestQemuCPUTopology_Unavailable(t *testing.T) {
+	vm := &qemu{architectureName: "x86_64"}
+
+	cpuInfo := qemuTestCPUInfo()
+	cpuInfo.Sockets[0].Cores[1].Threads[0].Online = false
+
+	_, _, _, _, _, err := vm.cpuTopology(cpuInfo, "0-3")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "missing on the host: 2")
+
+	_, _, _, _, _, err = vm.cpuTopology(cpuInfo, "0,1,3,9")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "missing on the host: 9")
+
+	_, _, _, vcpus, _, err := vm.cpuTopology(cpuInfo, "0,1,3")
+	require.NoError(t, err)
+	assert.Equal(t, map[uint64]uint64{0: 0, 1: 1, 2: 3}, vcpus)
+}
+
+// Test that the recorded pins are reused as long as they pin the same host CPUs.
+func TestQemuCPUTopology_CachedPins(t *testing.T) {
+	vm := &qemu{
+		common: common{
+			localConfig: map[string]string{
+				"volatile.vm.cpu_pins": "0:5,1:4,2:1,3:0",
+			},
+		},
+		architectureName: "x86_64",
+	}
+
+	_, _, _, vcpus, numaNodes, err := vm.cpuTopology(qemuTestCPUInfo(), "0,1,4,5")
+	require.NoError(t, err)
+	assert.Equal(t, map[uint64]uint64{0: 5, 1: 4, 2: 1, 3: 0}, vcpus)
+	assert.Equal(t, []string{"2-3"}, qemuCPURanges(numaNodes[0]))
+	assert.Equal(t, []string{"0-1"}, qemuCPURanges(numaNodes[1]))
+
+	// Different host CPUs.
+	_, _, _, vcpus, _, err = vm.cpuTopology(qemuTestCPUInfo(), "0,1,4,6")
+	require.NoError(t, err)
+	assert.Equal(t, map[uint64]uint64{0: 0, 1: 1, 2: 4, 3: 6}, vcpus)
+
+	assert.Equal(t, "0:5,1:4,2:1,3:0", qemuFormatCPUPins(map[uint64]uint64{0: 5, 1: 4, 2: 1, 3: 0}))
+
+	for _, value := range []string{"", "0:1,2:3", "0-1", "0:a"} {
+		_, err := qemuParseCPUPins(value)
+		assert.Error(t, err, value)
+	}
+}
+
+// Test that the VM's cgroup settings are written in the hierarchy of their controller.
+func TestQemuCgroupReadWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lxd-qemu-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	oldRoot := qemuCgroupRoot
+	qemuCgroupRoot = dir
+	defer func() { qemuCgroupRoot = oldRoot }()
+
+	parents := map[string]string{"cpu": "/lxd", "": "/system.slice/lxd.service"}
+	rw := &qemuCgroupReadWriter{name: "lxd.vm.default_vm1", parents: parents}
+	assert.Equal(t, filepath.Join(dir, "cpu", "lxd", "lxd.vm.default_vm1", "cpu.shares"), rw.path(cgroup.V1, "cpu", "cpu.shares"))
+	assert.Equal(t, filepath.Join(dir, "system.slice", "lxd.service", "lxd.vm.default_vm1", "cpu.max"), rw.path(cgroup.V2, "cpu", "cpu.max"))
+	assert.Equal(t, filepath.Join(dir, "system.slice", "lxd.service", "cgroup.subtree_control"), rw.parentPath(cgroup.V2, "cpu", "cgroup.subtree_control"))
+
+	rw.hybrid = true
+	assert.Equal(t, filepath.Join(dir, "unified", "system.slice", "lxd.service", "lxd.vm.default_vm1", "cpu.max"), rw.path(cgroup.V2, "cpu", "cpu.max"))
+
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "cpu", "lxd", "lxd.vm.default_vm1"), 0755))
+	require.NoError(t, rw.Set(cgroup.V1, "cpu", "cpu.cfs_quota_us", "50000"))
+
+	value, err := rw.Get(cgroup.V1, "cpu", "cpu.cfs_quota_us")
+	require.NoError(t, err)
+	assert.Equal(t, "50000", value)
+
+	// Controllers are enabled in the subtree of LXD's cgroup on cgroup v2.
+	rw.hybrid = false
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "system.slice", "lxd.service", "lxd.vm.default_vm1"), 0755))
+	require.NoError(t, rw.enableController(cgroup.V2, "memory"))
+
+	value, err = rw.Get(cgroup.V2, "memory", "../cgroup.subtree_control")
+	require.NoError(t, err)
+	assert.Equal(t, "+memory", value)
+
+	assert.False(t, rw.hasController(cgroup.V2, "memory"))
+	require.NoError(t, rw.Set(cgroup.V2, "memory", "cgroup.controllers", "cpu memory"))
+	assert.True(t, rw.hasController(cgroup.V2, "memory"))
+	assert.True(t, rw.hasController(cgroup.V1, "memory"))
+}
+
+// Test finding LXD's own cgroups, for both cgroup versions.
+func TestQemuParseSelfCgroup(t *testing.T) {
+	content := `12:cpu,cpuacct:/lxd
+11:memory:/system.slice/lxd.service
+1:name=systemd:/system.slice/lxd.service
+0::/system.slice/lxd.service
+`
+
+	paths := qemuParseSelfCgroup(content)
+	assert.Equal(t, "/lxd", paths["cpu"])
+	assert.Equal(t, "/lxd", paths["cpuacct"])
+	assert.Equal(t, "/system.slice/lxd.service", paths["memory"])
+	assert.Equal(t, "/system.slice/lxd.service", paths[""])
+}
+
+// qemuTestCgroups points the cgroup hierarchies and the list of LXD's own cgroups to a temporary
+// directory, laid out for the cgroup version with the cpu and memory controllers. The returned
+// function restores them.
+func qemuTestCgroups(t *testing.T, version cgroup.Backend) (string, func()) {
+	dir, err := ioutil.TempDir("", "lxd-qemu-test-")
+	require.NoError(t, err)
+
+	selfCgroup := "12:cpu,cpuacct:/lxd\n11:memory:/lxd\n0::/lxd\n"
+	controllers := map[string]cgroup.Backend{"cpu": cgroup.V1, "cpuacct": cgroup.V1, "memory": cgroup.V1}
+	if version == cgroup.V2 {
+		selfCgroup = "0::/lxd.service\n"
+		controllers = map[string]cgroup.Backend{"unified": cgroup.V2, "cpu": cgroup.V2, "memory": cgroup.V2}
+
+		// The kernel lists the controllers enabled in the subtree of LXD's cgroup in the VM's one.
+		vmCgroup := filepath.Join(dir, "lxd.service", "lxd.vm.default_vm1")
+		require.NoError(t, os.MkdirAll(vmCgroup, 0755))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(vmCgroup, "cgroup.controllers"), []byte("cpu memory\n"), 0644))
+	}
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "self"), []byte(selfCgroup), 0644))
+
+	oldRoot := qemuCgroupRoot
+	oldSelf := qemuSelfCgroup
+	qemuCgroupRoot = dir
+	qemuSelfCgroup = filepath.Join(dir, "self")
+	restoreControllers := cgroup.SetTestControllers(controllers)
+
+	return dir, func() {
+		restoreControllers()
+		qemuCgroupRoot = oldRoot
+		qemuSelfCgroup = oldSelf
+		os.RemoveAll(dir)
+	}
+}
+
+// Test that the CPU and memory limits are applied to the cgroup of a VM, for both cgroup versions.
+func TestQemuSetupCgroup(t *testing.T) {
+	tests := []struct {
+		version cgroup.Backend
+		layout  cgroup.Layout
+		files   map[string]string
+	}{
+		{cgroup.V1, cgroup.CgroupsLegacy, map[string]string{
+			"cpu/lxd/lxd.vm.default_vm1/cpu.shares":               "524",
+			"cpu/lxd/lxd.vm.default_vm1/cpu.cfs_period_us":        "100000",
+			"cpu/lxd/lxd.vm.default_vm1/cpu.cfs_quota_us":         "-1",
+			"memory/lxd/lxd.vm.default_vm1/memory.limit_in_bytes": "1342177280",
+		}},
+		{cgroup.V2, cgroup.CgroupsUnified, map[string]string{
+			"lxd.service/lxd.vm.default_vm1/cpu.weight": "51",
+			"lxd.service/lxd.vm.default_vm1/cpu.max":    "max 100000",
+			"lxd.service/lxd.vm.default_vm1/memory.max": "1342177280",
+		}},
+	}
+
+	for _, test := range tests {
+		dir, cleanup := qemuTestCgroups(t, test.version)
+
+		vm := &qemu{
+			common: common{
+				project:        "default",
+				state:          &state.State{OS: &sys.OS{CGInfo: cgroup.Info{Layout: test.layout}}},
+				expandedConfig: map[string]string{"limits.cpu.allowance": "50%"},
+			},
+			name: "vm1",
+		}
+
+		require.NoError(t, vm.setupCgroup(os.Getpid()))
+
+		for path, value := range test.files {
+			content, err := ioutil.ReadFile(filepath.Join(dir, path))
+			require.NoError(t, err)
+			assert.Equal(t, value, string(content), path)
+		}
+
+		cleanup()
+	}
+}
+
+// Test that the memory limit of the VM's cgroup leaves out hugepages and memory overridden by raw.qemu.
+func TestQemuCgroupMemoryLimit(t *testing.T) {
+	tests := []struct {
+		config map[string]string
+		limit  int64
+	}{
+		{map[string]string{}, (1024 + 256) * 1024 * 1024},
+		{map[string]string{"limits.memory": "2GiB", "limits.memory.overhead": "512MiB"}, (2048 + 512) * 1024 * 1024},
+		{map[string]string{"limits.memory": "2GiB", "limits.memory.hugepages": "false"}, (2048 + 256) * 1024 * 1024},
+		{map[string]string{"limits.memory": "2GiB", "limits.memory.hugepages": "true"}, 256 * 1024 * 1024},
+		{map[string]string{"limits.memory": "2GiB", "limits.memory.hugepages": "1GB"}, 256 * 1024 * 1024},
+		{map[string]string{"raw.qemu": "-m 4G"}, -1},
+	}
+
+	for _, test := range tests {
+		vm := &qemu{common: common{expandedConfig: test.config}}
+		limit, err := vm.cgroupMemoryLimit()
+		require.NoError(t, err)
+		assert.Equal(t, test.limit, limit, test.config)
+	}
+}
+
+// Test counting the OOM kills of a cgroup, for both cgroup versions.
+func TestQemuParseOOMKills(t *testing.T) {
+	assert.Equal(t, int64(0), qemuParseOOMKills("low 0\nhigh 0\nmax 12\noom 1\noom_kill 0\n"))
+	assert.Equal(t, int64(1), qemuParseOOMKills("low 0\nhigh 0\nmax 12\noom 1\noom_kill 1\n"))
+	assert.Equal(t, int64(2), qemuParseOOMKills("oom_kill_disable 0\nunder_oom 0\noom_kill 2\n"))
+	assert.Equal(t, int64(0), qemuParseOOMKills("oom_kill_disable 0\nunder_oom 0\n"))
+}
+
+// Test that USB events are only applied to running VMs and tell added from removed devices.
+func TestQemuDeviceEventHandler_USB(t *testing.T) {
+	vm, cleanup := qemuTestVM(t)
+	defer cleanup()
+
+	usbConfig := []deviceConfig.RunConfigItem{
+		{Key: "devName", Value: "usb0"},
+		{Key: "hostDevice", Value: "1:4"},
+		{Key: "action", Value: "remove"},
+	}
+
+	assert.True(t, qemuUSBRemoved(usbConfig))
+	assert.False(t, qemuUSBRemoved(usbConfig[:2]))
+
+	devName, hostDevices := qemuUSBHostDevices(usbConfig)
+	assert.Equal(t, "usb0", devName)
+	assert.Equal(t, [][2]string{{"1", "4"}}, hostDevices)
+
+	// The VM isn't running.
+	assert.NoError(t, vm.DeviceEventHandler(&deviceConfig.RunConfig{USBDevice: usbConfig}))
+	assert.NoError(t, vm.DeviceEventHandler(nil))
+}
+
+func TestQemuSnapshotDiskDevice(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lxd-qemu-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	image := filepath.Join(dir, "data.img")
+	require.NoError(t, ioutil.WriteFile(image, []byte{}, 0600))
+
+	vm := &qemu{}
+	vm.expandedDevices = deviceConfig.Devices{
+		"root":   deviceConfig.Device{"type": "disk", "path": "/", "pool": "default"},
+		"data":   deviceConfig.Device{"type": "disk", "source": image},
+		"vol":    deviceConfig.Device{"type": "disk", "source": "vol", "pool": "default", "path": "/mnt"},
+		"share":  deviceConfig.Device{"type": "disk", "source": dir, "path": "/mnt"},
+		"iso":    deviceConfig.Device{"type": "disk", "source": image, "cdrom": "true"},
+		"config": deviceConfig.Device{"type": "disk", "source": "cloud-init:config"},
+		"eth0":   deviceConfig.Device{"type": "nic", "network": "lxdbr0"},
+	}
+
+	for _, devName := range []string{"data", "vol"} {
+		_, err = vm.snapshotDiskDevice(devName)
+		assert.NoError(t, err, devName)
+	}
+
+	for _, devName := range []string{"missing", "eth0", "root", "iso", "config"} {
+		_, err = vm.snapshotDiskDevice(devName)
+		assert.Error(t, err, devName)
+	}
+
+	_, err = vm.snapshotDiskDevice("share")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "9p directory share")
+}
+
+func TestQemuAddSharedMemDevConfig(t *testing.T) {
+	vm := &qemu{}
+	sb := &strings.Builder{}
+	fdFiles := []string{"/dev/net/tun"}
+
+	err := vm.addSharedMemDevConfig(sb, &fdFiles, []deviceConfig.RunConfigItem{
+		{Key: "devName", Value: "ipc"},
+		{Key: "devPath", Value: "/dev/shm/lxd.ipc"},
+		{Key: "size", Value: "67108864"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/dev/net/tun", "/dev/shm/lxd.ipc"}, fdFiles)
+
+	conf := sb.String()
+	assert.Contains(t, conf, `mem-path = "/proc/self/fd/4"`)
+	assert.Contains(t, conf, `size = "67108864"`)
+	assert.Contains(t, conf, `share = "on"`)
+	assert.Contains(t, conf, `driver = "ivshmem-plain"`)
+	assert.Contains(t, conf, `memdev = "lxd_ipc"`)
+}
+
+func TestQemuNICDriver(t *testing.T) {
+	vm := &qemu{architectureName: "x86_64"}
+
+	tests := map[string]string{
+		"":           "virtio-net-pci",
+		"virtio-net": "virtio-net-pci",
+		"e1000":      "e1000",
+		"e1000e":     "e1000e",
+		"rtl8139":    "rtl8139",
+	}
+
+	for model, driver := range tests {
+		nicDriver, err := vm.nicDriver(model)
+		require.NoError(t, err, model)
+		assert.Equal(t, driver, nicDriver, model)
+	}
+
+	// Models are checked against the architecture.
+	vm.architectureName = "ppc64le"
+	_, err := vm.nicDriver("e1000e")
+	assert.EqualError(t, err, `NIC model "e1000e" isn't supported on ppc64le`)
+}
+
+func TestQemuNICROM(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lxd-qemu-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	vm := &qemu{}
+	vm.expandedDevices = deviceConfig.Devices{
+		"eth0": deviceConfig.Device{"type": "nic", "network": "lxdbr0", "boot.priority": "10"},
+		"eth1": deviceConfig.Device{"type": "nic", "network": "lxdbr0"},
+	}
+
+	vm.localConfig = map[string]string{}
+	vm.expandedConfig = map[string]string{}
+
+	// Only NICs the VM may boot from get a ROM.
+	rom, err := vm.nicROM("eth0", "virtio-net-pci")
+	require.NoError(t, err)
+	assert.Equal(t, "efi-virtio.rom", rom)
+
+	rom, err = vm.nicROM("eth1", "virtio-net-pci")
+	require.NoError(t, err)
+	assert.Equal(t, "", rom)
+
+	vm.localConfig["boot.once"] = "eth1"
+	rom, err = vm.nicROM("eth1", "e1000e")
+	require.NoError(t, err)
+	assert.Equal(t, "efi-e1000e.rom", rom)
+
+	// Physically passed through NICs keep their own ROM.
+	rom, err = vm.nicROM("eth0", "vfio-pci")
+	require.NoError(t, err)
+	assert.Equal(t, "", rom)
+
+	// A custom ROM must exist.
+	romPath := filepath.Join(dir, "ipxe.efirom")
+	vm.expandedConfig["boot.ipxe_rom"] = romPath
+	_, err = vm.nicROM("eth0", "virtio-net-pci")
+	assert.Error(t, err)
+
+	require.NoError(t, ioutil.WriteFile(romPath, []byte{}, 0600))
+	for _, nicDriver := range []string{"virtio-net-pci", "vfio-pci"} {
+		rom, err = vm.nicROM("eth0", nicDriver)
+		require.NoError(t, err)
+		assert.Equal(t, romPath, rom)
+	}
+}
+
+func TestQemuBootTime(t *testing.T) {
+	vm := &qemu{}
+	vm.localConfig = map[string]string{}
+	assert.True(t, vm.bootTime().IsZero())
+
+	vm.localConfig["volatile.vm.boot_time"] = "2020-06-01T10:20:30Z"
+	assert.Equal(t, time.Date(2020, 6, 1, 10, 20, 30, 0, time.UTC), vm.bootTime())
+
+	vm.localConfig["volatile.vm.boot_time"] = "invalid"
+	assert.True(t, vm.bootTime().IsZero())
+}
+
+// Test that ipvlan NICs get their addresses and default routes through the interface, matched by the
+// MAC address of their parent.
+func TestQemuCloudInitNetworkConfig_IPVLAN(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lxd-qemu-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "eth0"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "eth0", "address"), []byte("00:16:3E:AA:BB:CC\n"), 0644))
+
+	defer func(path string) { qemuSysClassNet = path }(qemuSysClassNet)
+	qemuSysClassNet = dir
+
+	vm := &qemu{common: common{
+		expandedConfig: map[string]string{"boot.cloud_init_network_config": "true"},
+		expandedDevices: deviceConfig.Devices{
+			"eth0": deviceConfig.Device{"type": "nic", "nictype": "ipvlan", "parent": "eth0", "mtu": "1400", "ipv4.address": "192.0.2.10, 192.0.2.11", "ipv6.address": "2001:db8::10"},
+		},
+	}}
+
+	config, err := vm.cloudInitNetworkConfig()
+	require.NoError(t, err)
+	assert.Equal(t, `ethernets:
+  eth0:
+    addresses:
+    - 192.0.2.10/32
+    - 192.0.2.11/32
+    - 2001:db8::10/128
+    match:
+      macaddress: 00:16:3e:aa:bb:cc
+    mtu: 1400
+    routes:
+    - scope: link
+      to: 0.0.0.0/0
+    - scope: link
+      to: ::/0
+version: 2
+`, config)
+}
+
+func TestQemuCloudInitNetworkConfig(t *testing.T) {
+	netConfig := map[string]string{
+		"ipv4.address":       "10.0.0.1/24",
+		"ipv6.address":       "fd42::1/64",
+		"ipv6.dhcp.stateful": "true",
+		"bridge.mtu":         "1400",
+	}
+
+	// NICs with static addresses on a managed network get the network's gateway and DNS server.
+	ethernets := map[string]interface{}{
+		"eth0": qemuCloudInitEthernet(deviceConfig.Device{"hwaddr": "00:16:3E:AA:BB:CC", "ipv4.address": "10.0.0.10"}, netConfig),
+		"eth1": qemuCloudInitEthernet(deviceConfig.Device{"hwaddr": "00:16:3e:00:00:01", "mtu": "9000"}, nil),
+	}
+
+	config, err := qemuMergeCloudInitNetworkConfig(ethernets, "")
+	require.NoError(t, err)
+	assert.Equal(t, `ethernets:
+  eth0:
+    addresses:
+    - 10.0.0.10/24
+    dhcp6: true
+    gateway4: 10.0.0.1
+    match:
+      macaddress: 00:16:3e:aa:bb:cc
+    mtu: 1400
+    nameservers:
+      addresses:
+      - 10.0.0.1
+      search:
+      - lxd
+  eth1:
+    dhcp4: true
+    match:
+      macaddress: 00:16:3e:00:00:01
+    mtu: 9000
+version: 2
+`, config)
+
+	// Other formats than v2 are used as is.
+	userConfig := "version: 1\nconfig:\n- type: physical\n  name: eth0\n"
+	config, err = qemuMergeCloudInitNetworkConfig(ethernets, userConfig)
+	require.NoError(t, err)
+	assert.Equal(t, userConfig, config)
+
+	// User ethernets replace the generated ones of the same MAC address.
+	userConfig = `network:
+  version: 2
+  ethernets:
+    lan:
+      match:
+        macaddress: 00:16:3E:00:00:01
+      dhcp4: false
+  bonds: {}
+`
+	config, err = qemuMergeCloudInitNetworkConfig(ethernets, userConfig)
+	require.NoError(t, err)
+	assert.Equal(t, `bonds: {}
+ethernets:
+  eth0:
+    addresses:
+    - 10.0.0.10/24
+    dhcp6: true
+    gateway4: 10.0.0.1
+    match:
+      macaddress: 00:16:3e:aa:bb:cc
+    mtu: 1400
+    nameservers:
+      addresses:
+      - 10.0.0.1
+      search:
+      - lxd
+  lan:
+    dhcp4: false
+    match:
+      macaddress: 00:16:3E:00:00:01
+version: 2
+`, config)
+
+	// Without bridged NICs, the user config is left alone.
+	config, err = qemuMergeCloudInitNetworkConfig(map[string]interface{}{}, userConfig)
+	require.NoError(t, err)
+	assert.Equal(t, userConfig, config)
+
+	_, err = qemuMergeCloudInitNetworkConfig(ethernets, "version: [")
+	assert.Error(t, err)
+}
+
+func TestQemuNICStaticAllocation(t *testing.T) {
+	_, cleanup := qemuTestVM(t)
+	defer cleanup()
+
+	err := os.MkdirAll(shared.VarPath("networks", "lxdbr0", "dnsmasq.hosts"), 0755)
+	require.NoError(t, err)
+
+	netConfig := map[string]string{
+		"ipv4.address": "10.0.0.1/24",
+		"ipv6.address": "fd42::1/64",
+	}
+
+	tests := []struct {
+		name      string
+		nic       deviceConfig.Device
+		addresses []string
+	}{
+		{
+			name:      "static",
+			nic:       deviceConfig.Device{"hwaddr": "00:16:3e:00:00:01", "ipv4.address": "10.0.0.10", "ipv6.address": "fd42::10"},
+			addresses: []string{"10.0.0.10/24", "fd42::10/64"},
+		},
+		{
+			name:      "filtering",
+			nic:       deviceConfig.Device{"hwaddr": "00:16:3e:00:00:02", "security.ipv4_filtering": "true"},
+			addresses: []string{"10.0.0.20/24"},
+		},
+	}
+
+	// An address previously allocated to the instance in the dnsmasq config, kept with IP filtering.
+	err = dnsmasq.UpdateStaticEntry("lxdbr0", "default", "filtering", netConfig, "00:16:3e:00:00:02", "10.0.0.20", "")
+	require.NoError(t, err)
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m, err := qemuNICStaticAllocation(test.nic, "lxdbr0", "default", test.name)
+			require.NoError(t, err)
+
+			// Write the DHCP reservation the way the NIC device does.
+			ipv4Address, ipv6Address, err := dnsmasq.StaticAllocation("lxdbr0", "default", test.name, test.nic)
+			require.NoError(t, err)
+			err = dnsmasq.UpdateStaticEntry("lxdbr0", "default", test.name, netConfig, test.nic["hwaddr"], ipv4Address, ipv6Address)
+			require.NoError(t, err)
+
+			// The addresses of the cloud-init config are the ones of the lease file.
+			leaseIPv4, leaseIPv6, err := dnsmasq.DHCPStaticIPs("lxdbr0", "default", test.name)
+			require.NoError(t, err)
+
+			leases := []string{}
+			if leaseIPv4.IP != nil {
+				leases = append(leases, fmt.Sprintf("%s/24", leaseIPv4.IP))
+			}
+
+			if leaseIPv6.IP != nil {
+				leases = append(leases, fmt.Sprintf("%s/64", leaseIPv6.IP))
+			}
+
+			ethernet := qemuCloudInitEthernet(m, netConfig)
+			assert.Equal(t, test.addresses, leases)
+			assert.Equal(t, leases, ethernet["addresses"])
+			assert.Nil(t, ethernet["dhcp4"])
+		})
+	}
+}
+
+func TestQemuVsockID(t *testing.T) {
+	vm := &qemu{id: 7}
+	vm.localConfig = map[string]string{}
+	assert.Equal(t, uint32(10), vm.vsockID())
+
+	vm.localConfig["volatile.vm.vsock_id"] = "42"
+	assert.Equal(t, uint32(42), vm.vsockID())
+
+	// IDs beyond the 31bit range are kept.
+	vm.localConfig["volatile.vm.vsock_id"] = "4294967294"
+	assert.Equal(t, qemuVsockMaxID, vm.vsockID())
+
+	vm.localConfig["volatile.vm.vsock_id"] = "4294967296"
+	assert.Equal(t, uint32(10), vm.vsockID())
+
+	used := map[uint32]bool{42: true, 43: true, qemuVsockMaxID: true, qemuVsockMinID: true}
+	inUse := func(vsockID uint32) (bool, error) {
+		return used[vsockID], nil
+	}
+
+	vsockID, err := qemuNextVsockID(41, inUse)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(41), vsockID)
+
+	vsockID, err = qemuNextVsockID(42, inUse)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(44), vsockID)
+
+	// The IDs wrap around after the highest one.
+	vsockID, err = qemuNextVsockID(qemuVsockMaxID, inUse)
+	require.NoError(t, err)
+	assert.Equal(t, qemuVsockMinID+1, vsockID)
+
+	_, err = qemuNextVsockID(42, func(vsockID uint32) (bool, error) { return true, nil })
+	assert.Error(t, err)
+}
+
+func TestQemuSyncDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lxd-qemu-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	srcDir := filepath.Join(dir, "config.new")
+	dstDir := filepath.Join(dir, "config")
+	for _, path := range []string{srcDir, dstDir} {
+		require.NoError(t, os.MkdirAll(filepath.Join(path, "cloud-init"), 0500))
+	}
+
+	files := map[string]string{
+		"cloud-init/user-data":   "#cloud-config\n",
+		"cloud-init/meta-data":   "instance-id: vm1\n",
+		"server.crt":             "new",
+		"files/hostname.tpl.out": "vm1\n",
+	}
+
+	require.NoError(t, os.MkdirAll(filepath.Join(srcDir, "files"), 0500))
+	for path, content := range files {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(srcDir, path), []byte(content), 0400))
+	}
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dstDir, "cloud-init/user-data"), []byte("#cloud-config\n"), 0400))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dstDir, "cloud-init/network-config"), []byte("version: 2\n"), 0400))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dstDir, "server.crt"), []byte("old"), 0400))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dstDir, "lxd-agent"), []byte("agent"), 0500))
+
+	unchanged, err := os.Stat(filepath.Join(dstDir, "cloud-init/user-data"))
+	require.NoError(t, err)
+
+	require.NoError(t, qemuSyncDir(srcDir, dstDir, []string{"lxd-agent"}))
+
+	for path, content := range files {
+		buf, err := ioutil.ReadFile(filepath.Join(dstDir, path))
+		require.NoError(t, err)
+		assert.Equal(t, content, string(buf))
+	}
+
+	// Unchanged files are left in place, removed ones are gone and kept ones stay.
+	info, err := os.Stat(filepath.Join(dstDir, "cloud-init/user-data"))
+	require.NoError(t, err)
+	assert.True(t, os.SameFile(unchanged, info))
+
+	assert.False(t, shared.PathExists(filepath.Join(dstDir, "cloud-init/network-config")))
+	assert.True(t, shared.PathExists(filepath.Join(dstDir, "lxd-agent")))
+
+	same, err := qemuSameContent(filepath.Join(dstDir, "server.crt"), filepath.Join(dstDir, "missing"))
+	require.NoError(t, err)
+	assert.False(t, same)
+}
+
+// Benchmark syncing an unchanged config share, as done when restarting a VM.
+func BenchmarkQemuSyncDir(b *testing.B) {
+	dir, err := ioutil.TempDir("", "lxd-qemu-test-")
+	require.NoError(b, err)
+	defer os.RemoveAll(dir)
+
+	srcDir := filepath.Join(dir, "config.new")
+	dstDir := filepath.Join(dir, "config")
+	content := []byte(strings.Repeat("#cloud-config\n", 1024))
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		require.NoError(b, os.MkdirAll(filepath.Join(srcDir, "cloud-init"), 0700))
+		for _, name := range []string{"user-data", "vendor-data", "meta-data"} {
+			require.NoError(b, ioutil.WriteFile(filepath.Join(srcDir, "cloud-init", name), content, 0400))
+		}
+
+		require.NoError(b, qemuSyncDir(srcDir, dstDir, nil))
+		os.RemoveAll(srcDir)
+	}
+}
+
+func TestQemuDriveIOModes(t *testing.T) {
+	cacheMode, aioMode := qemuDriveIOModes([]string{"ro", qemuUnsafeIO})
+	assert.Equal(t, "", cacheMode)
+	assert.Equal(t, "", aioMode)
+
+	cacheMode, aioMode = qemuDriveIOModes([]string{deviceConfig.MountOptCache + "directsync", deviceConfig.MountOptAIO + "native"})
+	assert.Equal(t, "directsync", cacheMode)
+	assert.Equal(t, "native", aioMode)
+
+	dir, err := ioutil.TempDir("", "lxd-qemu-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	devPath := filepath.Join(dir, "disk.img")
+	require.NoError(t, ioutil.WriteFile(devPath, make([]byte, 4096), 0600))
+
+	vm := &qemu{}
+	pcieIndex := 0
+
+	// An explicit cache mode overrides the unsafe I/O heuristic, and picks threaded async I/O.
+	sb := &strings.Builder{}
+	err = vm.addDriveConfig(sb, map[string]int{}, &pcieIndex, deviceConfig.MountEntryItem{
+		DevName: "data",
+		DevPath: devPath,
+		Opts:    []string{qemuUnsafeIO, deviceConfig.MountOptCache + "writeback"},
+	}, false)
+	require.NoError(t, err)
+	assert.Contains(t, sb.String(), `cache = "writeback"`)
+	assert.Contains(t, sb.String(), `aio = "threads"`)
+
+	// Native async I/O needs O_DIRECT.
+	err = vm.addDriveConfig(&strings.Builder{}, map[string]int{}, &pcieIndex, deviceConfig.MountEntryItem{
+		DevName: "data",
+		DevPath: devPath,
+		Opts:    []string{deviceConfig.MountOptCache + "writethrough", deviceConfig.MountOptAIO + "native"},
+	}, false)
+	assert.Error(t, err)
+
+	err = qemuCheckDirectIO(filepath.Join(dir, "missing"))
+	assert.Error(t, err)
+}
+
+func TestQemuDriveBus(t *testing.T) {
+	assert.Equal(t, "virtio-scsi", qemuDriveBus([]string{"ro"}))
+	assert.Equal(t, "virtio-blk", qemuDriveBus([]string{deviceConfig.MountOptBus + "virtio-blk"}))
+
+	dir, err := ioutil.TempDir("", "lxd-qemu-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	devPath := filepath.Join(dir, "disk.img")
+	require.NoError(t, ioutil.WriteFile(devPath, make([]byte, 4096), 0600))
+
+	vm := &qemu{architectureName: "x86_64"}
+	bootIndexes := map[string]int{"root": 0, "data": 1, "fast": 2}
+	pcieIndex := 0
+
+	// Drives are attached to the SCSI controller by default, without using a PCIe root port.
+	sb := &strings.Builder{}
+	err = vm.addDriveConfig(sb, bootIndexes, &pcieIndex, deviceConfig.MountEntryItem{
+		DevName: "data",
+		DevPath: devPath,
+		Opts:    []string{deviceConfig.MountOptCache + "writeback"},
+	}, false)
+	require.NoError(t, err)
+	assert.Contains(t, sb.String(), `driver = "scsi-hd"`)
+	assert.Contains(t, sb.String(), `bus = "qemu_scsi.0"`)
+	assert.Contains(t, sb.String(), `scsi-id = "1"`)
+	assert.Contains(t, sb.String(), `bootindex = "1"`)
+	assert.Equal(t, 0, pcieIndex)
+
+	// A virtio-blk drive takes the next PCIe root port, and keeps its boot index.
+	sb = &strings.Builder{}
+	err = vm.addDriveConfig(sb, bootIndexes, &pcieIndex, deviceConfig.MountEntryItem{
+		DevName: "fast",
+		DevPath: devPath,
+		Opts:    []string{deviceConfig.MountOptCache + "writeback", deviceConfig.MountOptBus + "virtio-blk"},
+	}, false)
+	require.NoError(t, err)
+	assert.Contains(t, sb.String(), `[device "qemu_pcie5"]`)
+	assert.Contains(t, sb.String(), `driver = "virtio-blk-pci"`)
+	assert.Contains(t, sb.String(), `bus = "qemu_pcie5"`)
+	assert.Contains(t, sb.String(), `bootindex = "2"`)
+	assert.NotContains(t, sb.String(), "qemu_scsi")
+	assert.Equal(t, 1, pcieIndex)
+
+	// On ppc64le, virtio-blk drives are on the PCI bus.
+	vm.architectureName = "ppc64le"
+	sb = &strings.Builder{}
+	err = vm.addDriveConfig(sb, bootIndexes, &pcieIndex, deviceConfig.MountEntryItem{
+		DevName: "fast",
+		DevPath: devPath,
+		Opts:    []string{deviceConfig.MountOptCache + "writeback", deviceConfig.MountOptBus + "virtio-blk"},
+	}, false)
+	require.NoError(t, err)
+	assert.Contains(t, sb.String(), `bus = "pci.0"`)
+	assert.NotContains(t, sb.String(), "pcie-root-port")
+}
+
+func TestQemuDriveFormat(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lxd-qemu-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	devPath := filepath.Join(dir, "disk.img")
+	require.NoError(t, ioutil.WriteFile(devPath, make([]byte, 4096), 0600))
+
+	vm := &qemu{architectureName: "x86_64"}
+	pcieIndex := 0
+
+	// Drives are raw unless another format is set.
+	assert.Equal(t, "raw", qemuDriveFormat([]string{deviceConfig.MountOptCache + "writeback"}))
+
+	sb := &strings.Builder{}
+	err = vm.addDriveConfig(sb, map[string]int{}, &pcieIndex, deviceConfig.MountEntryItem{
+		DevName: "root",
+		DevPath: devPath,
+		Opts:    []string{deviceConfig.MountOptCache + "writeback", deviceConfig.MountOptFormat + "qcow2"},
+	}, false)
+	require.NoError(t, err)
+	assert.Contains(t, sb.String(), `format = "qcow2"`)
+}
+
+func TestQemuProbeIOUring(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lxd-qemu-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// A qemu build with io_uring reads the quit command from the monitor.
+	supported := filepath.Join(dir, "qemu-supported")
+	script := `#!/bin/sh
+read cmd
+[ "$cmd" = "quit" ]
+`
+	require.NoError(t, ioutil.WriteFile(supported, []byte(script), 0755))
+	assert.NoError(t, qemuProbeIOUring(supported))
+
+	unsupported := filepath.Join(dir, "qemu-unsupported")
+	script = `#!/bin/sh
+echo "qemu-system-x86_64: -blockdev aio=io_uring: aio=io_uring was specified, but is not supported in this build." >&2
+exit 1
+`
+	require.NoError(t, ioutil.WriteFile(unsupported, []byte(script), 0755))
+	err = qemuProbeIOUring(unsupported)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "not supported in this build")
+}
+
+// Test that a qemu that hangs while being probed is killed instead of holding up the capabilities lock.
+func TestQemuProbeTimeout(t *testing.T) {
+	defer func(timeout time.Duration) { qemuProbeTimeout = timeout }(qemuProbeTimeout)
+	qemuProbeTimeout = 100 * time.Millisecond
+
+	dir, err := ioutil.TempDir("", "lxd-qemu-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	qemuPath := filepath.Join(dir, "qemu-system-x86_64")
+	require.NoError(t, ioutil.WriteFile(qemuPath, []byte("#!/bin/sh\nexec sleep 60\n"), 0755))
+
+	start := time.Now()
+	_, err = qemuGetCapabilities(qemuPath)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "didn't complete within")
+	assert.True(t, time.Since(start) < 10*time.Second)
+}
+
+func TestQemuGetCapabilities(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lxd-qemu-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// The fake qemu counts how many times it's run.
+	qemuPath := filepath.Join(dir, "qemu-system-x86_64")
+	script := fmt.Sprintf(`#!/bin/sh
+echo run >> %s/runs
+case "$*" in
+-version)
+	echo "QEMU emulator version 4.2.1 (Debian 1:4.2-3ubuntu6.17)"
+	echo "Copyright (c) 2003-2019 Fabrice Bellard and the QEMU Project developers"
+	;;
+"-machine help")
+	echo "Supported machines are:"
+	echo "q35                  Standard PC (Q35 + ICH9, 2009) (alias of pc-q35-4.2)"
+	echo "pc-q35-4.2           Standard PC (Q35 + ICH9, 2009)"
+	echo "none                 empty machine"
+	;;
+"-device help")
+	echo "Network devices:"
+	echo 'name "virtio-net-pci", bus PCI, alias "virtio-net"'
+	echo
+	echo "Misc devices:"
+	echo 'name "vhost-vsock-pci", bus PCI'
+	;;
+*)
+	read cmd
+	[ "$cmd" = "quit" ]
+	;;
+esac
+`, dir)
+	require.NoError(t, ioutil.WriteFile(qemuPath, []byte(script), 0755))
+
+	runs := func() int {
+		out, _ := ioutil.ReadFile(filepath.Join(dir, "runs"))
+		return strings.Count(string(out), "run")
+	}
+
+	caps, err := qemuGetCapabilities(qemuPath)
+	require.NoError(t, err)
+	assert.Equal(t, "4.2.1", caps.version.String())
+	assert.Equal(t, []string{"q35", "pc-q35-4.2", "none"}, caps.machines)
+	assert.Equal(t, []string{"virtio-net-pci", "vhost-vsock-pci"}, caps.devices)
+	assert.NoError(t, caps.ioUring)
+	assert.Equal(t, 4, runs())
+
+	// The result is cached.
+	_, err = qemuGetCapabilities(qemuPath)
+	require.NoError(t, err)
+	assert.Equal(t, 4, runs())
+
+	// Until the binary changes.
+	modTime := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(qemuPath, modTime, modTime))
+	_, err = qemuGetCapabilities(qemuPath)
+	require.NoError(t, err)
+	assert.Equal(t, 8, runs())
+}
+
+func TestQemuMissingCapabilities(t *testing.T) {
+	v, _ := version.NewDottedVersion("2.0.0")
+	caps := &qemuCapabilities{version: v, machines: []string{"pc"}, devices: []string{"virtio-net-pci"}}
+
+	// All the missing features are reported together.
+	missing := qemuMissingCapabilities(caps, "x86_64", map[string]string{"limits.cpu": "0-3"})
+	assert.Equal(t, []string{
+		`the "q35" machine type`,
+		"vhost-vsock support (vhost-vsock-pci device)",
+		"secure boot support (requires qemu 2.4.0, found 2.0.0)",
+		"NUMA support (requires qemu 2.1.0, found 2.0.0)",
+	}, missing)
+
+	missing = qemuMissingCapabilities(caps, "x86_64", map[string]string{"limits.cpu": "4", "security.secureboot": "false", "limits.memory.max": "4GiB"})
+	assert.Contains(t, missing, "memory hotplug support (requires qemu 2.1.0, found 2.0.0)")
+
+	// Secure boot and NUMA nodes are only required when in use.
+	missing = qemuMissingCapabilities(caps, "x86_64", map[string]string{"limits.cpu": "4", "security.secureboot": "false"})
+	assert.Len(t, missing, 2)
+
+	v, _ = version.NewDottedVersion("6.2.0")
+	caps = &qemuCapabilities{version: v, machines: []string{"q35"}, devices: []string{"vhost-vsock-pci"}}
+	assert.Empty(t, qemuMissingCapabilities(caps, "x86_64", map[string]string{"limits.cpu": "0-3"}))
+}
+
+func TestQemuDriveDirConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lxd-qemu-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	vm := &qemu{}
+
+	// Read-only shares are exported directly.
+	sb := &strings.Builder{}
+	fdFiles := []string{}
+	agentMounts := []instancetype.VMAgentMount{}
+	err = vm.addDriveDirConfig(sb, &fdFiles, &agentMounts, deviceConfig.MountEntryItem{DevName: "data", DevPath: dir, TargetPath: "/data", FSType: "9p", Opts: []string{"ro"}})
+	require.NoError(t, err)
+	assert.Contains(t, sb.String(), `readonly = "on"`)
+	assert.Contains(t, sb.String(), `security_model = "none"`)
+	assert.Equal(t, []string{"ro"}, agentMounts[0].Options)
+
+	// Writable shares of directories are exported directly, passing file ownership through.
+	sb = &strings.Builder{}
+	err = vm.addDriveDirConfig(sb, &fdFiles, &agentMounts, deviceConfig.MountEntryItem{DevName: "data", DevPath: dir, TargetPath: "/data", FSType: "9p", Opts: []string{"msize=262144", "posixacl"}})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"msize=262144", "posixacl"}, agentMounts[1].Options)
+	assert.Contains(t, sb.String(), `fsdriver = "local"`)
+	assert.Contains(t, sb.String(), `security_model = "passthrough"`)
+	assert.Contains(t, sb.String(), fmt.Sprintf(`path = "%s"`, dir))
+	assert.Len(t, fdFiles, 0)
+
+	// Writable shares through the proxy use its socket.
+	sockPath := filepath.Join(dir, "data.sock")
+	require.NoError(t, ioutil.WriteFile(sockPath, []byte{}, 0600))
+
+	sb = &strings.Builder{}
+	err = vm.addDriveDirConfig(sb, &fdFiles, &agentMounts, deviceConfig.MountEntryItem{DevName: "data", DevPath: sockPath, TargetPath: "/data", FSType: "9p"})
+	require.NoError(t, err)
+	assert.Contains(t, sb.String(), `fsdriver = "proxy"`)
+	assert.Equal(t, []string{sockPath}, fdFiles)
+}
+
+// A VM whose root disk refers to a storage pool renamed while it was stopped fails to start with an error
+// naming the pool its volume is now on.
+func TestQemuCheckRootDiskPool_Renamed(t *testing.T) {
+	s, cleanup := state.NewTestState(t)
+	defer cleanup()
+
+	poolID, err := s.Cluster.StoragePoolCreate("new", "", "dir", nil)
+	require.NoError(t, err)
+
+	_, err = s.Cluster.StoragePoolVolumeCreate("default", "vm1", "", db.StoragePoolVolumeTypeVM, false, poolID, nil)
+	require.NoError(t, err)
+
+	err = s.Cluster.Transaction(func(tx *db.ClusterTx) error {
+		_, err := tx.InstanceCreate(db.Instance{
+			Project: "default",
+			Name:    "vm1",
+			Node:    "none",
+			Type:    instancetype.VM,
+		})
+		return err
+	})
+	require.NoError(t, err)
+
+	vm := &qemu{
+		common: common{
+			dbType:  instancetype.VM,
+			project: "default",
+			state:   s,
+			expandedDevices: deviceConfig.Devices{
+				"root": deviceConfig.Device{"type": "disk", "path": "/", "pool": "old"},
+			},
+		},
+		name: "vm1",
+	}
+
+	err = vm.checkRootDiskPool()
+	assert.EqualError(t, err, `Storage pool "old" of root disk "root" doesn't exist, the instance volume is on pool "new": set the pool property of the root disk to "new"`)
+
+	vm.expandedDevices["root"]["pool"] = "new"
+	assert.NoError(t, vm.checkRootDiskPool())
+
+	// The pool is gone along with the instance volume.
+	vm.expandedDevices["root"]["pool"] = "removed"
+	vm.name = "vm2"
+	err = vm.checkRootDiskPool()
+	assert.EqualError(t, err, `Storage pool "removed" of root disk "root" doesn't exist`)
+}
+
+// The dry run returns the config and arguments without writing to the instance's directories.
+func TestQemuQemuConfig(t *testing.T) {
+	vm, cleanup := qemuTestVM(t)
+	defer cleanup()
+
+	ovmfDir := shared.VarPath("ovmf")
+	require.NoError(t, os.MkdirAll(ovmfDir, 0700))
+	for _, name := range []string{"OVMF_CODE.fd", "OVMF_VARS.ms.fd"} {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(ovmfDir, name), nil, 0600))
+	}
+
+	os.Setenv("LXD_OVMF_PATH", ovmfDir)
+	defer os.Unsetenv("LXD_OVMF_PATH")
+
+	binDir := shared.VarPath("bin")
+	require.NoError(t, os.MkdirAll(binDir, 0700))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(binDir, "qemu-system-x86_64"), []byte("#!/bin/sh\nexit 1\n"), 0755))
+
+	os.Setenv("PATH", fmt.Sprintf("%s:%s", binDir, os.Getenv("PATH")))
+	defer os.Setenv("PATH", strings.TrimPrefix(os.Getenv("PATH"), binDir+":"))
+
+	s, cleanupState := state.NewTestState(t)
+	defer cleanupState()
+
+	vm.dbType = instancetype.VM
+	vm.state = s
+	vm.expandedConfig = map[string]string{
+		"limits.cpu":     "2",
+		"raw.qemu":       "-name custom",
+		"smbios.product": "Widget",
+	}
+	vm.expandedDevices = deviceConfig.Devices{
+		"eth0": deviceConfig.Device{"type": "nic", "nictype": "bridged", "parent": "lxdbr0", "queues": "auto"},
+		"usb0": deviceConfig.Device{"type": "usb", "vendorid": "1234"},
+	}
+	vm.localConfig = map[string]string{
+		"volatile.vm.uuid":        "0b9b6ad3-1a3d-4e6b-8c1d-8d5a1fc7d1a2",
+		"volatile.eth0.hwaddr":    "00:16:3e:00:00:01",
+		"volatile.eth0.host_name": "tap1234",
+	}
+	vm.architecture = osarch.ARCH_64BIT_INTEL_X86
+	vm.architectureName = "x86_64"
+
+	conf, err := vm.QemuConfig()
+	require.NoError(t, err)
+
+	assert.Contains(t, conf.Config, `cpus = "2"`)
+	assert.Contains(t, conf.Config, `[netdev "lxd_eth0"]`)
+	assert.Contains(t, conf.Config, `ifname = "tap1234"`)
+	assert.Contains(t, conf.Config, `mac = "00:16:3e:00:00:01"`)
+	assert.Contains(t, conf.Config, `queues = "2"`)
+	assert.Contains(t, conf.Config, `# Device "usb0" (usb) is set up when the VM starts`)
+	assert.Equal(t, filepath.Join(binDir, "qemu-system-x86_64"), conf.Command[0])
+	assert.Contains(t, strings.Join(conf.Command, " "), "-name custom")
+	assert.Contains(t, strings.Join(conf.Command, " "), "-uuid 0b9b6ad3-1a3d-4e6b-8c1d-8d5a1fc7d1a2")
+	assert.Contains(t, strings.Join(conf.Command, "\n"), "-smbios\ntype=1,product=Widget,uuid=0b9b6ad3-1a3d-4e6b-8c1d-8d5a1fc7d1a2\n")
+	assert.NotContains(t, conf.Config, "[smbios]")
+
+	// Nothing was written to the instance's directories.
+	assert.False(t, shared.PathExists(filepath.Join(vm.LogPath(), "qemu.conf")))
+	assert.False(t, shared.PathExists(filepath.Join(vm.Path(), "config", "agent-mounts.json")))
+}
+
+func TestQemuSMBIOSArg(t *testing.T) {
+	vm := &qemu{
+		common: common{
+			expandedConfig: map[string]string{
+				"smbios.manufacturer": "ACME, Inc.",
+				"smbios.product":      `The "Widget"`,
+				"smbios.serial":       "SN-1234",
+			},
+			localConfig: map[string]string{
+				"volatile.vm.uuid": "0b9b6ad3-1a3d-4e6b-8c1d-8d5a1fc7d1a2",
+			},
+		},
+		architectureName: "x86_64",
+	}
+
+	// The system UUID defaults to the VM's, commas are escaped and double quotes kept as they are.
+	arg, err := vm.smbiosArg()
+	require.NoError(t, err)
+	assert.Equal(t, `type=1,manufacturer=ACME,, Inc.,product=The "Widget",serial=SN-1234,uuid=0b9b6ad3-1a3d-4e6b-8c1d-8d5a1fc7d1a2`, arg)
+
+	vm.expandedConfig["smbios.uuid"] = "5d8a3c4e-9f5b-4d0e-a2a1-3b7c6e1f0a9d"
+	arg, err = vm.smbiosArg()
+	require.NoError(t, err)
+	assert.Contains(t, arg, ",uuid=5d8a3c4e-9f5b-4d0e-a2a1-3b7c6e1f0a9d")
+
+	// Without any SMBIOS keys, qemu takes the UUID from its command line.
+	vm.expandedConfig = map[string]string{}
+	arg, err = vm.smbiosArg()
+	require.NoError(t, err)
+	assert.Empty(t, arg)
+}
+
+func TestQemuRestoredConfig(t *testing.T) {
+	vmUUID := "0b9b6ad3-1a3d-4e6b-8c1d-8d5a1fc7d1a2"
+
+	// Snapshot taken before the VM was first started, and so without a UUID.
+	snapshotConfig := map[string]string{"limits.cpu": "2"}
+
+	// The VM was started and reconfigured since.
+	config := map[string]string{"limits.cpu": "4", "volatile.vm.uuid": vmUUID}
+
+	restored := qemuRestoredConfig(config, snapshotConfig)
+	assert.Equal(t, map[string]string{"limits.cpu": "2", "volatile.vm.uuid": vmUUID}, restored)
+	assert.NotContains(t, snapshotConfig, "volatile.vm.uuid")
+
+	// A snapshot carrying a different UUID, such as one copied from another VM, doesn't change it either.
+	snapshotConfig["volatile.vm.uuid"] = "5d8a3c4e-9f5b-4d0e-a2a1-3b7c6e1f0a9d"
+	restored = qemuRestoredConfig(config, snapshotConfig)
+	assert.Equal(t, vmUUID, restored["volatile.vm.uuid"])
+
+	// A VM never started adopts the snapshot's UUID.
+	restored = qemuRestoredConfig(map[string]string{}, snapshotConfig)
+	assert.Equal(t, snapshotConfig["volatile.vm.uuid"], restored["volatile.vm.uuid"])
+}
+
+// qemuTestRestorePool is a qemuTestPool on which instances can be mounted, recording the snapshots
+// restored.
+type qemuTestRestorePool struct {
+	qemuTestPool
+
+	restored []string
+}
+
+func (p *qemuTestRestorePool) MountInstance(inst instance.Instance, op *operations.Operation) (bool, error) {
+	return false, nil
+}
+
+func (p *qemuTestRestorePool) RestoreInstanceSnapshot(inst instance.Instance, src instance.Instance, op *operations.Operation) error {
+	p.restored = append(p.restored, src.Name())
+	return nil
+}
+
+// Test that the UUID of a VM survives taking a snapshot and restoring it.
+func TestQemuRestore_KeepsUUID(t *testing.T) {
+	vm, cleanup := qemuTestStoppedVM(t, map[string]string{"limits.cpu": "2"})
+	defer cleanup()
+
+	pool := &qemuTestRestorePool{}
+	vm.storagePool = pool
+
+	// Snapshot the VM as the daemon does.
+	snapshot := func(name string) instance.Instance {
+		return qemuInstantiate(vm.state, db.InstanceArgs{
+			Project:      vm.Project(),
+			Architecture: vm.Architecture(),
+			Config:       vm.LocalConfig(),
+			Type:         vm.Type(),
+			Snapshot:     true,
+			Devices:      vm.LocalDevices(),
+			Name:         vm.Name() + shared.SnapshotDelimiter + name,
+			Profiles:     vm.Profiles(),
+		}, nil)
+	}
+
+	// Taken before the VM was first started, and so without a UUID.
+	snap0 := snapshot("snap0")
+	assert.NotContains(t, snap0.LocalConfig(), "volatile.vm.uuid")
+
+	// As done by the first start.
+	vmUUID := "0b9b6ad3-1a3d-4e6b-8c1d-8d5a1fc7d1a2"
+	require.NoError(t, vm.VolatileSet(map[string]string{"volatile.vm.uuid": vmUUID}))
+
+	snap1 := snapshot("snap1")
+	assert.Equal(t, vmUUID, snap1.LocalConfig()["volatile.vm.uuid"])
+
+	args := qemuTestUpdateArgs(vm)
+	args.Config["limits.cpu"] = "4"
+	require.NoError(t, vm.Update(args, true))
+
+	require.NoError(t, vm.Restore(snap0, false))
+	assert.Equal(t, "2", vm.LocalConfig()["limits.cpu"])
+	assert.Equal(t, vmUUID, vm.LocalConfig()["volatile.vm.uuid"])
+
+	require.NoError(t, vm.Restore(snap1, false))
+	assert.Equal(t, vmUUID, vm.LocalConfig()["volatile.vm.uuid"])
+
+	assert.Equal(t, []string{"vm1/snap0", "vm1/snap1"}, pool.restored)
+
+	// The UUID kept is the one recorded in the database.
+	value, err := vm.state.Cluster.ContainerConfigGet(vm.id, "volatile.vm.uuid")
+	require.NoError(t, err)
+	assert.Equal(t, vmUUID, value)
+}
+
+// Test that the snapshots of a VM are listed, and that the disk usage of the VM and of its snapshots
+// is the one the pool reports for each of them, rather than the VM's usage including its snapshots.
+func TestQemuSnapshots_DiskState(t *testing.T) {
+	vm, cleanup := qemuTestStoppedVM(t, map[string]string{"limits.cpu": "2"})
+	defer cleanup()
+
+	pool := &qemuTestPool{usage: map[string]int64{"vm1": 1073741824, "vm1/snap0": 16384, "vm1/snap1": 32768}}
+	vm.storagePool = pool
+
+	snaps, err := vm.Snapshots()
+	require.NoError(t, err)
+	assert.Len(t, snaps, 0)
+
+	err = vm.state.Cluster.Transaction(func(tx *db.ClusterTx) error {
+		for i, name := range []string{"snap0", "snap1"} {
+			_, err := tx.InstanceSnapshotCreate(db.InstanceSnapshot{
+				Project:      "default",
+				Instance:     "vm1",
+				Name:         name,
+				CreationDate: time.Now().Add(time.Duration(i) * time.Second),
+				Config:       map[string]string{"limits.cpu": "2"},
+				Devices:      map[string]map[string]string{"root": {"type": "disk", "path": "/", "pool": "default"}},
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	snaps, err = vm.Snapshots()
+	require.NoError(t, err)
+	require.Len(t, snaps, 2)
+
+	for i, snap := range snaps {
+		name := fmt.Sprintf("vm1/snap%d", i)
+		assert.Equal(t, name, snap.Name())
+		assert.True(t, snap.IsSnapshot())
+		assert.Equal(t, instancetype.VM, snap.Type())
+
+		// A snapshot has no snapshots of its own.
+		snapSnaps, err := snap.Snapshots()
+		require.NoError(t, err)
+		assert.Len(t, snapSnaps, 0)
+
+		snapVM := snap.(*qemu)
+		snapVM.storagePool = pool
+		disk, err := snapVM.diskState()
+		require.NoError(t, err)
+		assert.Equal(t, map[string]api.InstanceStateDisk{"root": {Usage: pool.usage[name]}}, disk)
+	}
+
+	disk, err := vm.diskState()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]api.InstanceStateDisk{"root": {Usage: 1073741824}}, disk)
+}
+
+// Test that devices see their own buffered volatile changes, without the VM's config being modified.
+func TestQemuDeviceVolatile(t *testing.T) {
+	vm := &qemu{
+		common: common{
+			localConfig: map[string]string{
+				"volatile.eth0.hwaddr":    "00:16:3e:00:00:01",
+				"volatile.eth0.host_name": "tap1",
+				"volatile.eth1.hwaddr":    "00:16:3e:00:00:02",
+			},
+		},
+	}
+
+	volatile := vm.newDeviceVolatile()
+
+	wg := sync.WaitGroup{}
+	for _, devName := range []string{"eth0", "eth1"} {
+		wg.Add(1)
+		go func(devName string) {
+			defer wg.Done()
+			assert.NoError(t, volatile.setFunc(devName)(map[string]string{"host_name": "", "last_state.created": "true"}))
+		}(devName)
+	}
+
+	wg.Wait()
+
+	assert.Equal(t, map[string]string{"hwaddr": "00:16:3e:00:00:01", "last_state.created": "true"}, volatile.getFunc("eth0")())
+	assert.Equal(t, map[string]string{"hwaddr": "00:16:3e:00:00:02", "last_state.created": "true"}, volatile.getFunc("eth1")())
+	assert.Equal(t, "tap1", vm.localConfig["volatile.eth0.host_name"])
+	assert.Len(t, volatile.changes, 4)
+}
+
+// Test that only the registered VMs whose health check interval elapsed are due.
+func TestQemuHealthChecksDue(t *testing.T) {
+	vm := &qemu{id: 1002, common: common{expandedConfig: map[string]string{"health_check.command": "true", "health_check.interval": "60"}}}
+	defer delete(qemuHealthChecks, vm.id)
+
+	vm.registerHealthCheck()
+	assert.Contains(t, healthChecksDue(), vm.id)
+	assert.Equal(t, time.Minute, qemuHealthChecks[vm.id].interval)
+
+	// Re-registering keeps the state of the check.
+	qemuHealthChecks[vm.id].lastRun = time.Now()
+	vm.registerHealthCheck()
+	assert.NotContains(t, healthChecksDue(), vm.id)
+
+	vm.expandedConfig["health_check.interval"] = "0"
+	vm.registerHealthCheck()
+	assert.Contains(t, healthChecksDue(), vm.id)
+
+	qemuHealthChecks[vm.id].running = true
+	assert.NotContains(t, healthChecksDue(), vm.id)
+
+	// VMs without a health check are dropped.
+	vm.expandedConfig = map[string]string{}
+	vm.registerHealthCheck()
+	_, ok := qemuHealthChecks[vm.id]
+	assert.False(t, ok)
+}
+
+func TestQemuNextHealth(t *testing.T) {
+	tests := []struct {
+		health   string
+		failures int
+		want     string
+	}{
+		{"", 0, "healthy"},
+		{"", 1, "healthy"}, // A single failure isn't enough.
+		{"healthy", 2, "healthy"},
+		{"healthy", 3, "unhealthy"},
+		{"unhealthy", 4, "unhealthy"},
+		{"unhealthy", 1, "unhealthy"}, // The failure count is lost when LXD restarts.
+		{"unhealthy", 0, "healthy"},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.want, qemuNextHealth(test.health, test.failures, 3), "health %q after %d failures", test.health, test.failures)
+	}
+}
+
+func TestQemuGuestLogConfig(t *testing.T) {
+	vm := &qemu{common: common{project: "default", expandedConfig: map[string]string{}}, name: "vm1"}
+
+	sb := &strings.Builder{}
+	require.NoError(t, vm.addGuestLogConfig(sb))
+	assert.Empty(t, sb.String())
+
+	vm.expandedConfig["log.guest"] = "true"
+	require.NoError(t, vm.addGuestLogConfig(sb))
+	assert.Contains(t, sb.String(), `backend = "ringbuf"`)
+	assert.Contains(t, sb.String(), `size = "1048576B"`)
+	assert.Contains(t, sb.String(), `name = "org.linuxcontainers.lxd.log"`)
+
+	// User serial ports can't take the names of LXD's.
+	assert.Error(t, qemuCheckSerialPortName("org.linuxcontainers.lxd.log"))
+	assert.NoError(t, qemuCheckSerialPortName("console2"))
+}
+
+// Test that the guest log is drained from qemu and capped in size.
+func TestQemuDrainGuestLog(t *testing.T) {
+	vm, cleanup := qemuTestVM(t)
+	defer cleanup()
+
+	vm.expandedConfig = map[string]string{"log.guest": "true"}
+
+	stop := qemuTestQMPServer(t, vm.getMonitorPath())
+	defer stop()
+
+	monitor, err := vm.getMonitor()
+	require.NoError(t, err)
+	defer monitor.Disconnect()
+
+	require.NoError(t, vm.drainGuestLog(monitor))
+	content, err := ioutil.ReadFile(vm.GuestLogPath())
+	require.NoError(t, err)
+	assert.Equal(t, "guest booted\n", string(content))
+
+	// Only the end of the log is kept.
+	require.NoError(t, ioutil.WriteFile(vm.GuestLogPath(), bytes.Repeat([]byte("x"), qemuGuestLogSize), 0600))
+	require.NoError(t, vm.drainGuestLog(monitor))
+	content, err = ioutil.ReadFile(vm.GuestLogPath())
+	require.NoError(t, err)
+	assert.Len(t, content, qemuGuestLogSize)
+	assert.True(t, bytes.HasSuffix(content, []byte("xguest booted\n")))
+
+	// Nothing is read when the guest log is disabled.
+	require.NoError(t, os.Remove(vm.GuestLogPath()))
+	vm.expandedConfig["log.guest"] = "false"
+	require.NoError(t, vm.drainGuestLog(monitor))
+	assert.False(t, shared.PathExists(vm.GuestLogPath()))
+}
+
+// Test that the guest log of a running VM is drained periodically, until the monitor disconnects.
+func TestQemuWatchGuestLog(t *testing.T) {
+	defer func(interval time.Duration) { qemuGuestLogInterval = interval }(qemuGuestLogInterval)
+	qemuGuestLogInterval = 10 * time.Millisecond
+
+	vm, cleanup := qemuTestVM(t)
+	defer cleanup()
+
+	vm.expandedConfig = map[string]string{"log.guest": "true"}
+
+	stop := qemuTestQMPServer(t, vm.getMonitorPath())
+	defer stop()
+
+	monitor, err := vm.getMonitor()
+	require.NoError(t, err)
+
+	done := make(chan struct{})
+	go func() {
+		vm.watchGuestLog(monitor)
+		close(done)
+	}()
+
+	for i := 0; i < 100 && !shared.PathExists(vm.GuestLogPath()); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	content, err := ioutil.ReadFile(vm.GuestLogPath())
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(content), "guest booted\n"))
+
+	monitor.Disconnect()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Guest log still watched after the monitor disconnected")
+	}
+}
+
+func TestQemuBlockIOErrorReason(t *testing.T) {
+	// Errors reported to the guest don't pause the VM.
+	_, paused := qemuBlockIOErrorReason(map[string]interface{}{"device": "lxd_root", "operation": "read", "action": "report", "reason": "Input/output error"})
+	assert.False(t, paused)
+
+	reason, paused := qemuBlockIOErrorReason(map[string]interface{}{"device": "lxd_root", "node-name": "#block123", "operation": "write", "action": "stop", "nospace": true, "reason": "No space left on device"})
+	assert.True(t, paused)
+	assert.Equal(t, `I/O error on disk "root" during write: No space left on device`, reason)
+
+	reason, paused = qemuBlockIOErrorReason(map[string]interface{}{"device": "", "node-name": "lxd_data", "operation": "read", "action": "stop", "nospace": false, "reason": "Input/output error"})
+	assert.True(t, paused)
+	assert.Equal(t, `I/O error on disk "data" during read: Input/output error`, reason)
+}
+
+func TestQemuLogExcerpt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lxd-qemu-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// A missing log is empty.
+	excerpt, err := qemuLogExcerpt(filepath.Join(dir, "missing.log"), 4096)
+	require.NoError(t, err)
+	assert.Equal(t, "", excerpt)
+
+	// Escape sequences and carriage returns of the firmware's output are cleaned up.
+	path := filepath.Join(dir, "console.log")
+	err = ioutil.WriteFile(path, []byte("\x1b[2J\x1b[01;01H\x1b[0m\x1b[35m\x1b[40mBdsDxe: loading Boot0001\r\nBdsDxe: failed to load Boot0001\r\n\x00"), 0600)
+	require.NoError(t, err)
+
+	excerpt, err = qemuLogExcerpt(path, 4096)
+	require.NoError(t, err)
+	assert.Equal(t, "BdsDxe: loading Boot0001\nBdsDxe: failed to load Boot0001", excerpt)
+
+	// Only the end is kept, starting at a line boundary.
+	excerpt, err = qemuLogExcerpt(path, 45)
+	require.NoError(t, err)
+	assert.Equal(t, "[...]\nBdsDxe: failed to load Boot0001", excerpt)
+
+	excerpt, err = qemuLogExcerpt(path, 0)
+	require.NoError(t, err)
+	assert.Equal(t, "", excerpt)
+}
+
+// Test that the console log is cut back to the boot window, keeping its start.
+func TestQemuCapLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lxd-qemu-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// A missing log is left alone.
+	path := filepath.Join(dir, "console.log")
+	require.NoError(t, qemuCapLog(path, 10))
+	assert.False(t, shared.PathExists(path))
+
+	require.NoError(t, ioutil.WriteFile(path, []byte("BdsDxe: loading Boot0001\n"), 0600))
+	require.NoError(t, qemuCapLog(path, 100))
+	content, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "BdsDxe: loading Boot0001\n", string(content))
+
+	require.NoError(t, qemuCapLog(path, 6))
+	content, err = ioutil.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "BdsDxe", string(content))
+}
+
+func TestQemuSnapshotDiff(t *testing.T) {
+	snapConfig := map[string]string{"limits.cpu": "2", "limits.memory": "1GiB", "security.secureboot": "false", "volatile.eth0.hwaddr": "00:16:3e:00:00:01", "volatile.last_state.power": "STOPPED"}
+	snapDevices := deviceConfig.Devices{
+		"root": deviceConfig.Device{"type": "disk", "path": "/", "pool": "default"},
+		"eth0": deviceConfig.Device{"type": "nic", "network": "lxdbr0"},
+		"gpu":  deviceConfig.Device{"type": "gpu"},
+	}
+
+	config := map[string]string{"limits.cpu": "4", "limits.memory": "1GiB", "boot.autostart": "true", "volatile.eth0.hwaddr": "00:16:3e:00:00:02", "volatile.vm.uuid": "0b9b6ad3-1a3d-4e6b-8c1d-8d5a1fc7d1a2"}
+	devices := deviceConfig.Devices{
+		"root": deviceConfig.Device{"type": "disk", "path": "/", "pool": "default", "size": "20GiB"},
+		"eth0": deviceConfig.Device{"type": "nic", "network": "lxdbr0"},
+		"eth1": deviceConfig.Device{"type": "nic", "network": "lxdbr1"},
+	}
+
+	diff := qemuSnapshotDiff(snapConfig, snapDevices, config, devices)
+	assert.Equal(t, []string{"boot.autostart"}, diff.ConfigAdded)
+	assert.Equal(t, []string{"security.secureboot"}, diff.ConfigRemoved)
+	assert.Equal(t, []string{"limits.cpu"}, diff.ConfigChanged)
+	assert.Equal(t, []string{"eth1"}, diff.DevicesAdded)
+	assert.Equal(t, []string{"gpu"}, diff.DevicesRemoved)
+	assert.Equal(t, []string{"root"}, diff.DevicesChanged)
+
+	// Nothing differs from an identical snapshot.
+	diff = qemuSnapshotDiff(config, devices, config, devices)
+	assert.Empty(t, diff.ConfigAdded)
+	assert.Empty(t, diff.ConfigRemoved)
+	assert.Empty(t, diff.ConfigChanged)
+	assert.Empty(t, diff.DevicesAdded)
+	assert.Empty(t, diff.DevicesRemoved)
+	assert.Empty(t, diff.DevicesChanged)
+}
+
+func TestQemuNetDevConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lxd-qemu-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	defer func(path string) { qemuSysClassNet = path }(qemuSysClassNet)
+	qemuSysClassNet = dir
+
+	// Fake host interfaces, as created by the NIC devices.
+	for path, content := range map[string]string{
+		"mac123/macvtap/tap7/dev": "",
+		"mac123/ifindex":          "7\n",
+		"ipv123/ipvtap/tap8/dev":  "",
+		"ipv123/ifindex":          "8\n",
+		"tap123/tun_flags":        "0x1002\n",
+	} {
+		path = filepath.Join(dir, path)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, ioutil.WriteFile(path, []byte(content), 0644))
+	}
+
+	vm := &qemu{}
+	vm.architectureName = "x86_64"
+	vm.expandedDevices = deviceConfig.Devices{}
+	vm.localConfig = map[string]string{}
+	vm.expandedConfig = map[string]string{}
+
+	tests := []struct {
+		nicType  string
+		nicName  string
+		pciSlot  string
+		queues   string
+		contains []string
+		fdFiles  []string
+	}{
+		{
+			nicType:  "macvlan",
+			nicName:  "mac123",
+			queues:   "2",
+			contains: []string{`fds = "3:4"`, `mac = "00:16:3e:00:00:01"`},
+			fdFiles:  []string{"/dev/tap7", "/dev/tap7"},
+		},
+		{
+			nicType:  "ipvlan",
+			nicName:  "ipv123",
+			queues:   "1",
+			contains: []string{`fd = "3"`, `mac = "00:16:3e:00:00:01"`},
+			fdFiles:  []string{"/dev/tap8"},
+		},
+		{
+			nicType:  "bridged",
+			nicName:  "tap123",
+			queues:   "1",
+			contains: []string{`ifname = "tap123"`, `mac = "00:16:3e:00:00:01"`},
+		},
+		{
+			nicType:  "physical",
+			nicName:  "enp5s0",
+			pciSlot:  "0000:05:00.0",
+			contains: []string{`driver = "vfio-pci"`, `host = "0000:05:00.0"`},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.nicType, func(t *testing.T) {
+			sb := &strings.Builder{}
+			fdFiles := []string{}
+			err := vm.addNetDevConfig(sb, 0, map[string]int{}, []deviceConfig.RunConfigItem{
+				{Key: "link", Value: test.nicName},
+				{Key: "devName", Value: "eth0"},
+				{Key: "hwaddr", Value: "00:16:3e:00:00:01"},
+				{Key: "pciSlotName", Value: test.pciSlot},
+				{Key: "queues", Value: test.queues},
+			}, &fdFiles, false)
+			require.NoError(t, err)
+
+			for _, s := range test.contains {
+				assert.Contains(t, sb.String(), s)
+			}
+
+			if test.fdFiles == nil {
+				test.fdFiles = []string{}
+			}
+
+			assert.Equal(t, test.fdFiles, fdFiles)
+		})
+	}
+
+	// The host interface must exist.
+	fdFiles := []string{}
+	err = vm.addNetDevConfig(&strings.Builder{}, 0, map[string]int{}, []deviceConfig.RunConfigItem{
+		{Key: "link", Value: "missing"},
+		{Key: "devName", Value: "eth0"},
+	}, &fdFiles, false)
+	assert.EqualError(t, err, `Host interface "missing" of device "eth0" doesn't exist`)
+
+	// Unless on a dry run, where it's rendered as a tap device.
+	sb := &strings.Builder{}
+	err = vm.addNetDevConfig(sb, 0, map[string]int{}, []deviceConfig.RunConfigItem{
+		{Key: "link", Value: "missing"},
+		{Key: "devName", Value: "eth0"},
+	}, &fdFiles, true)
+	require.NoError(t, err)
+	assert.Contains(t, sb.String(), `ifname = "missing"`)
+	assert.Equal(t, []string{}, fdFiles)
+}
+
+func TestQemuNICOffloads(t *testing.T) {
+	assert.Equal(t, []string{}, qemuNICOffloads("", "true"))
+	assert.Equal(t, []string{"csum", "host_tso4", "host_tso6", "host_ecn", "host_ufo"}, qemuNICOffloads("false", ""))
+	assert.Equal(t, []string{"guest_csum", "guest_tso4", "guest_tso6", "guest_ecn", "guest_ufo"}, qemuNICOffloads("true", "false"))
+
+	dir, err := ioutil.TempDir("", "lxd-qemu-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	defer func(path string) { qemuSysClassNet = path }(qemuSysClassNet)
+	qemuSysClassNet = dir
+
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "tap123"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "tap123", "tun_flags"), []byte("0x1002\n"), 0644))
+
+	vm := &qemu{}
+	vm.architectureName = "x86_64"
+	vm.expandedDevices = deviceConfig.Devices{}
+	vm.localConfig = map[string]string{}
+	vm.expandedConfig = map[string]string{}
+
+	nicConfig := []deviceConfig.RunConfigItem{
+		{Key: "link", Value: "tap123"},
+		{Key: "devName", Value: "eth0"},
+		{Key: "hwaddr", Value: "00:16:3e:00:00:01"},
+		{Key: "offload.rx", Value: "false"},
+	}
+
+	// The disabled offloads are turned off on the virtio-net device.
+	sb := &strings.Builder{}
+	fdFiles := []string{}
+	err = vm.addNetDevConfig(sb, 0, map[string]int{}, nicConfig, &fdFiles, false)
+	require.NoError(t, err)
+	assert.Contains(t, sb.String(), "guest_csum = \"off\"\nguest_tso4 = \"off\"\n")
+	assert.NotContains(t, sb.String(), "host_tso4")
+
+	// Other models can't turn them off.
+	nicConfig = append(nicConfig, deviceConfig.RunConfigItem{Key: "model", Value: "e1000e"})
+	err = vm.addNetDevConfig(&strings.Builder{}, 0, map[string]int{}, nicConfig, &fdFiles, false)
+	assert.EqualError(t, err, `Offloads can only be turned off with the virtio-net model on device "eth0"`)
+}
+
+func TestQemuDirectKernelConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lxd-qemu-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	kernelPath := filepath.Join(dir, "vmlinuz")
+	initrdPath := filepath.Join(dir, "initrd.img")
+	require.NoError(t, ioutil.WriteFile(kernelPath, []byte{}, 0600))
+	require.NoError(t, ioutil.WriteFile(initrdPath, []byte{}, 0600))
+
+	vm := &qemu{}
+	vm.expandedConfig = map[string]string{
+		"raw.qemu.kernel":  kernelPath,
+		"raw.qemu.initrd":  initrdPath,
+		"raw.qemu.cmdline": "console=ttyS0 root=/dev/sda2",
+	}
+
+	// The kernel and initrd are passed as file descriptors, in place of the firmware.
+	sb := &strings.Builder{}
+	fdFiles := []string{}
+	err = vm.addFirmwareConfig(sb, &fdFiles)
+	require.NoError(t, err)
+	assert.Equal(t, `
+# Direct kernel boot
+[machine]
+kernel = "/proc/self/fd/3"
+initrd = "/proc/self/fd/4"
+append = "console=ttyS0 root=/dev/sda2"
+`, sb.String())
+	assert.Equal(t, []string{kernelPath, initrdPath}, fdFiles)
+	assert.NotContains(t, sb.String(), "pflash")
+
+	// The files must be readable regular files.
+	for _, path := range []string{filepath.Join(dir, "missing"), dir} {
+		vm.expandedConfig["raw.qemu.initrd"] = path
+		err = vm.addFirmwareConfig(&strings.Builder{}, &[]string{})
+		assert.Error(t, err)
+	}
+}
+
+// A VM failing to start after a config change points to the rollback, which restores the config it
+// last started successfully with. The test VMs can't be mounted, so a start which gets past the
+// checks of qemu's capabilities fails there instead.
+func TestQemuRollbackConfig(t *testing.T) {
+	if !shared.PathExists("/sys/module/vhost_vsock") {
+		t.Skip("vhost_vsock isn't loaded")
+	}
+
+	vm, cleanup := qemuTestStoppedVM(t, map[string]string{"limits.cpu": "2", "security.secureboot": "false"})
+	defer cleanup()
+
+	// A qemu too old for secure boot.
+	binDir, err := ioutil.TempDir("", "lxd-qemu-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(binDir)
+
+	script := `#!/bin/sh
+case "$*" in
+-version)
+	echo "QEMU emulator version 2.0.0"
+	;;
+"-machine help")
+	echo "Supported machines are:"
+	echo "q35                  Standard PC (Q35 + ICH9, 2009)"
+	;;
+"-device help")
+	echo "Misc devices:"
+	echo 'name "vhost-vsock-pci", bus PCI'
+	;;
+*)
+	read cmd
+	;;
+esac
+`
+	require.NoError(t, ioutil.WriteFile(filepath.Join(binDir, "qemu-system-x86_64"), []byte(script), 0755))
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", binDir+":"+os.Getenv("PATH"))
+
+	// Nothing to roll back to before the first successful start.
+	assert.Error(t, vm.RollbackConfig())
+
+	err = vm.Start(false)
+	assert.Equal(t, errQemuTestMount, err)
+
+	// As done by a successful start.
+	vm.recordLastGoodConfig()
+
+	// Update to a config which fails to start.
+	args := qemuTestUpdateArgs(vm)
+	args.Config["security.secureboot"] = "true"
+	args.Config["volatile.eth0.hwaddr"] = "00:16:3e:12:34:56"
+	args.Devices["eth0"] = deviceConfig.Device{"type": "nic", "nictype": "p2p"}
+	require.NoError(t, vm.Update(args, true))
+
+	err = vm.Start(false)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "secure boot support")
+	assert.Contains(t, err.Error(), `the "rollback-config" state action restores it`)
+
+	// The rollback restores the previous config and devices, keeping the volatile keys.
+	require.NoError(t, vm.RollbackConfig())
+	assert.Equal(t, "false", vm.LocalConfig()["security.secureboot"])
+	assert.Equal(t, "00:16:3e:12:34:56", vm.LocalConfig()["volatile.eth0.hwaddr"])
+	assert.Equal(t, deviceConfig.Devices{"root": deviceConfig.Device{"type": "disk", "path": "/", "pool": "default"}}, vm.LocalDevices())
+
+	// The VM starts again as far as it did before the update.
+	err = vm.Start(false)
+	assert.Equal(t, errQemuTestMount, err)
+}
+
+func TestQemuDeviceClaimsHostDevice(t *testing.T) {
+	assert.True(t, qemuDeviceClaimsHostDevice(deviceConfig.Device{"type": "nic", "nictype": "sriov", "parent": "eth0"}))
+	assert.True(t, qemuDeviceClaimsHostDevice(deviceConfig.Device{"type": "nic", "nictype": "physical", "parent": "eth0"}))
+	assert.True(t, qemuDeviceClaimsHostDevice(deviceConfig.Device{"type": "gpu"}))
+	assert.False(t, qemuDeviceClaimsHostDevice(deviceConfig.Device{"type": "nic", "nictype": "bridged", "parent": "lxdbr0"}))
+	assert.False(t, qemuDeviceClaimsHostDevice(deviceConfig.Device{"type": "disk", "path": "/", "pool": "default"}))
+}
+
+// qemuTestPool is a storage pool on which updating the backup file of an instance does nothing. The
+// disk of its instances is at diskPath and their usage is taken from usage, by instance name.
+type qemuTestPool struct {
+	storagePools.Pool
+
+	diskPath string
+	usage    map[string]int64
+}
+
+func (p *qemuTestPool) GetInstanceDisk(inst instance.Instance) (string, error) {
+	return p.diskPath, nil
+}
+
+func (p *qemuTestPool) GetInstanceUsage(inst instance.Instance) (int64, error) {
+	return p.usage[inst.Name()], nil
+}
+
+func (p *qemuTestPool) UpdateInstanceBackupFile(inst instance.Instance, op *operations.Operation) error {
+	return nil
+}
+
+// errQemuTestMount is returned when mounting an instance on a qemuTestPool.
+var errQemuTestMount = fmt.Errorf("Test instances can't be mounted")
+
+func (p *qemuTestPool) MountInstance(inst instance.Instance, op *operations.Operation) (bool, error) {
+	return false, errQemuTestMount
+}
+
+// qemuTestRunningVM returns the VM vm1 of the default project with the given config and a root disk,
+// recorded in a test database and reported as running by a QMP server passing commands to handler.
+// The returned function removes them.
+func qemuTestRunningVM(t *testing.T, config map[string]string, handler func(command string, args map[string]interface{}) string) (*qemu, func()) {
+	vm, cleanupVM := qemuTestStoppedVM(t, config)
+	stop := qemuTestQMPServerHandler(t, vm.getMonitorPath(), "running", handler)
+
+	cleanup := func() {
+		qemuTestDisconnect(vm)
+		stop()
+		cleanupVM()
+	}
+
+	return vm, cleanup
+}
+
+// qemuTestStoppedVM returns the VM vm1 of the default project with the given config and a root disk,
+// recorded in a test database. The returned function removes them.
+func qemuTestStoppedVM(t *testing.T, config map[string]string) (*qemu, func()) {
+	vm, cleanupVM := qemuTestVM(t)
+	s, cleanupState := state.NewTestState(t)
+	s.Events = events.NewServer(false, false)
+
+	cleanup := func() {
+		cleanupState()
+		cleanupVM()
+	}
+
+	_, err := s.Cluster.StoragePoolCreate("default", "", "dir", nil)
+	if err == nil {
+		err = s.Cluster.Transaction(func(tx *db.ClusterTx) error {
+			id, err := tx.InstanceCreate(db.Instance{
+				Project: "default",
+				Name:    "vm1",
+				Node:    "none",
+				Type:    instancetype.VM,
+			})
+			vm.id = int(id)
+			return err
+		})
+	}
+
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+
+	vm.dbType = instancetype.VM
+	vm.state = s
+	vm.architecture = osarch.ARCH_64BIT_INTEL_X86
+	vm.architectureName = "x86_64"
+	vm.storagePool = &qemuTestPool{}
+	vm.localConfig = config
+	vm.localDevices = deviceConfig.Devices{
+		"root": deviceConfig.Device{"type": "disk", "path": "/", "pool": "default"},
+	}
+
+	vm.expandedConfig = map[string]string{}
+	for k, v := range config {
+		vm.expandedConfig[k] = v
+	}
+
+	vm.expandedDevices = vm.localDevices.Clone()
+
+	return vm, cleanup
+}
+
+// qemuTestUpdateArgs returns the arguments updating a test VM to its current config and devices,
+// for the test to change.
+func qemuTestUpdateArgs(vm *qemu) db.InstanceArgs {
+	config := map[string]string{}
+	for k, v := range vm.localConfig {
+		config[k] = v
+	}
+
+	return db.InstanceArgs{
+		Type:         instancetype.VM,
+		Project:      vm.project,
+		Architecture: vm.architecture,
+		Config:       config,
+		Devices:      vm.localDevices.Clone(),
+		Profiles:     []string{},
+	}
+}
+
+// Test that vCPUs are hot-plugged when limits.cpu changes on a running VM, while the changes which
+// can't be applied to it are refused.
+func TestQemuUpdate_Running(t *testing.T) {
+	var lock sync.Mutex
+	added := []string{}
+
+	vm, cleanup := qemuTestRunningVM(t, map[string]string{"limits.cpu": "2", "limits.cpu.max": "4"}, func(command string, args map[string]interface{}) string {
+		switch command {
+		case "query-hotpluggable-cpus":
+			return `{"return": [` +
+				`{"type": "host-x86_64-cpu", "qom-path": "/machine/unattached/device[0]", "props": {"socket-id": 0, "core-id": 0, "thread-id": 0}},` +
+				`{"type": "host-x86_64-cpu", "qom-path": "/machine/unattached/device[1]", "props": {"socket-id": 0, "core-id": 1, "thread-id": 0}},` +
+				`{"type": "host-x86_64-cpu", "props": {"socket-id": 0, "core-id": 2, "thread-id": 0}},` +
+				`{"type": "host-x86_64-cpu", "props": {"socket-id": 0, "core-id": 3, "thread-id": 0}}]}`
+		case "device_add":
+			lock.Lock()
+			added = append(added, args["id"].(string))
+			lock.Unlock()
+		}
+
+		return ""
+	})
+	defer cleanup()
+
+	// Two vCPUs are added to the running VM.
+	args := qemuTestUpdateArgs(vm)
+	args.Config["limits.cpu"] = "4"
+	require.NoError(t, vm.Update(args, true))
+	assert.Equal(t, []string{"qemu_cpu2", "qemu_cpu3"}, added)
+	assert.Equal(t, "4", vm.LocalConfig()["limits.cpu"])
+
+	// Keys only used by LXD can be changed.
+	args = qemuTestUpdateArgs(vm)
+	args.Config["user.comment"] = "test"
+	args.Config["boot.autostart"] = "true"
+	assert.NoError(t, vm.Update(args, true))
+
+	// The room for vCPUs can't be changed on the running VM.
+	args = qemuTestUpdateArgs(vm)
+	args.Config["limits.cpu.max"] = "8"
+	assert.EqualError(t, vm.Update(args, true), `Key "limits.cpu.max" cannot be changed whilst the VM is running`)
+	assert.Equal(t, "4", vm.LocalConfig()["limits.cpu.max"])
+
+	// Memory can't be added without room for it.
+	args = qemuTestUpdateArgs(vm)
+	args.Config["limits.memory"] = "2GiB"
+	assert.EqualError(t, vm.Update(args, true), "limits.memory can only be changed whilst the VM is running when it was started with limits.memory.max")
+
+	// Disks can't be hot-plugged.
+	args = qemuTestUpdateArgs(vm)
+	args.Devices["data"] = deviceConfig.Device{"type": "disk", "path": "/mnt", "source": shared.VarPath()}
+	assert.EqualError(t, vm.Update(args, true), `Device "data" of type "disk" cannot be added or removed whilst the VM is running`)
+	assert.NotContains(t, vm.ExpandedDevices(), "data")
+}
+
+// Test that a new CPU allowance is applied to the cgroup of a running VM.
+func TestQemuUpdate_CPUAllowance(t *testing.T) {
+	dir, cleanupCgroups := qemuTestCgroups(t, cgroup.V2)
+	defer cleanupCgroups()
+
+	vm, cleanup := qemuTestRunningVM(t, map[string]string{}, nil)
+	defer cleanup()
+
+	vm.state.OS.CGInfo.Layout = cgroup.CgroupsUnified
+
+	args := qemuTestUpdateArgs(vm)
+	args.Config["limits.cpu.allowance"] = "25ms/100ms"
+	require.NoError(t, vm.Update(args, true))
+
+	content, err := ioutil.ReadFile(filepath.Join(dir, "lxd.service", "lxd.vm.default_vm1", "cpu.max"))
+	require.NoError(t, err)
+	assert.Equal(t, "25000 100000", string(content))
+
+	content, err = ioutil.ReadFile(filepath.Join(dir, "lxd.service", "lxd.vm.default_vm1", "cpu.weight"))
+	require.NoError(t, err)
+	assert.Equal(t, "100", string(content))
+}
+
+// Test that memory is hot-added as a DIMM when limits.memory is raised on a running VM, along with the
+// limit of its cgroup.
+func TestQemuUpdate_Memory(t *testing.T) {
+	dir, cleanupCgroups := qemuTestCgroups(t, cgroup.V2)
+	defer cleanupCgroups()
+
+	var lock sync.Mutex
+	drivers := []string{}
+
+	vm, cleanup := qemuTestRunningVM(t, map[string]string{"limits.memory": "1536MiB", "limits.memory.max": "4GiB"}, func(command string, args map[string]interface{}) string {
+		if command == "device_add" {
+			lock.Lock()
+			drivers = append(drivers, args["driver"].(string))
+			lock.Unlock()
+		}
+
+		return ""
+	})
+	defer cleanup()
+
+	vm.state.OS.CGInfo.Layout = cgroup.CgroupsUnified
+
+	args := qemuTestUpdateArgs(vm)
+	args.Config["limits.memory"] = "2GiB"
+	require.NoError(t, vm.Update(args, true))
+	assert.Equal(t, []string{"pc-dimm"}, drivers)
+
+	content, err := ioutil.ReadFile(filepath.Join(dir, "lxd.service", "lxd.vm.default_vm1", "memory.max"))
+	require.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf("%d", (2048+256)*1024*1024), string(content))
+
+	// The room for memory can't be changed on the running VM.
+	args = qemuTestUpdateArgs(vm)
+	args.Config["limits.memory.max"] = "8GiB"
+	assert.EqualError(t, vm.Update(args, true), `Key "limits.memory.max" cannot be changed whilst the VM is running`)
+}
+
+// Test that qemu is told about the new size of the root disk when it's grown on a running VM.
+func TestQemuUpdate_RootDiskResize(t *testing.T) {
+	var lock sync.Mutex
+	resized := []map[string]interface{}{}
+
+	vm, cleanup := qemuTestRunningVM(t, map[string]string{}, func(command string, args map[string]interface{}) string {
+		if command == "block_resize" {
+			lock.Lock()
+			resized = append(resized, args)
+			lock.Unlock()
+		}
+
+		return ""
+	})
+	defer cleanup()
+
+	// The raw root disk of the VM on the default dir pool.
+	poolID, _, err := vm.state.Cluster.StoragePoolGet("default")
+	require.NoError(t, err)
+
+	_, err = vm.state.Cluster.StoragePoolVolumeCreate("default", "vm1", "", db.StoragePoolVolumeTypeVM, false, poolID, nil)
+	require.NoError(t, err)
+
+	diskPath := shared.VarPath("storage-pools", "default", "virtual-machines", "vm1", "root.img")
+	require.NoError(t, os.MkdirAll(filepath.Dir(diskPath), 0700))
+	require.NoError(t, ioutil.WriteFile(diskPath, nil, 0600))
+	require.NoError(t, os.Truncate(diskPath, 10*1024*1024))
+	vm.storagePool = &qemuTestPool{diskPath: diskPath}
+
+	args := qemuTestUpdateArgs(vm)
+	args.Devices["root"]["size"] = "20MiB"
+	require.NoError(t, vm.Update(args, true))
+
+	info, err := os.Stat(diskPath)
+	require.NoError(t, err)
+	assert.Equal(t, int64(20*1024*1024), info.Size())
+	assert.Equal(t, []map[string]interface{}{{"device": "lxd_root", "size": float64(20 * 1024 * 1024)}}, resized)
+}
+
+// Test that changing the source of a CD-ROM drive on a running VM swaps its media, and that removing
+// the source ejects it.
+func TestQemuUpdate_CDROMMedia(t *testing.T) {
+	var lock sync.Mutex
+	commands := []string{}
+
+	vm, cleanup := qemuTestRunningVM(t, map[string]string{}, func(command string, args map[string]interface{}) string {
+		if command == "blockdev-change-medium" || command == "eject" {
+			lock.Lock()
+			commands = append(commands, fmt.Sprintf("%s %v", command, args["device"]))
+			lock.Unlock()
+		}
+
+		return ""
+	})
+	defer cleanup()
+
+	for _, name := range []string{"old.iso", "new.iso"} {
+		require.NoError(t, ioutil.WriteFile(shared.VarPath(name), []byte(name), 0600))
+	}
+
+	vm.localDevices["cd"] = deviceConfig.Device{"type": "disk", "cdrom": "true", "source": shared.VarPath("old.iso")}
+	vm.expandedDevices = vm.localDevices.Clone()
+
+	args := qemuTestUpdateArgs(vm)
+	args.Devices["cd"]["source"] = shared.VarPath("new.iso")
+	require.NoError(t, vm.Update(args, true))
+	assert.Equal(t, shared.VarPath("new.iso"), vm.ExpandedDevices()["cd"]["source"])
+
+	args = qemuTestUpdateArgs(vm)
+	delete(args.Devices["cd"], "source")
+	require.NoError(t, vm.Update(args, true))
+
+	assert.Equal(t, []string{"blockdev-change-medium lxd_cd", "eject lxd_cd"}, commands)
+}
+
+// Test that adding a USB device to a running VM adds the USB controller it needs, and that removing
+// it unplugs the host devices passed through to the VM.
+func TestQemuUpdate_USB(t *testing.T) {
+	var lock sync.Mutex
+	commands := []string{}
+
+	vm, cleanup := qemuTestRunningVM(t, map[string]string{}, func(command string, args map[string]interface{}) string {
+		lock.Lock()
+		defer lock.Unlock()
+
+		switch command {
+		case "device_add":
+			commands = append(commands, fmt.Sprintf("%s %v", command, args["driver"]))
+		case "device_del":
+			commands = append(commands, fmt.Sprintf("%s %v", command, args["id"]))
+		case "qom-list":
+			if len(commands) > 0 {
+				return `{"return": [{"name": "qemu_usb", "type": "child<qemu-xhci>"}, {"name": "dev-lxd_usb0-1-2", "type": "child<usb-host>"}, {"name": "type", "type": "string"}]}`
+			}
+		}
+
+		return ""
+	})
+	defer cleanup()
+
+	// No host device matches, only the controller is added.
+	args := qemuTestUpdateArgs(vm)
+	args.Devices["usb0"] = deviceConfig.Device{"type": "usb", "vendorid": "ffff", "productid": "ffff"}
+	require.NoError(t, vm.Update(args, true))
+	assert.Contains(t, vm.ExpandedDevices(), "usb0")
+
+	args = qemuTestUpdateArgs(vm)
+	delete(args.Devices, "usb0")
+	require.NoError(t, vm.Update(args, true))
+	assert.NotContains(t, vm.ExpandedDevices(), "usb0")
+
+	assert.Equal(t, []string{"device_add qemu-xhci", "device_del dev-lxd_usb0-1-2"}, commands)
+}
+
+// Test that virtio serial ports are hot-plugged into and unplugged from a running VM, while isa ones
+// are refused.
+func TestQemuUpdate_Serial(t *testing.T) {
+	var lock sync.Mutex
+	commands := []string{}
+
+	vm, cleanup := qemuTestRunningVM(t, map[string]string{}, func(command string, args map[string]interface{}) string {
+		switch command {
+		case "chardev-add", "chardev-remove", "device_del":
+			lock.Lock()
+			commands = append(commands, fmt.Sprintf("%s %v", command, args["id"]))
+			lock.Unlock()
+		case "device_add":
+			lock.Lock()
+			commands = append(commands, fmt.Sprintf("%s %v %v", command, args["id"], args["chardev"]))
+			lock.Unlock()
+		}
+
+		return ""
+	})
+	defer cleanup()
+
+	args := qemuTestUpdateArgs(vm)
+	args.Devices["port0"] = deviceConfig.Device{"type": "serial", "source": "/dev/null"}
+	require.NoError(t, vm.Update(args, true))
+	assert.Contains(t, vm.ExpandedDevices(), "port0")
+
+	args = qemuTestUpdateArgs(vm)
+	delete(args.Devices, "port0")
+	require.NoError(t, vm.Update(args, true))
+	assert.NotContains(t, vm.ExpandedDevices(), "port0")
+
+	assert.Equal(t, []string{
+		"chardev-add lxd_port0",
+		"device_add dev-lxd_port0 lxd_port0",
+		"device_del dev-lxd_port0",
+		"chardev-remove lxd_port0",
+	}, commands)
+
+	// Ports on the isa bus only exist from the start of the VM.
+	args = qemuTestUpdateArgs(vm)
+	args.Devices["com1"] = deviceConfig.Device{"type": "serial", "source": "/dev/null", "bus": "isa"}
+	err := vm.Update(args, true)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "Device cannot be started when instance is running")
+}
+
+// Test that a new memory overhead is applied to the cgroup memory limit of a running VM.
+func TestQemuUpdate_MemoryOverhead(t *testing.T) {
+	dir, cleanupCgroups := qemuTestCgroups(t, cgroup.V2)
+	defer cleanupCgroups()
+
+	vm, cleanup := qemuTestRunningVM(t, map[string]string{"limits.memory": "1GiB"}, nil)
+	defer cleanup()
+
+	vm.state.OS.CGInfo.Layout = cgroup.CgroupsUnified
+
+	args := qemuTestUpdateArgs(vm)
+	args.Config["limits.memory.overhead"] = "512MiB"
+	require.NoError(t, vm.Update(args, true))
+
+	content, err := ioutil.ReadFile(filepath.Join(dir, "lxd.service", "lxd.vm.default_vm1", "memory.max"))
+	require.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf("%d", (1024+512)*1024*1024), string(content))
+}
+
+// Test that changing the cloud-init config of a running VM swaps its cloud-init ISO for a new one.
+func TestQemuUpdate_CloudInitISO(t *testing.T) {
+	found := false
+	for _, name := range []string{"genisoimage", "mkisofs", "xorriso"} {
+		_, err := exec.LookPath(name)
+		if err == nil {
+			found = true
+			break
+		}
+	}
+
+	if !found {
+		t.Skip("No ISO building tool available")
+	}
+
+	var lock sync.Mutex
+	commands := []string{}
+
+	vm, cleanup := qemuTestRunningVM(t, map[string]string{"boot.cloud_init_iso": "true"}, func(command string, args map[string]interface{}) string {
+		if command == "blockdev-change-medium" {
+			lock.Lock()
+			commands = append(commands, fmt.Sprintf("%s %v", command, args["device"]))
+			lock.Unlock()
+		}
+
+		return ""
+	})
+	defer cleanup()
+
+	require.NoError(t, os.MkdirAll(vm.Path(), 0700))
+
+	args := qemuTestUpdateArgs(vm)
+	args.Config["user.user-data"] = "#cloud-config\npackages: [htop]\n"
+	require.NoError(t, vm.Update(args, true))
+	assert.FileExists(t, vm.cloudInitISOPath())
+	assert.Equal(t, []string{"blockdev-change-medium qemu_cloud_init"}, commands)
+
+	// Other keys leave the ISO alone.
+	args = qemuTestUpdateArgs(vm)
+	args.Config["user.comment"] = "test"
+	require.NoError(t, vm.Update(args, true))
+	assert.Len(t, commands, 1)
+}
@@ -24,6 +24,9 @@ func init() {
 
 	// Expose create to the instance package, to avoid circular imports.
 	instance.Create = create
+
+	// Expose healthChecksDue to the instance package, to avoid circular imports.
+	instance.HealthChecksDue = healthChecksDue
 }
 
 // load creates the underlying instance type struct and returns it as an Instance.
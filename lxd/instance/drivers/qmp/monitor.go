@@ -1,6 +1,7 @@
 package qmp
 
 import (
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"os"
@@ -19,6 +20,9 @@ var monitorsLock sync.Mutex
 // RingbufSize is the size of the agent serial ringbuffer in bytes
 var RingbufSize = 16
 
+// RingbufMaxSize is the most read from a ringbuf character device at once, qemu's largest ringbuf size.
+const RingbufMaxSize = 1 << 30
+
 // Monitor represents a QMP monitor.
 type Monitor struct {
 	path string
@@ -30,6 +34,9 @@ type Monitor struct {
 	eventHandler func(name string, data map[string]interface{})
 }
 
+// connectRetries is the number of times a failed connection to an existing socket is retried.
+const connectRetries = 3
+
 // Connect creates or retrieves an existing QMP monitor for the path.
 func Connect(path string, eventHandler func(name string, data map[string]interface{})) (*Monitor, error) {
 	monitorsLock.Lock()
@@ -42,15 +49,21 @@ func Connect(path string, eventHandler func(name string, data map[string]interfa
 		return monitor, nil
 	}
 
-	// Setup the connection.
-	qmpConn, err := qmp.NewSocketMonitor("unix", path, time.Second)
-	if err != nil {
-		return nil, err
-	}
+	// Setup the connection, retrying with a short backoff as long as the socket exists so that a
+	// transient failure isn't mistaken for the VM being gone.
+	var qmpConn *qmp.SocketMonitor
+	var err error
+	for i := 0; ; i++ {
+		qmpConn, err = connect(path)
+		if err == nil {
+			break
+		}
 
-	err = qmpConn.Connect()
-	if err != nil {
-		return nil, err
+		if i >= connectRetries || !shared.PathExists(path) {
+			return nil, err
+		}
+
+		time.Sleep(time.Duration(100<<uint(i)) * time.Millisecond)
 	}
 
 	// Setup the monitor struct.
@@ -72,6 +85,21 @@ func Connect(path string, eventHandler func(name string, data map[string]interfa
 	return monitor, nil
 }
 
+// connect opens a new QMP connection to the socket at path.
+func connect(path string) (*qmp.SocketMonitor, error) {
+	qmpConn, err := qmp.NewSocketMonitor("unix", path, time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	err = qmpConn.Connect()
+	if err != nil {
+		return nil, err
+	}
+
+	return qmpConn, nil
+}
+
 func (m *Monitor) run() error {
 	// Start ringbuffer monitoring go routine.
 	go func() {
@@ -131,6 +159,11 @@ func (m *Monitor) run() error {
 					continue
 				}
 
+				// The agent has to report in again after the guest was reset.
+				if e.Event == "RESET" {
+					m.agentReady = false
+				}
+
 				if m.eventHandler != nil {
 					m.eventHandler(e.Event, e.Data)
 				}
@@ -151,6 +184,11 @@ func (m *Monitor) Wait() (chan struct{}, error) {
 	return m.chDisconnect, nil
 }
 
+// Disconnected returns whether the monitor got disconnected from QEMU.
+func (m *Monitor) Disconnected() bool {
+	return m.disconnected
+}
+
 // Disconnect forces a disconnection from QEMU.
 func (m *Monitor) Disconnect() {
 	// Stop all go routines and disconnect from socket.
@@ -265,6 +303,11 @@ func (m *Monitor) Powerdown() error {
 	return m.runCmd("system_powerdown")
 }
 
+// Reset tells QEMU to reset the VM in place.
+func (m *Monitor) Reset() error {
+	return m.runCmd("system_reset")
+}
+
 // Start tells QEMU to start the emulation.
 func (m *Monitor) Start() error {
 	return m.runCmd("cont")
@@ -320,3 +363,410 @@ func (m *Monitor) GetCPUs() ([]int, error) {
 
 	return pids, nil
 }
+
+// CPU represents a vCPU of the VM along with its position in the CPU topology.
+type CPU struct {
+	Index    int            `json:"cpu-index"`
+	ThreadID int            `json:"thread-id"`
+	Props    map[string]int `json:"props"`
+}
+
+// GetCPUsFast fetches the vCPU information for pinning, including the socket, core and thread of each
+// vCPU, without interrupting them. This requires QEMU 2.12 or later, which deprecated query-cpus.
+func (m *Monitor) GetCPUsFast() ([]CPU, error) {
+	respRaw, err := m.runCmdArgs("query-cpus-fast", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Process the response.
+	var respDecoded struct {
+		Return []CPU `json:"return"`
+	}
+
+	err = json.Unmarshal(respRaw, &respDecoded)
+	if err != nil {
+		return nil, ErrMonitorBadReturn
+	}
+
+	return respDecoded.Return, nil
+}
+
+// qmpCommand is a QMP command along with its arguments.
+type qmpCommand struct {
+	Execute   string      `json:"execute"`
+	Arguments interface{} `json:"arguments,omitempty"`
+}
+
+// runCmdArgs runs a QMP command with arguments and returns its raw response. Errors returned by QEMU
+// for the command itself don't cause the monitor to be disconnected.
+func (m *Monitor) runCmdArgs(cmd string, args interface{}) ([]byte, error) {
+	// Check if disconnected
+	if m.disconnected {
+		return nil, ErrMonitorDisconnect
+	}
+
+	reqJSON, err := json.Marshal(qmpCommand{Execute: cmd, Arguments: args})
+	if err != nil {
+		return nil, err
+	}
+
+	return m.qmp.Run(reqJSON)
+}
+
+// RingbufRead returns and removes the content of a ringbuf character device.
+func (m *Monitor) RingbufRead(charDevID string) ([]byte, error) {
+	respRaw, err := m.runCmdArgs("ringbuf-read", map[string]interface{}{"device": charDevID, "size": RingbufMaxSize, "format": "base64"})
+	if err != nil {
+		return nil, err
+	}
+
+	// Process the response.
+	var respDecoded struct {
+		Return string `json:"return"`
+	}
+
+	err = json.Unmarshal(respRaw, &respDecoded)
+	if err != nil {
+		return nil, ErrMonitorBadReturn
+	}
+
+	return base64.StdEncoding.DecodeString(respDecoded.Return)
+}
+
+// AddDevice adds a new device to the running VM.
+func (m *Monitor) AddDevice(device map[string]interface{}) error {
+	_, err := m.runCmdArgs("device_add", device)
+	return err
+}
+
+// RemoveDevice removes a device from the running VM.
+func (m *Monitor) RemoveDevice(deviceID string) error {
+	_, err := m.runCmdArgs("device_del", map[string]string{"id": deviceID})
+	return err
+}
+
+// GetDevices returns the IDs of the user defined devices of the VM.
+func (m *Monitor) GetDevices() ([]string, error) {
+	respRaw, err := m.runCmdArgs("qom-list", map[string]string{"path": "/machine/peripheral"})
+	if err != nil {
+		return nil, err
+	}
+
+	// Process the response.
+	var respDecoded struct {
+		Return []struct {
+			Name string `json:"name"`
+			Type string `json:"type"`
+		} `json:"return"`
+	}
+
+	err = json.Unmarshal(respRaw, &respDecoded)
+	if err != nil {
+		return nil, ErrMonitorBadReturn
+	}
+
+	// Only children of the container are devices, the rest are properties.
+	devices := []string{}
+	for _, entry := range respDecoded.Return {
+		if strings.HasPrefix(entry.Type, "child<") {
+			devices = append(devices, entry.Name)
+		}
+	}
+
+	return devices, nil
+}
+
+// HotpluggableCPU represents a vCPU slot of the VM.
+type HotpluggableCPU struct {
+	Type    string         `json:"type"`
+	QOMPath string         `json:"qom-path"`
+	Props   map[string]int `json:"props"`
+}
+
+// GetHotpluggableCPUs returns the vCPU slots of the VM. Slots with an empty QOMPath are free.
+func (m *Monitor) GetHotpluggableCPUs() ([]HotpluggableCPU, error) {
+	respRaw, err := m.runCmdArgs("query-hotpluggable-cpus", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Process the response.
+	var respDecoded struct {
+		Return []HotpluggableCPU `json:"return"`
+	}
+
+	err = json.Unmarshal(respRaw, &respDecoded)
+	if err != nil {
+		return nil, ErrMonitorBadReturn
+	}
+
+	return respDecoded.Return, nil
+}
+
+// BlockStats represents the I/O counters of a block device.
+type BlockStats struct {
+	BytesRead       int64 `json:"rd_bytes"`
+	BytesWritten    int64 `json:"wr_bytes"`
+	ReadOperations  int64 `json:"rd_operations"`
+	WriteOperations int64 `json:"wr_operations"`
+}
+
+// GetBlockStats returns the I/O counters of the VM's block devices, keyed by drive ID or, for drives
+// without one, by the ID of the device they're attached to.
+func (m *Monitor) GetBlockStats() (map[string]BlockStats, error) {
+	respRaw, err := m.runCmdArgs("query-blockstats", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Process the response.
+	var respDecoded struct {
+		Return []struct {
+			Device string     `json:"device"`
+			QDev   string     `json:"qdev"`
+			Stats  BlockStats `json:"stats"`
+		} `json:"return"`
+	}
+
+	err = json.Unmarshal(respRaw, &respDecoded)
+	if err != nil {
+		return nil, ErrMonitorBadReturn
+	}
+
+	stats := map[string]BlockStats{}
+	for _, entry := range respDecoded.Return {
+		name := entry.Device
+		if name == "" {
+			name = entry.QDev
+		}
+
+		if name == "" {
+			continue
+		}
+
+		stats[name] = entry.Stats
+	}
+
+	return stats, nil
+}
+
+// GetBalloonSize returns the amount of memory in bytes currently given to the VM by its balloon.
+func (m *Monitor) GetBalloonSize() (int64, error) {
+	respRaw, err := m.runCmdArgs("query-balloon", nil)
+	if err != nil {
+		return -1, err
+	}
+
+	// Process the response.
+	var respDecoded struct {
+		Return struct {
+			Actual int64 `json:"actual"`
+		} `json:"return"`
+	}
+
+	err = json.Unmarshal(respRaw, &respDecoded)
+	if err != nil {
+		return -1, ErrMonitorBadReturn
+	}
+
+	return respDecoded.Return.Actual, nil
+}
+
+// GetMemorySize returns the total amount of memory in bytes of the VM, including hot-plugged memory.
+func (m *Monitor) GetMemorySize() (int64, error) {
+	respRaw, err := m.runCmdArgs("query-memory-size-summary", nil)
+	if err != nil {
+		return -1, err
+	}
+
+	// Process the response.
+	var respDecoded struct {
+		Return struct {
+			BaseMemory    int64 `json:"base-memory"`
+			PluggedMemory int64 `json:"plugged-memory"`
+		} `json:"return"`
+	}
+
+	err = json.Unmarshal(respRaw, &respDecoded)
+	if err != nil {
+		return -1, ErrMonitorBadReturn
+	}
+
+	return respDecoded.Return.BaseMemory + respDecoded.Return.PluggedMemory, nil
+}
+
+// AddObject adds a new object, such as a memory backend, to the running VM. The object properties are
+// passed inline as done by recent QEMU versions, falling back to the "props" argument used before.
+func (m *Monitor) AddObject(qomType string, id string, props map[string]interface{}) error {
+	args := map[string]interface{}{
+		"qom-type": qomType,
+		"id":       id,
+	}
+
+	for key, value := range props {
+		args[key] = value
+	}
+
+	_, err := m.runCmdArgs("object-add", args)
+	if err == nil {
+		return nil
+	}
+
+	_, err = m.runCmdArgs("object-add", map[string]interface{}{"qom-type": qomType, "id": id, "props": props})
+	return err
+}
+
+// RemoveObject removes an object from the running VM.
+func (m *Monitor) RemoveObject(id string) error {
+	_, err := m.runCmdArgs("object-del", map[string]string{"id": id})
+	return err
+}
+
+// GetObjectProperty decodes the value of a property of the object at the supplied QOM path.
+func (m *Monitor) GetObjectProperty(path string, property string, value interface{}) error {
+	respRaw, err := m.runCmdArgs("qom-get", map[string]string{"path": path, "property": property})
+	if err != nil {
+		return err
+	}
+
+	// Process the response.
+	respDecoded := struct {
+		Return interface{} `json:"return"`
+	}{Return: value}
+
+	err = json.Unmarshal(respRaw, &respDecoded)
+	if err != nil {
+		return ErrMonitorBadReturn
+	}
+
+	return nil
+}
+
+// ACPIOSPMStatus represents the status reported by the guest OS for a hot-plugged device.
+type ACPIOSPMStatus struct {
+	Device   string `json:"device"`
+	Slot     string `json:"slot"`
+	SlotType string `json:"slot-type"`
+	Source   int    `json:"source"`
+	Status   int    `json:"status"`
+}
+
+// GetACPIOSPMStatus returns the status reported by the guest OS for the hotpluggable slots of the VM.
+// A source of 0 means the guest didn't report anything for the slot.
+func (m *Monitor) GetACPIOSPMStatus() ([]ACPIOSPMStatus, error) {
+	respRaw, err := m.runCmdArgs("query-acpi-ospm-status", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Process the response.
+	var respDecoded struct {
+		Return []ACPIOSPMStatus `json:"return"`
+	}
+
+	err = json.Unmarshal(respRaw, &respDecoded)
+	if err != nil {
+		return nil, ErrMonitorBadReturn
+	}
+
+	return respDecoded.Return, nil
+}
+
+// Eject ejects the media of a removable drive.
+func (m *Monitor) Eject(driveID string) error {
+	_, err := m.runCmdArgs("eject", map[string]interface{}{"device": driveID, "force": true})
+	return err
+}
+
+// ResizeDrive tells QEMU the new size of a drive, in bytes, after its image was grown.
+func (m *Monitor) ResizeDrive(driveID string, size int64) error {
+	_, err := m.runCmdArgs("block_resize", map[string]interface{}{"device": driveID, "size": size})
+	return err
+}
+
+// SnapshotDrive takes an internal snapshot of a drive, stored within its image.
+func (m *Monitor) SnapshotDrive(driveID string, name string) error {
+	_, err := m.runCmdArgs("blockdev-snapshot-internal-sync", map[string]interface{}{"device": driveID, "name": name})
+	return err
+}
+
+// addFD passes a file descriptor to QEMU in a new fdset and returns its ID. The fdset can then be
+// referred to as /dev/fdset/ID where QEMU expects a path.
+func (m *Monitor) addFD(file *os.File) (int, error) {
+	// Check if disconnected
+	if m.disconnected {
+		return -1, ErrMonitorDisconnect
+	}
+
+	// Add the file descriptor to a new fdset.
+	respRaw, err := m.qmp.RunWithFile([]byte("{'execute': 'add-fd'}"), file)
+	if err != nil {
+		return -1, err
+	}
+
+	// Process the response.
+	var respDecoded struct {
+		Return struct {
+			FDSetID int `json:"fdset-id"`
+		} `json:"return"`
+	}
+
+	err = json.Unmarshal(respRaw, &respDecoded)
+	if err != nil {
+		return -1, ErrMonitorBadReturn
+	}
+
+	return respDecoded.Return.FDSetID, nil
+}
+
+// ChangeMedia replaces the media of a removable drive with the supplied file. The file is passed
+// to QEMU as a file descriptor so that it needn't be reachable from within its chroot.
+func (m *Monitor) ChangeMedia(driveID string, file *os.File) error {
+	fdSetID, err := m.addFD(file)
+	if err != nil {
+		return err
+	}
+
+	// The fdset is only needed until QEMU has opened the media.
+	defer m.runCmdArgs("remove-fdset", map[string]interface{}{"fdset-id": fdSetID})
+
+	_, err = m.runCmdArgs("blockdev-change-medium", map[string]interface{}{
+		"device":         driveID,
+		"filename":       fmt.Sprintf("/dev/fdset/%d", fdSetID),
+		"format":         "raw",
+		"read-only-mode": "read-only",
+	})
+
+	return err
+}
+
+// AddSerialCharDevice adds a character device backed by the supplied host serial port. The port is
+// passed to QEMU as a file descriptor so that it needn't be reachable from within its chroot.
+func (m *Monitor) AddSerialCharDevice(charDevID string, file *os.File) error {
+	fdSetID, err := m.addFD(file)
+	if err != nil {
+		return err
+	}
+
+	// The fdset is only needed until QEMU has opened the port.
+	defer m.runCmdArgs("remove-fdset", map[string]interface{}{"fdset-id": fdSetID})
+
+	_, err = m.runCmdArgs("chardev-add", map[string]interface{}{
+		"id": charDevID,
+		"backend": map[string]interface{}{
+			"type": "serial",
+			"data": map[string]interface{}{
+				"device": fmt.Sprintf("/dev/fdset/%d", fdSetID),
+			},
+		},
+	})
+
+	return err
+}
+
+// RemoveCharDevice removes a character device.
+func (m *Monitor) RemoveCharDevice(charDevID string) error {
+	_, err := m.runCmdArgs("chardev-remove", map[string]interface{}{"id": charDevID})
+	return err
+}
@@ -52,6 +52,7 @@ type Instance interface {
 	// Snapshots & migration & backups.
 	Restore(source Instance, stateful bool) error
 	Snapshots() ([]Instance, error)
+	SnapshotDisk(devName string, snapshotName string) error
 	Backups() ([]backup.Backup, error)
 	UpdateBackupFile() error
 
@@ -71,6 +72,8 @@ type Instance interface {
 	FilePull(srcpath string, dstpath string) (int64, int64, os.FileMode, string, []string, error)
 	FilePush(fileType string, srcpath string, dstpath string, uid int64, gid int64, mode int, write string) error
 	FileRemove(path string) error
+	FilePullTree(srcpath string, w io.Writer) error
+	FilePushTree(r io.Reader, dstpath string, uid int64, gid int64) error
 
 	// Console - Allocate and run a console tty.
 	Console() (*os.File, chan error, error)
@@ -80,6 +83,7 @@ type Instance interface {
 	Render() (interface{}, interface{}, error)
 	RenderFull() (*api.InstanceFull, interface{}, error)
 	RenderState() (*api.InstanceState, error)
+	Metrics() (*api.InstanceMetrics, error)
 	IsRunning() bool
 	IsFrozen() bool
 	IsEphemeral() bool
@@ -143,6 +147,16 @@ type Container interface {
 	InsertSeccompUnixDevice(prefix string, m deviceConfig.Device, pid int) error
 }
 
+// VM interface is for VM specific functions.
+type VM interface {
+	Instance
+
+	QemuConfig() (*api.InstanceQemuConfig, error)
+	HealthCheck() (bool, error)
+	GuestLog() (string, error)
+	Reattach()
+}
+
 // CriuMigrationArgs arguments for CRIU migration.
 type CriuMigrationArgs struct {
 	Cmd          uint
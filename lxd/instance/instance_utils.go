@@ -41,6 +41,10 @@ var Load func(s *state.State, args db.InstanceArgs, profiles []api.Profile) (Ins
 // Create is linked from instance/drivers.create to allow difference instance types to be created.
 var Create func(s *state.State, args db.InstanceArgs) (Instance, error)
 
+// HealthChecksDue is linked from instance/drivers.healthChecksDue to list the IDs of the local VMs whose
+// health check is due, without loading all instances.
+var HealthChecksDue func() []int
+
 // CompareSnapshots returns a list of snapshots to sync to the target and a list of
 // snapshots to remove from the target. A snapshot will be marked as "to sync" if it either doesn't
 // exist in the target or its creation date is different to the source. A snapshot will be marked
@@ -144,6 +148,15 @@ func ValidConfig(sysOS *sys.OS, config map[string]string, profile bool, expanded
 		return err
 	}
 
+	if expanded && config["raw.qemu.kernel"] == "" && (config["raw.qemu.initrd"] != "" || config["raw.qemu.cmdline"] != "") {
+		return fmt.Errorf("raw.qemu.initrd and raw.qemu.cmdline require raw.qemu.kernel")
+	}
+
+	// The firmware is skipped when booting a kernel directly, and with it secure boot.
+	if expanded && config["raw.qemu.kernel"] != "" && (config["security.secureboot"] == "" || shared.IsTrue(config["security.secureboot"])) {
+		return fmt.Errorf("raw.qemu.kernel is incompatible with secure boot, security.secureboot must be set to false")
+	}
+
 	if expanded && (config["security.privileged"] == "" || !shared.IsTrue(config["security.privileged"])) && sysOS.IdmapSet == nil {
 		return fmt.Errorf("LXD doesn't have a uid/gid allocation. In this mode, only privileged containers are supported")
 	}
@@ -189,6 +202,65 @@ func validConfigKey(os *sys.OS, key string, value string) error {
 	return nil
 }
 
+// ValidCloudInitConfig checks the cloud-init user-data and vendor-data keys of a new config, which
+// differ from the old one. The old config is nil on creation. Unchanged values aren't checked again,
+// so that existing instances and profiles can still be updated.
+func ValidCloudInitConfig(oldConfig map[string]string, config map[string]string) error {
+	for _, key := range []string{"user.user-data", "user.vendor-data"} {
+		if config[key] == oldConfig[key] {
+			continue
+		}
+
+		err := cloudInitValidUserData(config[key])
+		if err != nil {
+			return errors.Wrapf(err, "Invalid %s", key)
+		}
+	}
+
+	return nil
+}
+
+// cloudInitUserDataHeaders lists the first lines cloud-init recognizes user-data and vendor-data by,
+// other than #cloud-config and scripts.
+var cloudInitUserDataHeaders = []string{"#cloud-config-archive", "#cloud-config-jsonp", "#cloud-boothook", "#include", "#include-once", "#part-handler", "#upstart-job", "## template: jinja"}
+
+// cloudInitValidUserData checks that the content of user-data or vendor-data starts with a header
+// cloud-init recognizes, and that #cloud-config payloads are a valid YAML mapping. Other payloads are
+// passed through to cloud-init unchecked.
+func cloudInitValidUserData(value string) error {
+	if value == "" {
+		return nil
+	}
+
+	// Compressed and MIME multi-part payloads have no header line.
+	if strings.HasPrefix(value, "\x1f\x8b") || strings.HasPrefix(value, "Content-Type:") || strings.HasPrefix(value, "MIME-Version:") {
+		return nil
+	}
+
+	header := strings.TrimRight(strings.SplitN(value, "\n", 2)[0], " \t\r")
+	if strings.HasPrefix(header, "#!") {
+		return nil
+	}
+
+	if header != "#cloud-config" {
+		for _, known := range cloudInitUserDataHeaders {
+			if header == known || strings.HasPrefix(header, known+" ") {
+				return nil
+			}
+		}
+
+		return fmt.Errorf("Unrecognized header %q, expected #cloud-config, a script starting with #! or another cloud-init user-data format", header)
+	}
+
+	content := map[string]interface{}{}
+	err := yaml.Unmarshal([]byte(value), &content)
+	if err != nil {
+		return errors.Wrap(err, "Invalid #cloud-config YAML")
+	}
+
+	return nil
+}
+
 func lxcParseRawLXC(line string) (string, string, error) {
 	// Ignore empty lines
 	if len(line) == 0 {
@@ -0,0 +1,25 @@
+package instance
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidCloudInitConfig(t *testing.T) {
+	valid := "#cloud-config\npackages:\n  - htop\n"
+	invalid := "packages:\n  - htop\n"
+
+	// New values are checked on creation.
+	assert.NoError(t, ValidCloudInitConfig(nil, map[string]string{"user.user-data": valid}))
+	assert.NoError(t, ValidCloudInitConfig(nil, map[string]string{"user.vendor-data": "#!/bin/sh\necho hello\n"}))
+	assert.EqualError(t, ValidCloudInitConfig(nil, map[string]string{"user.user-data": invalid}), `Invalid user.user-data: Unrecognized header "packages:", expected #cloud-config, a script starting with #! or another cloud-init user-data format`)
+	assert.Error(t, ValidCloudInitConfig(nil, map[string]string{"user.vendor-data": "#cloud-config\n- htop\n"}))
+
+	// Unchanged values aren't checked again on update.
+	assert.NoError(t, ValidCloudInitConfig(map[string]string{"user.user-data": invalid}, map[string]string{"user.user-data": invalid, "limits.cpu": "2"}))
+
+	// Changed values are.
+	assert.Error(t, ValidCloudInitConfig(map[string]string{"user.user-data": valid}, map[string]string{"user.user-data": invalid}))
+	assert.NoError(t, ValidCloudInitConfig(map[string]string{"user.user-data": invalid}, map[string]string{}))
+}
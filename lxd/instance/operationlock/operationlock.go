@@ -91,8 +91,12 @@ func (op *InstanceOperation) Wait() error {
 	return op.err
 }
 
-// Done indicates the operation has finished.
+// Done indicates the operation has finished. It is a no-op on a nil operation.
 func (op *InstanceOperation) Done(err error) {
+	if op == nil {
+		return
+	}
+
 	instanceOperationsLock.Lock()
 	defer instanceOperationsLock.Unlock()
 
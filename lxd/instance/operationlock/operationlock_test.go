@@ -0,0 +1,57 @@
+package operationlock
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Test that an instance can't be stopped while it's being paused, but can once the pause is done.
+func TestCreate_PauseThenStop(t *testing.T) {
+	pauseOp, err := Create(1, "freeze", false, false)
+	require.NoError(t, err)
+
+	_, err = Create(1, "stop", false, true)
+	assert.EqualError(t, err, "Instance is busy running a freeze operation")
+
+	pauseOp.Done(nil)
+	assert.NoError(t, pauseOp.Wait())
+
+	stopOp, err := Create(1, "stop", false, true)
+	require.NoError(t, err)
+	assert.Equal(t, "stop", stopOp.Action())
+	stopOp.Done(nil)
+}
+
+// Test that an instance can't be paused while it's being stopped.
+func TestCreate_StopThenPause(t *testing.T) {
+	stopOp, err := Create(2, "stop", false, true)
+	require.NoError(t, err)
+
+	_, err = Create(2, "freeze", false, false)
+	assert.EqualError(t, err, "Instance is busy running a stop operation")
+
+	stopOp.Done(nil)
+	assert.Nil(t, Get(2))
+}
+
+// Test that a failed pause releases the lock and reports its error.
+func TestCreate_PauseFailed(t *testing.T) {
+	pauseOp, err := Create(3, "freeze", false, false)
+	require.NoError(t, err)
+
+	pauseOp.Done(assert.AnError)
+	assert.Equal(t, assert.AnError, pauseOp.Wait())
+
+	_, err = Create(3, "stop", false, true)
+	assert.NoError(t, err)
+	Get(3).Done(nil)
+}
+
+// Test that finishing a missing operation is a no-op.
+func TestDone_Nil(t *testing.T) {
+	op := Get(4)
+	assert.Nil(t, op)
+	op.Done(assert.AnError)
+}
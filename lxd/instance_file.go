@@ -11,6 +11,7 @@ import (
 	"github.com/gorilla/mux"
 
 	"github.com/lxc/lxd/lxd/instance"
+	"github.com/lxc/lxd/lxd/instance/instancetype"
 	"github.com/lxc/lxd/lxd/response"
 	"github.com/lxc/lxd/shared"
 )
@@ -160,3 +161,76 @@ func containerFileDelete(c instance.Instance, path string, r *http.Request) resp
 
 	return response.EmptySyncResponse
 }
+
+func instanceFileTreeHandler(d *Daemon, r *http.Request) response.Response {
+	instanceType, err := urlInstanceTypeDetect(r)
+	if err != nil {
+		return response.SmartError(err)
+	}
+
+	project := projectParam(r)
+	name := mux.Vars(r)["name"]
+
+	resp, err := ForwardedResponseIfContainerIsRemote(d, r, project, name, instanceType)
+	if err != nil {
+		return response.SmartError(err)
+	}
+	if resp != nil {
+		return resp
+	}
+
+	inst, err := instance.LoadByProjectAndName(d.State(), project, name)
+	if err != nil {
+		return response.SmartError(err)
+	}
+
+	if inst.Type() != instancetype.VM {
+		return response.BadRequest(fmt.Errorf("File trees can only be transferred to and from virtual machines"))
+	}
+
+	path := r.FormValue("path")
+	if path == "" {
+		return response.BadRequest(fmt.Errorf("missing path argument"))
+	}
+
+	switch r.Method {
+	case "GET":
+		return &instanceFileTreeResponse{inst: inst, path: path}
+	case "POST":
+		uid, gid, _, _, _ := shared.ParseLXDFileHeaders(r.Header)
+
+		err = inst.FilePushTree(r.Body, path, uid, gid)
+		if err != nil {
+			return response.SmartError(err)
+		}
+
+		return response.EmptySyncResponse
+	default:
+		return response.NotFound(fmt.Errorf("Method '%s' not found", r.Method))
+	}
+}
+
+// instanceFileTreeResponse streams the file tree at path in the instance as a tar archive. As the
+// status has already been sent by the time the archive fails to be written, errors are reported in
+// the X-LXD-Error trailer.
+type instanceFileTreeResponse struct {
+	inst instance.Instance
+	path string
+}
+
+func (r *instanceFileTreeResponse) Render(w http.ResponseWriter) error {
+	w.Header().Set("Content-Type", "application/x-tar")
+	w.Header().Set("Trailer", "X-LXD-Error")
+	w.WriteHeader(http.StatusOK)
+
+	err := r.inst.FilePullTree(r.path, w)
+	if err != nil {
+		w.Header().Set("X-LXD-Error", err.Error())
+	}
+
+	return nil
+}
+
+func (r *instanceFileTreeResponse) String() string {
+	return fmt.Sprintf("file tree %s", r.path)
+}
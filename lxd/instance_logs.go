@@ -95,6 +95,8 @@ func validLogFileName(fname string) bool {
 	return fname == "lxc.log" ||
 		fname == "lxc.conf" ||
 		fname == "qemu.log" ||
+		fname == "guest.log" ||
+		fname == "console.log" ||
 		strings.HasPrefix(fname, "migration_") ||
 		strings.HasPrefix(fname, "snapshot_") ||
 		strings.HasPrefix(fname, "exec_")
@@ -129,6 +131,22 @@ func containerLogGet(d *Daemon, r *http.Request) response.Response {
 		return response.BadRequest(fmt.Errorf("log file name %s not valid", file))
 	}
 
+	// The guest log of running VMs is held by qemu until saved.
+	if file == "guest.log" {
+		inst, err := instance.LoadByProjectAndName(d.State(), projectName, name)
+		if err != nil {
+			return response.SmartError(err)
+		}
+
+		vm, ok := inst.(instance.VM)
+		if ok {
+			_, err = vm.GuestLog()
+			if err != nil {
+				return response.SmartError(err)
+			}
+		}
+	}
+
 	ent := response.FileResponseEntry{
 		Path:     shared.LogPath(project.Instance(projectName, name), file),
 		Filename: file,
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"github.com/lxc/lxd/lxd/instance"
+	"github.com/lxc/lxd/lxd/instance/instancetype"
+	"github.com/lxc/lxd/lxd/response"
+)
+
+var instanceMetricsCmd = APIEndpoint{
+	Name: "instanceMetrics",
+	Path: "instances/{name}/metrics",
+	Aliases: []APIEndpointAlias{
+		{Name: "vmMetrics", Path: "virtual-machines/{name}/metrics"},
+	},
+
+	Get: APIEndpointAction{Handler: instanceMetricsGet, AccessHandler: AllowProjectPermission("containers", "view")},
+}
+
+// instanceMetricsGet returns the resource usage of a virtual machine, for monitoring.
+func instanceMetricsGet(d *Daemon, r *http.Request) response.Response {
+	instanceType, err := urlInstanceTypeDetect(r)
+	if err != nil {
+		return response.SmartError(err)
+	}
+
+	project := projectParam(r)
+	name := mux.Vars(r)["name"]
+
+	// Forward the request if the instance is remote.
+	resp, err := ForwardedResponseIfContainerIsRemote(d, r, project, name, instanceType)
+	if err != nil {
+		return response.SmartError(err)
+	}
+	if resp != nil {
+		return resp
+	}
+
+	inst, err := instance.LoadByProjectAndName(d.State(), project, name)
+	if err != nil {
+		return response.SmartError(err)
+	}
+
+	if inst.Type() != instancetype.VM {
+		return response.BadRequest(fmt.Errorf("Instance is not virtual-machine type"))
+	}
+
+	metrics, err := inst.Metrics()
+	if err != nil {
+		return response.SmartError(err)
+	}
+
+	return response.SyncResponse(true, metrics)
+}
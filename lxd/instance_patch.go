@@ -121,6 +121,11 @@ func containerPatch(d *Daemon, r *http.Request) response.Response {
 		}
 	}
 
+	err = instance.ValidCloudInitConfig(c.LocalConfig(), req.Config)
+	if err != nil {
+		return response.BadRequest(err)
+	}
+
 	// Check project limits.
 	err = d.cluster.Transaction(func(tx *db.ClusterTx) error {
 		return projecthelpers.AllowInstanceUpdate(tx, project, name, req, c.LocalConfig())
@@ -23,6 +23,7 @@ import (
 	driver "github.com/lxc/lxd/lxd/storage"
 	"github.com/lxc/lxd/shared"
 	"github.com/lxc/lxd/shared/api"
+	log "github.com/lxc/lxd/shared/log15"
 	"github.com/lxc/lxd/shared/logger"
 )
 
@@ -173,6 +174,21 @@ func containerPost(d *Daemon, r *http.Request) response.Response {
 
 	if req.Migration {
 		if targetNode != "" {
+			// Moving to the requested node is allowed, but warn about its anti-affinity instances.
+			placement := instancePlacement(project, inst.ExpandedConfig())
+			var conflicts []string
+			err = d.cluster.Transaction(func(tx *db.ClusterTx) error {
+				conflicts, err = tx.NodePlacementConflicts(targetNode, placement)
+				return err
+			})
+			if err != nil {
+				return response.SmartError(err)
+			}
+
+			if len(conflicts) > 0 {
+				logger.Warn("Moving instance to a node running its anti-affinity instances", log.Ctx{"project": project, "instance": name, "node": targetNode, "anti_affinity": conflicts})
+			}
+
 			// Check whether the container is running.
 			if !sourceNodeOffline && inst.IsRunning() {
 				return response.BadRequest(fmt.Errorf("Container is running"))
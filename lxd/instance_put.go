@@ -66,6 +66,14 @@ func containerPut(d *Daemon, r *http.Request) response.Response {
 		architecture = 0
 	}
 
+	// Restoring a snapshot puts back the cloud-init data it had, only check the one set by the user.
+	if configRaw.Restore == "" {
+		err = instance.ValidCloudInitConfig(c.LocalConfig(), configRaw.Config)
+		if err != nil {
+			return response.BadRequest(err)
+		}
+	}
+
 	// Check project limits.
 	err = d.cluster.Transaction(func(tx *db.ClusterTx) error {
 		return projecthelpers.AllowInstanceUpdate(tx, project, name, configRaw, c.LocalConfig())
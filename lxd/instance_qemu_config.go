@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"github.com/lxc/lxd/lxd/instance"
+	"github.com/lxc/lxd/lxd/instance/instancetype"
+	"github.com/lxc/lxd/lxd/response"
+)
+
+var instanceQemuConfigCmd = APIEndpoint{
+	Name: "instanceQemuConfig",
+	Path: "instances/{name}/qemu-config",
+	Aliases: []APIEndpointAlias{
+		{Name: "vmQemuConfig", Path: "virtual-machines/{name}/qemu-config"},
+	},
+
+	Get: APIEndpointAction{Handler: instanceQemuConfigGet, AccessHandler: AllowProjectPermission("containers", "view")},
+}
+
+// instanceQemuConfigGet returns the qemu config file and arguments a virtual machine would be started
+// with, without starting it.
+func instanceQemuConfigGet(d *Daemon, r *http.Request) response.Response {
+	instanceType, err := urlInstanceTypeDetect(r)
+	if err != nil {
+		return response.SmartError(err)
+	}
+
+	project := projectParam(r)
+	name := mux.Vars(r)["name"]
+
+	// Forward the request if the instance is remote.
+	resp, err := ForwardedResponseIfContainerIsRemote(d, r, project, name, instanceType)
+	if err != nil {
+		return response.SmartError(err)
+	}
+	if resp != nil {
+		return resp
+	}
+
+	inst, err := instance.LoadByProjectAndName(d.State(), project, name)
+	if err != nil {
+		return response.SmartError(err)
+	}
+
+	if inst.Type() != instancetype.VM {
+		return response.BadRequest(fmt.Errorf("Instance is not virtual-machine type"))
+	}
+
+	conf, err := inst.(instance.VM).QemuConfig()
+	if err != nil {
+		return response.SmartError(err)
+	}
+
+	return response.SyncResponse(true, conf)
+}
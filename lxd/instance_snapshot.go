@@ -150,6 +150,28 @@ func containerSnapshotsPost(d *Daemon, r *http.Request) response.Response {
 		}
 	}
 
+	// Snapshot a single disk device rather than the whole instance.
+	if req.Device != "" {
+		if req.Stateful {
+			return response.BadRequest(fmt.Errorf("Disk device snapshots can't be stateful"))
+		}
+
+		snapshotDisk := func(op *operations.Operation) error {
+			return inst.SnapshotDisk(req.Device, req.Name)
+		}
+
+		resources := map[string][]string{}
+		resources["instances"] = []string{name}
+		resources["containers"] = resources["instances"]
+
+		op, err := operations.OperationCreate(d.State(), project, operations.OperationClassTask, db.OperationSnapshotCreate, resources, nil, snapshotDisk, nil, nil)
+		if err != nil {
+			return response.InternalError(err)
+		}
+
+		return operations.OperationResponse(op)
+	}
+
 	snapshot := func(op *operations.Operation) error {
 		args := db.InstanceArgs{
 			Project:      inst.Project(),
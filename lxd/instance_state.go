@@ -12,11 +12,24 @@ import (
 	"github.com/lxc/lxd/lxd/db"
 	"github.com/lxc/lxd/lxd/instance"
 	"github.com/lxc/lxd/lxd/operations"
+	projecthelpers "github.com/lxc/lxd/lxd/project"
 	"github.com/lxc/lxd/lxd/response"
 	"github.com/lxc/lxd/shared"
 	"github.com/lxc/lxd/shared/api"
 )
 
+// instanceRebooter is implemented by instances which can reboot without a full stop and start.
+type instanceRebooter interface {
+	Reboot(timeout time.Duration) error
+}
+
+// instanceConfigRollbacker is implemented by instances which can restore the configuration they last
+// started successfully with.
+type instanceConfigRollbacker interface {
+	LastGoodConfig() (db.InstanceArgs, error)
+	RollbackConfig() error
+}
+
 func containerState(d *Daemon, r *http.Request) response.Response {
 	instanceType, err := urlInstanceTypeDetect(r)
 	if err != nil {
@@ -177,6 +190,12 @@ func containerStatePut(d *Daemon, r *http.Request) response.Response {
 					return fmt.Errorf("Instance is not running")
 				}
 
+				// Virtual machines can reboot without going through a full stop and start.
+				rebooter, ok := c.(instanceRebooter)
+				if ok {
+					return rebooter.Reboot(time.Duration(raw.Timeout) * time.Second)
+				}
+
 				err = c.Shutdown(time.Duration(raw.Timeout) * time.Second)
 				if err != nil {
 					return err
@@ -210,6 +229,36 @@ func containerStatePut(d *Daemon, r *http.Request) response.Response {
 			c.SetOperation(op)
 			return c.Unfreeze()
 		}
+	case shared.RollbackConfig:
+		rollbacker, ok := c.(instanceConfigRollbacker)
+		if !ok {
+			return response.BadRequest(fmt.Errorf("Instances of type %q don't record a configuration to roll back to", c.Type()))
+		}
+
+		args, err := rollbacker.LastGoodConfig()
+		if err != nil {
+			return response.BadRequest(err)
+		}
+
+		// Check project limits, as rolling back is an update of the instance.
+		req := api.InstancePut{
+			Config:   args.Config,
+			Devices:  args.Devices.CloneNative(),
+			Profiles: args.Profiles,
+		}
+
+		err = d.cluster.Transaction(func(tx *db.ClusterTx) error {
+			return projecthelpers.AllowInstanceUpdate(tx, project, name, req, c.LocalConfig())
+		})
+		if err != nil {
+			return response.SmartError(err)
+		}
+
+		opType = db.OperationContainerUpdate
+		do = func(op *operations.Operation) error {
+			c.SetOperation(op)
+			return rollbacker.RollbackConfig()
+		}
 	default:
 		return response.BadRequest(fmt.Errorf("unknown action %s", raw.Action))
 	}
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/suite"
 
@@ -384,6 +386,60 @@ func (suite *containerTestSuite) TestContainer_findIdmap_maxed() {
 	}
 }
 
+func (suite *containerTestSuite) TestExpiredInstanceSnapshots_VM() {
+	state := suite.d.State()
+
+	for _, name := range []string{"testVM", "testProtectedVM"} {
+		args := db.InstanceArgs{
+			Type:      instancetype.VM,
+			Ephemeral: false,
+			Name:      name,
+		}
+
+		if name == "testProtectedVM" {
+			args.Config = map[string]string{"security.protection.delete": "true"}
+		}
+
+		vm, err := instanceCreateInternal(state, args)
+		suite.Req.Nil(err)
+		defer vm.Delete()
+
+		for i, expiry := range []time.Time{time.Now().Add(-time.Minute), time.Now().Add(time.Hour), {}} {
+			snap, err := instanceCreateInternal(state, db.InstanceArgs{
+				Type:       instancetype.VM,
+				Snapshot:   true,
+				Name:       fmt.Sprintf("%s%ssnap%d", name, shared.SnapshotDelimiter, i),
+				ExpiryDate: expiry,
+			})
+			suite.Req.Nil(err)
+			defer snap.Delete()
+		}
+	}
+
+	instances, err := instance.LoadNodeAll(state, instancetype.Any)
+	suite.Req.Nil(err)
+
+	// Only the expired snapshot of the unprotected VM is pruned.
+	expired := expiredInstanceSnapshots(instances, time.Now())
+	suite.Req.Len(expired, 1)
+	suite.Equal("testVM/snap0", expired[0].Name())
+
+	err = pruneExpiredContainerSnapshots(context.Background(), suite.d, expired)
+	suite.Req.Nil(err)
+
+	vm, err := instance.LoadByProjectAndName(state, "default", "testVM")
+	suite.Req.Nil(err)
+
+	snapshots, err := vm.Snapshots()
+	suite.Req.Nil(err)
+	suite.Len(snapshots, 2)
+
+	// The next sweep has nothing left to prune.
+	instances, err = instance.LoadNodeAll(state, instancetype.Any)
+	suite.Req.Nil(err)
+	suite.Len(expiredInstanceSnapshots(instances, time.Now()), 0)
+}
+
 func TestContainerTestSuite(t *testing.T) {
 	suite.Run(t, new(containerTestSuite))
 }
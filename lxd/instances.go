@@ -69,6 +69,17 @@ var instanceFileCmd = APIEndpoint{
 	Delete: APIEndpointAction{Handler: containerFileHandler, AccessHandler: AllowProjectPermission("containers", "operate-containers")},
 }
 
+var instanceFileTreeCmd = APIEndpoint{
+	Name: "instanceFileTree",
+	Path: "instances/{name}/files/tree",
+	Aliases: []APIEndpointAlias{
+		{Name: "vmFileTree", Path: "virtual-machines/{name}/files/tree"},
+	},
+
+	Get:  APIEndpointAction{Handler: instanceFileTreeHandler, AccessHandler: AllowProjectPermission("containers", "operate-containers")},
+	Post: APIEndpointAction{Handler: instanceFileTreeHandler, AccessHandler: AllowProjectPermission("containers", "operate-containers")},
+}
+
 var instanceSnapshotsCmd = APIEndpoint{
 	Name: "instanceSnapshots",
 	Path: "instances/{name}/snapshots",
@@ -257,6 +268,11 @@ func vmMonitor(s *state.State) error {
 	for _, inst := range insts {
 		// Retrieve running state, this will re-connect to QMP
 		inst.IsRunning()
+
+		vm, ok := inst.(instance.VM)
+		if ok {
+			vm.Reattach()
+		}
 	}
 
 	return nil
@@ -726,22 +726,39 @@ func containersPost(d *Daemon, r *http.Request) response.Response {
 	targetNode := queryParam(r, "target")
 	if targetNode == "" {
 		// If no target node was specified, pick the node with the
-		// least number of containers. If there's just one node, or if
-		// the selected node is the local one, this is effectively a
-		// no-op, since NodeWithLeastContainers() will return an empty
-		// string.
+		// least number of containers, honouring the placement hints of
+		// the instance. If there's just one node, or if the selected
+		// node is the local one, this is effectively a no-op.
 		architectures, err := instance.SuitableArchitectures(d.State(), project, req)
 		if err != nil {
 			return response.BadRequest(err)
 		}
+
+		// Placement hints may come from the profiles the instance is created with.
+		profileNames := req.Profiles
+		if profileNames == nil {
+			profileNames = []string{"default"}
+		}
+
+		profiles, err := d.cluster.ProfilesGet(project, profileNames)
+		if err != nil {
+			return response.SmartError(err)
+		}
+
+		placement := instancePlacement(project, db.ProfilesExpandConfig(req.Config, profiles))
+		satisfied := true
 		err = d.cluster.Transaction(func(tx *db.ClusterTx) error {
 			var err error
-			targetNode, err = tx.NodeWithLeastContainers(architectures)
+			targetNode, satisfied, err = tx.NodeForPlacement(architectures, placement)
 			return err
 		})
 		if err != nil {
 			return response.SmartError(err)
 		}
+
+		if !satisfied {
+			logger.Warn("No node available away from the anti-affinity instances", log.Ctx{"project": project, "instance": req.Name, "node": targetNode, "anti_affinity": placement.AntiAffinity})
+		}
 	}
 
 	if targetNode != "" {
@@ -857,6 +874,14 @@ func containersPost(d *Daemon, r *http.Request) response.Response {
 		return response.SmartError(err)
 	}
 
+	// Copies and migrations keep the cloud-init data of their source, only check the one set by the user.
+	if shared.StringInSlice(req.Source.Type, []string{"image", "none"}) {
+		err = instance.ValidCloudInitConfig(nil, req.Config)
+		if err != nil {
+			return response.BadRequest(err)
+		}
+	}
+
 	switch req.Source.Type {
 	case "image":
 		return createFromImage(d, project, &req)
@@ -1012,3 +1037,25 @@ func clusterCopyContainerInternal(d *Daemon, source instance.Instance, project s
 	// Run the migration
 	return createFromMigration(d, project, req)
 }
+
+// instancePlacement returns the hints for placing an instance of the project on a cluster node,
+// from the placement.affinity and placement.anti_affinity keys of its config.
+func instancePlacement(project string, config map[string]string) db.NodePlacement {
+	names := func(value string) []string {
+		result := []string{}
+		for _, name := range strings.Split(value, ",") {
+			name = strings.TrimSpace(name)
+			if name != "" {
+				result = append(result, name)
+			}
+		}
+
+		return result
+	}
+
+	return db.NodePlacement{
+		Project:      project,
+		Affinity:     names(config["placement.affinity"]),
+		AntiAffinity: names(config["placement.anti_affinity"]),
+	}
+}
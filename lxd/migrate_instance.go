@@ -31,6 +31,11 @@ import (
 )
 
 func NewMigrationSource(inst instance.Instance, stateful bool, instanceOnly bool) (*migrationSourceWs, error) {
+	// The paused state of a VM would be lost on the target, refuse to migrate it.
+	if inst.Type() == instancetype.VM && inst.IsFrozen() {
+		return nil, fmt.Errorf("Unable to migrate a paused virtual machine")
+	}
+
 	ret := migrationSourceWs{migrationFields{instance: inst}, make(chan bool, 1)}
 	ret.instanceOnly = instanceOnly
 
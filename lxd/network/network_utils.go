@@ -256,22 +256,12 @@ func UpdateDNSMasqStatic(s *state.State, networkName string) error {
 				entries[d["parent"]] = [][]string{}
 			}
 
-			if (shared.IsTrue(d["security.ipv4_filtering"]) && d["ipv4.address"] == "") || (shared.IsTrue(d["security.ipv6_filtering"]) && d["ipv6.address"] == "") {
-				curIPv4, curIPv6, err := dnsmasq.DHCPStaticIPs(d["parent"], inst.Project(), inst.Name())
-				if err != nil && !os.IsNotExist(err) {
-					return err
-				}
-
-				if d["ipv4.address"] == "" && curIPv4.IP != nil {
-					d["ipv4.address"] = curIPv4.IP.String()
-				}
-
-				if d["ipv6.address"] == "" && curIPv6.IP != nil {
-					d["ipv6.address"] = curIPv6.IP.String()
-				}
+			ipv4Address, ipv6Address, err := dnsmasq.StaticAllocation(d["parent"], inst.Project(), inst.Name(), d)
+			if err != nil {
+				return err
 			}
 
-			entries[d["parent"]] = append(entries[d["parent"]], []string{d["hwaddr"], inst.Project(), inst.Name(), d["ipv4.address"], d["ipv6.address"]})
+			entries[d["parent"]] = append(entries[d["parent"]], []string{d["hwaddr"], inst.Project(), inst.Name(), ipv4Address, ipv6Address})
 		}
 	}
 
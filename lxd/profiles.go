@@ -110,6 +110,11 @@ func profilesPost(d *Daemon, r *http.Request) response.Response {
 		return response.BadRequest(err)
 	}
 
+	err = instance.ValidCloudInitConfig(nil, req.Config)
+	if err != nil {
+		return response.BadRequest(err)
+	}
+
 	// At this point we don't know the instance type, so just use instancetype.Any type for validation.
 	err = instance.ValidDevices(d.State(), d.cluster, instancetype.Any, deviceConfig.NewDevices(req.Devices), false)
 	if err != nil {
@@ -30,6 +30,11 @@ func doProfileUpdate(d *Daemon, project, name string, id int64, profile *api.Pro
 		return err
 	}
 
+	err = instance.ValidCloudInitConfig(profile.Config, req.Config)
+	if err != nil {
+		return err
+	}
+
 	// At this point we don't know the instance type, so just use instancetype.Any type for validation.
 	err = instance.ValidDevices(d.State(), d.cluster, instancetype.Any, deviceConfig.NewDevices(req.Devices), false)
 	if err != nil {
@@ -37,14 +37,23 @@ func AllowInstanceCreation(tx *db.ClusterTx, projectName string, req api.Instanc
 		return fmt.Errorf("Unexpected instance type '%s'", instanceType)
 	}
 
-	err = checkInstanceCountLimit(project, len(instances), instanceType)
+	instanceCount := 0
+	for _, instance := range instances {
+		if instance.Type == instanceType {
+			instanceCount++
+		}
+	}
+
+	err = checkInstanceCountLimit(project, instanceCount, instanceType)
 	if err != nil {
 		return err
 	}
 
 	// Add the instance being created.
 	instances = append(instances, db.Instance{
+		Project:  projectName,
 		Name:     req.Name,
+		Type:     instanceType,
 		Profiles: req.Profiles,
 		Config:   req.Config,
 	})
@@ -64,6 +73,64 @@ func AllowInstanceCreation(tx *db.ClusterTx, projectName string, req api.Instanc
 	return nil
 }
 
+// AllowInstanceStart returns an error if starting the given instance would
+// make the running instances of the project exceed its limits.memory or
+// limits.cpu.
+func AllowInstanceStart(tx *db.ClusterTx, projectName string, instanceName string) error {
+	project, profiles, instances, err := fetchProject(tx, projectName, true)
+	if err != nil {
+		return err
+	}
+
+	if project == nil {
+		return nil
+	}
+
+	aggregateKeys := []string{}
+	for _, key := range []string{"limits.memory", "limits.cpu"} {
+		if project.Config[key] != "" {
+			aggregateKeys = append(aggregateKeys, key)
+		}
+	}
+
+	if len(aggregateKeys) == 0 {
+		return nil
+	}
+
+	// Only account for the instances which are running, along with the one
+	// being started.
+	running := []db.Instance{}
+	for _, instance := range instances {
+		if instance.Name == instanceName || instance.Config["volatile.last_state.power"] == "RUNNING" {
+			running = append(running, instance)
+		}
+	}
+
+	running = expandInstancesConfigAndDevices(running, profiles)
+
+	totals, err := getTotalsAcrossInstances(running, aggregateKeys)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range aggregateKeys {
+		parser := aggregateLimitConfigValueParsers[key]
+		max, err := parser(project.Config[key])
+		if err != nil {
+			return err
+		}
+
+		if totals[key] > max {
+			printer := aggregateLimitConfigValuePrinters[key]
+			return fmt.Errorf(
+				"Starting instance %s would exceed %q of project %s: running instances would use %s out of %s",
+				instanceName, key, project.Name, printer(totals[key]), project.Config[key])
+		}
+	}
+
+	return nil
+}
+
 // Check that we have not reached the maximum number of instances for
 // this type.
 func checkInstanceCountLimit(project *api.Project, instanceCount int, instanceType instancetype.Type) error {
@@ -271,6 +338,14 @@ func checkRestrictions(project *api.Project, instances []db.Instance, profiles [
 					return fmt.Errorf("Unix hotplug devices are forbidden")
 				}
 
+				return nil
+			}
+		case "restricted.devices.serial":
+			devicesChecks["serial"] = func(device map[string]string) error {
+				if restrictionValue != "allow" {
+					return fmt.Errorf("Serial devices are forbidden")
+				}
+
 				return nil
 			}
 		case "restricted.devices.infiniband":
@@ -431,6 +506,7 @@ var AllRestrictions = []string{
 	"restricted.devices.unix-char",
 	"restricted.devices.unix-block",
 	"restricted.devices.unix-hotplug",
+	"restricted.devices.serial",
 	"restricted.devices.infiniband",
 	"restricted.devices.gpu",
 	"restricted.devices.usb",
@@ -446,6 +522,7 @@ var defaultRestrictionsValues = map[string]string{
 	"restricted.devices.unix-char":         "block",
 	"restricted.devices.unix-block":        "block",
 	"restricted.devices.unix-hotplug":      "block",
+	"restricted.devices.serial":            "block",
 	"restricted.devices.infiniband":        "block",
 	"restricted.devices.gpu":               "block",
 	"restricted.devices.usb":               "block",
@@ -480,8 +557,15 @@ func isContainerLowLevelOptionForbidden(key string) bool {
 func isVMLowLevelOptionForbidden(key string) bool {
 	if shared.StringInSlice(key, []string{
 		"boot.host_shutdown_timeout",
+		"boot.ipxe_rom",
 		"limits.memory.hugepages",
 		"raw.qemu",
+		"raw.qemu.cmdline",
+		"raw.qemu.debug",
+		"raw.qemu.initrd",
+		"raw.qemu.kernel",
+		"security.sandbox",
+		"security.sandbox.allow",
 	}) {
 		return true
 	}
@@ -786,6 +870,14 @@ func getInstanceLimits(instance db.Instance, keys []string) (map[string]int64, e
 
 	for _, key := range keys {
 		value, ok := instance.Config[key]
+
+		// Virtual machines always get some memory and CPUs, so account for
+		// the defaults they start with.
+		if (!ok || value == "") && instance.Type == instancetype.VM && vmAggregateLimitDefaults[key] != "" {
+			value = vmAggregateLimitDefaults[key]
+			ok = true
+		}
+
 		if !ok || value == "" {
 			return nil, fmt.Errorf(
 				"Instance %s in project %s has no '%s' config, either directly or via a profile",
@@ -806,6 +898,12 @@ func getInstanceLimits(instance db.Instance, keys []string) (map[string]int64, e
 	return limits, nil
 }
 
+// The values virtual machines default to for the aggregate limits.
+var vmAggregateLimitDefaults = map[string]string{
+	"limits.memory": "1GiB",
+	"limits.cpu":    "1",
+}
+
 var aggregateLimitConfigValueParsers = map[string]func(string) (int64, error){
 	"limits.memory": func(value string) (int64, error) {
 		if strings.HasSuffix(value, "%") {
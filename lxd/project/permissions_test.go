@@ -1,6 +1,7 @@
 package project_test
 
 import (
+	"fmt"
 	"testing"
 
 	"github.com/lxc/lxd/lxd/db"
@@ -124,3 +125,165 @@ func TestAllowInstanceCreation_DifferentType(t *testing.T) {
 	err = project.AllowInstanceCreation(tx, "p1", req)
 	assert.NoError(t, err)
 }
+
+// The limit on the number of virtual machines only counts virtual machines.
+func TestAllowInstanceCreation_VMCount(t *testing.T) {
+	tx, cleanup := db.NewTestClusterTx(t)
+	defer cleanup()
+
+	_, err := tx.ProjectCreate(api.ProjectsPost{
+		Name: "p1",
+		ProjectPut: api.ProjectPut{
+			Config: map[string]string{
+				"limits.virtual-machines": "1",
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	_, err = tx.InstanceCreate(db.Instance{
+		Project:      "p1",
+		Name:         "c1",
+		Type:         instancetype.Container,
+		Architecture: 1,
+		Node:         "none",
+	})
+	require.NoError(t, err)
+
+	req := api.InstancesPost{
+		Name: "vm1",
+		Type: api.InstanceTypeVM,
+	}
+
+	err = project.AllowInstanceCreation(tx, "p1", req)
+	assert.NoError(t, err)
+
+	_, err = tx.InstanceCreate(db.Instance{
+		Project:      "p1",
+		Name:         "vm1",
+		Type:         instancetype.VM,
+		Architecture: 1,
+		Node:         "none",
+	})
+	require.NoError(t, err)
+
+	req.Name = "vm2"
+	err = project.AllowInstanceCreation(tx, "p1", req)
+	assert.EqualError(t, err, "Reached maximum number of instances of type virtual-machine in project p1")
+}
+
+// Virtual machines without limits.memory account for the memory they get by
+// default.
+func TestAllowInstanceCreation_VMMemory(t *testing.T) {
+	tx, cleanup := db.NewTestClusterTx(t)
+	defer cleanup()
+
+	_, err := tx.ProjectCreate(api.ProjectsPost{
+		Name: "p1",
+		ProjectPut: api.ProjectPut{
+			Config: map[string]string{
+				"limits.memory": "2GiB",
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	_, err = tx.InstanceCreate(db.Instance{
+		Project:      "p1",
+		Name:         "vm1",
+		Type:         instancetype.VM,
+		Architecture: 1,
+		Node:         "none",
+	})
+	require.NoError(t, err)
+
+	req := api.InstancesPost{
+		Name: "vm2",
+		Type: api.InstanceTypeVM,
+		InstancePut: api.InstancePut{
+			Config: map[string]string{"limits.memory": "1GiB"},
+		},
+	}
+
+	err = project.AllowInstanceCreation(tx, "p1", req)
+	assert.NoError(t, err)
+
+	req.Config["limits.memory"] = "2GiB"
+	err = project.AllowInstanceCreation(tx, "p1", req)
+	assert.EqualError(t, err, `Reached maximum aggregate value 2GiB for "limits.memory" in project p1`)
+}
+
+// Low-level VM options reading host files are forbidden in restricted projects.
+func TestAllowInstanceCreation_VMLowLevel(t *testing.T) {
+	tx, cleanup := db.NewTestClusterTx(t)
+	defer cleanup()
+
+	_, err := tx.ProjectCreate(api.ProjectsPost{
+		Name: "p1",
+		ProjectPut: api.ProjectPut{
+			Config: map[string]string{
+				"restricted": "true",
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	for _, key := range []string{"raw.qemu.kernel", "raw.qemu.initrd", "raw.qemu.debug", "boot.ipxe_rom", "security.sandbox", "security.sandbox.allow"} {
+		req := api.InstancesPost{
+			Name: "vm1",
+			Type: api.InstanceTypeVM,
+			InstancePut: api.InstancePut{
+				Config: map[string]string{key: "/etc/shadow"},
+			},
+		}
+
+		err = project.AllowInstanceCreation(tx, "p1", req)
+		assert.EqualError(t, err, fmt.Sprintf(`Use of low-level config %q on virtual machine "vm1" of project "p1" is forbidden`, key))
+	}
+}
+
+// Starting a virtual machine only accounts for the instances which are
+// running.
+func TestAllowInstanceStart(t *testing.T) {
+	tx, cleanup := db.NewTestClusterTx(t)
+	defer cleanup()
+
+	_, err := tx.ProjectCreate(api.ProjectsPost{
+		Name: "p1",
+		ProjectPut: api.ProjectPut{
+			Config: map[string]string{
+				"limits.cpu":    "4",
+				"limits.memory": "4GiB",
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	instances := map[string]map[string]string{
+		"vm1": {"limits.cpu": "2", "volatile.last_state.power": "RUNNING"},
+		"vm2": {"limits.cpu": "2"},
+		"vm3": {"limits.cpu": "3"},
+		"vm4": {"limits.memory": "4GiB"},
+	}
+
+	for name, config := range instances {
+		_, err = tx.InstanceCreate(db.Instance{
+			Project:      "p1",
+			Name:         name,
+			Type:         instancetype.VM,
+			Architecture: 1,
+			Node:         "none",
+			Config:       config,
+		})
+		require.NoError(t, err)
+	}
+
+	err = project.AllowInstanceStart(tx, "p1", "vm2")
+	assert.NoError(t, err)
+
+	err = project.AllowInstanceStart(tx, "p1", "vm3")
+	assert.EqualError(t, err, `Starting instance vm3 would exceed "limits.cpu" of project p1: running instances would use 5 out of 4`)
+
+	err = project.AllowInstanceStart(tx, "p1", "vm4")
+	assert.EqualError(t, err, `Starting instance vm4 would exceed "limits.memory" of project p1: running instances would use 5.4GB out of 4GiB`)
+}
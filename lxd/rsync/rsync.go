@@ -18,8 +18,8 @@ import (
 	"github.com/lxc/lxd/shared/logger"
 )
 
-// LocalCopy copies a directory using rsync (with the --devices option).
-func LocalCopy(source string, dest string, bwlimit string, xattrs bool) (string, error) {
+// LocalCopy copies a directory using rsync (with the --devices option), passing any extra rsyncArgs.
+func LocalCopy(source string, dest string, bwlimit string, xattrs bool, rsyncArgs ...string) (string, error) {
 	err := os.MkdirAll(dest, 0755)
 	if err != nil {
 		return "", err
@@ -52,6 +52,8 @@ func LocalCopy(source string, dest string, bwlimit string, xattrs bool) (string,
 		args = append(args, "--bwlimit", bwlimit)
 	}
 
+	args = append(args, rsyncArgs...)
+
 	args = append(args,
 		rsyncVerbosity,
 		shared.AddSlash(source),
@@ -884,7 +884,7 @@ func (b *lxdBackend) imageFiller(fingerprint string, op *operations.Operation) f
 				}}
 		}
 		imageFile := shared.VarPath("images", fingerprint)
-		return ImageUnpack(imageFile, mountPath, rootBlockPath, b.driver.Info().BlockBacking, b.state.OS.RunningInUserNS, tracker)
+		return ImageUnpack(imageFile, mountPath, rootBlockPath, b.driver.Info().BlockBacking, b.state.OS.RunningInUserNS, b.state.OS.Architectures, tracker)
 	}
 }
 
@@ -920,9 +920,12 @@ func (b *lxdBackend) CreateInstanceFromImage(inst instance.Instance, fingerprint
 
 	vol := b.newVolume(volType, contentType, volStorageName, rootDiskConf)
 
+	// VM root disks on dir pools set to use qcow2 are overlays over the disk of an image volume.
+	overlay := vol.IsVMBlock() && vol.ExpandedConfig("dir.block_format") == "qcow2"
+
 	// If the driver doesn't support optimized image volumes then create a new empty volume and
 	// populate it with the contents of the image archive.
-	if !b.driver.Info().OptimizedImages {
+	if !b.driver.Info().OptimizedImages && !overlay {
 		volFiller := drivers.VolumeFiller{
 			Fingerprint: fingerprint,
 			Fill:        b.imageFiller(fingerprint, op),
@@ -936,7 +939,7 @@ func (b *lxdBackend) CreateInstanceFromImage(inst instance.Instance, fingerprint
 		// If the driver does support optimized images then ensure the optimized image
 		// volume has been created for the archive's fingerprint and then proceed to create
 		// a new volume by copying the optimized image volume.
-		err := b.EnsureImage(fingerprint, op)
+		err := b.ensureImageVolume(fingerprint, op)
 		if err != nil {
 			return err
 		}
@@ -1454,13 +1457,16 @@ func (b *lxdBackend) GetInstanceUsage(inst instance.Instance) (int64, error) {
 
 // SetInstanceQuota sets the quota on the instance's root volume.
 // Returns ErrRunningQuotaResizeNotSupported if the instance is running and the storage driver
-// doesn't support resizing whilst the instance is running.
+// doesn't support resizing whilst the instance is running, or its root disk is a qcow2 overlay.
 func (b *lxdBackend) SetInstanceQuota(inst instance.Instance, size string, op *operations.Operation) error {
 	logger := logging.AddContext(b.logger, log.Ctx{"project": inst.Project(), "instance": inst.Name()})
 	logger.Debug("SetInstanceQuota started")
 	defer logger.Debug("SetInstanceQuota finished")
 
-	if inst.IsRunning() && !b.driver.Info().RunningQuotaResize {
+	contentVolume := InstanceContentType(inst)
+
+	// Block volumes can be grown whilst in use by a VM, only filesystems may need to be unmounted.
+	if inst.IsRunning() && contentVolume != drivers.ContentTypeBlock && !b.driver.Info().RunningQuotaResize {
 		return ErrRunningQuotaResizeNotSupported
 	}
 
@@ -1470,13 +1476,24 @@ func (b *lxdBackend) SetInstanceQuota(inst instance.Instance, size string, op *o
 		return err
 	}
 
-	contentVolume := InstanceContentType(inst)
 	volStorageName := project.Instance(inst.Project(), inst.Name())
 
 	// Get the volume.
 	// There's no need to pass config as it's not needed when setting quotas.
 	vol := b.newVolume(volType, contentVolume, volStorageName, nil)
 
+	// A qcow2 overlay is locked by the running qemu, it's resized on next start.
+	if inst.IsRunning() && contentVolume == drivers.ContentTypeBlock {
+		diskPath, err := b.driver.GetVolumeDiskPath(vol)
+		if err != nil {
+			return err
+		}
+
+		if drivers.BlockFileFormat(diskPath) == "qcow2" {
+			return ErrRunningQuotaResizeNotSupported
+		}
+	}
+
 	return b.driver.SetVolumeQuota(vol, size, op)
 }
 
@@ -1923,6 +1940,14 @@ func (b *lxdBackend) EnsureImage(fingerprint string, op *operations.Operation) e
 		return nil // Nothing to do for drivers that don't support optimized images volumes.
 	}
 
+	return b.ensureImageVolume(fingerprint, op)
+}
+
+// ensureImageVolume creates the volume of the image if it doesn't already exist. This is also used by
+// drivers without optimized images to create the base of qcow2 overlays.
+func (b *lxdBackend) ensureImageVolume(fingerprint string, op *operations.Operation) error {
+	logger := logging.AddContext(b.logger, log.Ctx{"fingerprint": fingerprint})
+
 	// We need to lock this operation to ensure that the image is not being created multiple times.
 	// Uses a lock name of "EnsureImage_<fingerprint>" to avoid deadlocking with CreateVolume below that also
 	// establishes a lock on the volume type & name if it needs to mount the volume before filling.
@@ -152,7 +152,7 @@ func (d *btrfs) deleteSubvolume(path string, recursion bool) error {
 	// Single subvolume deletion.
 	destroy := func(path string) error {
 		// Attempt (but don't fail on) to delete any qgroup on the subvolume.
-		qgroup, _, err := d.getQGroup(path)
+		qgroup, _, _, err := d.getQGroup(path)
 		if err == nil {
 			shared.RunCommand("btrfs", "qgroup", "destroy", qgroup, path)
 		}
@@ -192,16 +192,26 @@ func (d *btrfs) deleteSubvolume(path string, recursion bool) error {
 	return nil
 }
 
-func (d *btrfs) getQGroup(path string) (string, int64, error) {
+// getQGroup returns the qgroup of a subvolume, along with how much data the subvolume references and how
+// much of it isn't shared with other subvolumes, such as its snapshots.
+func (d *btrfs) getQGroup(path string) (string, int64, int64, error) {
 	// Try to get the qgroup details.
 	output, err := shared.RunCommand("btrfs", "qgroup", "show", "-e", "-f", path)
 	if err != nil {
-		return "", -1, errBtrfsNoQuota
+		return "", -1, -1, errBtrfsNoQuota
 	}
 
-	// Parse to extract the qgroup identifier.
-	var qgroup string
-	usage := int64(-1)
+	qgroup, referenced, exclusive := btrfsParseQGroup(output)
+	if qgroup == "" {
+		return "", -1, -1, errBtrfsNoQGroup
+	}
+
+	return qgroup, referenced, exclusive, nil
+}
+
+// btrfsParseQGroup extracts the qgroup identifier and its referenced and exclusive usage from the output
+// of "btrfs qgroup show -e -f". The usage is -1 when it can't be parsed.
+func btrfsParseQGroup(output string) (string, int64, int64) {
 	for _, line := range strings.Split(output, "\n") {
 		if line == "" || strings.HasPrefix(line, "qgroupid") || strings.HasPrefix(line, "---") {
 			continue
@@ -212,20 +222,20 @@ func (d *btrfs) getQGroup(path string) (string, int64, error) {
 			continue
 		}
 
-		qgroup = fields[0]
-		val, err := strconv.ParseInt(fields[2], 10, 64)
-		if err == nil {
-			usage = val
+		referenced, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			referenced = -1
 		}
 
-		break
-	}
+		exclusive, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			exclusive = -1
+		}
 
-	if qgroup == "" {
-		return "", -1, errBtrfsNoQGroup
+		return fields[0], referenced, exclusive
 	}
 
-	return qgroup, usage, nil
+	return "", -1, -1
 }
 
 func (d *btrfs) sendSubvolume(path string, parent string, conn io.ReadWriteCloser, tracker *ioprogress.ProgressTracker) error {
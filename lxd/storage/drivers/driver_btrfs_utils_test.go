@@ -0,0 +1,30 @@
+package drivers
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_btrfsParseQGroup(t *testing.T) {
+	// A snapshot shares all of a VM's disk image with the VM, leaving it with little exclusive data.
+	output := `qgroupid         rfer         excl     max_excl 
+--------         ----         ----     -------- 
+0/257      1073885184        16384         none 
+`
+
+	qgroup, referenced, exclusive := btrfsParseQGroup(output)
+	assert.Equal(t, "0/257", qgroup)
+	assert.Equal(t, int64(1073885184), referenced)
+	assert.Equal(t, int64(16384), exclusive)
+
+	// Unparsable usage.
+	qgroup, referenced, exclusive = btrfsParseQGroup("0/258 1.00GiB 16.00KiB none\n")
+	assert.Equal(t, "0/258", qgroup)
+	assert.Equal(t, int64(-1), referenced)
+	assert.Equal(t, int64(-1), exclusive)
+
+	// No qgroup.
+	qgroup, _, _ = btrfsParseQGroup("qgroupid rfer excl max_excl\n-------- ---- ---- --------\n")
+	assert.Equal(t, "", qgroup)
+}
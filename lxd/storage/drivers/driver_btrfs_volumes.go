@@ -391,7 +391,7 @@ func (d *btrfs) UpdateVolume(vol Volume, changedConfig map[string]string) error
 // GetVolumeUsage returns the disk space used by the volume.
 func (d *btrfs) GetVolumeUsage(vol Volume) (int64, error) {
 	// Attempt to get the qgroup information.
-	_, usage, err := d.getQGroup(vol.MountPath())
+	_, referenced, exclusive, err := d.getQGroup(vol.MountPath())
 	if err != nil {
 		if err == errBtrfsNoQuota {
 			return 0, nil
@@ -400,7 +400,18 @@ func (d *btrfs) GetVolumeUsage(vol Volume) (int64, error) {
 		return -1, err
 	}
 
-	return usage, nil
+	return btrfsVolumeUsage(vol, referenced, exclusive), nil
+}
+
+// btrfsVolumeUsage returns the usage of a volume out of the data its subvolume references and the data
+// exclusive to it. The disk image of a block volume is shared with its snapshots until it's written to,
+// so only counting its exclusive data would have its usage drop with each snapshot.
+func btrfsVolumeUsage(vol Volume, referenced int64, exclusive int64) int64 {
+	if vol.contentType == ContentTypeBlock {
+		return referenced
+	}
+
+	return exclusive
 }
 
 // SetVolumeQuota sets the quota on the volume.
@@ -443,7 +454,7 @@ func (d *btrfs) SetVolumeQuota(vol Volume, size string, op *operations.Operation
 	}
 
 	// Try to locate an existing quota group.
-	qgroup, _, err := d.getQGroup(volPath)
+	qgroup, _, _, err := d.getQGroup(volPath)
 	if err != nil && !d.state.OS.RunningInUserNS {
 		// If quotas are disabled, attempt to enable them.
 		if err == errBtrfsNoQuota {
@@ -455,7 +466,7 @@ func (d *btrfs) SetVolumeQuota(vol Volume, size string, op *operations.Operation
 			}
 
 			// Try again.
-			qgroup, _, err = d.getQGroup(volPath)
+			qgroup, _, _, err = d.getQGroup(volPath)
 		}
 
 		// If there's no qgroup, attempt to create one.
@@ -487,7 +498,7 @@ func (d *btrfs) SetVolumeQuota(vol Volume, size string, op *operations.Operation
 			}
 
 			// Try to get the qgroup again.
-			qgroup, _, err = d.getQGroup(volPath)
+			qgroup, _, _, err = d.getQGroup(volPath)
 		}
 
 		if err != nil {
@@ -0,0 +1,32 @@
+package drivers
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_btrfsVolumeUsage(t *testing.T) {
+	tests := []struct {
+		name string
+		vol  Volume
+		want int64
+	}{
+		{
+			"Filesystem volume, not counting the data shared with its snapshots",
+			NewVolume(nil, "testpool", VolumeTypeContainer, ContentTypeFS, "testvol", nil, nil),
+			16384,
+		},
+		{
+			"VM block volume, counting the disk image shared with its snapshots",
+			NewVolume(nil, "testpool", VolumeTypeVM, ContentTypeBlock, "testvol", nil, nil),
+			1073885184,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, btrfsVolumeUsage(tt.vol, 1073885184, 16384))
+		})
+	}
+}
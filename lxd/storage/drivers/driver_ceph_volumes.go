@@ -678,6 +678,43 @@ func (d *ceph) SetVolumeQuota(vol Volume, size string, op *operations.Operation)
 		return err
 	}
 
+	// Block volumes hold no filesystem of ours to resize, only grow the RBD device to the new size.
+	if vol.contentType == ContentTypeBlock {
+		f, err := os.Open(RBDDevPath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		// The size of block devices is only found by seeking to their end.
+		oldSize, err = f.Seek(0, io.SeekEnd)
+		if err != nil {
+			return err
+		}
+
+		if newSize == 0 || newSize == oldSize {
+			return nil
+		}
+
+		if newSize < oldSize {
+			return fmt.Errorf("You cannot shrink block volumes")
+		}
+
+		_, err = shared.TryRunCommand(
+			"rbd",
+			"resize",
+			"--id", d.config["ceph.user.name"],
+			"--cluster", d.config["ceph.cluster_name"],
+			"--pool", d.config["ceph.osd.pool_name"],
+			"--size", fmt.Sprintf("%dM", (newSize/1024/1024)),
+			d.getRBDVolumeName(vol, "", false, false))
+		if err != nil {
+			return err
+		}
+
+		return nil
+	}
+
 	// The right disjunct just means that someone unset the size property in
 	// the container's config. We obviously cannot resize to 0.
 	if oldSize == newSize || newSize == 0 {
@@ -99,7 +99,13 @@ func (d *dir) Delete(op *operations.Operation) error {
 
 // Validate checks that all provide keys are supported and that no conflicting or missing configuration is present.
 func (d *dir) Validate(config map[string]string) error {
-	return d.validatePool(config, nil)
+	rules := map[string]func(value string) error{
+		"volume.dir.block_format": func(value string) error {
+			return shared.IsOneOf(value, []string{"raw", "qcow2"})
+		},
+	}
+
+	return d.validatePool(config, rules)
 }
 
 // Update applies any driver changes required from a configuration change.
@@ -3,14 +3,15 @@ package drivers
 import (
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 
 	"github.com/pkg/errors"
 
 	"github.com/lxc/lxd/lxd/migration"
 	"github.com/lxc/lxd/lxd/operations"
 	"github.com/lxc/lxd/lxd/revert"
-	"github.com/lxc/lxd/lxd/rsync"
 	"github.com/lxc/lxd/lxd/storage/quota"
 	"github.com/lxc/lxd/shared"
 	log "github.com/lxc/lxd/shared/log15"
@@ -75,6 +76,14 @@ func (d *dir) CreateVolume(vol Volume, filler *VolumeFiller, op *operations.Oper
 				return err
 			}
 		}
+
+		// Image volumes are only created on dir pools to be the read-only base of qcow2 overlays.
+		if vol.volType == VolumeTypeImage {
+			err = os.Chmod(rootBlockPath, 0444)
+			if err != nil {
+				return err
+			}
+		}
 	}
 
 	revert.Success()
@@ -123,10 +132,78 @@ func (d *dir) CreateVolumeFromCopy(vol Volume, srcVol Volume, copySnapshots bool
 		}
 	}
 
+	// VM root disks created from an image are qcow2 overlays over its disk when the pool is set to use them.
+	if srcVol.volType == VolumeTypeImage && vol.IsVMBlock() && vol.ExpandedConfig("dir.block_format") == "qcow2" {
+		return d.createVolumeOverlay(vol, srcVol)
+	}
+
 	// Run the generic copy.
 	return genericCopyVolume(d, d.setupInitialQuota, vol, srcVol, srcSnapshots, false, op)
 }
 
+// createVolumeOverlay creates a VM volume from an image volume, with its root disk a qcow2 overlay over the
+// disk of the image. The image's disk is hard linked into the volume as the base of the overlay, so deleting
+// the image volume doesn't affect the instance. Copies and snapshots of the volume copy the overlay and link
+// the same base.
+func (d *dir) createVolumeOverlay(vol Volume, imgVol Volume) error {
+	volPath := vol.MountPath()
+	imgPath := imgVol.MountPath()
+
+	revert := revert.New()
+	defer revert.Fail()
+
+	err := vol.EnsureMountPath()
+	if err != nil {
+		return err
+	}
+	revert.Add(func() { os.RemoveAll(volPath) })
+
+	rootBlockPath, err := d.GetVolumeDiskPath(vol)
+	if err != nil {
+		return err
+	}
+
+	imgBlockPath, err := d.GetVolumeDiskPath(imgVol)
+	if err != nil {
+		return err
+	}
+
+	// Copy the image metadata and templates, everything but its disk.
+	entries, err := ioutil.ReadDir(imgPath)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if entry.Name() == filepath.Base(imgBlockPath) {
+			continue
+		}
+
+		if entry.IsDir() {
+			err = shared.DirCopy(filepath.Join(imgPath, entry.Name()), filepath.Join(volPath, entry.Name()))
+		} else {
+			err = shared.FileCopy(filepath.Join(imgPath, entry.Name()), filepath.Join(volPath, entry.Name()))
+		}
+
+		if err != nil {
+			return errors.Wrapf(err, "Failed copying %q from image volume", entry.Name())
+		}
+	}
+
+	err = os.Link(imgBlockPath, filepath.Join(volPath, blockOverlayBaseName))
+	if err != nil {
+		return errors.Wrapf(err, "Failed linking base of disk image %s", rootBlockPath)
+	}
+
+	err = createBlockOverlay(rootBlockPath, vol.ExpandedConfig("size"))
+	if err != nil {
+		return err
+	}
+
+	revert.Success()
+	return nil
+}
+
 // CreateVolumeFromMigration creates a volume being sent via a migration.
 func (d *dir) CreateVolumeFromMigration(vol Volume, conn io.ReadWriteCloser, volTargetArgs migration.VolumeTargetArgs, preFiller *VolumeFiller, op *operations.Operation) error {
 	if vol.contentType != ContentTypeFS {
@@ -257,6 +334,13 @@ func (d *dir) SetVolumeQuota(vol Volume, size string, op *operations.Operation)
 			size = defaultBlockSize
 		}
 
+		// Root disks created as qcow2 overlays grow their virtual size. The GPT alt header isn't moved as
+		// it's a raw disk operation, guests fix it up when growing their partitions.
+		if BlockFileFormat(rootBlockPath) == "qcow2" {
+			_, err = resizeBlockOverlay(rootBlockPath, size)
+			return err
+		}
+
 		resized, err := genericVFSResizeBlockFile(rootBlockPath, size)
 		if err != nil {
 			return err
@@ -351,7 +435,7 @@ func (d *dir) CreateVolumeSnapshot(snapVol Volume, op *operations.Operation) err
 	bwlimit := d.config["rsync.bwlimit"]
 
 	// Copy volume into snapshot directory.
-	_, err = rsync.LocalCopy(srcPath, snapPath, bwlimit, true)
+	err = blockOverlayLocalCopy(srcPath, snapPath, bwlimit)
 	if err != nil {
 		return err
 	}
@@ -410,7 +494,7 @@ func (d *dir) RestoreVolume(vol Volume, snapshotName string, op *operations.Oper
 
 	// Restore using rsync.
 	bwlimit := d.config["rsync.bwlimit"]
-	_, err := rsync.LocalCopy(srcPath, volPath, bwlimit, true)
+	err := blockOverlayLocalCopy(srcPath, volPath, bwlimit)
 	if err != nil {
 		return errors.Wrap(err, "Failed to rsync volume")
 	}
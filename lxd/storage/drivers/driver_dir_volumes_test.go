@@ -0,0 +1,54 @@
+package drivers
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Test that the dir backend, having no native snapshots, snapshots a VM by copying its disk image.
+func Test_dirCreateVolumeSnapshot_Block(t *testing.T) {
+	_, err := exec.LookPath("rsync")
+	if err != nil {
+		t.Skip("rsync is missing")
+	}
+
+	tmpDir, err := ioutil.TempDir("", "lxd-drivers-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	defer os.Setenv("LXD_DIR", os.Getenv("LXD_DIR"))
+	os.Setenv("LXD_DIR", tmpDir)
+
+	d := &dir{common: common{name: "testpool", config: map[string]string{}}}
+
+	vol := NewVolume(d, "testpool", VolumeTypeVM, ContentTypeBlock, "vm1", nil, nil)
+	require.NoError(t, os.MkdirAll(vol.MountPath(), 0711))
+	require.NoError(t, os.MkdirAll(filepath.Dir(GetVolumeSnapshotDir("testpool", VolumeTypeVM, "vm1")), 0711))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(vol.MountPath(), "root.img"), []byte("disk"), 0600))
+
+	snapVol := NewVolume(d, "testpool", VolumeTypeVM, ContentTypeBlock, "vm1/snap0", nil, nil)
+	require.NoError(t, d.CreateVolumeSnapshot(snapVol, nil))
+
+	// The snapshot holds its own copy of the disk image.
+	info, err := os.Stat(filepath.Join(vol.MountPath(), "root.img"))
+	require.NoError(t, err)
+	snapInfo, err := os.Stat(filepath.Join(snapVol.MountPath(), "root.img"))
+	require.NoError(t, err)
+	assert.False(t, os.SameFile(info, snapInfo))
+
+	content, err := ioutil.ReadFile(filepath.Join(snapVol.MountPath(), "root.img"))
+	require.NoError(t, err)
+	assert.Equal(t, "disk", string(content))
+
+	// Writes to the VM's disk don't reach the snapshot.
+	require.NoError(t, ioutil.WriteFile(filepath.Join(vol.MountPath(), "root.img"), []byte("changed"), 0600))
+	content, err = ioutil.ReadFile(filepath.Join(snapVol.MountPath(), "root.img"))
+	require.NoError(t, err)
+	assert.Equal(t, "disk", string(content))
+}
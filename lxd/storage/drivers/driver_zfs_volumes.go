@@ -727,13 +727,19 @@ func (d *zfs) UpdateVolume(vol Volume, changedConfig map[string]string) error {
 	return nil
 }
 
+// zfsUsageProperty returns the dataset property holding the usage of a volume. Block volumes report the
+// data their zvol references, not including the data of their snapshots, nor the space reserved for them.
+func zfsUsageProperty(vol Volume) string {
+	if vol.contentType == ContentTypeBlock || shared.IsTrue(vol.ExpandedConfig("zfs.use_refquota")) {
+		return "referenced"
+	}
+
+	return "used"
+}
+
 // GetVolumeUsage returns the disk space used by the volume.
 func (d *zfs) GetVolumeUsage(vol Volume) (int64, error) {
-	// Determine what key to use.
-	key := "used"
-	if shared.IsTrue(vol.ExpandedConfig("zfs.use_refquota")) {
-		key = "referenced"
-	}
+	key := zfsUsageProperty(vol)
 
 	// Shortcut for refquota filesystems.
 	if key == "referenced" && vol.contentType == ContentTypeFS && shared.IsMountPoint(vol.MountPath()) {
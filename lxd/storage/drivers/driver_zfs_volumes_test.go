@@ -0,0 +1,42 @@
+package drivers
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_zfsUsageProperty(t *testing.T) {
+	tests := []struct {
+		name string
+		vol  Volume
+		want string
+	}{
+		{
+			"Filesystem volume",
+			NewVolume(nil, "testpool", VolumeTypeContainer, ContentTypeFS, "testvol", nil, nil),
+			"used",
+		},
+		{
+			"Filesystem volume using refquota",
+			NewVolume(nil, "testpool", VolumeTypeContainer, ContentTypeFS, "testvol", map[string]string{"zfs.use_refquota": "true"}, nil),
+			"referenced",
+		},
+		{
+			"Filesystem volume using refquota from the pool",
+			NewVolume(nil, "testpool", VolumeTypeContainer, ContentTypeFS, "testvol", nil, map[string]string{"volume.zfs.use_refquota": "true"}),
+			"referenced",
+		},
+		{
+			"VM block volume, not counting its snapshots",
+			NewVolume(nil, "testpool", VolumeTypeVM, ContentTypeBlock, "testvol", nil, nil),
+			"referenced",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, zfsUsageProperty(tt.vol))
+		})
+	}
+}
@@ -45,7 +45,7 @@ func genericCopyVolume(d Driver, initVolume func(vol Volume) (func(), error), vo
 				// Mount the source snapshot.
 				err := srcSnapshot.MountTask(func(srcMountPath string, op *operations.Operation) error {
 					// Copy the snapshot.
-					_, err := rsync.LocalCopy(srcMountPath, mountPath, bwlimit, true)
+					err := blockOverlayLocalCopy(srcMountPath, mountPath, bwlimit)
 					if err != nil {
 						return err
 					}
@@ -99,7 +99,7 @@ func genericCopyVolume(d Driver, initVolume func(vol Volume) (func(), error), vo
 
 		// Copy source to destination (mounting each volume if needed).
 		err := srcVol.MountTask(func(srcMountPath string, op *operations.Operation) error {
-			_, err := rsync.LocalCopy(srcMountPath, mountPath, bwlimit, true)
+			err := blockOverlayLocalCopy(srcMountPath, mountPath, bwlimit)
 			if err != nil {
 				return err
 			}
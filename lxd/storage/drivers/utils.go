@@ -1,6 +1,7 @@
 package drivers
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -14,6 +15,7 @@ import (
 	"golang.org/x/sys/unix"
 
 	"github.com/lxc/lxd/lxd/operations"
+	"github.com/lxc/lxd/lxd/rsync"
 	"github.com/lxc/lxd/shared"
 	"github.com/lxc/lxd/shared/idmap"
 	"github.com/lxc/lxd/shared/units"
@@ -339,6 +341,204 @@ func ensureVolumeBlockFile(path, blockSize string) error {
 	return nil
 }
 
+// blockOverlayBaseName is the name of the read-only base of a VM root disk created as a qcow2 overlay.
+// It's a hard link to the disk of the image the volume was created from, kept next to the overlay.
+const blockOverlayBaseName = "base.img"
+
+// qemuImgInfo represents the fields of a "qemu-img info" image used to check qcow2 overlays.
+type qemuImgInfo struct {
+	Filename              string `json:"filename"`
+	Format                string `json:"format"`
+	VirtualSize           int64  `json:"virtual-size"`
+	FullBackingFilename   string `json:"full-backing-filename"`
+	BackingFilenameFormat string `json:"backing-filename-format"`
+}
+
+// BlockFileFormat returns the qemu format of a VM block file, "qcow2" for root disks created as overlays
+// (which have their base next to them) and "raw" otherwise. The content of the file isn't looked at as the
+// guest can write anything to a raw disk, including a qcow2 header pointing at a host file.
+func BlockFileFormat(path string) string {
+	if shared.PathExists(filepath.Join(filepath.Dir(path), blockOverlayBaseName)) {
+		return "qcow2"
+	}
+
+	return "raw"
+}
+
+// BlockFileSize returns the size of a VM block file or block device as seen by the guest, which is the
+// virtual size for qcow2 overlays.
+func BlockFileSize(path string) (int64, error) {
+	if BlockFileFormat(path) == "qcow2" {
+		chain, err := qemuImgBackingChain(path)
+		if err != nil {
+			return -1, err
+		}
+
+		return chain[0].VirtualSize, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return -1, err
+	}
+	defer f.Close()
+
+	// Seeking to the end works for block devices, whose size isn't reported by stat.
+	return f.Seek(0, io.SeekEnd)
+}
+
+// qemuImgBackingChain returns the images of the backing chain of a disk file, starting with the file.
+func qemuImgBackingChain(path string) ([]qemuImgInfo, error) {
+	out, err := shared.RunCommand("qemu-img", "info", "--force-share", "--output=json", "--backing-chain", path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed getting backing chain of disk image %s", path)
+	}
+
+	chain := []qemuImgInfo{}
+	err = json.Unmarshal([]byte(out), &chain)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed parsing backing chain of disk image %s", path)
+	}
+
+	if len(chain) == 0 {
+		return nil, fmt.Errorf("No image found in backing chain of disk image %s", path)
+	}
+
+	return chain, nil
+}
+
+// ValidateBlockOverlay checks that a qcow2 overlay is only backed by the raw base next to it, and that the
+// base is a regular file of no more than the size of the overlay.
+func ValidateBlockOverlay(path string) error {
+	basePath := filepath.Join(filepath.Dir(path), blockOverlayBaseName)
+
+	fi, err := os.Lstat(basePath)
+	if err != nil {
+		return errors.Wrapf(err, "Failed checking base of disk image %s", path)
+	}
+
+	if !fi.Mode().IsRegular() {
+		return fmt.Errorf("Base %s of disk image %s isn't a regular file", basePath, path)
+	}
+
+	chain, err := qemuImgBackingChain(path)
+	if err != nil {
+		return err
+	}
+
+	if chain[0].Format != "qcow2" {
+		return fmt.Errorf("Disk image %s has format %q rather than qcow2", path, chain[0].Format)
+	}
+
+	if filepath.Clean(chain[0].FullBackingFilename) != basePath || len(chain) != 2 {
+		return fmt.Errorf("Disk image %s isn't backed by its base %s only", path, basePath)
+	}
+
+	if chain[0].BackingFilenameFormat != "raw" || chain[1].Format != "raw" {
+		return fmt.Errorf("Base %s of disk image %s isn't raw", basePath, path)
+	}
+
+	if chain[1].VirtualSize > chain[0].VirtualSize {
+		return fmt.Errorf("Base %s is larger than disk image %s", basePath, path)
+	}
+
+	return nil
+}
+
+// blockOverlayLocalCopy copies the volume directory srcPath into dstPath with rsync, except for the read-only
+// base of a qcow2 overlay which is hard linked, so that copies and snapshots of the volume share it. The base
+// is only copied when it can't be linked, such as from a snapshot mounted read-only.
+func blockOverlayLocalCopy(srcPath string, dstPath string, bwlimit string) error {
+	_, err := rsync.LocalCopy(srcPath, dstPath, bwlimit, true, "--exclude", "/"+blockOverlayBaseName)
+	if err != nil {
+		return err
+	}
+
+	srcBasePath := filepath.Join(srcPath, blockOverlayBaseName)
+	dstBasePath := filepath.Join(dstPath, blockOverlayBaseName)
+
+	// Drop any previous base, as rsync leaves it alone and the source may not have one.
+	err = os.Remove(dstBasePath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if !shared.PathExists(srcBasePath) {
+		return nil
+	}
+
+	err = os.Link(srcBasePath, dstBasePath)
+	if err == nil {
+		return nil
+	}
+
+	linkErr, ok := err.(*os.LinkError)
+	if !ok || linkErr.Err != unix.EXDEV {
+		return errors.Wrapf(err, "Failed linking base of disk image in %s", dstPath)
+	}
+
+	_, err = rsync.LocalCopy(srcPath, dstPath, bwlimit, true, "--include", "/"+blockOverlayBaseName, "--exclude", "*")
+	return err
+}
+
+// createBlockOverlay creates a qcow2 overlay over the raw base next to it. The base is referenced with a
+// relative path so that copies of the volume directory use their own base. The overlay is at least as large
+// as the base.
+func createBlockOverlay(path, blockSize string) error {
+	if blockSize == "" {
+		blockSize = defaultBlockSize
+	}
+
+	blockSizeBytes, err := roundVolumeBlockFileSizeBytes(blockSize)
+	if err != nil {
+		return err
+	}
+
+	fi, err := os.Stat(filepath.Join(filepath.Dir(path), blockOverlayBaseName))
+	if err != nil {
+		return err
+	}
+
+	if fi.Size() > blockSizeBytes {
+		blockSizeBytes = fi.Size()
+	}
+
+	_, err = shared.RunCommand("qemu-img", "create", "-f", "qcow2", "-b", blockOverlayBaseName, "-F", "raw", path, fmt.Sprintf("%d", blockSizeBytes))
+	if err != nil {
+		return errors.Wrapf(err, "Failed creating disk image %s as size %s", path, blockSize)
+	}
+
+	return nil
+}
+
+// resizeBlockOverlay grows the virtual size of a qcow2 overlay, returning whether it was resized.
+func resizeBlockOverlay(path, blockSize string) (bool, error) {
+	blockSizeBytes, err := roundVolumeBlockFileSizeBytes(blockSize)
+	if err != nil {
+		return false, err
+	}
+
+	chain, err := qemuImgBackingChain(path)
+	if err != nil {
+		return false, err
+	}
+
+	if blockSizeBytes < chain[0].VirtualSize {
+		return false, fmt.Errorf("You cannot shrink block volumes")
+	}
+
+	if blockSizeBytes == chain[0].VirtualSize {
+		return false, nil
+	}
+
+	_, err = shared.RunCommand("qemu-img", "resize", "-f", "qcow2", path, fmt.Sprintf("%d", blockSizeBytes))
+	if err != nil {
+		return false, errors.Wrapf(err, "Failed resizing disk image %s to size %s", path, blockSize)
+	}
+
+	return true, nil
+}
+
 // mkfsOptions represents options for filesystem creation.
 type mkfsOptions struct {
 	Label string
@@ -1,9 +1,16 @@
 package drivers
 
 import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lxc/lxd/shared"
 )
 
 // Test GetVolumeMountPath
@@ -35,3 +42,122 @@ func TestGetVolumeMountPath(t *testing.T) {
 	expected = GetPoolMountPath(poolName) + "/virtual-machines/testvol"
 	assert.Equal(t, expected, path)
 }
+
+// Test BlockFileFormat
+func TestBlockFileFormat(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lxd-drivers-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// A raw disk stays raw whatever the guest wrote to it.
+	rootPath := filepath.Join(dir, "root.img")
+	require.NoError(t, ioutil.WriteFile(rootPath, []byte("QFI\xfb"), 0600))
+	assert.Equal(t, "raw", BlockFileFormat(rootPath))
+
+	size, err := BlockFileSize(rootPath)
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), size)
+
+	// Overlays have their base next to them.
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, blockOverlayBaseName), nil, 0444))
+	assert.Equal(t, "qcow2", BlockFileFormat(rootPath))
+}
+
+// Test createBlockOverlay and ValidateBlockOverlay
+func TestBlockOverlay(t *testing.T) {
+	_, err := exec.LookPath("qemu-img")
+	if err != nil {
+		t.Skip("qemu-img is missing")
+	}
+
+	dir, err := ioutil.TempDir("", "lxd-drivers-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	rootPath := filepath.Join(dir, "root.img")
+	basePath := filepath.Join(dir, blockOverlayBaseName)
+
+	// The base is required.
+	assert.Error(t, createBlockOverlay(rootPath, "8MiB"))
+	assert.Error(t, ValidateBlockOverlay(rootPath))
+
+	require.NoError(t, ioutil.WriteFile(basePath, nil, 0444))
+	require.NoError(t, os.Truncate(basePath, 4*1024*1024))
+
+	// The overlay gets the requested size, or the one of its base when larger.
+	require.NoError(t, createBlockOverlay(rootPath, "8MiB"))
+	require.NoError(t, ValidateBlockOverlay(rootPath))
+
+	size, err := BlockFileSize(rootPath)
+	require.NoError(t, err)
+	assert.Equal(t, int64(8*1024*1024), size)
+
+	require.NoError(t, os.Remove(rootPath))
+	require.NoError(t, createBlockOverlay(rootPath, "1MiB"))
+
+	size, err = BlockFileSize(rootPath)
+	require.NoError(t, err)
+	assert.Equal(t, int64(4*1024*1024), size)
+
+	// A raw disk isn't an overlay.
+	require.NoError(t, os.Remove(rootPath))
+	require.NoError(t, ioutil.WriteFile(rootPath, nil, 0600))
+	require.NoError(t, os.Truncate(rootPath, 8*1024*1024))
+	assert.Error(t, ValidateBlockOverlay(rootPath))
+
+	// Nor is a disk backed by any other file than its base.
+	otherPath := filepath.Join(dir, "other.img")
+	require.NoError(t, ioutil.WriteFile(otherPath, nil, 0600))
+	require.NoError(t, os.Truncate(otherPath, 4*1024*1024))
+
+	require.NoError(t, os.Remove(rootPath))
+	_, err = shared.RunCommand("qemu-img", "create", "-f", "qcow2", "-b", otherPath, "-F", "raw", rootPath, "8M")
+	require.NoError(t, err)
+	assert.Error(t, ValidateBlockOverlay(rootPath))
+
+	// The base must be a regular file.
+	require.NoError(t, os.Remove(rootPath))
+	require.NoError(t, os.Remove(basePath))
+	require.NoError(t, os.Symlink("other.img", basePath))
+	require.NoError(t, createBlockOverlay(rootPath, "8MiB"))
+	assert.Error(t, ValidateBlockOverlay(rootPath))
+}
+
+// Test blockOverlayLocalCopy
+func TestBlockOverlayLocalCopy(t *testing.T) {
+	_, err := exec.LookPath("rsync")
+	if err != nil {
+		t.Skip("rsync is missing")
+	}
+
+	dir, err := ioutil.TempDir("", "lxd-drivers-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	srcPath := filepath.Join(dir, "src")
+	dstPath := filepath.Join(dir, "dst")
+	require.NoError(t, os.Mkdir(srcPath, 0700))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(srcPath, "root.img"), []byte("overlay"), 0600))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(srcPath, blockOverlayBaseName), []byte("base"), 0444))
+
+	require.NoError(t, blockOverlayLocalCopy(srcPath, dstPath, ""))
+
+	// The overlay is copied.
+	srcInfo, err := os.Stat(filepath.Join(srcPath, "root.img"))
+	require.NoError(t, err)
+	dstInfo, err := os.Stat(filepath.Join(dstPath, "root.img"))
+	require.NoError(t, err)
+	assert.False(t, os.SameFile(srcInfo, dstInfo))
+
+	// The base is shared.
+	srcInfo, err = os.Stat(filepath.Join(srcPath, blockOverlayBaseName))
+	require.NoError(t, err)
+	dstInfo, err = os.Stat(filepath.Join(dstPath, blockOverlayBaseName))
+	require.NoError(t, err)
+	assert.True(t, os.SameFile(srcInfo, dstInfo))
+
+	// A base left over in the target is dropped when the source has none.
+	require.NoError(t, os.Remove(filepath.Join(srcPath, blockOverlayBaseName)))
+	require.NoError(t, blockOverlayLocalCopy(srcPath, dstPath, ""))
+	assert.False(t, shared.PathExists(filepath.Join(dstPath, blockOverlayBaseName)))
+}
@@ -4,10 +4,12 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"strings"
 
 	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
 
 	"github.com/lxc/lxd/lxd/db"
 	"github.com/lxc/lxd/lxd/instance"
@@ -22,6 +24,7 @@ import (
 	log "github.com/lxc/lxd/shared/log15"
 	"github.com/lxc/lxd/shared/logger"
 	"github.com/lxc/lxd/shared/logging"
+	"github.com/lxc/lxd/shared/osarch"
 	"github.com/lxc/lxd/shared/units"
 )
 
@@ -562,7 +565,11 @@ func validateVolumeCommonRules(vol drivers.Volume) map[string]func(string) error
 // VM Format A: Separate metadata tarball and root qcow2 file.
 // 	- Unpack metadata tarball into mountPath.
 //	- Check rootBlockPath is a file and convert qcow2 file into raw format in rootBlockPath.
-func ImageUnpack(imageFile, destPath, destBlockFile string, blockBackend, runningInUserns bool, tracker *ioprogress.ProgressTracker) error {
+// VM Format B: Combined tarball containing metadata files and root qcow2 file, as produced by export.
+//	- Unpack combined tarball into a temporary directory.
+//	- Convert qcow2 file into raw format in rootBlockPath and transfer the rest into mountPath.
+// For VM images, the architecture in metadata.yaml must be one of the supplied host architectures.
+func ImageUnpack(imageFile, destPath, destBlockFile string, blockBackend, runningInUserns bool, architectures []int, tracker *ioprogress.ProgressTracker) error {
 	// For all formats, first unpack the metadata (or combined) tarball into destPath.
 	imageRootfsFile := imageFile + ".rootfs"
 
@@ -599,6 +606,10 @@ func ImageUnpack(imageFile, destPath, destBlockFile string, blockBackend, runnin
 	}
 
 	// If a rootBlockPath is supplied then this is a VM image unpack.
+	_, err := exec.LookPath("qemu-img")
+	if err != nil {
+		return fmt.Errorf("Unpacking VM images requires qemu-img, which couldn't be found")
+	}
 
 	// Validate the target.
 	fileInfo, err := os.Stat(destBlockFile)
@@ -606,7 +617,7 @@ func ImageUnpack(imageFile, destPath, destBlockFile string, blockBackend, runnin
 		return err
 	}
 
-	if fileInfo.IsDir() {
+	if err == nil && fileInfo.IsDir() {
 		// If the dest block file exists, and it is a directory, fail.
 		return fmt.Errorf("Root block path isn't a file: %s", destBlockFile)
 	}
@@ -618,6 +629,11 @@ func ImageUnpack(imageFile, destPath, destBlockFile string, blockBackend, runnin
 			return err
 		}
 
+		err = imageCheckArchitecture(destPath, architectures)
+		if err != nil {
+			return err
+		}
+
 		// Convert the qcow2 format to a raw block device.
 		_, err = shared.RunCommand("qemu-img", "convert", "-O", "raw", imageRootfsFile, destBlockFile)
 		if err != nil {
@@ -637,8 +653,17 @@ func ImageUnpack(imageFile, destPath, destBlockFile string, blockBackend, runnin
 			return err
 		}
 
+		err = imageCheckArchitecture(tempDir, architectures)
+		if err != nil {
+			return err
+		}
+
 		// Convert the qcow2 format to a raw block device.
 		imgPath := filepath.Join(tempDir, "rootfs.img")
+		if !shared.PathExists(imgPath) {
+			return fmt.Errorf("Image is missing a rootfs.img: %s", imageFile)
+		}
+
 		_, err = shared.RunCommand("qemu-img", "convert", "-O", "raw", imgPath, destBlockFile)
 		if err != nil {
 			return fmt.Errorf("Failed converting image to raw at %s: %v", destBlockFile, err)
@@ -660,6 +685,32 @@ func ImageUnpack(imageFile, destPath, destBlockFile string, blockBackend, runnin
 	return nil
 }
 
+// imageCheckArchitecture checks that the architecture in the image metadata unpacked in path is one
+// of the supplied architectures.
+func imageCheckArchitecture(path string, architectures []int) error {
+	content, err := ioutil.ReadFile(filepath.Join(path, "metadata.yaml"))
+	if err != nil {
+		return errors.Wrap(err, "Failed reading image metadata")
+	}
+
+	metadata := api.ImageMetadata{}
+	err = yaml.Unmarshal(content, &metadata)
+	if err != nil {
+		return errors.Wrap(err, "Failed parsing image metadata")
+	}
+
+	id, err := osarch.ArchitectureId(metadata.Architecture)
+	if err != nil {
+		return err
+	}
+
+	if !shared.IntInSlice(id, architectures) {
+		return fmt.Errorf("Image architecture %q isn't supported by this host", metadata.Architecture)
+	}
+
+	return nil
+}
+
 // InstanceContentType returns the instance's content type.
 func InstanceContentType(inst instance.Instance) drivers.ContentType {
 	contentType := drivers.ContentTypeFS
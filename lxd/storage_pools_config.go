@@ -72,6 +72,11 @@ var storagePoolConfigKeys = map[string]func(value string) error{
 	// valid drivers: ceph, lvm
 	"volume.size": shared.IsSize,
 
+	// valid drivers: dir
+	"volume.dir.block_format": func(value string) error {
+		return shared.IsOneOf(value, []string{"raw", "qcow2"})
+	},
+
 	// valid drivers: zfs
 	"volume.zfs.remove_snapshots": shared.IsBool,
 	"volume.zfs.use_refquota":     shared.IsBool,
@@ -130,6 +135,12 @@ func storagePoolValidateConfig(name string, driver string, config map[string]str
 			}
 		}
 
+		if driver != "dir" {
+			if prfx(key, "volume.dir.") {
+				return fmt.Errorf("the key %s cannot be used with %s storage pools", key, strings.ToUpper(driver))
+			}
+		}
+
 		if driver != "zfs" {
 			if prfx(key, "volume.zfs.") || prfx(key, "zfs.") {
 				return fmt.Errorf("the key %s cannot be used with %s storage pools", key, strings.ToUpper(driver))
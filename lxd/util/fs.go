@@ -2,6 +2,7 @@ package util
 
 import (
 	"fmt"
+	"strings"
 
 	"golang.org/x/sys/unix"
 
@@ -15,6 +16,8 @@ const (
 	FilesystemSuperMagicXfs   = 0x58465342
 	FilesystemSuperMagicNfs   = 0x6969
 	FilesystemSuperMagicZfs   = 0x2fc12fc1
+	FilesystemSuperMagicCeph  = 0x00C36400
+	FilesystemSuperMagicFuse  = 0x65735546
 )
 
 // FilesystemDetect returns the filesystem on which the passed-in path sits.
@@ -26,21 +29,37 @@ func FilesystemDetect(path string) (string, error) {
 		return "", err
 	}
 
-	switch fs.Type {
+	name := FilesystemName(int64(fs.Type))
+	if strings.HasPrefix(name, "0x") {
+		logger.Debugf("Unknown backing filesystem type: %s", name)
+	}
+
+	return name, nil
+}
+
+// FilesystemName returns the name of the filesystem with the given magic number, or the magic number
+// in hexadecimal notation if it is unknown.
+func FilesystemName(magic int64) string {
+	switch magic {
 	case FilesystemSuperMagicBtrfs:
-		return "btrfs", nil
+		return "btrfs"
 	case FilesystemSuperMagicZfs:
-		return "zfs", nil
+		return "zfs"
 	case FilesystemSuperMagicTmpfs:
-		return "tmpfs", nil
+		return "tmpfs"
 	case FilesystemSuperMagicExt4:
-		return "ext4", nil
+		return "ext4"
 	case FilesystemSuperMagicXfs:
-		return "xfs", nil
+		return "xfs"
 	case FilesystemSuperMagicNfs:
-		return "nfs", nil
+		return "nfs"
+	case FilesystemSuperMagicCifs:
+		return "cifs"
+	case FilesystemSuperMagicCeph:
+		return "ceph"
+	case FilesystemSuperMagicFuse:
+		return "fuse"
 	default:
-		logger.Debugf("Unknown backing filesystem type: 0x%x", fs.Type)
-		return fmt.Sprintf("0x%x", fs.Type), nil
+		return fmt.Sprintf("0x%x", magic)
 	}
 }
@@ -5,4 +5,7 @@ package util
 const (
 	// FilesystemSuperMagicBtrfs is the 32bit magic for Btrfs (as signed constant)
 	FilesystemSuperMagicBtrfs = -1859950530
+
+	// FilesystemSuperMagicCifs is the 32bit magic for CIFS (as signed constant)
+	FilesystemSuperMagicCifs = -11317950
 )
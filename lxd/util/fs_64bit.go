@@ -5,4 +5,7 @@ package util
 const (
 	// FilesystemSuperMagicBtrfs is the 64bit magic for Btrfs
 	FilesystemSuperMagicBtrfs = 0x9123683E
+
+	// FilesystemSuperMagicCifs is the 64bit magic for CIFS
+	FilesystemSuperMagicCifs = 0xFF534D42
 )
@@ -0,0 +1,42 @@
+package util_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+
+	"github.com/lxc/lxd/lxd/util"
+)
+
+func TestFilesystemName(t *testing.T) {
+	assert.Equal(t, "ext4", util.FilesystemName(util.FilesystemSuperMagicExt4))
+	assert.Equal(t, "zfs", util.FilesystemName(util.FilesystemSuperMagicZfs))
+	assert.Equal(t, "btrfs", util.FilesystemName(util.FilesystemSuperMagicBtrfs))
+	assert.Equal(t, "cifs", util.FilesystemName(util.FilesystemSuperMagicCifs))
+	assert.Equal(t, "0x1234", util.FilesystemName(0x1234))
+}
+
+// The filesystem detected for a path matches the one reported by statfs.
+func TestFilesystemDetect(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lxd-util-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "disk.img")
+	require.NoError(t, ioutil.WriteFile(path, []byte{}, 0600))
+
+	fs := unix.Statfs_t{}
+	require.NoError(t, unix.Statfs(dir, &fs))
+
+	name, err := util.FilesystemDetect(path)
+	require.NoError(t, err)
+	assert.Equal(t, util.FilesystemName(int64(fs.Type)), name)
+
+	_, err = util.FilesystemDetect(filepath.Join(dir, "missing"))
+	assert.Error(t, err)
+}
@@ -21,7 +21,7 @@ func Listen(port uint32) (net.Listener, error) {
 }
 
 // HTTPClient provides an HTTP client for using over vsock.
-func HTTPClient(vsockID int, tlsClientCert string, tlsClientKey string, tlsServerCert string) (*http.Client, error) {
+func HTTPClient(vsockID uint32, tlsClientCert string, tlsClientKey string, tlsServerCert string) (*http.Client, error) {
 	client := &http.Client{}
 
 	// Get the TLS configuration.
@@ -34,7 +34,7 @@ func HTTPClient(vsockID int, tlsClientCert string, tlsClientKey string, tlsServe
 		TLSClientConfig: tlsConfig,
 		// Setup a VM socket dialer.
 		Dial: func(network, addr string) (net.Conn, error) {
-			conn, err := Dial(uint32(vsockID), 8443)
+			conn, err := Dial(vsockID, 8443)
 			if err != nil {
 				return nil, err
 			}
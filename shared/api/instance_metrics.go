@@ -0,0 +1,45 @@
+package api
+
+// InstanceMetrics represents the resource usage of an instance, as collected for monitoring.
+//
+// API extension: instance_metrics
+type InstanceMetrics struct {
+	// Whether the CPU, memory and network figures come from inside the instance.
+	AgentConnected bool `json:"agent_connected" yaml:"agent_connected"`
+
+	CPU     InstanceMetricsCPU                `json:"cpu" yaml:"cpu"`
+	Memory  InstanceMetricsMemory             `json:"memory" yaml:"memory"`
+	Disk    map[string]InstanceMetricsDisk    `json:"disk" yaml:"disk"`
+	Network map[string]InstanceMetricsNetwork `json:"network" yaml:"network"`
+}
+
+// InstanceMetricsCPU represents the CPU time used by an instance, in nanoseconds.
+type InstanceMetricsCPU struct {
+	Usage int64 `json:"usage" yaml:"usage"`
+}
+
+// InstanceMetricsMemory represents the memory of an instance, in bytes. Total and Balloon are left at 0 when
+// unknown.
+type InstanceMetricsMemory struct {
+	Usage     int64 `json:"usage" yaml:"usage"`
+	UsagePeak int64 `json:"usage_peak" yaml:"usage_peak"`
+	Total     int64 `json:"total" yaml:"total"`
+	Balloon   int64 `json:"balloon" yaml:"balloon"`
+}
+
+// InstanceMetricsDisk represents the I/O counters of an instance's disk device.
+type InstanceMetricsDisk struct {
+	BytesRead       int64 `json:"bytes_read" yaml:"bytes_read"`
+	BytesWritten    int64 `json:"bytes_written" yaml:"bytes_written"`
+	ReadOperations  int64 `json:"read_operations" yaml:"read_operations"`
+	WriteOperations int64 `json:"write_operations" yaml:"write_operations"`
+}
+
+// InstanceMetricsNetwork represents the counters of an instance's NIC device, from the instance's point of
+// view.
+type InstanceMetricsNetwork struct {
+	BytesReceived   int64 `json:"bytes_received" yaml:"bytes_received"`
+	BytesSent       int64 `json:"bytes_sent" yaml:"bytes_sent"`
+	PacketsReceived int64 `json:"packets_received" yaml:"packets_received"`
+	PacketsSent     int64 `json:"packets_sent" yaml:"packets_sent"`
+}
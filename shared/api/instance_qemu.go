@@ -0,0 +1,9 @@
+package api
+
+// InstanceQemuConfig represents the qemu config file and arguments LXD would start a virtual machine with.
+//
+// API extension: instance_qemu_config
+type InstanceQemuConfig struct {
+	Config  string   `json:"config" yaml:"config"`
+	Command []string `json:"command" yaml:"command"`
+}
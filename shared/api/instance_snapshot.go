@@ -13,6 +13,9 @@ type InstanceSnapshotsPost struct {
 
 	// API extension: snapshot_expiry_creation
 	ExpiresAt *time.Time `json:"expires_at" yaml:"expires_at"`
+
+	// API extension: instance_snapshot_disk
+	Device string `json:"device,omitempty" yaml:"device,omitempty"`
 }
 
 // InstanceSnapshotPost represents the fields required to rename/move a LXD instance snapshot.
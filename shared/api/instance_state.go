@@ -1,5 +1,9 @@
 package api
 
+import (
+	"time"
+)
+
 // InstanceStatePut represents the modifiable fields of a LXD instance's state.
 //
 // API extension: instances
@@ -22,6 +26,33 @@ type InstanceState struct {
 	Pid        int64                           `json:"pid" yaml:"pid"`
 	Processes  int64                           `json:"processes" yaml:"processes"`
 	CPU        InstanceStateCPU                `json:"cpu" yaml:"cpu"`
+
+	// API extension: vm_agent_status
+	AgentConnected bool `json:"agent_connected" yaml:"agent_connected"`
+
+	// API extension: vm_boot_time
+	BootTime time.Time `json:"boot_time" yaml:"boot_time"`
+
+	// API extension: vm_vsock_id
+	VsockID int64 `json:"vsock_id" yaml:"vsock_id"`
+
+	// API extension: vm_health_check
+	Health string `json:"health" yaml:"health"`
+
+	// API extension: vm_pause_reason
+	PauseReason string `json:"pause_reason" yaml:"pause_reason"`
+
+	// API extension: vm_guest_os_info
+	OSInfo *InstanceStateOSInfo `json:"os_info" yaml:"os_info"`
+}
+
+// InstanceStateOSInfo represents the operating system information section of a LXD instance's state.
+//
+// API extension: vm_guest_os_info
+type InstanceStateOSInfo struct {
+	OS            string `json:"os" yaml:"os"`
+	OSVersion     string `json:"os_version" yaml:"os_version"`
+	KernelVersion string `json:"kernel_version" yaml:"kernel_version"`
 }
 
 // InstanceStateDisk represents the disk information section of a LXD instance's state.
@@ -29,6 +60,12 @@ type InstanceState struct {
 // API extension: instances
 type InstanceStateDisk struct {
 	Usage int64 `json:"usage" yaml:"usage"`
+
+	// API extension: vm_disk_io_stats
+	BytesRead       int64 `json:"bytes_read" yaml:"bytes_read"`
+	BytesWritten    int64 `json:"bytes_written" yaml:"bytes_written"`
+	ReadOperations  int64 `json:"read_operations" yaml:"read_operations"`
+	WriteOperations int64 `json:"write_operations" yaml:"write_operations"`
 }
 
 // InstanceStateCPU represents the cpu information section of a LXD instance's state.
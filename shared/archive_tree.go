@@ -0,0 +1,256 @@
+package shared
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/lxc/lxd/shared/logger"
+)
+
+// TarTree writes the file tree rooted at path to w as a tar archive, preserving modes, ownership and
+// symlinks. Entries other than directories, regular files and symlinks are skipped.
+func TarTree(w io.Writer, path string) error {
+	tw := tar.NewWriter(w)
+
+	err := filepath.Walk(path, func(entPath string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		link := ""
+		if fi.Mode()&os.ModeSymlink != 0 {
+			link, err = os.Readlink(entPath)
+			if err != nil {
+				return err
+			}
+		} else if !fi.Mode().IsDir() && !fi.Mode().IsRegular() {
+			return nil
+		}
+
+		hdr, err := tar.FileInfoHeader(fi, link)
+		if err != nil {
+			return err
+		}
+
+		hdr.Name, err = filepath.Rel(path, entPath)
+		if err != nil {
+			return err
+		}
+
+		if fi.IsDir() {
+			hdr.Name += "/"
+		}
+
+		err = tw.WriteHeader(hdr)
+		if err != nil {
+			return err
+		}
+
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+
+		f, err := os.Open(entPath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return tw.Close()
+}
+
+// UntarTree extracts the tar archive read from r below path, restoring permissions and symlinks.
+// The setuid, setgid and sticky bits are dropped. Entries are owned by uid and gid, or by the IDs
+// recorded in the archive when passing -1, which requires the privileges to do so. Entries which
+// would end up outside of path, directly or through a symlink, are refused. If the extraction fails,
+// the entries it created are removed again. Files it overwrote aren't restored.
+func UntarTree(r io.Reader, path string, uid int64, gid int64) (err error) {
+	type dirMode struct {
+		path string
+		mode os.FileMode
+	}
+
+	created := []string{}
+	dirs := []dirMode{}
+
+	chown := func(target string, hdr *tar.Header) error {
+		entUID := uid
+		if entUID == -1 {
+			entUID = int64(hdr.Uid)
+		}
+
+		entGID := gid
+		if entGID == -1 {
+			entGID = int64(hdr.Gid)
+		}
+
+		return os.Lchown(target, int(entUID), int(entGID))
+	}
+
+	defer func() {
+		if err == nil {
+			return
+		}
+
+		for i := len(created) - 1; i >= 0; i-- {
+			os.Remove(created[i])
+		}
+	}()
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return err
+		}
+
+		name := filepath.Clean(hdr.Name)
+		if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return fmt.Errorf("Invalid path %q in archive", hdr.Name)
+		}
+
+		err = untarCheckParents(path, name)
+		if err != nil {
+			return err
+		}
+
+		target := filepath.Join(path, name)
+		mode := os.FileMode(hdr.Mode) & os.ModePerm
+
+		fi, err := os.Lstat(target)
+		exists := err == nil
+		if exists && fi.IsDir() && hdr.Typeflag != tar.TypeDir {
+			return fmt.Errorf("Can't replace directory %q", target)
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if exists && !fi.IsDir() {
+				return fmt.Errorf("Can't replace %q with a directory", target)
+			}
+
+			if !exists {
+				// The final mode is applied once the directory content is in place.
+				err = os.Mkdir(target, 0700)
+				if err != nil {
+					return err
+				}
+
+				created = append(created, target)
+			}
+
+			err = chown(target, hdr)
+			if err != nil {
+				return err
+			}
+
+			dirs = append(dirs, dirMode{path: target, mode: mode})
+		case tar.TypeReg, tar.TypeRegA:
+			// Don't write through an existing symlink.
+			if exists && !fi.Mode().IsRegular() {
+				err = os.Remove(target)
+				if err != nil {
+					return err
+				}
+			}
+
+			f, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+			if err != nil {
+				return err
+			}
+
+			if !exists {
+				created = append(created, target)
+			}
+
+			_, err = io.Copy(f, tr)
+			f.Close()
+			if err != nil {
+				return err
+			}
+
+			err = chown(target, hdr)
+			if err != nil {
+				return err
+			}
+
+			err = os.Chmod(target, mode)
+			if err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if exists {
+				err = os.Remove(target)
+				if err != nil {
+					return err
+				}
+			}
+
+			err = os.Symlink(hdr.Linkname, target)
+			if err != nil {
+				return err
+			}
+
+			if !exists {
+				created = append(created, target)
+			}
+
+			err = chown(target, hdr)
+			if err != nil {
+				return err
+			}
+		default:
+			logger.Debugf("Skipping unsupported entry %q of type %q in archive", hdr.Name, hdr.Typeflag)
+		}
+	}
+
+	// Apply the directory modes last so read-only directories don't prevent extracting their content.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		err = os.Chmod(dirs[i].path, dirs[i].mode)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// untarCheckParents checks that all the parents of the archive entry name below root are
+// directories, so the entry can't be redirected elsewhere through a symlink.
+func untarCheckParents(root string, name string) error {
+	parent := filepath.Dir(name)
+	if parent == "." {
+		return nil
+	}
+
+	cur := root
+	for _, elem := range strings.Split(parent, "/") {
+		cur = filepath.Join(cur, elem)
+
+		fi, err := os.Lstat(cur)
+		if err != nil {
+			return err
+		}
+
+		if !fi.IsDir() {
+			return fmt.Errorf("Invalid path %q in archive, %q isn't a directory", name, cur)
+		}
+	}
+
+	return nil
+}
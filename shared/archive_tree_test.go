@@ -0,0 +1,274 @@
+package shared
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTarTree(t *testing.T) {
+	src, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+
+	dst, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dst)
+
+	err = os.Mkdir(filepath.Join(src, "dir"), 0750)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(src, "dir", "file"), []byte("content"), 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.Symlink("dir/file", filepath.Join(src, "link"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Read-only directories must still get their content.
+	err = os.Mkdir(filepath.Join(src, "ro"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(src, "ro", "file"), []byte("ro"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.Chmod(filepath.Join(src, "ro"), 0500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(filepath.Join(src, "ro"), 0700)
+
+	// The setuid bit isn't kept.
+	err = ioutil.WriteFile(filepath.Join(src, "suid"), []byte("suid"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.Chmod(filepath.Join(src, "suid"), os.ModeSetuid|0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := bytes.Buffer{}
+	err = TarTree(&buf, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = UntarTree(&buf, dst, int64(os.Getuid()), int64(os.Getgid()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(filepath.Join(dst, "ro"), 0700)
+
+	content, err := ioutil.ReadFile(filepath.Join(dst, "dir", "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(content) != "content" {
+		t.Errorf("Unexpected file content %q", content)
+	}
+
+	modes := map[string]os.FileMode{
+		"dir":      os.ModeDir | 0750,
+		"dir/file": 0640,
+		"ro":       os.ModeDir | 0500,
+		"ro/file":  0600,
+		"suid":     0755,
+	}
+
+	for name, mode := range modes {
+		fi, err := os.Lstat(filepath.Join(dst, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if fi.Mode() != mode {
+			t.Errorf("Unexpected mode %v for %q, expected %v", fi.Mode(), name, mode)
+		}
+	}
+
+	target, err := os.Readlink(filepath.Join(dst, "link"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if target != "dir/file" {
+		t.Errorf("Unexpected symlink target %q", target)
+	}
+}
+
+// The ownership of the entries is recorded in the archive and kept when extracting without IDs.
+func TestTarTree_Ownership(t *testing.T) {
+	src, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+
+	dst, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dst)
+
+	err = ioutil.WriteFile(filepath.Join(src, "file"), []byte("content"), 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := bytes.Buffer{}
+	err = TarTree(&buf, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	archive := buf.Bytes()
+	tr := tar.NewReader(bytes.NewReader(archive))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if hdr.Uid != os.Getuid() || hdr.Gid != os.Getgid() {
+			t.Errorf("Unexpected ownership %d:%d for %q", hdr.Uid, hdr.Gid, hdr.Name)
+		}
+	}
+
+	err = UntarTree(bytes.NewReader(archive), dst, -1, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := os.Lstat(filepath.Join(dst, "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, uid, gid := GetOwnerMode(fi)
+	if uid != os.Getuid() || gid != os.Getgid() {
+		t.Errorf("Unexpected ownership %d:%d", uid, gid)
+	}
+}
+
+func TestUntarTree_Invalid(t *testing.T) {
+	tests := map[string][]tar.Header{
+		"parent": {
+			{Name: "../escape", Typeflag: tar.TypeReg, Mode: 0600},
+		},
+		"absolute": {
+			{Name: "/escape", Typeflag: tar.TypeReg, Mode: 0600},
+		},
+		"symlink": {
+			{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "/", Mode: 0777},
+			{Name: "link/escape", Typeflag: tar.TypeReg, Mode: 0600},
+		},
+	}
+
+	for name, hdrs := range tests {
+		dst, err := ioutil.TempDir("", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dst)
+
+		buf := bytes.Buffer{}
+		tw := tar.NewWriter(&buf)
+		for _, hdr := range hdrs {
+			hdr.Uid = os.Getuid()
+			hdr.Gid = os.Getgid()
+
+			err = tw.WriteHeader(&hdr)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		err = tw.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = UntarTree(&buf, dst, -1, -1)
+		if err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+
+		ents, err := ioutil.ReadDir(dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(ents) != 0 {
+			t.Errorf("%s: expected the destination to be left empty, got %d entries", name, len(ents))
+		}
+	}
+}
+
+func TestUntarTree_Truncated(t *testing.T) {
+	dst, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dst)
+
+	buf := bytes.Buffer{}
+	tw := tar.NewWriter(&buf)
+	hdrs := []tar.Header{
+		{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "dir/file", Typeflag: tar.TypeReg, Mode: 0644, Size: 1024},
+	}
+
+	for _, hdr := range hdrs {
+		hdr.Uid = os.Getuid()
+		hdr.Gid = os.Getgid()
+
+		err = tw.WriteHeader(&hdr)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err = tw.Write([]byte(strings.Repeat("a", 512)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = UntarTree(&buf, dst, -1, -1)
+	if err == nil {
+		t.Fatal("Expected an error")
+	}
+
+	ents, err := ioutil.ReadDir(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ents) != 0 {
+		t.Errorf("Expected the partial extraction to be removed, got %d entries", len(ents))
+	}
+}
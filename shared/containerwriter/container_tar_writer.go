@@ -6,6 +6,7 @@ import (
 	"io"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/lxc/lxd/shared"
 	"github.com/lxc/lxd/shared/idmap"
@@ -118,6 +119,27 @@ func (ctw *ContainerTarWriter) WriteFile(offset int, path string, fi os.FileInfo
 	return nil
 }
 
+// WriteFileFromReader adds a regular file to the tarball, copying its size bytes of content from src
+func (ctw *ContainerTarWriter) WriteFileFromReader(name string, size int64, mode os.FileMode, src io.Reader) error {
+	hdr := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     size,
+		Mode:     int64(mode.Perm()),
+		ModTime:  time.Now(),
+	}
+
+	if err := ctw.tarWriter.WriteHeader(hdr); err != nil {
+		return fmt.Errorf("failed to write tar header: %s", err)
+	}
+
+	if _, err := io.CopyN(ctw.tarWriter, src, size); err != nil {
+		return fmt.Errorf("failed to copy file content: %s", err)
+	}
+
+	return nil
+}
+
 // Close finishes writing the tarball
 func (ctw *ContainerTarWriter) Close() error {
 	err := ctw.tarWriter.Close()
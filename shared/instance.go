@@ -1,7 +1,9 @@
 package shared
 
 import (
+	"encoding/json"
 	"fmt"
+	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
@@ -16,11 +18,12 @@ import (
 type InstanceAction string
 
 const (
-	Stop     InstanceAction = "stop"
-	Start    InstanceAction = "start"
-	Restart  InstanceAction = "restart"
-	Freeze   InstanceAction = "freeze"
-	Unfreeze InstanceAction = "unfreeze"
+	Stop           InstanceAction = "stop"
+	Start          InstanceAction = "start"
+	Restart        InstanceAction = "restart"
+	Freeze         InstanceAction = "freeze"
+	Unfreeze       InstanceAction = "unfreeze"
+	RollbackConfig InstanceAction = "rollback-config"
 )
 
 func IsInt64(value string) error {
@@ -62,6 +65,20 @@ func IsUint32(value string) error {
 	return nil
 }
 
+// isPositiveUint32 validates string is an unsigned 32 bit integer of at least 1.
+func isPositiveUint32(value string) error {
+	err := IsUint32(value)
+	if err != nil {
+		return err
+	}
+
+	if value != "" && strings.TrimLeft(value, "0") == "" {
+		return fmt.Errorf("Invalid value: %s (must be at least 1)", value)
+	}
+
+	return nil
+}
+
 func IsPriority(value string) error {
 	if value == "" {
 		return nil
@@ -147,6 +164,106 @@ func IsDeviceID(value string) error {
 	return nil
 }
 
+// SMBIOSStringMaxLength is the longest string accepted in the SMBIOS fields of a VM.
+const SMBIOSStringMaxLength = 64
+
+// IsSMBIOSString validates string is printable ASCII no longer than SMBIOSStringMaxLength, suitable for an
+// SMBIOS field.
+func IsSMBIOSString(value string) error {
+	if len(value) > SMBIOSStringMaxLength {
+		return fmt.Errorf("Invalid value, must be at most %d characters long", SMBIOSStringMaxLength)
+	}
+
+	for _, r := range value {
+		if r < ' ' || r > '~' {
+			return fmt.Errorf("Invalid value, must only contain printable ASCII characters")
+		}
+	}
+
+	return nil
+}
+
+// IsUUID validates string is a UUID in its canonical textual form.
+func IsUUID(value string) error {
+	if value == "" {
+		return nil
+	}
+
+	regexUUID, err := regexp.Compile("^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$")
+	if err != nil {
+		return err
+	}
+
+	if !regexUUID.MatchString(value) {
+		return fmt.Errorf("Invalid value, must be a UUID such as 0b9b6ad3-1a3d-4e6b-8c1d-8d5a1fc7d1a2")
+	}
+
+	return nil
+}
+
+// IsAbsFilePath validates an absolute file path.
+func IsAbsFilePath(value string) error {
+	if value == "" {
+		return nil
+	}
+
+	if !filepath.IsAbs(value) {
+		return fmt.Errorf("Must be an absolute path")
+	}
+
+	return nil
+}
+
+// isQemuConfigString validates a string set in the qemu config file, which has no escaping and limits
+// values to 1023 characters.
+func isQemuConfigString(value string) error {
+	if strings.ContainsAny(value, "\"\n") {
+		return fmt.Errorf("Must not contain double quotes or new lines")
+	}
+
+	if len(value) > 1023 {
+		return fmt.Errorf("Must be at most 1023 characters long")
+	}
+
+	return nil
+}
+
+// isInstanceNameList validates a comma separated list of instance names.
+func isInstanceNameList(value string) error {
+	if value == "" {
+		return nil
+	}
+
+	for _, name := range strings.Split(value, ",") {
+		err := ValidHostname(strings.TrimSpace(name))
+		if err != nil {
+			return fmt.Errorf("Invalid instance name %q: %v", strings.TrimSpace(name), err)
+		}
+	}
+
+	return nil
+}
+
+// isLastGoodConfig validates the configuration recorded by a VM on its last successful start.
+func isLastGoodConfig(value string) error {
+	if value == "" {
+		return nil
+	}
+
+	lastGood := struct {
+		Config   map[string]string            `json:"config"`
+		Devices  map[string]map[string]string `json:"devices"`
+		Profiles []string                     `json:"profiles"`
+	}{}
+
+	err := json.Unmarshal([]byte(value), &lastGood)
+	if err != nil {
+		return errors.Wrap(err, "Invalid recorded configuration")
+	}
+
+	return nil
+}
+
 // IsRootDiskDevice returns true if the given device representation is configured as root disk for
 // a container. It typically get passed a specific entry of api.Instance.Devices.
 func IsRootDiskDevice(device map[string]string) bool {
@@ -194,11 +311,54 @@ var HugePageSizeSuffix = [...]string{"64KB", "1MB", "2MB", "1GB"}
 // to an appropriate checker function, which validates whether or not a
 // given value is syntactically legal.
 var KnownInstanceConfigKeys = map[string]func(value string) error{
-	"boot.autostart":             IsBool,
-	"boot.autostart.delay":       IsInt64,
-	"boot.autostart.priority":    IsInt64,
-	"boot.stop.priority":         IsInt64,
-	"boot.host_shutdown_timeout": IsInt64,
+	"boot.autostart":                 IsBool,
+	"boot.autostart.delay":           IsInt64,
+	"boot.autostart.priority":        IsInt64,
+	"boot.cloud_init_iso":            IsBool,
+	"boot.cloud_init_network_config": IsBool,
+	"boot.diagnostics_size":          IsSize,
+	"boot.shutdown_retry_agent":      IsBool,
+	"boot.shutdown_retry_interval":   IsUint32,
+	"boot.stop.priority":             IsInt64,
+	"boot.supervised":                IsBool,
+	"boot.host_shutdown_timeout":     IsInt64,
+	"boot.in_place_reboot":           IsBool,
+	"boot.menu":                      IsBool,
+	"boot.menu.timeout": func(value string) error {
+		if value == "" {
+			return nil
+		}
+
+		// The firmware is given the timeout in milliseconds, which qemu limits to 65535.
+		timeout, err := strconv.ParseUint(value, 10, 32)
+		if err != nil || timeout > 65 {
+			return fmt.Errorf("Invalid value for an integer between 0 and 65: %s", value)
+		}
+
+		return nil
+	},
+	"boot.once": IsAny,
+	"boot.ipxe_rom": func(value string) error {
+		if value == "" {
+			return nil
+		}
+
+		if !filepath.IsAbs(value) {
+			return fmt.Errorf("Network boot ROM must be an absolute path")
+		}
+
+		return nil
+	},
+
+	"health_check.action": func(value string) error {
+		return IsOneOf(value, []string{"log", "restart"})
+	},
+	"health_check.command": func(value string) error {
+		_, err := SplitShellArgs(value)
+		return err
+	},
+	"health_check.interval": isPositiveUint32,
+	"health_check.retries":  isPositiveUint32,
 
 	"limits.cpu": func(value string) error {
 		if value == "" {
@@ -257,6 +417,31 @@ var KnownInstanceConfigKeys = map[string]func(value string) error{
 		return nil
 	},
 	"limits.cpu.priority": IsPriority,
+	"limits.cpu.max":      IsUint32,
+	"limits.cpu.model": func(value string) error {
+		if value == "" {
+			return nil
+		}
+
+		if !regexp.MustCompile(`^[A-Za-z0-9._-]+$`).MatchString(value) {
+			return fmt.Errorf("Invalid CPU model %q, must only contain letters, digits, dots, underscores and dashes", value)
+		}
+
+		return nil
+	},
+	"limits.cpu.features": func(value string) error {
+		if value == "" {
+			return nil
+		}
+
+		for _, feature := range strings.Split(value, ",") {
+			if len(feature) < 2 || (feature[0] != '+' && feature[0] != '-') {
+				return fmt.Errorf("Invalid CPU feature %q, must be of the form +feature or -feature", feature)
+			}
+		}
+
+		return nil
+	},
 
 	"limits.disk.priority": IsPriority,
 
@@ -286,12 +471,28 @@ var KnownInstanceConfigKeys = map[string]func(value string) error{
 
 		return nil
 	},
+	"limits.memory.max": IsSize,
 	"limits.memory.enforce": func(value string) error {
 		return IsOneOf(value, []string{"soft", "hard"})
 	},
+	"limits.memory.overhead": func(value string) error {
+		if value == "" {
+			return nil
+		}
+
+		_, err := units.ParseByteSizeString(value)
+		return err
+	},
 	"limits.memory.swap":          IsBool,
 	"limits.memory.swap.priority": IsPriority,
-	"limits.memory.hugepages":     IsBool,
+	"limits.memory.hugepages": func(value string) error {
+		// Either a boolean or an explicit hugepage size.
+		if IsBool(value) == nil {
+			return nil
+		}
+
+		return IsOneOf(value, HugePageSizeSuffix[:])
+	},
 
 	"limits.network.priority": IsPriority,
 
@@ -299,6 +500,8 @@ var KnownInstanceConfigKeys = map[string]func(value string) error{
 
 	"linux.kernel_modules": IsAny,
 
+	"log.guest": IsBool,
+
 	"migration.incremental.memory":            IsBool,
 	"migration.incremental.memory.iterations": IsUint32,
 	"migration.incremental.memory.goal":       IsUint32,
@@ -308,6 +511,9 @@ var KnownInstanceConfigKeys = map[string]func(value string) error{
 	"nvidia.require.cuda":        IsAny,
 	"nvidia.require.driver":      IsAny,
 
+	"placement.affinity":      isInstanceNameList,
+	"placement.anti_affinity": isInstanceNameList,
+
 	"security.nesting":       IsBool,
 	"security.privileged":    IsBool,
 	"security.devlxd":        IsBool,
@@ -321,6 +527,27 @@ var KnownInstanceConfigKeys = map[string]func(value string) error{
 	"security.idmap.size":     IsUint32,
 
 	"security.secureboot": IsBool,
+	"security.tpm":        IsBool,
+
+	"security.watchdog.action": func(value string) error {
+		return IsOneOf(value, []string{"reset", "poweroff", "none"})
+	},
+
+	"security.sandbox": IsBool,
+	"security.sandbox.allow": func(value string) error {
+		if value == "" {
+			return nil
+		}
+
+		for _, item := range strings.Split(value, ",") {
+			err := IsOneOf(strings.TrimSpace(item), []string{"obsolete", "spawn", "resourcecontrol"})
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	},
 
 	"security.syscalls.blacklist_default":       IsBool,
 	"security.syscalls.blacklist_compat":        IsBool,
@@ -333,6 +560,14 @@ var KnownInstanceConfigKeys = map[string]func(value string) error{
 	"security.syscalls.intercept.setxattr":      IsBool,
 	"security.syscalls.whitelist":               IsAny,
 
+	"smbios.family":       IsSMBIOSString,
+	"smbios.manufacturer": IsSMBIOSString,
+	"smbios.product":      IsSMBIOSString,
+	"smbios.serial":       IsSMBIOSString,
+	"smbios.sku":          IsSMBIOSString,
+	"smbios.uuid":         IsUUID,
+	"smbios.version":      IsSMBIOSString,
+
 	"snapshots.schedule": func(value string) error {
 		if value == "" {
 			return nil
@@ -361,8 +596,23 @@ var KnownInstanceConfigKeys = map[string]func(value string) error{
 	"raw.apparmor": IsAny,
 	"raw.idmap":    IsAny,
 	"raw.lxc":      IsAny,
-	"raw.qemu":     IsAny,
-	"raw.seccomp":  IsAny,
+	"raw.qemu": func(value string) error {
+		args, err := SplitShellArgs(value)
+		if err != nil {
+			return err
+		}
+
+		if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+			return fmt.Errorf("Must start with an option, got %q", args[0])
+		}
+
+		return nil
+	},
+	"raw.qemu.cmdline": isQemuConfigString,
+	"raw.qemu.debug":   IsAny,
+	"raw.qemu.initrd":  IsAbsFilePath,
+	"raw.qemu.kernel":  IsAbsFilePath,
+	"raw.seccomp":      IsAny,
 
 	"volatile.apply_template":   IsAny,
 	"volatile.base_image":       IsAny,
@@ -426,6 +676,34 @@ func ConfigKeyChecker(key string) (func(value string) error, error) {
 			return IsAny, nil
 		}
 
+		if strings.HasSuffix(key, "vm.firmware") {
+			return IsAny, nil
+		}
+
+		if strings.HasSuffix(key, "vm.cpu_pins") {
+			return IsAny, nil
+		}
+
+		if strings.HasSuffix(key, "vm.boot_time") {
+			return IsAny, nil
+		}
+
+		if strings.HasSuffix(key, "vm.vsock_id") {
+			return IsUint32, nil
+		}
+
+		if strings.HasSuffix(key, "vm.last_good_config") {
+			return isLastGoodConfig, nil
+		}
+
+		if strings.HasSuffix(key, "vm.health") {
+			return IsAny, nil
+		}
+
+		if strings.HasSuffix(key, "vm.pause_reason") {
+			return IsAny, nil
+		}
+
 		if strings.HasSuffix(key, ".ceph_rbd") {
 			return IsAny, nil
 		}
@@ -839,6 +839,68 @@ func RemoveDuplicatesFromString(s string, sep string) string {
 	return s
 }
 
+// SplitShellArgs splits a command line into arguments the way a POSIX shell would, honouring single
+// quotes, double quotes and backslash escapes, but without performing any expansion.
+func SplitShellArgs(s string) ([]string, error) {
+	args := []string{}
+	var arg strings.Builder
+	inArg := false
+	var quote rune
+
+	runes := []rune(s)
+	for i := 0; i < len(runes); i++ {
+		c := runes[i]
+
+		switch {
+		case quote == '\'':
+			if c == '\'' {
+				quote = 0
+			} else {
+				arg.WriteRune(c)
+			}
+		case c == '\\' && (quote == 0 || (i+1 < len(runes) && strings.ContainsRune("$`\"\\\n", runes[i+1]))):
+			if i+1 >= len(runes) {
+				return nil, fmt.Errorf("Trailing backslash")
+			}
+
+			// An escaped newline is a line continuation.
+			i++
+			if runes[i] != '\n' {
+				arg.WriteRune(runes[i])
+				inArg = true
+			}
+		case quote == '"':
+			if c == '"' {
+				quote = 0
+			} else {
+				arg.WriteRune(c)
+			}
+		case c == '\'' || c == '"':
+			quote = c
+			inArg = true
+		case c == ' ' || c == '\t' || c == '\n':
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteRune(c)
+			inArg = true
+		}
+	}
+
+	if quote != 0 {
+		return nil, fmt.Errorf("Unterminated %c quote", quote)
+	}
+
+	if inArg {
+		args = append(args, arg.String())
+	}
+
+	return args, nil
+}
+
 type RunError struct {
 	msg    string
 	Err    error
@@ -174,3 +174,35 @@ func TestGetSnapshotExpiry(t *testing.T) {
 	require.Error(t, err)
 	require.Equal(t, time.Time{}, expiryDate)
 }
+
+func TestSplitShellArgs(t *testing.T) {
+	tests := []struct {
+		value string
+		args  []string
+		err   string
+	}{
+		{"", []string{}, ""},
+		{"-a  -b\tc\n", []string{"-a", "-b", "c"}, ""},
+		{`-smbios "type=1,product=My VM"`, []string{"-smbios", "type=1,product=My VM"}, ""},
+		{`-name 'a "b" \c'`, []string{"-name", `a "b" \c`}, ""},
+		{`-name "a \"b\" \c"`, []string{"-name", `a "b" \c`}, ""},
+		{`-name a\ b ""`, []string{"-name", "a b", ""}, ""},
+		{`-name x"y z"'w'`, []string{"-name", "xy zw"}, ""},
+		{`-name "a`, nil, "Unterminated \" quote"},
+		{`-name 'a`, nil, "Unterminated ' quote"},
+		{`-name a\`, nil, "Trailing backslash"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.value, func(t *testing.T) {
+			args, err := SplitShellArgs(test.value)
+			if test.err != "" {
+				assert.EqualError(t, err, test.err)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, test.args, args)
+		})
+	}
+}
@@ -194,6 +194,61 @@ var APIExtensions = []string{
 	"limits_hugepages",
 	"container_nic_routed_gateway",
 	"projects_restrictions",
+	"vm_hugepages_size",
+	"vm_cpu_model",
+	"vm_watchdog",
+	"vm_gpu_passthrough",
+	"vm_usb_passthrough",
+	"vm_tpm",
+	"vm_agent_status",
+	"vm_cpu_hotplug",
+	"vm_disk_io_stats",
+	"vm_cdrom",
+	"vm_nic_model",
+	"vm_nic_multiqueue",
+	"vm_in_place_reboot",
+	"vm_pause",
+	"vm_crash_event",
+	"vm_firmware_volatile",
+	"vm_cloud_init_iso",
+	"vm_qemu_debug",
+	"device_serial",
+	"instance_file_tree",
+	"vm_export_format",
+	"vm_boot_menu",
+	"vm_sandbox_config",
+	"vm_cpu_pins",
+	"vm_limits_cpu_allowance",
+	"vm_memory_cgroup",
+	"vm_usb_hotplug",
+	"vm_live_disk_resize",
+	"vm_shm_device",
+	"vm_ipxe_rom",
+	"vm_boot_time",
+	"vm_cloud_init_network_config",
+	"vm_vsock_id",
+	"vm_supervised",
+	"vm_disk_io_modes",
+	"vm_disk_io_uring",
+	"vm_disk_mount_options",
+	"instance_qemu_config",
+	"vm_smbios",
+	"vm_health_check",
+	"vm_guest_log",
+	"vm_pause_reason",
+	"vm_boot_diagnostics",
+	"vm_shutdown_retry",
+	"vm_disk_io_bus",
+	"vm_nic_ipvlan",
+	"vm_nic_offloads",
+	"vm_direct_kernel_boot",
+	"vm_guest_os_info",
+	"instance_placement_hints",
+	"vm_config_rollback",
+	"storage_dir_qcow2",
+	"vm_memory_hotplug",
+	"instance_metrics",
+	"instance_snapshot_disk",
 }
 
 // APIExtensionsCount returns the number of available API extensions.